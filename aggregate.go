@@ -0,0 +1,106 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"math"
+)
+
+//
+// Summarize the raw values of each key in each interval of
+// resolution with fn, for all keys or those selected by opts, e.g.
+// for medians or geometric means, which rollups can't give.  Values
+// are read from the base archive, so only its retention is covered,
+// and fn is passed the values appended in one interval, in order
+// (the slice is only valid for the call).  Intervals without values
+// are missing, filled per opts.  As for Stitched, each timestamp is
+// the start of the interval its values cover.
+//
+func (t *TimeSeries) Aggregate(startTime, endTime, resolution int64, fn func(values []float64) float64,
+	opts ...QueryOptions) (map[string][]float64, []int64, error) {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	o := t.queryOptions(opts)
+	stats := collectStats(&o)
+	res := make(map[string][]float64)
+	timestamps, err := t.rawIntervals(startTime, endTime, resolution, o.Keys, func(key string, i, l int, values []float64) {
+		out := res[key]
+		if out == nil {
+			out = make([]float64, l)
+			for j := range out {
+				out[j] = math.NaN()
+			}
+			res[key] = out
+		}
+		out[i] = fn(values)
+	})
+	if timestamps == nil {
+		return nil, nil, err
+	}
+
+	limitSeries(res, o.Limit)
+	fill, value := o.Fill, o.FillValue
+	if fill == FILL_DEFAULT {
+		fill, value = FILL_CONSTANT, 0
+	}
+	for _, v := range res {
+		fillGaps(v, fill, value)
+	}
+	applyTransforms(res, o.Transforms)
+	finishStats(stats, res)
+	return res, timestamps, err
+}
+
+//
+// Read the raw values of the keys in keys from the base archive,
+// and call visit with those of each key in each interval of
+// resolution that has any, i being the interval's index of l.
+// Returns the start of each interval; nil if nothing could be read.
+//
+func (t *TimeSeries) rawIntervals(startTime, endTime, resolution int64, keys *KeyFilter,
+	visit func(key string, i, l int, values []float64)) ([]int64, error) {
+
+	base := t.baseArchive()
+	if resolution <= 0 || resolution % base.Interval != 0 {
+		return nil, fmt.Errorf("resolution %d is not a multiple of the base resolution", resolution)
+	}
+	startTime -= startTime % resolution
+	if err := t.checkQuerySize(startTime, endTime, base.Interval, keys, 8); err != nil {
+		return nil, err
+	}
+	raw, stamps, err := base.GetRollupValuesMatching(nil, nil, startTime, endTime, func(r Rollup) float64 {
+		if r.Count == 0 {
+			return math.NaN()
+		}
+		return r.Last
+	}, keys)
+
+	l := int((endTime - startTime + resolution - 1) / resolution)
+	timestamps := make([]int64, l)
+	for i := range timestamps {
+		timestamps[i] = startTime + int64(i) * resolution
+	}
+	var buf []float64
+	for k, v := range raw {
+		b := -1
+		for i, ts := range stamps {
+			if nb := int((ts - startTime) / resolution); nb != b {
+				if len(buf) > 0 {
+					visit(k, b, l, buf)
+				}
+				b, buf = nb, buf[:0]
+			}
+			if !math.IsNaN(v[i]) {
+				buf = append(buf, v[i])
+			}
+		}
+		if len(buf) > 0 {
+			visit(k, b, l, buf)
+		}
+		buf = buf[:0]
+	}
+	return timestamps, err
+}
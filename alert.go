@@ -0,0 +1,357 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// Alert rules are checked as data is added: against each value
+// appended at the base resolution, or each rollup as it's completed
+// in a coarser archive.  A rule's condition compares a key's value
+// with a threshold, and may need to hold for a while before the
+// rule fires for that key; it resolves when the condition next
+// fails.  Absence rules instead fire when a key gets no data for a
+// while, and resolve when it gets some.  Rules live in memory only,
+// so they must be added again after OpenTimeSeries.
+//
+
+type AlertState int
+
+const (
+	ALERT_FIRING AlertState = iota
+	ALERT_RESOLVED
+)
+
+// Sent when a rule fires or resolves for a key.  Value is the value
+// that made it change, at Timestamp; NaN when an absence rule fires.
+type AlertEvent struct {
+	Rule      string
+	Key       string
+	State     AlertState
+	Value     float64
+	Timestamp int64
+}
+
+// A rule for AddAlertRule.  Name identifies the rule.  Keys selects
+// the keys it applies to (all if nil).  Condition is a comparison
+// and threshold, optionally with how long it must hold, as a Go
+// duration: "> 0.9", ">= 100 for 5m".  The comparisons are >, >=,
+// <, <=, == and !=.  Resolution picks the archive whose values are
+// checked, reduced by its aggregation; 0 means the base archive.
+//
+// A Condition of "absent for <duration>" makes an absence rule,
+// which fires for a key once the base archive's latest data
+// (its EndTime) is that far past the key's latest value, and
+// ignores Resolution.  Keys are tracked from their value in the
+// latest data when the rule is added, or from their next value.
+// Absence is checked as data is added, and by CheckAlerts, for
+// when none is.
+//
+// Events go to Notify, if set, and are sent on Events, if set,
+// without blocking: they're dropped if the channel is full.  Both
+// are called from AddValue(s).
+type AlertRule struct {
+	Name       string
+	Keys       *KeyFilter
+	Condition  string
+	Resolution int64
+	Notify     func(AlertEvent)
+	Events     chan<- AlertEvent
+}
+
+type alertKeyState struct {
+	// whether the condition holds, and since when
+	holding bool
+	since   int64
+	firing  bool
+	// the key's latest timestamp, for absence rules
+	last    int64
+}
+
+type alertRule struct {
+	AlertRule
+	archive   int
+	// nil for absence rules
+	compare   func(v float64) bool
+	duration  int64
+	keys      map[string]*alertKeyState
+}
+
+var alertComparisons = []struct {
+	op  string
+	cmp func(v, threshold float64) bool
+}{
+	// two-character operators first
+	{ ">=", func(v, th float64) bool { return v >= th } },
+	{ "<=", func(v, th float64) bool { return v <= th } },
+	{ "==", func(v, th float64) bool { return v == th } },
+	{ "!=", func(v, th float64) bool { return v != th } },
+	{ ">", func(v, th float64) bool { return v > th } },
+	{ "<", func(v, th float64) bool { return v < th } },
+}
+
+//
+// Parse an alert condition into a comparison and the number of
+// seconds it must hold; the comparison is nil for an absence rule.
+//
+func parseCondition(cond string) (func(float64) bool, int64, error) {
+	cond = strings.TrimSpace(cond)
+	if fields := strings.Fields(cond); len(fields) > 0 && fields[0] == "absent" {
+		if len(fields) == 3 && fields[1] == "for" {
+			d, err := time.ParseDuration(fields[2])
+			if err == nil && d >= time.Second {
+				return nil, int64(d / time.Second), nil
+			}
+		}
+		return nil, 0, fmt.Errorf("invalid alert condition %q", cond)
+	}
+	for _, c := range alertComparisons {
+		if !strings.HasPrefix(cond, c.op) {
+			continue
+		}
+		fields := strings.Fields(cond[len(c.op):])
+		if len(fields) != 1 && (len(fields) != 3 || fields[1] != "for") {
+			break
+		}
+		threshold, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			break
+		}
+		var secs int64
+		if len(fields) == 3 {
+			d, err := time.ParseDuration(fields[2])
+			if err != nil || d < 0 {
+				break
+			}
+			secs = int64(d / time.Second)
+		}
+		cmp := c.cmp
+		return func(v float64) bool { return cmp(v, threshold) }, secs, nil
+	}
+	return nil, 0, fmt.Errorf("invalid alert condition %q", cond)
+}
+
+//
+// Add an alert rule, replacing any with the same name.  Fails if the
+// condition can't be parsed or there's no archive at the rule's
+// resolution.
+//
+func (t *TimeSeries) AddAlertRule(rule AlertRule) error {
+	if rule.Name == "" {
+		return fmt.Errorf("alert rule has no name")
+	}
+	cmp, secs, err := parseCondition(rule.Condition)
+	if err != nil {
+		return err
+	}
+	ar := &alertRule{
+		AlertRule: rule,
+		archive: -1,
+		compare: cmp,
+		duration: secs,
+		keys: make(map[string]*alertKeyState),
+	}
+	if rule.Resolution == 0 || cmp == nil {
+		ar.archive = 0
+	}
+	for i, a := range t.archives {
+		if a.Interval == rule.Resolution && cmp != nil {
+			ar.archive = i
+		}
+	}
+	if ar.archive < 0 {
+		return fmt.Errorf("no archive with resolution %d", rule.Resolution)
+	}
+	if cmp == nil {
+		t.mu.RLock()
+		latest, ts := t.baseArchive().LatestFloats()
+		t.mu.RUnlock()
+		for k := range latest {
+			if rule.Keys.Has(k) {
+				ar.keys[k] = &alertKeyState{ last: ts }
+			}
+		}
+	}
+
+	t.alertsMu.Lock()
+	defer t.alertsMu.Unlock()
+	t.removeAlertRule(rule.Name)
+	t.alerts = append(t.alerts, ar)
+	return nil
+}
+
+//
+// Remove the alert rule with the given name, if any.
+//
+func (t *TimeSeries) RemoveAlertRule(name string) {
+	t.alertsMu.Lock()
+	defer t.alertsMu.Unlock()
+	t.removeAlertRule(name)
+}
+
+func (t *TimeSeries) removeAlertRule(name string) {
+	for i, ar := range t.alerts {
+		if ar.Name == name {
+			t.alerts = append(t.alerts[:i], t.alerts[i + 1:]...)
+			return
+		}
+	}
+}
+
+//
+// Whether any alert rule checks the archive at index i.
+//
+func (t *TimeSeries) alertsOn(i int) bool {
+	t.alertsMu.Lock()
+	defer t.alertsMu.Unlock()
+	for _, ar := range t.alerts {
+		if ar.archive == i {
+			return true
+		}
+	}
+	return false
+}
+
+// Alert events waiting to be sent, with the rules that raised them.
+type alertBatch struct {
+	events []AlertEvent
+	rules  []*alertRule
+}
+
+func (b *alertBatch) send() {
+	for j, ev := range b.events {
+		notify(b.rules[j].AlertRule, ev)
+	}
+}
+
+//
+// Check the rules on the archive at index i against vals, the values
+// it got at timestamp, adding any events to b.
+//
+func (t *TimeSeries) checkAlerts(i int, vals map[string]float64, timestamp int64, b *alertBatch) {
+	events, rules := b.events, b.rules
+
+	t.alertsMu.Lock()
+	for _, ar := range t.alerts {
+		if ar.archive != i {
+			continue
+		}
+		for k, v := range vals {
+			if !ar.Keys.Has(k) {
+				continue
+			}
+			ks := ar.keys[k]
+			if ks == nil {
+				ks = &alertKeyState{}
+				ar.keys[k] = ks
+			}
+			if ar.compare == nil {
+				ks.last = timestamp
+				if ks.firing {
+					ks.firing = false
+					events = append(events, AlertEvent{ ar.Name, k, ALERT_RESOLVED, v, timestamp })
+					rules = append(rules, ar)
+				}
+				continue
+			}
+			if !ar.compare(v) {
+				ks.holding = false
+				if ks.firing {
+					ks.firing = false
+					events = append(events, AlertEvent{ ar.Name, k, ALERT_RESOLVED, v, timestamp })
+					rules = append(rules, ar)
+				}
+				continue
+			}
+			if !ks.holding {
+				ks.holding, ks.since = true, timestamp
+			}
+			if !ks.firing && timestamp - ks.since >= ar.duration {
+				ks.firing = true
+				events = append(events, AlertEvent{ ar.Name, k, ALERT_FIRING, v, timestamp })
+				rules = append(rules, ar)
+			}
+		}
+		if ar.compare == nil {
+			events, rules = ar.checkAbsent(timestamp, events, rules)
+		}
+	}
+	t.alertsMu.Unlock()
+	b.events, b.rules = events, rules
+}
+
+//
+// Fire the absence rule for keys with no value in the duration
+// before timestamp, appending to events and rules.
+//
+func (ar *alertRule) checkAbsent(timestamp int64, events []AlertEvent, rules []*alertRule) ([]AlertEvent, []*alertRule) {
+	for k, ks := range ar.keys {
+		if !ks.firing && timestamp - ks.last >= ar.duration {
+			ks.firing = true
+			events = append(events, AlertEvent{ ar.Name, k, ALERT_FIRING, math.NaN(), timestamp })
+			rules = append(rules, ar)
+		}
+	}
+	return events, rules
+}
+
+//
+// Check absence rules as of timestamp (a Unix time, usually now),
+// for when no data is being added at all.  The base archive's
+// EndTime is used if it's later.
+//
+func (t *TimeSeries) CheckAlerts(timestamp int64) {
+	t.mu.RLock()
+	end := t.baseArchive().EndTime
+	t.mu.RUnlock()
+	if end > timestamp {
+		timestamp = end
+	}
+	var b alertBatch
+	t.alertsMu.Lock()
+	for _, ar := range t.alerts {
+		if ar.compare == nil {
+			b.events, b.rules = ar.checkAbsent(timestamp, b.events, b.rules)
+		}
+	}
+	t.alertsMu.Unlock()
+	b.send()
+}
+
+func notify(rule AlertRule, ev AlertEvent) {
+	if rule.Notify != nil {
+		rule.Notify(ev)
+	}
+	if rule.Events != nil {
+		select {
+		case rule.Events <- ev:
+		default:
+		}
+	}
+}
+
+//
+// Check the rules on the rollup archive at index i against the
+// rollups it just got at timestamp.
+//
+func (t *TimeSeries) checkRollupAlerts(i int, timestamp int64, b *alertBatch) {
+	a := t.archives[i]
+	rollups, _, err := a.GetRollups(timestamp, timestamp + a.Interval)
+	if err != nil {
+		return
+	}
+	vals := make(map[string]float64, len(rollups))
+	for k, r := range rollups {
+		if len(r) > 0 && r[0].Count > 0 {
+			vals[k] = t.aggregators[i](r[0])
+		}
+	}
+	t.checkAlerts(i, vals, timestamp, b)
+}
@@ -0,0 +1,336 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"sort"
+)
+
+//
+// Results can be written in the Apache Arrow IPC streaming format,
+// which pyarrow, pandas, Polars, DuckDB and the other Arrow readers
+// load without parsing: a schema, record batches of up to
+// arrowBatchRows rows, and the end-of-stream marker.  The first
+// column is "timestamp", a non-null Timestamp in seconds; each key is
+// a nullable Float64 column, null where the Result is missing a
+// value.  Metadata is encoded with the few flatbuffer constructs the
+// format needs, below, so no Arrow library is required.
+//
+
+const arrowBatchRows = 1 << 16
+
+// Constants from the Arrow flatbuffer schemas.
+const (
+	arrowMetadataV5        = 4
+	arrowHeaderSchema      = 1
+	arrowHeaderRecordBatch = 3
+	arrowTypeFloatingPoint = 3
+	arrowTypeTimestamp     = 10
+	arrowPrecisionDouble   = 2
+	arrowUnitSecond        = 0
+)
+
+//
+// Write the result to w as an Arrow IPC stream, with a column for
+// each key, sorted.
+//
+func (r *Result) WriteArrow(w io.Writer) error {
+	keys := r.Keys()
+	if err := writeArrowMessage(w, arrowSchema(keys), nil); err != nil {
+		return err
+	}
+	for start := 0; start < len(r.Timestamps); start += arrowBatchRows {
+		end := start + arrowBatchRows
+		if end > len(r.Timestamps) {
+			end = len(r.Timestamps)
+		}
+		meta, body := r.arrowBatch(keys, start, end)
+		if err := writeArrowMessage(w, meta, body); err != nil {
+			return err
+		}
+	}
+	// end of stream
+	_, err := w.Write([]byte{ 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0 })
+	return err
+}
+
+//
+// Query the series, as Query does, writing the result to w as an
+// Arrow IPC stream.
+//
+func (t *TimeSeries) QueryArrow(w io.Writer, startTime, endTime, resolution int64, agg Aggregation,
+	opts ...QueryOptions) error {
+
+	res, err := t.Query(startTime, endTime, resolution, agg, opts...)
+	if err != nil {
+		return err
+	}
+	return res.WriteArrow(w)
+}
+
+//
+// Write an encapsulated message: the continuation marker, the
+// metadata's length and the metadata, padded to 8 bytes, then the
+// body.
+//
+func writeArrowMessage(w io.Writer, meta, body []byte) error {
+	for len(meta) % 8 != 0 {
+		meta = append(meta, 0)
+	}
+	var prefix [8]byte
+	binary.LittleEndian.PutUint32(prefix[:], 0xffffffff)
+	binary.LittleEndian.PutUint32(prefix[4:], uint32(len(meta)))
+	for _, b := range [][]byte{ prefix[:], meta, body } {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func arrowMessage(headerType byte, header fbRef, bodyLength int64) []byte {
+	return fbFinish(fbTable(
+		fbInt16(0, arrowMetadataV5),
+		fbUint8(1, headerType),
+		fbRefField(2, header),
+		fbInt64(3, bodyLength),
+	))
+}
+
+func arrowSchema(keys []string) []byte {
+	fields := []fbRef{ arrowField("timestamp", false, arrowTypeTimestamp, fbTable(fbInt16(0, arrowUnitSecond))) }
+	for _, k := range keys {
+		fields = append(fields, arrowField(k, true, arrowTypeFloatingPoint, fbTable(fbInt16(0, arrowPrecisionDouble))))
+	}
+	// little-endian
+	schema := fbTable(fbInt16(0, 0), fbRefField(1, fbVector(fields)))
+	return arrowMessage(arrowHeaderSchema, schema, 0)
+}
+
+func arrowField(name string, nullable bool, typ byte, typeTable fbRef) fbRef {
+	n := byte(0)
+	if nullable {
+		n = 1
+	}
+	return fbTable(
+		fbRefField(0, fbString(name)),
+		fbUint8(1, n),
+		fbUint8(2, typ),
+		fbRefField(3, typeTable),
+		fbRefField(5, fbVector(nil)),
+	)
+}
+
+//
+// The metadata and body of a record batch of rows [start, end).
+//
+func (r *Result) arrowBatch(keys []string, start, end int) ([]byte, []byte) {
+	n := end - start
+	var body []byte
+	// FieldNodes and Buffers, as pairs of longs
+	var nodes, buffers []int64
+	addBuffer := func(b []byte) {
+		buffers = append(buffers, int64(len(body)), int64(len(b)))
+		body = append(body, b...)
+		for len(body) % 8 != 0 {
+			body = append(body, 0)
+		}
+	}
+
+	data := make([]byte, 8 * n)
+	for i, ts := range r.Timestamps[start:end] {
+		binary.LittleEndian.PutUint64(data[8 * i:], uint64(ts))
+	}
+	nodes = append(nodes, int64(n), 0)
+	addBuffer(nil)
+	addBuffer(data)
+
+	for _, k := range keys {
+		vals, missing := r.Values[k], r.Missing[k]
+		valid := make([]byte, (n + 7) / 8)
+		nulls := 0
+		for i := 0; i < n; i++ {
+			j := start + i
+			if j < len(vals) && !(j < len(missing) && missing[j]) {
+				valid[i / 8] |= 1 << uint(i % 8)
+				binary.LittleEndian.PutUint64(data[8 * i:], math.Float64bits(vals[j]))
+			} else {
+				nulls++
+				binary.LittleEndian.PutUint64(data[8 * i:], 0)
+			}
+		}
+		nodes = append(nodes, int64(n), int64(nulls))
+		if nulls == 0 {
+			valid = nil
+		}
+		addBuffer(valid)
+		addBuffer(data)
+	}
+
+	batch := fbTable(
+		fbInt64(0, int64(n)),
+		fbRefField(1, fbStructs(nodes)),
+		fbRefField(2, fbStructs(buffers)),
+	)
+	return arrowMessage(arrowHeaderRecordBatch, batch, int64(len(body))), body
+}
+
+//
+// A minimal flatbuffer encoder.  Unlike the flatbuffers library,
+// which builds buffers back to front, it writes each object before
+// the objects it refers to, patching references as they're written;
+// references only ever point forward, as flatbuffers requires.
+//
+
+type fbBuilder struct {
+	buf []byte
+}
+
+// Writes an object, returning its position.
+type fbRef func(b *fbBuilder) int
+
+// A table field: inline scalar bytes, or a reference.
+type fbField struct {
+	slot   int
+	scalar []byte
+	ref    fbRef
+}
+
+func (f fbField) size() int {
+	if f.ref != nil {
+		return 4
+	}
+	return len(f.scalar)
+}
+
+func fbUint8(slot int, v byte) fbField {
+	return fbField{ slot: slot, scalar: []byte{ v } }
+}
+
+func fbInt16(slot int, v int16) fbField {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, uint16(v))
+	return fbField{ slot: slot, scalar: b }
+}
+
+func fbInt64(slot int, v int64) fbField {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(v))
+	return fbField{ slot: slot, scalar: b }
+}
+
+func fbRefField(slot int, ref fbRef) fbField {
+	return fbField{ slot: slot, ref: ref }
+}
+
+func (b *fbBuilder) align(n int) {
+	for len(b.buf) % n != 0 {
+		b.buf = append(b.buf, 0)
+	}
+}
+
+func (b *fbBuilder) grow(n int) int {
+	pos := len(b.buf)
+	b.buf = append(b.buf, make([]byte, n)...)
+	return pos
+}
+
+// Point the reference at pos to target.
+func (b *fbBuilder) patch(pos, target int) {
+	binary.LittleEndian.PutUint32(b.buf[pos:], uint32(target - pos))
+}
+
+//
+// A table of fields: its vtable, then the table, with scalars
+// aligned to their size, largest first.
+//
+func fbTable(fields ...fbField) fbRef {
+	return func(b *fbBuilder) int {
+		sorted := append([]fbField(nil), fields...)
+		sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].size() > sorted[j].size() })
+		offsets := make(map[int]int)
+		off, slots := 4, 0
+		for _, f := range sorted {
+			n := f.size()
+			off = (off + n - 1) / n * n
+			offsets[f.slot] = off
+			off += n
+			if f.slot >= slots {
+				slots = f.slot + 1
+			}
+		}
+		size := (off + 3) / 4 * 4
+
+		b.align(2)
+		vtable := b.grow(4 + 2 * slots)
+		binary.LittleEndian.PutUint16(b.buf[vtable:], uint16(4 + 2 * slots))
+		binary.LittleEndian.PutUint16(b.buf[vtable + 2:], uint16(size))
+		for s := 0; s < slots; s++ {
+			binary.LittleEndian.PutUint16(b.buf[vtable + 4 + 2 * s:], uint16(offsets[s]))
+		}
+		b.align(8)
+		pos := b.grow(size)
+		binary.LittleEndian.PutUint32(b.buf[pos:], uint32(int32(pos - vtable)))
+		for _, f := range fields {
+			if f.ref == nil {
+				copy(b.buf[pos + offsets[f.slot]:], f.scalar)
+			}
+		}
+		for _, f := range fields {
+			if f.ref != nil {
+				b.patch(pos + offsets[f.slot], f.ref(b))
+			}
+		}
+		return pos
+	}
+}
+
+// A vector of references, to tables or strings.
+func fbVector(elems []fbRef) fbRef {
+	return func(b *fbBuilder) int {
+		b.align(4)
+		pos := b.grow(4 + 4 * len(elems))
+		binary.LittleEndian.PutUint32(b.buf[pos:], uint32(len(elems)))
+		for i, e := range elems {
+			b.patch(pos + 4 + 4 * i, e(b))
+		}
+		return pos
+	}
+}
+
+// A vector of structs of two longs, given flattened.
+func fbStructs(longs []int64) fbRef {
+	return func(b *fbBuilder) int {
+		// the elements, after the count, are 8-aligned
+		for (len(b.buf) + 4) % 8 != 0 {
+			b.buf = append(b.buf, 0)
+		}
+		pos := b.grow(4 + 8 * len(longs))
+		binary.LittleEndian.PutUint32(b.buf[pos:], uint32(len(longs) / 2))
+		for i, v := range longs {
+			binary.LittleEndian.PutUint64(b.buf[pos + 4 + 8 * i:], uint64(v))
+		}
+		return pos
+	}
+}
+
+func fbString(s string) fbRef {
+	return func(b *fbBuilder) int {
+		b.align(4)
+		pos := b.grow(4 + len(s) + 1)
+		binary.LittleEndian.PutUint32(b.buf[pos:], uint32(len(s)))
+		copy(b.buf[pos + 4:], s)
+		return pos
+	}
+}
+
+// A buffer whose root is the given table.
+func fbFinish(root fbRef) []byte {
+	b := &fbBuilder{ buf: make([]byte, 4, 256) }
+	b.patch(0, root(b))
+	return b.buf
+}
@@ -0,0 +1,406 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fred-lewis/tissa/internal"
+)
+
+// The manifest every backup holds, written last.
+const backupManifestFile = "backup"
+
+type backupFile struct {
+	Size    int64
+	ModTime int64
+}
+
+//
+// What a backup holds: when it was taken, the series' newest data
+// then, and the size and modification time each file had in the
+// series, by its path in the directory.
+//
+type backupManifest struct {
+	Time   int64
+	Newest int64
+	Files  map[string]backupFile
+}
+
+//
+// What Backup did: the number of files copied and their bytes, and
+// the number linked from the base backup.
+//
+type BackupStats struct {
+	Copied      int
+	CopiedBytes int64
+	Linked      int
+}
+
+//
+// Back the series up to dir, which must not exist, after writing
+// it, unless it's a replica.  The backup is a copy of the series'
+// directory, which OpenTimeSeries can open, and a manifest of its
+// files.
+//
+// If base is set, it names an earlier backup of the series, and
+// files that haven't changed since it was taken (chunks are never
+// modified in place, so this is most of them) are hard-linked from
+// it rather than copied, or copied from it if they can't be linked.
+// Each backup is still complete, so older ones can be deleted
+// without harming newer ones, and nightly backups of large archives
+// cost little more than the chunks written that day.  Since backups
+// may share files, they shouldn't be opened and appended to.
+//
+// Appends wait while the files are copied, and queries carry on.
+//
+func (t *TimeSeries) Backup(dir, base string) (BackupStats, error) {
+	var stats BackupStats
+	if t.InMemory() {
+		return stats, fmt.Errorf("in-memory series can't be backed up")
+	}
+	var prev *backupManifest
+	if base != "" {
+		prev = &backupManifest{}
+		if err := internal.ReadObject(filepath.Join(base, backupManifestFile), prev); err != nil {
+			return stats, fmt.Errorf("%s isn't a backup: %w", base, err)
+		}
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return stats, fmt.Errorf("%s already exists", dir)
+	}
+	if !t.readOnly {
+		if err := t.Write(); err != nil {
+			return stats, err
+		}
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, newest := t.baseArchive().TimeRange()
+	manifest := backupManifest{ Time: time.Now().Unix(), Newest: newest, Files: make(map[string]backupFile) }
+	err := filepath.WalkDir(t.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(t.dir, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(dir, rel), 0700)
+		}
+		if !d.Type().IsRegular() || skipBackup(rel) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		f := backupFile{ Size: info.Size(), ModTime: info.ModTime().UnixNano() }
+		manifest.Files[rel] = f
+		dst := filepath.Join(dir, rel)
+
+		if prev != nil && prev.Files[rel] == f {
+			src := filepath.Join(base, rel)
+			if os.Link(src, dst) == nil {
+				stats.Linked++
+				return nil
+			}
+			if n, err := copyFile(src, dst); err == nil {
+				stats.Copied++
+				stats.CopiedBytes += n
+				return nil
+			}
+		}
+		n, err := copyFile(path, dst)
+		if err != nil {
+			return err
+		}
+		stats.Copied++
+		stats.CopiedBytes += n
+		return nil
+	})
+	if err == nil {
+		fp := filepath.Join(dir, backupManifestFile)
+		err = internal.WriteObject(fp, manifest)
+		if err == nil {
+			err = internal.SyncFile(fp)
+		}
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return BackupStats{}, err
+	}
+	return stats, nil
+}
+
+//
+// Files left behind by interrupted writes, the previous versions of
+// files kept in case a write is torn, and the lock, aren't backed up.
+//
+func skipBackup(rel string) bool {
+	return rel == backupManifestFile || rel == lockFile || strings.HasSuffix(rel, ".tmp") || strings.HasSuffix(rel, ".prev")
+}
+
+//
+// Copy the file at src to dst, flushed to stable storage.  Returns
+// the number of bytes copied.
+//
+func copyFile(src, dst string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+//
+// Restore the series backed up to snapshotDir into destDir, which
+// must not exist, and open it.  snapshotDir is a backup made by
+// Backup, whose files are checked against its manifest, or a copy of
+// a series' directory taken some other way, such as a filesystem
+// snapshot.  The files are copied, so the backup is left as it was.
+//
+func RestoreTimeSeries(snapshotDir, destDir string) (*TimeSeries, error) {
+	if _, err := os.Stat(destDir); err == nil {
+		return nil, fmt.Errorf("%s already exists", destDir)
+	}
+	manifest := &backupManifest{}
+	err := internal.ReadObject(filepath.Join(snapshotDir, backupManifestFile), manifest)
+	if errors.Is(err, os.ErrNotExist) {
+		manifest, err = snapshotManifest(snapshotDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var t *TimeSeries
+	err = restoreFiles(snapshotDir, destDir, manifest)
+	if err == nil {
+		t, err = OpenTimeSeries(destDir)
+	}
+	if err != nil {
+		os.RemoveAll(destDir)
+		return nil, err
+	}
+	return t, nil
+}
+
+//
+// A manifest of the files in a series' directory, for one that
+// wasn't made by Backup.  The previous versions of files are kept,
+// in case the live ones were torn.
+//
+func snapshotManifest(dir string) (*backupManifest, error) {
+	manifest := &backupManifest{ Files: make(map[string]backupFile) }
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() || strings.HasSuffix(path, ".tmp") {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		manifest.Files[rel] = backupFile{ Size: info.Size(), ModTime: info.ModTime().UnixNano() }
+		return err
+	})
+	return manifest, err
+}
+
+func restoreFiles(snapshotDir, destDir string, manifest *backupManifest) error {
+	if err := os.MkdirAll(destDir, 0700); err != nil {
+		return err
+	}
+	for rel, f := range manifest.Files {
+		dst := filepath.Join(destDir, rel)
+		if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			return err
+		}
+		n, err := copyFile(filepath.Join(snapshotDir, rel), dst)
+		if err != nil {
+			return err
+		}
+		if n != f.Size {
+			return fmt.Errorf("%s is %d bytes, not the %d backed up: %w", rel, n, f.Size, ErrCorruptChunk)
+		}
+	}
+	return nil
+}
+
+//
+// Restore the series backed up to snapshotDir into destDir, as
+// RestoreTimeSeries does, but only its data from before until, as if
+// it had been backed up then.  The series is rebuilt rather than
+// copied: each archive holds the values, or the rollups of
+// intervals ending by until, that snapshotDir's held, and the
+// rollup of the interval until falls in is made again from the
+// finer archives when the series is next appended to, as it would
+// have been had nothing after until been appended.
+//
+// Counters carry on from their latest value before until, as though
+// they weren't reset after it.  The change log, if the series keeps
+// one, starts afresh, and the quantile sketches and unique counts
+// kept by Percentiles and Uniques archives aren't restored.
+//
+func RestoreTimeSeriesUntil(snapshotDir, destDir string, until int64) (*TimeSeries, error) {
+	if _, err := os.Stat(destDir); err == nil {
+		return nil, fmt.Errorf("%s already exists", destDir)
+	}
+	var config TimeSeriesConfig
+	if err := internal.ReadObject(filepath.Join(snapshotDir, "config"), &config); err != nil {
+		return nil, err
+	}
+	snapshot := config
+	snapshot.Archives = append([]ArchiveConfig(nil), config.Archives...)
+	// the restored series' chunks mustn't overwrite the snapshot's
+	config.StorePrefix = ""
+	t, err := NewTimeSeries(destDir, config)
+	if err == nil {
+		err = t.restoreUntil(snapshotDir, snapshot, until)
+	}
+	if err != nil {
+		os.RemoveAll(destDir)
+		return nil, err
+	}
+	return t, nil
+}
+
+//
+// Fill a new series with the data the series in dir, configured as
+// config, held from before until.  The snapshot's files are only
+// read; opening it as a TimeSeries could write to them.
+//
+func (t *TimeSeries) restoreUntil(dir string, config TimeSeriesConfig, until int64) error {
+	codec, err := lookupCodec(t.config.Codec)
+	if err != nil {
+		return err
+	}
+	restored := make(map[string]bool)
+	for i, a := range t.archives {
+		src, err := openArchive(dir, config, config.Archives[i], codec)
+		if err != nil {
+			return err
+		}
+		if err = restoreArchive(a, src, i == 0, until, restored); err != nil {
+			return fmt.Errorf("archive %d: %w", a.Interval, err)
+		}
+	}
+
+	metrics, err := readMetrics(dir)
+	if err != nil {
+		return err
+	}
+	for k, m := range metrics {
+		if m.Type != METRIC_COUNTER {
+			continue
+		}
+		state := &metricState{ Type: METRIC_COUNTER }
+		if vals, _, err := t.baseArchive().LatestN(k, 1); err == nil && len(vals) == 1 {
+			state.Raw, state.Seen, state.Offset = vals[0] - m.Offset, true, m.Offset
+		}
+		t.metrics[k] = state
+	}
+	t.metricsDirty = len(t.metrics) > 0
+
+	labels, err := readLabels(dir)
+	if err != nil {
+		return err
+	}
+	for k := range labels.known {
+		if restored[k] {
+			name, l, err := ParseSeriesKey(k)
+			if err != nil {
+				return err
+			}
+			t.labels.add(k, name, l)
+		}
+	}
+	if t.recording, err = readRecordingRules(dir); err != nil {
+		return err
+	}
+	if len(t.recording) > 0 {
+		if err = t.writeRecordingRules(); err != nil {
+			return err
+		}
+	}
+	return t.Write()
+}
+
+//
+// Append src's data from before until to the empty archive dst, a
+// chunk at a time, noting the keys appended in restored.  Rollups
+// are stamped with the end of their interval, so those stamped until
+// are kept.
+//
+func restoreArchive(dst, src *internal.Archive, base bool, until int64, restored map[string]bool) error {
+	start, end := src.TimeRange()
+	if end == 0 {
+		return nil
+	}
+	limit := until
+	if !base {
+		limit++
+	}
+	stop := end + src.Interval
+	if limit < stop {
+		stop = limit
+	}
+	for cs := start - start % src.ChunkSize; cs < stop; cs += src.ChunkSize {
+		ce := cs + src.ChunkSize
+		if ce > stop {
+			ce = stop
+		}
+		data, stamps, err := src.GetData(cs, ce)
+		if err != nil {
+			return err
+		}
+		for i, ts := range stamps {
+			floats := make(map[string]float64)
+			rollups := make(map[string]Rollup)
+			for k, vals := range data {
+				if i >= len(vals) {
+					continue
+				}
+				switch v := vals[i].(type) {
+				case float64:
+					floats[k] = v
+				case Rollup:
+					rollups[k] = v
+				default:
+					continue
+				}
+				restored[k] = true
+			}
+			if base && len(floats) > 0 {
+				dst.AppendFloats(floats, ts)
+			} else if !base && len(rollups) > 0 {
+				dst.AppendRollups(rollups, ts)
+			}
+		}
+	}
+	return nil
+}
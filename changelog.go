@@ -0,0 +1,377 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fred-lewis/tissa/internal"
+)
+
+// Returned (wrapped) by ChangeLog.Read for an offset that's been
+// truncated away.
+var ErrTruncated = errors.New("change log truncated")
+
+// One AddValues call, as the values and timestamp it was given.
+type Change struct {
+	Offset    int64
+	Timestamp int64
+	Values    map[string]float64
+}
+
+//
+// A ChangeLog records every AddValues call the series accepts, in
+// order, so other systems can tail what's written to a series and
+// pick up where they left off after a restart.  Appends dropped as
+// older than the latest data aren't recorded.  Each call gets the
+// next offset, from 0.
+// The log is kept in segment files in the series' "changelog"
+// directory, named for the first offset they hold, each record being
+// its length and CRC-32 followed by the msgpack-encoded Change.
+// Like the archives, it's written out by Write(), and synced
+// according to the series' Durability.
+//
+type ChangeLog struct {
+	dir      string
+	mu       sync.Mutex
+	// the first offset in each segment, ascending
+	segments []int64
+	file     *os.File
+	w        *bufio.Writer
+	// the size of the latest segment, including what's buffered
+	size     int64
+	next     int64
+}
+
+const (
+	changeLogDir = "changelog"
+	consumersDir = "consumers"
+	// the largest record read back, to catch corrupt lengths
+	maxChangeSize = 1 << 28
+)
+
+// Segments are started afresh once they reach this size.
+var changeLogSegmentSize int64 = 64 << 20
+
+func segmentName(first int64) string {
+	return fmt.Sprintf("%020d.log", first)
+}
+
+func openChangeLog(dir string) (*ChangeLog, error) {
+	if err := os.MkdirAll(filepath.Join(dir, consumersDir), 0700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	l := &ChangeLog{ dir: dir }
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".log") {
+			continue
+		}
+		first, err := strconv.ParseInt(strings.TrimSuffix(e.Name(), ".log"), 10, 64)
+		if err == nil {
+			l.segments = append(l.segments, first)
+		}
+	}
+	sort.Slice(l.segments, func(i, j int) bool { return l.segments[i] < l.segments[j] })
+	if len(l.segments) == 0 {
+		return l, l.startSegment(0)
+	}
+
+	// find the end of the latest segment, cutting off any record left
+	// half-written
+	first := l.segments[len(l.segments) - 1]
+	fp := filepath.Join(dir, segmentName(first))
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	l.next = first
+	r := bufio.NewReader(f)
+	for {
+		c, n, err := readChange(r)
+		if err != nil {
+			break
+		}
+		l.size += n
+		l.next = c.Offset + 1
+	}
+	f.Close()
+	if err = os.Truncate(fp, l.size); err != nil {
+		return nil, err
+	}
+	l.file, err = os.OpenFile(fp, os.O_WRONLY | os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l.w = bufio.NewWriter(l.file)
+	return l, nil
+}
+
+func (l *ChangeLog) startSegment(first int64) error {
+	f, err := os.OpenFile(filepath.Join(l.dir, segmentName(first)), os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	l.file, l.w, l.size = f, bufio.NewWriter(f), 0
+	if n := len(l.segments); n == 0 || l.segments[n - 1] != first {
+		l.segments = append(l.segments, first)
+	}
+	return nil
+}
+
+//
+// Read one record, returning it and its size on disk.
+//
+func readChange(r io.Reader) (Change, int64, error) {
+	var c Change
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return c, 0, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:4])
+	if n > maxChangeSize {
+		return c, 0, fmt.Errorf("change of %d bytes: %w", n, ErrCorruptChunk)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return c, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(hdr[4:]) {
+		return c, 0, fmt.Errorf("change failed its checksum: %w", ErrCorruptChunk)
+	}
+	err := internal.Msgpack.Decode(bytes.NewReader(payload), &c)
+	return c, int64(len(hdr)) + int64(n), err
+}
+
+//
+// Record an AddValues call.
+//
+func (l *ChangeLog) append(vals map[string]float64, timestamp int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size >= changeLogSegmentSize {
+		if err := l.w.Flush(); err != nil {
+			return err
+		}
+		l.file.Close()
+		if err := l.startSegment(l.next); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 8))
+	err := internal.Msgpack.Encode(&buf, Change{ Offset: l.next, Timestamp: timestamp, Values: vals })
+	if err != nil {
+		return err
+	}
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b) - 8))
+	binary.BigEndian.PutUint32(b[4:], crc32.ChecksumIEEE(b[8:]))
+	if _, err = l.w.Write(b); err != nil {
+		return err
+	}
+	l.size += int64(len(b))
+	l.next++
+	return nil
+}
+
+//
+// Write out the buffered records, and fsync them if sync is set.
+//
+func (l *ChangeLog) flush(sync bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	if sync {
+		return l.file.Sync()
+	}
+	return nil
+}
+
+//
+// Close the latest segment.  Records are written out first by the
+// series' final Write.
+//
+func (l *ChangeLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+//
+// The offset the next accepted AddValues call will get.
+//
+func (l *ChangeLog) NextOffset() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.next
+}
+
+//
+// The oldest offset still held.
+//
+func (l *ChangeLog) FirstOffset() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.segments[0]
+}
+
+//
+// Up to max changes (all if max is 0), from offset on.  Reading
+// at NextOffset returns none; reading before FirstOffset fails with
+// ErrTruncated.
+//
+func (l *ChangeLog) Read(offset int64, max int) ([]Change, error) {
+	l.mu.Lock()
+	if err := l.w.Flush(); err != nil {
+		l.mu.Unlock()
+		return nil, err
+	}
+	segments := append([]int64(nil), l.segments...)
+	next := l.next
+	l.mu.Unlock()
+
+	if offset < segments[0] {
+		return nil, fmt.Errorf("offset %d is before %d: %w", offset, segments[0], ErrTruncated)
+	}
+	if offset > next {
+		return nil, fmt.Errorf("offset %d is past the end of the log, %d", offset, next)
+	}
+	i := sort.Search(len(segments), func(i int) bool { return segments[i] > offset }) - 1
+	var changes []Change
+	for ; i < len(segments); i++ {
+		f, err := os.Open(filepath.Join(l.dir, segmentName(segments[i])))
+		if err != nil {
+			return changes, err
+		}
+		r := bufio.NewReader(f)
+		for {
+			c, _, err := readChange(r)
+			if err != nil {
+				f.Close()
+				if err != io.EOF && err != io.ErrUnexpectedEOF {
+					return changes, err
+				}
+				break
+			}
+			if c.Offset >= next {
+				// appended since we started
+				f.Close()
+				return changes, nil
+			}
+			if c.Offset >= offset {
+				changes = append(changes, c)
+				if max > 0 && len(changes) == max {
+					f.Close()
+					return changes, nil
+				}
+			}
+		}
+	}
+	return changes, nil
+}
+
+//
+// Record that consumer has dealt with everything before offset, so
+// it can resume from there.
+//
+func (l *ChangeLog) Commit(consumer string, offset int64) error {
+	if err := checkName(consumer); err != nil {
+		return err
+	}
+	return internal.WriteObject(filepath.Join(l.dir, consumersDir, consumer), offset)
+}
+
+//
+// The offset consumer last committed, or 0 if it never has.
+//
+func (l *ChangeLog) Committed(consumer string) (int64, error) {
+	if err := checkName(consumer); err != nil {
+		return 0, err
+	}
+	var offset int64
+	err := internal.ReadObject(filepath.Join(l.dir, consumersDir, consumer), &offset)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	return offset, err
+}
+
+//
+// Delete the segments holding only changes before offset.  The
+// latest segment is always kept.
+//
+func (l *ChangeLog) Truncate(offset int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for len(l.segments) > 1 && l.segments[1] <= offset {
+		if err := os.Remove(filepath.Join(l.dir, segmentName(l.segments[0]))); err != nil {
+			return err
+		}
+		l.segments = l.segments[1:]
+	}
+	return nil
+}
+
+//
+// The series' change log, or nil if its config doesn't keep one.
+//
+func (t *TimeSeries) ChangeLog() *ChangeLog {
+	return t.changes
+}
+
+//
+// Apply changes read from another series' change log, such as the
+// primary's a standby replicates, as that series accepted them.  The
+// series must keep a change log of its own, whose offsets then stay
+// in step with the other's: changes before its NextOffset are taken
+// to be applied already and skipped, so replaying from an earlier
+// offset is harmless, and a change past it fails.  Labeled keys are
+// indexed as AddLabeledValues would index them.
+//
+func (t *TimeSeries) Replay(changes []Change) error {
+	if t.changes == nil {
+		return fmt.Errorf("replaying changes needs a change log")
+	}
+	for _, c := range changes {
+		next := t.changes.NextOffset()
+		if c.Offset < next {
+			continue
+		}
+		if c.Offset > next {
+			return fmt.Errorf("change %d is past the next expected, %d", c.Offset, next)
+		}
+		t.labelsMu.Lock()
+		for k := range c.Values {
+			if name, labels, err := ParseSeriesKey(k); err == nil && labels != nil {
+				t.labels.add(k, name, labels)
+			}
+		}
+		t.labelsMu.Unlock()
+		if err := t.AddValues(c.Values, c.Timestamp); err != nil {
+			return fmt.Errorf("change %d: %w", c.Offset, err)
+		}
+		if t.changes.NextOffset() == next {
+			return fmt.Errorf("change %d was older than the series' latest data", c.Offset)
+		}
+	}
+	return nil
+}
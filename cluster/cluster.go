@@ -0,0 +1,466 @@
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package cluster replicates writes to a tissa.TimeSeries through a
+Raft log, for highly available writes: every append goes through
+the log, and every node in the cluster, three or more of them,
+applies the log in order to a series of its own, so each holds the
+same archives, and the cluster keeps accepting writes while a
+majority of its nodes are up.
+
+It works with any Raft library, through the Log interface, and is
+the replicated state machine it drives.  With
+github.com/hashicorp/raft, for instance, the adapter is a few lines:
+
+	type raftLog struct{ r *raft.Raft }
+
+	func (l raftLog) Apply(cmd []byte) (interface{}, error) {
+		f := l.r.Apply(cmd, 10 * time.Second)
+		if err := f.Error(); err != nil {
+			return nil, err
+		}
+		return f.Response(), nil
+	}
+
+	type fsm struct{ n *cluster.Node }
+
+	func (f fsm) Apply(l *raft.Log) interface{} { return f.n.Apply(l.Index, l.Data) }
+	func (f fsm) Snapshot() (raft.FSMSnapshot, error) {
+		s, err := f.n.Snapshot()
+		if err != nil {
+			return nil, err
+		}
+		return snapshot{ s }, nil
+	}
+	func (f fsm) Restore(rc io.ReadCloser) error { defer rc.Close(); return f.n.Restore(rc) }
+
+	type snapshot struct{ *cluster.Snapshot }
+
+	func (s snapshot) Persist(sink raft.SnapshotSink) error {
+		if _, err := s.WriteTo(sink); err != nil {
+			sink.Cancel()
+			return err
+		}
+		return sink.Close()
+	}
+
+and on each node:
+
+	node, err := cluster.NewNode("/var/lib/tissa/cpu", config)
+	r, err := raft.NewRaft(raftConfig, fsm{ node }, logs, stable, snapshots, transport)
+	node.Log = raftLog{ r }
+	err = node.AddValues(map[string]float64{ "web1": 0.5 }, time.Now().Unix())
+
+Appends on a node that isn't the leader fail as the Log fails them
+(raft.ErrNotLeader, say), and should be sent to the leader.  Queries
+go to the node's own series, through Series(), and may lag the
+leader's by the entries it hasn't applied yet.
+
+Each node writes its own series to disk, with Write, and records
+the index of the last entry it applied with it, so after a restart,
+entries the library replays that are already in the series are
+skipped.  Snapshots are backups of the series; a node restored from
+one is replaced by it.  Every node must be created with the same
+config, and since entries must have the same effect on every node,
+the series shouldn't have a write-rate quota, which depends on when
+each node applies them.
+*/
+package cluster
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fred-lewis/tissa"
+	"github.com/fred-lewis/tissa/internal"
+)
+
+//
+// What a Node needs of a Raft library.  Apply appends cmd to the
+// log, waits until it's committed and applied on this node, and
+// returns what Node.Apply returned for it.  It fails if this node
+// isn't the leader, or the entry isn't committed in time.
+//
+type Log interface {
+	Apply(cmd []byte) (interface{}, error)
+}
+
+// Command operations.
+const (
+	opAddValues = iota
+	opAddLabeledValues
+	opSetMetricType
+)
+
+//
+// An entry in the log.
+//
+type command struct {
+	Op        int
+	Timestamp int64
+	Values    map[string]float64
+	Labeled   []tissa.LabeledValue
+	Key       string
+	Type      tissa.MetricType
+}
+
+const (
+	seriesDir   = "series"
+	appliedFile = "applied"
+	restoreDir  = "restore"
+)
+
+//
+// A node in the cluster: the series it materializes from the log, in
+// a directory of its own.
+//
+type Node struct {
+	dir string
+	// the cluster's log, which must be set before appending
+	Log Log
+
+	mu      sync.RWMutex
+	ts      *tissa.TimeSeries
+	applied uint64
+}
+
+//
+// Construct a new node in dir, whose series has the given
+// configuration.
+//
+func NewNode(dir string, config tissa.TimeSeriesConfig) (*Node, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	ts, err := tissa.NewTimeSeries(filepath.Join(dir, seriesDir), config)
+	if err != nil {
+		return nil, err
+	}
+	return &Node{ dir: dir, ts: ts }, nil
+}
+
+//
+// Open the node in dir.
+//
+func OpenNode(dir string) (*Node, error) {
+	ts, err := tissa.OpenTimeSeries(filepath.Join(dir, seriesDir))
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{ dir: dir, ts: ts }
+	if n.applied, err = readApplied(dir); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func readApplied(dir string) (uint64, error) {
+	var applied uint64
+	err := internal.ReadObject(filepath.Join(dir, appliedFile), &applied)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	return applied, err
+}
+
+//
+// The node's series, for queries.
+//
+func (n *Node) Series() *tissa.TimeSeries {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.ts
+}
+
+//
+// The index of the last entry applied.
+//
+func (n *Node) Applied() uint64 {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.applied
+}
+
+//
+// Append cmd to the log, returning the error applying it gave.
+//
+func (n *Node) propose(cmd command) error {
+	if n.Log == nil {
+		return fmt.Errorf("node has no log")
+	}
+	var buf bytes.Buffer
+	if err := internal.Msgpack.Encode(&buf, cmd); err != nil {
+		return err
+	}
+	res, err := n.Log.Apply(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	if err, ok := res.(error); ok {
+		return err
+	}
+	return nil
+}
+
+//
+// Add a single key-value pair through the log, as
+// TimeSeries.AddValue does.
+//
+func (n *Node) AddValue(key string, val float64, timestamp int64) error {
+	return n.AddValues(map[string]float64{ key: val }, timestamp)
+}
+
+//
+// Add multiple key-value pairs through the log, as
+// TimeSeries.AddValues does.
+//
+func (n *Node) AddValues(vals map[string]float64, timestamp int64) error {
+	return n.propose(command{ Op: opAddValues, Timestamp: timestamp, Values: vals })
+}
+
+//
+// Add values for labeled series through the log, as
+// TimeSeries.AddLabeledValues does.
+//
+func (n *Node) AddLabeledValues(vals []tissa.LabeledValue, timestamp int64) error {
+	return n.propose(command{ Op: opAddLabeledValues, Timestamp: timestamp, Labeled: vals })
+}
+
+//
+// Set the metric type of key through the log.
+//
+func (n *Node) SetMetricType(key string, typ tissa.MetricType) error {
+	return n.propose(command{ Op: opSetMetricType, Key: key, Type: typ })
+}
+
+//
+// Apply the log entry at index to the series, for the Raft library
+// to call on every node, in log order.  Returns the error applying
+// it gave, if any, which Log.Apply returns to the node that appended
+// it; entries at or before the last applied are skipped.
+//
+func (n *Node) Apply(index uint64, cmd []byte) interface{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if index <= n.applied {
+		return nil
+	}
+	n.applied = index
+	var c command
+	if err := internal.Msgpack.Decode(bytes.NewReader(cmd), &c); err != nil {
+		return fmt.Errorf("entry %d: %w", index, err)
+	}
+	var err error
+	switch c.Op {
+	case opAddValues:
+		err = n.ts.AddValues(c.Values, c.Timestamp)
+	case opAddLabeledValues:
+		err = n.ts.AddLabeledValues(c.Labeled, c.Timestamp)
+	case opSetMetricType:
+		err = n.ts.SetMetricType(c.Key, c.Type)
+	default:
+		err = fmt.Errorf("entry %d: unknown operation %d", index, c.Op)
+	}
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+//
+// Write the node's series, and the index of the last entry applied
+// to it.  Entries aren't applied while it's written.
+//
+func (n *Node) Write() error {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if err := n.ts.Write(); err != nil {
+		return err
+	}
+	return internal.WriteObject(filepath.Join(n.dir, appliedFile), n.applied)
+}
+
+//
+// Write the node, as Write does, and close its series.
+//
+func (n *Node) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.ts.Close(); err != nil {
+		return err
+	}
+	return internal.WriteObject(filepath.Join(n.dir, appliedFile), n.applied)
+}
+
+//
+// A snapshot of a node's series, for the Raft library to persist:
+// a backup of it, and the index of the last entry applied to it.
+//
+type Snapshot struct {
+	dir string
+}
+
+//
+// Snapshot the node's series.  Entries aren't applied while the
+// series is backed up.
+//
+func (n *Node) Snapshot() (*Snapshot, error) {
+	dir, err := os.MkdirTemp(n.dir, "snapshot")
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{ dir: dir }
+	n.mu.Lock()
+	_, err = n.ts.Backup(filepath.Join(dir, seriesDir), "")
+	if err == nil {
+		err = internal.WriteObject(filepath.Join(dir, appliedFile), n.applied)
+	}
+	n.mu.Unlock()
+	if err != nil {
+		s.Release()
+		return nil, err
+	}
+	return s, nil
+}
+
+//
+// Write the snapshot to w, as a tar archive.
+//
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{ w: w }
+	tw := tar.NewWriter(cw)
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{ Name: filepath.ToSlash(rel), Mode: 0600, Size: info.Size(), ModTime: info.ModTime() }
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	return cw.n, err
+}
+
+//
+// Delete the snapshot's files.
+//
+func (s *Snapshot) Release() {
+	os.RemoveAll(s.dir)
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+//
+// Replace the node's series with the snapshot read from r, as
+// Snapshot.WriteTo wrote it.  The node's previous series is only
+// deleted once the snapshot is restored.
+//
+func (n *Node) Restore(r io.Reader) error {
+	tmp := filepath.Join(n.dir, restoreDir)
+	os.RemoveAll(tmp)
+	defer os.RemoveAll(tmp)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		rel := filepath.FromSlash(hdr.Name)
+		if !filepath.IsLocal(rel) {
+			return fmt.Errorf("snapshot holds %q", hdr.Name)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		path := filepath.Join(tmp, rel)
+		if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	applied, err := readApplied(tmp)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	series, old := filepath.Join(n.dir, seriesDir), filepath.Join(n.dir, seriesDir + ".old")
+	os.RemoveAll(old)
+	// closed before it's moved aside, so nothing it writes lands in
+	// the restored series, and opened again if the restore fails
+	n.ts.Close()
+	if err = os.Rename(series, old); err != nil {
+		return n.reopen(err)
+	}
+	ts, err := tissa.RestoreTimeSeries(filepath.Join(tmp, seriesDir), series)
+	if err != nil {
+		os.Rename(old, series)
+		return n.reopen(err)
+	}
+	n.ts, n.applied = ts, applied
+	if err = internal.WriteObject(filepath.Join(n.dir, appliedFile), applied); err != nil {
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+//
+// Open the node's series again after a failed Restore, returning
+// err.  n.mu must be held.
+//
+func (n *Node) reopen(err error) error {
+	if ts, oerr := tissa.OpenTimeSeries(filepath.Join(n.dir, seriesDir)); oerr == nil {
+		n.ts = ts
+	}
+	return err
+}
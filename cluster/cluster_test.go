@@ -0,0 +1,160 @@
+package cluster
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/fred-lewis/tissa"
+)
+
+//
+// A log committing every entry at once, applying it to each node in
+// turn, and answering with the first node's result.
+//
+type memLog struct {
+	nodes   []*Node
+	entries [][]byte
+}
+
+func (l *memLog) Apply(cmd []byte) (interface{}, error) {
+	l.entries = append(l.entries, cmd)
+	var res interface{}
+	for i, n := range l.nodes {
+		if r := n.Apply(uint64(len(l.entries)), cmd); i == 0 {
+			res = r
+		}
+	}
+	return res, nil
+}
+
+func TestCluster(t *testing.T) {
+	dir := "/tmp/timeseries_test/cluster"
+	os.RemoveAll(dir)
+	config := tissa.TimeSeriesConfig{
+		Archives: []tissa.ArchiveConfig{
+			{Resolution: tissa.SECOND, Retention: tissa.HOUR},
+			{Resolution: tissa.MINUTE, Retention: tissa.DAY},
+		},
+	}
+	log := &memLog{}
+	for i := 0; i < 3; i++ {
+		n, err := NewNode(fmt.Sprintf("%s/%d", dir, i), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.Log = log
+		log.nodes = append(log.nodes, n)
+	}
+
+	start := int64(1560628800)
+	leader := log.nodes[0]
+	if err := leader.SetMetricType("requests", tissa.METRIC_COUNTER); err != nil {
+		t.Fatal(err)
+	}
+	for s := int64(0); s < 90; s++ {
+		if err := leader.AddValues(map[string]float64{ "requests": float64(s % 40) }, start + s); err != nil {
+			t.Fatal(err)
+		}
+		err := leader.AddLabeledValues([]tissa.LabeledValue{
+			{ Name: "cpu", Labels: tissa.Labels{ "host": "a" }, Value: float64(s) },
+		}, start + s)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// errors applying an entry come back to the node that appended it
+	err := leader.AddLabeledValues([]tissa.LabeledValue{
+		{ Name: "cpu", Labels: tissa.Labels{ "host-name": "a" }, Value: 1 },
+	}, start + 89)
+	if err == nil {
+		t.Errorf("Added a value with a bad label name")
+	}
+
+	query := func(n *Node) string {
+		t.Helper()
+		var out string
+		for _, res := range []int64{ tissa.SECOND, tissa.MINUTE } {
+			r, err := n.Series().Query(start, start + 90, res, tissa.AGGREGATE_AVERAGE)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out += fmt.Sprint(r.Values)
+		}
+		return out
+	}
+	want := query(leader)
+	for i, n := range log.nodes {
+		if got := query(n); got != want {
+			t.Errorf("Node %d has %s, not %s", i, got, want)
+		}
+		if n.Applied() != 182 {
+			t.Errorf("Node %d applied %d", i, n.Applied())
+		}
+		if err := n.Write(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if keys := log.nodes[2].Series().SelectSeries("cpu", nil); len(keys) != 1 {
+		t.Errorf("Node 2 indexed %v", keys)
+	}
+
+	// reopened, a node skips the entries it has applied
+	if err := log.nodes[1].Close(); err != nil {
+		t.Fatal(err)
+	}
+	n, err := OpenNode(dir + "/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Log = log
+	log.nodes[1] = n
+	if n.Applied() != 182 {
+		t.Errorf("Reopened node applied %d", n.Applied())
+	}
+	for i, cmd := range log.entries {
+		n.Apply(uint64(i + 1), cmd)
+	}
+	if got := query(n); got != want {
+		t.Errorf("Replayed node has %s, not %s", got, want)
+	}
+
+	// a new node catches up from a snapshot
+	snap, err := leader.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err = snap.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	snap.Release()
+	late, err := NewNode(dir + "/3", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = late.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if late.Applied() != 182 {
+		t.Errorf("Restored node applied %d", late.Applied())
+	}
+	late.Log = log
+	log.nodes = append(log.nodes, late)
+	if err = leader.AddValue("requests", 50, start + 90); err != nil {
+		t.Fatal(err)
+	}
+	if a, b := late.Series().MetricType("requests"), leader.Series().MetricType("requests"); a != b {
+		t.Errorf("Restored node has requests as %v", a)
+	}
+	if got, want := query(late), query(leader); got != want {
+		t.Errorf("Restored node has %s, not %s", got, want)
+	}
+	if entries, _ := os.ReadDir(dir + "/0"); len(entries) != 2 {
+		t.Errorf("Snapshot left %d entries behind", len(entries))
+	}
+}
@@ -0,0 +1,84 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"math"
+)
+
+//
+// The Pearson correlation between the average values of keyA and
+// keyB in [startTime, endTime) at resolution, from -1 to 1, over the
+// intervals where both have a value.  NaN if there are fewer than
+// two such intervals or either key's values are constant there.
+//
+func (t *TimeSeries) Correlate(keyA, keyB string, startTime, endTime, resolution int64) (float64, error) {
+	corr, err := t.CrossCorrelate(keyA, keyB, startTime, endTime, resolution, 0)
+	if corr == nil {
+		return math.NaN(), err
+	}
+	return corr[0], err
+}
+
+//
+// Like Correlate, at each lag from -maxLag to maxLag intervals:
+// element i is the correlation of keyA with keyB i - maxLag
+// intervals later, so a peak at a positive lag suggests keyB
+// follows keyA.  Only intervals inside [startTime, endTime) are
+// paired, so longer lags have fewer pairs.
+//
+func (t *TimeSeries) CrossCorrelate(keyA, keyB string, startTime, endTime, resolution int64,
+	maxLag int) ([]float64, error) {
+
+	if maxLag < 0 {
+		return nil, fmt.Errorf("lag %d is negative", maxLag)
+	}
+	vals, _, err := t.Averages(startTime, endTime, resolution, QueryOptions{
+		Keys: Keys(keyA, keyB),
+		Fill: FILL_NAN,
+	})
+	if vals == nil {
+		return nil, err
+	}
+	a, b := vals[keyA], vals[keyB]
+	corr := make([]float64, 2 * maxLag + 1)
+	for i := range corr {
+		corr[i] = pearson(a, b, i - maxLag)
+	}
+	return corr, err
+}
+
+//
+// The correlation of a[j] with b[j + lag], over the j where both are
+// present and not NaN.
+//
+func pearson(a, b []float64, lag int) float64 {
+	var n, sa, sb, saa, sbb, sab float64
+	for j := range a {
+		if j + lag < 0 || j + lag >= len(b) {
+			continue
+		}
+		x, y := a[j], b[j + lag]
+		if math.IsNaN(x) || math.IsNaN(y) {
+			continue
+		}
+		n++
+		sa += x
+		sb += y
+		saa += x * x
+		sbb += y * y
+		sab += x * y
+	}
+	if n < 2 {
+		return math.NaN()
+	}
+	cov := sab - sa * sb / n
+	va := saa - sa * sa / n
+	vb := sbb - sb * sb / n
+	if va <= 0 || vb <= 0 {
+		return math.NaN()
+	}
+	return cov / math.Sqrt(va * vb)
+}
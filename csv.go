@@ -0,0 +1,64 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+)
+
+//
+// Write the result as CSV: a header of "timestamp" and the keys, in
+// order, then a row for each timestamp.  Missing values are left
+// empty.
+//
+func (r *Result) WriteCSV(w io.Writer) error {
+	return r.writeCSV(w, r.Keys())
+}
+
+func (r *Result) writeCSV(w io.Writer, keys []string) error {
+	cw := csv.NewWriter(w)
+	row := make([]string, len(keys) + 1)
+	row[0] = "timestamp"
+	copy(row[1:], keys)
+	if err := cw.Write(row); err != nil {
+		return err
+	}
+	for i, ts := range r.Timestamps {
+		row[0] = strconv.FormatInt(ts, 10)
+		for j, k := range keys {
+			row[j + 1] = ""
+			if v := r.Values[k]; i < len(v) && !r.Missing[k][i] {
+				row[j + 1] = strconv.FormatFloat(v[i], 'g', -1, 64)
+			}
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+//
+// Write the averages of [startTime, endTime) at resolution to w as
+// CSV, as Result.WriteCSV does, with a column for each of keys, in
+// the order given, or for every key, sorted, if none are.  For other
+// aggregations or options, Query and write the Result.
+//
+func (t *TimeSeries) ExportCSV(w io.Writer, startTime, endTime, resolution int64, keys ...string) error {
+	o := QueryOptions{ Fill: FILL_NAN }
+	if len(keys) > 0 {
+		o.Keys = Keys(keys...)
+	}
+	res, err := t.Query(startTime, endTime, resolution, AGGREGATE_AVERAGE, o)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		keys = res.Keys()
+	}
+	return res.writeCSV(w, keys)
+}
@@ -0,0 +1,383 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fred-lewis/tissa/internal"
+)
+
+//
+// A DB keeps many named TimeSeries under one directory, creating
+// them with a default configuration the first time they're written
+// to and opening them the first time they're used.  Each series is
+// in its own directory under "series", and the default
+// configuration is saved in the "db" file.
+//
+// Series may also be kept in Namespaces, e.g. one per tenant, each
+// with its own defaults and its own series names, under
+// "namespaces".  The series methods on a DB itself are for those
+// outside any namespace.
+//
+type DB struct {
+	*seriesSet
+	namespaces map[string]*Namespace
+	nsMu       sync.Mutex
+}
+
+//
+// A set of series sharing a directory and default configuration.
+//
+type seriesSet struct {
+	dir      string
+	defaults TimeSeriesConfig
+	series   map[string]*TimeSeries
+	mu       sync.Mutex
+	// the limits on all the series together (a Quota), and their
+	// usage; atomic, so appends can check it without s.mu
+	quota    atomic.Value
+	usage    quotaState
+}
+
+// Returned (wrapped) by DB methods given a series that doesn't exist.
+var ErrNoSeries = errors.New("no such series")
+
+const (
+	dbFile    = "db"
+	seriesDir = "series"
+)
+
+func newSeriesSet(dir string, defaults TimeSeriesConfig) *seriesSet {
+	return &seriesSet{ dir: dir, defaults: defaults, series: make(map[string]*TimeSeries) }
+}
+
+func newDB(dir string, defaults TimeSeriesConfig) *DB {
+	return &DB{ seriesSet: newSeriesSet(dir, defaults), namespaces: make(map[string]*Namespace) }
+}
+
+//
+// Create dir for a set of series, saving defaults in its file fn.
+//
+func createSeriesSet(dir, fn string, defaults TimeSeriesConfig) error {
+	if len(defaults.Archives) == 0 {
+		return fmt.Errorf("config must specify at least one archive")
+	}
+	err := os.MkdirAll(filepath.Join(dir, seriesDir), 0700)
+	if err != nil {
+		return err
+	}
+	return internal.WriteObject(filepath.Join(dir, fn), defaults)
+}
+
+//
+// Construct a new DB in the given directory, creating series with
+// defaults unless they're created with CreateSeries.
+//
+func NewDB(dir string, defaults TimeSeriesConfig) (*DB, error) {
+	if err := createSeriesSet(dir, dbFile, defaults); err != nil {
+		return nil, err
+	}
+	return newDB(dir, defaults), nil
+}
+
+//
+// Open an existing DB in the given directory.  Series are opened as
+// they're used.
+//
+func OpenDB(dir string) (*DB, error) {
+	var defaults TimeSeriesConfig
+	err := internal.ReadObject(filepath.Join(dir, dbFile), &defaults)
+	if err != nil {
+		return nil, err
+	}
+	return newDB(dir, defaults), nil
+}
+
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	return nil
+}
+
+func (s *seriesSet) seriesPath(name string) string {
+	return filepath.Join(s.dir, seriesDir, name)
+}
+
+//
+// The named series, opened if need be; ErrNoSeries if it doesn't
+// exist.
+//
+func (s *seriesSet) Series(name string) (*TimeSeries, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.open(name, nil)
+}
+
+//
+// The named series, created with the DB's default configuration if
+// it doesn't exist.
+//
+func (s *seriesSet) SeriesOrCreate(name string) (*TimeSeries, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.open(name, &s.defaults)
+}
+
+//
+// Create a series with its own configuration.  Fails if it already
+// exists.
+//
+func (s *seriesSet) CreateSeries(name string, config TimeSeriesConfig) (*TimeSeries, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fp := s.seriesPath(name)
+	if _, err := os.Stat(fp); err == nil {
+		return nil, fmt.Errorf("series %q already exists", name)
+	}
+	ts, err := NewTimeSeries(fp, config)
+	if err != nil {
+		return nil, err
+	}
+	ts.group = s
+	s.series[name] = ts
+	return ts, nil
+}
+
+//
+// Open name, or if create is set and it doesn't exist, create it
+// with that config.  s.mu must be held.
+//
+func (s *seriesSet) open(name string, create *TimeSeriesConfig) (*TimeSeries, error) {
+	if ts := s.series[name]; ts != nil {
+		return ts, nil
+	}
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	fp := s.seriesPath(name)
+	ts, err := OpenTimeSeries(fp)
+	if errors.Is(err, os.ErrNotExist) {
+		if create == nil {
+			return nil, fmt.Errorf("%q: %w", name, ErrNoSeries)
+		}
+		// a copy, since NewTimeSeries sorts the archives in place
+		config := *create
+		config.Archives = append([]ArchiveConfig(nil), create.Archives...)
+		ts, err = NewTimeSeries(fp, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ts.group = s
+	s.series[name] = ts
+	return ts, nil
+}
+
+//
+// The names of all series in the DB, sorted.
+//
+func (s *seriesSet) Names() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, seriesDir))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+//
+// Delete the named series and all its data.
+//
+func (s *seriesSet) DeleteSeries(name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	// counted before taking s.mu, since appends hold the series'
+	// lock while they update the set's usage
+	s.mu.Lock()
+	ts := s.series[name]
+	s.mu.Unlock()
+	keys := 0
+	if ts != nil {
+		keys = ts.numKeys()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fp := s.seriesPath(name)
+	if _, err := os.Stat(fp); err != nil {
+		return fmt.Errorf("%q: %w", name, ErrNoSeries)
+	}
+	if open := s.series[name]; open != nil {
+		if open != ts {
+			// reopened meanwhile
+			keys = open.numKeys()
+		}
+		s.usage.addKeys(-keys)
+		// its data is about to go, so a failed final Write doesn't
+		// matter
+		open.Close()
+	}
+	delete(s.series, name)
+	return os.RemoveAll(fp)
+}
+
+//
+// Add key-value pairs to the named series, creating it if need be.
+//
+func (s *seriesSet) AddValues(name string, vals map[string]float64, timestamp int64) error {
+	ts, err := s.SeriesOrCreate(name)
+	if err != nil {
+		return err
+	}
+	return ts.AddValues(vals, timestamp)
+}
+
+//
+// Run a Query against the named series.
+//
+func (s *seriesSet) Query(name string, startTime, endTime, resolution int64, agg Aggregation,
+	opts ...QueryOptions) (*Result, error) {
+
+	ts, err := s.Series(name)
+	if err != nil {
+		return nil, err
+	}
+	return ts.Query(startTime, endTime, resolution, agg, opts...)
+}
+
+//
+// Write every open series, in every namespace, returning the first
+// error.  The rest are still written.
+//
+func (db *DB) Write() error {
+	db.nsMu.Lock()
+	sets := []*seriesSet{ db.seriesSet }
+	for _, ns := range db.namespaces {
+		sets = append(sets, ns.seriesSet)
+	}
+	db.nsMu.Unlock()
+
+	var firstErr error
+	for _, set := range sets {
+		if err := set.write(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (s *seriesSet) write() error {
+	s.mu.Lock()
+	open := make([]*TimeSeries, 0, len(s.series))
+	for _, ts := range s.series {
+		open = append(open, ts)
+	}
+	s.mu.Unlock()
+
+	var firstErr error
+	for _, ts := range open {
+		if err := ts.Write(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if s.getQuota().MaxDiskBytes > 0 {
+		if err := s.usage.measure(s.dir); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+//
+// Close every open series, in every namespace, as TimeSeries.Close
+// does, returning the first error.  The rest are still closed.
+// Series used afterwards are opened again.
+//
+func (db *DB) Close() error {
+	db.nsMu.Lock()
+	sets := []*seriesSet{ db.seriesSet }
+	for _, ns := range db.namespaces {
+		sets = append(sets, ns.seriesSet)
+	}
+	db.nsMu.Unlock()
+
+	var firstErr error
+	for _, set := range sets {
+		if err := set.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (s *seriesSet) close() error {
+	s.mu.Lock()
+	open := s.series
+	s.series = make(map[string]*TimeSeries)
+	s.mu.Unlock()
+
+	var firstErr error
+	for _, ts := range open {
+		if err := ts.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+//
+// Run Write in the background every interval seconds, until the
+// returned function is called, which writes once more.  Errors are
+// passed to onError, if not nil.
+//
+func (db *DB) WriteEvery(interval int64, onError func(error)) (stop func()) {
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	write := func() {
+		if err := db.Write(); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				write()
+			case <-done:
+				write()
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+			<-stopped
+		})
+	}
+}
@@ -23,8 +23,8 @@ deleted.
 Example:
 	tsc := TimeSeriesConfig{
 		Archives: []ArchiveConfig{
-			{SECOND, HOUR}, // retain 1-second data for 1 hour
-			{MINUTE, DAY}, // retain 1-minute rollups for 1 day
+			{Resolution: SECOND, Retention: HOUR}, // retain 1-second data for 1 hour
+			{Resolution: MINUTE, Retention: DAY}, // retain 1-minute rollups for 1 day
 		},
 		DefaultValue: 0,
 	}
@@ -0,0 +1,327 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/fred-lewis/tissa/internal"
+)
+
+//
+// Export and import of a whole TimeSeries as JSON, for dumping,
+// inspecting, diffing and moving series between tissa versions.  The
+// format is a single object:
+//
+//	{
+//	  "format": "tissa",
+//	  "version": 1,
+//	  "config": {...},
+//	  "counters": {"requests": {"raw": 1200, "seen": true, "offset": 5000}},
+//	  "labeled": ["cpu{host=\"web1\"}"],
+//	  "archives": [
+//	    {"resolution": 1, "chunks": [
+//	      {"start": 1560628800, "timestamps": [1560628800, ...],
+//	       "values": {"web1": [0.5, null, ...]}}
+//	    ]},
+//	    {"resolution": 60, "chunks": [
+//	      {"start": 1560628800, "timestamps": [...],
+//	       "values": {"web1": [{"total": 30, "count": 60, "min": 0, ...}, ...]}}
+//	    ]}
+//	  ]
+//	}
+//
+// config is the TimeSeriesConfig, with its fields named as in Go.
+// counters holds the state of METRIC_COUNTER keys, and labeled the
+// keys in the label index.  Each archive's ticks are grouped by the
+// chunks they were stored in, oldest first; values are null where a
+// key has none, and rollup archives hold rollups, with the fields of
+// Rollup in lower case.  NaN and infinities, which JSON has no
+// numbers for, are the strings "NaN", "+Inf" and "-Inf".  The
+// quantile sketches and unique counts kept by Percentiles and
+// Uniques archives aren't exported.
+//
+
+const (
+	exportFormat  = "tissa"
+	exportVersion = 1
+)
+
+type exportDoc struct {
+	Format   string                   `json:"format"`
+	Version  int                      `json:"version"`
+	Config   exportConfig             `json:"config"`
+	Counters map[string]exportCounter `json:"counters,omitempty"`
+	Labeled  []string                 `json:"labeled,omitempty"`
+	Archives []exportArchive          `json:"archives"`
+}
+
+// The config, with a DefaultValue that may be NaN.
+type exportConfig struct {
+	TimeSeriesConfig
+	DefaultValue jsonFloat
+}
+
+type exportCounter struct {
+	Raw    jsonFloat `json:"raw"`
+	Seen   bool      `json:"seen"`
+	Offset jsonFloat `json:"offset"`
+}
+
+type exportArchive struct {
+	Resolution int64         `json:"resolution"`
+	Chunks     []exportChunk `json:"chunks"`
+}
+
+type exportChunk struct {
+	Start      int64                      `json:"start"`
+	Timestamps []int64                    `json:"timestamps"`
+	Values     map[string]json.RawMessage `json:"values"`
+}
+
+type exportRollup struct {
+	Total    jsonFloat `json:"total"`
+	Count    int64     `json:"count"`
+	Min      jsonFloat `json:"min"`
+	Max      jsonFloat `json:"max"`
+	SumSq    jsonFloat `json:"sumsq"`
+	First    jsonFloat `json:"first"`
+	Last     jsonFloat `json:"last"`
+	Weighted jsonFloat `json:"weighted"`
+	Duration jsonFloat `json:"duration"`
+}
+
+// A float64 that encodes NaN and infinities as strings.
+type jsonFloat float64
+
+func (f jsonFloat) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	switch {
+	case math.IsNaN(v):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(v, 1):
+		return []byte(`"+Inf"`), nil
+	case math.IsInf(v, -1):
+		return []byte(`"-Inf"`), nil
+	}
+	return []byte(strconv.FormatFloat(v, 'g', -1, 64)), nil
+}
+
+func (f *jsonFloat) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || !(math.IsNaN(v) || math.IsInf(v, 0)) {
+			return fmt.Errorf("bad number %q", s)
+		}
+		*f = jsonFloat(v)
+		return nil
+	}
+	var v float64
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*f = jsonFloat(v)
+	return nil
+}
+
+func toExportRollup(r Rollup) exportRollup {
+	return exportRollup{
+		Total: jsonFloat(r.Total), Count: r.Count, Min: jsonFloat(r.Min), Max: jsonFloat(r.Max),
+		SumSq: jsonFloat(r.SumSq), First: jsonFloat(r.First), Last: jsonFloat(r.Last),
+		Weighted: jsonFloat(r.Weighted), Duration: jsonFloat(r.Duration),
+	}
+}
+
+func (r exportRollup) rollup() Rollup {
+	return Rollup{
+		Total: float64(r.Total), Count: r.Count, Min: float64(r.Min), Max: float64(r.Max),
+		SumSq: float64(r.SumSq), First: float64(r.First), Last: float64(r.Last),
+		Weighted: float64(r.Weighted), Duration: float64(r.Duration),
+	}
+}
+
+//
+// Write the whole series to w in the export format.
+//
+func (t *TimeSeries) Export(w io.Writer) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	doc := exportDoc{
+		Format: exportFormat,
+		Version: exportVersion,
+		Config: exportConfig{ TimeSeriesConfig: t.config, DefaultValue: jsonFloat(t.config.DefaultValue) },
+	}
+	t.metricsMu.Lock()
+	for k, m := range t.metrics {
+		if m.Type == METRIC_COUNTER {
+			if doc.Counters == nil {
+				doc.Counters = make(map[string]exportCounter)
+			}
+			doc.Counters[k] = exportCounter{ Raw: jsonFloat(m.Raw), Seen: m.Seen, Offset: jsonFloat(m.Offset) }
+		}
+	}
+	t.metricsMu.Unlock()
+	t.labelsMu.Lock()
+	for k := range t.labels.known {
+		doc.Labeled = append(doc.Labeled, k)
+	}
+	t.labelsMu.Unlock()
+	sort.Strings(doc.Labeled)
+
+	for _, a := range t.archives {
+		ea := exportArchive{ Resolution: a.Interval, Chunks: []exportChunk{} }
+		start, end := a.TimeRange()
+		if end > 0 {
+			for cs := start - start % a.ChunkSize; cs <= end; cs += a.ChunkSize {
+				c, err := exportChunkOf(a, cs, end)
+				if err != nil {
+					return err
+				}
+				if c != nil {
+					ea.Chunks = append(ea.Chunks, *c)
+				}
+			}
+		}
+		doc.Archives = append(doc.Archives, ea)
+	}
+	return json.NewEncoder(w).Encode(doc)
+}
+
+//
+// The ticks of a in the chunk starting at start, up to end; nil if
+// it has no data.
+//
+func exportChunkOf(a *internal.Archive, start, end int64) (*exportChunk, error) {
+	stop := start + a.ChunkSize
+	if stop > end + a.Interval {
+		stop = end + a.Interval
+	}
+	data, timestamps, err := a.GetData(start, stop)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	c := &exportChunk{ Start: start, Timestamps: timestamps, Values: make(map[string]json.RawMessage, len(data)) }
+	for k, vals := range data {
+		out := make([]interface{}, len(vals))
+		for i, v := range vals {
+			switch x := v.(type) {
+			case float64:
+				out[i] = jsonFloat(x)
+			case Rollup:
+				out[i] = toExportRollup(x)
+			}
+		}
+		if c.Values[k], err = json.Marshal(out); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+//
+// Create a TimeSeries in dir from an export read from r.  dir must
+// not hold a series already.
+//
+func ImportTimeSeries(dir string, r io.Reader) (*TimeSeries, error) {
+	var doc exportDoc
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	if doc.Format != exportFormat || doc.Version < 1 || doc.Version > exportVersion {
+		return nil, fmt.Errorf("unsupported export format %q version %d", doc.Format, doc.Version)
+	}
+	config := doc.Config.TimeSeriesConfig
+	config.DefaultValue = float64(doc.Config.DefaultValue)
+	t, err := NewTimeSeries(dir, config)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ea := range doc.Archives {
+		var a *internal.Archive
+		for _, ta := range t.archives {
+			if ta.Interval == ea.Resolution {
+				a = ta
+			}
+		}
+		if a == nil {
+			return nil, fmt.Errorf("no archive with resolution %d", ea.Resolution)
+		}
+		for _, c := range ea.Chunks {
+			if err = importChunk(a, a == t.baseArchive(), c); err != nil {
+				return nil, fmt.Errorf("chunk %d at resolution %d: %w", c.Start, ea.Resolution, err)
+			}
+		}
+	}
+
+	for k, c := range doc.Counters {
+		t.metrics[k] = &metricState{ Type: METRIC_COUNTER, Raw: float64(c.Raw), Seen: c.Seen, Offset: float64(c.Offset) }
+	}
+	t.metricsDirty = len(doc.Counters) > 0
+	for _, k := range doc.Labeled {
+		name, labels, err := ParseSeriesKey(k)
+		if err != nil {
+			return nil, err
+		}
+		t.labels.add(k, name, labels)
+	}
+	if err = t.Write(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func importChunk(a *internal.Archive, base bool, c exportChunk) error {
+	floats := make(map[string][]*jsonFloat)
+	rollups := make(map[string][]*exportRollup)
+	for k, raw := range c.Values {
+		var err error
+		if base {
+			var vals []*jsonFloat
+			err = json.Unmarshal(raw, &vals)
+			floats[k] = vals
+		} else {
+			var vals []*exportRollup
+			err = json.Unmarshal(raw, &vals)
+			rollups[k] = vals
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+	}
+	for i, ts := range c.Timestamps {
+		if base {
+			vals := make(map[string]float64)
+			for k, v := range floats {
+				if i < len(v) && v[i] != nil {
+					vals[k] = float64(*v[i])
+				}
+			}
+			if len(vals) > 0 {
+				a.AppendFloats(vals, ts)
+			}
+			continue
+		}
+		vals := make(map[string]Rollup)
+		for k, v := range rollups {
+			if i < len(v) && v[i] != nil {
+				vals[k] = v[i].rollup()
+			}
+		}
+		if len(vals) > 0 {
+			a.AppendRollups(vals, ts)
+		}
+	}
+	return nil
+}
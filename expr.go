@@ -0,0 +1,410 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+//
+// Arithmetic expressions over keys, such as
+//
+//	errors / requests * 100
+//	"cpu{host=\"web1\"}" - -1.5
+//
+// Keys are written bare if they're a letter or underscore followed
+// by letters, digits, underscores, dots and colons; any other key is
+// quoted as a Go string.  The operators are +, -, * and / (and
+// unary -), with the usual precedence, and parentheses.  Functions
+// are called as name(arg, ...); see Eval for those available.
+//
+
+type expr struct {
+	// 0 for a number, 'k' for a key, 'n' for negation, 'f' for a
+	// function call (named by key), else the binary operator
+	op    byte
+	value float64
+	key   string
+	args  []*expr
+}
+
+type exprParser struct {
+	src string
+	pos int
+}
+
+func parseExpr(src string) (*expr, error) {
+	p := &exprParser{ src: src }
+	e, err := p.sum()
+	if err == nil {
+		p.skipSpace()
+		if p.pos < len(p.src) {
+			err = p.errorf("unexpected %q", p.src[p.pos:])
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("expression %q: %s", p.src, fmt.Sprintf(format, args...))
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && strings.IndexByte(" \t\n\r", p.src[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+// The next non-space byte, or 0 at the end.
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+func (p *exprParser) sum() (*expr, error) {
+	e, err := p.product()
+	for err == nil {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			break
+		}
+		p.pos++
+		var r *expr
+		r, err = p.product()
+		e = &expr{ op: op, args: []*expr{ e, r } }
+	}
+	return e, err
+}
+
+func (p *exprParser) product() (*expr, error) {
+	e, err := p.unary()
+	for err == nil {
+		op := p.peek()
+		if op != '*' && op != '/' {
+			break
+		}
+		p.pos++
+		var r *expr
+		r, err = p.unary()
+		e = &expr{ op: op, args: []*expr{ e, r } }
+	}
+	return e, err
+}
+
+func (p *exprParser) unary() (*expr, error) {
+	if p.peek() == '-' {
+		p.pos++
+		e, err := p.unary()
+		return &expr{ op: 'n', args: []*expr{ e } }, err
+	}
+	return p.primary()
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9') || c == '.' || c == ':'
+}
+
+func (p *exprParser) primary() (*expr, error) {
+	c := p.peek()
+	start := p.pos
+	switch {
+	case c == '(':
+		p.pos++
+		e, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("missing )")
+		}
+		p.pos++
+		return e, nil
+	case c == '"' || c == '`':
+		q, err := strconv.QuotedPrefix(p.src[p.pos:])
+		if err != nil {
+			return nil, p.errorf("bad quoted key at %d", p.pos)
+		}
+		p.pos += len(q)
+		key, _ := strconv.Unquote(q)
+		return &expr{ op: 'k', key: key }, nil
+	case isIdentStart(c):
+		for p.pos < len(p.src) && isIdentChar(p.src[p.pos]) {
+			p.pos++
+		}
+		name := p.src[start:p.pos]
+		if p.peek() != '(' {
+			return &expr{ op: 'k', key: name }, nil
+		}
+		p.pos++
+		e := &expr{ op: 'f', key: name }
+		for p.peek() != ')' {
+			if len(e.args) > 0 {
+				if p.peek() != ',' {
+					return nil, p.errorf("missing ) after arguments to %s", name)
+				}
+				p.pos++
+			}
+			a, err := p.sum()
+			if err != nil {
+				return nil, err
+			}
+			e.args = append(e.args, a)
+		}
+		p.pos++
+		return e, nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		for p.pos < len(p.src) && strings.IndexByte("0123456789.eE", p.src[p.pos]) >= 0 {
+			if (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') && p.pos + 1 < len(p.src) &&
+				(p.src[p.pos + 1] == '-' || p.src[p.pos + 1] == '+') {
+				p.pos++
+			}
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return nil, p.errorf("bad number %q", p.src[start:p.pos])
+		}
+		return &expr{ value: v }, nil
+	case c == 0:
+		return nil, p.errorf("unexpected end")
+	}
+	return nil, p.errorf("unexpected %q", p.src[p.pos:])
+}
+
+//
+// The keys e refers to, added to keys.
+//
+func (e *expr) keys(keys map[string]bool) {
+	if e.op == 'k' {
+		keys[e.key] = true
+	}
+	for _, a := range e.args {
+		a.keys(keys)
+	}
+}
+
+func (e *expr) hasCalls() bool {
+	if e.op == 'f' {
+		return true
+	}
+	for _, a := range e.args {
+		if a.hasCalls() {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Evaluate e with the values lookup gives keys; false if any key has
+// no value.
+//
+func (e *expr) evalScalar(lookup func(key string) (float64, bool)) (float64, bool) {
+	switch e.op {
+	case 0:
+		return e.value, true
+	case 'k':
+		return lookup(e.key)
+	case 'f':
+		return 0, false
+	}
+	vals := make([]float64, len(e.args))
+	for i, a := range e.args {
+		v, ok := a.evalScalar(lookup)
+		if !ok {
+			return 0, false
+		}
+		vals[i] = v
+	}
+	if e.op == 'n' {
+		return -vals[0], true
+	}
+	return arith(e.op, vals[0], vals[1]), true
+}
+
+func arith(op byte, a, b float64) float64 {
+	switch op {
+	case '+':
+		return a + b
+	case '-':
+		return a - b
+	case '*':
+		return a * b
+	}
+	return a / b
+}
+
+//
+//  Evaluate an expression over [startTime, endTime) at the given
+//  resolution, giving one series.  A key stands for its averages,
+//  and operators apply interval by interval, so
+//
+//	errors / requests * 100
+//
+//  is the percentage of requests that failed in each interval.  The
+//  functions are:
+//
+//	rate(key)        the key's Rates
+//	derivative(key)  the key's Derivatives
+//	abs(x)           absolute values
+//	<aggregation>(key)
+//	                 the key under any registered Aggregation
+//	                 named by a plain word: sum(key), max(key),
+//	                 last(key) and so on
+//
+//  An interval is NaN if a key in it has no value, unless opts fills
+//  gaps; Transforms in opts apply to the result, and Keys, Limit and
+//  Stats are ignored.
+//
+func (t *TimeSeries) Eval(expression string, startTime, endTime, resolution int64,
+	opts ...QueryOptions) ([]float64, []int64, error) {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	e, err := parseExpr(expression)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the timestamps, which also checks the resolution
+	_, timestamps, err := t.query(startTime, endTime, resolution, averageOf, false,
+		[]QueryOptions{ { Keys: Keys(), Fill: FILL_NAN } })
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ev := &seriesEval{ t: t, startTime: startTime, endTime: endTime, resolution: resolution, l: len(timestamps) }
+	v, err := ev.eval(e)
+	if err != nil {
+		return nil, nil, err
+	}
+	o := t.queryOptions(opts)
+	if o.Fill != FILL_DEFAULT {
+		fillGaps(v, o.Fill, o.FillValue)
+	}
+	applyTransforms(map[string][]float64{ expression: v }, o.Transforms)
+	return v, timestamps, ev.err
+}
+
+type seriesEval struct {
+	t          *TimeSeries
+	startTime  int64
+	endTime    int64
+	resolution int64
+	l          int
+	// the first error reading data, returned with the result
+	err        error
+}
+
+func (ev *seriesEval) eval(e *expr) ([]float64, error) {
+	switch e.op {
+	case 0:
+		v := make([]float64, ev.l)
+		for i := range v {
+			v[i] = e.value
+		}
+		return v, nil
+	case 'k':
+		return ev.aggregate(AGGREGATE_AVERAGE, e.key)
+	case 'f':
+		return ev.call(e)
+	}
+
+	args := make([][]float64, len(e.args))
+	for i, a := range e.args {
+		v, err := ev.eval(a)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	v := args[0]
+	for i := range v {
+		if e.op == 'n' {
+			v[i] = -v[i]
+		} else {
+			v[i] = arith(e.op, v[i], args[1][i])
+		}
+	}
+	return v, nil
+}
+
+func (ev *seriesEval) call(e *expr) ([]float64, error) {
+	if len(e.args) != 1 {
+		return nil, fmt.Errorf("%s takes 1 argument, not %d", e.key, len(e.args))
+	}
+	if e.key == "abs" {
+		v, err := ev.eval(e.args[0])
+		if err != nil {
+			return nil, err
+		}
+		for i := range v {
+			v[i] = math.Abs(v[i])
+		}
+		return v, nil
+	}
+
+	if e.args[0].op != 'k' {
+		return nil, fmt.Errorf("the argument to %s must be a key", e.key)
+	}
+	key := e.args[0].key
+	switch e.key {
+	case "rate", "derivative":
+		vals, _, err := ev.t.differences(ev.startTime, ev.endTime, ev.resolution, e.key == "rate", Keys(key))
+		ev.keep(err)
+		return ev.series(vals[key]), nil
+	}
+	aggregatorsMu.RLock()
+	_, ok := aggregators[Aggregation(e.key)]
+	aggregatorsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s", e.key)
+	}
+	return ev.aggregate(Aggregation(e.key), key)
+}
+
+func (ev *seriesEval) aggregate(agg Aggregation, key string) ([]float64, error) {
+	res, err := ev.t.queryResult(ev.startTime, ev.endTime, ev.resolution, agg, []QueryOptions{{
+		Keys: Keys(key),
+		Fill: FILL_NAN,
+	}})
+	if res == nil {
+		return nil, err
+	}
+	ev.keep(err)
+	return ev.series(res.Values[key]), nil
+}
+
+func (ev *seriesEval) keep(err error) {
+	if ev.err == nil {
+		ev.err = err
+	}
+}
+
+//
+// A copy of v with one value per timestamp, NaN where it has none.
+//
+func (ev *seriesEval) series(v []float64) []float64 {
+	res := make([]float64, ev.l)
+	for i := range res {
+		if i < len(v) {
+			res[i] = v[i]
+		} else {
+			res[i] = math.NaN()
+		}
+	}
+	return res
+}
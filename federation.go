@@ -0,0 +1,157 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+//
+// Anything that answers a Query: a TimeSeries, a ShardedSeries, or a
+// series elsewhere.
+//
+type Queryable interface {
+	Query(startTime, endTime, resolution int64, agg Aggregation, opts ...QueryOptions) (*Result, error)
+}
+
+//
+// A Federation queries several series as one, such as those each
+// host of a cluster writes for itself, and merges their results by
+// key.  Where more than one member has a key, its values are
+// combined in each interval by Combine (AGGREGATE_SUM if empty), over
+// the members with a value there.
+//
+type Federation struct {
+	Combine Aggregation
+	names   []string
+	members []Queryable
+}
+
+//
+// Add a member, named for error messages.
+//
+func (f *Federation) Add(name string, q Queryable) {
+	f.names = append(f.names, name)
+	f.members = append(f.members, q)
+}
+
+//
+// Open the series in dir, sharded or not, and add it as a member
+// named for dir.
+//
+func (f *Federation) AddPath(dir string) error {
+	var q Queryable
+	var err error
+	if _, serr := os.Stat(filepath.Join(dir, shardsFile)); serr == nil {
+		q, err = OpenShardedSeries(dir)
+	} else {
+		q, err = OpenTimeSeries(dir)
+	}
+	if err != nil {
+		return err
+	}
+	f.Add(dir, q)
+	return nil
+}
+
+//
+// Run a Query on every member at the same time and merge the
+// results.  Limit, Fill and Transforms in opts apply to the merged
+// result, and Stats is ignored.  Members
+// that fail are left out, and their errors returned (joined) along
+// with the rest.
+//
+func (f *Federation) Query(startTime, endTime, resolution int64, agg Aggregation,
+	opts ...QueryOptions) (*Result, error) {
+
+	combine, err := lookupAggregation(f.Combine)
+	if f.Combine == "" {
+		combine, err = lookupAggregation(AGGREGATE_SUM)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var o QueryOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	// gaps are filled and transforms applied once merged
+	merged := o
+	o.Limit, o.Fill, o.Transforms, o.Stats = 0, FILL_NAN, nil, nil
+
+	results := make([]*Result, len(f.members))
+	errs := make([]error, len(f.members))
+	var wg sync.WaitGroup
+	for i, q := range f.members {
+		wg.Add(1)
+		go func(i int, q Queryable) {
+			defer wg.Done()
+			results[i], errs[i] = q.Query(startTime, endTime, resolution, agg, o)
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("%s: %w", f.names[i], errs[i])
+			}
+		}(i, q)
+	}
+	wg.Wait()
+
+	res := &Result{
+		Resolution: resolution,
+		Values: make(map[string][]float64),
+		Missing: make(map[string][]bool),
+	}
+	for _, r := range results {
+		if r != nil && len(r.Timestamps) > len(res.Timestamps) {
+			res.Timestamps = r.Timestamps
+		}
+	}
+	l := len(res.Timestamps)
+	groups := make(map[string][]Rollup)
+	for _, r := range results {
+		if r == nil {
+			continue
+		}
+		for k, v := range r.Values {
+			g := groups[k]
+			if g == nil {
+				g = make([]Rollup, l)
+				groups[k] = g
+			}
+			for i := 0; i < len(v) && i < l; i++ {
+				if !r.Missing[k][i] {
+					g[i].Add(v[i])
+				}
+			}
+		}
+	}
+	for k, g := range groups {
+		vals := make([]float64, l)
+		missing := make([]bool, l)
+		for i := range g {
+			if g[i].Count == 0 {
+				vals[i] = math.NaN()
+				missing[i] = true
+			} else {
+				vals[i] = combine(g[i])
+			}
+		}
+		res.Values[k] = vals
+		res.Missing[k] = missing
+	}
+	limitSeries(res.Values, merged.Limit)
+	limitSeries(res.Missing, merged.Limit)
+	fill, value := merged.Fill, merged.FillValue
+	if fill == FILL_DEFAULT {
+		fill, value = FILL_CONSTANT, 0
+	}
+	for _, v := range res.Values {
+		fillGaps(v, fill, value)
+	}
+	applyTransforms(res.Values, merged.Transforms)
+	return res, errors.Join(errs...)
+}
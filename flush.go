@@ -0,0 +1,143 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"sync"
+	"time"
+)
+
+//
+// Writes a series in the background, so callers needn't remember
+// to: every FlushInterval seconds, and whenever what's been appended
+// since the last Write reaches MaxUnflushedPoints values,
+// MaxUnflushedTicks ticks, or MaxUnflushedAge seconds old.  Appends
+// are buffered in memory in between, so disk I/O comes in batches
+// of a bounded size, however fast values arrive.
+//
+type flusher struct {
+	// wakes the flusher to Write
+	kick    chan struct{}
+	// wakes the flusher to Write once the oldest unwritten append is
+	// MaxUnflushedAge seconds old
+	arm     chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+//
+// Start writing the series in the background, if its config asks
+// for it.
+//
+func (t *TimeSeries) startFlusher() {
+	c := t.config
+	if t.readOnly || (c.FlushInterval <= 0 && c.MaxUnflushedPoints <= 0 &&
+		c.MaxUnflushedTicks <= 0 && c.MaxUnflushedAge <= 0) {
+		return
+	}
+	f := &flusher{
+		kick: make(chan struct{}, 1),
+		arm: make(chan struct{}, 1),
+		done: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go func() {
+		defer close(f.stopped)
+		var tick <-chan time.Time
+		if c.FlushInterval > 0 {
+			ticker := time.NewTicker(time.Duration(c.FlushInterval) * time.Second)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		var deadline <-chan time.Time
+		for {
+			// errors are left for the next flush to retry
+			select {
+			case <-tick:
+				t.Write()
+			case <-f.kick:
+				t.Write()
+			case <-f.arm:
+				if deadline == nil {
+					deadline = time.After(t.unflushedFor(c.MaxUnflushedAge))
+				}
+			case <-deadline:
+				deadline = nil
+				if wait := t.unflushedFor(c.MaxUnflushedAge); wait > 0 {
+					// written since, and appended to again
+					deadline = time.After(wait)
+				} else if wait == 0 {
+					t.Write()
+				}
+			case <-f.done:
+				return
+			}
+		}
+	}()
+	t.flusher = f
+}
+
+//
+// Stop the background flusher, if there is one, waiting for any
+// Write it's doing.
+//
+func (t *TimeSeries) stopFlusher() {
+	f := t.flusher
+	if f == nil {
+		return
+	}
+	f.once.Do(func() {
+		close(f.done)
+		<-f.stopped
+	})
+}
+
+//
+// How long until the oldest unwritten append is age seconds old: 0
+// if it already is, and -1 if nothing's waiting to be written.
+//
+func (t *TimeSeries) unflushedFor(age int64) time.Duration {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.unflushedSince.IsZero() {
+		return -1
+	}
+	wait := time.Until(t.unflushedSince.Add(time.Duration(age) * time.Second))
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+//
+// Count n values appended, waking the flusher if that's enough to
+// need a Write.  t.mu must be held.
+//
+func (t *TimeSeries) countUnflushed(n int) {
+	f := t.flusher
+	if f == nil {
+		return
+	}
+	t.unflushed += int64(n)
+	c := t.config
+	if t.unflushedSince.IsZero() {
+		t.unflushedSince = time.Now()
+		if c.MaxUnflushedAge > 0 {
+			wake(f.arm)
+		}
+	}
+	if (c.MaxUnflushedPoints > 0 && t.unflushed >= c.MaxUnflushedPoints) ||
+		(c.MaxUnflushedTicks > 0 && t.baseArchive().UnwrittenTicks() >= c.MaxUnflushedTicks) {
+		wake(f.kick)
+	}
+}
+
+func wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+		// already woken
+	}
+}
@@ -0,0 +1,459 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// How RenderSVG and RenderPNG draw a graph.  Width and Height are in
+// pixels (600 by 200 by default).  Colors are used for the keys in
+// sorted order, as "#rrggbb", repeating if need be; there's a
+// default palette.  The value axis covers Min to Max, or the range
+// of the values if they're equal.  Times are labelled in UTC unless
+// Location is set.
+//
+type GraphOptions struct {
+	Width    int
+	Height   int
+	Title    string
+	Colors   []string
+	Min      float64
+	Max      float64
+	Location *time.Location
+}
+
+var graphPalette = []string{
+	"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd",
+	"#8c564b", "#e377c2", "#7f7f7f", "#bcbd22", "#17becf",
+}
+
+//
+// The layout of a graph: the plot area, the axes' ranges and ticks,
+// and the keys with their colors.
+//
+type graph struct {
+	res            *Result
+	opts           GraphOptions
+	width, height  int
+	// the plot area
+	left, top      int
+	right, bottom  int
+	start, end     int64
+	lo, hi         float64
+	timeTicks      []int64
+	timeFormat     string
+	valueTicks     []float64
+	keys           []string
+	colors         []color.RGBA
+}
+
+// The size of a character in the PNG font, scaled, and the space it
+// takes.
+const (
+	glyphScale   = 2
+	glyphWidth   = 3 * glyphScale
+	glyphHeight  = 5 * glyphScale
+	glyphAdvance = glyphWidth + glyphScale
+)
+
+func newGraph(res *Result, opts GraphOptions) (*graph, error) {
+	g := &graph{ res: res, opts: opts, width: opts.Width, height: opts.Height }
+	if g.width == 0 {
+		g.width = 600
+	}
+	if g.height == 0 {
+		g.height = 200
+	}
+	if g.opts.Location == nil {
+		g.opts.Location = time.UTC
+	}
+	colors := opts.Colors
+	if len(colors) == 0 {
+		colors = graphPalette
+	}
+	for k := range res.Values {
+		g.keys = append(g.keys, k)
+	}
+	sort.Strings(g.keys)
+	for i := range g.keys {
+		c, err := parseColor(colors[i % len(colors)])
+		if err != nil {
+			return nil, err
+		}
+		g.colors = append(g.colors, c)
+	}
+
+	if n := len(res.Timestamps); n > 0 {
+		g.start, g.end = res.Timestamps[0], res.Timestamps[n - 1]
+	}
+	if g.end == g.start {
+		g.end = g.start + 1
+	}
+	g.lo, g.hi = opts.Min, opts.Max
+	if g.lo == g.hi {
+		g.lo, g.hi = math.Inf(1), math.Inf(-1)
+		for _, v := range res.Values {
+			for _, x := range v {
+				if !math.IsNaN(x) {
+					g.lo, g.hi = math.Min(g.lo, x), math.Max(g.hi, x)
+				}
+			}
+		}
+		if g.lo > g.hi {
+			g.lo, g.hi = 0, 1
+		}
+		if g.lo > 0 && g.lo < g.hi / 2 {
+			// start from zero, as long as that doesn't squash the lines
+			g.lo = 0
+		}
+		if g.lo == g.hi {
+			g.lo, g.hi = g.lo - 1, g.hi + 1
+		}
+		step := niceStep((g.hi - g.lo) / 4)
+		g.lo = math.Floor(g.lo / step) * step
+		g.hi = math.Ceil(g.hi / step) * step
+	}
+	step := niceStep((g.hi - g.lo) / 4)
+	for v := math.Ceil(g.lo / step) * step; v <= g.hi + step / 1e6; v += step {
+		g.valueTicks = append(g.valueTicks, v)
+	}
+
+	// room for the value labels on the left, the title above, and
+	// the time labels and legend below
+	labelWidth := 0
+	for _, v := range g.valueTicks {
+		if l := len(formatValue(v)); l > labelWidth {
+			labelWidth = l
+		}
+	}
+	g.left = labelWidth * glyphAdvance + 12
+	g.top = 10
+	if opts.Title != "" {
+		g.top += glyphHeight + 10
+	}
+	g.right = g.width - 24
+	g.bottom = g.height - (glyphHeight + 12) * 2
+	if g.right - g.left < 20 || g.bottom - g.top < 20 {
+		return nil, fmt.Errorf("graph of %dx%d is too small", g.width, g.height)
+	}
+	g.timeTicks, g.timeFormat = timeTicks(g.start, g.end, (g.right - g.left) / 90, g.opts.Location)
+	return g, nil
+}
+
+func parseColor(s string) (color.RGBA, error) {
+	v, err := strconv.ParseUint(strings.TrimPrefix(s, "#"), 16, 32)
+	if err != nil || len(s) != 7 || s[0] != '#' {
+		return color.RGBA{}, fmt.Errorf("invalid color %q", s)
+	}
+	return color.RGBA{ uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff }, nil
+}
+
+//
+// The 1, 2 or 5 times a power of ten nearest above d.
+//
+func niceStep(d float64) float64 {
+	if d <= 0 || math.IsInf(d, 0) || math.IsNaN(d) {
+		return 1
+	}
+	p := math.Pow(10, math.Floor(math.Log10(d)))
+	for _, m := range []float64{ 1, 2, 5 } {
+		if m * p >= d {
+			return m * p
+		}
+	}
+	return 10 * p
+}
+
+var timeSteps = []int64{
+	1, 2, 5, 10, 15, 30,
+	MINUTE, 2 * MINUTE, 5 * MINUTE, 10 * MINUTE, 15 * MINUTE, 30 * MINUTE,
+	HOUR, 2 * HOUR, 3 * HOUR, 6 * HOUR, 12 * HOUR,
+	DAY, 2 * DAY, 7 * DAY, 14 * DAY, 30 * DAY, 90 * DAY, 365 * DAY,
+}
+
+//
+// Times from start to end, at most max of them, on round steps, and
+// the layout to label them with.
+//
+func timeTicks(start, end int64, max int, loc *time.Location) ([]int64, string) {
+	if max < 2 {
+		max = 2
+	}
+	step := timeSteps[len(timeSteps) - 1]
+	for _, s := range timeSteps {
+		if (end - start) / s < int64(max) {
+			step = s
+			break
+		}
+	}
+	format := "01-02"
+	switch {
+	case step < MINUTE:
+		format = "15:04:05"
+	case step < DAY:
+		format = "15:04"
+	}
+	// round in local time, so days start at midnight
+	_, offset := time.Unix(start, 0).In(loc).Zone()
+	t := start + int64(offset)
+	t = t - t % step + step - int64(offset)
+	if t - step >= start {
+		t -= step
+	}
+	var ticks []int64
+	for ; t <= end; t += step {
+		ticks = append(ticks, t)
+	}
+	return ticks, format
+}
+
+//
+// A short label for v: at most 4 significant figures, with k, M, G
+// or T for large values.
+//
+func formatValue(v float64) string {
+	suffix := ""
+	for _, s := range []string{ "k", "M", "G", "T" } {
+		if math.Abs(v) < 1000 {
+			break
+		}
+		v /= 1000
+		suffix = s
+	}
+	return strconv.FormatFloat(v, 'g', 4, 64) + suffix
+}
+
+func (g *graph) x(ts int64) float64 {
+	return float64(g.left) + float64(ts - g.start) / float64(g.end - g.start) * float64(g.right - g.left)
+}
+
+func (g *graph) y(v float64) float64 {
+	return float64(g.bottom) - (v - g.lo) / (g.hi - g.lo) * float64(g.bottom - g.top)
+}
+
+//
+// Call fn with each run of values of key without NaNs, as points,
+// clamped to the plot area.
+//
+func (g *graph) lines(key string, fn func(pts [][2]float64)) {
+	var pts [][2]float64
+	for i, v := range g.res.Values[key] {
+		if math.IsNaN(v) {
+			if len(pts) > 0 {
+				fn(pts)
+			}
+			pts = nil
+			continue
+		}
+		y := math.Max(float64(g.top), math.Min(float64(g.bottom), g.y(v)))
+		pts = append(pts, [2]float64{ g.x(g.res.Timestamps[i]), y })
+	}
+	if len(pts) > 0 {
+		fn(pts)
+	}
+}
+
+//
+// Draw res as an SVG line chart, one line per key, with a legend.
+// Missing (NaN) values break the lines.
+//
+func RenderSVG(w io.Writer, res *Result, opts GraphOptions) error {
+	g, err := newGraph(res, opts)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" `+
+		`font-family="sans-serif" font-size="11">`+"\n", g.width, g.height)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#ffffff"/>`+"\n", g.width, g.height)
+	if opts.Title != "" {
+		fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="middle" font-size="13">%s</text>`+"\n",
+			g.width / 2, g.top - 10, escapeXML(opts.Title))
+	}
+	for _, v := range g.valueTicks {
+		y := g.y(v)
+		fmt.Fprintf(&b, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#e0e0e0"/>`+"\n", g.left, y, g.right, y)
+		fmt.Fprintf(&b, `<text x="%d" y="%.1f" text-anchor="end" dominant-baseline="middle">%s</text>`+"\n",
+			g.left - 6, y, formatValue(v))
+	}
+	for _, ts := range g.timeTicks {
+		x := g.x(ts)
+		fmt.Fprintf(&b, `<line x1="%.1f" y1="%d" x2="%.1f" y2="%d" stroke="#e0e0e0"/>`+"\n", x, g.top, x, g.bottom)
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" text-anchor="middle">%s</text>`+"\n",
+			x, g.bottom + 14, time.Unix(ts, 0).In(g.opts.Location).Format(g.timeFormat))
+	}
+	fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" fill="none" stroke="#808080"/>`+"\n",
+		g.left, g.top, g.right - g.left, g.bottom - g.top)
+
+	for i, k := range g.keys {
+		c := g.colors[i]
+		stroke := fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+		g.lines(k, func(pts [][2]float64) {
+			b.WriteString(`<polyline fill="none" stroke="` + stroke + `" stroke-width="1.5" points="`)
+			for j, p := range pts {
+				if j > 0 {
+					b.WriteByte(' ')
+				}
+				fmt.Fprintf(&b, "%.1f,%.1f", p[0], p[1])
+			}
+			b.WriteString(`"/>` + "\n")
+		})
+	}
+	x := g.left
+	for i, k := range g.keys {
+		c := g.colors[i]
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="10" height="10" fill="#%02x%02x%02x"/>`+"\n",
+			x, g.height - 20, c.R, c.G, c.B)
+		fmt.Fprintf(&b, `<text x="%d" y="%d">%s</text>`+"\n", x + 14, g.height - 11, escapeXML(k))
+		x += 14 + 7 * len(k) + 16
+	}
+	b.WriteString("</svg>\n")
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+func escapeXML(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+//
+// Draw res as a PNG line chart, like RenderSVG.  Text is drawn in a
+// small built-in font of capitals, digits and some punctuation, so
+// keys are shown in capitals.
+//
+func RenderPNG(w io.Writer, res *Result, opts GraphOptions) error {
+	g, err := newGraph(res, opts)
+	if err != nil {
+		return err
+	}
+	img := image.NewRGBA(image.Rect(0, 0, g.width, g.height))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	grid := color.RGBA{ 0xe0, 0xe0, 0xe0, 0xff }
+	frame := color.RGBA{ 0x80, 0x80, 0x80, 0xff }
+	ink := color.RGBA{ 0x20, 0x20, 0x20, 0xff }
+
+	if opts.Title != "" {
+		drawText(img, opts.Title, (g.width - len(opts.Title) * glyphAdvance) / 2, 10, ink)
+	}
+	for _, v := range g.valueTicks {
+		y := g.y(v)
+		drawLine(img, float64(g.left), y, float64(g.right), y, grid)
+		label := formatValue(v)
+		drawText(img, label, g.left - 6 - len(label) * glyphAdvance, int(y) - glyphHeight / 2, ink)
+	}
+	for _, ts := range g.timeTicks {
+		x := g.x(ts)
+		drawLine(img, x, float64(g.top), x, float64(g.bottom), grid)
+		label := time.Unix(ts, 0).In(g.opts.Location).Format(g.timeFormat)
+		lx := int(x) - len(label) * glyphAdvance / 2
+		if lx + len(label) * glyphAdvance > g.width {
+			lx = g.width - len(label) * glyphAdvance
+		}
+		drawText(img, label, lx, g.bottom + 6, ink)
+	}
+	l, t, r, b := float64(g.left), float64(g.top), float64(g.right), float64(g.bottom)
+	drawLine(img, l, t, r, t, frame)
+	drawLine(img, l, b, r, b, frame)
+	drawLine(img, l, t, l, b, frame)
+	drawLine(img, r, t, r, b, frame)
+
+	for i, k := range g.keys {
+		c := g.colors[i]
+		g.lines(k, func(pts [][2]float64) {
+			if len(pts) == 1 {
+				drawLine(img, pts[0][0], pts[0][1], pts[0][0], pts[0][1], c)
+			}
+			for j := 1; j < len(pts); j++ {
+				drawLine(img, pts[j - 1][0], pts[j - 1][1], pts[j][0], pts[j][1], c)
+			}
+		})
+	}
+	x := g.left
+	for i, k := range g.keys {
+		for dy := 0; dy < glyphHeight; dy++ {
+			for dx := 0; dx < glyphHeight; dx++ {
+				img.SetRGBA(x + dx, g.height - glyphHeight - 8 + dy, g.colors[i])
+			}
+		}
+		drawText(img, k, x + glyphHeight + 4, g.height - glyphHeight - 8, ink)
+		x += glyphHeight + 4 + len(k) * glyphAdvance + 12
+	}
+	return png.Encode(w, img)
+}
+
+//
+// Draw a line from (x0, y0) to (x1, y1), two pixels wide.
+//
+func drawLine(img *image.RGBA, x0, y0, x1, y1 float64, c color.RGBA) {
+	steps := int(math.Max(math.Abs(x1 - x0), math.Abs(y1 - y0))) + 1
+	for i := 0; i <= steps; i++ {
+		f := float64(i) / float64(steps)
+		x := int(math.Round(x0 + (x1 - x0) * f))
+		y := int(math.Round(y0 + (y1 - y0) * f))
+		img.SetRGBA(x, y, c)
+		if x0 != x1 || y0 != y1 {
+			img.SetRGBA(x, y + 1, c)
+		}
+	}
+}
+
+//
+// A 3x5 font: each glyph is its rows, top to bottom, as "#" for ink.
+//
+var glyphs = map[rune]string{
+	'A': ".#.#.#####.##.#", 'B': "##.#.###.#.###.", 'C': ".###..#..#...##",
+	'D': "##.#.##.##.###.", 'E': "####..##.#..###", 'F': "####..##.#..#..",
+	'G': ".###..#.##.#.##", 'H': "#.##.#####.##.#", 'I': "###.#..#..#.###",
+	'J': "..#..#..##.#.#.", 'K': "#.##.###.#.##.#", 'L': "#..#..#..#..###",
+	'M': "#.########.##.#", 'N': "##.#.##.##.##.#", 'O': ".#.#.##.##.#.#.",
+	'P': "##.#.###.#..#..", 'Q': ".#.#.##.###..##", 'R': "##.#.###.#.##.#",
+	'S': ".###...#...###.", 'T': "###.#..#..#..#.", 'U': "#.##.##.##.####",
+	'V': "#.##.##.##.#.#.", 'W': "#.##.########.#", 'X': "#.##.#.#.#.##.#",
+	'Y': "#.##.#.#..#..#.", 'Z': "###..#.#.#..###", '0': "####.##.##.####",
+	'1': ".#.##..#..#.###", '2': "##...#.#.#..###", '3': "##...#.#...###.",
+	'4': "#.##.####..#..#", '5': "####..##...###.", '6': ".###..####.####",
+	'7': "###..#.#..#..#.", '8': "####.#####.####", '9': "####.####..###.",
+	'.': ".............#.", '-': "......###......", ':': "....#.....#....",
+	'_': "............###", '/': "..#..#.#.#..#..", ',': "..........#.#..",
+	'+': "....#.###.#....", '%': "#....#.#.#....#", '(': ".#.#..#..#...#.",
+	')': ".#...#..#..#.#.", '=': "...###...###...", '*': "...#.#.#.#.#...",
+	'?': "##...#.#.....#.", ' ': "...............",
+}
+
+func drawText(img *image.RGBA, s string, x, y int, c color.RGBA) {
+	for _, r := range strings.ToUpper(s) {
+		glyph, ok := glyphs[r]
+		if !ok {
+			glyph = glyphs['?']
+		}
+		for i, p := range glyph {
+			if p != '#' {
+				continue
+			}
+			gx, gy := x + i % 3 * glyphScale, y + i / 3 * glyphScale
+			for dy := 0; dy < glyphScale; dy++ {
+				for dx := 0; dx < glyphScale; dx++ {
+					img.SetRGBA(gx + dx, gy + dy, c)
+				}
+			}
+		}
+		x += glyphAdvance
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package graphite accepts metrics in the Carbon protocols Graphite
+clients send, writing them into a tissa.DB, so anything that can
+report to Graphite can report to tissa:
+
+	db, _ := tissa.OpenDB("/var/lib/tissa")
+	s := graphite.NewServer(db)
+	l, _ := net.Listen("tcp", ":2003")
+	go s.Serve(l)
+	p, _ := net.Listen("tcp", ":2004")
+	go s.ServePickle(p)
+
+The plaintext protocol is a line per value:
+
+	servers.web1.cpu 0.75 1560628800
+
+A timestamp of -1 means now.  The pickle protocol is batches of
+pickled [(path, (timestamp, value)), ...] lists, each preceded by its
+length as a 4-byte big-endian integer.  Only the plain data types
+such a list is made of are unpickled.
+
+Metric paths are mapped to a series and key by the server's Mapper;
+by default the first component of the path names the series and the
+rest is the key, so the line above adds "web1.cpu" to the series
+"servers".  Series are created with the DB's defaults as needed.
+Lines that can't be parsed or stored are skipped and reported to
+OnError, if set; the connection carries on.
+
+History kept in Graphite's Whisper files can be moved over with
+ImportWhisper, and moved back with ExportWhisper.
+*/
+package graphite
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fred-lewis/tissa"
+)
+
+//
+// Maps a metric path to the series and key its values are added
+// to.
+//
+type Mapper func(path string) (series, key string, err error)
+
+//
+// The first component of the path is the series, the rest the key.
+//
+func DefaultMapper(path string) (series, key string, err error) {
+	i := strings.IndexByte(path, '.')
+	if i <= 0 || i == len(path) - 1 {
+		return "", "", fmt.Errorf("metric path %q has no key", path)
+	}
+	return path[:i], path[i + 1:], nil
+}
+
+type Server struct {
+	db *tissa.DB
+	// maps metric paths; DefaultMapper if nil
+	Mapper Mapper
+	// called with each metric that couldn't be stored, if set
+	OnError func(error)
+}
+
+// The largest pickled batch accepted, as for Carbon.
+const maxPickle = 1 << 20
+
+func NewServer(db *tissa.DB) *Server {
+	return &Server{ db: db }
+}
+
+//
+// Accept plaintext connections on l until it's closed.  Each
+// connection is served by a goroutine of its own.
+//
+func (s *Server) Serve(l net.Listener) error {
+	return s.accept(l, s.ServeConn)
+}
+
+//
+// Accept pickle connections on l until it's closed.
+//
+func (s *Server) ServePickle(l net.Listener) error {
+	return s.accept(l, s.ServePickleConn)
+}
+
+func (s *Server) accept(l net.Listener, serve func(io.ReadCloser) error) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serve(conn)
+	}
+}
+
+//
+// Read plaintext lines from conn until the client hangs up, then
+// close it.
+//
+func (s *Server) ServeConn(conn io.ReadCloser) error {
+	defer conn.Close()
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		path, val, timestamp, err := parseLine(line)
+		if err == nil {
+			err = s.add(path, val, timestamp)
+		}
+		s.report(err)
+	}
+	return sc.Err()
+}
+
+//
+// Read pickled batches from conn until the client hangs up, then
+// close it.  A batch that can't be unpickled closes the connection.
+//
+func (s *Server) ServePickleConn(conn io.ReadCloser) error {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		n := binary.BigEndian.Uint32(hdr[:])
+		if n > maxPickle {
+			err := fmt.Errorf("pickled batch of %d bytes is too large", n)
+			s.report(err)
+			return err
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return err
+		}
+		v, err := unpickle(buf)
+		if err == nil {
+			err = s.addPickled(v)
+		}
+		if err != nil {
+			s.report(err)
+			return err
+		}
+	}
+}
+
+func (s *Server) report(err error) {
+	if err != nil && s.OnError != nil {
+		s.OnError(err)
+	}
+}
+
+//
+// Parse "path value timestamp".
+//
+func parseLine(line string) (path string, val float64, timestamp int64, err error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return "", 0, 0, fmt.Errorf("bad line %q", line)
+	}
+	if val, err = strconv.ParseFloat(fields[1], 64); err != nil {
+		return "", 0, 0, fmt.Errorf("bad value in %q", line)
+	}
+	// some clients send fractional timestamps
+	ts, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil || math.IsNaN(ts) || math.IsInf(ts, 0) {
+		return "", 0, 0, fmt.Errorf("bad timestamp in %q", line)
+	}
+	return fields[0], val, int64(ts), nil
+}
+
+//
+// Add the values of a pickled [(path, (timestamp, value)), ...] list.
+// Entries that don't have that shape are skipped and reported.
+//
+func (s *Server) addPickled(v interface{}) error {
+	list, ok := v.([]interface{})
+	if !ok {
+		return errors.New("pickled batch isn't a list")
+	}
+	for _, e := range list {
+		path, val, timestamp, err := pickledMetric(e)
+		if err == nil {
+			err = s.add(path, val, timestamp)
+		}
+		s.report(err)
+	}
+	return nil
+}
+
+func pickledMetric(e interface{}) (string, float64, int64, error) {
+	bad := fmt.Errorf("bad pickled metric %v", e)
+	pair, ok := e.([]interface{})
+	if !ok || len(pair) != 2 {
+		return "", 0, 0, bad
+	}
+	path, ok := pair[0].(string)
+	datapoint, _ := pair[1].([]interface{})
+	if !ok || len(datapoint) != 2 {
+		return "", 0, 0, bad
+	}
+	ts, ok1 := pickledNumber(datapoint[0])
+	val, ok2 := pickledNumber(datapoint[1])
+	if !ok1 || !ok2 || math.IsNaN(ts) || math.IsInf(ts, 0) {
+		return "", 0, 0, bad
+	}
+	return path, val, int64(ts), nil
+}
+
+func pickledNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func (s *Server) add(path string, val float64, timestamp int64) error {
+	mapper := s.Mapper
+	if mapper == nil {
+		mapper = DefaultMapper
+	}
+	series, key, err := mapper(path)
+	if err != nil {
+		return err
+	}
+	if timestamp < 0 {
+		timestamp = time.Now().Unix()
+	}
+	if err = s.db.AddValues(series, map[string]float64{ key: val }, timestamp); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package graphite
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fred-lewis/tissa"
+)
+
+func pickleFrame(p string) io.ReadCloser {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(p)))
+	buf.WriteString(p)
+	return io.NopCloser(&buf)
+}
+
+func TestServer(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/graphite")
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+
+	db, err := tissa.NewDB("/tmp/timeseries_test/graphite", tissa.TimeSeriesConfig{
+		Archives: []tissa.ArchiveConfig{
+			{Resolution: tissa.SECOND, Retention: tissa.HOUR},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(db)
+	var errs []error
+	s.OnError = func(err error) { errs = append(errs, err) }
+
+	lines := "servers.web1.cpu 0.75 1560628800\n" +
+		"servers.web2.cpu 1 1560628800.5\n" +
+		"\n" +
+		"nokey 1 1560628800\n" +
+		"servers.web1.mem oops 1560628800\n" +
+		"servers.web1.cpu 0.5 1560628801\n"
+	if err = s.ServeConn(io.NopCloser(strings.NewReader(lines))); err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 2 {
+		t.Errorf("Expected 2 bad lines reported, got %v", errs)
+	}
+	ts, err := db.Series("servers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vals, timestamp := ts.Latest()
+	if timestamp != 1560628801 || vals["web1.cpu"] != 0.5 {
+		t.Errorf("Latest after plaintext was %v at %d", vals, timestamp)
+	}
+	if v, _, ok, _ := ts.LatestFor("web2.cpu"); !ok || v != 1 {
+		t.Errorf("Expected web2.cpu 1, got %g", v)
+	}
+
+	// [('servers.web1.cpu', (1560628802, 0.5)), ('servers.web2.cpu', (1560628802, 1)),
+	//  ('servers.web1.cpu', (1560628803, '0.25'))], in protocols 0 and 2
+	protocol0 := "(lp0\n(Vservers.web1.cpu\np1\n(I1560628802\nF0.5\ntp2\ntp3\na(Vservers.web2.cpu\np4\n" +
+		"(I1560628802\nI1\ntp5\ntp6\na(g1\n(I1560628803\nV0.25\np7\ntp8\ntp9\na."
+	protocol2 := "\x80\x02]q\x00(X\x10\x00\x00\x00servers.web1.cpuq\x01JBN\x05]G?\xe0\x00\x00\x00\x00\x00\x00" +
+		"\x86q\x02\x86q\x03X\x10\x00\x00\x00servers.web2.cpuq\x04JBN\x05]K\x01\x86q\x05\x86q\x06h\x01JCN\x05]" +
+		"X\x04\x00\x00\x000.25q\x07\x86q\x08\x86q\te."
+	for _, p := range []string{ protocol0, protocol2 } {
+		errs = nil
+		if err = s.ServePickleConn(pickleFrame(p)); err != nil || len(errs) > 0 {
+			t.Fatalf("Pickle failed: %v %v", err, errs)
+		}
+		vals, timestamp = ts.Latest()
+		if timestamp != 1560628803 || vals["web1.cpu"] != 0.25 {
+			t.Errorf("Latest after pickle was %v at %d", vals, timestamp)
+		}
+		if v, at, _, _ := ts.LatestFor("web2.cpu"); v != 1 || at != 1560628802 {
+			t.Errorf("Expected web2.cpu 1 at 1560628802, got %g at %d", v, at)
+		}
+	}
+
+	// globals aren't unpickled
+	err = s.ServePickleConn(pickleFrame("cos\nsystem\n(S'true'\ntR."))
+	if !errors.Is(err, errBadPickle) {
+		t.Errorf("Expected a global to be refused, got %v", err)
+	}
+
+	s.Mapper = func(path string) (string, string, error) {
+		return "all", path, nil
+	}
+	s.ServeConn(io.NopCloser(strings.NewReader("nokey 2 1560628800\n")))
+	ts, err = db.Series("all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _, ok, _ := ts.LatestFor("nokey"); !ok || v != 2 {
+		t.Errorf("Expected the mapper to add nokey 2, got %g", v)
+	}
+}
+
+func TestConcurrentConns(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/graphite_concurrent")
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+
+	db, err := tissa.NewDB("/tmp/timeseries_test/graphite_concurrent", tissa.TimeSeriesConfig{
+		Archives: []tissa.ArchiveConfig{
+			{Resolution: tissa.SECOND, Retention: tissa.HOUR},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(db)
+	s.OnError = func(err error) { t.Error(err) }
+
+	// connections adding to the same series at once
+	var wg sync.WaitGroup
+	for c := 0; c < 4; c++ {
+		var lines strings.Builder
+		for i := 0; i < 100; i++ {
+			fmt.Fprintf(&lines, "servers.web%d.cpu %d %d\n", c, i, 1560628800 + i)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.ServeConn(io.NopCloser(strings.NewReader(lines.String())))
+		}()
+	}
+	wg.Wait()
+	ts, err := db.Series("servers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := ts.Keys(); len(keys) == 0 {
+		t.Errorf("No keys after concurrent connections")
+	}
+}
+
+// A Whisper file; archives are seconds per point, then points, then
+// the (timestamp, value) pairs in their ring, by slot.
+func whisperFile(agg WhisperAggregation, archives ...[]float64) []byte {
+	var buf bytes.Buffer
+	be := binary.BigEndian
+	binary.Write(&buf, be, []uint32{ uint32(agg), 0 })
+	binary.Write(&buf, be, float32(0.5))
+	binary.Write(&buf, be, uint32(len(archives)))
+	offset := whisperHeaderSize + whisperArchiveSize * len(archives)
+	for _, a := range archives {
+		binary.Write(&buf, be, []uint32{ uint32(offset), uint32(a[0]), uint32(a[1]) })
+		offset += whisperPointSize * int(a[1])
+	}
+	for _, a := range archives {
+		ring := make([]byte, whisperPointSize * int(a[1]))
+		for slot, p := 0, a[2:]; len(p) >= 2; slot, p = slot + 1, p[2:] {
+			be.PutUint32(ring[slot * whisperPointSize:], uint32(p[0]))
+			be.PutUint64(ring[slot * whisperPointSize + 4:], math.Float64bits(p[1]))
+		}
+		buf.Write(ring)
+	}
+	return buf.Bytes()
+}
+
+func TestImportWhisper(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/whisper")
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+
+	start := float64(1560628800)
+	file := whisperFile(WHISPER_MAX,
+		// a stale point the ring has wrapped past, and one never written
+		[]float64{ 1, 4, start + 118, 2, start + 10, 99, start + 119, 3, start + 117, 1 },
+		[]float64{ 60, 3, 0, 0, start, 5, start + 60, 6 },
+	)
+	ts, err := ImportWhisper("/tmp/timeseries_test/whisper", "cpu", bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archives := ts.Config().Archives; len(archives) != 2 || archives[1].Retention != 180 ||
+		archives[1].Aggregation != tissa.AGGREGATE_MAX {
+		t.Errorf("Archives were %+v", archives)
+	}
+
+	res, err := ts.Query(int64(start) + 116, int64(start) + 120, tissa.SECOND, tissa.AGGREGATE_AVERAGE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(res.Values["cpu"][1:]) != "[1 2 3]" || !res.Missing["cpu"][0] {
+		t.Errorf("Seconds were %v", res.Values["cpu"])
+	}
+	// rollups are stamped with the end of their minute
+	res, err = ts.Query(int64(start) + 60, int64(start) + 180, tissa.MINUTE, tissa.AGGREGATE_MAX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(res.Values["cpu"]) != "[5 6]" {
+		t.Errorf("Minutes were %v", res.Values["cpu"])
+	}
+
+	if _, err = ImportWhisper("/tmp/timeseries_test/whisper2", "cpu", bytes.NewReader(file[:20])); !errors.Is(err, ErrBadWhisper) {
+		t.Errorf("Truncated file gave %v", err)
+	}
+}
+
+func TestExportWhisper(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/whisper_export")
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+
+	start := float64(1560628800)
+	file := whisperFile(WHISPER_SUM,
+		[]float64{ 1, 4, start + 118, 2, start + 119, 3, start + 117, 1 },
+		[]float64{ 60, 3, start, 5, start + 60, 6 },
+	)
+	want, err := ReadWhisper(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := ImportWhisper("/tmp/timeseries_test/whisper_export", "cpu", bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err = ExportWhisper(&buf, ts, "cpu"); err != nil {
+		t.Fatal(err)
+	}
+	// the oldest point of each archive is in its first slot
+	data := buf.Bytes()
+	if base := binary.BigEndian.Uint32(data[whisperHeaderSize:]); binary.BigEndian.Uint32(data[base:]) != uint32(start) + 117 {
+		t.Errorf("first slot held %d", binary.BigEndian.Uint32(data[base:]))
+	}
+	got, err := ReadWhisper(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Aggregation != WHISPER_SUM || len(got.Archives) != 2 {
+		t.Fatalf("Exported %+v", got)
+	}
+	for i, a := range got.Archives {
+		w := want.Archives[i]
+		if a.SecondsPerPoint != w.SecondsPerPoint || a.Points != w.Points ||
+			fmt.Sprint(a.Timestamps, a.Values) != fmt.Sprint(w.Timestamps, w.Values) {
+			t.Errorf("Archive %d was %+v, not %+v", i, a, w)
+		}
+	}
+}
@@ -0,0 +1,465 @@
+package graphite
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+//
+// A small unpickler for the data Carbon clients send: lists and
+// tuples of strings and numbers, in any pickle protocol.  Lists and
+// tuples both come out as []interface{}, strings (and bytes) as
+// string, integers as int64 and floats as float64.  Anything else,
+// in particular globals and object construction, is an error, so
+// clients can't run code in the server.
+//
+
+var errBadPickle = errors.New("bad pickle")
+
+// Pickle opcodes.
+const (
+	opMark           = '('
+	opStop           = '.'
+	opPop            = '0'
+	opPopMark        = '1'
+	opDup            = '2'
+	opFloat          = 'F'
+	opInt            = 'I'
+	opBinInt         = 'J'
+	opBinInt1        = 'K'
+	opLong           = 'L'
+	opBinInt2        = 'M'
+	opNone           = 'N'
+	opString         = 'S'
+	opBinString      = 'T'
+	opShortBinString = 'U'
+	opUnicode        = 'V'
+	opBinUnicode     = 'X'
+	opAppend         = 'a'
+	opGet            = 'g'
+	opBinGet         = 'h'
+	opLongBinGet     = 'j'
+	opList           = 'l'
+	opPut            = 'p'
+	opBinPut         = 'q'
+	opLongBinPut     = 'r'
+	opTuple          = 't'
+	opAppends        = 'e'
+	opEmptyList      = ']'
+	opEmptyTuple     = ')'
+	opBinFloat       = 'G'
+	opBinBytes       = 'B'
+	opShortBinBytes  = 'C'
+	opProto          = 0x80
+	opTuple1         = 0x85
+	opTuple2         = 0x86
+	opTuple3         = 0x87
+	opNewTrue        = 0x88
+	opNewFalse       = 0x89
+	opLong1          = 0x8a
+	opShortBinUnicode = 0x8c
+	opMemoize        = 0x94
+	opFrame          = 0x95
+)
+
+// A list, which may be appended to after it's memoized.
+type pickleList struct {
+	items []interface{}
+}
+
+// Marks the stack position opMark pushed.
+type pickleMark struct{}
+
+type unpickler struct {
+	buf   []byte
+	stack []interface{}
+	memo  map[int]interface{}
+	// items resolved so far
+	items int
+}
+
+func unpickle(buf []byte) (interface{}, error) {
+	u := &unpickler{ buf: buf, memo: make(map[int]interface{}) }
+	v, err := u.run()
+	if err == nil {
+		v, err = u.resolve(v, 0)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadPickle, err)
+	}
+	return v, nil
+}
+
+// How deeply lists may nest, which also stops lists that contain
+// themselves, and how many items they may hold in all, counting
+// each time one's repeated through the memo.
+const (
+	maxPickleDepth = 16
+	maxPickleItems = 1 << 20
+)
+
+//
+// Replace pickleLists with their items, throughout v.
+//
+func (u *unpickler) resolve(v interface{}, depth int) (interface{}, error) {
+	if depth > maxPickleDepth {
+		return nil, errors.New("nested too deeply")
+	}
+	switch x := v.(type) {
+	case pickleMark:
+		return nil, errors.New("unmatched mark")
+	case *pickleList:
+		return u.resolve(x.items, depth)
+	case []interface{}:
+		if u.items += len(x); u.items > maxPickleItems {
+			return nil, errors.New("too many items")
+		}
+		out := make([]interface{}, len(x))
+		for i, e := range x {
+			var err error
+			if out[i], err = u.resolve(e, depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+func (u *unpickler) next(n int) ([]byte, error) {
+	if n < 0 || n > len(u.buf) {
+		return nil, errors.New("truncated")
+	}
+	b := u.buf[:n]
+	u.buf = u.buf[n:]
+	return b, nil
+}
+
+func (u *unpickler) line() (string, error) {
+	i := bytes.IndexByte(u.buf, '\n')
+	if i < 0 {
+		return "", errors.New("truncated")
+	}
+	s := string(u.buf[:i])
+	u.buf = u.buf[i + 1:]
+	return s, nil
+}
+
+func (u *unpickler) uint(n int) (int, error) {
+	b, err := u.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for i := n - 1; i >= 0; i-- {
+		v = v << 8 | uint64(b[i])
+	}
+	if v > math.MaxInt32 {
+		return 0, errors.New("length out of range")
+	}
+	return int(v), nil
+}
+
+func (u *unpickler) push(v interface{}) {
+	u.stack = append(u.stack, v)
+}
+
+func (u *unpickler) pop() (interface{}, error) {
+	n := len(u.stack)
+	if n == 0 {
+		return nil, errors.New("stack underflow")
+	}
+	v := u.stack[n - 1]
+	u.stack = u.stack[:n - 1]
+	return v, nil
+}
+
+func (u *unpickler) top() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, errors.New("stack underflow")
+	}
+	return u.stack[len(u.stack) - 1], nil
+}
+
+//
+// Pop everything above the topmost mark, and the mark.
+//
+func (u *unpickler) popMark() ([]interface{}, error) {
+	for i := len(u.stack) - 1; i >= 0; i-- {
+		if _, ok := u.stack[i].(pickleMark); ok {
+			items := append([]interface{}(nil), u.stack[i + 1:]...)
+			u.stack = u.stack[:i]
+			return items, nil
+		}
+	}
+	return nil, errors.New("no mark")
+}
+
+func (u *unpickler) popN(n int) ([]interface{}, error) {
+	if len(u.stack) < n {
+		return nil, errors.New("stack underflow")
+	}
+	items := append([]interface{}(nil), u.stack[len(u.stack) - n:]...)
+	u.stack = u.stack[:len(u.stack) - n]
+	return items, nil
+}
+
+func (u *unpickler) appendTo(items ...interface{}) error {
+	v, err := u.top()
+	if err != nil {
+		return err
+	}
+	l, ok := v.(*pickleList)
+	if !ok {
+		return errors.New("append to a non-list")
+	}
+	l.items = append(l.items, items...)
+	return nil
+}
+
+func (u *unpickler) get(i int) error {
+	v, ok := u.memo[i]
+	if !ok {
+		return fmt.Errorf("no memo %d", i)
+	}
+	u.push(v)
+	return nil
+}
+
+func (u *unpickler) put(i int) error {
+	v, err := u.top()
+	if err == nil {
+		u.memo[i] = v
+	}
+	return err
+}
+
+//
+// Python's quoted string literal, as opString has it.
+//
+func unquote(s string) (string, error) {
+	if len(s) < 2 || (s[0] != '\'' && s[0] != '"') || s[len(s) - 1] != s[0] {
+		return "", errors.New("bad string")
+	}
+	if s[0] == '\'' {
+		s = `"` + strings.ReplaceAll(strings.ReplaceAll(s[1:len(s) - 1], `\'`, `'`), `"`, `\"`) + `"`
+	}
+	return strconv.Unquote(s)
+}
+
+//
+// A little-endian two's complement integer, as opLong1 has it.
+//
+func littleInt(b []byte) (int64, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	be := make([]byte, len(b))
+	for i := range b {
+		be[len(b) - 1 - i] = b[i]
+	}
+	n := new(big.Int).SetBytes(be)
+	if b[len(b) - 1] & 0x80 != 0 {
+		n.Sub(n, new(big.Int).Lsh(big.NewInt(1), uint(8 * len(b))))
+	}
+	if !n.IsInt64() {
+		return 0, errors.New("integer out of range")
+	}
+	return n.Int64(), nil
+}
+
+func (u *unpickler) run() (interface{}, error) {
+	for {
+		b, err := u.next(1)
+		if err != nil {
+			return nil, err
+		}
+		switch op := b[0]; op {
+		case opProto:
+			_, err = u.next(1)
+		case opFrame:
+			_, err = u.next(8)
+		case opStop:
+			v, err := u.pop()
+			if err == nil && len(u.stack) > 0 {
+				err = errors.New("data left on the stack")
+			}
+			return v, err
+		case opMark:
+			u.push(pickleMark{})
+		case opPop:
+			_, err = u.pop()
+		case opPopMark:
+			_, err = u.popMark()
+		case opDup:
+			var v interface{}
+			if v, err = u.top(); err == nil {
+				u.push(v)
+			}
+		case opNone:
+			u.push(nil)
+		case opNewTrue:
+			u.push(int64(1))
+		case opNewFalse:
+			u.push(int64(0))
+		case opInt, opLong:
+			var s string
+			if s, err = u.line(); err != nil {
+				break
+			}
+			s = strings.TrimSuffix(s, "L")
+			var n int64
+			if n, err = strconv.ParseInt(s, 10, 64); err == nil {
+				u.push(n)
+			}
+		case opBinInt:
+			var b []byte
+			if b, err = u.next(4); err == nil {
+				u.push(int64(int32(binary.LittleEndian.Uint32(b))))
+			}
+		case opBinInt1, opBinInt2:
+			n := 1
+			if op == opBinInt2 {
+				n = 2
+			}
+			var v int
+			if v, err = u.uint(n); err == nil {
+				u.push(int64(v))
+			}
+		case opLong1:
+			var n int
+			var b []byte
+			if n, err = u.uint(1); err == nil {
+				if b, err = u.next(n); err == nil {
+					var v int64
+					if v, err = littleInt(b); err == nil {
+						u.push(v)
+					}
+				}
+			}
+		case opFloat:
+			var s string
+			if s, err = u.line(); err != nil {
+				break
+			}
+			var f float64
+			if f, err = strconv.ParseFloat(s, 64); err == nil {
+				u.push(f)
+			}
+		case opBinFloat:
+			var b []byte
+			if b, err = u.next(8); err == nil {
+				u.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+			}
+		case opString:
+			var s string
+			if s, err = u.line(); err != nil {
+				break
+			}
+			if s, err = unquote(s); err == nil {
+				u.push(s)
+			}
+		case opUnicode:
+			var s string
+			if s, err = u.line(); err == nil {
+				if !utf8.ValidString(s) {
+					err = errors.New("bad unicode")
+				}
+				u.push(s)
+			}
+		case opBinString, opShortBinString, opBinUnicode, opShortBinUnicode, opBinBytes, opShortBinBytes:
+			n := 4
+			if op == opShortBinString || op == opShortBinUnicode || op == opShortBinBytes {
+				n = 1
+			}
+			var b []byte
+			if n, err = u.uint(n); err == nil {
+				if b, err = u.next(n); err == nil {
+					u.push(string(b))
+				}
+			}
+		case opEmptyList:
+			u.push(&pickleList{})
+		case opList:
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				u.push(&pickleList{ items: items })
+			}
+		case opAppend:
+			var v interface{}
+			if v, err = u.pop(); err == nil {
+				err = u.appendTo(v)
+			}
+		case opAppends:
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				err = u.appendTo(items...)
+			}
+		case opEmptyTuple:
+			u.push([]interface{}{})
+		case opTuple:
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				u.push(items)
+			}
+		case opTuple1, opTuple2, opTuple3:
+			var items []interface{}
+			if items, err = u.popN(int(op - opTuple1 + 1)); err == nil {
+				u.push(items)
+			}
+		case opPut:
+			var s string
+			if s, err = u.line(); err != nil {
+				break
+			}
+			var i int
+			if i, err = strconv.Atoi(s); err == nil {
+				err = u.put(i)
+			}
+		case opBinPut, opLongBinPut:
+			n := 1
+			if op == opLongBinPut {
+				n = 4
+			}
+			var i int
+			if i, err = u.uint(n); err == nil {
+				err = u.put(i)
+			}
+		case opMemoize:
+			err = u.put(len(u.memo))
+		case opGet:
+			var s string
+			if s, err = u.line(); err != nil {
+				break
+			}
+			var i int
+			if i, err = strconv.Atoi(s); err == nil {
+				err = u.get(i)
+			}
+		case opBinGet, opLongBinGet:
+			n := 1
+			if op == opLongBinGet {
+				n = 4
+			}
+			var i int
+			if i, err = u.uint(n); err == nil {
+				err = u.get(i)
+			}
+		default:
+			err = fmt.Errorf("unsupported opcode 0x%02x", op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package graphite
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/fred-lewis/tissa"
+)
+
+//
+// Whisper files, Graphite's storage, hold one metric in a number of
+// archives of decreasing resolution, each a fixed-size ring of
+// points.  ImportWhisper moves a file's history into a TimeSeries
+// with matching archives, for migrating from Graphite, and
+// ExportWhisper writes a key's history back out as one, for
+// Graphite and the whisper tools.
+//
+// A file is a header:
+//
+//	aggregation method, max retention, x-files factor, archive count
+//
+// then an (offset, seconds per point, points) entry for each archive,
+// finest first, then the archives, each a ring of (timestamp, value)
+// points.  Every number is big-endian: uint32s, but for the float32
+// x-files factor and float64 values.
+//
+
+type WhisperAggregation uint32
+
+const (
+	WHISPER_AVERAGE WhisperAggregation = iota + 1
+	WHISPER_SUM
+	WHISPER_LAST
+	WHISPER_MAX
+	WHISPER_MIN
+	WHISPER_AVG_ZERO
+	WHISPER_ABSMAX
+	WHISPER_ABSMIN
+)
+
+const (
+	whisperHeaderSize  = 16
+	whisperArchiveSize = 12
+	whisperPointSize   = 12
+)
+
+var ErrBadWhisper = errors.New("not a whisper file")
+
+//
+// The contents of a Whisper file.
+//
+type Whisper struct {
+	Aggregation  WhisperAggregation
+	XFilesFactor float32
+	// finest first
+	Archives     []WhisperArchive
+}
+
+//
+// A Whisper archive: its resolution and size, and the points it
+// holds, oldest first.  Slots of the ring that were never written,
+// or hold points too old to be in the archive, are left out.
+//
+type WhisperArchive struct {
+	SecondsPerPoint int64
+	Points          int64
+	Timestamps      []int64
+	Values          []float64
+}
+
+func (a *WhisperArchive) Retention() int64 {
+	return a.SecondsPerPoint * a.Points
+}
+
+//
+// Read a Whisper file.
+//
+func ReadWhisper(r io.Reader) (*Whisper, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < whisperHeaderSize {
+		return nil, ErrBadWhisper
+	}
+	be := binary.BigEndian
+	w := &Whisper{
+		Aggregation: WhisperAggregation(be.Uint32(data)),
+		XFilesFactor: math.Float32frombits(be.Uint32(data[8:])),
+	}
+	count := int(be.Uint32(data[12:]))
+	if count == 0 || len(data) < whisperHeaderSize + count * whisperArchiveSize {
+		return nil, ErrBadWhisper
+	}
+
+	for i := 0; i < count; i++ {
+		info := data[whisperHeaderSize + i * whisperArchiveSize:]
+		offset, spp, points := int64(be.Uint32(info)), int64(be.Uint32(info[4:])), int64(be.Uint32(info[8:]))
+		if spp == 0 || offset + points * whisperPointSize > int64(len(data)) {
+			return nil, fmt.Errorf("archive %d: %w", i, ErrBadWhisper)
+		}
+		if i > 0 && spp % w.Archives[i - 1].SecondsPerPoint != 0 {
+			return nil, fmt.Errorf("archive %d: %d seconds per point isn't a multiple of the finer archive's: %w",
+				i, spp, ErrBadWhisper)
+		}
+		a := WhisperArchive{ SecondsPerPoint: spp, Points: points }
+		a.read(data[offset:offset + points * whisperPointSize])
+		w.Archives = append(w.Archives, a)
+	}
+	return w, nil
+}
+
+func (a *WhisperArchive) read(ring []byte) {
+	be := binary.BigEndian
+	type point struct {
+		ts int64
+		v  float64
+	}
+	var pts []point
+	latest := int64(0)
+	for p := 0; p + whisperPointSize <= len(ring); p += whisperPointSize {
+		ts := int64(be.Uint32(ring[p:]))
+		if ts == 0 {
+			continue
+		}
+		pts = append(pts, point{ ts, math.Float64frombits(be.Uint64(ring[p + 4:])) })
+		if ts > latest {
+			latest = ts
+		}
+	}
+	sort.Slice(pts, func(i, j int) bool { return pts[i].ts < pts[j].ts })
+	for _, p := range pts {
+		// slots the ring has since wrapped past
+		if p.ts <= latest - a.Retention() {
+			continue
+		}
+		a.Timestamps = append(a.Timestamps, p.ts)
+		a.Values = append(a.Values, p.v)
+	}
+}
+
+//
+// The aggregation the matching tissa archives answer Values queries
+// with.
+//
+func (agg WhisperAggregation) aggregation() tissa.Aggregation {
+	switch agg {
+	case WHISPER_SUM:
+		return tissa.AGGREGATE_SUM
+	case WHISPER_LAST:
+		return tissa.AGGREGATE_LAST
+	case WHISPER_MAX, WHISPER_ABSMAX:
+		return tissa.AGGREGATE_MAX
+	case WHISPER_MIN, WHISPER_ABSMIN:
+		return tissa.AGGREGATE_MIN
+	}
+	return tissa.AGGREGATE_AVERAGE
+}
+
+//
+// A rollup of a single point standing for a whole interval.
+//
+func pointRollup(v float64, interval int64) tissa.Rollup {
+	return tissa.Rollup{
+		Total: v, Count: 1, Min: v, Max: v, SumSq: v * v, First: v, Last: v,
+		Weighted: v * float64(interval), Duration: float64(interval),
+	}
+}
+
+//
+// Create a TimeSeries in dir with an archive for each of the Whisper
+// file's, and add its history under key.  Each point of a coarser
+// archive becomes a rollup of that one value, so Values and
+// Averages queries answer as Graphite would, but counts are of
+// points rather than of the datapoints Graphite aggregated.
+//
+func ImportWhisper(dir, key string, r io.Reader) (*tissa.TimeSeries, error) {
+	w, err := ReadWhisper(r)
+	if err != nil {
+		return nil, err
+	}
+	config := tissa.TimeSeriesConfig{}
+	for _, a := range w.Archives {
+		config.Archives = append(config.Archives, tissa.ArchiveConfig{
+			Resolution: a.SecondsPerPoint,
+			Retention: a.Retention(),
+			Aggregation: w.Aggregation.aggregation(),
+		})
+	}
+	ts, err := tissa.NewTimeSeries(dir, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// the coarser archives first, as the finest, added as values, only
+	// rolls up into them past their latest points.  Whisper stamps
+	// points with the start of their interval, and tissa rollups with
+	// the end.
+	for _, a := range w.Archives[1:] {
+		for i, stamp := range a.Timestamps {
+			rollup := map[string]tissa.Rollup{ key: pointRollup(a.Values[i], a.SecondsPerPoint) }
+			if err = ts.AddRollups(a.SecondsPerPoint, rollup, stamp + a.SecondsPerPoint); err != nil {
+				return nil, err
+			}
+		}
+	}
+	base := w.Archives[0]
+	for i, stamp := range base.Timestamps {
+		if err = ts.AddValue(key, base.Values[i], stamp); err != nil {
+			return nil, err
+		}
+	}
+	if err = ts.Write(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+//
+// Write w as a Whisper file.  Each archive's ring is laid out as
+// Whisper lays it out, relative to its oldest point; points that
+// don't fit in it overwrite older ones.
+//
+func WriteWhisper(out io.Writer, w *Whisper) error {
+	be := binary.BigEndian
+	maxRetention := int64(0)
+	for _, a := range w.Archives {
+		if a.Retention() > maxRetention {
+			maxRetention = a.Retention()
+		}
+	}
+	header := make([]byte, whisperHeaderSize + whisperArchiveSize * len(w.Archives))
+	be.PutUint32(header, uint32(w.Aggregation))
+	be.PutUint32(header[4:], uint32(maxRetention))
+	be.PutUint32(header[8:], math.Float32bits(w.XFilesFactor))
+	be.PutUint32(header[12:], uint32(len(w.Archives)))
+	offset := int64(len(header))
+	for i, a := range w.Archives {
+		info := header[whisperHeaderSize + i * whisperArchiveSize:]
+		be.PutUint32(info, uint32(offset))
+		be.PutUint32(info[4:], uint32(a.SecondsPerPoint))
+		be.PutUint32(info[8:], uint32(a.Points))
+		offset += a.Points * whisperPointSize
+	}
+	if _, err := out.Write(header); err != nil {
+		return err
+	}
+
+	for _, a := range w.Archives {
+		ring := make([]byte, a.Points * whisperPointSize)
+		for i, ts := range a.Timestamps {
+			slot := (ts - a.Timestamps[0]) / a.SecondsPerPoint % a.Points
+			be.PutUint32(ring[slot * whisperPointSize:], uint32(ts))
+			be.PutUint64(ring[slot * whisperPointSize + 4:], math.Float64bits(a.Values[i]))
+		}
+		if _, err := out.Write(ring); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// The Whisper aggregation method for a tissa aggregation.
+//
+func whisperAggregation(agg tissa.Aggregation) WhisperAggregation {
+	switch agg {
+	case tissa.AGGREGATE_SUM:
+		return WHISPER_SUM
+	case tissa.AGGREGATE_LAST:
+		return WHISPER_LAST
+	case tissa.AGGREGATE_MAX:
+		return WHISPER_MAX
+	case tissa.AGGREGATE_MIN:
+		return WHISPER_MIN
+	}
+	return WHISPER_AVERAGE
+}
+
+//
+// Write key's history in ts to out as a Whisper file, with an
+// archive for each of the series', as many points long as its
+// retention allows.  Rollup archives are reduced by their
+// Aggregation, which, for the first of them, is also the file's
+// aggregation method.  Missing values are left out.
+//
+func ExportWhisper(out io.Writer, ts *tissa.TimeSeries, key string) error {
+	config := ts.Config()
+	w := &Whisper{ Aggregation: WHISPER_AVERAGE, XFilesFactor: 0.5 }
+	for i, ac := range config.Archives {
+		if i == 1 {
+			w.Aggregation = whisperAggregation(ac.Aggregation)
+		}
+		a := WhisperArchive{ SecondsPerPoint: ac.Resolution, Points: ac.Retention / ac.Resolution }
+		if a.Points < 1 {
+			a.Points = 1
+		}
+		start, end, err := ts.TimeRange(ac.Resolution)
+		if err != nil {
+			return err
+		}
+		if end - start > a.Retention() {
+			start = end - a.Retention()
+		}
+		if end > 0 {
+			// rollups are stamped with the end of their interval, and
+			// Whisper points with the start
+			agg, shift := ac.Aggregation, ac.Resolution
+			if i == 0 {
+				agg, shift = tissa.AGGREGATE_AVERAGE, 0
+			}
+			res, err := ts.Query(start, end, ac.Resolution, agg,
+				tissa.QueryOptions{ Keys: tissa.Keys(key), Fill: tissa.FILL_NAN })
+			if err != nil {
+				return err
+			}
+			for j, stamp := range res.Timestamps {
+				if v, missing := res.Values[key], res.Missing[key]; j < len(v) && !missing[j] {
+					a.Timestamps = append(a.Timestamps, stamp - shift)
+					a.Values = append(a.Values, v[j])
+				}
+			}
+		}
+		w.Archives = append(w.Archives, a)
+	}
+	return WriteWhisper(out, w)
+}
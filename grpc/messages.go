@@ -0,0 +1,515 @@
+package grpc
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+//
+// The messages of tissa.proto, encoded by hand in the protobuf wire
+// format so the package needs no generated code.
+//
+type message interface {
+	marshal(b []byte) []byte
+	unmarshal(b []byte) error
+}
+
+type AddValuesRequest struct {
+	Namespace string
+	Series    string
+	Timestamp int64
+	Values    map[string]float64
+}
+
+type AddValuesResponse struct {
+	Count int64
+}
+
+// How a query fills missing values; the same as tissa.FillPolicy.
+type Fill int32
+
+const (
+	FILL_DEFAULT Fill = iota
+	FILL_NAN
+	FILL_PREVIOUS
+	FILL_LINEAR
+	FILL_CONSTANT
+)
+
+type QueryRequest struct {
+	Namespace   string
+	Series      string
+	StartTime   int64
+	EndTime     int64
+	Resolution  int64
+	Aggregation string
+	Keys        []string
+	KeyGlob     string
+	Limit       int32
+	Fill        Fill
+	FillValue   float64
+}
+
+type Values struct {
+	Values  []float64
+	Missing []bool
+}
+
+type QueryResponse struct {
+	Resolution int64
+	Timestamps []int64
+	Values     map[string]*Values
+}
+
+type LatestRequest struct {
+	Namespace string
+	Series    string
+}
+
+type LatestResponse struct {
+	Timestamp int64
+	Values    map[string]float64
+}
+
+type KeysRequest struct {
+	Namespace string
+	Series    string
+}
+
+type KeysResponse struct {
+	Keys []string
+}
+
+//
+// Encoding.  As proto3 does, zero values are left out and repeated
+// numbers are packed.
+//
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendInt(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+func appendDouble(b []byte, num protowire.Number, v float64) []byte {
+	if math.Float64bits(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(v))
+}
+
+// An embedded message (or map entry), encoded by fn.
+func appendMessage(b []byte, num protowire.Number, fn func(b []byte) []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, fn(nil))
+}
+
+func appendDoubleMap(b []byte, num protowire.Number, m map[string]float64) []byte {
+	for k, v := range m {
+		b = appendMessage(b, num, func(b []byte) []byte {
+			return appendDouble(appendString(b, 1, k), 2, v)
+		})
+	}
+	return b
+}
+
+func (m *AddValuesRequest) marshal(b []byte) []byte {
+	b = appendString(b, 1, m.Namespace)
+	b = appendString(b, 2, m.Series)
+	b = appendInt(b, 3, m.Timestamp)
+	return appendDoubleMap(b, 4, m.Values)
+}
+
+func (m *AddValuesResponse) marshal(b []byte) []byte {
+	return appendInt(b, 1, m.Count)
+}
+
+func (m *QueryRequest) marshal(b []byte) []byte {
+	b = appendString(b, 1, m.Namespace)
+	b = appendString(b, 2, m.Series)
+	b = appendInt(b, 3, m.StartTime)
+	b = appendInt(b, 4, m.EndTime)
+	b = appendInt(b, 5, m.Resolution)
+	b = appendString(b, 6, m.Aggregation)
+	for _, k := range m.Keys {
+		b = protowire.AppendTag(b, 7, protowire.BytesType)
+		b = protowire.AppendString(b, k)
+	}
+	b = appendString(b, 8, m.KeyGlob)
+	b = appendInt(b, 9, int64(m.Limit))
+	b = appendInt(b, 10, int64(m.Fill))
+	return appendDouble(b, 11, m.FillValue)
+}
+
+func (m *Values) marshal(b []byte) []byte {
+	if len(m.Values) > 0 {
+		b = appendMessage(b, 1, func(b []byte) []byte {
+			for _, v := range m.Values {
+				b = protowire.AppendFixed64(b, math.Float64bits(v))
+			}
+			return b
+		})
+	}
+	if len(m.Missing) > 0 {
+		b = appendMessage(b, 2, func(b []byte) []byte {
+			for _, v := range m.Missing {
+				b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+			}
+			return b
+		})
+	}
+	return b
+}
+
+func (m *QueryResponse) marshal(b []byte) []byte {
+	b = appendInt(b, 1, m.Resolution)
+	if len(m.Timestamps) > 0 {
+		b = appendMessage(b, 2, func(b []byte) []byte {
+			for _, ts := range m.Timestamps {
+				b = protowire.AppendVarint(b, uint64(ts))
+			}
+			return b
+		})
+	}
+	for k, v := range m.Values {
+		b = appendMessage(b, 3, func(b []byte) []byte {
+			b = appendString(b, 1, k)
+			return appendMessage(b, 2, v.marshal)
+		})
+	}
+	return b
+}
+
+func (m *LatestRequest) marshal(b []byte) []byte {
+	return appendString(appendString(b, 1, m.Namespace), 2, m.Series)
+}
+
+func (m *LatestResponse) marshal(b []byte) []byte {
+	b = appendInt(b, 1, m.Timestamp)
+	return appendDoubleMap(b, 2, m.Values)
+}
+
+func (m *KeysRequest) marshal(b []byte) []byte {
+	return appendString(appendString(b, 1, m.Namespace), 2, m.Series)
+}
+
+func (m *KeysResponse) marshal(b []byte) []byte {
+	for _, k := range m.Keys {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, k)
+	}
+	return b
+}
+
+//
+// Decoding.  Unknown fields, and fields of the wrong wire type, are
+// skipped.  Repeated numbers may be packed or not.
+//
+
+type field struct {
+	num protowire.Number
+	typ protowire.Type
+	// the value of a varint or fixed64 field
+	u   uint64
+	// the contents of a length-delimited one
+	b   []byte
+}
+
+func (f field) string() string {
+	return string(f.b)
+}
+
+func (f field) int() int64 {
+	if f.typ != protowire.VarintType {
+		return 0
+	}
+	return int64(f.u)
+}
+
+func (f field) double() float64 {
+	if f.typ != protowire.Fixed64Type {
+		return 0
+	}
+	return math.Float64frombits(f.u)
+}
+
+//
+// Call fn with each field in b.
+//
+func parseFields(b []byte, fn func(f field) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		f := field{ num: num, typ: typ }
+		switch typ {
+		case protowire.VarintType:
+			f.u, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			f.u, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			f.b, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// Call fn with each value of a repeated varint field.
+//
+func varints(f field, fn func(v uint64)) error {
+	switch f.typ {
+	case protowire.VarintType:
+		fn(f.u)
+	case protowire.BytesType:
+		for b := f.b; len(b) > 0; {
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			fn(v)
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+func doubles(f field, dst []float64) ([]float64, error) {
+	switch f.typ {
+	case protowire.Fixed64Type:
+		dst = append(dst, math.Float64frombits(f.u))
+	case protowire.BytesType:
+		if len(f.b) % 8 != 0 {
+			return dst, fmt.Errorf("packed doubles of %d bytes", len(f.b))
+		}
+		for b := f.b; len(b) > 0; b = b[8:] {
+			v, _ := protowire.ConsumeFixed64(b)
+			dst = append(dst, math.Float64frombits(v))
+		}
+	}
+	return dst, nil
+}
+
+//
+// Parse a map entry, calling value with its value field.
+//
+func mapEntry(f field, value func(f field) error) (string, error) {
+	var key string
+	err := parseFields(f.b, func(e field) error {
+		switch e.num {
+		case 1:
+			key = e.string()
+		case 2:
+			return value(e)
+		}
+		return nil
+	})
+	return key, err
+}
+
+func doubleMapEntry(f field, m map[string]float64) error {
+	var v float64
+	k, err := mapEntry(f, func(e field) error {
+		v = e.double()
+		return nil
+	})
+	m[k] = v
+	return err
+}
+
+func (m *AddValuesRequest) unmarshal(b []byte) error {
+	*m = AddValuesRequest{ Values: make(map[string]float64) }
+	return parseFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			m.Namespace = f.string()
+		case 2:
+			m.Series = f.string()
+		case 3:
+			m.Timestamp = f.int()
+		case 4:
+			return doubleMapEntry(f, m.Values)
+		}
+		return nil
+	})
+}
+
+func (m *AddValuesResponse) unmarshal(b []byte) error {
+	*m = AddValuesResponse{}
+	return parseFields(b, func(f field) error {
+		if f.num == 1 {
+			m.Count = f.int()
+		}
+		return nil
+	})
+}
+
+func (m *QueryRequest) unmarshal(b []byte) error {
+	*m = QueryRequest{}
+	return parseFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			m.Namespace = f.string()
+		case 2:
+			m.Series = f.string()
+		case 3:
+			m.StartTime = f.int()
+		case 4:
+			m.EndTime = f.int()
+		case 5:
+			m.Resolution = f.int()
+		case 6:
+			m.Aggregation = f.string()
+		case 7:
+			m.Keys = append(m.Keys, f.string())
+		case 8:
+			m.KeyGlob = f.string()
+		case 9:
+			m.Limit = int32(f.int())
+		case 10:
+			m.Fill = Fill(f.int())
+		case 11:
+			m.FillValue = f.double()
+		}
+		return nil
+	})
+}
+
+func (m *Values) unmarshal(b []byte) error {
+	*m = Values{}
+	return parseFields(b, func(f field) (err error) {
+		switch f.num {
+		case 1:
+			m.Values, err = doubles(f, m.Values)
+		case 2:
+			err = varints(f, func(v uint64) {
+				m.Missing = append(m.Missing, protowire.DecodeBool(v))
+			})
+		}
+		return err
+	})
+}
+
+func (m *QueryResponse) unmarshal(b []byte) error {
+	*m = QueryResponse{ Values: make(map[string]*Values) }
+	return parseFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			m.Resolution = f.int()
+		case 2:
+			return varints(f, func(v uint64) {
+				m.Timestamps = append(m.Timestamps, int64(v))
+			})
+		case 3:
+			v := &Values{}
+			k, err := mapEntry(f, func(e field) error {
+				return v.unmarshal(e.b)
+			})
+			m.Values[k] = v
+			return err
+		}
+		return nil
+	})
+}
+
+func (m *LatestRequest) unmarshal(b []byte) error {
+	*m = LatestRequest{}
+	return parseFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			m.Namespace = f.string()
+		case 2:
+			m.Series = f.string()
+		}
+		return nil
+	})
+}
+
+func (m *LatestResponse) unmarshal(b []byte) error {
+	*m = LatestResponse{ Values: make(map[string]float64) }
+	return parseFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			m.Timestamp = f.int()
+		case 2:
+			return doubleMapEntry(f, m.Values)
+		}
+		return nil
+	})
+}
+
+func (m *KeysRequest) unmarshal(b []byte) error {
+	*m = KeysRequest{}
+	return parseFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			m.Namespace = f.string()
+		case 2:
+			m.Series = f.string()
+		}
+		return nil
+	})
+}
+
+func (m *KeysResponse) unmarshal(b []byte) error {
+	*m = KeysResponse{}
+	return parseFields(b, func(f field) error {
+		if f.num == 1 {
+			m.Keys = append(m.Keys, f.string())
+		}
+		return nil
+	})
+}
+
+//
+// The codec for the tissa messages, registered as "proto" so clients
+// generated from tissa.proto can talk to the server.
+//
+type codec struct{}
+
+func (codec) Name() string {
+	return "proto"
+}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(message)
+	if !ok {
+		return nil, fmt.Errorf("tissa/grpc: can't marshal %T", v)
+	}
+	return m.marshal(nil), nil
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(message)
+	if !ok {
+		return fmt.Errorf("tissa/grpc: can't unmarshal %T", v)
+	}
+	return m.unmarshal(data)
+}
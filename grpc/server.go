@@ -0,0 +1,256 @@
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package grpc serves a tissa.DB over gRPC, so services in any language
+can push data into it and query it.  The service is defined in
+tissa.proto; generate a client from it with protoc as usual:
+
+	db, _ := tissa.OpenDB("/var/lib/tissa")
+	l, _ := net.Listen("tcp", ":7070")
+	grpc.NewServer(db).Serve(l)
+
+AddValues is a client stream of values for any series, creating
+series with the DB's defaults as needed.  Query, Latest and Keys
+read one series.  Every request names a series and optionally the
+namespace it's in; a missing series or namespace is reported as
+NotFound, and exceeding a quota or query limit as
+ResourceExhausted.
+
+The messages are encoded by this package rather than by generated
+code, so the server uses its own codec (see Codec), and can't host
+other services.
+*/
+package grpc
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+
+	"github.com/fred-lewis/tissa"
+)
+
+// The codec a server for the tissa service must use.
+var Codec encoding.Codec = codec{}
+
+//
+// The tissa service, answering from a DB.
+//
+type Server struct {
+	db *tissa.DB
+}
+
+//
+// A gRPC server for db, ready to Serve.
+//
+func NewServer(db *tissa.DB, opts ...grpc.ServerOption) *grpc.Server {
+	s := grpc.NewServer(append(opts, grpc.ForceServerCodec(Codec))...)
+	Register(s, db)
+	return s
+}
+
+//
+// Register the tissa service for db with s, which must have been
+// created with grpc.ForceServerCodec(Codec).
+//
+func Register(s grpc.ServiceRegistrar, db *tissa.DB) {
+	s.RegisterService(&serviceDesc, &Server{ db: db })
+}
+
+//
+// What a DB and its Namespaces have in common.
+//
+type seriesSet interface {
+	Series(name string) (*tissa.TimeSeries, error)
+	AddValues(name string, vals map[string]float64, timestamp int64) error
+	Names() ([]string, error)
+}
+
+func (s *Server) seriesSet(namespace string) (seriesSet, error) {
+	if namespace == "" {
+		return s.db, nil
+	}
+	ns, err := s.db.Namespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+func (s *Server) series(namespace, name string) (*tissa.TimeSeries, error) {
+	set, err := s.seriesSet(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return set.Series(name)
+}
+
+//
+// The status to return for err.
+//
+func statusOf(err error) error {
+	code := codes.Unknown
+	switch {
+	case errors.Is(err, tissa.ErrNoSeries), errors.Is(err, tissa.ErrNoNamespace):
+		code = codes.NotFound
+	case errors.Is(err, tissa.ErrQuotaExceeded), errors.Is(err, tissa.ErrQueryTooLarge):
+		code = codes.ResourceExhausted
+	case errors.Is(err, tissa.ErrGapTooLarge):
+		code = codes.InvalidArgument
+	case errors.Is(err, tissa.ErrCorruptChunk):
+		code = codes.DataLoss
+	}
+	return status.Error(code, err.Error())
+}
+
+//
+// Add each request's values until the client closes the stream,
+// stopping at the first error.
+//
+func (s *Server) AddValues(stream grpc.ServerStream) error {
+	var count int64
+	for {
+		var req AddValuesRequest
+		err := stream.RecvMsg(&req)
+		if err == io.EOF {
+			return stream.SendMsg(&AddValuesResponse{ Count: count })
+		}
+		if err != nil {
+			return err
+		}
+		set, err := s.seriesSet(req.Namespace)
+		if err == nil {
+			err = set.AddValues(req.Series, req.Values, req.Timestamp)
+		}
+		if err != nil {
+			return statusOf(err)
+		}
+		count++
+	}
+}
+
+func (s *Server) Query(ctx context.Context, req *QueryRequest) (*QueryResponse, error) {
+	ts, err := s.series(req.Namespace, req.Series)
+	if err != nil {
+		return nil, statusOf(err)
+	}
+	opts := tissa.QueryOptions{
+		Limit: int(req.Limit),
+		Fill: tissa.FillPolicy(req.Fill),
+		FillValue: req.FillValue,
+	}
+	switch {
+	case len(req.Keys) > 0 && req.KeyGlob != "":
+		return nil, status.Error(codes.InvalidArgument, "keys and key_glob can't both be given")
+	case len(req.Keys) > 0:
+		opts.Keys = tissa.Keys(req.Keys...)
+	case req.KeyGlob != "":
+		if opts.Keys, err = tissa.KeyGlob(req.KeyGlob); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	if req.Resolution <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "resolution must be positive")
+	}
+	res, err := ts.Query(req.StartTime, req.EndTime, req.Resolution, tissa.Aggregation(req.Aggregation), opts)
+	if err != nil {
+		return nil, statusOf(err)
+	}
+	resp := &QueryResponse{
+		Resolution: res.Resolution,
+		Timestamps: res.Timestamps,
+		Values: make(map[string]*Values, len(res.Values)),
+	}
+	for k, vals := range res.Values {
+		resp.Values[k] = &Values{ Values: vals, Missing: res.Missing[k] }
+	}
+	return resp, nil
+}
+
+func (s *Server) Latest(ctx context.Context, req *LatestRequest) (*LatestResponse, error) {
+	ts, err := s.series(req.Namespace, req.Series)
+	if err != nil {
+		return nil, statusOf(err)
+	}
+	vals, timestamp := ts.Latest()
+	return &LatestResponse{ Timestamp: timestamp, Values: vals }, nil
+}
+
+func (s *Server) Keys(ctx context.Context, req *KeysRequest) (*KeysResponse, error) {
+	set, err := s.seriesSet(req.Namespace)
+	if err != nil {
+		return nil, statusOf(err)
+	}
+	if req.Series == "" {
+		names, err := set.Names()
+		if err != nil {
+			return nil, statusOf(err)
+		}
+		return &KeysResponse{ Keys: names }, nil
+	}
+	ts, err := set.Series(req.Series)
+	if err != nil {
+		return nil, statusOf(err)
+	}
+	return &KeysResponse{ Keys: ts.Keys() }, nil
+}
+
+//
+// The service description, as protoc would generate it.
+//
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: "tissa.Tissa",
+	HandlerType: (*Server)(nil),
+	Methods: []grpc.MethodDesc{
+		unary("Query", func() message { return new(QueryRequest) },
+			func(s *Server, ctx context.Context, req message) (interface{}, error) {
+				return s.Query(ctx, req.(*QueryRequest))
+			}),
+		unary("Latest", func() message { return new(LatestRequest) },
+			func(s *Server, ctx context.Context, req message) (interface{}, error) {
+				return s.Latest(ctx, req.(*LatestRequest))
+			}),
+		unary("Keys", func() message { return new(KeysRequest) },
+			func(s *Server, ctx context.Context, req message) (interface{}, error) {
+				return s.Keys(ctx, req.(*KeysRequest))
+			}),
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "AddValues",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(*Server).AddValues(stream)
+			},
+			ClientStreams: true,
+		},
+	},
+	Metadata: "tissa.proto",
+}
+
+func unary(name string, newReq func() message,
+	call func(s *Server, ctx context.Context, req message) (interface{}, error)) grpc.MethodDesc {
+
+	handler := func(srv interface{}, ctx context.Context, dec func(interface{}) error,
+		interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+
+		req := newReq()
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return call(srv.(*Server), ctx, req)
+		}
+		info := &grpc.UnaryServerInfo{ Server: srv, FullMethod: "/tissa.Tissa/" + name }
+		return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return call(srv.(*Server), ctx, req.(message))
+		})
+	}
+	return grpc.MethodDesc{ MethodName: name, Handler: handler }
+}
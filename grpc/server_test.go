@@ -0,0 +1,123 @@
+package grpc
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/fred-lewis/tissa"
+)
+
+//
+// A client stream of AddValuesRequests, passed through the codec.
+//
+type addStream struct {
+	grpc.ServerStream
+	reqs [][]byte
+	resp AddValuesResponse
+}
+
+func (s *addStream) RecvMsg(m interface{}) error {
+	if len(s.reqs) == 0 {
+		return io.EOF
+	}
+	b := s.reqs[0]
+	s.reqs = s.reqs[1:]
+	return Codec.Unmarshal(b, m)
+}
+
+func (s *addStream) SendMsg(m interface{}) error {
+	b, err := Codec.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return Codec.Unmarshal(b, &s.resp)
+}
+
+func TestServer(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/grpc")
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+
+	db, err := tissa.NewDB("/tmp/timeseries_test/grpc", tissa.TimeSeriesConfig{
+		Archives: []tissa.ArchiveConfig{
+			{Resolution: tissa.SECOND, Retention: tissa.HOUR},
+			{Resolution: tissa.MINUTE, Retention: tissa.DAY},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{ db: db }
+	ctx := context.Background()
+
+	startTime := int64(1560632400)
+	stream := &addStream{}
+	for i := int64(0); i < 180; i++ {
+		b, _ := Codec.Marshal(&AddValuesRequest{
+			Series: "cpu",
+			Timestamp: startTime + i,
+			Values: map[string]float64{ "web1": float64(i), "web2": 2 },
+		})
+		stream.reqs = append(stream.reqs, b)
+	}
+	if err = s.AddValues(stream); err != nil {
+		t.Fatal(err)
+	}
+	if stream.resp.Count != 180 {
+		t.Errorf("Added %d requests", stream.resp.Count)
+	}
+
+	req := &QueryRequest{
+		Series: "cpu",
+		StartTime: startTime,
+		EndTime: startTime + 180,
+		Resolution: tissa.MINUTE,
+		Aggregation: "max",
+		Keys: []string{ "web1" },
+	}
+	b, _ := Codec.Marshal(req)
+	if err = Codec.Unmarshal(b, req); err != nil || req.Keys[0] != "web1" || req.EndTime != startTime + 180 {
+		t.Fatalf("Query request came back as %+v: %v", req, err)
+	}
+	resp, err := s.Query(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = Codec.Marshal(resp)
+	if err = Codec.Unmarshal(b, resp); err != nil {
+		t.Fatal(err)
+	}
+	web1 := resp.Values["web1"]
+	if len(resp.Values) != 1 || web1 == nil || len(resp.Timestamps) != 3 || web1.Values[2] != 119 ||
+		len(web1.Missing) != 3 || web1.Missing[2] {
+		t.Errorf("Query gave %v %v", resp.Timestamps, web1)
+	}
+
+	latest, err := s.Latest(ctx, &LatestRequest{ Series: "cpu" })
+	if err != nil || latest.Timestamp != startTime + 179 || latest.Values["web1"] != 179 {
+		t.Errorf("Latest gave %+v: %v", latest, err)
+	}
+	keys, err := s.Keys(ctx, &KeysRequest{ Series: "cpu" })
+	if err != nil || len(keys.Keys) != 2 || keys.Keys[0] != "web1" {
+		t.Errorf("Keys gave %+v: %v", keys, err)
+	}
+	keys, err = s.Keys(ctx, &KeysRequest{})
+	if err != nil || len(keys.Keys) != 1 || keys.Keys[0] != "cpu" {
+		t.Errorf("Series names are %+v: %v", keys, err)
+	}
+
+	if _, err = s.Latest(ctx, &LatestRequest{ Series: "mem" }); status.Code(err) != codes.NotFound {
+		t.Errorf("Missing series gave %v", err)
+	}
+	if _, err = s.Keys(ctx, &KeysRequest{ Namespace: "acme" }); status.Code(err) != codes.NotFound {
+		t.Errorf("Missing namespace gave %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"sort"
+)
+
+//
+// Counts of values by range over time, as for a heatmap.  Bounds are
+// the buckets' upper bounds, ascending; a value goes in the first
+// bucket whose bound it's at most, or in the extra last bucket if
+// it's above them all.  Counts has, per key, a row per timestamp of
+// len(Bounds) + 1 counts.
+//
+type Histogram struct {
+	Resolution int64
+	Bounds     []float64
+	Timestamps []int64
+	Counts     map[string][][]int64
+}
+
+//
+// Bin the raw values of each key, for all keys or those selected by
+// opts, into the buckets bounded by bounds in each interval of
+// resolution.  Values are read from the base archive as for
+// Aggregate, and only Keys, Limit and Stats in opts apply.
+//
+func (t *TimeSeries) Histogram(startTime, endTime, resolution int64, bounds []float64,
+	opts ...QueryOptions) (*Histogram, error) {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if !sort.Float64sAreSorted(bounds) {
+		return nil, fmt.Errorf("histogram bounds are not in ascending order")
+	}
+	o := t.queryOptions(opts)
+	stats := collectStats(&o)
+	h := &Histogram{
+		Resolution: resolution,
+		Bounds: bounds,
+		Counts: make(map[string][][]int64),
+	}
+	var err error
+	h.Timestamps, err = t.rawIntervals(startTime, endTime, resolution, o.Keys, func(key string, i, l int, values []float64) {
+		rows := h.Counts[key]
+		if rows == nil {
+			rows = make([][]int64, l)
+			for j := range rows {
+				rows[j] = make([]int64, len(bounds) + 1)
+			}
+			h.Counts[key] = rows
+		}
+		for _, v := range values {
+			rows[i][sort.SearchFloat64s(bounds, v)]++
+		}
+	})
+	if h.Timestamps == nil {
+		return nil, err
+	}
+	limitSeries(h.Counts, o.Limit)
+	finishStats(stats, h.Counts)
+	return h, err
+}
+
+//
+// n bucket bounds, width apart, the first being start.
+//
+func LinearBuckets(start, width float64, n int) []float64 {
+	bounds := make([]float64, n)
+	for i := range bounds {
+		bounds[i] = start + width * float64(i)
+	}
+	return bounds
+}
+
+//
+// n bucket bounds, each factor times the last, the first being
+// start; suits latencies, which span orders of magnitude.
+//
+func ExponentialBuckets(start, factor float64, n int) []float64 {
+	bounds := make([]float64, n)
+	for i := range bounds {
+		bounds[i] = start
+		start *= factor
+	}
+	return bounds
+}
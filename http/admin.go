@@ -0,0 +1,342 @@
+package http
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fred-lewis/tissa"
+)
+
+//
+// A small web UI for looking at what's in a DB: its namespaces and
+// series, each series' archives and settings and the range of data
+// each archive holds, its keys, and graphs of them.  It also serves
+// the JSON API (see NewHandler) under api/, which its graphs use.
+// Mount it on a path ending in a slash:
+//
+//	http.Handle("/admin/", http.StripPrefix("/admin", tissahttp.NewAdmin(db)))
+//
+func NewAdmin(db *tissa.DB) http.Handler {
+	a := &admin{ db: db, api: http.StripPrefix("/api", NewHandler(db)) }
+	return a
+}
+
+type admin struct {
+	db  *tissa.DB
+	api http.Handler
+}
+
+func (a *admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/api/"):
+		a.api.ServeHTTP(w, r)
+		return
+	case r.Method != http.MethodGet:
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var page bytes.Buffer
+	var err error
+	switch {
+	case path == "/" || path == "":
+		err = a.index(&page, r)
+	case strings.HasPrefix(path, "/series/"):
+		err = a.series(&page, strings.TrimPrefix(path, "/series/"), r)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, tissa.ErrNoSeries) || errors.Is(err, tissa.ErrNoNamespace) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	page.WriteTo(w)
+}
+
+var adminFuncs = template.FuncMap{
+	"path": url.PathEscape,
+	"query": url.QueryEscape,
+	"duration": formatDuration,
+	"time": func(ts int64) string {
+		if ts == 0 {
+			return "-"
+		}
+		return time.Unix(ts, 0).UTC().Format("2006-01-02 15:04:05")
+	},
+}
+
+//
+// Seconds as a short duration: 90 is "1m30s", 86400 is "1d".
+//
+func formatDuration(secs int64) string {
+	if secs == 0 {
+		return "0s"
+	}
+	var b strings.Builder
+	for _, u := range []struct {
+		secs int64
+		unit string
+	}{ { tissa.DAY, "d" }, { tissa.HOUR, "h" }, { tissa.MINUTE, "m" }, { tissa.SECOND, "s" } } {
+		if secs >= u.secs {
+			fmt.Fprintf(&b, "%d%s", secs / u.secs, u.unit)
+			secs %= u.secs
+		}
+	}
+	return b.String()
+}
+
+const adminStyle = `<style>
+body { font-family: sans-serif; margin: 2em; color: #202020; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #d0d0d0; padding: 0.3em 0.8em; text-align: left; }
+th { background: #f0f0f0; }
+a { color: #1f77b4; }
+.keys { columns: 4; }
+</style>`
+
+var indexTemplate = template.Must(template.New("index").Funcs(adminFuncs).Parse(`<!DOCTYPE html>
+<html><head><title>tissa{{ if .Namespace }}: {{ .Namespace }}{{ end }}</title>` + adminStyle + `</head>
+<body>
+<h1>{{ if .Namespace }}<a href="./">tissa</a> / {{ .Namespace }}{{ else }}tissa{{ end }}</h1>
+<h2>Series</h2>
+{{ if .Series }}<table>
+<tr><th>Name</th><th>Keys</th><th>Oldest</th><th>Newest</th></tr>
+{{ range .Series }}<tr>
+<td><a href="series/{{ path .Name }}?namespace={{ query $.Namespace }}">{{ .Name }}</a></td>
+<td>{{ .Keys }}</td><td>{{ time .Oldest }}</td><td>{{ time .Newest }}</td>
+</tr>
+{{ end }}</table>{{ else }}<p>None.</p>{{ end }}
+{{ if .Namespaces }}<h2>Namespaces</h2>
+<ul>{{ range .Namespaces }}<li><a href="./?namespace={{ query . }}">{{ . }}</a></li>{{ end }}</ul>{{ end }}
+</body></html>
+`))
+
+type seriesSummary struct {
+	Name   string
+	Keys   int
+	Oldest int64
+	Newest int64
+}
+
+func (a *admin) seriesSet(r *http.Request) (seriesSet, string, error) {
+	namespace := r.URL.Query().Get("namespace")
+	if namespace == "" {
+		return a.db, "", nil
+	}
+	ns, err := a.db.Namespace(namespace)
+	if err != nil {
+		return nil, "", err
+	}
+	return ns, namespace, nil
+}
+
+func (a *admin) index(w *bytes.Buffer, r *http.Request) error {
+	set, namespace, err := a.seriesSet(r)
+	if err != nil {
+		return err
+	}
+	names, err := set.Names()
+	if err != nil {
+		return err
+	}
+	data := struct {
+		Namespace  string
+		Namespaces []string
+		Series     []seriesSummary
+	}{ Namespace: namespace }
+	for _, name := range names {
+		ts, err := set.Series(name)
+		if err != nil {
+			return err
+		}
+		data.Series = append(data.Series, seriesSummary{
+			Name: name,
+			Keys: len(ts.Keys()),
+			Oldest: ts.Oldest(),
+			Newest: ts.Newest(),
+		})
+	}
+	if namespace == "" {
+		if data.Namespaces, err = a.db.Namespaces(); err != nil {
+			return err
+		}
+	}
+	return indexTemplate.Execute(w, data)
+}
+
+var seriesTemplate = template.Must(template.New("series").Funcs(adminFuncs).Parse(`<!DOCTYPE html>
+<html><head><title>tissa: {{ .Name }}</title>` + adminStyle + `</head>
+<body>
+<h1><a href="../?namespace={{ query .Namespace }}">{{ if .Namespace }}{{ .Namespace }}{{ else }}tissa{{ end }}</a> / {{ .Name }}</h1>
+<h2>Archives</h2>
+<table>
+<tr><th>Resolution</th><th>Retention</th><th>Aggregation</th><th>Encoding</th><th>Shards</th><th>Holds</th></tr>
+{{ range .Archives }}<tr>
+<td>{{ duration .Resolution }}</td><td>{{ duration .Retention }}</td><td>{{ .Aggregation }}</td>
+<td>{{ .Encoding }}</td><td>{{ .Shards }}</td><td>{{ time .Start }} &ndash; {{ time .End }}</td>
+</tr>
+{{ end }}</table>
+<h2>Settings</h2>
+<table>
+{{ range .Settings }}<tr><th>{{ index . 0 }}</th><td>{{ index . 1 }}</td></tr>
+{{ end }}</table>
+<h2>Graph</h2>
+<form>
+<input type="hidden" name="namespace" value="{{ .Namespace }}">
+Last <select name="span">{{ range .Spans }}<option value="{{ . }}"{{ if eq . $.Span }} selected{{ end }}>{{ duration . }}</option>{{ end }}</select>
+of <input name="keys" value="{{ .Selected }}" size="40" placeholder="comma-separated keys">
+<input type="submit" value="Draw">
+</form>
+{{ if .Graph }}<p><img src="{{ .Graph }}" alt="graph"></p>{{ else }}<p>No data.</p>{{ end }}
+<h2>Keys ({{ len .Keys }})</h2>
+<div class="keys">{{ range .Keys }}<div><a href="?namespace={{ query $.Namespace }}&amp;span={{ $.Span }}&amp;keys={{ query . }}">{{ . }}</a></div>{{ end }}</div>
+</body></html>
+`))
+
+type archiveSummary struct {
+	tissa.ArchiveConfig
+	Encoding string
+	Start    int64
+	End      int64
+}
+
+var encodingNames = map[tissa.ChunkEncoding]string{
+	tissa.ENCODING_RAW: "raw",
+	tissa.ENCODING_GORILLA: "gorilla",
+	tissa.ENCODING_FIXED: "fixed",
+	tissa.ENCODING_RLE: "rle",
+	tissa.ENCODING_DELTA: "delta",
+}
+
+var compressionNames = map[tissa.CompressionCodec]string{
+	tissa.COMPRESSION_NONE: "none",
+	tissa.COMPRESSION_GZIP: "gzip",
+	tissa.COMPRESSION_SNAPPY: "snappy",
+	tissa.COMPRESSION_ZSTD: "zstd",
+}
+
+var fillNames = map[tissa.FillPolicy]string{
+	tissa.FILL_DEFAULT: "default value",
+	tissa.FILL_NAN: "NaN",
+	tissa.FILL_PREVIOUS: "previous",
+	tissa.FILL_LINEAR: "linear",
+	tissa.FILL_CONSTANT: "constant",
+}
+
+// The spans the graph can show, and how many keys it shows at once.
+var graphSpans = []int64{ tissa.HOUR, 6 * tissa.HOUR, tissa.DAY, 7 * tissa.DAY, 30 * tissa.DAY, 365 * tissa.DAY }
+
+const (
+	maxGraphKeys = 10
+	graphWidth   = 800
+)
+
+func (a *admin) series(w *bytes.Buffer, name string, r *http.Request) error {
+	set, namespace, err := a.seriesSet(r)
+	if err != nil {
+		return err
+	}
+	ts, err := set.Series(name)
+	if err != nil {
+		return err
+	}
+	config := ts.Config()
+	data := struct {
+		Name      string
+		Namespace string
+		Archives  []archiveSummary
+		Settings  [][2]string
+		Keys      []string
+		Spans     []int64
+		Span      int64
+		Selected  string
+		Graph     string
+	}{ Name: name, Namespace: namespace, Keys: ts.Keys(), Spans: graphSpans, Span: tissa.DAY }
+
+	for _, ac := range config.Archives {
+		s := archiveSummary{ ArchiveConfig: ac, Encoding: encodingNames[ac.Encoding] }
+		if s.Aggregation == "" {
+			s.Aggregation = tissa.AGGREGATE_AVERAGE
+		}
+		if s.Start, s.End, err = ts.TimeRange(ac.Resolution); err != nil {
+			return err
+		}
+		data.Archives = append(data.Archives, s)
+	}
+	data.Settings = [][2]string{
+		{ "Default value", fmt.Sprint(config.DefaultValue) },
+		{ "Fill", fillNames[config.Fill] },
+		{ "Compression", compressionNames[config.Compression] },
+		{ "Codec", config.Codec },
+		{ "Max gap", formatDuration(config.MaxGap) },
+		{ "Cache size", fmt.Sprint(config.CacheSize) },
+		{ "Max query points", fmt.Sprint(config.MaxQueryPoints) },
+		{ "Max query bytes", fmt.Sprint(config.MaxQueryBytes) },
+	}
+	if data.Settings[3][1] == "" {
+		data.Settings[3][1] = "msgpack"
+	}
+
+	params := r.URL.Query()
+	if span, err := parseSpan(params.Get("span")); err == nil {
+		data.Span = span
+	}
+	keys := data.Keys
+	if data.Selected = params.Get("keys"); data.Selected != "" {
+		keys = strings.Split(data.Selected, ",")
+	}
+	if len(keys) > maxGraphKeys {
+		keys = keys[:maxGraphKeys]
+	}
+	if end := ts.Newest(); end > 0 && len(keys) > 0 {
+		end++
+		start := end - data.Span
+		// the finest archive covering the span in a graph's width
+		res := config.Archives[len(config.Archives) - 1].Resolution
+		for _, ac := range config.Archives {
+			if ac.Resolution * graphWidth >= data.Span && ac.Retention >= data.Span {
+				res = ac.Resolution
+				break
+			}
+		}
+		graph := url.Values{
+			"start": { fmt.Sprint(start) },
+			"end": { fmt.Sprint(end) },
+			"res": { fmt.Sprint(res) },
+			"keys": { strings.Join(keys, ",") },
+			"width": { fmt.Sprint(graphWidth) },
+			"height": { "300" },
+		}
+		if namespace != "" {
+			graph.Set("namespace", namespace)
+		}
+		data.Graph = "../api/series/" + url.PathEscape(name) + "/graph.svg?" + graph.Encode()
+	}
+	return seriesTemplate.Execute(w, data)
+}
+
+func parseSpan(s string) (int64, error) {
+	var span int64
+	_, err := fmt.Sscan(s, &span)
+	if err == nil && span <= 0 {
+		err = fmt.Errorf("bad span %d", span)
+	}
+	return span, err
+}
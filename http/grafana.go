@@ -0,0 +1,381 @@
+package http
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fred-lewis/tissa"
+)
+
+//
+// Grafana serves a DB as a Grafana JSON datasource (the simple-JSON
+// contract, which the Infinity and JSON datasource plugins also
+// speak), so it can be graphed without an exporter.  Point the
+// datasource at the URL Grafana is served on.
+//
+// Targets are written [namespace/]series:keys, where keys is a key
+// or a glob pattern matching several, e.g. "cpu:web*" or
+// "acme/mem:web1".  Each matching key is returned as a series of its
+// own, named by its target.  A target's data (or payload) may give
+// an aggregation: {"aggregation": "max"}, with the names the REST
+// API uses; avg by default.  Queries use the finest archive still
+// holding the start of the range, at the dashboard's interval
+// rounded up to a multiple of its resolution.
+//
+// Annotations come from those added with Annotate, or recorded
+// from alert rules with AlertNotifier; an annotation query is a
+// target selecting which (all if it's empty).  Annotations without a
+// key match any keys.
+//
+type Grafana struct {
+	db          *tissa.DB
+	mu          sync.Mutex
+	annotations []Annotation
+}
+
+//
+// An event to show on Grafana graphs.  Series is as in a target,
+// with a namespace if need be, and Key may be empty for one
+// concerning the whole series.  Time is a Unix time.
+//
+type Annotation struct {
+	Series string
+	Key    string
+	Time   int64
+	Title  string
+	Text   string
+	Tags   []string
+}
+
+// The most annotations kept; the oldest are dropped first.
+const maxAnnotations = 10000
+
+func NewGrafana(db *tissa.DB) *Grafana {
+	return &Grafana{ db: db }
+}
+
+//
+// Add an annotation.
+//
+func (g *Grafana) Annotate(a Annotation) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.annotations) == maxAnnotations {
+		g.annotations = append(g.annotations[:0], g.annotations[1:]...)
+	}
+	g.annotations = append(g.annotations, a)
+}
+
+//
+// A function for AlertRule.Notify that annotates series with the
+// rule's events.
+//
+func (g *Grafana) AlertNotifier(series string) func(tissa.AlertEvent) {
+	return func(e tissa.AlertEvent) {
+		a := Annotation{
+			Series: series,
+			Key: e.Key,
+			Time: e.Timestamp,
+			Title: e.Rule + " firing",
+			Text: fmt.Sprintf("%s = %g", e.Key, e.Value),
+			Tags: []string{ "alert", e.Rule },
+		}
+		if e.State == tissa.ALERT_RESOLVED {
+			a.Title = e.Rule + " resolved"
+		}
+		g.Annotate(a)
+	}
+}
+
+type grafanaTarget struct {
+	set     seriesSet
+	series  string
+	keys    *tissa.KeyFilter
+	pattern string
+}
+
+//
+// Split a target into its series, with any namespace, and its keys.
+//
+func splitTarget(target string) (series, pattern string) {
+	if i := strings.IndexByte(target, ':'); i >= 0 {
+		return target[:i], target[i + 1:]
+	}
+	return target, ""
+}
+
+//
+// Parse [namespace/]series[:keys].  Without keys, every key matches.
+//
+func (g *Grafana) parseTarget(target string) (*grafanaTarget, error) {
+	t := &grafanaTarget{ set: g.db }
+	t.series, t.pattern = splitTarget(target)
+	if i := strings.IndexByte(t.series, '/'); i >= 0 {
+		ns, err := g.db.Namespace(t.series[:i])
+		if err != nil {
+			return nil, err
+		}
+		t.set, t.series = ns, t.series[i + 1:]
+	}
+	if t.pattern != "" {
+		keys, err := tissa.KeyGlob(t.pattern)
+		if err != nil {
+			return nil, badRequest("bad target %q: %v", target, err)
+		}
+		t.keys = keys
+	}
+	return t, nil
+}
+
+func (g *Grafana) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	if path == "" {
+		// the datasource's connection test
+		writeJSON(w, http.StatusOK, map[string]string{ "status": "ok" })
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, &statusError{ status: http.StatusMethodNotAllowed, err: fmt.Errorf("%s takes POST", r.URL.Path) })
+		return
+	}
+	var resp interface{}
+	var err error
+	switch path {
+	case "search":
+		resp, err = g.search(r)
+	case "query":
+		resp, err = g.query(r)
+	case "annotations":
+		resp, err = g.annotate(r)
+	default:
+		err = &statusError{ status: http.StatusNotFound, err: fmt.Errorf("no endpoint %s", r.URL.Path) }
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func decodeBody(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxBody)).Decode(v)
+	if err != nil {
+		return badRequest("bad request body: %v", err)
+	}
+	return nil
+}
+
+//
+// The targets containing the search text: series:key for every key
+// written to recently in every series outside a namespace.
+//
+func (g *Grafana) search(r *http.Request) (interface{}, error) {
+	var req struct {
+		Target string `json:"target"`
+	}
+	if err := decodeBody(r, &req); err != nil {
+		return nil, err
+	}
+	names, err := g.db.Names()
+	if err != nil {
+		return nil, err
+	}
+	targets := []string{}
+	for _, name := range names {
+		ts, err := g.db.Series(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range ts.Keys() {
+			if target := name + ":" + key; strings.Contains(target, req.Target) {
+				targets = append(targets, target)
+			}
+		}
+	}
+	return targets, nil
+}
+
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type grafanaQuery struct {
+	Range         grafanaRange `json:"range"`
+	IntervalMs    int64        `json:"intervalMs"`
+	MaxDataPoints int64        `json:"maxDataPoints"`
+	Targets       []struct {
+		Target  string `json:"target"`
+		RefID   string `json:"refId"`
+		Type    string `json:"type"`
+		// objects, though older versions may send other things
+		Data    json.RawMessage `json:"data"`
+		Payload json.RawMessage `json:"payload"`
+	} `json:"targets"`
+}
+
+type grafanaSeries struct {
+	Target     string         `json:"target"`
+	Datapoints [][2]jsonFloat `json:"datapoints"`
+}
+
+type grafanaTable struct {
+	Type    string              `json:"type"`
+	Columns []map[string]string `json:"columns"`
+	Rows    [][]interface{}     `json:"rows"`
+}
+
+func (g *Grafana) query(r *http.Request) (interface{}, error) {
+	var req grafanaQuery
+	if err := decodeBody(r, &req); err != nil {
+		return nil, err
+	}
+	start, end := req.Range.From.Unix(), req.Range.To.Unix()
+	if end <= start {
+		return nil, badRequest("empty range")
+	}
+
+	resp := []interface{}{}
+	for _, target := range req.Targets {
+		if target.Target == "" {
+			continue
+		}
+		t, err := g.parseTarget(target.Target)
+		if err != nil {
+			return nil, err
+		}
+		var data struct {
+			Aggregation string `json:"aggregation"`
+		}
+		if json.Unmarshal(target.Data, &data) != nil || data.Aggregation == "" {
+			json.Unmarshal(target.Payload, &data)
+		}
+		agg := data.Aggregation
+		if agg == "" {
+			agg = "avg"
+		}
+		aggregation, ok := aggregations[agg]
+		if !ok {
+			return nil, badRequest("no aggregation %q", agg)
+		}
+		ts, err := t.set.Series(t.series)
+		if err != nil {
+			return nil, err
+		}
+
+		// whole multiples of the archive's resolution, no more than
+		// maxDataPoints of them
+		base := ts.BestResolution(start)
+		res := (req.IntervalMs / 1000 + base - 1) / base * base
+		if res < base {
+			res = base
+		}
+		if req.MaxDataPoints > 0 && (end - start) / res > req.MaxDataPoints {
+			res = ((end - start) / req.MaxDataPoints + base - 1) / base * base
+		}
+		result, err := ts.Stitched(start, end, res, aggregation, tissa.QueryOptions{ Keys: t.keys })
+		if err != nil {
+			return nil, err
+		}
+
+		keys := make([]string, 0, len(result.Values))
+		for k := range result.Values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if target.Type == "table" {
+			table := &grafanaTable{
+				Type: "table",
+				Columns: []map[string]string{
+					{ "text": "Time", "type": "time" },
+					{ "text": "Key", "type": "string" },
+					{ "text": "Value", "type": "number" },
+				},
+				Rows: [][]interface{}{},
+			}
+			for _, k := range keys {
+				for i, v := range result.Values[k] {
+					table.Rows = append(table.Rows, []interface{}{ result.Timestamps[i] * 1000, k, jsonFloat(v) })
+				}
+			}
+			resp = append(resp, table)
+			continue
+		}
+		prefix := target.Target
+		if t.pattern != "" {
+			prefix = prefix[:len(prefix) - len(t.pattern)]
+		} else {
+			prefix += ":"
+		}
+		for _, k := range keys {
+			s := &grafanaSeries{ Target: prefix + k, Datapoints: make([][2]jsonFloat, len(result.Timestamps)) }
+			for i, v := range result.Values[k] {
+				s.Datapoints[i] = [2]jsonFloat{ jsonFloat(v), jsonFloat(result.Timestamps[i] * 1000) }
+			}
+			resp = append(resp, s)
+		}
+	}
+	return resp, nil
+}
+
+func (g *Grafana) annotate(r *http.Request) (interface{}, error) {
+	var req struct {
+		Range      grafanaRange    `json:"range"`
+		Annotation json.RawMessage `json:"annotation"`
+	}
+	if err := decodeBody(r, &req); err != nil {
+		return nil, err
+	}
+	var annotation struct {
+		Query string `json:"query"`
+	}
+	json.Unmarshal(req.Annotation, &annotation)
+	series, pattern := splitTarget(annotation.Query)
+	var keys *tissa.KeyFilter
+	if pattern != "" {
+		var err error
+		if keys, err = tissa.KeyGlob(pattern); err != nil {
+			return nil, badRequest("bad annotation query %q: %v", annotation.Query, err)
+		}
+	}
+
+	start, end := req.Range.From.Unix(), req.Range.To.Unix()
+	type grafanaAnnotation struct {
+		Annotation json.RawMessage `json:"annotation"`
+		Time       int64           `json:"time"`
+		Title      string          `json:"title"`
+		Text       string          `json:"text"`
+		Tags       []string        `json:"tags"`
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	resp := []grafanaAnnotation{}
+	for _, a := range g.annotations {
+		if a.Time < start || a.Time > end {
+			continue
+		}
+		if series != "" && a.Series != series {
+			continue
+		}
+		if keys != nil && a.Key != "" && !keys.Has(a.Key) {
+			continue
+		}
+		resp = append(resp, grafanaAnnotation{
+			Annotation: req.Annotation,
+			Time: a.Time * 1000,
+			Title: a.Title,
+			Text: a.Text,
+			Tags: a.Tags,
+		})
+	}
+	return resp, nil
+}
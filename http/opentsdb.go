@@ -0,0 +1,234 @@
+package http
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fred-lewis/tissa"
+)
+
+//
+// A handler serving OpenTSDB's put API at /api/put, so collectors
+// writing to OpenTSDB can be pointed at a DB instead.  Datapoints are
+// posted as an object, or an array of them, optionally gzipped:
+//
+//	{"metric": "sys.cpu.user", "timestamp": 1560632400, "value": 42.5,
+//	 "tags": {"host": "web01", "dc": "lga"}}
+//
+// and added to the named series (created with the DB's defaults if
+// need be, in namespace if one's given) as labeled series, named by
+// their metric with their tags as labels.  Characters OpenTSDB allows
+// in tag names but labels don't are replaced with underscores.
+// Timestamps are in seconds, or milliseconds if they're too large
+// to be seconds; values may be numbers or numeric strings.
+//
+// As for OpenTSDB, success is 204 No Content, or with the summary or
+// details parameter, {"success": n, "failed": n}, and with details,
+// the errors too.  Any failed datapoint makes it a 400.  The
+// datapoints that can be added are added regardless.
+//
+func NewOpenTSDB(db *tissa.DB, series string) http.Handler {
+	return &openTSDB{ db: db, series: series }
+}
+
+type openTSDB struct {
+	db     *tissa.DB
+	series string
+}
+
+type tsdbDatapoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp json.Number       `json:"timestamp"`
+	Value     json.RawMessage   `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+type tsdbError struct {
+	Datapoint json.RawMessage `json:"datapoint"`
+	Error     string          `json:"error"`
+}
+
+// Timestamps from here on are taken to be in milliseconds.
+const maxSeconds = 9999999999
+
+func (o *openTSDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.Trim(r.URL.Path, "/") != "api/put" {
+		writeError(w, &statusError{ status: http.StatusNotFound, err: fmt.Errorf("no endpoint %s", r.URL.Path) })
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, &statusError{ status: http.StatusMethodNotAllowed, err: fmt.Errorf("%s takes POST", r.URL.Path) })
+		return
+	}
+	ts, err := o.seriesFor(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	raw, err := readDatapoints(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var errs []tsdbError
+	fail := func(raw json.RawMessage, err error) {
+		errs = append(errs, tsdbError{ Datapoint: raw, Error: err.Error() })
+	}
+	// grouped by timestamp, to add each in one append
+	byTime := make(map[int64][]int)
+	vals := make([]tissa.LabeledValue, len(raw))
+	for i, r := range raw {
+		timestamp, err := parseDatapoint(r, &vals[i])
+		if err != nil {
+			fail(r, err)
+			continue
+		}
+		byTime[timestamp] = append(byTime[timestamp], i)
+	}
+	times := make([]int64, 0, len(byTime))
+	for t := range byTime {
+		times = append(times, t)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	for _, t := range times {
+		group := make([]tissa.LabeledValue, len(byTime[t]))
+		for i, j := range byTime[t] {
+			group[i] = vals[j]
+		}
+		if err := ts.AddLabeledValues(group, t); err != nil {
+			for _, j := range byTime[t] {
+				fail(raw[j], err)
+			}
+		}
+	}
+
+	params := r.URL.Query()
+	_, details := params["details"]
+	_, summary := params["summary"]
+	status := http.StatusOK
+	if len(errs) > 0 {
+		status = http.StatusBadRequest
+	}
+	switch {
+	case details:
+		if errs == nil {
+			errs = []tsdbError{}
+		}
+		writeJSON(w, status, map[string]interface{}{ "success": len(raw) - len(errs), "failed": len(errs), "errors": errs })
+	case summary:
+		writeJSON(w, status, map[string]int{ "success": len(raw) - len(errs), "failed": len(errs) })
+	case len(errs) > 0:
+		writeError(w, badRequest("%d of %d datapoints had errors, the first: %s", len(errs), len(raw), errs[0].Error))
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (o *openTSDB) seriesFor(r *http.Request) (*tissa.TimeSeries, error) {
+	namespace := r.URL.Query().Get("namespace")
+	if namespace == "" {
+		return o.db.SeriesOrCreate(o.series)
+	}
+	ns, err := o.db.Namespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return ns.SeriesOrCreate(o.series)
+}
+
+//
+// The posted datapoints, each left encoded so it can be quoted back
+// in errors.
+//
+func readDatapoints(r *http.Request) ([]json.RawMessage, error) {
+	var body io.Reader = http.MaxBytesReader(nil, r.Body, maxBody)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, badRequest("bad gzipped body: %v", err)
+		}
+		defer gz.Close()
+		// no more than we'd take uncompressed
+		body = io.LimitReader(gz, maxBody)
+	}
+	var all json.RawMessage
+	if err := json.NewDecoder(body).Decode(&all); err != nil {
+		return nil, badRequest("bad datapoints: %v", err)
+	}
+	if len(all) > 0 && all[0] == '[' {
+		var raw []json.RawMessage
+		if err := json.Unmarshal(all, &raw); err != nil {
+			return nil, badRequest("bad datapoints: %v", err)
+		}
+		return raw, nil
+	}
+	return []json.RawMessage{ all }, nil
+}
+
+//
+// Decode a datapoint into v, returning its timestamp in seconds.
+//
+func parseDatapoint(raw json.RawMessage, v *tissa.LabeledValue) (int64, error) {
+	var dp tsdbDatapoint
+	if err := json.Unmarshal(raw, &dp); err != nil {
+		return 0, err
+	}
+	if dp.Metric == "" {
+		return 0, fmt.Errorf("no metric")
+	}
+	timestamp, err := dp.Timestamp.Int64()
+	if err != nil || timestamp <= 0 {
+		return 0, fmt.Errorf("bad timestamp %q", dp.Timestamp)
+	}
+	if timestamp > maxSeconds {
+		timestamp /= 1000
+	}
+	var val float64
+	var s string
+	if json.Unmarshal(dp.Value, &s) == nil {
+		val, err = strconv.ParseFloat(s, 64)
+	} else {
+		err = json.Unmarshal(dp.Value, &val)
+	}
+	if err != nil || math.IsNaN(val) || math.IsInf(val, 0) {
+		return 0, fmt.Errorf("bad value %s", dp.Value)
+	}
+	labels := make(tissa.Labels, len(dp.Tags))
+	for k, tv := range dp.Tags {
+		labels[labelName(k)] = tv
+	}
+	if _, err = tissa.SeriesKey(dp.Metric, labels); err != nil {
+		return 0, err
+	}
+	*v = tissa.LabeledValue{ Name: dp.Metric, Labels: labels, Value: val }
+	return timestamp, nil
+}
+
+//
+// An OpenTSDB tag name as a label name: letters, digits and
+// underscores, not starting with a digit.
+//
+func labelName(tag string) string {
+	b := []byte(tag)
+	for i, c := range b {
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			b[i] = '_'
+		}
+	}
+	if len(b) > 0 && b[0] >= '0' && b[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
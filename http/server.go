@@ -0,0 +1,481 @@
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package http serves a tissa.DB as a small JSON metrics service:
+
+	db, _ := tissa.OpenDB("/var/lib/tissa")
+	http.ListenAndServe(":8080", tissahttp.NewHandler(db))
+
+The endpoints are:
+
+	GET  /series                     the names of the series
+	POST /series/{name}/values       add values, creating the series
+	GET  /series/{name}/latest       the latest values
+	GET  /series/{name}/{agg}        query, reducing intervals by agg
+	GET  /series/{name}/graph.png    draw a query as a line chart
+	GET  /series/{name}/graph.svg
+	GET  /series/{name}/stream       a WebSocket of values as they're added
+
+Values are posted as an object, or an array of them:
+
+	{"timestamp": 1560632400, "values": {"cpu": 0.5, "mem": 1024}}
+
+The timestamp defaults to now.  Queries take start, end and res (all
+in seconds; res defaults to the finest resolution still holding start),
+keys (a comma-separated list) or glob to select keys, limit, and
+fill ("nan", "previous", "linear" or a number).  agg is avg, sum,
+count, min, max, first, last or time-weighted.  They return
+
+	{"resolution": 60, "timestamps": [...], "values": {"cpu": [...]}}
+
+with null for missing values, or, given format=arrow, the result as
+an Apache Arrow IPC stream (see tissa.Result.WriteArrow), for
+loading into pandas, Polars or DuckDB without parsing.  Graphs take the same parameters, and
+agg, width, height, title, min and max, and colors (a
+comma-separated list of hex colors); missing values are left as
+gaps unless fill is given.  Streams take keys or glob, and send a
+message like those posted for each AddValues.  Every endpoint takes namespace to
+use the series in a namespace.  Errors are returned as
+{"error": "..."}, with 404 for a missing series or namespace and 429
+for an exceeded quota.
+
+The package also serves a DB as a Grafana datasource (see Grafana),
+as a small web UI for browsing it (see NewAdmin), and to collectors
+speaking OpenTSDB's put API (see NewOpenTSDB).
+*/
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fred-lewis/tissa"
+)
+
+// The most a single POST may carry.
+const maxBody = 16 << 20
+
+type handler struct {
+	db *tissa.DB
+}
+
+//
+// A handler serving db at /series.  To serve it under another
+// prefix, use http.StripPrefix.
+//
+func NewHandler(db *tissa.DB) http.Handler {
+	return &handler{ db: db }
+}
+
+//
+// What a DB and its Namespaces have in common.
+//
+type seriesSet interface {
+	Series(name string) (*tissa.TimeSeries, error)
+	AddValues(name string, vals map[string]float64, timestamp int64) error
+	Names() ([]string, error)
+}
+
+func (h *handler) seriesSet(r *http.Request) (seriesSet, error) {
+	namespace := r.URL.Query().Get("namespace")
+	if namespace == "" {
+		return h.db, nil
+	}
+	ns, err := h.db.Namespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+// An error with the status to return for it.
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &statusError{ status: http.StatusBadRequest, err: fmt.Errorf(format, args...) }
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var se *statusError
+	switch {
+	case errors.As(err, &se):
+		status = se.status
+	case errors.Is(err, tissa.ErrNoSeries), errors.Is(err, tissa.ErrNoNamespace):
+		status = http.StatusNotFound
+	case errors.Is(err, tissa.ErrQuotaExceeded):
+		status = http.StatusTooManyRequests
+	case errors.Is(err, tissa.ErrQueryTooLarge), errors.Is(err, tissa.ErrGapTooLarge):
+		status = http.StatusBadRequest
+	}
+	writeJSON(w, status, map[string]string{ "error": err.Error() })
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	if parts[0] != "series" || len(parts) > 3 || len(parts) == 2 {
+		writeError(w, &statusError{ status: http.StatusNotFound, err: fmt.Errorf("no endpoint %s", r.URL.Path) })
+		return
+	}
+	method := http.MethodGet
+	if len(parts) == 3 && parts[2] == "values" {
+		method = http.MethodPost
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, &statusError{ status: http.StatusMethodNotAllowed, err: fmt.Errorf("%s takes %s", r.URL.Path, method) })
+		return
+	}
+
+	set, err := h.seriesSet(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(parts) == 3 && parts[2] == "stream" {
+		if err = stream(w, set, parts[1], r); err != nil {
+			writeError(w, err)
+		}
+		return
+	}
+	if len(parts) == 3 && (parts[2] == "graph.png" || parts[2] == "graph.svg") {
+		if err = graph(w, set, parts[1], parts[2], r); err != nil {
+			writeError(w, err)
+		}
+		return
+	}
+	var resp interface{}
+	switch {
+	case len(parts) == 1:
+		var names []string
+		names, err = set.Names()
+		resp = map[string][]string{ "series": names }
+	case parts[2] == "values":
+		resp, err = addValues(set, parts[1], r)
+	case parts[2] == "latest":
+		resp, err = latest(set, parts[1])
+	default:
+		switch format := r.URL.Query().Get("format"); format {
+		case "", "json":
+			resp, err = query(set, parts[1], parts[2], r)
+		case "arrow":
+			if err = queryArrow(w, set, parts[1], parts[2], r); err != nil {
+				writeError(w, err)
+			}
+			return
+		default:
+			err = badRequest("bad format %q", format)
+		}
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type postedValues struct {
+	Timestamp *int64             `json:"timestamp"`
+	Values    map[string]float64 `json:"values"`
+}
+
+func addValues(set seriesSet, name string, r *http.Request) (interface{}, error) {
+	body := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxBody))
+	var raw json.RawMessage
+	if err := body.Decode(&raw); err != nil {
+		return nil, badRequest("bad values: %v", err)
+	}
+	var posts []postedValues
+	if len(raw) > 0 && raw[0] == '[' {
+		if err := json.Unmarshal(raw, &posts); err != nil {
+			return nil, badRequest("bad values: %v", err)
+		}
+	} else {
+		var p postedValues
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return nil, badRequest("bad values: %v", err)
+		}
+		posts = append(posts, p)
+	}
+
+	now := time.Now().Unix()
+	for i, p := range posts {
+		ts := now
+		if p.Timestamp != nil {
+			ts = *p.Timestamp
+		}
+		if err := set.AddValues(name, p.Values, ts); err != nil {
+			return map[string]int{ "added": i }, err
+		}
+	}
+	return map[string]int{ "added": len(posts) }, nil
+}
+
+// A float, or null if NaN.
+type jsonFloat float64
+
+func (f jsonFloat) MarshalJSON() ([]byte, error) {
+	if math.IsNaN(float64(f)) || math.IsInf(float64(f), 0) {
+		return []byte("null"), nil
+	}
+	return strconv.AppendFloat(nil, float64(f), 'g', -1, 64), nil
+}
+
+func jsonFloats(vals map[string][]float64) map[string][]jsonFloat {
+	res := make(map[string][]jsonFloat, len(vals))
+	for k, v := range vals {
+		f := make([]jsonFloat, len(v))
+		for i := range v {
+			f[i] = jsonFloat(v[i])
+		}
+		res[k] = f
+	}
+	return res
+}
+
+func jsonFloatMap(vals map[string]float64) map[string]jsonFloat {
+	res := make(map[string]jsonFloat, len(vals))
+	for k, v := range vals {
+		res[k] = jsonFloat(v)
+	}
+	return res
+}
+
+func latest(set seriesSet, name string) (interface{}, error) {
+	ts, err := set.Series(name)
+	if err != nil {
+		return nil, err
+	}
+	vals, timestamp := ts.Latest()
+	return struct {
+		Timestamp int64                `json:"timestamp"`
+		Values    map[string]jsonFloat `json:"values"`
+	}{ timestamp, jsonFloatMap(vals) }, nil
+}
+
+var aggregations = map[string]tissa.Aggregation{
+	"avg": tissa.AGGREGATE_AVERAGE,
+	"sum": tissa.AGGREGATE_SUM,
+	"count": tissa.AGGREGATE_COUNT,
+	"min": tissa.AGGREGATE_MIN,
+	"max": tissa.AGGREGATE_MAX,
+	"first": tissa.AGGREGATE_FIRST,
+	"last": tissa.AGGREGATE_LAST,
+	"time-weighted": tissa.AGGREGATE_TIME_WEIGHTED,
+}
+
+func intParam(r *http.Request, name string, required bool) (int64, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		if required {
+			return 0, badRequest("%s is required", name)
+		}
+		return 0, nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, badRequest("bad %s %q", name, s)
+	}
+	return v, nil
+}
+
+//
+// The options given by r's parameters, with fill as the fill policy
+// if r doesn't give one.
+//
+func queryOptions(r *http.Request, fill tissa.FillPolicy) (tissa.QueryOptions, error) {
+	o := tissa.QueryOptions{ Fill: fill }
+	params := r.URL.Query()
+	limit, err := intParam(r, "limit", false)
+	if err != nil {
+		return o, err
+	}
+	o.Limit = int(limit)
+
+	keys, glob := params.Get("keys"), params.Get("glob")
+	switch {
+	case keys != "" && glob != "":
+		return o, badRequest("keys and glob can't both be given")
+	case keys != "":
+		o.Keys = tissa.Keys(strings.Split(keys, ",")...)
+	case glob != "":
+		if o.Keys, err = tissa.KeyGlob(glob); err != nil {
+			return o, badRequest("bad glob: %v", err)
+		}
+	}
+
+	switch fill := params.Get("fill"); fill {
+	case "":
+	case "nan":
+		o.Fill = tissa.FILL_NAN
+	case "previous":
+		o.Fill = tissa.FILL_PREVIOUS
+	case "linear":
+		o.Fill = tissa.FILL_LINEAR
+	default:
+		if o.FillValue, err = strconv.ParseFloat(fill, 64); err != nil {
+			return o, badRequest("bad fill %q", fill)
+		}
+		o.Fill = tissa.FILL_CONSTANT
+	}
+	return o, nil
+}
+
+func query(set seriesSet, name, agg string, r *http.Request) (interface{}, error) {
+	aggregation, ok := aggregations[agg]
+	if !ok {
+		return nil, &statusError{ status: http.StatusNotFound, err: fmt.Errorf("no aggregation %q", agg) }
+	}
+	result, err := runQuery(set, name, aggregation, r, tissa.FILL_DEFAULT)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		Resolution int64                  `json:"resolution"`
+		Timestamps []int64                `json:"timestamps"`
+		Values     map[string][]jsonFloat `json:"values"`
+	}{ result.Resolution, result.Timestamps, jsonFloats(result.Values) }, nil
+}
+
+//
+// Write a query's result as an Arrow IPC stream.
+//
+func queryArrow(w http.ResponseWriter, set seriesSet, name, agg string, r *http.Request) error {
+	aggregation, ok := aggregations[agg]
+	if !ok {
+		return &statusError{ status: http.StatusNotFound, err: fmt.Errorf("no aggregation %q", agg) }
+	}
+	result, err := runQuery(set, name, aggregation, r, tissa.FILL_DEFAULT)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err = result.WriteArrow(&buf); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/vnd.apache.arrow.stream")
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+//
+// Run the query r's parameters describe on the named series.
+//
+func runQuery(set seriesSet, name string, aggregation tissa.Aggregation, r *http.Request,
+	fill tissa.FillPolicy) (*tissa.Result, error) {
+
+	start, err := intParam(r, "start", true)
+	if err != nil {
+		return nil, err
+	}
+	end, err := intParam(r, "end", true)
+	if err != nil {
+		return nil, err
+	}
+	res, err := intParam(r, "res", false)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := queryOptions(r, fill)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := set.Series(name)
+	if err != nil {
+		return nil, err
+	}
+	if res == 0 {
+		res = ts.BestResolution(start)
+	}
+	if res < 0 {
+		return nil, badRequest("res must be positive")
+	}
+	return ts.Query(start, end, res, aggregation, opts)
+}
+
+//
+// Draw the query r's parameters describe as graph.png or graph.svg.
+//
+func graph(w http.ResponseWriter, set seriesSet, name, file string, r *http.Request) error {
+	params := r.URL.Query()
+	agg := params.Get("agg")
+	if agg == "" {
+		agg = "avg"
+	}
+	aggregation, ok := aggregations[agg]
+	if !ok {
+		return badRequest("no aggregation %q", agg)
+	}
+	opts := tissa.GraphOptions{ Title: params.Get("title") }
+	var err error
+	for _, p := range []struct {
+		name string
+		v    *int
+	}{ { "width", &opts.Width }, { "height", &opts.Height } } {
+		n, err := intParam(r, p.name, false)
+		if err != nil {
+			return err
+		}
+		if n < 0 || n > 4096 {
+			return badRequest("bad %s %d", p.name, n)
+		}
+		*p.v = int(n)
+	}
+	for _, p := range []struct {
+		name string
+		v    *float64
+	}{ { "min", &opts.Min }, { "max", &opts.Max } } {
+		if s := params.Get(p.name); s != "" {
+			if *p.v, err = strconv.ParseFloat(s, 64); err != nil {
+				return badRequest("bad %s %q", p.name, s)
+			}
+		}
+	}
+	if colors := params.Get("colors"); colors != "" {
+		for _, c := range strings.Split(colors, ",") {
+			opts.Colors = append(opts.Colors, "#" + strings.TrimPrefix(c, "#"))
+		}
+	}
+
+	result, err := runQuery(set, name, aggregation, r, tissa.FILL_NAN)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	contentType := "image/png"
+	if file == "graph.svg" {
+		contentType = "image/svg+xml"
+		err = tissa.RenderSVG(&buf, result, opts)
+	} else {
+		err = tissa.RenderPNG(&buf, result, opts)
+	}
+	if err != nil {
+		return badRequest("%v", err)
+	}
+	w.Header().Set("Content-Type", contentType)
+	_, err = buf.WriteTo(w)
+	return err
+}
@@ -0,0 +1,432 @@
+package http
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fred-lewis/tissa"
+)
+
+func TestHandler(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/http")
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+
+	db, err := tissa.NewDB("/tmp/timeseries_test/http", tissa.TimeSeriesConfig{
+		Archives: []tissa.ArchiveConfig{
+			{Resolution: tissa.SECOND, Retention: tissa.HOUR},
+			{Resolution: tissa.MINUTE, Retention: tissa.DAY},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(NewHandler(db))
+	defer srv.Close()
+
+	startTime := int64(1560632400)
+	var posts []string
+	for i := int64(0); i < 180; i++ {
+		posts = append(posts, fmt.Sprintf(`{"timestamp": %d, "values": {"web1": %d, "web2": 2}}`, startTime + i, i))
+	}
+	resp, err := http.Post(srv.URL + "/series/cpu/values", "application/json",
+		strings.NewReader("[" + strings.Join(posts, ",") + "]"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var added map[string]int
+	json.NewDecoder(resp.Body).Decode(&added)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || added["added"] != 180 {
+		t.Errorf("Post gave %d %v", resp.StatusCode, added)
+	}
+
+	get := func(path string, v interface{}) int {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		json.NewDecoder(resp.Body).Decode(v)
+		return resp.StatusCode
+	}
+
+	var res struct {
+		Resolution int64
+		Timestamps []int64
+		Values     map[string][]*float64
+	}
+	path := fmt.Sprintf("/series/cpu/max?start=%d&end=%d&res=60&keys=web1&fill=nan", startTime, startTime + 180)
+	if code := get(path, &res); code != http.StatusOK {
+		t.Fatalf("Query gave %d", code)
+	}
+	web1 := res.Values["web1"]
+	if res.Resolution != 60 || len(res.Timestamps) != 3 || len(res.Values) != 1 || len(web1) != 3 ||
+		web1[0] != nil || *web1[2] != 119 {
+		t.Errorf("Query gave %+v", res)
+	}
+
+	var latest struct {
+		Timestamp int64
+		Values    map[string]float64
+	}
+	if code := get("/series/cpu/latest", &latest); code != http.StatusOK ||
+		latest.Timestamp != startTime + 179 || latest.Values["web1"] != 179 {
+		t.Errorf("Latest gave %d %+v", code, latest)
+	}
+	var names map[string][]string
+	if code := get("/series", &names); code != http.StatusOK || len(names["series"]) != 1 {
+		t.Errorf("Series gave %d %v", code, names)
+	}
+
+	var e map[string]string
+	if code := get("/series/mem/latest", &e); code != http.StatusNotFound || e["error"] == "" {
+		t.Errorf("Missing series gave %d %v", code, e)
+	}
+	if code := get("/series/cpu/avg?start=1", &e); code != http.StatusBadRequest {
+		t.Errorf("Query without end gave %d", code)
+	}
+	if code := get("/series/cpu/median?start=1&end=2", &e); code != http.StatusNotFound {
+		t.Errorf("Unknown aggregation gave %d", code)
+	}
+	resp, err = http.Get(srv.URL + strings.Replace(path, "/max?", "/graph.png?", 1) + "&title=cpu")
+	if err == nil {
+		resp.Body.Close()
+	}
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("Graph gave %v: %v", resp, err)
+	}
+	if code := get("/series/cpu/values", &e); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET of values gave %d", code)
+	}
+
+	resp, err = http.Get(srv.URL + path + "&format=arrow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/vnd.apache.arrow.stream" ||
+		!strings.HasPrefix(string(body), "\xff\xff\xff\xff") || !strings.HasSuffix(string(body), "\xff\xff\xff\xff\x00\x00\x00\x00") {
+		t.Errorf("Arrow query gave %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if code := get(path + "&format=xml", &e); code != http.StatusBadRequest {
+		t.Errorf("Unknown format gave %d", code)
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/http_concurrent")
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+
+	db, err := tissa.NewDB("/tmp/timeseries_test/http_concurrent", tissa.TimeSeriesConfig{
+		Archives: []tissa.ArchiveConfig{
+			{Resolution: tissa.SECOND, Retention: tissa.HOUR},
+			{Resolution: tissa.MINUTE, Retention: tissa.DAY},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(NewHandler(db))
+	defer srv.Close()
+	stop := db.WriteEvery(1, func(err error) { t.Error(err) })
+	defer stop()
+
+	// posts to and queries of the same series, served side by side
+	startTime := int64(1560632400)
+	var wg sync.WaitGroup
+	for w := int64(0); w < 4; w++ {
+		wg.Add(2)
+		go func(w int64) {
+			defer wg.Done()
+			for i := int64(0); i < 30; i++ {
+				body := fmt.Sprintf(`{"timestamp": %d, "values": {"web1": %d}}`, startTime + i, i)
+				if resp, err := http.Post(srv.URL + fmt.Sprintf("/series/cpu%d/values", w), "application/json",
+					strings.NewReader(body)); err == nil {
+					resp.Body.Close()
+				}
+			}
+		}(w)
+		go func(w int64) {
+			defer wg.Done()
+			for i := 0; i < 30; i++ {
+				path := fmt.Sprintf("/series/cpu%d/max?start=%d&end=%d&res=60", w, startTime, startTime + 120)
+				if resp, err := http.Get(srv.URL + path); err == nil {
+					resp.Body.Close()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for w := 0; w < 4; w++ {
+		ts, err := db.Series(fmt.Sprintf("cpu%d", w))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, timestamp := ts.Latest(); timestamp != startTime + 29 || v["web1"] != 29 {
+			t.Errorf("cpu%d latest is %v at %d", w, v, timestamp)
+		}
+	}
+}
+
+func TestGrafana(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/grafana")
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+
+	db, err := tissa.NewDB("/tmp/timeseries_test/grafana", tissa.TimeSeriesConfig{
+		Archives: []tissa.ArchiveConfig{
+			{Resolution: tissa.SECOND, Retention: tissa.HOUR},
+			{Resolution: tissa.MINUTE, Retention: tissa.DAY},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560632400)
+	for i := int64(0); i < 180; i++ {
+		db.AddValues("cpu", map[string]float64{ "web1": float64(i), "web2": 2, "db1": 3 }, startTime + i)
+	}
+	g := NewGrafana(db)
+	g.Annotate(Annotation{ Series: "cpu", Key: "web1", Time: startTime + 30, Title: "deploy" })
+	g.Annotate(Annotation{ Series: "cpu", Key: "db1", Time: startTime + 40, Title: "backup" })
+	srv := httptest.NewServer(g)
+	defer srv.Close()
+
+	post := func(path, body string, v interface{}) int {
+		resp, err := http.Post(srv.URL + path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		json.NewDecoder(resp.Body).Decode(v)
+		return resp.StatusCode
+	}
+
+	var targets []string
+	if code := post("/search", `{"target": "web"}`, &targets); code != http.StatusOK ||
+		len(targets) != 2 || targets[0] != "cpu:web1" {
+		t.Errorf("Search gave %d %v", code, targets)
+	}
+
+	rng := fmt.Sprintf(`"range": {"from": %q, "to": %q}`,
+		time.Unix(startTime, 0).UTC().Format(time.RFC3339), time.Unix(startTime + 180, 0).UTC().Format(time.RFC3339))
+	var series []struct {
+		Target     string
+		Datapoints [][2]float64
+	}
+	body := `{` + rng + `, "intervalMs": 60000, "targets": [{"target": "cpu:web*", "refId": "A",
+		"data": {"aggregation": "max"}}]}`
+	if code := post("/query", body, &series); code != http.StatusOK || len(series) != 2 {
+		t.Fatalf("Query gave %d %v", code, series)
+	}
+	if s := series[0]; s.Target != "cpu:web1" || len(s.Datapoints) != 3 || s.Datapoints[0][0] != 59 ||
+		s.Datapoints[0][1] != float64(startTime * 1000) {
+		t.Errorf("Query gave %v", series)
+	}
+
+	var annotations []struct {
+		Time  int64
+		Title string
+	}
+	if code := post("/annotations", `{` + rng + `, "annotation": {"query": "cpu:web*"}}`, &annotations);
+		code != http.StatusOK || len(annotations) != 1 || annotations[0].Title != "deploy" ||
+		annotations[0].Time != (startTime + 30) * 1000 {
+		t.Errorf("Annotations gave %d %v", code, annotations)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/admin")
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+
+	config := tissa.TimeSeriesConfig{
+		Archives: []tissa.ArchiveConfig{
+			{Resolution: tissa.SECOND, Retention: tissa.HOUR},
+			{Resolution: tissa.MINUTE, Retention: tissa.DAY},
+		},
+	}
+	db, err := tissa.NewDB("/tmp/timeseries_test/admin", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560632400)
+	for i := int64(0); i < 180; i++ {
+		db.AddValues("cpu", map[string]float64{ "web1": float64(i), "web2": 2 }, startTime + i)
+	}
+	if _, err = db.CreateNamespace("acme", config); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.StripPrefix("/admin", NewAdmin(db)))
+	defer srv.Close()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var b strings.Builder
+		io.Copy(&b, resp.Body)
+		return resp.StatusCode, b.String()
+	}
+
+	code, page := get("/admin/")
+	if code != http.StatusOK || !strings.Contains(page, `href="series/cpu?namespace="`) ||
+		!strings.Contains(page, `href="./?namespace=acme"`) {
+		t.Errorf("Index gave %d %s", code, page)
+	}
+	code, page = get("/admin/series/cpu?span=3600")
+	if code != http.StatusOK || !strings.Contains(page, "<td>1s</td><td>1h</td>") ||
+		!strings.Contains(page, "web2") || !strings.Contains(page, "graph.svg?") {
+		t.Errorf("Series page gave %d %s", code, page)
+	}
+	if code, _ = get("/admin/series/mem"); code != http.StatusNotFound {
+		t.Errorf("Missing series gave %d", code)
+	}
+
+	i := strings.Index(page, `src="../api/`)
+	graph := strings.ReplaceAll(page[i + len(`src="../`):strings.Index(page[i + 5:], `"`) + i + 5], "&amp;", "&")
+	if code, page = get("/admin/" + graph); code != http.StatusOK || !strings.HasPrefix(page, "<svg") {
+		t.Errorf("Graph %s gave %d %.100s", graph, code, page)
+	}
+}
+
+func TestStream(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/stream")
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+
+	db, err := tissa.NewDB("/tmp/timeseries_test/stream", tissa.TimeSeriesConfig{
+		Archives: []tissa.ArchiveConfig{
+			{Resolution: tissa.SECOND, Retention: tissa.HOUR},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560632400)
+	db.AddValues("cpu", map[string]float64{ "web1": 1 }, startTime)
+	srv := httptest.NewServer(NewHandler(db))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /series/cpu/stream?glob=web* HTTP/1.1\r\nHost: tissa\r\nUpgrade: websocket\r\n" +
+		"Connection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Handshake gave %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// the subscription starts once the handshake is done
+	ts, _ := db.Series("cpu")
+	ts.AddValues(map[string]float64{ "web1": 2, "db1": 3 }, startTime + 1)
+	var hdr [2]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, hdr[1] & 0x7f)
+	io.ReadFull(r, payload)
+	var msg struct {
+		Timestamp int64
+		Values    map[string]float64
+	}
+	if err = json.Unmarshal(payload, &msg); hdr[0] != 0x81 || err != nil ||
+		msg.Timestamp != startTime + 1 || len(msg.Values) != 1 || msg.Values["web1"] != 2 {
+		t.Errorf("Stream sent %x %s: %v", hdr, payload, err)
+	}
+
+	// a masked close frame
+	conn.Write([]byte{ 0x88, 0x82, 1, 2, 3, 4, 0x03 ^ 1, 0xe8 ^ 2 })
+	if _, err = io.ReadFull(r, hdr[:]); err != nil || hdr[0] != 0x88 {
+		t.Errorf("Close gave %x: %v", hdr, err)
+	}
+}
+
+func TestOpenTSDB(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/opentsdb")
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+
+	db, err := tissa.NewDB("/tmp/timeseries_test/opentsdb", tissa.TimeSeriesConfig{
+		Archives: []tissa.ArchiveConfig{
+			{Resolution: tissa.SECOND, Retention: tissa.HOUR},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(NewOpenTSDB(db, "tsdb"))
+	defer srv.Close()
+
+	startTime := int64(1560632400)
+	put := func(query, body string) (int, string) {
+		resp, err := http.Post(srv.URL + "/api/put" + query, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	status, _ := put("", fmt.Sprintf(`[
+		{"metric": "sys.cpu.user", "timestamp": %d, "value": 42.5, "tags": {"host": "web01", "dc.name": "lga"}},
+		{"metric": "sys.cpu.user", "timestamp": %d, "value": "40", "tags": {"host": "web02", "dc.name": "lga"}}]`,
+		startTime, (startTime + 1) * 1000))
+	if status != http.StatusNoContent {
+		t.Errorf("Put gave %d", status)
+	}
+	ts, err := db.Series("tsdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := ts.SelectSeries("sys.cpu.user", tissa.Labels{ "dc_name": "lga" })
+	if len(keys) != 2 || keys[0] != `sys.cpu.user{dc_name="lga",host="web01"}` {
+		t.Errorf("Expected two labeled series, got %v", keys)
+	}
+	vals, timestamp := ts.Latest()
+	if timestamp != startTime + 1 || vals[keys[1]] != 40 {
+		t.Errorf("Latest was %v at %d", vals, timestamp)
+	}
+
+	status, body := put("?details", fmt.Sprintf(`[
+		{"metric": "sys.mem", "timestamp": %d, "value": 1, "tags": {"host": "web01"}},
+		{"metric": "", "timestamp": %d, "value": 1},
+		{"metric": "sys.mem", "timestamp": %d, "value": "lots"}]`, startTime + 2, startTime + 2, startTime + 2))
+	var details struct {
+		Success int
+		Failed  int
+		Errors  []struct {
+			Datapoint map[string]interface{}
+			Error     string
+		}
+	}
+	if err = json.Unmarshal([]byte(body), &details); status != http.StatusBadRequest || err != nil ||
+		details.Success != 1 || details.Failed != 2 || len(details.Errors) != 2 || details.Errors[1].Datapoint["value"] != "lots" {
+		t.Errorf("Put with details gave %d %s", status, body)
+	}
+	if status, body = put("?summary", `{"metric": "sys.mem", "timestamp": 1560632403, "value": 2}`);
+		status != http.StatusOK || body != "{\"failed\":0,\"success\":1}\n" {
+		t.Errorf("Put with summary gave %d %s", status, body)
+	}
+}
@@ -0,0 +1,245 @@
+package http
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fred-lewis/tissa"
+)
+
+//
+// A minimal WebSocket (RFC 6455) server side, enough to push text
+// messages and answer pings and closes.
+//
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opText  = 0x1
+	opClose = 0x8
+	opPing  = 0x9
+	opPong  = 0xa
+)
+
+// Close codes.
+const (
+	closeNormal   = 1000
+	closeTooSlow  = 1008
+)
+
+// How many messages may wait for a slow client before it's cut off,
+// and how long a write may take.
+const (
+	streamBuffer  = 256
+	streamTimeout = 10 * time.Second
+)
+
+// The largest frame a client may send; it only needs to send control
+// frames.
+const maxClientFrame = 1 << 16
+
+type websocket struct {
+	conn net.Conn
+	r    *bufio.Reader
+	mu   sync.Mutex
+}
+
+func headerHas(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//
+// Complete the WebSocket handshake for r and take over its
+// connection.
+//
+func upgrade(w http.ResponseWriter, r *http.Request) (*websocket, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerHas(r.Header, "Connection", "upgrade") || !headerHas(r.Header, "Upgrade", "websocket") || key == "" {
+		return nil, badRequest("not a websocket request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, badRequest("unsupported websocket version")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection can't be taken over")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err = rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &websocket{ conn: conn, r: rw.Reader }, nil
+}
+
+func (ws *websocket) writeFrame(op byte, payload []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	hdr := []byte{ 0x80 | op, 0 }
+	switch n := len(payload); {
+	case n < 126:
+		hdr[1] = byte(n)
+	case n < 1 << 16:
+		hdr[1] = 126
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr[1] = 127
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+	ws.conn.SetWriteDeadline(time.Now().Add(streamTimeout))
+	if _, err := ws.conn.Write(append(hdr, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (ws *websocket) close(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	ws.writeFrame(opClose, append(payload, reason...))
+	return ws.conn.Close()
+}
+
+//
+// Read frames from the client, answering pings, until it closes the
+// connection or goes away.
+//
+func (ws *websocket) readLoop() error {
+	for {
+		var hdr [2]byte
+		if _, err := io.ReadFull(ws.r, hdr[:]); err != nil {
+			return err
+		}
+		op := hdr[0] & 0x0f
+		masked := hdr[1] & 0x80 != 0
+		n := uint64(hdr[1] & 0x7f)
+		switch n {
+		case 126:
+			var b [2]byte
+			if _, err := io.ReadFull(ws.r, b[:]); err != nil {
+				return err
+			}
+			n = uint64(binary.BigEndian.Uint16(b[:]))
+		case 127:
+			var b [8]byte
+			if _, err := io.ReadFull(ws.r, b[:]); err != nil {
+				return err
+			}
+			n = binary.BigEndian.Uint64(b[:])
+		}
+		if !masked || n > maxClientFrame {
+			return errors.New("bad frame from websocket client")
+		}
+		var mask [4]byte
+		if _, err := io.ReadFull(ws.r, mask[:]); err != nil {
+			return err
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(ws.r, payload); err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i % 4]
+		}
+		switch op {
+		case opClose:
+			ws.close(closeNormal, "")
+			return nil
+		case opPing:
+			if err := ws.writeFrame(opPong, payload); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+//
+// Push the values appended to the named series as JSON text
+// messages, one per append:
+//
+//	{"timestamp": 1560632400, "values": {"cpu": 0.5}}
+//
+// Keys are selected with keys or glob, as for queries.  A client
+// that falls too far behind is disconnected.
+//
+func stream(w http.ResponseWriter, set seriesSet, name string, r *http.Request) error {
+	opts, err := queryOptions(r, tissa.FILL_DEFAULT)
+	if err != nil {
+		return err
+	}
+	ts, err := set.Series(name)
+	if err != nil {
+		return err
+	}
+	msgs := make(chan []byte, streamBuffer)
+	slow := make(chan struct{})
+	var slowOnce sync.Once
+	cancel := ts.Subscribe(opts.Keys, func(timestamp int64, vals map[string]float64) {
+		msg, err := json.Marshal(struct {
+			Timestamp int64                `json:"timestamp"`
+			Values    map[string]jsonFloat `json:"values"`
+		}{ timestamp, jsonFloatMap(vals) })
+		if err != nil {
+			return
+		}
+		select {
+		case msgs <- msg:
+		default:
+			slowOnce.Do(func() { close(slow) })
+		}
+	})
+	defer cancel()
+	// subscribed first, so the client sees everything added after the
+	// handshake
+	ws, err := upgrade(w, r)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ws.readLoop()
+		close(done)
+	}()
+	for {
+		select {
+		case msg := <-msgs:
+			if err := ws.writeFrame(opText, msg); err != nil {
+				ws.conn.Close()
+				return nil
+			}
+		case <-slow:
+			ws.close(closeTooSlow, "too slow")
+			return nil
+		case <-done:
+			ws.conn.Close()
+			return nil
+		}
+	}
+}
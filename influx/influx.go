@@ -0,0 +1,386 @@
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package influx moves data between InfluxDB and a tissa.TimeSeries,
+in InfluxDB's line protocol or the results of Flux queries:
+
+	f, _ := os.Open("export.lp")
+	n, err := influx.Import(ts, f, time.Nanosecond)
+
+	n, err = influx.ImportQuery(ts, "http://localhost:8086", "my-org", token,
+		`from(bucket: "telegraf") |> range(start: -30d) |> filter(fn: (r) => r._measurement == "cpu")`)
+
+	err = influx.Export(w, ts, start, end, nil)
+
+Import reads line protocol, such as influx_inspect export writes;
+comment lines, and the CREATE statements it writes ahead of the
+data, are skipped.  Timestamps are
+in units of precision, nanoseconds if it's 0, and lines without one
+are stamped with the current time.  ImportFlux reads the CSV tables
+a Flux query returns, with or without annotations, and ImportQuery
+runs a Flux query over HTTP against InfluxDB 2.x, or 1.8 and later,
+and imports its result.
+
+Each field of a point is added as a labeled value, labeled with the
+point's tags, and named as Prometheus names Telegraf's metrics: the
+measurement and the field key joined by an underscore, or just the
+measurement for a field named "value".  Tag keys that aren't valid
+label names have their other characters replaced with underscores.
+Boolean fields are stored as 1 or 0, and string fields are skipped.
+
+InfluxDB exports points a series at a time, rather than in time
+order, so every point is read before any is added; they're then
+added in time order, as AddValues would have added them as they came
+in, so they're rolled up into the series' rollup archives along the
+way.  Timestamps are cut to seconds, and the last of a series' points
+in a second is the one kept.  Since a TimeSeries drops appends older
+than its latest data, data should be imported into a series with
+nothing newer.
+
+Export writes the values of a series' base archive back out as line
+protocol, a line per value: each key's name is the measurement, its
+labels the tags, and its value the field "value", with timestamps in
+nanoseconds.
+*/
+package influx
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fred-lewis/tissa"
+)
+
+//
+// Add the points of the line protocol read from r to ts, with
+// timestamps in units of precision.  Returns the number of values
+// added.
+//
+func Import(ts *tissa.TimeSeries, r io.Reader, precision time.Duration) (int, error) {
+	if precision <= 0 {
+		precision = time.Nanosecond
+	}
+	pts := newPoints()
+	now := time.Now().UnixNano()
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1 << 20)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' || strings.HasPrefix(line, "CREATE ") {
+			continue
+		}
+		p, err := parseLine(line)
+		if err != nil {
+			return 0, fmt.Errorf("line %d: %w", n, err)
+		}
+		ns := now
+		if p.hasTime {
+			ns = p.timestamp * int64(precision)
+		}
+		for _, f := range p.fields {
+			if !f.numeric {
+				continue
+			}
+			if err = pts.add(seriesName(p.measurement, f.key), p.tags, f.value, ns); err != nil {
+				return 0, fmt.Errorf("line %d: %w", n, err)
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return 0, err
+	}
+	return pts.addTo(ts)
+}
+
+//
+// Add the values in the CSV tables of a Flux query's result, read
+// from r, to ts.  Returns the number of values added.
+//
+func ImportFlux(ts *tissa.TimeSeries, r io.Reader) (int, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	pts := newPoints()
+
+	var header []string
+	var timeCol, valueCol, fieldCol, measurementCol, errCol int
+	var tagCols []int
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if len(rec) > 0 && strings.HasPrefix(rec[0], "#") {
+			// annotations, ahead of a table's header
+			header = nil
+			continue
+		}
+		if header == nil || isHeader(rec) {
+			header = rec
+			timeCol, valueCol, fieldCol, measurementCol, errCol = -1, -1, -1, -1, -1
+			tagCols = nil
+			for i, c := range rec {
+				switch c {
+				case "_time":
+					timeCol = i
+				case "_value":
+					valueCol = i
+				case "_field":
+					fieldCol = i
+				case "_measurement":
+					measurementCol = i
+				case "error":
+					errCol = i
+				case "", "result", "table":
+				default:
+					if !strings.HasPrefix(c, "_") {
+						tagCols = append(tagCols, i)
+					}
+				}
+			}
+			continue
+		}
+		if errCol >= 0 && valueCol < 0 && errCol < len(rec) {
+			return 0, fmt.Errorf("flux query failed: %s", rec[errCol])
+		}
+		if timeCol < 0 || valueCol < 0 || (fieldCol < 0 && measurementCol < 0) {
+			return 0, fmt.Errorf("flux table has no _time, _value, or _field and _measurement columns")
+		}
+		if len(rec) != len(header) {
+			return 0, fmt.Errorf("flux row has %d columns, its table %d", len(rec), len(header))
+		}
+		stamp, err := time.Parse(time.RFC3339Nano, rec[timeCol])
+		if err != nil {
+			return 0, fmt.Errorf("bad _time %q", rec[timeCol])
+		}
+		v, ok := fluxValue(rec[valueCol])
+		if !ok {
+			continue
+		}
+		var name string
+		switch {
+		case measurementCol < 0:
+			name = rec[fieldCol]
+		case fieldCol < 0:
+			name = rec[measurementCol]
+		default:
+			name = seriesName(rec[measurementCol], rec[fieldCol])
+		}
+		var tags tissa.Labels
+		for _, i := range tagCols {
+			if rec[i] != "" {
+				if tags == nil {
+					tags = make(tissa.Labels)
+				}
+				tags[header[i]] = rec[i]
+			}
+		}
+		if err = pts.add(name, tags, v, stamp.UnixNano()); err != nil {
+			return 0, err
+		}
+	}
+	return pts.addTo(ts)
+}
+
+//
+// Without annotations, tables are separated by blank lines, which
+// the CSV reader skips, so a new table's header is told from a row
+// by its column names.
+//
+func isHeader(rec []string) bool {
+	var hasTime, hasValue bool
+	for _, c := range rec {
+		hasTime = hasTime || c == "_time"
+		hasValue = hasValue || c == "_value"
+	}
+	return hasTime && hasValue
+}
+
+func fluxValue(s string) (float64, bool) {
+	if v, err := strconv.ParseFloat(s, 64); err == nil {
+		return v, true
+	}
+	switch s {
+	case "true":
+		return 1, true
+	case "false":
+		return 0, true
+	}
+	// strings, and empty values
+	return 0, false
+}
+
+//
+// Run the Flux query against the InfluxDB at addr (as in
+// "http://localhost:8086") and add its result to ts, as ImportFlux
+// does.  The request is authorized with token, if set, which for
+// InfluxDB 1.8 is "username:password"; 1.8 ignores org.
+//
+func ImportQuery(ts *tissa.TimeSeries, addr, org, token, query string) (int, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"query": query,
+		"type": "flux",
+		"dialect": map[string]interface{}{ "annotations": []string{ "datatype", "group", "default" } },
+	})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(addr, "/") + "/api/v2/query?org=" + url.QueryEscape(org),
+		bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/csv")
+	if token != "" {
+		req.Header.Set("Authorization", "Token " + token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return 0, fmt.Errorf("influxdb query: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return ImportFlux(ts, resp.Body)
+}
+
+//
+// Write the values in ts's base archive between start and end, of
+// the keys selected by keys (all if nil), to w as line protocol.
+// Missing and infinite values, which line protocol can't hold, are
+// left out.
+//
+func Export(w io.Writer, ts *tissa.TimeSeries, start, end int64, keys *tissa.KeyFilter) error {
+	res, err := ts.Query(start, end, ts.Config().Archives[0].Resolution, tissa.AGGREGATE_AVERAGE,
+		tissa.QueryOptions{ Keys: keys, Fill: tissa.FILL_NAN })
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(res.Values))
+	for k := range res.Values {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	for _, k := range names {
+		name, labels, err := tissa.ParseSeriesKey(k)
+		if err != nil {
+			return err
+		}
+		prefix := linePrefix(name, labels)
+		for i, v := range res.Values[k] {
+			if res.Missing[k][i] || math.IsInf(v, 0) {
+				continue
+			}
+			bw.WriteString(prefix)
+			bw.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+			bw.WriteByte(' ')
+			bw.WriteString(strconv.FormatInt(res.Timestamps[i] * int64(time.Second), 10))
+			bw.WriteByte('\n')
+		}
+	}
+	return bw.Flush()
+}
+
+//
+// The name of the series a field is added to.
+//
+func seriesName(measurement, field string) string {
+	if field == "value" {
+		return measurement
+	}
+	return measurement + "_" + field
+}
+
+//
+// A tag key as a label name: letters, digits and underscores, not
+// starting with a digit.
+//
+func labelName(k string) string {
+	b := []byte(k)
+	for i, c := range b {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+//
+// Points read, by second and series key, to be added in time order.
+//
+type points struct {
+	seconds map[int64]map[string]tissa.LabeledValue
+}
+
+func newPoints() *points {
+	return &points{ seconds: make(map[int64]map[string]tissa.LabeledValue) }
+}
+
+func (p *points) add(name string, tags tissa.Labels, v float64, ns int64) error {
+	var labels tissa.Labels
+	if len(tags) > 0 {
+		labels = make(tissa.Labels, len(tags))
+		for k, tv := range tags {
+			labels[labelName(k)] = tv
+		}
+	}
+	key, err := tissa.SeriesKey(name, labels)
+	if err != nil {
+		return err
+	}
+	sec := ns / int64(time.Second)
+	if ns % int64(time.Second) < 0 {
+		sec--
+	}
+	vals := p.seconds[sec]
+	if vals == nil {
+		vals = make(map[string]tissa.LabeledValue)
+		p.seconds[sec] = vals
+	}
+	vals[key] = tissa.LabeledValue{ Name: name, Labels: labels, Value: v }
+	return nil
+}
+
+//
+// Add the points to ts a second at a time, then write it.
+//
+func (p *points) addTo(ts *tissa.TimeSeries) (int, error) {
+	secs := make([]int64, 0, len(p.seconds))
+	for s := range p.seconds {
+		secs = append(secs, s)
+	}
+	sort.Slice(secs, func(i, j int) bool { return secs[i] < secs[j] })
+
+	added := 0
+	for _, s := range secs {
+		vals := make([]tissa.LabeledValue, 0, len(p.seconds[s]))
+		for _, v := range p.seconds[s] {
+			vals = append(vals, v)
+		}
+		if err := ts.AddLabeledValues(vals, s); err != nil {
+			return added, err
+		}
+		added += len(vals)
+	}
+	return added, ts.Write()
+}
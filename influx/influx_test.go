@@ -0,0 +1,224 @@
+package influx
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fred-lewis/tissa"
+)
+
+func newSeries(t *testing.T, dir string) *tissa.TimeSeries {
+	os.RemoveAll(dir)
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+	ts, err := tissa.NewTimeSeries(dir, tissa.TimeSeriesConfig{
+		Archives: []tissa.ArchiveConfig{
+			{Resolution: tissa.SECOND, Retention: tissa.HOUR},
+			{Resolution: tissa.MINUTE, Retention: tissa.DAY},
+		},
+		CarryForwardTicks: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+func TestParseLine(t *testing.T) {
+	p, err := parseLine(`disk\ io,host=web\,1,path=/a\=b read=1.5,ok=t,n=-3i,u=7u,msg="a \"b\", c" 1560628800000000000`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.measurement != "disk io" || p.tags["host"] != "web,1" || p.tags["path"] != "/a=b" ||
+		!p.hasTime || p.timestamp != 1560628800000000000 {
+		t.Errorf("Parsed %+v", p)
+	}
+	if fmt.Sprint(p.fields) != "[{read 1.5 true} {ok 1 true} {n -3 true} {u 7 true} {msg 0 false}]" {
+		t.Errorf("Fields were %v", p.fields)
+	}
+	if p, err = parseLine("cpu value=1"); err != nil || p.hasTime || p.tags != nil {
+		t.Errorf("Parsed %+v, %v", p, err)
+	}
+	for _, bad := range []string{ "cpu", "cpu,host value=1", "cpu value=x", `cpu msg="open`, "cpu value=1 now", " value=1" } {
+		if _, err = parseLine(bad); err == nil {
+			t.Errorf("Parsed %q", bad)
+		}
+	}
+	name, labels, _ := tissa.ParseSeriesKey(`disk io{host="web,1"}`)
+	if prefix := linePrefix(name, labels); prefix != `disk\ io,host=web\,1 value=` {
+		t.Errorf("Prefix was %s", prefix)
+	}
+}
+
+func TestImportExport(t *testing.T) {
+	ts := newSeries(t, "/tmp/timeseries_test/influx")
+	start := int64(1560628800)
+	ms := func(s int64) string { return fmt.Sprint((start + s) * 1000) }
+	// a series at a time, as influx_inspect exports them
+	lines := "# DDL\nCREATE DATABASE telegraf WITH NAME autogen\n# DML\n# CONTEXT-DATABASE:telegraf\n" +
+		"cpu,host=a,cpu-id=0 usage=1,up=true,note=\"ok\" " + ms(0) + "\n" +
+		"cpu,host=a,cpu-id=0 usage=2,up=false " + ms(30) + "\n" +
+		"cpu,host=a,cpu-id=0 usage=3 " + ms(61) + "\n" +
+		"load value=5i " + ms(0) + "\n" +
+		// the last in a second is kept
+		"load value=6i " + ms(30) + "\n" +
+		"load value=7i " + fmt.Sprint((start + 30) * 1000 + 500) + "\n"
+	n, err := Import(ts, strings.NewReader(lines), time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 7 {
+		t.Errorf("Added %d values", n)
+	}
+	usage, up := `cpu_usage{cpu_id="0",host="a"}`, `cpu_up{cpu_id="0",host="a"}`
+	if keys := ts.Keys(); fmt.Sprint(keys) != fmt.Sprint([]string{ up, usage, "load" }) {
+		t.Errorf("Keys were %v", keys)
+	}
+	res, err := ts.Query(start, start + 62, tissa.SECOND, tissa.AGGREGATE_AVERAGE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := res.Values[usage]; v[0] != 1 || v[30] != 2 || v[61] != 3 || !res.Missing[usage][1] {
+		t.Errorf("usage was %v", v)
+	}
+	if v := res.Values[up]; v[0] != 1 || v[30] != 0 {
+		t.Errorf("up was %v", v)
+	}
+	if v := res.Values["load"]; v[0] != 5 || v[30] != 7 {
+		t.Errorf("load was %v", v)
+	}
+	// rolled up as they were added, and stamped with the minute's end
+	rollups, _, err := ts.Rollups(start + 60, start + 120, tissa.MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := rollups[usage]; len(r) != 1 || r[0].Count != 2 || r[0].Total != 3 {
+		t.Errorf("usage rolled up to %+v", r)
+	}
+	if _, err = Import(ts, strings.NewReader("cpu value=1\ncpu value=\n"), 0); err == nil ||
+		!strings.HasPrefix(err.Error(), "line 2:") {
+		t.Errorf("Bad line gave %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err = Export(&buf, ts, start, start + 62, tissa.Keys(usage, "load")); err != nil {
+		t.Fatal(err)
+	}
+	ns := func(s int64) string { return fmt.Sprint((start + s) * 1e9) }
+	want := "cpu_usage,cpu_id=0,host=a value=1 " + ns(0) + "\n" +
+		"cpu_usage,cpu_id=0,host=a value=2 " + ns(30) + "\n" +
+		"cpu_usage,cpu_id=0,host=a value=3 " + ns(61) + "\n" +
+		"load value=5 " + ns(0) + "\n" +
+		"load value=7 " + ns(30) + "\n"
+	if buf.String() != want {
+		t.Errorf("Exported\n%s", buf.String())
+	}
+
+	// and back in, as the same keys
+	ts2 := newSeries(t, "/tmp/timeseries_test/influx2")
+	if n, err = Import(ts2, &buf, 0); err != nil || n != 5 {
+		t.Fatalf("Reimported %d, %v", n, err)
+	}
+	if keys := ts2.Keys(); fmt.Sprint(keys) != fmt.Sprint([]string{ usage, "load" }) {
+		t.Errorf("Reimported keys were %v", keys)
+	}
+}
+
+const fluxResult = `#datatype,string,long,dateTime:RFC3339,dateTime:RFC3339,dateTime:RFC3339,double,string,string,string
+#group,false,false,true,true,false,false,true,true,true
+#default,_result,,,,,,,,
+,result,table,_start,_stop,_time,_value,_field,_measurement,host
+,,0,2019-06-15T20:00:00Z,2019-06-15T21:00:00Z,2019-06-15T20:00:00Z,1.5,usage,cpu,a
+,,0,2019-06-15T20:00:00Z,2019-06-15T21:00:00Z,2019-06-15T20:00:30Z,2.5,usage,cpu,a
+
+#datatype,string,long,dateTime:RFC3339,dateTime:RFC3339,dateTime:RFC3339,string,string,string,string
+#group,false,false,true,true,false,false,true,true,true
+#default,_result,,,,,,,,
+,result,table,_start,_stop,_time,_value,_field,_measurement,host
+,,1,2019-06-15T20:00:00Z,2019-06-15T21:00:00Z,2019-06-15T20:00:00Z,up,state,svc,a
+
+#datatype,string,long,dateTime:RFC3339,dateTime:RFC3339,dateTime:RFC3339,double,string,string
+#group,false,false,true,true,false,false,true,true
+#default,_result,,,,,,,
+,result,table,_start,_stop,_time,_value,_field,_measurement
+,,2,2019-06-15T20:00:00Z,2019-06-15T21:00:00Z,2019-06-15T20:00:10.250Z,4,value,load
+`
+
+func TestImportFlux(t *testing.T) {
+	start := int64(1560628800)
+	check := func(ts *tissa.TimeSeries) {
+		t.Helper()
+		usage := `cpu_usage{host="a"}`
+		if keys := ts.Keys(); fmt.Sprint(keys) != fmt.Sprint([]string{ usage, "load" }) {
+			t.Errorf("Keys were %v", keys)
+		}
+		res, err := ts.Query(start, start + 31, tissa.SECOND, tissa.AGGREGATE_AVERAGE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := res.Values[usage]; v[0] != 1.5 || v[30] != 2.5 {
+			t.Errorf("usage was %v", v)
+		}
+		if v := res.Values["load"]; v[10] != 4 {
+			t.Errorf("load was %v", v)
+		}
+	}
+
+	ts := newSeries(t, "/tmp/timeseries_test/influx")
+	if n, err := ImportFlux(ts, strings.NewReader(fluxResult)); err != nil || n != 3 {
+		t.Fatalf("Imported %d, %v", n, err)
+	}
+	check(ts)
+
+	// without annotations, tables are separated by blank lines
+	var plain []string
+	for _, l := range strings.Split(fluxResult, "\n") {
+		if !strings.HasPrefix(l, "#") {
+			plain = append(plain, l)
+		}
+	}
+	ts = newSeries(t, "/tmp/timeseries_test/influx")
+	if n, err := ImportFlux(ts, strings.NewReader(strings.Join(plain, "\n"))); err != nil || n != 3 {
+		t.Fatalf("Imported %d unannotated, %v", n, err)
+	}
+	check(ts)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Query string `json:"query"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		switch {
+		case r.URL.Path != "/api/v2/query" || r.URL.Query().Get("org") != "my org" ||
+			r.Header.Get("Authorization") != "Token secret":
+			http.Error(w, `{"code":"unauthorized","message":"unauthorized access"}`, http.StatusUnauthorized)
+		case req.Query == "bad":
+			w.Write([]byte("#datatype,string,string\n#group,true,true\n#default,,\n,error,reference\n,type error,\n"))
+		default:
+			w.Write([]byte(fluxResult))
+		}
+	}))
+	defer srv.Close()
+	ts = newSeries(t, "/tmp/timeseries_test/influx")
+	if n, err := ImportQuery(ts, srv.URL + "/", "my org", "secret", `from(bucket: "b")`); err != nil || n != 3 {
+		t.Fatalf("Queried %d, %v", n, err)
+	}
+	check(ts)
+	if _, err := ImportQuery(ts, srv.URL, "my org", "wrong", "q"); err == nil ||
+		!strings.Contains(err.Error(), "unauthorized access") {
+		t.Errorf("Unauthorized query gave %v", err)
+	}
+	if _, err := ImportQuery(ts, srv.URL, "my org", "secret", "bad"); err == nil ||
+		!strings.Contains(err.Error(), "type error") {
+		t.Errorf("Failed query gave %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package influx
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fred-lewis/tissa"
+)
+
+//
+// A line of line protocol:
+//
+//	measurement[,tag=value...] field=value[,field=value...] [timestamp]
+//
+// Commas and spaces in the measurement, and commas, equals signs and
+// spaces in tag keys, tag values and field keys, are escaped with a
+// backslash.  String field values are double-quoted, with double
+// quotes and backslashes in them escaped.
+//
+type point struct {
+	measurement string
+	tags        tissa.Labels
+	fields      []field
+	timestamp   int64
+	hasTime     bool
+}
+
+type field struct {
+	key   string
+	value float64
+	// false for string fields, which have no numeric value
+	numeric bool
+}
+
+func parseLine(line string) (*point, error) {
+	p := &point{}
+	var rest string
+	p.measurement, rest = scan(line, ", ")
+	if p.measurement == "" {
+		return nil, fmt.Errorf("no measurement")
+	}
+	for strings.HasPrefix(rest, ",") {
+		var k, v string
+		k, rest = scan(rest[1:], ",= ")
+		if !strings.HasPrefix(rest, "=") {
+			return nil, fmt.Errorf("tag %q has no value", k)
+		}
+		v, rest = scan(rest[1:], ", ")
+		if k == "" || v == "" {
+			return nil, fmt.Errorf("empty tag key or value")
+		}
+		if p.tags == nil {
+			p.tags = make(tissa.Labels)
+		}
+		p.tags[k] = v
+	}
+	if !strings.HasPrefix(rest, " ") {
+		return nil, fmt.Errorf("no fields")
+	}
+	rest = rest[1:]
+	for {
+		var f field
+		f.key, rest = scan(rest, ",= ")
+		if f.key == "" || !strings.HasPrefix(rest, "=") {
+			return nil, fmt.Errorf("bad field %q", f.key)
+		}
+		var err error
+		if f.value, f.numeric, rest, err = fieldValue(rest[1:]); err != nil {
+			return nil, fmt.Errorf("field %q: %w", f.key, err)
+		}
+		p.fields = append(p.fields, f)
+		if !strings.HasPrefix(rest, ",") {
+			break
+		}
+		rest = rest[1:]
+	}
+	if rest = strings.TrimSpace(rest); rest != "" {
+		ts, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad timestamp %q", rest)
+		}
+		p.timestamp, p.hasTime = ts, true
+	}
+	return p, nil
+}
+
+//
+// Read up to the first unescaped byte in stops, returning the
+// unescaped text before it and the rest.
+//
+func scan(s, stops string) (string, string) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i + 1 < len(s) && strings.IndexByte(",= ", s[i + 1]) >= 0 {
+			i++
+			b.WriteByte(s[i])
+			continue
+		}
+		if strings.IndexByte(stops, c) >= 0 {
+			return b.String(), s[i:]
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), ""
+}
+
+//
+// Read a field value: a float, an integer ending in i or u, a
+// boolean, stored as 1 or 0, or a quoted string.
+//
+func fieldValue(s string) (float64, bool, string, error) {
+	if strings.HasPrefix(s, "\"") {
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				return 0, false, s[i + 1:], nil
+			}
+		}
+		return 0, false, "", fmt.Errorf("unterminated string")
+	}
+	end := strings.IndexAny(s, ", ")
+	if end < 0 {
+		end = len(s)
+	}
+	v, rest := s[:end], s[end:]
+	switch v {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, rest, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, rest, nil
+	}
+	var f float64
+	var err error
+	switch {
+	case strings.HasSuffix(v, "i"):
+		var n int64
+		n, err = strconv.ParseInt(v[:len(v) - 1], 10, 64)
+		f = float64(n)
+	case strings.HasSuffix(v, "u"):
+		var n uint64
+		n, err = strconv.ParseUint(v[:len(v) - 1], 10, 64)
+		f = float64(n)
+	default:
+		f, err = strconv.ParseFloat(v, 64)
+	}
+	if err != nil {
+		return 0, false, "", fmt.Errorf("bad value %q", v)
+	}
+	return f, true, rest, nil
+}
+
+//
+// The start of each line written for a series: its measurement and
+// tags, then the field key.
+//
+func linePrefix(name string, labels tissa.Labels) string {
+	var b strings.Builder
+	b.WriteString(escape(name, ", "))
+	names := make([]string, 0, len(labels))
+	for l, v := range labels {
+		// line protocol has no empty tag values
+		if v != "" {
+			names = append(names, l)
+		}
+	}
+	sort.Strings(names)
+	for _, l := range names {
+		b.WriteByte(',')
+		b.WriteString(escape(l, ",= "))
+		b.WriteByte('=')
+		b.WriteString(escape(labels[l], ",= "))
+	}
+	b.WriteString(" value=")
+	return b.String()
+}
+
+func escape(s, special string) string {
+	if !strings.ContainsAny(s, special) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(special, s[i]) >= 0 {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -4,23 +4,45 @@ package internal
 // license that can be found in the LICENSE file.
 
 import (
+	"errors"
 	"path/filepath"
 	"fmt"
-	"sync"
+	"hash/fnv"
 	"os"
-	"github.com/ugorji/go/codec"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
 )
 
 type Archive struct {
-	Interval    int64
-	ChunkSize   int64
-	Dir         string
-	Retention   int64
-	StartTime   int64
-	EndTime     int64
-	chunks      []*chunk
-	mu          sync.Mutex
-	lastWrite   int64
+	Interval     int64
+	ChunkSize    int64
+	Dir          string
+	Retention    int64
+	StartTime    int64
+	EndTime      int64
+	Encoding     int
+	Shards       int
+	ValueType    int
+	Compression  int
+	Sketches     bool
+	Uniques      bool
+	chunks       []*chunk
+	mu           sync.Mutex
+	lastWrite    int64
+	// the latest tick written by Write, or held when opened
+	written      int64
+	unsynced     map[string]bool
+	cache        *ChunkCache
+	queryWorkers int
+	carryForward int
+	codec        Codec
+	// where chunk files are kept, if not in Dir
+	store        ChunkStore
+	storePrefix  string
+	// kept only in memory, with no directory
+	memory       bool
 }
 
 func NewArchive(dirPath string, interval, retention, chunkSize int64) *Archive {
@@ -33,34 +55,79 @@ func NewArchive(dirPath string, interval, retention, chunkSize int64) *Archive {
 }
 
 func OpenArchive(dirPath string) (*Archive, error) {
+	return OpenArchiveCodec(dirPath, nil)
+}
+
+//
+// Open an archive whose chunk files were written with codec.
+//
+func OpenArchiveCodec(dirPath string, codec Codec) (*Archive, error) {
+	return OpenArchiveStore(dirPath, codec, nil, "")
+}
+
+//
+// Open an archive whose chunk files were written with codec, and are
+// kept in store under names starting with prefix, if store isn't
+// nil.
+//
+func OpenArchiveStore(dirPath string, codec Codec, store ChunkStore, prefix string) (*Archive, error) {
 	var archive Archive
 	fp := filepath.Join(dirPath, "archive")
-	err := readObject(fp, &archive)
+	err := ReadObject(fp, &archive)
 	if err != nil {
 		return nil, err
 	}
+	archive.codec = codec
+	archive.store, archive.storePrefix = store, prefix
+	archive.written = archive.EndTime
+
+	var state rechunkState
+	err = ReadObject(filepath.Join(dirPath, rechunkDir, "state"), &state)
+	if err == nil && state.Swapping {
+		// a Rechunk was interrupted part way through swapping files
+		err = archive.finishRechunk(state)
+		if err != nil {
+			return nil, err
+		}
+		return &archive, nil
+	}
 	if archive.EndTime > 0 {
-		var lastChunk chunk
-		lastChunkTs := archive.chunkStart(archive.EndTime)
-		fp = filepath.Join(dirPath, fmt.Sprintf("%d", lastChunkTs))
-		err = readObject(fp, &lastChunk)
+		lastChunk, err := archive.readChunk(archive.chunkStart(archive.EndTime))
 		if err != nil {
 			return nil, err
 		}
-		archive.chunks = []*chunk{ &lastChunk }
+		archive.chunks = []*chunk{ lastChunk }
 	}
 	return &archive, nil
 }
 
+//
+// Serialize chunk files with codec instead of msgpack.  Only used
+// for new archives; reopen existing ones with OpenArchiveCodec.
+//
+func (a *Archive) SetCodec(codec Codec) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.codec = codec
+}
+
+//
+// Cache historical chunks read by queries in cc.  By default every
+// query reads the chunks it needs from disk.
+//
+func (a *Archive) SetCache(cc *ChunkCache) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cache = cc
+}
+
 func (a *Archive) Write() error {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 	if a.EndTime > a.lastWrite {
 		for _, c := range a.chunks {
 			if c.dirty {
-				fp := filepath.Join(a.Dir,
-					fmt.Sprintf("%d", a.chunkStart(c.StartTime)))
-				err := writeObject(fp, c)
+				err := a.writeChunk(c)
 				if err != nil {
 					return err
 				}
@@ -70,32 +137,211 @@ func (a *Archive) Write() error {
 		a.exerciseRetention()
 	}
 	a.lastWrite = a.EndTime
-	writeObject(filepath.Join(a.Dir, "archive"), a)
+	a.written = a.EndTime
+	if a.memory {
+		return nil
+	}
+	fp := filepath.Join(a.Dir, "archive")
+	WriteObject(fp, a)
+	a.markUnsynced(fp)
+	return nil
+}
+
+func (a *Archive) writeChunk(c *chunk) error {
+	ts := a.chunkStart(c.StartTime)
+	parts := []*chunk{ c }
+	if a.Shards > 1 {
+		parts = c.split(a.Shards)
+	}
+	for shard, part := range parts {
+		if part == nil {
+			// no keys in this shard
+			continue
+		}
+		fp := a.chunkPath(ts, shard)
+		if a.store != nil {
+			if err := a.putChunk(fp, part); err != nil {
+				return err
+			}
+		} else {
+			if err := part.write(fp, a.Encoding, a.Compression, a.codec); err != nil {
+				return err
+			}
+			a.markUnsynced(fp)
+		}
+		if a.cache != nil {
+			a.cache.invalidate(fp)
+		}
+	}
+	return nil
+}
+
+//
+// Read a whole chunk into memory, merging its shards if the archive
+// is sharded.
+//
+func (a *Archive) readChunk(ts int64) (*chunk, error) {
+	if a.Shards <= 1 {
+		return a.readChunkFile(a.chunkPath(ts, 0))
+	}
+	var c *chunk
+	for shard := 0; shard < a.Shards; shard++ {
+		part, err := a.readChunkFile(a.chunkPath(ts, shard))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if c == nil {
+			c = part
+		} else {
+			c.merge(part)
+		}
+	}
+	if c == nil {
+		return nil, fmt.Errorf("no shards found for chunk %d: %w", ts, os.ErrNotExist)
+	}
+	return c, nil
+}
+
+func (a *Archive) readChunkFile(fp string) (*chunk, error) {
+	if a.store != nil {
+		return a.getChunk(fp)
+	}
+	return readChunk(fp, a.codec)
+}
+
+func (a *Archive) markUnsynced(fp string) {
+	if a.unsynced == nil {
+		a.unsynced = make(map[string]bool)
+	}
+	a.unsynced[fp] = true
+}
+
+//
+// Flush every file written since the last Sync to stable storage.
+// Files are renamed into place before they are synced, so a crash
+// before Sync completes can leave a torn file behind; the checksum
+// catches that, and reads fall back to the previous version.
+//
+func (a *Archive) Sync() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.unsynced) == 0 {
+		return nil
+	}
+	for fp := range a.unsynced {
+		err := SyncFile(fp)
+		if err != nil {
+			return err
+		}
+	}
+	err := SyncFile(a.Dir)
+	if err != nil {
+		return err
+	}
+	a.unsynced = nil
 	return nil
 }
 
 func (a *Archive) Append(val map[string]interface{}, timestamp int64) {
-	timestamp = a.tsNorm(timestamp)
 	a.mu.Lock()
 	defer a.mu.Unlock()
+	c, tick, ok := a.advance(timestamp)
+	if !ok {
+		return
+	}
+	for tag, v := range val {
+		c.setValue(tick, tag, valueKind(v), toFloats(v))
+	}
+}
+
+func (a *Archive) AppendFloats(val map[string]float64, timestamp int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c, tick, ok := a.advance(timestamp)
+	if !ok {
+		return
+	}
+	var f [1]float64
+	for tag, v := range val {
+		f[0] = v
+		c.setValue(tick, tag, kindFloat, f[:])
+	}
+}
+
+func (a *Archive) AppendRollups(val map[string]Rollup, timestamp int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c, tick, ok := a.advance(timestamp)
+	if !ok {
+		return
+	}
+	var f [maxWidth]float64
+	for tag, r := range val {
+		r.floats(f[:width(rollupKind)])
+		c.setValue(tick, tag, rollupKind, f[:width(rollupKind)])
+	}
+}
+
+//
+// Move the archive forward to timestamp, starting a new chunk if
+// needed.  Returns the chunk and tick to write values at, or false
+// if timestamp is older than the latest data.
+//
+func (a *Archive) advance(timestamp int64) (*chunk, int, bool) {
+	timestamp = a.tsNorm(timestamp)
 	lc := a.lastChunk()
 	if lc == nil {
 		startChunk := timestamp - (timestamp % a.ChunkSize)
 		lc = newChunk(a.Interval, startChunk)
+		lc.ValueType = a.ValueType
 		a.chunks = []*chunk{lc}
 	} else if a.boundaryCheck(timestamp) {
 		nextStart := a.chunkStart(timestamp)
 		if lc.EndTime < a.chunkEnd(lc.StartTime) {
-			lc.fillTo(nextStart)
+			lc.fillTo(nextStart, a.carryTicks())
 		}
 		lc = newChunk(a.Interval, nextStart)
+		lc.ValueType = a.ValueType
 		a.chunks = append(a.chunks, lc)
 	}
-	lc.append(val, timestamp)
+	tick, ok := lc.advance(timestamp, a.carryTicks())
+	if !ok {
+		return nil, 0, false
+	}
 	a.EndTime = timestamp
 	if a.StartTime == 0 {
 		a.StartTime = timestamp
 	}
+	return lc, tick, true
+}
+
+//
+// The timestamps of the oldest and latest ticks the archive holds,
+// or 0s if it's empty.
+//
+func (a *Archive) TimeRange() (int64, int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.StartTime, a.EndTime
+}
+
+//
+// The number of ticks appended since the last Write (or since the
+// archive was opened), counting any filled in between them.
+//
+func (a *Archive) UnwrittenTicks() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.EndTime <= a.written {
+		return 0
+	}
+	if a.written == 0 {
+		return (a.EndTime - a.StartTime) / a.Interval + 1
+	}
+	return (a.EndTime - a.written) / a.Interval
 }
 
 func (a *Archive) Latest() (map[string]interface{}, int64) {
@@ -106,24 +352,410 @@ func (a *Archive) Latest() (map[string]interface{}, int64) {
 	return lc.latest(), lc.EndTime
 }
 
-func (a *Archive) GetData(startTime, endTime int64) (map[string][]interface{}, []int64) {
+//
+// The number of keys in the latest chunk.
+//
+func (a *Archive) NumKeys() int {
+	lc := a.lastChunk()
+	if lc == nil {
+		return 0
+	}
+	return len(lc.Tags)
+}
+
+//
+// Whether key has data in the latest chunk.
+//
+func (a *Archive) HasKey(key string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	lc := a.lastChunk()
+	if lc == nil {
+		return false
+	}
+	_, ok := lc.tagMap[key]
+	return ok
+}
+
+//
+// The keys with data in the latest chunk, sorted.
+//
+func (a *Archive) Keys() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	lc := a.lastChunk()
+	if lc == nil {
+		return nil
+	}
+	keys := append([]string(nil), lc.Tags...)
+	sort.Strings(keys)
+	return keys
+}
+
+func (a *Archive) LatestFloats() (map[string]float64, int64) {
+	lc := a.lastChunk()
+	if lc == nil || lc.Ticks == 0 {
+		return map[string]float64{}, 0
+	}
+	last := lc.Ticks - 1
+	res := make(map[string]float64, len(lc.Values))
+	for i := range lc.Values {
+		col := &lc.Values[i]
+		if col.has(last) {
+			res[lc.Tags[i]] = col.get(last, width(lc.Kind))[0]
+		}
+	}
+	return res, lc.EndTime
+}
+
+//
+// Returns the latest n plain values of key and their timestamps,
+// oldest first, reading back a chunk at a time from EndTime until
+// there are enough.  Fewer are returned if the archive doesn't hold
+// n.  Corrupt chunks are skipped, and reported as for GetData.
+//
+func (a *Archive) LatestN(key string, n int) ([]float64, []int64, error) {
+	keys := newKeySet([]string{ key })
+	var vals []float64
+	var stamps []int64
+	var firstErr error
+	for end := a.EndTime + a.Interval; end > a.StartTime && len(vals) < n; {
+		start := a.chunkStart(end - a.Interval)
+		var cv []float64
+		var cs []int64
+		err := a.scan(start, end, keys, func(tag string, i int64, f []float64) {
+			if len(f) == 1 {
+				cv = append(cv, f[0])
+				cs = append(cs, start + i * a.Interval)
+			}
+		})
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		vals = append(cv, vals...)
+		stamps = append(cs, stamps...)
+		end = start
+	}
+	if len(vals) > n {
+		vals = vals[len(vals) - n:]
+		stamps = stamps[len(stamps) - n:]
+	}
+	return vals, stamps, firstErr
+}
+
+//
+// Returns data for all keys in [startTime, endTime), or only the given
+// keys if any are listed.  Missing chunks are treated as gaps.  If a
+// chunk is corrupt, the data that could be read is returned along with
+// an error wrapping ErrCorruptChunk.
+//
+func (a *Archive) GetData(startTime, endTime int64, keys ...string) (map[string][]interface{}, []int64, error) {
+	return collect(a, startTime, endTime, newKeySet(keys), nil, func(f []float64) interface{} {
+		if len(f) > 1 {
+			return rollupFromFloats(f)
+		}
+		return f[0]
+	})
+}
+
+//
+// Like GetData, reusing the series in dst and the stamps slice where
+// they're big enough, so repeated queries needn't allocate.  Series
+// in dst for keys with no data in the range are removed.
+//
+func (a *Archive) GetDataInto(dst map[string][]interface{}, stamps []int64,
+	startTime, endTime int64, keys ...string) (map[string][]interface{}, []int64, error) {
+
+	return collectInto(a, dst, stamps, startTime, endTime, newKeySet(keys), nil, func(f []float64) interface{} {
+		if len(f) > 1 {
+			return rollupFromFloats(f)
+		}
+		return f[0]
+	})
+}
+
+//
+// Like GetData, for archives of plain values.  Missing ticks are set
+// to fill.
+//
+func (a *Archive) GetFloats(startTime, endTime int64, fill float64, keys ...string) (map[string][]float64, []int64, error) {
+	return a.GetFloatsInto(nil, nil, startTime, endTime, fill, keys...)
+}
+
+//
+// Like GetFloats, reusing dst and stamps as GetDataInto does.
+//
+func (a *Archive) GetFloatsInto(dst map[string][]float64, stamps []int64,
+	startTime, endTime int64, fill float64, keys ...string) (map[string][]float64, []int64, error) {
+
+	return a.GetFloatsMatching(dst, stamps, startTime, endTime, fill, newKeySet(keys))
+}
+
+//
+// Like GetFloatsInto, for the keys in a KeySet.
+//
+func (a *Archive) GetFloatsMatching(dst map[string][]float64, stamps []int64,
+	startTime, endTime int64, fill float64, keys *KeySet) (map[string][]float64, []int64, error) {
+
+	return collectInto(a, dst, stamps, startTime, endTime, keys, fill, func(f []float64) float64 {
+		return f[0]
+	})
+}
+
+//
+// Like GetData, for rollup archives.  Missing ticks are zero Rollups.
+//
+func (a *Archive) GetRollups(startTime, endTime int64, keys ...string) (map[string][]Rollup, []int64, error) {
+	return a.GetRollupsMatching(startTime, endTime, newKeySet(keys))
+}
+
+//
+// Like GetRollups, for the keys in a KeySet.
+//
+func (a *Archive) GetRollupsMatching(startTime, endTime int64, keys *KeySet) (map[string][]Rollup, []int64, error) {
+	return collect(a, startTime, endTime, keys, Rollup{}, rollupFromFloats)
+}
+
+//
+// Like GetRollups, with each Rollup reduced to a single value by fn,
+// reusing dst and stamps as GetDataInto does.  Missing ticks are set
+// to fn(Rollup{}).  Plain values are passed to fn as a Rollup of one
+// value.
+//
+func (a *Archive) GetRollupValuesInto(dst map[string][]float64, stamps []int64,
+	startTime, endTime int64, fn func(Rollup) float64, keys ...string) (map[string][]float64, []int64, error) {
+
+	return a.GetRollupValuesMatching(dst, stamps, startTime, endTime, fn, newKeySet(keys))
+}
+
+//
+// Like GetRollupValuesInto, for the keys in a KeySet.
+//
+func (a *Archive) GetRollupValuesMatching(dst map[string][]float64, stamps []int64,
+	startTime, endTime int64, fn func(Rollup) float64, keys *KeySet) (map[string][]float64, []int64, error) {
+
+	return collectInto(a, dst, stamps, startTime, endTime, keys, fn(Rollup{}), func(f []float64) float64 {
+		if len(f) == 1 {
+			var r Rollup
+			r.add(f[0], true)
+			return fn(r)
+		}
+		return fn(rollupFromFloats(f))
+	})
+}
+
+//
+// Summarize [startTime, endTime) into a single Rollup per key.
+// Plain values are rolled up; rollups are merged.
+//
+func (a *Archive) RollupRange(startTime, endTime int64) (map[string]Rollup, error) {
+	res := make(map[string]Rollup)
+	err := a.rollupInto(res, make(map[string]int64), startTime, endTime)
+	return res, err
+}
+
+//
+// Roll up [startTime, endTime) into consecutive buckets of bucket
+// seconds from startTime, for the keys in keys.  Rollups count
+// towards the bucket holding the interval they cover.  Buckets with
+// no data have a Count of 0.
+//
+func (a *Archive) RollupBuckets(startTime, endTime, bucket int64, keys *KeySet) (map[string][]Rollup, error) {
+	l := int((endTime - startTime + bucket - 1) / bucket)
+	res := make(map[string][]Rollup)
+	first := a.tsNorm(startTime)
+	// rollups are stored at the end of the interval they cover
+	err := a.scan(first, endTime + a.Interval, keys, func(tag string, i int64, f []float64) {
+		ts := first + i * a.Interval
+		if len(f) > 1 {
+			ts -= a.Interval
+		}
+		if ts < startTime || ts >= endTime {
+			return
+		}
+		ser := res[tag]
+		if ser == nil {
+			ser = make([]Rollup, l)
+			res[tag] = ser
+		}
+		b := (ts - startTime) / bucket
+		r := &ser[b]
+		if len(f) > 1 {
+			r.merge(rollupFromFloats(f), r.Count == 0)
+		} else {
+			r.add(f[0], r.Count == 0)
+		}
+	})
+	return res, err
+}
+
+//
+// Plain values are in effect until the next one (or endTime); the
+// latest value before a rollup covers the part of its interval
+// before its first value.  ends tracks, per key, the time up to
+// which values have been counted.
+//
+func (a *Archive) rollupInto(res map[string]Rollup, ends map[string]int64, startTime, endTime int64) error {
 	startTime = a.tsNorm(startTime)
-	endTime = a.tsNorm(endTime)
+	end := a.tsNorm(endTime)
+	err := a.scan(startTime, endTime, nil, func(tag string, i int64, f []float64) {
+		r, ok := res[tag]
+		ts := startTime + i * a.Interval
+		if len(f) > 1 {
+			// rollups are stored at the end of their interval
+			o := rollupFromFloats(f)
+			if ok {
+				r.carry(float64(ts - ends[tag]) - o.Duration)
+			}
+			r.merge(o, !ok)
+			ends[tag] = ts
+			end = a.tsNorm(endTime) - a.Interval
+		} else {
+			if ok {
+				r.carry(float64(ts - ends[tag]))
+			}
+			r.add(f[0], !ok)
+			r.carry(float64(a.Interval))
+			ends[tag] = ts + a.Interval
+		}
+		res[tag] = r
+	})
+	for tag, r := range res {
+		r.carry(float64(end - ends[tag]))
+		res[tag] = r
+	}
+	return err
+}
+
+//
+// Roll up [startTime, endTime) into dst at endTime.  Like calling
+// RollupRange and then dst.AppendRollups, without allocating a map
+// every time.
+//
+func (a *Archive) RollupTo(dst *Archive, startTime, endTime int64) error {
+	res := rollupMapPool.Get().(map[string]Rollup)
+	ends := endsMapPool.Get().(map[string]int64)
+	err := a.rollupInto(res, ends, startTime, endTime)
+	dst.AppendRollups(res, endTime)
+	if dst.Sketches {
+		sk, serr := a.sketchRange(startTime, endTime)
+		dst.appendSketches(sketchQuantiles, sk, endTime)
+		if err == nil {
+			err = serr
+		}
+	}
+	if dst.Uniques {
+		hs, herr := a.uniquesRange(startTime, endTime)
+		dst.appendSketches(sketchUniques, hs, endTime)
+		if err == nil {
+			err = herr
+		}
+	}
+	for k := range res {
+		delete(res, k)
+		delete(ends, k)
+	}
+	rollupMapPool.Put(res)
+	endsMapPool.Put(ends)
+	return err
+}
+
+//
+// Gathers [startTime, endTime) into one series per key, converting
+// each tick's floats with conv.
+//
+func collect[T any](a *Archive, startTime, endTime int64, keys *KeySet, fill T,
+	conv func([]float64) T) (map[string][]T, []int64, error) {
 
-	l := (endTime - startTime) / a.Interval
+	return collectInto(a, nil, nil, startTime, endTime, keys, fill, conv)
+}
 
-	chunkStart := a.chunkStart(startTime)
-	data := make(map[string][]interface{}, 0)
-	stamps := make([]int64, l)
+//
+// Like collect, reusing the series in dst and stamps.
+//
+func collectInto[T any](a *Archive, dst map[string][]T, stamps []int64, startTime, endTime int64,
+	keys *KeySet, fill T, conv func([]float64) T) (map[string][]T, []int64, error) {
+
+	startTime = a.tsNorm(startTime)
+	endTime = a.tsNorm(endTime)
+	l := int((endTime - startTime) / a.Interval)
+
+	if dst == nil {
+		dst = make(map[string][]T, 0)
+	}
+	// series are refilled the first time scan sees their key
+	for k, ser := range dst {
+		dst[k] = ser[:0]
+	}
+	stamps = resize(stamps, l)
 
 	t := startTime
-	for i := int64(0); i < l; i++ {
+	for i := 0; i < l; i++ {
 		stamps[i] = t
 		t += a.Interval
 	}
 
+	err := a.scan(startTime, endTime, keys, func(tag string, i int64, f []float64) {
+		ser := dst[tag]
+		if len(ser) == 0 {
+			ser = resize(ser, l)
+			for j := range ser {
+				ser[j] = fill
+			}
+			dst[tag] = ser
+		}
+		ser[i] = conv(f)
+	})
+
+	for k, ser := range dst {
+		if len(ser) == 0 {
+			delete(dst, k)
+		}
+	}
+	return dst, stamps, err
+}
+
+func resize[T any](s []T, l int) []T {
+	if cap(s) >= l {
+		return s[:l]
+	}
+	return make([]T, l)
+}
+
+//
+// Calls fn for every tick with data in [startTime, endTime), for
+// keys in the set (nil for all keys), with i relative to the
+// (normalized) startTime.  The slice passed to fn is only valid for
+// the duration of the call.
+//
+func (a *Archive) scan(startTime, endTime int64, keys *KeySet, fn func(tag string, i int64, f []float64)) error {
+	return a.walkChunks(startTime, endTime, keys, func(r chunkReader, cStart, cEnd, offset int64) error {
+		return r.scan(cStart, cEnd, keys, func(tag string, j int, f []float64) {
+			fn(tag, offset + int64(j), f)
+		})
+	})
+}
+
+//
+// Calls visit with a reader for each chunk overlapping [startTime,
+// endTime), the part of the range it covers, and the offset of that
+// part from the (normalized) startTime, in ticks.
+//
+func (a *Archive) walkChunks(startTime, endTime int64, keys *KeySet,
+	visit func(r chunkReader, cStart, cEnd, offset int64) error) error {
+
+	startTime = a.tsNorm(startTime)
+	endTime = a.tsNorm(endTime)
+
+	first := a.chunkStart(startTime)
+	numChunks := int((endTime - first + a.ChunkSize - 1) / a.ChunkSize)
+	opener := a.openChunks(first, numChunks, keys)
+	defer opener.finish()
+
+	var firstErr error
 	i := int64(0)
-	for chunkStart < endTime {
+	for n := 0; n < numChunks; n++ {
+		chunkStart := first + int64(n) * a.ChunkSize
 		cStart := chunkStart
 		cEnd := chunkStart + a.ChunkSize
 		if cStart < startTime {
@@ -132,271 +764,525 @@ func (a *Archive) GetData(startTime, endTime int64) (map[string][]interface{}, [
 		if cEnd > endTime {
 			cEnd = endTime
 		}
-		chunk, err := a.getChunkByStartTime(chunkStart)
+		o := opener.next()
+		err := o.err
 		if err == nil {
-			chunkData, _ := chunk.getData(cStart, cEnd)
-			for key, ticks := range chunkData {
-				exst, ok := data[key]
-				if !ok {
-					exst = make([]interface{}, l)
-					data[key] = exst
-				}
-				for j := 0; j < len(ticks); j++ {
-					exst[i + int64(j)] = ticks[j]
-				}
-			}
+			err = visit(o.reader, cStart, cEnd, i)
+			o.release()
+		}
+		// missing chunks are gaps, but the object store failing isn't
+		storeErr := a.store != nil && err != nil && !errors.Is(err, os.ErrNotExist)
+		if (errors.Is(err, ErrCorruptChunk) || storeErr) && firstErr == nil {
+			firstErr = err
 		}
 		i += (cEnd - cStart) / a.Interval
-		chunkStart += a.ChunkSize
 	}
-
-	return data, stamps
+	return firstErr
 }
 
-func (a *Archive) getChunkByStartTime(ts int64) (*chunk, error) {
-	for _, c := range(a.chunks) {
-		if c.StartTime == ts {
-			return c, nil
-		}
-	}
-	var c chunk
-	fp := filepath.Join(a.Dir, fmt.Sprintf("%d", ts))
-	err := readObject(fp, &c)
-	if err != nil {
-		return nil, err
-	}
-	return &c, nil
+type openedChunk struct {
+	reader  chunkReader
+	release func()
+	err     error
 }
 
 //
-// Round up to the nearest resolution.
+// Opens the chunks for a query in order.  With more than one query
+// worker, chunks are opened in the background, up to a.queryWorkers
+// at a time, so long range queries can decode one chunk while
+// scanning another.  A chunk counts against the limit until the next
+// call to next, so the caller must be done with it by then.  Openers
+// are pooled; call finish once every chunk has been read.
 //
-func (a *Archive) tsNorm(timestamp int64) int64 {
-	ts := timestamp - (timestamp % a.Interval)
-	if ts < timestamp {
-		ts += a.Interval
+type chunkOpener struct {
+	a         *Archive
+	first     int64
+	numChunks int
+	keys      *KeySet
+	n         int
+	opened    []chan openedChunk
+	sem       chan struct{}
+}
+
+func (a *Archive) openChunks(first int64, numChunks int, keys *KeySet) *chunkOpener {
+	o := openerPool.Get().(*chunkOpener)
+	o.a = a
+	o.first = first
+	o.numChunks = numChunks
+	o.keys = keys
+	o.n = 0
+
+	workers := a.queryWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
 	}
-	return ts
+	if workers > numChunks {
+		workers = numChunks
+	}
+	if workers <= 1 {
+		o.sem = nil
+		return o
+	}
+
+	for len(o.opened) < numChunks {
+		o.opened = append(o.opened, make(chan openedChunk, 1))
+	}
+	if cap(o.sem) != workers {
+		o.sem = make(chan struct{}, workers)
+	}
+	opened, sem := o.opened[:numChunks], o.sem
+	go func() {
+		for i := range opened {
+			sem <- struct{}{}
+			go a.openInto(opened[i], first + int64(i) * a.ChunkSize, keys)
+		}
+	}()
+	return o
 }
 
-func (a *Archive) exerciseRetention() {
-	for a.EndTime - a.StartTime > a.Retention {
-		fp := filepath.Join(a.Dir,
-			fmt.Sprintf("%d", a.chunkStart(a.StartTime)))
-		os.Remove(fp)
-		a.StartTime = a.chunkStart(a.StartTime) + a.ChunkSize
+func (o *chunkOpener) next() openedChunk {
+	n := o.n
+	o.n++
+	if o.sem == nil {
+		reader, release, err := o.a.openChunk(o.first + int64(n) * o.a.ChunkSize, o.keys)
+		return openedChunk{reader, release, err}
 	}
+	if n > 0 {
+		<-o.sem
+	}
+	return <-o.opened[n]
 }
 
-func (a *Archive) lastChunk() *chunk {
-	l := len(a.chunks)
-	if l > 0 {
-		return a.chunks[l - 1]
+func (o *chunkOpener) finish() {
+	if o.sem != nil && o.n > 0 {
+		// the last chunk's slot
+		<-o.sem
 	}
-	return nil
+	o.a = nil
+	o.keys = nil
+	openerPool.Put(o)
 }
 
-func (a *Archive) chunkStart(ts int64) int64 {
-	return ts - (ts % a.ChunkSize)
+func (a *Archive) openInto(ch chan openedChunk, ts int64, keys *KeySet) {
+	reader, release, err := a.openChunk(ts, keys)
+	ch <- openedChunk{reader, release, err}
 }
 
-func (a *Archive) chunkEnd(ts int64) int64 {
-	return a.chunkStart(ts) + a.ChunkSize - a.Interval
+//
+// Limit the number of chunks a query reads concurrently.  0 (the
+// default) means GOMAXPROCS; 1 reads chunks one at a time.
+//
+func (a *Archive) SetQueryWorkers(n int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.queryWorkers = n
+}
+
+//
+// Set the longest gap, in ticks, that appends fill by copying the
+// latest tick forward; longer gaps are left missing.  0 (the
+// default) means 1; a negative number means gaps are never filled.
+//
+func (a *Archive) SetCarryForward(ticks int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.carryForward = ticks
 }
 
+func (a *Archive) carryTicks() int {
+	if a.carryForward == 0 {
+		return defaultCarryForward
+	}
+	return a.carryForward
+}
 
-func (a *Archive) boundaryCheck(ts int64) bool {
-	c := a.lastChunk()
-	return ts > a.chunkEnd(c.StartTime)
+//
+// Something we can read a range of ticks from; either an in-memory
+// chunk or a memory-mapped chunk file.  scan calls fn for every tick
+// with data in [startTime, endTime) for keys in the set, with i
+// relative to startTime.
+//
+type chunkReader interface {
+	scan(startTime, endTime int64, keys *KeySet, fn func(tag string, i int, f []float64)) error
+	scanSketches(kind int, startTime, endTime int64, keys *KeySet, fn func(tag string, i int, s []byte)) error
 }
 
-var mph = codec.MsgpackHandle{}
+//
+// A set of keys to query, either listed or matched by a function;
+// nil means every key.  Only listed keys narrow down which shards
+// are read.  A set may also carry Stats, which queries using it add
+// to.
+//
+type KeySet struct {
+	names map[string]bool
+	match func(string) bool
+	all   bool
+	stats *Stats
+}
+
+//
+// What a query read.  Queries may read chunks concurrently, so the
+// counts are updated atomically.
+//
+type Stats struct {
+	ChunksRead   int64
+	CacheHits    int64
+	BytesDecoded int64
+}
 
-func writeObject(filePath string, obj interface{}) error {
-	file, err := os.Create(filePath)
-	if err == nil {
-		enc := codec.NewEncoder(file, &mph)
-		err = enc.Encode(obj)
+func (st *Stats) add(chunks, hits, bytes int64) {
+	if st == nil {
+		return
 	}
-	file.Close()
-	return err
+	atomic.AddInt64(&st.ChunksRead, chunks)
+	atomic.AddInt64(&st.CacheHits, hits)
+	atomic.AddInt64(&st.BytesDecoded, bytes)
 }
 
-func readObject(filePath string, v interface{}) error {
-	file, err := os.Open(filePath)
-	if err == nil {
-		dec := codec.NewDecoder(file, &mph)
-		err = dec.Decode(&v)
+func newKeySet(keys []string) *KeySet {
+	if len(keys) == 0 {
+		return nil
 	}
-	file.Close()
-	return err
+	return KeyNames(keys...)
 }
 
 //
+// The set of the given keys.
 //
-// Chunks are for the most granular data.
-// We normalize the data so all timestamps align
-// to resolution, and there are no missing ticks
-// (we proactively fill in missing data).  This
-// way, we don't have to store timestamps with
-// every datapoint.
+func KeyNames(keys ...string) *KeySet {
+	ks := &KeySet{ names: make(map[string]bool, len(keys)) }
+	for _, k := range keys {
+		ks.names[k] = true
+	}
+	return ks
+}
+
 //
+// The set of keys for which match returns true.
 //
-
-type chunk struct {
-	StartTime   int64
-	EndTime     int64
-	Resolution  int64
-	Data        []map[int]interface{}
-	Tags        []string
-	tagMap      map[string]int
-	dirty       bool
+func MatchKeys(match func(string) bool) *KeySet {
+	return &KeySet{ match: match }
 }
 
-func (c *chunk) fillTo(timestamp int64) {
-	numToFill := (timestamp - c.EndTime) / c.Resolution
+//
+// A copy of ks (every key if nil) that counts what queries read
+// into st.
+//
+func (ks *KeySet) WithStats(st *Stats) *KeySet {
+	var c KeySet
+	if ks == nil {
+		c.all = true
+	} else {
+		c = *ks
+	}
+	c.stats = st
+	return &c
+}
 
-	ts := c.EndTime + c.Resolution
-	//
-	// For short periods (a couple seconds), we copy the latest
-	// tick forward. For longer ones, we use a special value to
-	// indicate missing data.
-	//
-	var fillVal map[int]interface{} = nil
-	if numToFill < 3 {
-		fillVal = c.latestRaw()
+//
+// The keys listed in the set; nil if it's every key or matched by a
+// function.
+//
+func (ks *KeySet) Names() []string {
+	if ks == nil || ks.all || ks.match != nil {
+		return nil
 	}
-	for ts < timestamp {
-		c.Data = append(c.Data, fillVal)
-		c.EndTime = ts
-		c.dirty = true
-		ts += c.Resolution
+	names := make([]string, 0, len(ks.names))
+	for k := range ks.names {
+		names = append(names, k)
 	}
+	sort.Strings(names)
+	return names
 }
 
-func (c *chunk) empty() bool {
-	return c.EndTime == 0
+func (ks *KeySet) statsOf() *Stats {
+	if ks == nil {
+		return nil
+	}
+	return ks.stats
 }
 
-func (c *chunk) latestRaw() map[int]interface{} {
-	l := len(c.Data)
-	if l == 0 {
-		return nil
+//
+// Whether key is in the set.
+//
+func (ks *KeySet) Has(key string) bool {
+	return ks.has(key)
+}
+
+//
+// The number of keys listed in the set; false if it's every key or
+// matched by a function.
+//
+func (ks *KeySet) Len() (int, bool) {
+	if ks == nil || ks.all || ks.match != nil {
+		return 0, false
 	}
-	return c.Data[l - 1]
+	return len(ks.names), true
 }
 
-func (c *chunk) latest() map[string]interface{} {
-	latestRaw := c.latestRaw()
-	if latestRaw == nil {
-		return nil
+func (ks *KeySet) has(key string) bool {
+	if ks == nil || ks.all {
+		return true
 	}
-	ret := make(map[string]interface{}, len(latestRaw))
-	for i, v := range latestRaw {
-		tag := c.Tags[i]
-		ret[tag] = v
+	if ks.match != nil {
+		return ks.match(key)
 	}
-	return ret
+	return ks.names[key]
 }
 
-func (c *chunk) append(val map[string]interface{}, timestamp int64) {
-	if timestamp < c.EndTime {
-		return
+//
+// The shards of a chunk a query needs to read.
+//
+type shardReader []chunkReader
+
+func (sr shardReader) scan(startTime, endTime int64, keys *KeySet, fn func(tag string, i int, f []float64)) error {
+	for _, r := range sr {
+		err := r.scan(startTime, endTime, keys, fn)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	if timestamp == c.EndTime {
-		latest := c.Data[len(c.Data) - 1]
-		for k, v := range c.derefTags(val) {
-			latest[k] = v
+func (sr shardReader) scanSketches(kind int, startTime, endTime int64, keys *KeySet, fn func(tag string, i int, s []byte)) error {
+	for _, r := range sr {
+		err := r.scanSketches(kind, startTime, endTime, keys, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// Returns a reader for the chunk starting at ts, and a function to
+// release it once the caller is done.  Chunks that aren't in memory
+// are read through the cache if there is one.  Otherwise they're
+// memory-mapped; fixed-layout files are read directly out of the
+// mapping, other encodings are decoded and unmapped right away.
+// For sharded archives, only the shards holding keys are read.
+//
+func (a *Archive) openChunk(ts int64, keys *KeySet) (chunkReader, func(), error) {
+	st := keys.statsOf()
+	st.add(1, 0, 0)
+	for _, c := range(a.chunks) {
+		if c.StartTime == ts {
+			return c, func() {}, nil
+		}
+	}
+	if a.Shards <= 1 {
+		return a.openFile(a.chunkPath(ts, 0), st)
+	}
+
+	var readers shardReader
+	var releases []func()
+	release := func() {
+		for _, r := range releases {
+			r()
 		}
-		return
 	}
+	for _, shard := range a.shardsFor(keys) {
+		r, rel, err := a.openFile(a.chunkPath(ts, shard), st)
+		if errors.Is(err, os.ErrNotExist) {
+			// no keys in this shard
+			continue
+		}
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		readers = append(readers, r)
+		releases = append(releases, rel)
+	}
+	return readers, release, nil
+}
 
-	if !c.empty() && timestamp > c.EndTime + c.Resolution {
-		c.fillTo(timestamp)
+//
+// Open one chunk file for a query.  Fixed-layout files are read in
+// place and never cached, since decoding them would only cost time
+// and memory; other files are decoded, and cached if there's a cache.
+// What's read is counted in st, if not nil.
+//
+func (a *Archive) openFile(fp string, st *Stats) (chunkReader, func(), error) {
+	if a.cache != nil {
+		if c := a.cache.get(fp); c != nil {
+			st.add(0, 1, 0)
+			return c, func() {}, nil
+		}
 	}
 
-	if c.empty() && timestamp != c.StartTime {
-		ts := c.StartTime
-		for ts < timestamp {
-			c.Data = append(c.Data, nil)
-			ts += c.Resolution
+	var reader chunkReader
+	var release func()
+	var n int
+	var err error
+	if a.store != nil {
+		var data []byte
+		if data, err = a.store.Get(a.objectName(fp)); err == nil {
+			reader, release, n, err = parseChunk(fp, data, func() {}, a.codec)
 		}
+	} else {
+		reader, release, n, err = mapChunk(fp, a.codec)
 	}
+	if err != nil {
+		if a.store != nil {
+			// objects are never torn, so have no previous version
+			return nil, nil, err
+		}
+		var perr error
+		reader, release, n, perr = mapChunk(fp + prevSuffix, a.codec)
+		if perr != nil {
+			return nil, nil, err
+		}
+	}
+	st.add(0, 0, int64(n))
+	if c, ok := reader.(*chunk); ok && a.cache != nil {
+		// the cache owns it now, so it's never released to the pool
+		a.cache.put(fp, c)
+		return c, func() {}, nil
+	}
+	return reader, release, nil
+}
 
-	c.Data = append(c.Data, c.derefTags(val))
-	c.EndTime = timestamp
-	c.dirty = true
+//
+// Map a chunk file, returning a reader for it, the function to
+// release it, and the size of the file.
+//
+func mapChunk(filePath string, codec Codec) (chunkReader, func(), int, error) {
+	data, unmap, err := mmapFile(filePath)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return parseChunk(filePath, data, unmap, codec)
 }
 
-func (c *chunk) getData(startTime int64, endTime int64) (map[string][]interface{}, []int64) {
-	l := int((endTime - startTime) / c.Resolution)
+//
+// A reader for the chunk file data, read from filePath, whose memory
+// is released by unmap once the chunk's done with.
+//
+func parseChunk(filePath string, data []byte, unmap func(), codec Codec) (chunkReader, func(), int, error) {
+	if isFixed(data) {
+		m, err := parseFixed(data)
+		if err != nil {
+			unmap()
+			return nil, nil, 0, fmt.Errorf("%s: %v: %w", filePath, err, ErrCorruptChunk)
+		}
+		return m, unmap, len(data), nil
+	}
 
-	data := make(map[int][]interface{})
-	stamps := make([]int64, l)
+	defer unmap()
+	buf, err := verifyFooter(filePath, data)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	// the chunk is only used by this query, so it can be recycled
+	c, err := decodeChunkInto(getChunk(), filePath, buf, codec)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return c, func() { putChunk(c) }, len(data), nil
+}
 
-	ct := startTime
-	i := 0
-	for ct < endTime {
-		idx := c.tsIndex(ct)
+//
+// The timestamp of the tick an append at timestamp is stored in.
+//
+func (a *Archive) Normalize(timestamp int64) int64 {
+	return a.tsNorm(timestamp)
+}
 
-		if idx >= 0 && idx < len(c.Data) && c.Data[idx] != nil {
-			tick := c.Data[idx]
+//
+// Round up to the nearest resolution.
+//
+func (a *Archive) tsNorm(timestamp int64) int64 {
+	ts := timestamp - (timestamp % a.Interval)
+	if ts < timestamp {
+		ts += a.Interval
+	}
+	return ts
+}
 
-			for tag, val := range tick {
-				ser := data[tag]
-				if ser == nil {
-					ser = make([]interface{}, l)
-					data[tag] = ser
-				}
-				ser[i] = val
-			}
+func (a *Archive) exerciseRetention() {
+	for a.EndTime - a.StartTime > a.Retention {
+		a.removeChunk(a.chunkStart(a.StartTime))
+		a.StartTime = a.chunkStart(a.StartTime) + a.ChunkSize
+	}
+}
 
+func (a *Archive) removeChunk(ts int64) {
+	for shard := 0; shard < a.Shards || shard == 0; shard++ {
+		fp := a.chunkPath(ts, shard)
+		if a.store != nil {
+			a.store.Delete(a.objectName(fp))
+		} else {
+			RemoveObject(fp)
+		}
+		delete(a.unsynced, fp)
+		if a.cache != nil {
+			a.cache.invalidate(fp)
 		}
-
-		stamps[i] = ct
-		ct += c.Resolution
-		i++
 	}
+}
 
-	return c.resolveTags(data), stamps
+func (a *Archive) lastChunk() *chunk {
+	l := len(a.chunks)
+	if l > 0 {
+		return a.chunks[l - 1]
+	}
+	return nil
 }
 
-func (c *chunk) resolveTags(val map[int][]interface{}) map[string][]interface{} {
-	ret := make(map[string][]interface{}, len(val))
-	for i, v := range val {
-		tag := c.Tags[i]
-		ret[tag] = v
+//
+// Chunk files are named for their start time.  Sharded archives
+// split each chunk across Shards files, named <start>.<shard>.
+//
+func (a *Archive) chunkPath(ts int64, shard int) string {
+	if a.Shards <= 1 {
+		return filepath.Join(a.Dir, fmt.Sprintf("%d", ts))
 	}
-	return ret
+	return filepath.Join(a.Dir, fmt.Sprintf("%d.%d", ts, shard))
 }
 
-func (c *chunk) derefTags(val map[string]interface{}) map[int]interface{} {
-	ret := make(map[int]interface{}, len(val))
-	for tag, v := range val {
-		i, ok := c.tagMap[tag]
-		if !ok {
-			c.tagMap[tag] = len(c.Tags)
-			i = len(c.Tags)
-			c.Tags = append(c.Tags, tag)
+func (a *Archive) shardsFor(keys *KeySet) []int {
+	if keys == nil || keys.all || keys.match != nil {
+		shards := make([]int, a.Shards)
+		for i := range shards {
+			shards[i] = i
 		}
-		ret[i] = v
+		return shards
 	}
-	return ret
+	seen := make(map[int]bool, len(keys.names))
+	shards := make([]int, 0, len(keys.names))
+	for k := range keys.names {
+		shard := ShardOf(k, a.Shards)
+		if !seen[shard] {
+			seen[shard] = true
+			shards = append(shards, shard)
+		}
+	}
+	sort.Ints(shards)
+	return shards
+}
+
+//
+// The shard of shards a key's data goes in, by an FNV-1a hash of
+// the key.
+//
+func ShardOf(key string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(shards))
 }
 
-func (c *chunk) tsIndex(ts int64) int {
-	return int((ts - c.StartTime) / c.Resolution)
+func (a *Archive) chunkStart(ts int64) int64 {
+	return ts - (ts % a.ChunkSize)
 }
 
-func newChunk(resolution, startTime int64) *chunk {
-	return &chunk{
-		StartTime: startTime,
-		EndTime: 0,
-		Data: make([]map[int]interface{}, 0),
-		Resolution: resolution,
-		Tags: make([]string, 0),
-		tagMap: make(map[string]int),
-		dirty: true,
-	}
+func (a *Archive) chunkEnd(ts int64) int64 {
+	return a.chunkStart(ts) + a.ChunkSize - a.Interval
+}
+
+
+func (a *Archive) boundaryCheck(ts int64) bool {
+	c := a.lastChunk()
+	return ts > a.chunkEnd(c.StartTime)
 }
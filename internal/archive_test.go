@@ -5,7 +5,9 @@ package internal
 
 import (
 	"testing"
+	"fmt"
 	"os"
+	"path/filepath"
 )
 
 func TestDataOneSecond(t *testing.T) {
@@ -117,7 +119,7 @@ func TestArchiveRollover(t *testing.T) {
 		a.Append(map[string]interface{} { "val": float64(i) }, startTime + int64(i))
 	}
 
-	d, ts := a.GetData(1560634000, 1560637000)
+	d, ts, _ := a.GetData(1560634000, 1560637000)
 	a.Write()
 
 	if len(d["val"]) != 3000 {
@@ -139,7 +141,7 @@ func TestArchiveRollover(t *testing.T) {
 		return
 	}
 
-	d, ts = a.GetData(1560634000, 1560637000)
+	d, ts, _ = a.GetData(1560634000, 1560637000)
 	if len(d["val"]) != 3000 {
 		t.Errorf("Data length is %d", len(d))
 	}
@@ -174,7 +176,7 @@ func TestFillIns(t *testing.T) {
 		return
 	}
 
-	d, ts := a.GetData(1560634000, 1560638000)
+	d, ts, _ := a.GetData(1560634000, 1560638000)
 
 	if len(d["val"]) != 800 {
 		t.Errorf("Data length is %d", len(d))
@@ -195,3 +197,332 @@ func TestFillIns(t *testing.T) {
 		t.Errorf("Expected 100: %f", d["val"][759])
 	}
 }
+
+func TestLegacyChunk(t *testing.T) {
+	os.RemoveAll("/tmp/archive_test")
+	os.Mkdir("/tmp/archive_test", os.ModePerm)
+
+	// chunks used to store a map of tag index to value per tick
+	legacy := struct {
+		StartTime   int64
+		EndTime     int64
+		Resolution  int64
+		Data        []map[int]interface{}
+		Tags        []string
+	}{
+		StartTime: 1560632400,
+		EndTime: 1560632520,
+		Resolution: 60,
+		Data: []map[int]interface{} {
+			{ 0: Rollup{Total: 10, Count: 2, Min: 4, Max: 6} },
+			nil,
+			{ 0: Rollup{Total: 3, Count: 1, Min: 3, Max: 3}, 1: Rollup{Count: 5} },
+		},
+		Tags: []string{ "a", "b" },
+	}
+	WriteObject("/tmp/archive_test/1560632400", legacy)
+
+	c, err := readChunk("/tmp/archive_test/1560632400", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _ := c.getData(1560632400, 1560632580)
+	if d["a"][0] != legacy.Data[0][0] || d["a"][1] != nil || d["b"][2] != legacy.Data[2][1] {
+		t.Errorf("Data is %+v", d)
+	}
+
+	c.append(map[string]interface{} { "c": Rollup{Count: 1} }, 1560632580)
+	if c.Ticks != 4 || c.tagMap["c"] != 2 {
+		t.Errorf("Appended to %+v", c)
+	}
+}
+
+func TestShardedArchive(t *testing.T) {
+	os.RemoveAll("/tmp/archive_test")
+	os.Mkdir("/tmp/archive_test", os.ModePerm)
+
+	startTime := int64(1560632000)
+	a := NewArchive("/tmp/archive_test", 1, 100000, 100)
+	a.Shards = 4
+	keys := []string{ "a", "b", "c", "d", "e", "f", "g", "h" }
+	for i := 0; i < 250; i++ {
+		vals := make(map[string]float64)
+		for k, key := range keys {
+			vals[key] = float64(100 * k + i)
+		}
+		a.AppendFloats(vals, startTime + int64(i))
+	}
+	a.Write()
+
+	files, _ := filepath.Glob("/tmp/archive_test/1560632000.*")
+	if len(files) == 0 || len(files) > a.Shards {
+		t.Errorf("Sharded chunk files are %v", files)
+	}
+
+	a, err := OpenArchive("/tmp/archive_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.lastChunk().Tags) != len(keys) {
+		t.Errorf("Reopened chunk has tags %v", a.lastChunk().Tags)
+	}
+
+	d, _, err := a.GetFloats(startTime, startTime + 250, -1, "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d) != 1 || d["c"][0] != 200 || d["c"][249] != 449 {
+		t.Errorf("Data for c is %+v", d)
+	}
+
+	// a single-key query only opens that key's shard
+	r, release, err := a.openChunk(1560632000, newKeySet([]string{ "c" }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.(shardReader)) != 1 {
+		t.Errorf("Opened %d shards for one key", len(r.(shardReader)))
+	}
+	release()
+
+	d, _, err = a.GetFloats(startTime, startTime + 250, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, key := range keys {
+		if d[key][100] != float64(100 * k + 100) {
+			t.Errorf("Data for %s is %+v", key, d[key])
+		}
+	}
+}
+
+func TestParallelScan(t *testing.T) {
+	os.RemoveAll("/tmp/archive_test")
+	os.Mkdir("/tmp/archive_test", os.ModePerm)
+
+	startTime := int64(1560632000)
+	a := NewArchive("/tmp/archive_test", 1, 100000, 100)
+	a.Encoding = EncodingGorilla
+	for i := 0; i < 5000; i++ {
+		a.AppendFloats(map[string]float64{ "a": float64(i), "b": float64(-i) }, startTime + int64(i))
+		if i % 1000 == 0 {
+			a.Write()
+		}
+	}
+	a.Write()
+
+	var results []map[string][]float64
+	for _, workers := range []int{ 1, 4, 100 } {
+		a.SetQueryWorkers(workers)
+		d, _, err := a.GetFloats(startTime + 50, startTime + 4950, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, d)
+	}
+	for n, d := range results {
+		for i := 0; i < 4900; i++ {
+			if d["a"][i] != float64(i + 50) || d["b"][i] != float64(-i - 50) {
+				t.Fatalf("Result %d: data[%d] is %f, %f", n, i, d["a"][i], d["b"][i])
+			}
+		}
+	}
+}
+
+func benchArchive(b *testing.B, encoding int) (*Archive, int64) {
+	os.RemoveAll("/tmp/archive_bench")
+	os.Mkdir("/tmp/archive_bench", os.ModePerm)
+
+	startTime := int64(1560632000)
+	a := NewArchive("/tmp/archive_bench", 1, 100000, 2000)
+	a.Encoding = encoding
+	vals := map[string]float64{ "a": 1, "b": 2, "c": 3, "d": 4 }
+	for i := 0; i < 10000; i++ {
+		vals["a"] = float64(i)
+		a.AppendFloats(vals, startTime + int64(i))
+	}
+	a.Write()
+	return a, startTime
+}
+
+func BenchmarkGetFloats(b *testing.B) {
+	a, startTime := benchArchive(b, EncodingRaw)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		a.GetFloats(startTime, startTime + 10000, 0)
+	}
+}
+
+func BenchmarkGetFloatsInto(b *testing.B) {
+	a, startTime := benchArchive(b, EncodingRaw)
+	d, stamps, _ := a.GetFloats(startTime, startTime + 10000, 0)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d, stamps, _ = a.GetFloatsInto(d, stamps, startTime, startTime + 10000, 0)
+	}
+}
+
+func BenchmarkRollupTo(b *testing.B) {
+	a, startTime := benchArchive(b, EncodingRaw)
+	dst := NewArchive("/tmp/archive_bench/rollup", 60, 100000, 120000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := startTime + int64(i % 160) * 60
+		a.RollupTo(dst, start, start + 60)
+	}
+}
+
+func TestFloat32Archive(t *testing.T) {
+	os.RemoveAll("/tmp/archive_test")
+	os.Mkdir("/tmp/archive_test", os.ModePerm)
+
+	startTime := int64(1560632000)
+	for _, enc := range []int{ EncodingRaw, EncodingGorilla, EncodingFixed } {
+		var sizes [2]int64
+		for vt := ValueFloat64; vt <= ValueFloat32; vt++ {
+			dir := filepath.Join("/tmp/archive_test", fmt.Sprintf("%d-%d", enc, vt))
+			os.Mkdir(dir, os.ModePerm)
+			a := NewArchive(dir, 1, 100000, 1000)
+			a.Encoding = enc
+			a.ValueType = vt
+			for i := 0; i < 1000; i++ {
+				a.AppendFloats(map[string]float64{ "a": 1.0 / float64(i + 1) }, startTime + int64(i))
+			}
+			a.Write()
+
+			fi, err := os.Stat(filepath.Join(dir, "1560632000"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sizes[vt] = fi.Size()
+
+			a, err = OpenArchive(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, reopened := range []bool{ false, true } {
+				if reopened {
+					// read the chunk from disk rather than memory
+					a.chunks = nil
+				}
+				d, _, err := a.GetFloats(startTime, startTime + 1000, -1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := 1.0 / 3
+				if vt == ValueFloat32 {
+					want = float64(float32(want))
+				}
+				if d["a"][2] != want {
+					t.Errorf("Encoding %d, value type %d: got %v, want %v", enc, vt, d["a"][2], want)
+				}
+			}
+		}
+		if sizes[ValueFloat32] >= sizes[ValueFloat64] * 3 / 4 {
+			t.Errorf("Encoding %d: float32 chunk is %d bytes, float64 %d", enc, sizes[1], sizes[0])
+		}
+	}
+}
+
+func TestLatestN(t *testing.T) {
+	os.RemoveAll("/tmp/archive_test")
+	os.Mkdir("/tmp/archive_test", os.ModePerm)
+	os.Mkdir("/tmp/archive_test/a", os.ModePerm)
+	a := NewArchive("/tmp/archive_test/a", 1, 3600, 600)
+	startTime := int64(1560632000)
+	for i := 0; i < 2000; i++ {
+		vals := map[string]interface{} { "val": float64(i) }
+		if i % 500 == 0 {
+			vals["rare"] = float64(i)
+		}
+		a.Append(vals, startTime + int64(i))
+	}
+	a.Write()
+
+	// spans two chunks
+	v, ts, err := a.LatestN("val", 800)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 800 || v[0] != 1200 || v[799] != 1999 || ts[799] != startTime + 1999 {
+		t.Errorf("Latest values are %v...%v", v[0], v[len(v) - 1])
+	}
+
+	v, ts, _ = a.LatestN("rare", 10)
+	if len(v) != 4 || v[0] != 0 || v[3] != 1500 || ts[3] != startTime + 1500 {
+		t.Errorf("Latest rare values are %v at %v", v, ts)
+	}
+
+	v, _, _ = a.LatestN("missing", 1)
+	if len(v) != 0 {
+		t.Errorf("Latest missing values are %v", v)
+	}
+}
+
+func TestCarryForward(t *testing.T) {
+	os.RemoveAll("/tmp/archive_test")
+	os.Mkdir("/tmp/archive_test", os.ModePerm)
+	startTime := int64(1560632000)
+
+	for _, tc := range []struct{ carry int; gap int64; filled bool }{
+		{ 0, 2, true },
+		{ 0, 3, false },
+		{ -1, 2, false },
+		{ 5, 6, true },
+		{ 5, 7, false },
+	} {
+		os.RemoveAll("/tmp/archive_test/a")
+		os.Mkdir("/tmp/archive_test/a", os.ModePerm)
+		a := NewArchive("/tmp/archive_test/a", 1, 3600, 600)
+		a.SetCarryForward(tc.carry)
+		a.Append(map[string]interface{} { "val": 1.0 }, startTime)
+		a.Append(map[string]interface{} { "val": 2.0 }, startTime + tc.gap)
+
+		d, _, _ := a.GetData(startTime, startTime + tc.gap)
+		if filled := d["val"][tc.gap - 1] != nil; filled != tc.filled {
+			t.Errorf("Carrying %d ticks, a gap of %d filled: %v", tc.carry, tc.gap, filled)
+		}
+	}
+}
+
+func TestUnwrittenTicks(t *testing.T) {
+	os.RemoveAll("/tmp/archive_test")
+	os.Mkdir("/tmp/archive_test", os.ModePerm)
+	os.Mkdir("/tmp/archive_test/a", os.ModePerm)
+	a := NewArchive("/tmp/archive_test/a", 5, 3600, 600)
+	startTime := int64(1560632000)
+	if n := a.UnwrittenTicks(); n != 0 {
+		t.Errorf("Empty archive has %d unwritten ticks", n)
+	}
+	for i := int64(0); i < 10; i++ {
+		a.Append(map[string]interface{} { "val": float64(i) }, startTime + i * 5)
+	}
+	if n := a.UnwrittenTicks(); n != 10 {
+		t.Errorf("%d unwritten ticks, not 10", n)
+	}
+	a.Write()
+	if n := a.UnwrittenTicks(); n != 0 {
+		t.Errorf("%d unwritten ticks once written", n)
+	}
+	// a gap counts
+	a.Append(map[string]interface{} { "val": 1.0 }, startTime + 100)
+	if n := a.UnwrittenTicks(); n != 11 {
+		t.Errorf("%d unwritten ticks after a gap, not 11", n)
+	}
+	a.Write()
+
+	a, err := OpenArchive("/tmp/archive_test/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := a.UnwrittenTicks(); n != 0 {
+		t.Errorf("Reopened archive has %d unwritten ticks", n)
+	}
+	a.Append(map[string]interface{} { "val": 1.0 }, startTime + 105)
+	if n := a.UnwrittenTicks(); n != 1 {
+		t.Errorf("%d unwritten ticks, not 1", n)
+	}
+}
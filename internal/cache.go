@@ -0,0 +1,104 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"container/list"
+	"sync"
+)
+
+//
+// An LRU cache of decoded historical chunks, keyed by file path,
+// holding at most Budget bytes of chunk data.  Cached chunks are
+// shared between queries and must not be modified.  A cache may be
+// shared by several archives.
+//
+type ChunkCache struct {
+	Budget  int64
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+	mu      sync.Mutex
+}
+
+type cacheEntry struct {
+	path  string
+	chunk *chunk
+	size  int64
+}
+
+func NewChunkCache(budget int64) *ChunkCache {
+	return &ChunkCache{
+		Budget: budget,
+		lru: list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (cc *ChunkCache) get(path string) *chunk {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	e, ok := cc.entries[path]
+	if !ok {
+		return nil
+	}
+	cc.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).chunk
+}
+
+func (cc *ChunkCache) put(path string, c *chunk) {
+	size := c.size()
+	if size > cc.Budget {
+		return
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if e, ok := cc.entries[path]; ok {
+		cc.remove(e)
+	}
+	cc.entries[path] = cc.lru.PushFront(&cacheEntry{path, c, size})
+	cc.size += size
+	for cc.size > cc.Budget {
+		cc.remove(cc.lru.Back())
+	}
+}
+
+//
+// Drop path from the cache, e.g. because the file was rewritten.
+//
+func (cc *ChunkCache) invalidate(path string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if e, ok := cc.entries[path]; ok {
+		cc.remove(e)
+	}
+}
+
+func (cc *ChunkCache) remove(e *list.Element) {
+	ent := cc.lru.Remove(e).(*cacheEntry)
+	delete(cc.entries, ent.path)
+	cc.size -= ent.size
+}
+
+//
+// Approximate in-memory size of a chunk, in bytes.
+//
+func (c *chunk) size() int64 {
+	size := int64(0)
+	for i := range c.Values {
+		col := &c.Values[i]
+		size += int64(8 * len(col.Vals) + 8 * len(col.Valid) + 4 * len(col.Index))
+	}
+	for _, tag := range c.Tags {
+		size += int64(len(tag))
+	}
+	for _, kind := range sketchKinds {
+		for _, sk := range *c.sketchField(kind) {
+			for _, s := range sk {
+				size += int64(4 + len(s))
+			}
+		}
+	}
+	return size
+}
@@ -0,0 +1,119 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"testing"
+	"os"
+	"path/filepath"
+)
+
+func TestChunkCache(t *testing.T) {
+	os.RemoveAll("/tmp/archive_test")
+	os.Mkdir("/tmp/archive_test", os.ModePerm)
+
+	startTime := int64(1560632000)
+	a := NewArchive("/tmp/archive_test", 1, 100000, 100)
+	for i := 0; i < 1000; i++ {
+		a.AppendFloats(map[string]float64{ "a": float64(i), "b": float64(-i) }, startTime + int64(i))
+	}
+	a.Write()
+
+	a, err := OpenArchive("/tmp/archive_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// room for about three 100-tick, two-key chunks
+	cc := NewChunkCache(5000)
+	a.SetCache(cc)
+
+	d, _, err := a.GetFloats(startTime, startTime + 1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d["a"][250] != 250 || d["b"][999] != -999 {
+		t.Errorf("Data is %+v", d)
+	}
+	if cc.size > cc.Budget || cc.lru.Len() != 3 {
+		t.Errorf("Cache holds %d chunks, %d bytes", cc.lru.Len(), cc.size)
+	}
+	// the most recently read historical chunks are kept
+	if cc.get(filepath.Join(a.Dir, "1560632800")) == nil {
+		t.Errorf("Expected chunk 1560632800 to be cached")
+	}
+	if cc.get(filepath.Join(a.Dir, "1560632000")) != nil {
+		t.Errorf("Expected chunk 1560632000 to be evicted")
+	}
+
+	// cached data matches what's on disk
+	d, _, err = a.GetFloats(startTime + 800, startTime + 900, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d["a"][50] != 850 {
+		t.Errorf("Data is %+v", d)
+	}
+}
+
+func TestFixedNotCached(t *testing.T) {
+	os.RemoveAll("/tmp/archive_test")
+	os.Mkdir("/tmp/archive_test", os.ModePerm)
+
+	startTime := int64(1560632000)
+	a := NewArchive("/tmp/archive_test", 1, 100000, 100)
+	a.Encoding = EncodingFixed
+	for i := 0; i < 1000; i++ {
+		a.AppendFloats(map[string]float64{ "a": float64(i) }, startTime + int64(i))
+	}
+	a.Write()
+
+	cc := NewChunkCache(1 << 20)
+	a.SetCache(cc)
+	d, _, err := a.GetFloats(startTime + 150, startTime + 160, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d["a"][5] != 155 {
+		t.Errorf("Data is %+v", d)
+	}
+	// read in place, so nothing is decoded into the cache
+	if cc.lru.Len() != 0 {
+		t.Errorf("Cache holds %d fixed-layout chunks", cc.lru.Len())
+	}
+}
+
+func TestReopenedTagIndex(t *testing.T) {
+	os.RemoveAll("/tmp/archive_test")
+	os.Mkdir("/tmp/archive_test", os.ModePerm)
+
+	startTime := int64(1560632000)
+	for _, enc := range []int{ EncodingRaw, EncodingGorilla, EncodingFixed } {
+		dir := filepath.Join("/tmp/archive_test", string(rune('a' + enc)))
+		os.Mkdir(dir, os.ModePerm)
+		a := NewArchive(dir, 1, 100000, 100)
+		a.Encoding = enc
+		a.AppendFloats(map[string]float64{ "a": 1, "b": 2 }, startTime)
+		a.Write()
+
+		a, err := OpenArchive(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.AppendFloats(map[string]float64{ "b": 3, "c": 4 }, startTime + 1)
+
+		lc := a.lastChunk()
+		if len(lc.Tags) != 3 || len(lc.tagMap) != 3 || lc.tagMap["c"] != 2 {
+			t.Errorf("Encoding %d: tags are %v, %v", enc, lc.Tags, lc.tagMap)
+		}
+		for i, tag := range lc.Tags {
+			if lc.tagMap[tag] != i {
+				t.Errorf("Encoding %d: tags are %v, %v", enc, lc.Tags, lc.tagMap)
+			}
+		}
+		latest, _ := a.LatestFloats()
+		if latest["b"] != 3 || latest["c"] != 4 {
+			t.Errorf("Encoding %d: latest is %v", enc, latest)
+		}
+	}
+}
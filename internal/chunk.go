@@ -0,0 +1,664 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"fmt"
+)
+
+//
+//
+// Chunks are for the most granular data.
+// We normalize the data so all timestamps align
+// to resolution, and there are no missing ticks
+// (we proactively fill in missing data).  This
+// way, we don't have to store timestamps with
+// every datapoint.
+//
+// Data is stored column-wise: one run of floats
+// per tag (see column.go).
+//
+//
+
+// On-disk chunk encodings
+const (
+	EncodingRaw = iota
+	EncodingGorilla
+	EncodingFixed
+	EncodingRLE
+	EncodingDelta
+)
+
+// Stored precision of plain values.  Values are always float64 in
+// memory; ValueFloat32 rounds them on append and stores 32 bits.
+// Rollups are always stored in full.
+const (
+	ValueFloat64 = iota
+	ValueFloat32
+)
+
+// Value kinds; base archives hold float64, rollup archives Rollups.
+// kindRollup chunks were written before Rollups had SumSq, and
+// kindRollupSq before they had First and Last, and kindRollupEnds
+// before they had Weighted and Duration; they're widened to
+// rollupKind when appended to.
+const (
+	kindFloat = iota
+	kindRollup
+	kindRollupSq
+	kindRollupEnds
+	kindRollupTimed
+)
+
+// The kind new rollups are written as, and the widest of any kind.
+const (
+	rollupKind = kindRollupTimed
+	maxWidth = 9
+)
+
+type chunk struct {
+	StartTime   int64
+	EndTime     int64
+	Resolution  int64
+	Tags        []string
+	Kind        int
+	Ticks       int
+	Values      []column
+	Encoding    int
+	ValueType   int
+	Columns     [][]byte
+	// Data is only set in chunks written before the columnar
+	// layout; it's converted to Values on read.
+	Data        []map[int]interface{}
+	// encoded quantile sketches and HyperLogLogs by tag and tick,
+	// for archives that keep them; may be shorter than Tags
+	Sketches    []map[int32][]byte
+	Uniques     []map[int32][]byte
+	tagMap      map[string]int
+	dirty       bool
+	// the encoding the chunk was read in
+	fileEncoding int
+}
+
+func width(kind int) int {
+	switch kind {
+	case kindRollup:
+		return 4
+	case kindRollupSq:
+		return 5
+	case kindRollupEnds:
+		return 7
+	case kindRollupTimed:
+		return 9
+	}
+	return 1
+}
+
+func isRollup(kind int) bool {
+	return kind >= kindRollup && kind <= kindRollupTimed
+}
+
+func valueKind(val interface{}) int {
+	if _, ok := val.(Rollup); ok {
+		return rollupKind
+	}
+	return kindFloat
+}
+
+func toFloats(val interface{}) []float64 {
+	switch v := val.(type) {
+	case Rollup:
+		f := make([]float64, width(rollupKind))
+		v.floats(f)
+		return f
+	case float64:
+		return []float64{v}
+	}
+	return nil
+}
+
+func fromFloats(kind int, f []float64) interface{} {
+	if isRollup(kind) {
+		return rollupFromFloats(f)
+	}
+	return f[0]
+}
+
+func readChunk(filePath string, codec Codec) (*chunk, error) {
+	buf, err := ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return decodeChunk(filePath, buf, codec)
+}
+
+//
+// Decode a chunk file payload (any encoding) into memory.
+//
+func decodeChunk(filePath string, buf []byte, codec Codec) (*chunk, error) {
+	return decodeChunkInto(new(chunk), filePath, buf, codec)
+}
+
+//
+// Like decodeChunk, reusing c's slices where possible.
+//
+func decodeChunkInto(c *chunk, filePath string, buf []byte, codec Codec) (*chunk, error) {
+	if isFixed(buf) {
+		m, err := parseFixed(buf)
+		if err == nil {
+			var c *chunk
+			c, err = m.toChunk()
+			if err == nil {
+				c.fileEncoding = EncodingFixed
+				return c, nil
+			}
+		}
+		return nil, fmt.Errorf("%s: %v: %w", filePath, err, ErrCorruptChunk)
+	}
+
+	if codec != nil && codec != Msgpack {
+		// other codecs may skip zero fields, leaving stale
+		// values in reused columns
+		c.Values = nil
+	}
+	err := decodeBytes(filePath, buf, c, codec)
+	if err != nil {
+		return nil, err
+	}
+	encoding := c.Encoding
+	err = c.unpack()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v: %w", filePath, err, ErrCorruptChunk)
+	}
+	c.fileEncoding = encoding
+	return c, nil
+}
+
+func (c *chunk) write(filePath string, encoding, compression int, codec Codec) error {
+	data, err := c.encode(encoding, compression, codec)
+	if err != nil {
+		return err
+	}
+	return writeFramed(filePath, data)
+}
+
+//
+// The contents of the chunk's file, as write writes it.
+//
+func (c *chunk) encode(encoding, compression int, codec Codec) ([]byte, error) {
+	if encoding == EncodingFixed && c.hasSketches() {
+		// the fixed layout has no room for sketches
+		encoding = EncodingRaw
+	}
+	if encoding == EncodingFixed {
+		// read in place, so never compressed
+		return frame(encodeFixed(c), CompressNone)
+	}
+	buf, err := encodeObject(c.pack(encoding), codec)
+	if err != nil {
+		return nil, err
+	}
+	return frame(buf, compression)
+}
+
+func (c *chunk) scan(startTime, endTime int64, keys *KeySet, fn func(tag string, i int, f []float64)) error {
+	l := int((endTime - startTime) / c.Resolution)
+	first := c.tsIndex(startTime)
+	w := width(c.Kind)
+	for tag := range c.Values {
+		name := c.Tags[tag]
+		if !keys.has(name) {
+			continue
+		}
+		c.Values[tag].each(first, first + l, w, func(tick int, f []float64) {
+			fn(name, tick - first, f)
+		})
+	}
+	return nil
+}
+
+//
+// Returns a copy of the chunk in the given on-disk encoding.
+// Raw chunks are written as-is.
+//
+func (c *chunk) pack(encoding int) *chunk {
+	narrow := c.ValueType == ValueFloat32 && c.Kind == kindFloat
+	if encoding == EncodingRaw && !narrow {
+		return c
+	}
+
+	packed := &chunk{
+		StartTime: c.StartTime,
+		EndTime: c.EndTime,
+		Resolution: c.Resolution,
+		Tags: c.Tags,
+		Kind: c.Kind,
+		Ticks: c.Ticks,
+		Encoding: encoding,
+		ValueType: c.ValueType,
+		Sketches: c.Sketches,
+		Uniques: c.Uniques,
+	}
+	if packsColumns(encoding) {
+		packed.Columns = make([][]byte, len(c.Values))
+		for i := range c.Values {
+			packed.Columns[i] = c.encodeColumn(encoding, &c.Values[i])
+		}
+		return packed
+	}
+	packed.Encoding = EncodingRaw
+	packed.Values = make([]column, len(c.Values))
+	for i := range c.Values {
+		packed.Values[i] = c.Values[i].narrow()
+	}
+	return packed
+}
+
+//
+// Expand a packed or legacy chunk into Values, and rebuild the
+// tag index.
+//
+func (c *chunk) unpack() error {
+	if packsColumns(c.Encoding) {
+		if len(c.Columns) != len(c.Tags) {
+			return fmt.Errorf("chunk %d has %d columns for %d tags",
+				c.StartTime, len(c.Columns), len(c.Tags))
+		}
+		c.Values = make([]column, len(c.Columns))
+		for i, buf := range c.Columns {
+			col, err := c.decodeColumn(buf)
+			if err != nil {
+				return err
+			}
+			c.Values[i] = col
+		}
+		c.Encoding = EncodingRaw
+		c.Columns = nil
+	}
+
+	for i := range c.Values {
+		c.Values[i].widen()
+	}
+
+	if c.Data != nil {
+		c.Ticks = len(c.Data)
+		c.Values = make([]column, len(c.Tags))
+		for i := range c.Values {
+			c.Values[i] = newColumn()
+		}
+		for t, tick := range c.Data {
+			for tag, v := range tick {
+				v = legacyValue(v)
+				c.Kind = valueKind(v)
+				c.Values[tag].set(t, width(c.Kind), toFloats(v))
+			}
+		}
+		c.Data = nil
+	}
+
+	if len(c.Values) < len(c.Tags) {
+		c.Values = append(c.Values, make([]column, len(c.Tags) - len(c.Values))...)
+	}
+	if c.tagMap == nil {
+		c.tagMap = make(map[string]int, len(c.Tags))
+	}
+	for i, tag := range c.Tags {
+		c.tagMap[tag] = i
+	}
+	return nil
+}
+
+//
+// Encodings that pack each column into Columns.
+//
+func packsColumns(encoding int) bool {
+	switch encoding {
+	case EncodingGorilla, EncodingRLE, EncodingDelta:
+		return true
+	}
+	return false
+}
+
+func (c *chunk) encodeColumn(encoding int, col *column) []byte {
+	switch encoding {
+	case EncodingRLE:
+		return encodeRLEColumn(col, c.Kind, c.ValueType, c.Ticks)
+	case EncodingDelta:
+		return encodeDeltaColumn(col, c.Kind, c.Ticks)
+	}
+	// float32-rounded values XOR down to 32 bits or less anyway
+	return encodeGorillaColumn(col, c.Kind, c.Ticks)
+}
+
+func (c *chunk) decodeColumn(buf []byte) (column, error) {
+	switch c.Encoding {
+	case EncodingRLE:
+		return decodeRLEColumn(buf, c.Kind, c.ValueType, c.Ticks)
+	case EncodingDelta:
+		return decodeDeltaColumn(buf, c.Kind, c.Ticks)
+	}
+	return decodeGorillaColumn(buf, c.Kind, c.Ticks)
+}
+
+//
+// Legacy raw chunks stored values as bare interfaces, so rollups
+// come back from msgpack as generic maps.
+//
+func legacyValue(v interface{}) interface{} {
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return v
+	}
+	var r Rollup
+	for k, f := range m {
+		var key string
+		switch kk := k.(type) {
+		case string:
+			key = kk
+		case []byte:
+			key = string(kk)
+		}
+		switch key {
+		case "Total":
+			r.Total = toFloat64(f)
+		case "Count":
+			r.Count = int64(toFloat64(f))
+		case "Min":
+			r.Min = toFloat64(f)
+		case "Max":
+			r.Max = toFloat64(f)
+		}
+	}
+	return r
+}
+
+func toFloat64(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case float32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case uint64:
+		return float64(n)
+	}
+	return 0
+}
+
+//
+// The most ticks fillTo copies the latest tick into, unless told
+// otherwise.
+//
+const defaultCarryForward = 1
+
+func (c *chunk) fillTo(timestamp int64, carry int) {
+	numToFill := (timestamp - c.EndTime) / c.Resolution
+
+	//
+	// For short periods (up to carry ticks), we copy the latest
+	// tick forward. For longer ones, we leave the ticks invalid
+	// to indicate missing data.
+	//
+	last := c.Ticks - 1
+	w := width(c.Kind)
+	ts := c.EndTime + c.Resolution
+	if numToFill - 1 > int64(carry) {
+		// nothing to copy; just skip ahead
+		ts = timestamp - c.Resolution
+		c.Ticks = c.tsIndex(ts) + 1
+		c.EndTime = ts
+		c.dirty = true
+		return
+	}
+	for ts < timestamp {
+		tick := c.tsIndex(ts)
+		if last >= 0 {
+			for i := range c.Values {
+				col := &c.Values[i]
+				if col.has(last) {
+					col.set(tick, w, col.get(last, w))
+				}
+			}
+		}
+		c.Ticks = tick + 1
+		c.EndTime = ts
+		c.dirty = true
+		ts += c.Resolution
+	}
+}
+
+func (c *chunk) empty() bool {
+	return c.EndTime == 0
+}
+
+//
+// Does the chunk hold no values at all?
+//
+func (c *chunk) blank() bool {
+	for i := range c.Values {
+		col := &c.Values[i]
+		if len(col.Index) > 0 {
+			return false
+		}
+		for _, w := range col.Valid {
+			if w != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (c *chunk) latest() map[string]interface{} {
+	if c.Ticks == 0 {
+		return nil
+	}
+	last := c.Ticks - 1
+	w := width(c.Kind)
+	ret := make(map[string]interface{}, len(c.Values))
+	for i := range c.Values {
+		col := &c.Values[i]
+		if col.has(last) {
+			ret[c.Tags[i]] = fromFloats(c.Kind, col.get(last, w))
+		}
+	}
+	return ret
+}
+
+func (c *chunk) append(val map[string]interface{}, timestamp int64) {
+	tick, ok := c.advance(timestamp, defaultCarryForward)
+	if !ok {
+		return
+	}
+	for tag, v := range val {
+		c.setValue(tick, tag, valueKind(v), toFloats(v))
+	}
+}
+
+//
+// Move the chunk forward to timestamp, filling in any gap of up to
+// carry ticks, and return the tick to write values at.  Returns
+// false if timestamp is older than the latest tick.
+//
+func (c *chunk) advance(timestamp int64, carry int) (int, bool) {
+	if timestamp < c.EndTime {
+		return 0, false
+	}
+	c.dirty = true
+
+	if timestamp == c.EndTime {
+		return c.Ticks - 1, true
+	}
+
+	if !c.empty() && timestamp > c.EndTime + c.Resolution {
+		c.fillTo(timestamp, carry)
+	}
+
+	// ticks skipped at the start of the chunk are left invalid
+	tick := c.tsIndex(timestamp)
+	c.Ticks = tick + 1
+	c.EndTime = timestamp
+	return tick, true
+}
+
+func (c *chunk) setValue(tick int, tag string, kind int, f []float64) {
+	if len(c.Tags) == 0 {
+		c.Kind = kind
+	} else if kind != c.Kind && isRollup(kind) && isRollup(c.Kind) {
+		if width(kind) > width(c.Kind) {
+			c.widenRollups(kind)
+		} else {
+			f = widenRollup(f, c.Kind)
+		}
+	}
+	if c.ValueType == ValueFloat32 && kind == kindFloat {
+		f[0] = float64(float32(f[0]))
+	}
+	i := c.tagIndex(tag)
+	c.Values[i].set(tick, width(c.Kind), f)
+}
+
+func (c *chunk) getData(startTime int64, endTime int64) (map[string][]interface{}, []int64) {
+	l := int((endTime - startTime) / c.Resolution)
+
+	data := make(map[string][]interface{})
+	stamps := make([]int64, l)
+
+	ct := startTime
+	for i := 0; i < l; i++ {
+		stamps[i] = ct
+		ct += c.Resolution
+	}
+
+	c.scan(startTime, endTime, nil, func(tag string, i int, f []float64) {
+		ser := data[tag]
+		if ser == nil {
+			ser = make([]interface{}, l)
+			data[tag] = ser
+		}
+		ser[i] = fromFloats(c.Kind, f)
+	})
+
+	return data, stamps
+}
+
+//
+// Split the chunk into n chunks by key hash, for sharded archives.
+// Shards with no keys are nil.  The shards share columns with c.
+//
+func (c *chunk) split(n int) []*chunk {
+	parts := make([]*chunk, n)
+	for i, tag := range c.Tags {
+		shard := ShardOf(tag, n)
+		part := parts[shard]
+		if part == nil {
+			part = newChunk(c.Resolution, c.StartTime)
+			part.EndTime = c.EndTime
+			part.Kind = c.Kind
+			part.Ticks = c.Ticks
+			part.ValueType = c.ValueType
+			parts[shard] = part
+		}
+		part.tagMap[tag] = len(part.Tags)
+		part.Tags = append(part.Tags, tag)
+		part.Values = append(part.Values, c.Values[i])
+	}
+	for _, kind := range sketchKinds {
+		if len(*c.sketchField(kind)) == 0 {
+			continue
+		}
+		for i, tag := range c.Tags {
+			f := parts[ShardOf(tag, n)].sketchField(kind)
+			*f = append(*f, c.sketchesFor(kind, i))
+		}
+	}
+	return parts
+}
+
+//
+// Add the keys of another shard of the same chunk.
+//
+func (c *chunk) merge(o *chunk) {
+	if o.Kind != c.Kind && isRollup(o.Kind) && isRollup(c.Kind) {
+		if width(o.Kind) > width(c.Kind) {
+			c.widenRollups(o.Kind)
+		} else {
+			o.widenRollups(c.Kind)
+		}
+	}
+	for _, kind := range sketchKinds {
+		if len(*o.sketchField(kind)) == 0 {
+			continue
+		}
+		f := c.sketchField(kind)
+		for len(*f) < len(c.Tags) {
+			*f = append(*f, nil)
+		}
+		for i := range o.Tags {
+			*f = append(*f, o.sketchesFor(kind, i))
+		}
+	}
+	for i, tag := range o.Tags {
+		c.tagMap[tag] = len(c.Tags)
+		c.Tags = append(c.Tags, tag)
+		c.Values = append(c.Values, o.Values[i])
+	}
+	if o.fileEncoding != c.fileEncoding {
+		c.fileEncoding = -1
+	}
+	if o.EndTime > c.EndTime {
+		c.EndTime = o.EndTime
+		c.Ticks = o.Ticks
+	}
+}
+
+//
+// Convert a chunk of rollups to a wider kind, deriving the new
+// fields from the old ones where possible.
+//
+func (c *chunk) widenRollups(kind int) {
+	w := width(c.Kind)
+	for i := range c.Values {
+		col := newColumn()
+		c.Values[i].each(0, c.Ticks, w, func(t int, f []float64) {
+			col.set(t, width(kind), widenRollup(f, kind))
+		})
+		c.Values[i] = col
+	}
+	c.Kind = kind
+}
+
+func widenRollup(f []float64, kind int) []float64 {
+	wide := make([]float64, width(kind))
+	rollupFromFloats(f).floats(wide)
+	return wide
+}
+
+func (c *chunk) tagIndex(tag string) int {
+	i, ok := c.tagMap[tag]
+	if !ok {
+		i = len(c.Tags)
+		c.tagMap[tag] = i
+		c.Tags = append(c.Tags, tag)
+		c.Values = append(c.Values, newColumn())
+	}
+	return i
+}
+
+func (c *chunk) tsIndex(ts int64) int {
+	return int((ts - c.StartTime) / c.Resolution)
+}
+
+func newChunk(resolution, startTime int64) *chunk {
+	return &chunk{
+		StartTime: startTime,
+		EndTime: 0,
+		Resolution: resolution,
+		Tags: make([]string, 0),
+		Values: make([]column, 0),
+		tagMap: make(map[string]int),
+		dirty: true,
+	}
+}
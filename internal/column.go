@@ -0,0 +1,216 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"math/bits"
+	"sort"
+)
+
+//
+// One tag's values within a chunk, holding width(kind) floats per
+// tick.  Columns come in two layouts:
+//
+// Dense columns hold a slot for every tick up to the last one set,
+// with a bit set in Valid for every tick that has data.
+//
+// Sparse columns hold values only for the ticks listed in Index
+// (ascending), so a key that reports once an hour into a SECOND
+// archive costs one slot per report rather than one per second.
+//
+// New columns start out sparse, and switch to dense as soon as
+// that's smaller, so steadily-reporting keys are dense from their
+// first tick.  Dense columns switch back to sparse when a gap makes
+// them more than twice the size they'd be sparse.
+//
+type column struct {
+	Vals   []float64
+	Valid  []uint64
+	Sparse bool
+	Index  []int32
+	// Vals32 replaces Vals on disk for float32 archives
+	Vals32 []float32
+}
+
+func newColumn() column {
+	return column{Sparse: true}
+}
+
+func (col *column) has(tick int) bool {
+	if col.Sparse {
+		_, ok := col.find(tick)
+		return ok
+	}
+	w := tick / 64
+	return w < len(col.Valid) && col.Valid[w] & (1 << uint(tick % 64)) != 0
+}
+
+//
+// Returns the values for tick, which must be valid.
+//
+func (col *column) get(tick, width int) []float64 {
+	if col.Sparse {
+		pos, _ := col.find(tick)
+		return col.Vals[pos * width : (pos + 1) * width]
+	}
+	return col.Vals[tick * width : (tick + 1) * width]
+}
+
+func (col *column) set(tick, width int, v []float64) {
+	if col.Sparse {
+		col.setSparse(tick, width, v)
+		if col.denseIsSmaller(width) {
+			col.toDense(width)
+		}
+		return
+	}
+
+	if tick * width > len(col.Vals) && col.sparseIsSmaller(tick, width) {
+		col.toSparse(width)
+		col.setSparse(tick, width, v)
+		return
+	}
+
+	for len(col.Valid) <= tick / 64 {
+		col.Valid = append(col.Valid, 0)
+	}
+	col.Valid[tick / 64] |= 1 << uint(tick % 64)
+
+	need := (tick + 1) * width
+	if len(col.Vals) < need {
+		col.Vals = append(col.Vals, make([]float64, need - len(col.Vals))...)
+	}
+	copy(col.Vals[tick * width:], v)
+}
+
+//
+// Calls fn for every valid tick in [from, to).
+//
+func (col *column) each(from, to, width int, fn func(tick int, f []float64)) {
+	if from < 0 {
+		from = 0
+	}
+	if col.Sparse {
+		pos := sort.Search(len(col.Index), func(i int) bool {
+			return int(col.Index[i]) >= from
+		})
+		for ; pos < len(col.Index) && int(col.Index[pos]) < to; pos++ {
+			fn(int(col.Index[pos]), col.Vals[pos * width : (pos + 1) * width])
+		}
+		return
+	}
+	for tick := from; tick < to; tick++ {
+		if col.has(tick) {
+			fn(tick, col.Vals[tick * width : (tick + 1) * width])
+		}
+	}
+}
+
+//
+// Returns the position of tick in a sparse column's Index.
+//
+func (col *column) find(tick int) (int, bool) {
+	n := len(col.Index)
+	// appends are almost always at or after the end
+	if n > 0 && int(col.Index[n - 1]) == tick {
+		return n - 1, true
+	}
+	if n == 0 || int(col.Index[n - 1]) < tick {
+		return n, false
+	}
+	pos := sort.Search(n, func(i int) bool {
+		return int(col.Index[i]) >= tick
+	})
+	return pos, pos < n && int(col.Index[pos]) == tick
+}
+
+func (col *column) setSparse(tick, width int, v []float64) {
+	pos, ok := col.find(tick)
+	if !ok {
+		col.Index = append(col.Index, 0)
+		copy(col.Index[pos + 1:], col.Index[pos:])
+		col.Index[pos] = int32(tick)
+		col.Vals = append(col.Vals, make([]float64, width)...)
+		copy(col.Vals[(pos + 1) * width:], col.Vals[pos * width:])
+	}
+	copy(col.Vals[pos * width:], v)
+}
+
+func (col *column) denseIsSmaller(width int) bool {
+	n := len(col.Index)
+	if n == 0 {
+		return false
+	}
+	span := int(col.Index[n - 1]) + 1
+	sparseSize := n * (8 * width + 4)
+	denseSize := span * 8 * width + span / 8
+	return denseSize <= sparseSize
+}
+
+//
+// Would setting tick in a dense column be smaller as sparse?
+//
+func (col *column) sparseIsSmaller(tick, width int) bool {
+	n := 1
+	for _, w := range col.Valid {
+		n += bits.OnesCount64(w)
+	}
+	span := tick + 1
+	sparseSize := n * (8 * width + 4)
+	denseSize := span * 8 * width + span / 8
+	return 2 * sparseSize <= denseSize
+}
+
+func (col *column) toSparse(width int) {
+	dense := *col
+	*col = newColumn()
+	dense.each(0, len(dense.Vals) / width, width, func(tick int, f []float64) {
+		col.Index = append(col.Index, int32(tick))
+		col.Vals = append(col.Vals, f...)
+	})
+}
+
+func (col *column) toDense(width int) {
+	index, vals := col.Index, col.Vals
+	span := int(index[len(index) - 1]) + 1
+	*col = column{
+		Vals: make([]float64, span * width),
+		Valid: make([]uint64, (span + 63) / 64),
+	}
+	for i, tick := range index {
+		col.Valid[tick / 64] |= 1 << uint(tick % 64)
+		copy(col.Vals[int(tick) * width:], vals[i * width : (i + 1) * width])
+	}
+}
+
+//
+// Returns a copy of the column with Vals stored as float32, for
+// writing.  Valid and Index are shared.
+//
+func (col *column) narrow() column {
+	n := column{
+		Valid: col.Valid,
+		Sparse: col.Sparse,
+		Index: col.Index,
+		Vals32: make([]float32, len(col.Vals)),
+	}
+	for i, v := range col.Vals {
+		n.Vals32[i] = float32(v)
+	}
+	return n
+}
+
+//
+// Restore Vals after reading a narrowed column.
+//
+func (col *column) widen() {
+	if col.Vals32 == nil {
+		return
+	}
+	col.Vals = resize(col.Vals, len(col.Vals32))
+	for i, v := range col.Vals32 {
+		col.Vals[i] = float64(v)
+	}
+	col.Vals32 = nil
+}
@@ -0,0 +1,82 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"testing"
+	"os"
+)
+
+func TestSparseColumn(t *testing.T) {
+	col := newColumn()
+	col.set(10, 1, []float64{ 1 })
+	col.set(500, 1, []float64{ 2 })
+	col.set(1999, 1, []float64{ 3 })
+	col.set(250, 1, []float64{ 4 })
+
+	if !col.Sparse || len(col.Vals) != 4 {
+		t.Errorf("Expected sparse column: %+v", col)
+	}
+	if !col.has(250) || col.has(251) || col.get(500, 1)[0] != 2 {
+		t.Errorf("Lookup failed: %+v", col)
+	}
+
+	var ticks []int
+	col.each(11, 1999, 1, func(tick int, f []float64) {
+		ticks = append(ticks, tick)
+	})
+	if len(ticks) != 2 || ticks[0] != 250 || ticks[1] != 500 {
+		t.Errorf("Iterated %v", ticks)
+	}
+}
+
+func TestColumnGoesDense(t *testing.T) {
+	col := newColumn()
+	for i := 0; i < 100; i++ {
+		col.set(i, 4, []float64{ float64(i), 1, 2, 3 })
+	}
+	if col.Sparse {
+		t.Errorf("Expected dense column")
+	}
+	if col.get(99, 4)[0] != 99 || !col.has(0) || col.has(100) {
+		t.Errorf("Lookup failed")
+	}
+
+	col = newColumn()
+	col.set(100, 1, []float64{ 1 })
+	for i := 101; i < 2000; i++ {
+		col.set(i, 1, []float64{ float64(i) })
+	}
+	if col.Sparse || col.get(1500, 1)[0] != 1500 || col.has(99) {
+		t.Errorf("Expected dense column")
+	}
+}
+
+func TestSparseArchive(t *testing.T) {
+	os.RemoveAll("/tmp/archive_test")
+	os.Mkdir("/tmp/archive_test", os.ModePerm)
+	os.Mkdir("/tmp/archive_test/a", os.ModePerm)
+
+	a := NewArchive("/tmp/archive_test/a", 1, 86400, 2000)
+	startTime := int64(1560632000)
+	for i := 0; i < 2000; i += 500 {
+		a.AppendFloats(map[string]float64{ "val": float64(i) }, startTime + int64(i))
+	}
+	if c := a.lastChunk(); !c.Values[0].Sparse || len(c.Values[0].Vals) != 4 {
+		t.Errorf("Expected sparse column: %+v", c.Values[0])
+	}
+	a.Write()
+
+	a, err := OpenArchive("/tmp/archive_test/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _, err := a.GetFloats(startTime, startTime + 2000, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d["val"][500] != 500 || d["val"][1500] != 1500 || d["val"][501] != -1 {
+		t.Errorf("Data is %v, %v, %v", d["val"][500], d["val"][1500], d["val"][501])
+	}
+}
@@ -0,0 +1,73 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"os"
+)
+
+//
+// Tidy up historical chunk files: chunks written in an older
+// encoding are rewritten in the archive's current one, chunks with
+// no values left are deleted, and temp files left by interrupted
+// writes are removed.  Chunks still in memory are left alone; they're
+// written normally by Write().
+//
+// The archive is only locked while each chunk is compacted, so
+// Compact can run alongside appends and queries.  Corrupt chunks are
+// skipped, and the first error is returned once every other chunk
+// has been compacted.
+//
+func (a *Archive) Compact() error {
+	a.mu.Lock()
+	ts := a.chunkStart(a.StartTime)
+	end := a.EndTime
+	a.mu.Unlock()
+
+	var firstErr error
+	for ; ts <= end; ts += a.ChunkSize {
+		err := a.compactChunk(ts)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (a *Archive) compactChunk(ts int64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, c := range a.chunks {
+		if c.StartTime == ts {
+			return nil
+		}
+	}
+	if ts < a.chunkStart(a.StartTime) {
+		// expired since we started
+		return nil
+	}
+
+	for shard := 0; a.store == nil && (shard < a.Shards || shard == 0); shard++ {
+		os.Remove(a.chunkPath(ts, shard) + tmpSuffix)
+	}
+
+	c, err := a.readChunk(ts)
+	if errors.Is(err, os.ErrNotExist) {
+		// a gap
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if c.blank() {
+		a.removeChunk(ts)
+		return nil
+	}
+	if c.fileEncoding == a.Encoding {
+		return nil
+	}
+	return a.writeChunk(c)
+}
@@ -0,0 +1,57 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"testing"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func TestCompact(t *testing.T) {
+	os.RemoveAll("/tmp/archive_test")
+	os.Mkdir("/tmp/archive_test", os.ModePerm)
+
+	startTime := int64(1560632000)
+	a := NewArchive("/tmp/archive_test", 1, 100000, 100)
+	for i := 0; i < 500; i++ {
+		a.AppendFloats(map[string]float64{ "a": float64(i % 3) }, startTime + int64(i))
+	}
+	a.Write()
+
+	// a chunk with no values, and a temp file from a crashed write
+	WriteObject("/tmp/archive_test/1560632100", newChunk(1, 1560632100))
+	ioutil.WriteFile("/tmp/archive_test/1560632200.tmp", []byte("junk"), 0600)
+
+	a.Encoding = EncodingGorilla
+	err := a.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat("/tmp/archive_test/1560632100"); !os.IsNotExist(err) {
+		t.Errorf("Expected empty chunk to be removed")
+	}
+	if _, err := os.Stat("/tmp/archive_test/1560632200.tmp"); !os.IsNotExist(err) {
+		t.Errorf("Expected temp file to be removed")
+	}
+	for _, ts := range []string{ "1560632000", "1560632300" } {
+		c, err := readChunk(filepath.Join("/tmp/archive_test", ts), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.fileEncoding != EncodingGorilla {
+			t.Errorf("Chunk %s is encoded %d", ts, c.fileEncoding)
+		}
+	}
+
+	d, _, err := a.GetFloats(startTime, startTime + 500, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d["a"][0] != 0 || d["a"][150] != -1 || d["a"][301] != 1 || d["a"][499] != 1 {
+		t.Errorf("Data is %v", d)
+	}
+}
@@ -0,0 +1,80 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+//
+// Chunk files can be compressed as a whole.  The codec is recorded
+// in the file's footer (see persist.go), so files written with
+// different codecs, or before compression was added, can be mixed
+// freely in one archive.  Fixed-layout chunks are never compressed,
+// since they're read in place.
+//
+
+const (
+	CompressNone = iota
+	CompressGzip
+	CompressSnappy
+	CompressZstd
+)
+
+var (
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+)
+
+func initZstd() {
+	zstdEnc, _ = zstd.NewWriter(nil)
+	zstdDec, _ = zstd.NewReader(nil)
+}
+
+func compress(codec int, payload []byte) ([]byte, error) {
+	switch codec {
+	case CompressNone:
+		return payload, nil
+	case CompressGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, err := w.Write(payload)
+		if err == nil {
+			err = w.Close()
+		}
+		return buf.Bytes(), err
+	case CompressSnappy:
+		return snappy.Encode(nil, payload), nil
+	case CompressZstd:
+		zstdOnce.Do(initZstd)
+		return zstdEnc.EncodeAll(payload, nil), nil
+	}
+	return nil, fmt.Errorf("unknown compression codec %d", codec)
+}
+
+func decompress(codec int, buf []byte) ([]byte, error) {
+	switch codec {
+	case CompressNone:
+		return buf, nil
+	case CompressGzip:
+		r, err := gzip.NewReader(bytes.NewReader(buf))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	case CompressSnappy:
+		return snappy.Decode(nil, buf)
+	case CompressZstd:
+		zstdOnce.Do(initZstd)
+		return zstdDec.DecodeAll(buf, nil)
+	}
+	return nil, fmt.Errorf("unknown compression codec %d", codec)
+}
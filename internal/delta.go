@@ -0,0 +1,128 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+//
+// Delta encoding, for counters (byte totals, request counts) whose
+// values are whole numbers that only ever grow a little per tick.
+// Each column is a sequence of runs of consecutive valid ticks:
+//
+//	skip    uvarint (invalid ticks since the end of the last run)
+//	length  uvarint
+//	values  length x width(kind) values
+//
+// A whole-number value is stored as a varint of its delta from the
+// previous value of the same field, shifted left one bit.  Anything
+// else (fractions, NaN, huge values) is stored as a 1 bit followed by
+// the raw float64, so any series round-trips exactly; it just won't
+// shrink much.
+//
+
+// Largest magnitude at which every integer is exactly representable.
+const maxExactInt = 1 << 53
+
+func isWhole(v float64) bool {
+	return v == math.Trunc(v) && math.Abs(v) < maxExactInt
+}
+
+func encodeDeltaColumn(col *column, kind, ticks int) []byte {
+	w := width(kind)
+	var buf []byte
+	var tmp [binary.MaxVarintLen64]byte
+	prev := make([]float64, w)
+	var run []float64
+
+	prevEnd := 0
+	start, length := 0, 0
+	flush := func() {
+		if length == 0 {
+			return
+		}
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(start - prevEnd))]...)
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(length))]...)
+		for i, v := range run {
+			p := prev[i % w]
+			if isWhole(v) && isWhole(p) {
+				d := int64(v) - int64(p)
+				buf = append(buf, tmp[:binary.PutUvarint(tmp[:], zigzag(d) << 1)]...)
+			} else {
+				buf = append(buf, 1)
+				buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(v))
+			}
+			prev[i % w] = v
+		}
+		prevEnd = start + length
+		run = run[:0]
+	}
+
+	col.each(0, ticks, w, func(t int, f []float64) {
+		if length == 0 || t != start + length {
+			flush()
+			start, length = t, 0
+		}
+		run = append(run, f...)
+		length++
+	})
+	flush()
+	return buf
+}
+
+func decodeDeltaColumn(buf []byte, kind, ticks int) (column, error) {
+	w := width(kind)
+	col := newColumn()
+	prev := make([]float64, w)
+
+	pos, t := 0, 0
+	for pos < len(buf) {
+		skip, n := binary.Uvarint(buf[pos:])
+		if n <= 0 {
+			return col, fmt.Errorf("delta: bad run offset")
+		}
+		pos += n
+		length, n := binary.Uvarint(buf[pos:])
+		if n <= 0 {
+			return col, fmt.Errorf("delta: bad run length")
+		}
+		pos += n
+		if skip > uint64(ticks - t) || length > uint64(ticks - t) - skip {
+			return col, fmt.Errorf("delta: run past end of chunk")
+		}
+
+		t += int(skip)
+		for end := t + int(length); t < end; t++ {
+			for i := range prev {
+				h, n := binary.Uvarint(buf[pos:])
+				if n <= 0 {
+					return col, fmt.Errorf("delta: truncated value")
+				}
+				pos += n
+				if h & 1 == 0 {
+					prev[i] = float64(int64(prev[i]) + unzigzag(h >> 1))
+					continue
+				}
+				if pos + 8 > len(buf) {
+					return col, fmt.Errorf("delta: truncated value")
+				}
+				prev[i] = math.Float64frombits(binary.LittleEndian.Uint64(buf[pos:]))
+				pos += 8
+			}
+			col.set(t, w, prev)
+		}
+	}
+	return col, nil
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func unzigzag(u uint64) int64 {
+	return int64(u >> 1) ^ -int64(u & 1)
+}
@@ -0,0 +1,92 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"testing"
+	"math"
+	"os"
+)
+
+func TestDeltaColumn(t *testing.T) {
+	vals := []interface{} {
+		0.0, 1500.0, 3000.0, nil, 3001.0, -7.0, 2.5, 3.0, nil, nil,
+		math.MaxFloat64, 1e18, 1e18 + 4096, math.Inf(1), 12.0,
+	}
+
+	buf := encodeDeltaColumn(toColumn(vals), kindFloat, len(vals))
+	col, err := decodeDeltaColumn(buf, kindFloat, len(vals))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := fromColumn(col, kindFloat, len(vals))
+	for i := range vals {
+		if res[i] != vals[i] {
+			t.Errorf("Value %d is %v, expected %v", i, res[i], vals[i])
+		}
+	}
+
+	_, err = decodeDeltaColumn(buf[:len(buf) - 3], kindFloat, len(vals))
+	if err == nil {
+		t.Errorf("Expected error decoding truncated column")
+	}
+}
+
+func TestDeltaRollupColumn(t *testing.T) {
+	vals := []interface{} {
+		Rollup{Total: 600, Count: 60, Min: 5, Max: 15},
+		Rollup{Total: 1200, Count: 60, Min: 15, Max: 25},
+		nil,
+		Rollup{Total: 1.5, Count: 1, Min: 1.5, Max: 1.5},
+	}
+
+	buf := encodeDeltaColumn(toColumn(vals), rollupKind, len(vals))
+	col, err := decodeDeltaColumn(buf, rollupKind, len(vals))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := fromColumn(col, rollupKind, len(vals))
+	for i := range vals {
+		if res[i] != vals[i] {
+			t.Errorf("Value %d is %+v, expected %+v", i, res[i], vals[i])
+		}
+	}
+}
+
+func TestDeltaCompresses(t *testing.T) {
+	// a byte counter growing by up to 1000 a tick
+	vals := make([]interface{}, 2000)
+	total := 1e12
+	for i := range vals {
+		total += float64(i * 7 % 1000)
+		vals[i] = total
+	}
+
+	buf := encodeDeltaColumn(toColumn(vals), kindFloat, len(vals))
+	if len(buf) > 2000 * 3 {
+		t.Errorf("Column is %d bytes", len(buf))
+	}
+}
+
+func TestDeltaArchive(t *testing.T) {
+	os.RemoveAll("/tmp/archive_test")
+	os.Mkdir("/tmp/archive_test", os.ModePerm)
+
+	startTime := int64(1560632000)
+	a := NewArchive("/tmp/archive_test", 1, 100000, 1000)
+	a.Encoding = EncodingDelta
+	for i := 0; i < 1000; i++ {
+		a.AppendFloats(map[string]float64{ "bytes": float64(1000 * i), "load": 0.5 }, startTime + int64(i))
+	}
+	a.Write()
+	a.chunks = nil
+
+	d, _, err := a.GetFloats(startTime, startTime + 1000, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d["bytes"][999] != 999000 || d["load"][500] != 0.5 {
+		t.Errorf("Data is %v", d)
+	}
+}
@@ -0,0 +1,284 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+)
+
+//
+// Fixed-layout chunk files can be read straight out of a memory
+// mapping, so a range query only touches the pages it needs.
+// All integers are little-endian.
+//
+//	magic      "TSFX"
+//	version    uint8
+//	kind       uint8
+//	valueType  uint8
+//	reserved   uint8
+//	StartTime  int64
+//	EndTime    int64
+//	Resolution int64
+//	ticks      uint32
+//	numTags    uint32
+//	tags       numTags x (uint16 length, bytes)
+//	checksums  numTags x uint32 (CRC-32C of each column)
+//	columns    numTags x (validity bitmap, ticks x slot)
+//
+// A float slot is a float64, or a float32 for ValueFloat32 chunks.
+// A rollup slot is Total, Count (int64), Min, Max and (except in
+// older files) SumSq, First and Last.  Columns carry their own checksums so a query
+// only has to verify the columns it reads.
+//
+
+var fixedMagic = []byte("TSFX")
+
+const (
+	fixedVersion = 1
+	fixedHeaderSize = 40
+)
+
+func isFixed(buf []byte) bool {
+	return len(buf) >= len(fixedMagic) && bytes.Equal(buf[:len(fixedMagic)], fixedMagic)
+}
+
+func slotSize(kind, valueType int) int {
+	if isRollup(kind) {
+		return 8 * width(kind)
+	}
+	if valueType == ValueFloat32 {
+		return 4
+	}
+	return 8
+}
+
+func bitmapSize(ticks int) int {
+	return (ticks + 7) / 8
+}
+
+func encodeFixed(c *chunk) []byte {
+	kind := c.Kind
+	ticks := c.Ticks
+	slot := slotSize(kind, c.ValueType)
+	colSize := bitmapSize(ticks) + ticks * slot
+
+	size := fixedHeaderSize
+	for _, tag := range c.Tags {
+		size += 2 + len(tag)
+	}
+	size += 4 * len(c.Tags)
+	sumsStart := size - 4 * len(c.Tags)
+	colStart := size
+	size += colSize * len(c.Tags)
+
+	buf := make([]byte, size)
+	le := binary.LittleEndian
+	copy(buf, fixedMagic)
+	buf[4] = fixedVersion
+	buf[5] = byte(kind)
+	buf[6] = byte(c.ValueType)
+	le.PutUint64(buf[8:], uint64(c.StartTime))
+	le.PutUint64(buf[16:], uint64(c.EndTime))
+	le.PutUint64(buf[24:], uint64(c.Resolution))
+	le.PutUint32(buf[32:], uint32(ticks))
+	le.PutUint32(buf[36:], uint32(len(c.Tags)))
+
+	off := fixedHeaderSize
+	for _, tag := range c.Tags {
+		le.PutUint16(buf[off:], uint16(len(tag)))
+		off += 2
+		off += copy(buf[off:], tag)
+	}
+
+	w := width(kind)
+	for tag := range c.Values {
+		col := buf[colStart + tag * colSize:]
+		c.Values[tag].each(0, ticks, w, func(t int, f []float64) {
+			col[t / 8] |= 1 << uint(t % 8)
+			s := col[bitmapSize(ticks) + t * slot:]
+			if isRollup(kind) {
+				for j, v := range f {
+					if j == 1 {
+						le.PutUint64(s[8:], uint64(int64(v)))
+					} else {
+						le.PutUint64(s[8 * j:], math.Float64bits(v))
+					}
+				}
+			} else if slot == 4 {
+				le.PutUint32(s, math.Float32bits(float32(f[0])))
+			} else {
+				le.PutUint64(s, math.Float64bits(f[0]))
+			}
+		})
+	}
+
+	for tag := range c.Tags {
+		col := buf[colStart + tag * colSize : colStart + (tag + 1) * colSize]
+		le.PutUint32(buf[sumsStart + 4 * tag:], crc32.Checksum(col, crcTable))
+	}
+	return buf
+}
+
+//
+// A read-only view of a fixed-layout chunk.  buf is usually a
+// memory mapping, and is only valid until the mapping is released.
+//
+type mappedChunk struct {
+	StartTime  int64
+	EndTime    int64
+	Resolution int64
+	Tags       []string
+	kind       int
+	valueType  int
+	ticks      int
+	sums       []uint32
+	cols       [][]byte
+	verified   []bool
+}
+
+func parseFixed(buf []byte) (*mappedChunk, error) {
+	if len(buf) < fixedHeaderSize || !isFixed(buf) {
+		return nil, fmt.Errorf("short fixed chunk header")
+	}
+	if buf[4] != fixedVersion {
+		return nil, fmt.Errorf("unknown fixed chunk version %d", buf[4])
+	}
+
+	le := binary.LittleEndian
+	m := &mappedChunk{
+		StartTime: int64(le.Uint64(buf[8:])),
+		EndTime: int64(le.Uint64(buf[16:])),
+		Resolution: int64(le.Uint64(buf[24:])),
+		kind: int(buf[5]),
+		valueType: int(buf[6]),
+		ticks: int(le.Uint32(buf[32:])),
+	}
+	numTags := int(le.Uint32(buf[36:]))
+
+	off := fixedHeaderSize
+	m.Tags = make([]string, numTags)
+	for i := range m.Tags {
+		if off + 2 > len(buf) {
+			return nil, fmt.Errorf("truncated tag table")
+		}
+		l := int(le.Uint16(buf[off:]))
+		off += 2
+		if off + l > len(buf) {
+			return nil, fmt.Errorf("truncated tag table")
+		}
+		m.Tags[i] = string(buf[off : off + l])
+		off += l
+	}
+
+	if off + 4 * numTags > len(buf) {
+		return nil, fmt.Errorf("truncated checksums")
+	}
+	m.sums = make([]uint32, numTags)
+	for i := range m.sums {
+		m.sums[i] = le.Uint32(buf[off:])
+		off += 4
+	}
+
+	colSize := bitmapSize(m.ticks) + m.ticks * slotSize(m.kind, m.valueType)
+	// the file footer (if any) follows the columns
+	if off + colSize * numTags > len(buf) {
+		return nil, fmt.Errorf("truncated columns")
+	}
+	m.cols = make([][]byte, numTags)
+	for i := range m.cols {
+		m.cols[i] = buf[off : off + colSize]
+		off += colSize
+	}
+	m.verified = make([]bool, numTags)
+	return m, nil
+}
+
+func (m *mappedChunk) column(tag int) ([]byte, error) {
+	col := m.cols[tag]
+	if !m.verified[tag] {
+		if crc32.Checksum(col, crcTable) != m.sums[tag] {
+			return nil, fmt.Errorf("checksum mismatch in column %q: %w",
+				m.Tags[tag], ErrCorruptChunk)
+		}
+		m.verified[tag] = true
+	}
+	return col, nil
+}
+
+func (m *mappedChunk) scan(startTime, endTime int64, keys *KeySet, fn func(tag string, i int, f []float64)) error {
+	l := int((endTime - startTime) / m.Resolution)
+	first := int((startTime - m.StartTime) / m.Resolution)
+	le := binary.LittleEndian
+	slot := slotSize(m.kind, m.valueType)
+	var f [maxWidth]float64
+	w := width(m.kind)
+
+	for tag, name := range m.Tags {
+		if !keys.has(name) {
+			continue
+		}
+		col, err := m.column(tag)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < l; i++ {
+			idx := first + i
+			if idx < 0 || idx >= m.ticks || col[idx / 8] & (1 << uint(idx % 8)) == 0 {
+				continue
+			}
+			s := col[bitmapSize(m.ticks) + idx * slot:]
+			if isRollup(m.kind) {
+				for j := 0; j < w; j++ {
+					if j == 1 {
+						f[1] = float64(int64(le.Uint64(s[8:])))
+					} else {
+						f[j] = math.Float64frombits(le.Uint64(s[8 * j:]))
+					}
+				}
+				fn(name, i, f[:w])
+			} else if slot == 4 {
+				f[0] = float64(math.Float32frombits(le.Uint32(s)))
+				fn(name, i, f[:1])
+			} else {
+				f[0] = math.Float64frombits(le.Uint64(s))
+				fn(name, i, f[:1])
+			}
+		}
+	}
+	return nil
+}
+
+//
+// Fixed-layout chunks never hold sketches.
+//
+func (m *mappedChunk) scanSketches(kind int, startTime, endTime int64, keys *KeySet, fn func(tag string, i int, s []byte)) error {
+	return nil
+}
+
+//
+// Copy the whole chunk into memory, e.g. so it can be appended to.
+//
+func (m *mappedChunk) toChunk() (*chunk, error) {
+	c := newChunk(m.Resolution, m.StartTime)
+	c.Kind = m.kind
+	c.ValueType = m.valueType
+	c.dirty = false
+	for _, name := range m.Tags {
+		c.tagIndex(name)
+	}
+	end := m.StartTime + int64(m.ticks) * m.Resolution
+	err := m.scan(m.StartTime, end, nil, func(tag string, i int, f []float64) {
+		c.setValue(i, tag, m.kind, f)
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.EndTime = m.EndTime
+	c.Ticks = m.ticks
+	return c, nil
+}
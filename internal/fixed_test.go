@@ -0,0 +1,174 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"os"
+)
+
+func readAll(r chunkReader, startTime, endTime, resolution int64) (map[string][]interface{}, error) {
+	l := (endTime - startTime) / resolution
+	data := make(map[string][]interface{})
+	err := r.scan(startTime, endTime, nil, func(tag string, i int, f []float64) {
+		if data[tag] == nil {
+			data[tag] = make([]interface{}, l)
+		}
+		kind := kindFloat
+		if len(f) > 1 {
+			kind = rollupKind
+		}
+		data[tag][i] = fromFloats(kind, f)
+	})
+	return data, err
+}
+
+func TestFixedRoundTrip(t *testing.T) {
+	startTime := int64(1560632000)
+	c := newChunk(5, startTime)
+	c.append(map[string]interface{} { "a": 1.5, "b": 2.0 }, startTime)
+	c.append(map[string]interface{} { "a": 3.5 }, startTime + 5)
+	c.append(map[string]interface{} { "b": -1.0 }, startTime + 100)
+
+	m, err := parseFixed(encodeFixed(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.EndTime != startTime + 100 || len(m.Tags) != 2 {
+		t.Errorf("Header is %+v", m)
+	}
+
+	d, err := readAll(m, startTime + 5, startTime + 105, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d["a"]) != 20 || d["a"][0] != 3.5 || d["a"][19] != nil {
+		t.Errorf("a is %v", d["a"])
+	}
+	if d["b"][19] != -1.0 {
+		t.Errorf("b is %v", d["b"])
+	}
+
+	c2, err := m.toChunk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _ = c2.getData(startTime, startTime + 10)
+	if d["a"][0] != 1.5 || d["b"][0] != 2.0 || d["a"][1] != 3.5 {
+		t.Errorf("Data is %v", d)
+	}
+
+	// appending a new tag to a reloaded chunk
+	c2.append(map[string]interface{} { "c": 7.0 }, startTime + 105)
+	d, _ = c2.getData(startTime + 105, startTime + 110)
+	if d["c"][0] != 7.0 {
+		t.Errorf("Data is %v", d)
+	}
+}
+
+func TestFixedRollups(t *testing.T) {
+	c := newChunk(60, 1560632400)
+	r := Rollup{Total: 10, Count: 4, Min: 1, Max: 4}
+	c.append(map[string]interface{} { "a": r }, 1560632400)
+
+	m, err := parseFixed(encodeFixed(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := readAll(m, 1560632400, 1560632460, 60)
+	if err != nil || d["a"][0] != r {
+		t.Errorf("Data is %v, %v", d, err)
+	}
+}
+
+func TestLegacyRollups(t *testing.T) {
+	// written before Rollups had SumSq
+	c := newChunk(60, 1560632400)
+	c.advance(1560632400, defaultCarryForward)
+	c.setValue(0, "a", kindRollup, []float64{ 10, 4, 1, 4 })
+	c.setValue(0, "b", kindRollup, []float64{ 8, 4, 2, 2 })
+
+	m, err := parseFixed(encodeFixed(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = m.toChunk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := Rollup{Total: 3, Count: 2, Min: 1, Max: 2, SumSq: 5, First: 1, Last: 2, Weighted: 90, Duration: 60}
+	c.append(map[string]interface{} { "a": r }, 1560632460)
+	if c.Kind != rollupKind {
+		t.Fatalf("Chunk kind is %d after appending", c.Kind)
+	}
+
+	d, _ := c.getData(1560632400, 1560632520)
+	a0 := d["a"][0].(Rollup)
+	if a0.Total != 10 || !math.IsNaN(a0.SumSq) || !math.IsNaN(a0.Last) || !math.IsNaN(a0.Duration) {
+		t.Errorf("Legacy rollup is %+v", a0)
+	}
+	if v := a0.TimeWeightedAverage(); v != 2.5 {
+		t.Errorf("Legacy rollup's time-weighted average is %f", v)
+	}
+	// all datapoints were 2
+	if b0 := d["b"][0].(Rollup); b0.SumSq != 16 || b0.First != 2 || b0.Last != 2 {
+		t.Errorf("Legacy rollup is %+v", b0)
+	}
+	if d["a"][1] != r {
+		t.Errorf("New rollup is %+v", d["a"][1])
+	}
+}
+
+func TestFixedCorruptColumn(t *testing.T) {
+	c := newChunk(1, 1560632000)
+	for i := 0; i < 100; i++ {
+		c.append(map[string]interface{} { "a": float64(i), "b": 1.0 }, 1560632000 + int64(i))
+	}
+	buf := encodeFixed(c)
+	buf[len(buf) - 1] ^= 1
+
+	m, err := parseFixed(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.column(0); err != nil {
+		t.Errorf("Column a should be intact: %v", err)
+	}
+	if _, err := m.column(1); !errors.Is(err, ErrCorruptChunk) {
+		t.Errorf("Expected ErrCorruptChunk: %v", err)
+	}
+}
+
+func TestFixedArchive(t *testing.T) {
+	os.RemoveAll("/tmp/archive_test")
+	os.Mkdir("/tmp/archive_test", os.ModePerm)
+	os.Mkdir("/tmp/archive_test/a", os.ModePerm)
+
+	a := NewArchive("/tmp/archive_test/a", 1, 3600, 600)
+	a.Encoding = EncodingFixed
+	startTime := int64(1560632400)
+	for i := 0; i < 1500; i++ {
+		a.Append(map[string]interface{} { "val": float64(i) }, startTime + int64(i))
+	}
+	a.Write()
+
+	a, err := OpenArchive("/tmp/archive_test/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Append(map[string]interface{} { "val": 1500.0, "new": 1.0 }, startTime + 1500)
+
+	d, _, err := a.GetData(startTime + 500, startTime + 1501)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d["val"][0] != 500.0 || d["val"][600] != 1100.0 || d["val"][1000] != 1500.0 {
+		t.Errorf("Data is %v, %v, %v", d["val"][0], d["val"][600], d["val"][1000])
+	}
+	if d["new"][1000] != 1.0 {
+		t.Errorf("New key is %v", d["new"][1000])
+	}
+}
@@ -0,0 +1,18 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"os"
+)
+
+//
+// No flock here; nothing is locked.
+//
+func LockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,31 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+//
+// Take an exclusive advisory lock on f, without waiting.  Fails with
+// ErrLocked if another open file holds it.  The lock is released
+// when f is closed.
+//
+func LockFile(f *os.File) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX | syscall.LOCK_NB)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return ErrLocked
+		}
+		return err
+	}
+}
@@ -0,0 +1,232 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+//
+// Gorilla-style XOR float compression, as described in
+// "Gorilla: A Fast, Scalable, In-Memory Time Series Database"
+// (Pelkonen et al, 2015).  Chunks are already normalized to a
+// fixed resolution, so only the values need encoding; timestamps
+// are implied by position.
+//
+// Each tag is packed into its own column.  Every tick writes a
+// single presence bit, followed by the XOR-encoded value if the
+// tick has data.  Rollups are written as four interleaved XOR
+// streams (Total, Count, Min, Max).
+//
+
+type bitWriter struct {
+	buf  []byte
+	free uint8 // unused bits in the last byte
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.free == 0 {
+		w.buf = append(w.buf, 0)
+		w.free = 8
+	}
+	w.free--
+	if bit {
+		w.buf[len(w.buf) - 1] |= 1 << w.free
+	}
+}
+
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for n > 0 {
+		n--
+		w.writeBit((v >> uint(n)) & 1 == 1)
+	}
+}
+
+type bitReader struct {
+	buf []byte
+	pos int // bit offset
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos >= len(r.buf) * 8 {
+		return false, fmt.Errorf("gorilla: unexpected end of column")
+	}
+	b := r.buf[r.pos / 8] & (1 << uint(7 - r.pos % 8))
+	r.pos++
+	return b != 0, nil
+}
+
+func (r *bitReader) readBits(n int) (uint64, error) {
+	var v uint64
+	for i := 0; i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v <<= 1
+		if bit {
+			v |= 1
+		}
+	}
+	return v, nil
+}
+
+type xorEncoder struct {
+	w        *bitWriter
+	prev     uint64
+	leading  int
+	trailing int
+	started  bool
+}
+
+func (e *xorEncoder) encode(f float64) {
+	v := math.Float64bits(f)
+	if !e.started {
+		e.w.writeBits(v, 64)
+		e.prev = v
+		e.leading = -1
+		e.started = true
+		return
+	}
+
+	xor := v ^ e.prev
+	e.prev = v
+	if xor == 0 {
+		e.w.writeBit(false)
+		return
+	}
+	e.w.writeBit(true)
+
+	leading := bits.LeadingZeros64(xor)
+	trailing := bits.TrailingZeros64(xor)
+	if leading > 31 {
+		leading = 31
+	}
+
+	if e.leading >= 0 && leading >= e.leading && trailing >= e.trailing {
+		// reuse the previous window
+		e.w.writeBit(false)
+		e.w.writeBits(xor >> uint(e.trailing), 64 - e.leading - e.trailing)
+		return
+	}
+
+	sigBits := 64 - leading - trailing
+	e.w.writeBit(true)
+	e.w.writeBits(uint64(leading), 5)
+	// 64 significant bits doesn't fit in 6 bits, but 0 can't
+	// happen, so use it to stand in for 64.
+	e.w.writeBits(uint64(sigBits & 63), 6)
+	e.w.writeBits(xor >> uint(trailing), sigBits)
+	e.leading = leading
+	e.trailing = trailing
+}
+
+type xorDecoder struct {
+	r        *bitReader
+	prev     uint64
+	leading  int
+	trailing int
+	started  bool
+}
+
+func (d *xorDecoder) decode() (float64, error) {
+	if !d.started {
+		v, err := d.r.readBits(64)
+		if err != nil {
+			return 0, err
+		}
+		d.prev = v
+		d.started = true
+		return math.Float64frombits(v), nil
+	}
+
+	changed, err := d.r.readBit()
+	if err != nil {
+		return 0, err
+	}
+	if !changed {
+		return math.Float64frombits(d.prev), nil
+	}
+
+	newWindow, err := d.r.readBit()
+	if err != nil {
+		return 0, err
+	}
+	if newWindow {
+		leading, err := d.r.readBits(5)
+		if err != nil {
+			return 0, err
+		}
+		sigBits, err := d.r.readBits(6)
+		if err != nil {
+			return 0, err
+		}
+		if sigBits == 0 {
+			sigBits = 64
+		}
+		d.leading = int(leading)
+		d.trailing = 64 - int(leading) - int(sigBits)
+	}
+
+	xor, err := d.r.readBits(64 - d.leading - d.trailing)
+	if err != nil {
+		return 0, err
+	}
+	d.prev ^= xor << uint(d.trailing)
+	return math.Float64frombits(d.prev), nil
+}
+
+func encodeGorillaColumn(col *column, kind int, ticks int) []byte {
+	w := &bitWriter{}
+	encs := make([]xorEncoder, width(kind))
+	for i := range encs {
+		encs[i].w = w
+	}
+
+	next := 0
+	col.each(0, ticks, len(encs), func(t int, f []float64) {
+		for ; next < t; next++ {
+			w.writeBit(false)
+		}
+		w.writeBit(true)
+		for i, v := range f {
+			encs[i].encode(v)
+		}
+		next = t + 1
+	})
+	for ; next < ticks; next++ {
+		w.writeBit(false)
+	}
+	return w.buf
+}
+
+func decodeGorillaColumn(buf []byte, kind int, ticks int) (column, error) {
+	r := &bitReader{buf: buf}
+	decs := make([]xorDecoder, width(kind))
+	for i := range decs {
+		decs[i].r = r
+	}
+
+	col := newColumn()
+	f := make([]float64, len(decs))
+	for t := 0; t < ticks; t++ {
+		present, err := r.readBit()
+		if err != nil {
+			return col, err
+		}
+		if !present {
+			continue
+		}
+		for i := range decs {
+			f[i], err = decs[i].decode()
+			if err != nil {
+				return col, err
+			}
+		}
+		col.set(t, len(decs), f)
+	}
+	return col, nil
+}
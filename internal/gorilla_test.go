@@ -0,0 +1,120 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"testing"
+	"math"
+	"os"
+)
+
+func toColumn(vals []interface{}) *column {
+	col := &column{}
+	for i, v := range vals {
+		if v != nil {
+			col.set(i, width(valueKind(v)), toFloats(v))
+		}
+	}
+	return col
+}
+
+func fromColumn(col column, kind int, n int) []interface{} {
+	vals := make([]interface{}, n)
+	for i := range vals {
+		if col.has(i) {
+			vals[i] = fromFloats(kind, col.get(i, width(kind)))
+		}
+	}
+	return vals
+}
+
+func TestGorillaFloatColumn(t *testing.T) {
+	vals := []interface{} {
+		100.0, 100.0, nil, 101.5, -3.25, nil, nil, 0.0,
+		math.MaxFloat64, math.SmallestNonzeroFloat64, 1e-300, 42.0,
+	}
+
+	buf := encodeGorillaColumn(toColumn(vals), kindFloat, len(vals))
+	col, err := decodeGorillaColumn(buf, kindFloat, len(vals))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := fromColumn(col, kindFloat, len(vals))
+	for i := range vals {
+		if res[i] != vals[i] {
+			t.Errorf("Value %d is %v, expected %v", i, res[i], vals[i])
+		}
+	}
+}
+
+func TestGorillaRollupColumn(t *testing.T) {
+	vals := []interface{} {
+		Rollup{Total: 100, Count: 10, Min: 1, Max: 20},
+		nil,
+		Rollup{Total: 100, Count: 10, Min: 1, Max: 20},
+		Rollup{Total: 1234.5, Count: 60, Min: -2, Max: 99.75},
+	}
+
+	buf := encodeGorillaColumn(toColumn(vals), rollupKind, len(vals))
+	col, err := decodeGorillaColumn(buf, rollupKind, len(vals))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := fromColumn(col, rollupKind, len(vals))
+	for i := range vals {
+		if res[i] != vals[i] {
+			t.Errorf("Value %d is %+v, expected %+v", i, res[i], vals[i])
+		}
+	}
+}
+
+func TestGorillaCompresses(t *testing.T) {
+	vals := make([]interface{}, 2000)
+	for i := range vals {
+		vals[i] = float64(i % 10)
+	}
+
+	buf := encodeGorillaColumn(toColumn(vals), kindFloat, len(vals))
+	if len(buf) > 2000 * 8 / 2 {
+		t.Errorf("Column is %d bytes", len(buf))
+	}
+
+	_, err := decodeGorillaColumn(buf[:len(buf) / 2], kindFloat, len(vals))
+	if err == nil {
+		t.Errorf("Expected error decoding truncated column")
+	}
+}
+
+func TestGorillaArchive(t *testing.T) {
+	os.RemoveAll("/tmp/archive_test")
+	os.Mkdir("/tmp/archive_test", os.ModePerm)
+	os.Mkdir("/tmp/archive_test/a", os.ModePerm)
+
+	a := NewArchive("/tmp/archive_test/a", 1, 3600, 600)
+	a.Encoding = EncodingGorilla
+	startTime := int64(1560632000)
+	for i := 0; i < 1000; i++ {
+		if i % 100 == 50 {
+			continue
+		}
+		a.Append(map[string]interface{} { "val": float64(i) / 4 }, startTime + int64(i))
+	}
+	a.Write()
+
+	a, err := OpenArchive("/tmp/archive_test/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, _, _ := a.GetData(startTime, startTime + 1000)
+	if d["val"][0] != 0.0 {
+		t.Errorf("Expected 0: %v", d["val"][0])
+	}
+	if d["val"][51] != 51.0 / 4 {
+		t.Errorf("Expected 12.75: %v", d["val"][51])
+	}
+	if d["val"][999] != 999.0 / 4 {
+		t.Errorf("Expected 249.75: %v", d["val"][999])
+	}
+}
@@ -0,0 +1,194 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+//
+// HyperLogLogs, for archives that keep distinct counts of the values
+// (e.g. client IDs) appended in each interval.  Each value's float64
+// bits are hashed, and the register picked by the top hllPrecision
+// bits of the hash keeps the longest run of leading zeros seen in
+// the rest.  Estimates are within about 2% (1.04 / sqrt(registers)),
+// and two HLLs merge by taking the larger of each register.
+//
+// Most intervals only see a few distinct values, so an HLL is
+// stored as whichever is smaller of:
+//
+//	sparse  0, uvarint count, count x (uvarint index delta, register)
+//	dense   1, one byte per register
+//
+
+const (
+	hllPrecision = 11
+	hllRegisters = 1 << hllPrecision
+)
+
+type hll struct {
+	regs [hllRegisters]uint8
+}
+
+func hash64(v float64) uint64 {
+	// splitmix64's finalizer
+	x := math.Float64bits(v)
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (h *hll) add(v float64) {
+	x := hash64(v)
+	i := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x << hllPrecision | 1 << (hllPrecision - 1)) + 1)
+	if rank > h.regs[i] {
+		h.regs[i] = rank
+	}
+}
+
+func (h *hll) merge(o *hll) {
+	for i, r := range o.regs {
+		if r > h.regs[i] {
+			h.regs[i] = r
+		}
+	}
+}
+
+func (h *hll) estimate() float64 {
+	m := float64(hllRegisters)
+	sum := 0.0
+	zeros := 0
+	for _, r := range h.regs {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079 / m) * m * m / sum
+	if e <= 2.5 * m && zeros > 0 {
+		// linear counting is better for small cardinalities
+		e = m * math.Log(m / float64(zeros))
+	}
+	return e
+}
+
+func (h *hll) encode() []byte {
+	n := 0
+	for _, r := range h.regs {
+		if r != 0 {
+			n++
+		}
+	}
+	if n * 3 >= hllRegisters {
+		return append([]byte{ 1 }, h.regs[:]...)
+	}
+	buf := binary.AppendUvarint([]byte{ 0 }, uint64(n))
+	prev := 0
+	for i, r := range h.regs {
+		if r != 0 {
+			buf = binary.AppendUvarint(buf, uint64(i - prev))
+			buf = append(buf, r)
+			prev = i
+		}
+	}
+	return buf
+}
+
+func decodeHLL(buf []byte) (*hll, error) {
+	h := new(hll)
+	if len(buf) == 0 {
+		return nil, fmt.Errorf("hll: empty")
+	}
+	if buf[0] == 1 {
+		if len(buf) != 1 + hllRegisters {
+			return nil, fmt.Errorf("hll: %d bytes of registers", len(buf) - 1)
+		}
+		copy(h.regs[:], buf[1:])
+		return h, nil
+	}
+
+	n, pos := binary.Uvarint(buf[1:])
+	if pos <= 0 || n > hllRegisters {
+		return nil, fmt.Errorf("hll: bad register count")
+	}
+	pos++
+	i := 0
+	for j := uint64(0); j < n; j++ {
+		d, l := binary.Uvarint(buf[pos:])
+		if l <= 0 || pos + l >= len(buf) {
+			return nil, fmt.Errorf("hll: truncated")
+		}
+		pos += l
+		i += int(d)
+		if i >= hllRegisters {
+			return nil, fmt.Errorf("hll: register %d out of range", i)
+		}
+		h.regs[i] = buf[pos]
+		pos++
+	}
+	return h, nil
+}
+
+//
+// Summarize [startTime, endTime) into an encoded HLL per key.  Plain
+// values are added; HLLs, if the archive keeps them, are merged.
+//
+func (a *Archive) uniquesRange(startTime, endTime int64) (map[string][]byte, error) {
+	res := make(map[string]*hll)
+	get := func(tag string) *hll {
+		h := res[tag]
+		if h == nil {
+			h = new(hll)
+			res[tag] = h
+		}
+		return h
+	}
+
+	var err error
+	if !a.Uniques {
+		err = a.scan(startTime, endTime, nil, func(tag string, i int64, f []float64) {
+			if len(f) == 1 {
+				get(tag).add(f[0])
+			}
+		})
+		return encodeSketches(res, (*hll).encode), err
+	}
+	var firstErr error
+	err = a.scanSketches(sketchUniques, startTime, endTime, nil, func(tag string, i int64, buf []byte) {
+		h, err := decodeHLL(buf)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %v: %w", a.Dir, err, ErrCorruptChunk)
+			}
+			return
+		}
+		get(tag).merge(h)
+	})
+	if err == nil {
+		err = firstErr
+	}
+	return encodeSketches(res, (*hll).encode), err
+}
+
+//
+// Returns the approximate number of distinct values in every tick in
+// [startTime, endTime) that has an HLL, for all keys or only those
+// listed.  Ticks without one are 0.
+//
+func (a *Archive) GetUniqueCounts(startTime, endTime int64, keys ...string) (map[string][]float64, []int64, error) {
+	return a.getSketchValues(sketchUniques, startTime, endTime, keys, func(buf []byte) (float64, error) {
+		h, err := decodeHLL(buf)
+		if err != nil {
+			return 0, err
+		}
+		return math.Round(h.estimate()), nil
+	})
+}
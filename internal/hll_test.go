@@ -0,0 +1,48 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"math"
+	"testing"
+)
+
+func TestHLL(t *testing.T) {
+	a, b := new(hll), new(hll)
+	for i := 0; i < 10000; i++ {
+		a.add(float64(i))
+		a.add(float64(i))
+		b.add(float64(i + 5000))
+	}
+
+	for _, want := range []float64{ 0, 1, 10, 100 } {
+		h := new(hll)
+		for i := 0; i < int(want); i++ {
+			h.add(float64(i))
+		}
+		h, err := decodeHLL(h.encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := math.Round(h.estimate()); math.Abs(got - want) > want * 0.03 {
+			t.Errorf("Estimate of %f distinct values is %f", want, got)
+		}
+	}
+
+	h, err := decodeHLL(a.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := h.estimate(); math.Abs(got - 10000) > 500 {
+		t.Errorf("Estimate of 10000 distinct values is %f", got)
+	}
+	h.merge(b)
+	if got := h.estimate(); math.Abs(got - 15000) > 750 {
+		t.Errorf("Estimate of merged HLLs is %f", got)
+	}
+
+	if _, err := decodeHLL([]byte{ 0, 5, 1 }); err == nil {
+		t.Errorf("Truncated HLL decoded")
+	}
+}
@@ -0,0 +1,26 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"io/ioutil"
+)
+
+//
+// No mmap here; just read the whole file.
+//
+func mmapFile(filePath string) ([]byte, func(), error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("%s: empty file: %w", filePath, ErrCorruptChunk)
+	}
+	return data, func() {}, nil
+}
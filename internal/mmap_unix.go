@@ -0,0 +1,39 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+//
+// Map a file read-only.  The returned function unmaps it.
+//
+func mmapFile(filePath string) ([]byte, func(), error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if fi.Size() == 0 {
+		return nil, nil, fmt.Errorf("%s: empty file: %w", filePath, ErrCorruptChunk)
+	}
+
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(fi.Size()),
+		syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() { syscall.Munmap(data) }, nil
+}
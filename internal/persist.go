@@ -0,0 +1,287 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"github.com/ugorji/go/codec"
+)
+
+//
+// All files are written atomically: the object is encoded to a
+// temp file, the live file is moved aside to a ".prev" backup,
+// and the temp file is renamed into place.  A crash at any point
+// leaves either the new or the previous version readable, and
+// ReadObject falls back to the backup if the live file is missing
+// or can't be decoded.
+//
+// Every file ends with a footer holding a CRC-32C of the encoded
+// object and a magic number.  Files written before checksums were
+// added have no footer, and are read without verification.
+// Compressed files use a different magic number, ending in the
+// codec; the checksum covers the compressed bytes.
+//
+
+const (
+	tmpSuffix = ".tmp"
+	prevSuffix = ".prev"
+	footerSize = 8
+)
+
+var footerMagic = []byte("TCRC")
+var compressedMagic = []byte("TCZ")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+//
+// Returned (wrapped) when a file fails its checksum or can't be decoded.
+//
+var ErrCorruptChunk = errors.New("corrupt chunk")
+
+//
+// Returned by LockFile when another open file holds the lock.
+//
+var ErrLocked = errors.New("already locked")
+
+var mph = codec.MsgpackHandle{}
+
+//
+// A Codec serializes the objects stored in chunk files.  Name is
+// recorded alongside the data, so the same codec can be found
+// again when the files are reopened.
+//
+type Codec interface {
+	Name() string
+	Encode(w io.Writer, v interface{}) error
+	Decode(r io.Reader, v interface{}) error
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) Encode(w io.Writer, v interface{}) error {
+	return codec.NewEncoder(w, &mph).Encode(v)
+}
+
+func (msgpackCodec) Decode(r io.Reader, v interface{}) error {
+	return codec.NewDecoder(r, &mph).Decode(v)
+}
+
+//
+// The default codec, used for metadata files and for chunk files
+// unless an archive is given another.
+//
+var Msgpack Codec = msgpackCodec{}
+
+func WriteObject(filePath string, obj interface{}) error {
+	return writeObject(filePath, obj, CompressNone, nil)
+}
+
+func writeObject(filePath string, obj interface{}, compression int, c Codec) error {
+	buf, err := encodeObject(obj, c)
+	if err != nil {
+		return err
+	}
+	return writeFile(filePath, buf, compression)
+}
+
+func encodeObject(obj interface{}, c Codec) ([]byte, error) {
+	var buf []byte
+	var err error
+	if c == nil || c == Msgpack {
+		err = codec.NewEncoderBytes(&buf, &mph).Encode(obj)
+	} else {
+		var b bytes.Buffer
+		err = c.Encode(&b, obj)
+		buf = b.Bytes()
+	}
+	return buf, err
+}
+
+func ReadObject(filePath string, v interface{}) error {
+	err := decodeFile(filePath, v)
+	if err != nil {
+		perr := decodeFile(filePath + prevSuffix, v)
+		if perr == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+//
+// Atomically write an already-encoded payload, with a checksum footer.
+//
+func WriteFile(filePath string, payload []byte) error {
+	return writeFile(filePath, payload, CompressNone)
+}
+
+func writeFile(filePath string, payload []byte, compression int) error {
+	data, err := frame(payload, compression)
+	if err != nil {
+		return err
+	}
+	return writeFramed(filePath, data)
+}
+
+//
+// A file's contents: the payload, compressed, and its footer.
+//
+func frame(payload []byte, compression int) ([]byte, error) {
+	var footer [footerSize]byte
+	if compression == CompressNone {
+		copy(footer[4:], footerMagic)
+	} else {
+		var err error
+		payload, err = compress(compression, payload)
+		if err != nil {
+			return nil, err
+		}
+		copy(footer[4:], compressedMagic)
+		footer[7] = byte(compression)
+	}
+	binary.BigEndian.PutUint32(footer[:4], crc32.Checksum(payload, crcTable))
+	data := make([]byte, len(payload) + footerSize)
+	copy(data, payload)
+	copy(data[len(payload):], footer[:])
+	return data, nil
+}
+
+//
+// Atomically write data, already framed, to filePath.
+//
+func writeFramed(filePath string, data []byte) error {
+	tmp := filePath + tmpSuffix
+	file, err := os.Create(tmp)
+	if err == nil {
+		_, err = file.Write(data)
+		cerr := file.Close()
+		if err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(filePath, filePath + prevSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filePath)
+}
+
+//
+// Read the payload of a file written by WriteFile, falling back
+// to the previous version if the live file is missing or corrupt.
+//
+func ReadFile(filePath string) ([]byte, error) {
+	buf, err := readVerified(filePath)
+	if err != nil {
+		pbuf, perr := readVerified(filePath + prevSuffix)
+		if perr == nil {
+			return pbuf, nil
+		}
+	}
+	return buf, err
+}
+
+//
+// Remove a file written by WriteObject, along with its backup.
+//
+func RemoveObject(filePath string) error {
+	os.Remove(filePath + tmpSuffix)
+	os.Remove(filePath + prevSuffix)
+	err := os.Remove(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func decodeFile(filePath string, v interface{}) error {
+	buf, err := readVerified(filePath)
+	if err != nil {
+		return err
+	}
+	return decodeBytes(filePath, buf, v, nil)
+}
+
+func decodeBytes(filePath string, buf []byte, v interface{}, c Codec) error {
+	var err error
+	if c == nil || c == Msgpack {
+		err = codec.NewDecoderBytes(buf, &mph).Decode(v)
+	} else {
+		err = c.Decode(bytes.NewReader(buf), v)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v: %w", filePath, err, ErrCorruptChunk)
+	}
+	return nil
+}
+
+func readVerified(filePath string) ([]byte, error) {
+	buf, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return verifyFooter(filePath, buf)
+}
+
+//
+// Check and strip the checksum footer, if there is one, and
+// decompress the payload.
+//
+func verifyFooter(filePath string, buf []byte) ([]byte, error) {
+	l := len(buf)
+	if l < footerSize {
+		return buf, nil
+	}
+	compression := CompressNone
+	if bytes.Equal(buf[l - 4 : l - 1], compressedMagic) {
+		compression = int(buf[l - 1])
+	} else if !bytes.Equal(buf[l - 4:], footerMagic) {
+		return buf, nil
+	}
+
+	sum := binary.BigEndian.Uint32(buf[l - footerSize:])
+	buf = buf[:l - footerSize]
+	if crc32.Checksum(buf, crcTable) != sum {
+		return nil, fmt.Errorf("%s: checksum mismatch: %w", filePath, ErrCorruptChunk)
+	}
+	buf, err := decompress(compression, buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v: %w", filePath, err, ErrCorruptChunk)
+	}
+	return buf, nil
+}
+
+//
+// fsync a file or directory.  Files that have since been removed
+// (e.g. by retention) are ignored.
+//
+func SyncFile(filePath string) error {
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	file.Close()
+	return err
+}
@@ -0,0 +1,165 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"testing"
+	"errors"
+	"io/ioutil"
+	"os"
+)
+
+func TestWriteObjectRecovery(t *testing.T) {
+	os.RemoveAll("/tmp/persist_test")
+	os.Mkdir("/tmp/persist_test", os.ModePerm)
+	fp := "/tmp/persist_test/obj"
+
+	WriteObject(fp, Rollup{Total: 1, Count: 1})
+	WriteObject(fp, Rollup{Total: 2, Count: 2})
+
+	var r Rollup
+	err := ReadObject(fp, &r)
+	if err != nil || r.Total != 2 {
+		t.Errorf("Read %+v, %v", r, err)
+	}
+
+	// simulate a torn write of the live file
+	os.Truncate(fp, 3)
+	r = Rollup{}
+	err = ReadObject(fp, &r)
+	if err != nil || r.Total != 1 {
+		t.Errorf("Expected fallback to previous version: %+v, %v", r, err)
+	}
+
+	// simulate a crash between renames
+	os.Remove(fp)
+	r = Rollup{}
+	err = ReadObject(fp, &r)
+	if err != nil || r.Total != 1 {
+		t.Errorf("Expected fallback to previous version: %+v, %v", r, err)
+	}
+
+	RemoveObject(fp)
+	if _, err := os.Stat(fp + prevSuffix); !os.IsNotExist(err) {
+		t.Errorf("Backup not removed")
+	}
+	if err := ReadObject(fp, &r); err == nil {
+		t.Errorf("Expected error reading removed object")
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	os.RemoveAll("/tmp/persist_test")
+	os.Mkdir("/tmp/persist_test", os.ModePerm)
+
+	a := NewArchive("/tmp/persist_test", 1, 3600, 600)
+	startTime := int64(1560632400)
+	for i := 0; i < 1200; i++ {
+		a.Append(map[string]interface{} { "val": float64(i) }, startTime + int64(i))
+	}
+	a.Write()
+
+	// flip a bit in the middle of the first chunk
+	fp := "/tmp/persist_test/1560632400"
+	buf, _ := ioutil.ReadFile(fp)
+	buf[len(buf) / 2] ^= 0x10
+	ioutil.WriteFile(fp, buf, 0600)
+
+	var c chunk
+	err := ReadObject(fp, &c)
+	if !errors.Is(err, ErrCorruptChunk) {
+		t.Errorf("Expected ErrCorruptChunk: %v", err)
+	}
+
+	a, err = OpenArchive("/tmp/persist_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _, err := a.GetData(startTime, startTime + 1200)
+	if !errors.Is(err, ErrCorruptChunk) {
+		t.Errorf("Expected ErrCorruptChunk: %v", err)
+	}
+	if d["val"][0] != nil || d["val"][700] != 700.0 {
+		t.Errorf("Expected partial data: %v, %v", d["val"][0], d["val"][700])
+	}
+}
+
+func TestSync(t *testing.T) {
+	os.RemoveAll("/tmp/persist_test")
+	os.Mkdir("/tmp/persist_test", os.ModePerm)
+
+	a := NewArchive("/tmp/persist_test", 1, 600, 600)
+	startTime := int64(1560632400)
+	for i := 0; i < 1200; i++ {
+		a.Append(map[string]interface{} { "val": float64(i) }, startTime + int64(i))
+		if i % 500 == 0 {
+			a.Write()
+		}
+	}
+	a.Write()
+
+	if len(a.unsynced) == 0 {
+		t.Fatalf("Expected unsynced files")
+	}
+	// the first chunk has been removed by retention by now
+	err := a.Sync()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(a.unsynced) != 0 {
+		t.Errorf("Expected all files synced: %v", a.unsynced)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	os.RemoveAll("/tmp/persist_test")
+	os.Mkdir("/tmp/persist_test", os.ModePerm)
+
+	startTime := int64(1560632000)
+	a := NewArchive("/tmp/persist_test", 1, 100000, 1000)
+	for i := 0; i < 2500; i++ {
+		// each chunk is last written after the next one starts
+		if i == 1001 {
+			a.Compression = CompressGzip
+		} else if i == 2001 {
+			a.Compression = CompressZstd
+		}
+		a.AppendFloats(map[string]float64{ "a": 1, "b": float64(i % 7) }, startTime + int64(i))
+		a.Write()
+	}
+	a.Compression = CompressSnappy
+	a.Write()
+
+	a, err := OpenArchive("/tmp/persist_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _, err := a.GetFloats(startTime, startTime + 2500, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{ 0, 999, 1000, 1999, 2000, 2499 } {
+		if d["a"][i] != 1 || d["b"][i] != float64(i % 7) {
+			t.Errorf("Data[%d] is %v, %v", i, d["a"][i], d["b"][i])
+		}
+	}
+
+	raw, _ := ioutil.ReadFile("/tmp/persist_test/1560632000")
+	gz, _ := ioutil.ReadFile("/tmp/persist_test/1560633000")
+	if len(gz) >= len(raw) / 2 {
+		t.Errorf("Compressed chunk is %d bytes, uncompressed %d", len(gz), len(raw))
+	}
+
+	for codec := CompressNone; codec <= CompressZstd; codec++ {
+		payload := []byte("hello hello hello hello")
+		buf, err := compress(codec, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := decompress(codec, buf)
+		if err != nil || string(res) != string(payload) {
+			t.Errorf("Codec %d round-tripped %q, %v", codec, res, err)
+		}
+	}
+}
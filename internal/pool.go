@@ -0,0 +1,46 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"sync"
+)
+
+//
+// Pools for short-lived allocations on the append and query paths.
+// Chunks decoded for a single query are recycled once the query is
+// done with them, so the next decode can reuse their slices.
+//
+
+var chunkPool = sync.Pool{
+	New: func() interface{} { return new(chunk) },
+}
+
+var rollupMapPool = sync.Pool{
+	New: func() interface{} { return make(map[string]Rollup) },
+}
+
+var endsMapPool = sync.Pool{
+	New: func() interface{} { return make(map[string]int64) },
+}
+
+var openerPool = sync.Pool{
+	New: func() interface{} { return new(chunkOpener) },
+}
+
+func getChunk() *chunk {
+	return chunkPool.Get().(*chunk)
+}
+
+func putChunk(c *chunk) {
+	for k := range c.tagMap {
+		delete(c.tagMap, k)
+	}
+	*c = chunk{
+		Tags: c.Tags[:0],
+		Values: c.Values[:0],
+		tagMap: c.tagMap,
+	}
+	chunkPool.Put(c)
+}
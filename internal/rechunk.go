@@ -0,0 +1,297 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//
+// Rechunking rewrites an archive's chunk files at a new chunk size.
+// New chunks are built one old chunk at a time in a "rechunk"
+// staging directory, alongside a state file recording how far the
+// rewrite has got, so an interrupted Rechunk picks up where it left
+// off when it's called again.  Once every new chunk is staged, the
+// state is marked as swapping, the staged files are moved into the
+// archive and the old ones removed.  An interrupted swap is finished
+// by the next Rechunk or OpenArchive.
+//
+
+const rechunkDir = "rechunk"
+
+type rechunkState struct {
+	ChunkSize int64
+	// every new chunk starting before From is staged
+	From      int64
+	Swapping  bool
+}
+
+//
+// Rewrite the archive's chunks at chunkSize, which must be a multiple
+// of the interval.  The archive is locked throughout, so appends and
+// queries wait until it's done; it mustn't run alongside Compact.
+//
+func (a *Archive) Rechunk(chunkSize int64) error {
+	if a.memory {
+		return fmt.Errorf("in-memory archives can't be rechunked")
+	}
+	if a.store != nil {
+		return fmt.Errorf("archives in object storage can't be rechunked")
+	}
+	if chunkSize <= 0 || chunkSize % a.Interval != 0 {
+		return fmt.Errorf("chunk size %d is not a multiple of the interval %d", chunkSize, a.Interval)
+	}
+	err := a.Write()
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	dir := filepath.Join(a.Dir, rechunkDir)
+	statePath := filepath.Join(dir, "state")
+
+	var state rechunkState
+	err = ReadObject(statePath, &state)
+	if err == nil && state.Swapping {
+		err = a.finishRechunk(state)
+		if err != nil {
+			return err
+		}
+	}
+	if err != nil || state.Swapping || state.ChunkSize != chunkSize {
+		// nothing to resume
+		os.RemoveAll(dir)
+		if chunkSize == a.ChunkSize {
+			return nil
+		}
+		err = os.Mkdir(dir, 0700)
+		if err != nil {
+			return err
+		}
+		state = rechunkState{ ChunkSize: chunkSize }
+	}
+
+	if a.EndTime > 0 {
+		err = a.stageChunks(dir, &state)
+		if err != nil {
+			return err
+		}
+	}
+	state.Swapping = true
+	err = WriteObject(statePath, state)
+	if err == nil {
+		err = SyncFile(statePath)
+	}
+	if err != nil {
+		return err
+	}
+	return a.finishRechunk(state)
+}
+
+//
+// Build the new chunks in dir, starting from state.From.
+//
+func (a *Archive) stageChunks(dir string, state *rechunkState) error {
+	staged := &Archive{
+		Interval: a.Interval,
+		ChunkSize: state.ChunkSize,
+		Dir: dir,
+		Encoding: a.Encoding,
+		Shards: a.Shards,
+		ValueType: a.ValueType,
+		Compression: a.Compression,
+		Sketches: a.Sketches,
+		Uniques: a.Uniques,
+		codec: a.codec,
+	}
+	statePath := filepath.Join(dir, "state")
+
+	// new chunks that may still get values from later old chunks
+	var pending []*chunk
+	first := a.chunkStart(a.StartTime)
+	if state.From > a.StartTime {
+		first = a.chunkStart(state.From)
+	}
+	for ts := first; ts <= a.EndTime; ts += a.ChunkSize {
+		oc, err := a.readChunk(ts)
+		if errors.Is(err, os.ErrNotExist) {
+			// a gap
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		start := oc.StartTime
+		if start < state.From {
+			start = state.From
+		}
+		end := oc.StartTime + int64(oc.Ticks) * a.Interval
+		for t := start; t < end; t = staged.chunkStart(t) + state.ChunkSize {
+			ns := staged.chunkStart(t)
+			l := len(pending)
+			if l == 0 || pending[l - 1].StartTime != ns {
+				nc := newChunk(a.Interval, ns)
+				nc.Kind = oc.Kind
+				nc.ValueType = a.ValueType
+				pending = append(pending, nc)
+			}
+			nc := pending[len(pending) - 1]
+			last := ns + state.ChunkSize
+			if end < last {
+				last = end
+			}
+			nc.EndTime = last - a.Interval
+			nc.Ticks = nc.tsIndex(nc.EndTime) + 1
+		}
+
+		err = oc.scan(start, end, nil, func(tag string, i int, f []float64) {
+			t := start + int64(i) * a.Interval
+			j := len(pending) - 1
+			for pending[j].StartTime > t {
+				j--
+			}
+			pending[j].setValue(pending[j].tsIndex(t), tag, oc.Kind, f)
+		})
+		for _, kind := range sketchKinds {
+			if err != nil {
+				break
+			}
+			err = oc.scanSketches(kind, start, end, nil, func(tag string, i int, s []byte) {
+				t := start + int64(i) * a.Interval
+				j := len(pending) - 1
+				for pending[j].StartTime > t {
+					j--
+				}
+				pending[j].setSketch(kind, pending[j].tsIndex(t), tag, s)
+			})
+		}
+		if err != nil {
+			return err
+		}
+
+		// new chunks that end before the next old one are done
+		next := ts + a.ChunkSize
+		for len(pending) > 0 && pending[0].StartTime + state.ChunkSize <= next {
+			err = staged.writeChunk(pending[0])
+			if err != nil {
+				return err
+			}
+			pending = pending[1:]
+		}
+		state.From = next
+		if len(pending) > 0 {
+			state.From = pending[0].StartTime
+		}
+		err = staged.Sync()
+		if err == nil {
+			err = WriteObject(statePath, *state)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, nc := range pending {
+		err := staged.writeChunk(nc)
+		if err != nil {
+			return err
+		}
+	}
+	return staged.Sync()
+}
+
+//
+// Move the staged chunks into the archive, remove the old ones, and
+// switch to the new chunk size.
+//
+func (a *Archive) finishRechunk(state rechunkState) error {
+	dir := filepath.Join(a.Dir, rechunkDir)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if _, ok := chunkFileStart(f.Name()); !ok {
+			continue
+		}
+		if strings.HasSuffix(f.Name(), tmpSuffix) || strings.HasSuffix(f.Name(), prevSuffix) {
+			continue
+		}
+		fp := filepath.Join(a.Dir, f.Name())
+		// the backup belongs to the old chunk size
+		os.Remove(fp + prevSuffix)
+		err = os.Rename(filepath.Join(dir, f.Name()), fp)
+		if err != nil {
+			return err
+		}
+		a.forgetFile(fp)
+	}
+
+	files, err = ioutil.ReadDir(a.Dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		ts, ok := chunkFileStart(f.Name())
+		if !ok || ts % state.ChunkSize == 0 {
+			continue
+		}
+		fp := filepath.Join(a.Dir, f.Name())
+		err = os.Remove(fp)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		a.forgetFile(fp)
+	}
+
+	a.ChunkSize = state.ChunkSize
+	a.chunks = nil
+	if a.EndTime > 0 {
+		lc, err := a.readChunk(a.chunkStart(a.EndTime))
+		if err != nil {
+			return err
+		}
+		a.chunks = []*chunk{ lc }
+	}
+	a.lastWrite = a.EndTime
+	fp := filepath.Join(a.Dir, "archive")
+	err = WriteObject(fp, a)
+	if err == nil {
+		err = SyncFile(fp)
+	}
+	if err == nil {
+		err = SyncFile(a.Dir)
+	}
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (a *Archive) forgetFile(fp string) {
+	delete(a.unsynced, fp)
+	if a.cache != nil {
+		a.cache.invalidate(fp)
+	}
+}
+
+//
+// The start time of a chunk file (or its backup, temp file or shard)
+// named name.
+//
+func chunkFileStart(name string) (int64, bool) {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		name = name[:i]
+	}
+	ts, err := strconv.ParseInt(name, 10, 64)
+	return ts, err == nil
+}
@@ -0,0 +1,121 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func checkRechunked(t *testing.T, a *Archive, startTime int64, n int) {
+	d, _, err := a.GetFloats(startTime, startTime + int64(n), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if d["a"][i] != float64(i) {
+			t.Fatalf("Value %d is %f after rechunking to %d", i, d["a"][i], a.ChunkSize)
+		}
+		if i % 2 == 0 && d["b"][i] != float64(-i) {
+			t.Fatalf("Value b %d is %f after rechunking to %d", i, d["b"][i], a.ChunkSize)
+		}
+	}
+	files, _ := ioutil.ReadDir(a.Dir)
+	for _, f := range files {
+		if ts, ok := chunkFileStart(f.Name()); ok && ts % a.ChunkSize != 0 {
+			t.Errorf("Old chunk file %s left behind", f.Name())
+		}
+	}
+}
+
+func TestRechunk(t *testing.T) {
+	os.RemoveAll("/tmp/archive_test")
+	os.Mkdir("/tmp/archive_test", os.ModePerm)
+
+	startTime := int64(1560632050)
+	a := NewArchive("/tmp/archive_test", 1, 100000, 100)
+	for i := 0; i < 1000; i++ {
+		v := map[string]float64{ "a": float64(i) }
+		if i % 2 == 0 {
+			v["b"] = float64(-i)
+		}
+		a.AppendFloats(v, startTime + int64(i))
+	}
+	a.Write()
+
+	for _, size := range []int64{ 250, 30, 1000 } {
+		err := a.Rechunk(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkRechunked(t, a, startTime, 1000)
+	}
+
+	// appends carry on in the new chunks
+	a.AppendFloats(map[string]float64{ "a": 1000, "b": -1000 }, startTime + 1000)
+	a.Write()
+	a, err := OpenArchive("/tmp/archive_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.ChunkSize != 1000 {
+		t.Errorf("Chunk size is %d after reopening", a.ChunkSize)
+	}
+	checkRechunked(t, a, startTime, 1001)
+}
+
+func TestInterruptedRechunk(t *testing.T) {
+	os.RemoveAll("/tmp/archive_test")
+	os.Mkdir("/tmp/archive_test", os.ModePerm)
+
+	startTime := int64(1560632000)
+	a := NewArchive("/tmp/archive_test", 1, 100000, 100)
+	for i := 0; i < 1000; i++ {
+		a.AppendFloats(map[string]float64{ "a": float64(i), "b": float64(-i) }, startTime + int64(i))
+	}
+	a.Write()
+
+	// stage part of a rechunk, as if it had been killed
+	dir := filepath.Join(a.Dir, rechunkDir)
+	os.Mkdir(dir, 0700)
+	end := a.EndTime
+	a.EndTime = startTime + 449
+	state := rechunkState{ ChunkSize: 300 }
+	err := a.stageChunks(dir, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.EndTime = end
+	if state.From != startTime + 400 {
+		t.Errorf("Staged up to %d", state.From)
+	}
+
+	err = a.Rechunk(300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRechunked(t, a, startTime, 1000)
+
+	// a swap interrupted part way is finished on open
+	state = rechunkState{ ChunkSize: 200 }
+	os.Mkdir(dir, 0700)
+	a.stageChunks(dir, &state)
+	state.Swapping = true
+	WriteObject(filepath.Join(dir, "state"), state)
+	os.Rename(filepath.Join(dir, "1560632200"), filepath.Join(a.Dir, "1560632200"))
+
+	a, err = OpenArchive("/tmp/archive_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.ChunkSize != 200 {
+		t.Errorf("Chunk size is %d after reopening", a.ChunkSize)
+	}
+	checkRechunked(t, a, startTime, 1000)
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Staging directory left behind")
+	}
+}
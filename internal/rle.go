@@ -0,0 +1,118 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+//
+// Run-length encoding, for keys that hold the same value for long
+// stretches (e.g. "up" flags, or values copied forward over gaps).
+// Each column is a sequence of runs of identical values:
+//
+//	skip    uvarint (invalid ticks since the end of the last run)
+//	length  uvarint
+//	value   width(kind) floats, little-endian
+//
+// Floats are 8 bytes, or 4 for plain values in ValueFloat32 chunks.
+// Values are compared bitwise, so NaNs and signed zeros survive.
+//
+
+func rleFloatSize(kind, valueType int) int {
+	if kind == kindFloat && valueType == ValueFloat32 {
+		return 4
+	}
+	return 8
+}
+
+func encodeRLEColumn(col *column, kind, valueType, ticks int) []byte {
+	w := width(kind)
+	size := rleFloatSize(kind, valueType)
+	var buf []byte
+	var tmp [binary.MaxVarintLen64]byte
+
+	prevEnd := 0
+	start, length := 0, 0
+	run := make([]float64, w)
+	flush := func() {
+		if length == 0 {
+			return
+		}
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(start - prevEnd))]...)
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(length))]...)
+		for _, v := range run {
+			if size == 4 {
+				buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(v)))
+			} else {
+				buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(v))
+			}
+		}
+		prevEnd = start + length
+	}
+
+	col.each(0, ticks, w, func(t int, f []float64) {
+		if length > 0 && t == start + length && sameFloats(run, f) {
+			length++
+			return
+		}
+		flush()
+		start, length = t, 1
+		copy(run, f)
+	})
+	flush()
+	return buf
+}
+
+func sameFloats(a, b []float64) bool {
+	for i := range a {
+		if math.Float64bits(a[i]) != math.Float64bits(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func decodeRLEColumn(buf []byte, kind, valueType, ticks int) (column, error) {
+	w := width(kind)
+	size := rleFloatSize(kind, valueType)
+	col := newColumn()
+	run := make([]float64, w)
+
+	pos, t := 0, 0
+	for pos < len(buf) {
+		skip, n := binary.Uvarint(buf[pos:])
+		if n <= 0 {
+			return col, fmt.Errorf("rle: bad run offset")
+		}
+		pos += n
+		length, n := binary.Uvarint(buf[pos:])
+		if n <= 0 {
+			return col, fmt.Errorf("rle: bad run length")
+		}
+		pos += n
+		if skip > uint64(ticks - t) || length > uint64(ticks - t) - skip {
+			return col, fmt.Errorf("rle: run past end of chunk")
+		}
+		if pos + w * size > len(buf) {
+			return col, fmt.Errorf("rle: truncated run")
+		}
+		for i := range run {
+			if size == 4 {
+				run[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(buf[pos:])))
+			} else {
+				run[i] = math.Float64frombits(binary.LittleEndian.Uint64(buf[pos:]))
+			}
+			pos += size
+		}
+
+		t += int(skip)
+		for end := t + int(length); t < end; t++ {
+			col.set(t, w, run)
+		}
+	}
+	return col, nil
+}
@@ -0,0 +1,97 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"testing"
+	"math"
+	"os"
+)
+
+func TestRLEColumn(t *testing.T) {
+	vals := []interface{} {
+		1.0, 1.0, 1.0, nil, 1.0, 2.0, 2.0, nil, nil, 0.0,
+		math.Copysign(0, -1), 42.0,
+	}
+
+	buf := encodeRLEColumn(toColumn(vals), kindFloat, ValueFloat64, len(vals))
+	col, err := decodeRLEColumn(buf, kindFloat, ValueFloat64, len(vals))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := fromColumn(col, kindFloat, len(vals))
+	for i := range vals {
+		if res[i] != vals[i] {
+			t.Errorf("Value %d is %v, expected %v", i, res[i], vals[i])
+		}
+	}
+	if math.Signbit(res[9].(float64)) || !math.Signbit(res[10].(float64)) {
+		t.Errorf("Signed zeros were merged")
+	}
+
+	_, err = decodeRLEColumn(buf, kindFloat, ValueFloat64, 5)
+	if err == nil {
+		t.Errorf("Expected error decoding runs past the end of the chunk")
+	}
+}
+
+func TestRLERollupColumn(t *testing.T) {
+	r := Rollup{Total: 60, Count: 60, Min: 1, Max: 1}
+	vals := []interface{} { r, r, r, nil, Rollup{Total: 1, Count: 1, Min: 1, Max: 1} }
+
+	buf := encodeRLEColumn(toColumn(vals), rollupKind, ValueFloat64, len(vals))
+	col, err := decodeRLEColumn(buf, rollupKind, ValueFloat64, len(vals))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := fromColumn(col, rollupKind, len(vals))
+	for i := range vals {
+		if res[i] != vals[i] {
+			t.Errorf("Value %d is %+v, expected %+v", i, res[i], vals[i])
+		}
+	}
+}
+
+func TestRLECompresses(t *testing.T) {
+	vals := make([]interface{}, 2000)
+	for i := range vals {
+		vals[i] = float64(i / 500)
+	}
+
+	buf := encodeRLEColumn(toColumn(vals), kindFloat, ValueFloat64, len(vals))
+	if len(buf) > 4 * 12 {
+		t.Errorf("Column is %d bytes", len(buf))
+	}
+
+	_, err := decodeRLEColumn(buf[:len(buf) - 1], kindFloat, ValueFloat64, len(vals))
+	if err == nil {
+		t.Errorf("Expected error decoding truncated column")
+	}
+}
+
+func TestRLEArchive(t *testing.T) {
+	os.RemoveAll("/tmp/archive_test")
+	os.Mkdir("/tmp/archive_test", os.ModePerm)
+
+	startTime := int64(1560632000)
+	a := NewArchive("/tmp/archive_test", 1, 100000, 1000)
+	a.Encoding = EncodingRLE
+	a.ValueType = ValueFloat32
+	for i := 0; i < 1000; i++ {
+		if i % 100 == 50 {
+			continue
+		}
+		a.AppendFloats(map[string]float64{ "up": 1, "val": float64(i / 10) + 0.1 }, startTime + int64(i))
+	}
+	a.Write()
+	a.chunks = nil
+
+	d, _, err := a.GetFloats(startTime, startTime + 1000, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d["up"][0] != 1 || d["up"][999] != 1 || d["val"][123] != float64(float32(12.1)) {
+		t.Errorf("Data is %v", d)
+	}
+}
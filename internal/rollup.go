@@ -0,0 +1,183 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"math"
+)
+
+//
+// A Rollup summarizes all datapoints for a key within one
+// interval of a rollup archive.
+//
+// SumSq is the sum of the squares of the datapoints, for working
+// out the variance.  First and Last are the earliest and latest
+// datapoints.  They're NaN for rollups written before they were
+// added, unless they can be worked out (e.g. all datapoints were
+// the same).
+//
+// Duration is how many seconds of the interval the datapoints were
+// in effect for, and Weighted the sum of each datapoint times the
+// seconds it was in effect: from its own tick until the next
+// datapoint's, or the end of the interval.  Time before the first
+// datapoint isn't counted, since the datapoint before it belongs to
+// an earlier interval; coarser rollups fill it in from that
+// interval's Last.  Both are NaN for rollups written before they
+// were added.
+//
+type Rollup struct {
+	Total    float64
+	Count    int64
+	Min      float64
+	Max      float64
+	SumSq    float64
+	First    float64
+	Last     float64
+	Weighted float64
+	Duration float64
+}
+
+func rollupFromFloats(f []float64) Rollup {
+	r := Rollup{
+		Total: f[0],
+		Count: int64(f[1]),
+		Min: f[2],
+		Max: f[3],
+	}
+	if len(f) > 4 {
+		r.SumSq = f[4]
+	} else if r.Min == r.Max {
+		r.SumSq = float64(r.Count) * r.Min * r.Min
+	} else {
+		r.SumSq = math.NaN()
+	}
+	if len(f) > 5 {
+		r.First, r.Last = f[5], f[6]
+	} else if r.Min == r.Max {
+		r.First, r.Last = r.Min, r.Min
+	} else {
+		r.First, r.Last = math.NaN(), math.NaN()
+	}
+	if len(f) > 7 {
+		r.Weighted, r.Duration = f[7], f[8]
+	} else {
+		r.Weighted, r.Duration = math.NaN(), math.NaN()
+	}
+	return r
+}
+
+//
+// Flatten into f, which holds width(kind) floats for a rollup kind.
+//
+func (r Rollup) floats(f []float64) {
+	f[0] = r.Total
+	f[1] = float64(r.Count)
+	f[2] = r.Min
+	f[3] = r.Max
+	if len(f) > 4 {
+		f[4] = r.SumSq
+	}
+	if len(f) > 5 {
+		f[5], f[6] = r.First, r.Last
+	}
+	if len(f) > 7 {
+		f[7], f[8] = r.Weighted, r.Duration
+	}
+}
+
+//
+// The population variance of the datapoints; 0 if there are none.
+//
+func (r Rollup) Variance() float64 {
+	if r.Count == 0 {
+		return 0
+	}
+	mean := r.Total / float64(r.Count)
+	v := r.SumSq / float64(r.Count) - mean * mean
+	if v < 0 {
+		// rounding
+		return 0
+	}
+	return v
+}
+
+//
+// The population standard deviation of the datapoints.
+//
+func (r Rollup) StdDev() float64 {
+	return math.Sqrt(r.Variance())
+}
+
+//
+// The average of the datapoints weighted by how long each was in
+// effect.  Falls back to the plain average for rollups without
+// durations (single datapoints, or rollups written before Duration).
+//
+func (r Rollup) TimeWeightedAverage() float64 {
+	if r.Duration > 0 {
+		return r.Weighted / r.Duration
+	}
+	if r.Count > 0 {
+		return r.Total / float64(r.Count)
+	}
+	return 0
+}
+
+//
+// Add a single datapoint, later than any added so far.  first
+// should be set for the first datapoint added to an empty Rollup.
+//
+func (r *Rollup) add(v float64, first bool) {
+	r.Count++
+	r.Total += v
+	r.SumSq += v * v
+	if first {
+		r.First = v
+	}
+	r.Last = v
+	if first || v > r.Max {
+		r.Max = v
+	}
+	if first || v < r.Min {
+		r.Min = v
+	}
+}
+
+//
+// Add a datapoint, later than any added so far.
+//
+func (r *Rollup) Add(v float64) {
+	r.add(v, r.Count == 0)
+}
+
+//
+// Merge in a later Rollup.  first should be set if r is empty.
+//
+func (r *Rollup) merge(o Rollup, first bool) {
+	r.Count += o.Count
+	r.Total += o.Total
+	r.SumSq += o.SumSq
+	r.Weighted += o.Weighted
+	r.Duration += o.Duration
+	if first {
+		r.First = o.First
+	}
+	r.Last = o.Last
+	if first || o.Max > r.Max {
+		r.Max = o.Max
+	}
+	if first || o.Min < r.Min {
+		r.Min = o.Min
+	}
+}
+
+//
+// Count the latest datapoint as in effect for another secs seconds.
+//
+func (r *Rollup) carry(secs float64) {
+	if secs > 0 {
+		r.Weighted += r.Last * secs
+		r.Duration += secs
+	}
+}
@@ -0,0 +1,369 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+//
+// Quantile sketches, for archives that keep percentiles.  A sketch
+// is a DDSketch: values are counted in logarithmic buckets, so any
+// quantile can be read back to within sketchAccuracy of the true
+// value, and two sketches merge by adding their counts.  Sketches
+// are stored encoded, one per rollup tick:
+//
+//	zero      uvarint (count of zeros)
+//	positive  bucket list
+//	negative  bucket list
+//
+// A bucket list is a uvarint length followed by that many
+// (zigzag-varint index delta, uvarint count) pairs, ascending.
+//
+
+const sketchAccuracy = 0.01
+
+var (
+	sketchGamma = (1 + sketchAccuracy) / (1 - sketchAccuracy)
+	sketchLogGamma = math.Log(sketchGamma)
+)
+
+type sketch struct {
+	zero  uint64
+	pos   map[int32]uint64
+	neg   map[int32]uint64
+	count uint64
+}
+
+func newSketch() *sketch {
+	return &sketch{
+		pos: make(map[int32]uint64),
+		neg: make(map[int32]uint64),
+	}
+}
+
+func sketchIndex(v float64) int32 {
+	return int32(math.Ceil(math.Log(v) / sketchLogGamma))
+}
+
+func sketchValue(i int32) float64 {
+	return 2 * math.Pow(sketchGamma, float64(i)) / (sketchGamma + 1)
+}
+
+func (s *sketch) add(v float64) {
+	switch {
+	case math.IsNaN(v):
+		return
+	case v > 0:
+		s.pos[sketchIndex(v)]++
+	case v < 0:
+		s.neg[sketchIndex(-v)]++
+	default:
+		s.zero++
+	}
+	s.count++
+}
+
+func (s *sketch) merge(o *sketch) {
+	s.zero += o.zero
+	for i, n := range o.pos {
+		s.pos[i] += n
+	}
+	for i, n := range o.neg {
+		s.neg[i] += n
+	}
+	s.count += o.count
+}
+
+//
+// The value at quantile q (0 to 1), or NaN if the sketch is empty.
+//
+func (s *sketch) quantile(q float64) float64 {
+	if s.count == 0 {
+		return math.NaN()
+	}
+	rank := uint64(q * float64(s.count - 1))
+
+	// most negative first
+	neg := sortedIndexes(s.neg)
+	for j := len(neg) - 1; j >= 0; j-- {
+		n := s.neg[neg[j]]
+		if rank < n {
+			return -sketchValue(neg[j])
+		}
+		rank -= n
+	}
+	if rank < s.zero {
+		return 0
+	}
+	rank -= s.zero
+	pos := sortedIndexes(s.pos)
+	for _, i := range pos {
+		n := s.pos[i]
+		if rank < n {
+			return sketchValue(i)
+		}
+		rank -= n
+	}
+	return sketchValue(pos[len(pos) - 1])
+}
+
+func sortedIndexes(m map[int32]uint64) []int32 {
+	idx := make([]int32, 0, len(m))
+	for i := range m {
+		idx = append(idx, i)
+	}
+	sort.Slice(idx, func(a, b int) bool { return idx[a] < idx[b] })
+	return idx
+}
+
+func (s *sketch) encode() []byte {
+	var buf []byte
+	buf = binary.AppendUvarint(buf, s.zero)
+	for _, m := range []map[int32]uint64{ s.pos, s.neg } {
+		buf = binary.AppendUvarint(buf, uint64(len(m)))
+		prev := int32(0)
+		for _, i := range sortedIndexes(m) {
+			buf = binary.AppendUvarint(buf, zigzag(int64(i - prev)))
+			buf = binary.AppendUvarint(buf, m[i])
+			prev = i
+		}
+	}
+	return buf
+}
+
+func decodeSketch(buf []byte) (*sketch, error) {
+	s := newSketch()
+	pos := 0
+	next := func() (uint64, error) {
+		v, n := binary.Uvarint(buf[pos:])
+		if n <= 0 {
+			return 0, fmt.Errorf("sketch: truncated")
+		}
+		pos += n
+		return v, nil
+	}
+
+	var err error
+	s.zero, err = next()
+	if err != nil {
+		return nil, err
+	}
+	s.count = s.zero
+	for _, m := range []map[int32]uint64{ s.pos, s.neg } {
+		l, err := next()
+		if err != nil {
+			return nil, err
+		}
+		prev := int32(0)
+		for j := uint64(0); j < l; j++ {
+			d, err := next()
+			if err != nil {
+				return nil, err
+			}
+			n, err := next()
+			if err != nil {
+				return nil, err
+			}
+			prev += int32(unzigzag(d))
+			m[prev] = n
+			s.count += n
+		}
+	}
+	return s, nil
+}
+
+//
+// Chunks can hold two kinds of sketch per rollup tick: quantile
+// sketches (in Sketches) and HyperLogLogs (in Uniques).
+//
+const (
+	sketchQuantiles = iota
+	sketchUniques
+)
+
+var sketchKinds = []int{ sketchQuantiles, sketchUniques }
+
+func (c *chunk) sketchField(kind int) *[]map[int32][]byte {
+	if kind == sketchUniques {
+		return &c.Uniques
+	}
+	return &c.Sketches
+}
+
+func (c *chunk) hasSketches() bool {
+	return len(c.Sketches) > 0 || len(c.Uniques) > 0
+}
+
+func (c *chunk) sketchesFor(kind, tag int) map[int32][]byte {
+	f := *c.sketchField(kind)
+	if tag < len(f) {
+		return f[tag]
+	}
+	return nil
+}
+
+func (c *chunk) setSketch(kind, tick int, tag string, s []byte) {
+	i := c.tagIndex(tag)
+	f := c.sketchField(kind)
+	for len(*f) <= i {
+		*f = append(*f, nil)
+	}
+	if (*f)[i] == nil {
+		(*f)[i] = make(map[int32][]byte)
+	}
+	(*f)[i][int32(tick)] = s
+	c.dirty = true
+}
+
+//
+// Like scan, for sketches.  Ticks are visited in no particular order.
+//
+func (c *chunk) scanSketches(kind int, startTime, endTime int64, keys *KeySet, fn func(tag string, i int, s []byte)) error {
+	l := int((endTime - startTime) / c.Resolution)
+	first := c.tsIndex(startTime)
+	for tag, sk := range *c.sketchField(kind) {
+		name := c.Tags[tag]
+		if !keys.has(name) {
+			continue
+		}
+		for tick, s := range sk {
+			i := int(tick) - first
+			if i >= 0 && i < l {
+				fn(name, i, s)
+			}
+		}
+	}
+	return nil
+}
+
+func (a *Archive) scanSketches(kind int, startTime, endTime int64, keys *KeySet, fn func(tag string, i int64, s []byte)) error {
+	return a.walkChunks(startTime, endTime, keys, func(r chunkReader, cStart, cEnd, offset int64) error {
+		return r.scanSketches(kind, cStart, cEnd, keys, func(tag string, j int, s []byte) {
+			fn(tag, offset + int64(j), s)
+		})
+	})
+}
+
+//
+// Summarize [startTime, endTime) into a single sketch per key.
+// Plain values are added; sketches, if the archive keeps them, are
+// merged.
+//
+func (a *Archive) sketchRange(startTime, endTime int64) (map[string][]byte, error) {
+	res := make(map[string]*sketch)
+	get := func(tag string) *sketch {
+		s := res[tag]
+		if s == nil {
+			s = newSketch()
+			res[tag] = s
+		}
+		return s
+	}
+
+	var err error
+	if !a.Sketches {
+		err = a.scan(startTime, endTime, nil, func(tag string, i int64, f []float64) {
+			if len(f) == 1 {
+				get(tag).add(f[0])
+			}
+		})
+		return encodeSketches(res, (*sketch).encode), err
+	}
+	var firstErr error
+	err = a.scanSketches(sketchQuantiles, startTime, endTime, nil, func(tag string, i int64, buf []byte) {
+		s, err := decodeSketch(buf)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %v: %w", a.Dir, err, ErrCorruptChunk)
+			}
+			return
+		}
+		get(tag).merge(s)
+	})
+	if err == nil {
+		err = firstErr
+	}
+	return encodeSketches(res, (*sketch).encode), err
+}
+
+func encodeSketches[T any](res map[string]T, encode func(T) []byte) map[string][]byte {
+	enc := make(map[string][]byte, len(res))
+	for tag, s := range res {
+		enc[tag] = encode(s)
+	}
+	return enc
+}
+
+//
+// Store encoded sketches alongside the rollups just appended at
+// timestamp.
+//
+func (a *Archive) appendSketches(kind int, res map[string][]byte, timestamp int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	lc := a.lastChunk()
+	timestamp = a.tsNorm(timestamp)
+	if lc == nil || lc.EndTime != timestamp {
+		// the rollups weren't appended
+		return
+	}
+	tick := lc.tsIndex(timestamp)
+	for tag, s := range res {
+		lc.setSketch(kind, tick, tag, s)
+	}
+}
+
+//
+// Returns the value at quantile q (0 to 1) for every tick in
+// [startTime, endTime) that has a sketch, for all keys or only those
+// listed.  Ticks without one are 0.
+//
+func (a *Archive) GetQuantiles(startTime, endTime int64, q float64, keys ...string) (map[string][]float64, []int64, error) {
+	return a.getSketchValues(sketchQuantiles, startTime, endTime, keys, func(buf []byte) (float64, error) {
+		s, err := decodeSketch(buf)
+		if err != nil {
+			return 0, err
+		}
+		return s.quantile(q), nil
+	})
+}
+
+func (a *Archive) getSketchValues(kind int, startTime, endTime int64, keys []string,
+	value func([]byte) (float64, error)) (map[string][]float64, []int64, error) {
+
+	startTime = a.tsNorm(startTime)
+	endTime = a.tsNorm(endTime)
+	l := int((endTime - startTime) / a.Interval)
+
+	res := make(map[string][]float64)
+	stamps := make([]int64, l)
+	for i := range stamps {
+		stamps[i] = startTime + int64(i) * a.Interval
+	}
+
+	var firstErr error
+	err := a.scanSketches(kind, startTime, endTime, newKeySet(keys), func(tag string, i int64, buf []byte) {
+		v, err := value(buf)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %v: %w", a.Dir, err, ErrCorruptChunk)
+			}
+			return
+		}
+		ser := res[tag]
+		if ser == nil {
+			ser = make([]float64, l)
+			res[tag] = ser
+		}
+		ser[i] = v
+	})
+	if err == nil {
+		err = firstErr
+	}
+	return res, stamps, err
+}
@@ -0,0 +1,47 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSketch(t *testing.T) {
+	a, b := newSketch(), newSketch()
+	for i := 1; i <= 1000; i++ {
+		a.add(float64(i))
+		b.add(float64(-i))
+	}
+	b.add(0)
+
+	s, err := decodeSketch(a.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []float64{ 0, 0.5, 0.95, 0.99, 1 } {
+		want := 1 + q * 999
+		if got := s.quantile(q); math.Abs(got - want) > want * sketchAccuracy {
+			t.Errorf("Quantile %f is %f, expected %f", q, got, want)
+		}
+	}
+
+	s.merge(b)
+	if s.count != 2001 {
+		t.Errorf("Merged sketch holds %d values", s.count)
+	}
+	if got := s.quantile(0.5); got != 0 {
+		t.Errorf("Median is %f", got)
+	}
+	if got := s.quantile(0); math.Abs(got + 1000) > 1000 * sketchAccuracy {
+		t.Errorf("Minimum is %f", got)
+	}
+
+	if !math.IsNaN(newSketch().quantile(0.5)) {
+		t.Errorf("Empty sketch has a median")
+	}
+	if _, err := decodeSketch([]byte{ 0, 5 }); err == nil {
+		t.Errorf("Truncated sketch decoded")
+	}
+}
@@ -0,0 +1,109 @@
+package internal
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+//
+// Where an archive keeps its chunk files, if not in its directory: a
+// store of named objects, such as a bucket of S3-compatible object
+// storage.  Objects are written whole, so they're never torn.  Get
+// fails with an error wrapping os.ErrNotExist if there's no object
+// by that name; deleting one that doesn't exist succeeds.
+//
+type ChunkStore interface {
+	Get(name string) ([]byte, error)
+	Put(name string, data []byte) error
+	Delete(name string) error
+}
+
+//
+// Keep the archive's chunk files in store, under names starting with
+// prefix, rather than in its directory, which then holds only its
+// metadata.  Only used for new archives; reopen existing ones with
+// OpenArchiveStore.
+//
+func (a *Archive) SetChunkStore(store ChunkStore, prefix string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.store, a.storePrefix = store, prefix
+}
+
+//
+// The name of the object in the archive's store holding the chunk
+// file at fp.
+//
+func (a *Archive) objectName(fp string) string {
+	return a.storePrefix + filepath.Base(fp)
+}
+
+func (a *Archive) putChunk(fp string, c *chunk) error {
+	data, err := c.encode(a.Encoding, a.Compression, a.codec)
+	if err != nil {
+		return err
+	}
+	return a.store.Put(a.objectName(fp), data)
+}
+
+func (a *Archive) getChunk(fp string) (*chunk, error) {
+	data, err := a.store.Get(a.objectName(fp))
+	if err != nil {
+		return nil, err
+	}
+	buf, err := verifyFooter(fp, data)
+	if err != nil {
+		return nil, err
+	}
+	return decodeChunk(fp, buf, a.codec)
+}
+
+//
+// Keep the archive's chunks, encoded, in memory, and nothing on
+// disk: Write encodes chunks and exercises retention as usual, but
+// writes no files.  Only used for new archives, with no directory;
+// the chunks are gone once the archive is.
+//
+func (a *Archive) SetMemory() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.store, a.storePrefix = &memStore{ objects: make(map[string][]byte) }, ""
+	a.memory = true
+}
+
+//
+// A ChunkStore in memory.
+//
+type memStore struct {
+	mu      sync.RWMutex
+	objects map[string][]byte
+}
+
+func (m *memStore) Get(name string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	data, ok := m.objects[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	return data, nil
+}
+
+func (m *memStore) Put(name string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[name] = data
+	return nil
+}
+
+func (m *memStore) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, name)
+	return nil
+}
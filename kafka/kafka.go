@@ -0,0 +1,394 @@
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package kafka consumes datapoints from a Kafka topic into a tissa.DB.
+It works with any Kafka client, through the Reader interface; with
+github.com/segmentio/kafka-go, for instance, an adapter is a few
+lines around a kafka.Reader in a consumer group:
+
+	c := kafka.NewConsumer(db, reader)
+	c.Schema.Format = kafka.FORMAT_MSGPACK
+	err := c.Run(ctx)
+
+Messages hold a datapoint each, or an array of them, by default as
+JSON objects like
+
+	{"series": "cpu", "timestamp": 1560632400, "values": {"web1": 0.5}}
+
+with an optional "namespace"; the Schema says how to read them, or
+Decode may be set to read messages some other way.  Messages are
+batched, and their values for each series and timestamp added
+together, in timestamp order.  Each batch is written with the DB's
+Write() before its offsets are committed, so after a crash or
+restart, consumption resumes from the last batch known to be
+written.  Messages that can't be decoded, and datapoints that can't
+be added (e.g. to a missing namespace, or beyond a quota), are
+skipped and reported to OnError, if set.
+*/
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/fred-lewis/tissa"
+	"github.com/fred-lewis/tissa/internal"
+)
+
+// A message read from a topic.
+type Message struct {
+	Topic     string
+	Partition int
+	Offset    int64
+	Key       []byte
+	Value     []byte
+}
+
+//
+// What a Consumer needs of a Kafka client.  FetchMessage returns the
+// next message, blocking until there is one or ctx is done, without
+// committing it.  CommitMessages commits the offsets of msgs, which
+// are the latest read from each partition they're from.
+//
+type Reader interface {
+	FetchMessage(ctx context.Context) (Message, error)
+	CommitMessages(ctx context.Context, msgs ...Message) error
+}
+
+// Values to add to a series at a timestamp, in seconds.
+type Datapoint struct {
+	Namespace string
+	Series    string
+	Timestamp int64
+	Values    map[string]float64
+}
+
+// Message encodings.
+type Format int
+
+const (
+	FORMAT_JSON Format = iota
+	FORMAT_MSGPACK
+)
+
+//
+// How datapoints are encoded: as JSON or msgpack maps, whose fields
+// are named as given here, or "namespace", "series", "timestamp"
+// and "values" by default.  Series, if set, is the series of
+// datapoints without a series field.  TimestampUnit is the unit of
+// timestamps, such as time.Millisecond; seconds by default.
+//
+type Schema struct {
+	Format         Format
+	NamespaceField string
+	SeriesField    string
+	TimestampField string
+	ValuesField    string
+	Series         string
+	TimestampUnit  time.Duration
+}
+
+type Consumer struct {
+	db *tissa.DB
+	r  Reader
+	Schema Schema
+	// decodes messages instead of the Schema, if set
+	Decode func(Message) ([]Datapoint, error)
+	// the longest a batch is held before it's written; 10 seconds by
+	// default
+	FlushInterval time.Duration
+	// the most messages in a batch; 10000 by default
+	BatchSize int
+	// called with each message or datapoint skipped, if set
+	OnError func(error)
+}
+
+const (
+	defaultFlushInterval = 10 * time.Second
+	defaultBatchSize     = 10000
+)
+
+func NewConsumer(db *tissa.DB, r Reader) *Consumer {
+	return &Consumer{
+		db: db,
+		r: r,
+		FlushInterval: defaultFlushInterval,
+		BatchSize: defaultBatchSize,
+	}
+}
+
+func (c *Consumer) report(err error) {
+	if err != nil && c.OnError != nil {
+		c.OnError(err)
+	}
+}
+
+type pointKey struct {
+	namespace string
+	series    string
+	timestamp int64
+}
+
+type batch struct {
+	points map[pointKey]map[string]float64
+	// the latest message from each partition
+	latest map[string]Message
+	size   int
+}
+
+func newBatch() *batch {
+	return &batch{
+		points: make(map[pointKey]map[string]float64),
+		latest: make(map[string]Message),
+	}
+}
+
+func (b *batch) add(p Datapoint) {
+	k := pointKey{ p.Namespace, p.Series, p.Timestamp }
+	vals := b.points[k]
+	if vals == nil {
+		vals = make(map[string]float64, len(p.Values))
+		b.points[k] = vals
+	}
+	for key, v := range p.Values {
+		vals[key] = v
+	}
+}
+
+//
+// Consume messages until ctx is done or reading, writing or
+// committing fails.  What's been read when ctx is done is written
+// and committed before Run returns ctx.Err().
+//
+func (c *Consumer) Run(ctx context.Context) error {
+	interval := c.FlushInterval
+	if interval <= 0 {
+		interval = defaultFlushInterval
+	}
+	size := c.BatchSize
+	if size <= 0 {
+		size = defaultBatchSize
+	}
+
+	b := newBatch()
+	deadline := time.Now().Add(interval)
+	for {
+		fetchCtx, cancel := context.WithDeadline(ctx, deadline)
+		msg, err := c.r.FetchMessage(fetchCtx)
+		cancel()
+		if err == nil {
+			// even if ctx is done by now, so it's committed below
+			c.consume(b, msg)
+		}
+		switch {
+		case ctx.Err() != nil:
+			// the batch is still committed, though ctx isn't usable
+			if err := c.flush(context.Background(), b); err != nil {
+				return err
+			}
+			return ctx.Err()
+		case err == nil:
+			if b.size < size {
+				continue
+			}
+		case !errors.Is(err, context.DeadlineExceeded):
+			return err
+		}
+		if err := c.flush(ctx, b); err != nil {
+			return err
+		}
+		b = newBatch()
+		deadline = time.Now().Add(interval)
+	}
+}
+
+func (c *Consumer) consume(b *batch, msg Message) {
+	b.size++
+	b.latest[fmt.Sprintf("%s/%d", msg.Topic, msg.Partition)] = msg
+	decode := c.Decode
+	if decode == nil {
+		decode = c.Schema.decode
+	}
+	points, err := decode(msg)
+	if err != nil {
+		c.report(fmt.Errorf("%s/%d at %d: %w", msg.Topic, msg.Partition, msg.Offset, err))
+		return
+	}
+	for _, p := range points {
+		b.add(p)
+	}
+}
+
+//
+// Add the batch's values, write the DB and commit the batch.
+//
+func (c *Consumer) flush(ctx context.Context, b *batch) error {
+	if b.size == 0 {
+		return nil
+	}
+	keys := make([]pointKey, 0, len(b.points))
+	for k := range b.points {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].timestamp < keys[j].timestamp })
+	for _, k := range keys {
+		c.report(c.add(k, b.points[k]))
+	}
+	if err := c.db.Write(); err != nil {
+		return err
+	}
+	msgs := make([]Message, 0, len(b.latest))
+	for _, m := range b.latest {
+		msgs = append(msgs, m)
+	}
+	return c.r.CommitMessages(ctx, msgs...)
+}
+
+func (c *Consumer) add(k pointKey, vals map[string]float64) error {
+	var err error
+	if k.namespace == "" {
+		err = c.db.AddValues(k.series, vals, k.timestamp)
+	} else {
+		var ns *tissa.Namespace
+		if ns, err = c.db.Namespace(k.namespace); err == nil {
+			err = ns.AddValues(k.series, vals, k.timestamp)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s at %d: %w", k.series, k.timestamp, err)
+	}
+	return nil
+}
+
+func field(name, def string) string {
+	if name == "" {
+		return def
+	}
+	return name
+}
+
+//
+// Decode a message as the schema describes.
+//
+func (s *Schema) decode(msg Message) ([]Datapoint, error) {
+	var v interface{}
+	var err error
+	if s.Format == FORMAT_MSGPACK {
+		err = internal.Msgpack.Decode(bytes.NewReader(msg.Value), &v)
+	} else {
+		d := json.NewDecoder(bytes.NewReader(msg.Value))
+		d.UseNumber()
+		err = d.Decode(&v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	objs, ok := v.([]interface{})
+	if !ok {
+		objs = []interface{}{ v }
+	}
+	points := make([]Datapoint, len(objs))
+	for i, o := range objs {
+		if err = s.datapoint(o, &points[i]); err != nil {
+			return nil, err
+		}
+	}
+	return points, nil
+}
+
+func (s *Schema) datapoint(o interface{}, p *Datapoint) error {
+	m, ok := stringMap(o)
+	if !ok {
+		return fmt.Errorf("datapoint isn't a map: %v", o)
+	}
+	p.Series = s.Series
+	if v, ok := m[field(s.SeriesField, "series")]; ok {
+		if p.Series, ok = str(v); !ok {
+			return fmt.Errorf("bad series %v", v)
+		}
+	}
+	if p.Series == "" {
+		return errors.New("datapoint has no series")
+	}
+	if v, ok := m[field(s.NamespaceField, "namespace")]; ok {
+		if p.Namespace, ok = str(v); !ok {
+			return fmt.Errorf("bad namespace %v", v)
+		}
+	}
+	ts, ok := number(m[field(s.TimestampField, "timestamp")])
+	if !ok {
+		return errors.New("datapoint has no timestamp")
+	}
+	if s.TimestampUnit > 0 {
+		ts = ts * float64(s.TimestampUnit) / float64(time.Second)
+	}
+	p.Timestamp = int64(ts)
+	vals, ok := stringMap(m[field(s.ValuesField, "values")])
+	if !ok {
+		return errors.New("datapoint has no values")
+	}
+	p.Values = make(map[string]float64, len(vals))
+	for k, v := range vals {
+		if p.Values[k], ok = number(v); !ok {
+			return fmt.Errorf("bad value for %s: %v", k, v)
+		}
+	}
+	return nil
+}
+
+//
+// Decoded maps, from JSON or msgpack, with string keys.
+//
+func stringMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			s, ok := str(k)
+			if !ok {
+				return nil, false
+			}
+			out[s] = v
+		}
+		return out, true
+	}
+	return nil, false
+}
+
+func str(v interface{}) (string, bool) {
+	switch s := v.(type) {
+	case string:
+		return s, true
+	case []byte:
+		return string(s), true
+	}
+	return "", false
+}
+
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	}
+	return 0, false
+}
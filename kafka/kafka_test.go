@@ -0,0 +1,111 @@
+package kafka
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/fred-lewis/tissa"
+)
+
+type fakeReader struct {
+	msgs      chan Message
+	committed chan []Message
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (Message, error) {
+	select {
+	case m := <-r.msgs:
+		return m, nil
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+func (r *fakeReader) CommitMessages(ctx context.Context, msgs ...Message) error {
+	r.committed <- msgs
+	return nil
+}
+
+func offsets(msgs []Message) []int64 {
+	var o []int64
+	for _, m := range msgs {
+		o = append(o, m.Offset)
+	}
+	sort.Slice(o, func(i, j int) bool { return o[i] < o[j] })
+	return o
+}
+
+func TestConsumer(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/kafka")
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+
+	db, err := tissa.NewDB("/tmp/timeseries_test/kafka", tissa.TimeSeriesConfig{
+		Archives: []tissa.ArchiveConfig{
+			{Resolution: tissa.SECOND, Retention: tissa.HOUR},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeReader{ msgs: make(chan Message, 10), committed: make(chan []Message, 10) }
+	c := NewConsumer(db, r)
+	c.BatchSize = 4
+	c.Schema = Schema{ SeriesField: "s", TimestampField: "t", ValuesField: "v", TimestampUnit: time.Millisecond }
+	errs := make(chan error, 10)
+	c.OnError = func(err error) { errs <- err }
+
+	startTime := int64(1560628800)
+	r.msgs <- Message{ Partition: 0, Offset: 10, Value: []byte(`{"s": "cpu", "t": 1560628801000, "v": {"web1": 2}}`) }
+	r.msgs <- Message{ Partition: 1, Offset: 20, Value: []byte(`[{"s": "cpu", "t": 1560628800000, "v": {"web1": 1}},
+		{"s": "cpu", "t": 1560628801000, "v": {"web2": 3}}]`) }
+	r.msgs <- Message{ Partition: 0, Offset: 11, Value: []byte(`not json`) }
+	r.msgs <- Message{ Partition: 1, Offset: 21, Value: []byte(`{"s": "cpu", "namespace": "none", "t": 1560628800000, "v": {"x": 1}}`) }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- c.Run(ctx) }()
+
+	if got := offsets(<-r.committed); len(got) != 2 || got[0] != 11 || got[1] != 21 {
+		t.Errorf("Expected offsets 11 and 21 committed, got %v", got)
+	}
+	if len(errs) != 2 {
+		t.Errorf("Expected a bad message and a bad namespace reported, got %d", len(errs))
+	}
+	ts, err := db.Series("cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vals, timestamp := ts.Latest()
+	if timestamp != startTime + 1 || vals["web1"] != 2 || vals["web2"] != 3 {
+		t.Errorf("Latest was %v at %d", vals, timestamp)
+	}
+	if v, _, _, _ := ts.LatestFor("web1"); v != 2 {
+		t.Errorf("Expected web1 2, got %g", v)
+	}
+	if ts.LastWritten == 0 {
+		t.Errorf("Expected the series written before committing")
+	}
+
+	// what's pending is written when the consumer's stopped
+	r.msgs <- Message{ Partition: 0, Offset: 12, Value: []byte(`{"s": "cpu", "t": 1560628802000, "v": {"web1": 4}}`) }
+	for len(r.msgs) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err = <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected Run to stop with the context, got %v", err)
+	}
+	if got := offsets(<-r.committed); len(got) != 1 || got[0] != 12 {
+		t.Errorf("Expected offset 12 committed, got %v", got)
+	}
+	if vals, timestamp = ts.Latest(); timestamp != startTime + 2 || vals["web1"] != 4 {
+		t.Errorf("Latest after stopping was %v at %d", vals, timestamp)
+	}
+}
@@ -0,0 +1,314 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fred-lewis/tissa/internal"
+)
+
+//
+// Labeled series.  A series has a name and a set of labels
+// (host="web1", region="us-east"), and is stored under a single key:
+//
+//	name{host="web1",region="us-east"}
+//
+// with labels sorted by label name and values quoted as Go strings,
+// so labeled series work with every key-based query.  A plain key is
+// a series with no labels.  Series appended with AddLabeledValue(s)
+// are recorded in an index, saved to the "labels" file by Write, for
+// looking them up by label.
+//
+
+type Labels map[string]string
+
+// A value for AddLabeledValues.
+type LabeledValue struct {
+	Name   string
+	Labels Labels
+	Value  float64
+}
+
+const labelsFile = "labels"
+
+//
+// The index of labeled series: the keys of the series with each
+// name, and with each label value.  Key lists are sorted.
+//
+type labelIndex struct {
+	Names    map[string][]string
+	Postings map[string]map[string][]string
+	known    map[string]bool
+	dirty    bool
+}
+
+func newLabelIndex() *labelIndex {
+	return &labelIndex{
+		Names: make(map[string][]string),
+		Postings: make(map[string]map[string][]string),
+		known: make(map[string]bool),
+	}
+}
+
+func readLabels(dir string) (*labelIndex, error) {
+	idx := newLabelIndex()
+	err := internal.ReadObject(filepath.Join(dir, labelsFile), idx)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	if idx.Names == nil {
+		idx.Names = make(map[string][]string)
+	}
+	if idx.Postings == nil {
+		idx.Postings = make(map[string]map[string][]string)
+	}
+	for _, keys := range idx.Names {
+		for _, k := range keys {
+			idx.known[k] = true
+		}
+	}
+	return idx, err
+}
+
+func (t *TimeSeries) writeLabels() error {
+	if t.InMemory() {
+		t.labels.dirty = false
+		return nil
+	}
+	fp := filepath.Join(t.dir, labelsFile)
+	err := internal.WriteObject(fp, t.labels)
+	if err == nil && t.config.Durability != DURABILITY_NONE {
+		err = internal.SyncFile(fp)
+	}
+	if err == nil {
+		t.labels.dirty = false
+	}
+	return err
+}
+
+func insertSorted(keys []string, key string) []string {
+	i := sort.SearchStrings(keys, key)
+	keys = append(keys, "")
+	copy(keys[i + 1:], keys[i:])
+	keys[i] = key
+	return keys
+}
+
+func (idx *labelIndex) add(key, name string, labels Labels) {
+	if idx.known[key] {
+		return
+	}
+	idx.known[key] = true
+	idx.Names[name] = insertSorted(idx.Names[name], key)
+	for l, v := range labels {
+		vals := idx.Postings[l]
+		if vals == nil {
+			vals = make(map[string][]string)
+			idx.Postings[l] = vals
+		}
+		vals[v] = insertSorted(vals[v], key)
+	}
+	idx.dirty = true
+}
+
+func validLabelName(l string) bool {
+	if l == "" {
+		return false
+	}
+	for i, c := range l {
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+//
+// The key a series is stored under.  Fails if the name contains a
+// '{' or a label name isn't a letter or underscore followed by
+// letters, digits and underscores.
+//
+func SeriesKey(name string, labels Labels) (string, error) {
+	if name == "" || strings.IndexByte(name, '{') >= 0 {
+		return "", fmt.Errorf("invalid series name %q", name)
+	}
+	if len(labels) == 0 {
+		return name, nil
+	}
+	for l := range labels {
+		if !validLabelName(l) {
+			return "", fmt.Errorf("invalid label name %q", l)
+		}
+	}
+	return formatSeries(name, labels), nil
+}
+
+func formatSeries(name string, labels Labels) string {
+	names := make([]string, 0, len(labels))
+	for l := range labels {
+		names = append(names, l)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, l := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[l]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+//
+// The name and labels of the series stored under key; labels is nil
+// for a plain key.
+//
+func ParseSeriesKey(key string) (name string, labels Labels, err error) {
+	i := strings.IndexByte(key, '{')
+	if i < 0 {
+		return key, nil, nil
+	}
+	name = key[:i]
+	rest := key[i + 1:]
+	labels = make(Labels)
+	for rest != "}" {
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 || !validLabelName(rest[:eq]) {
+			return "", nil, fmt.Errorf("invalid series key %q", key)
+		}
+		q, err := strconv.QuotedPrefix(rest[eq + 1:])
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid series key %q", key)
+		}
+		v, _ := strconv.Unquote(q)
+		labels[rest[:eq]] = v
+		rest = rest[eq + 1 + len(q):]
+		if strings.HasPrefix(rest, ",") {
+			rest = rest[1:]
+		} else if rest != "}" {
+			return "", nil, fmt.Errorf("invalid series key %q", key)
+		}
+	}
+	return name, labels, nil
+}
+
+//
+// Add a single value for a labeled series; see AddValue.
+//
+func (t *TimeSeries) AddLabeledValue(name string, labels Labels, val float64, timestamp int64) error {
+	return t.AddLabeledValues([]LabeledValue{ { Name: name, Labels: labels, Value: val } }, timestamp)
+}
+
+//
+// Add values for several labeled series at the given timestamp; see
+// AddValues.  Nothing is appended if any series is invalid.
+//
+func (t *TimeSeries) AddLabeledValues(vals []LabeledValue, timestamp int64) error {
+	if t.readOnly {
+		return ErrReadOnly
+	}
+	valMap := make(map[string]float64, len(vals))
+	keys := make([]string, len(vals))
+	for i, v := range vals {
+		k, err := SeriesKey(v.Name, v.Labels)
+		if err != nil {
+			return err
+		}
+		keys[i] = k
+		valMap[k] = v.Value
+	}
+
+	t.labelsMu.Lock()
+	for i, v := range vals {
+		t.labels.add(keys[i], v.Name, v.Labels)
+	}
+	t.labelsMu.Unlock()
+	return t.AddValues(valMap, timestamp)
+}
+
+//
+// The keys of the labeled series named name (any name if empty)
+// having every one of the given labels, sorted.
+//
+func (t *TimeSeries) SelectSeries(name string, labels Labels) []string {
+	t.labelsMu.Lock()
+	defer t.labelsMu.Unlock()
+
+	var lists [][]string
+	if name != "" {
+		lists = append(lists, t.labels.Names[name])
+	}
+	for l, v := range labels {
+		lists = append(lists, t.labels.Postings[l][v])
+	}
+	if len(lists) == 0 {
+		keys := make([]string, 0, len(t.labels.known))
+		for k := range t.labels.known {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	// shortest first, so the intersection starts small
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+	res := append([]string(nil), lists[0]...)
+	for _, l := range lists[1:] {
+		res = intersectSorted(res, l)
+	}
+	return res
+}
+
+func intersectSorted(a, b []string) []string {
+	res := a[:0]
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			res = append(res, a[i])
+			i++
+			j++
+		}
+	}
+	return res
+}
+
+//
+// A filter for the series SelectSeries returns, for QueryOptions.
+// Series are looked up when the filter is made.
+//
+func (t *TimeSeries) LabelFilter(name string, labels Labels) *KeyFilter {
+	return Keys(t.SelectSeries(name, labels)...)
+}
+
+//
+// The values of label across all labeled series, sorted.
+//
+func (t *TimeSeries) LabelValues(label string) []string {
+	t.labelsMu.Lock()
+	defer t.labelsMu.Unlock()
+	vals := make([]string, 0, len(t.labels.Postings[label]))
+	for v := range t.labels.Postings[label] {
+		vals = append(vals, v)
+	}
+	sort.Strings(vals)
+	return vals
+}
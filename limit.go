@@ -0,0 +1,66 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"github.com/fred-lewis/tissa/internal"
+)
+
+// Returned (wrapped) by queries that would return more than
+// MaxQueryPoints intervals per series, or more than MaxQueryBytes.
+// Nothing is read.
+var ErrQueryTooLarge = errors.New("query too large")
+
+const rollupSize = int(unsafe.Sizeof(Rollup{}))
+
+//
+// Check a query of [startTime, endTime) at resolution against the
+// configured limits, with each value taking size bytes.  The series
+// counted are the keys listed in keys, or else every key in the
+// latest data, since there's no cheaper way to tell how many a
+// filter will match.
+//
+func (t *TimeSeries) checkQuerySize(startTime, endTime, resolution int64, keys *internal.KeySet, size int) error {
+	maxPoints, maxBytes := t.config.MaxQueryPoints, t.config.MaxQueryBytes
+	if (maxPoints <= 0 && maxBytes <= 0) || resolution <= 0 || endTime <= startTime {
+		return nil
+	}
+	points := (endTime - startTime + resolution - 1) / resolution
+	if maxPoints > 0 && points > maxPoints {
+		return fmt.Errorf("%w: %d intervals at resolution %d, limit %d", ErrQueryTooLarge,
+			points, resolution, maxPoints)
+	}
+	if maxBytes > 0 {
+		n, ok := keys.Len()
+		if !ok {
+			n = t.baseArchive().NumKeys()
+		}
+		if bytes := points * int64(n) * int64(size); bytes > maxBytes {
+			return fmt.Errorf("%w: about %d bytes at resolution %d, limit %d", ErrQueryTooLarge,
+				bytes, resolution, maxBytes)
+		}
+	}
+	return nil
+}
+
+//
+// The finest archive resolution, from resolution up, at which a query
+// of [startTime, endTime) is within the limits; resolution itself if
+// none is.
+//
+func (t *TimeSeries) fittingResolution(startTime, endTime, resolution int64, keys *internal.KeySet) int64 {
+	for _, a := range t.archives {
+		if a.Interval < resolution {
+			continue
+		}
+		if t.checkQuerySize(startTime, endTime, a.Interval, keys, 8) == nil {
+			return a.Interval
+		}
+	}
+	return resolution
+}
@@ -0,0 +1,86 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/fred-lewis/tissa/internal"
+)
+
+// Returned (wrapped) by NewTimeSeries and OpenTimeSeries when the
+// series is already open for writing, by another process or this
+// one.  Replicas (see OpenTimeSeriesReplica) don't lock, and can be
+// opened alongside it.
+var ErrLocked = internal.ErrLocked
+
+const lockFile = "lock"
+
+//
+// An advisory lock (flock) on a series' directory, held while the
+// series is open for writing, so no two TimeSeries, in one process
+// or several, append to the same files.
+//
+// While it's held, the lock file holds the process' pid, and it's
+// emptied when the series is closed, so finding it not empty when
+// the lock is taken means the last TimeSeries to have the series
+// open wasn't closed.
+//
+type dirLock struct {
+	file    *os.File
+	unclean bool
+}
+
+//
+// Lock the series in dir, failing with ErrLocked if it's open for
+// writing already.  Each lock is taken on a file of its own, so
+// they exclude each other within a process too.
+//
+func lockDir(dir string) (*dirLock, error) {
+	fp := filepath.Join(dir, lockFile)
+	f, err := os.OpenFile(fp, os.O_RDWR | os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = internal.LockFile(f); err != nil {
+		if pid, _ := os.ReadFile(fp); len(pid) > 0 {
+			err = fmt.Errorf("%w (process %s)", err, pid)
+		}
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", dir, err)
+	}
+	info, err := f.Stat()
+	if err == nil {
+		err = f.Truncate(0)
+	}
+	if err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &dirLock{ file: f, unclean: info.Size() > 0 }, nil
+}
+
+//
+// Unlock the directory.  If clean, the series was closed, rather
+// than abandoned part way through being opened or created.
+//
+func (l *dirLock) release(clean bool) error {
+	if l == nil {
+		return nil
+	}
+	var err error
+	if clean || !l.unclean {
+		err = l.file.Truncate(0)
+	}
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
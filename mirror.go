@@ -0,0 +1,238 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+//
+// A MirroredTimeSeries keeps two or more copies of a series, in
+// directories of their own (on a local disk and an NFS mount, say),
+// for cheap redundancy.  Every append and Write goes to each copy,
+// and every copy is tried even if others fail, so one unreachable
+// target doesn't stop the others; the errors are reported per target
+// in a MirrorError.
+//
+// Queries go to the first target that hasn't failed an append or a
+// Write since the mirror was opened, so they aren't served from a
+// copy with a gap in it.  A target that has failed can be brought
+// back in line by restoring a backup of a healthy one over it.
+//
+type MirroredTimeSeries struct {
+	targets []*TimeSeries
+	mu      sync.Mutex
+	failed  []bool
+}
+
+//
+// The errors from a mirrored operation, one per target in order, nil
+// for the targets it succeeded on.
+//
+type MirrorError struct {
+	Errs []error
+}
+
+func (e *MirrorError) Error() string {
+	var b strings.Builder
+	n := 0
+	for i, err := range e.Errs {
+		if err != nil {
+			if n > 0 {
+				b.WriteString("; ")
+			}
+			fmt.Fprintf(&b, "mirror %d: %v", i, err)
+			n++
+		}
+	}
+	return fmt.Sprintf("%d of %d mirrors failed: %s", n, len(e.Errs), b.String())
+}
+
+func (e *MirrorError) Unwrap() []error {
+	var errs []error
+	for _, err := range e.Errs {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+//
+// Construct a new MirroredTimeSeries with a copy in each of dirs,
+// each with the given configuration.
+//
+func NewMirroredTimeSeries(dirs []string, config TimeSeriesConfig) (*MirroredTimeSeries, error) {
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("a mirror needs at least one directory")
+	}
+	targets := make([]*TimeSeries, len(dirs))
+	for i, dir := range dirs {
+		// NewTimeSeries sorts the archives in place
+		c := config
+		c.Archives = append([]ArchiveConfig(nil), config.Archives...)
+		var err error
+		if targets[i], err = NewTimeSeries(dir, c); err != nil {
+			return nil, err
+		}
+	}
+	return Mirror(targets...), nil
+}
+
+//
+// Open the copies of a mirrored series in dirs.
+//
+func OpenMirroredTimeSeries(dirs ...string) (*MirroredTimeSeries, error) {
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("a mirror needs at least one directory")
+	}
+	targets := make([]*TimeSeries, len(dirs))
+	for i, dir := range dirs {
+		var err error
+		if targets[i], err = OpenTimeSeries(dir); err != nil {
+			return nil, err
+		}
+	}
+	return Mirror(targets...), nil
+}
+
+//
+// Mirror appends and writes to targets, already open.
+//
+func Mirror(targets ...*TimeSeries) *MirroredTimeSeries {
+	return &MirroredTimeSeries{ targets: targets, failed: make([]bool, len(targets)) }
+}
+
+//
+// The copies, in order.
+//
+func (m *MirroredTimeSeries) Targets() []*TimeSeries {
+	return m.targets
+}
+
+//
+// Run fn on each target, one at a time, or all at once if parallel,
+// noting the targets it fails on.
+//
+func (m *MirroredTimeSeries) each(parallel bool, fn func(*TimeSeries) error) error {
+	errs := make([]error, len(m.targets))
+	if parallel {
+		var wg sync.WaitGroup
+		for i, t := range m.targets {
+			wg.Add(1)
+			go func(i int, t *TimeSeries) {
+				defer wg.Done()
+				errs[i] = fn(t)
+			}(i, t)
+		}
+		wg.Wait()
+	} else {
+		for i, t := range m.targets {
+			errs[i] = fn(t)
+		}
+	}
+
+	failed := false
+	m.mu.Lock()
+	for i, err := range errs {
+		if err != nil {
+			m.failed[i], failed = true, true
+		}
+	}
+	m.mu.Unlock()
+	if !failed {
+		return nil
+	}
+	return &MirrorError{ Errs: errs }
+}
+
+//
+// Add a single key-value pair to every target, as
+// TimeSeries.AddValue does.
+//
+func (m *MirroredTimeSeries) AddValue(key string, val float64, timestamp int64) error {
+	return m.each(false, func(t *TimeSeries) error { return t.AddValue(key, val, timestamp) })
+}
+
+//
+// Add multiple key-value pairs to every target, as
+// TimeSeries.AddValues does.
+//
+func (m *MirroredTimeSeries) AddValues(vals map[string]float64, timestamp int64) error {
+	return m.each(false, func(t *TimeSeries) error { return t.AddValues(vals, timestamp) })
+}
+
+//
+// Add values for labeled series to every target, as
+// TimeSeries.AddLabeledValues does.
+//
+func (m *MirroredTimeSeries) AddLabeledValues(vals []LabeledValue, timestamp int64) error {
+	return m.each(false, func(t *TimeSeries) error { return t.AddLabeledValues(vals, timestamp) })
+}
+
+//
+// Set the metric type of key in every target.
+//
+func (m *MirroredTimeSeries) SetMetricType(key string, typ MetricType) error {
+	return m.each(false, func(t *TimeSeries) error { return t.SetMetricType(key, typ) })
+}
+
+//
+// Write every target, all at once, so a slow one doesn't hold the
+// others up.
+//
+func (m *MirroredTimeSeries) Write() error {
+	return m.each(true, (*TimeSeries).Write)
+}
+
+//
+// Close every target, all at once, as TimeSeries.Close does.
+//
+func (m *MirroredTimeSeries) Close() error {
+	return m.each(true, (*TimeSeries).Close)
+}
+
+//
+// Whether each target has failed an append or a Write since the
+// mirror was opened.
+//
+func (m *MirroredTimeSeries) Failed() []bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]bool(nil), m.failed...)
+}
+
+//
+// The target queries go to: the first that hasn't failed, or the
+// first if they all have.
+//
+func (m *MirroredTimeSeries) Reader() *TimeSeries {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, failed := range m.failed {
+		if !failed {
+			return m.targets[i]
+		}
+	}
+	return m.targets[0]
+}
+
+//
+// Query the series, as TimeSeries.Query does, from Reader().
+//
+func (m *MirroredTimeSeries) Query(startTime, endTime, resolution int64, agg Aggregation,
+	opts ...QueryOptions) (*Result, error) {
+
+	return m.Reader().Query(startTime, endTime, resolution, agg, opts...)
+}
+
+//
+// The latest values, as TimeSeries.Latest returns them, from
+// Reader().
+//
+func (m *MirroredTimeSeries) Latest() (map[string]float64, int64) {
+	return m.Reader().Latest()
+}
@@ -0,0 +1,167 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/fred-lewis/tissa/internal"
+)
+
+//
+// A named set of series within a DB, such as a tenant's, with its
+// own default configuration.  Series names are only unique within a
+// namespace, so tenants can't see or clash with each other's series.
+// A namespace's series are under "namespaces/<name>/series", its
+// defaults in "namespaces/<name>/namespace", and its Quota, if it
+// has one, in "namespaces/<name>/quota".
+//
+type Namespace struct {
+	*seriesSet
+	name string
+}
+
+// Returned (wrapped) by DB methods given a namespace that doesn't
+// exist.
+var ErrNoNamespace = errors.New("no such namespace")
+
+const (
+	namespacesDir = "namespaces"
+	namespaceFile = "namespace"
+)
+
+func (db *DB) namespacePath(name string) string {
+	return filepath.Join(db.dir, namespacesDir, name)
+}
+
+//
+// The namespace's name.
+//
+func (ns *Namespace) Name() string {
+	return ns.name
+}
+
+//
+// The configuration the namespace's series are created with, unless
+// created with CreateSeries.
+//
+func (ns *Namespace) Defaults() TimeSeriesConfig {
+	return ns.defaults
+}
+
+//
+// Create a namespace whose series are created with defaults.  Fails
+// if it already exists.
+//
+func (db *DB) CreateNamespace(name string, defaults TimeSeriesConfig) (*Namespace, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	db.nsMu.Lock()
+	defer db.nsMu.Unlock()
+	dir := db.namespacePath(name)
+	if _, err := os.Stat(dir); err == nil {
+		return nil, fmt.Errorf("namespace %q already exists", name)
+	}
+	if err := createSeriesSet(dir, namespaceFile, defaults); err != nil {
+		return nil, err
+	}
+	ns := &Namespace{ seriesSet: newSeriesSet(dir, defaults), name: name }
+	db.namespaces[name] = ns
+	return ns, nil
+}
+
+//
+// The named namespace, opened if need be; ErrNoNamespace if it
+// doesn't exist.
+//
+func (db *DB) Namespace(name string) (*Namespace, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	db.nsMu.Lock()
+	defer db.nsMu.Unlock()
+	if ns := db.namespaces[name]; ns != nil {
+		return ns, nil
+	}
+	dir := db.namespacePath(name)
+	var defaults TimeSeriesConfig
+	err := internal.ReadObject(filepath.Join(dir, namespaceFile), &defaults)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%q: %w", name, ErrNoNamespace)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ns := &Namespace{ seriesSet: newSeriesSet(dir, defaults), name: name }
+	var q Quota
+	err = internal.ReadObject(filepath.Join(dir, quotaFile), &q)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	ns.quota.Store(q)
+	if q.MaxKeys > 0 {
+		ns.countKeys()
+	}
+	if q.MaxDiskBytes > 0 {
+		if err = ns.usage.measure(dir); err != nil {
+			return nil, err
+		}
+	}
+	db.namespaces[name] = ns
+	return ns, nil
+}
+
+//
+// The names of all namespaces in the DB, sorted.
+//
+func (db *DB) Namespaces() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(db.dir, namespacesDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+//
+// Close the namespace's open series, as DB.Close does.
+//
+func (ns *Namespace) Close() error {
+	return ns.close()
+}
+
+//
+// Delete the named namespace, with all its series and their data.
+//
+func (db *DB) DeleteNamespace(name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	db.nsMu.Lock()
+	defer db.nsMu.Unlock()
+	dir := db.namespacePath(name)
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("%q: %w", name, ErrNoNamespace)
+	}
+	if ns := db.namespaces[name]; ns != nil {
+		// as for DeleteSeries, errors don't matter
+		ns.close()
+		delete(db.namespaces, name)
+	}
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,227 @@
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package nats adds values published on NATS subjects to a tissa.DB,
+for deployments already fanning telemetry out over NATS.  It works
+with any NATS client, through the Conn interface; with
+github.com/nats-io/nats.go, an adapter is a few lines around
+nc.Subscribe:
+
+	s := nats.NewSubscriber(db, conn)
+	s.Subscribe("telemetry.*")
+	defer s.Close()
+
+Messages hold values as the http package takes them posted, an
+object or an array of them:
+
+	{"timestamp": 1560632400, "values": {"web1": 0.5, "web2": 0.25}}
+
+where the timestamp defaults to now.  The series they're added to is
+named by the subject, by the Subscriber's Mapper; by default, the
+tokens of the subject that the subscription's wildcards matched,
+joined with dots, so a message on "telemetry.cpu" subscribed to as
+"telemetry.*" is added to the series "cpu", and one on
+"hosts.web1.cpu" subscribed to as "hosts.>" to "web1.cpu".  Series
+are created with the DB's defaults as needed.  Messages that can't
+be decoded or added are skipped and reported to OnError, if set.
+*/
+package nats
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fred-lewis/tissa"
+)
+
+// A message published on a subject.
+type Msg struct {
+	Subject string
+	Data    []byte
+}
+
+//
+// What a Subscriber needs of a NATS client.  Subscribe calls handler
+// with each message published on subjects matching subject, which
+// may have wildcards, until the subscription's unsubscribed.
+//
+type Conn interface {
+	Subscribe(subject string, handler func(Msg)) (Subscription, error)
+}
+
+type Subscription interface {
+	Unsubscribe() error
+}
+
+//
+// Maps the subject a message was published on, and the tokens of it
+// the subscription's wildcards matched, to the namespace ("" for
+// none) and series its values are added to.
+//
+type Mapper func(subject string, matched []string) (namespace, series string, err error)
+
+//
+// The matched tokens, joined with dots, name the series.
+//
+func DefaultMapper(subject string, matched []string) (namespace, series string, err error) {
+	if len(matched) == 0 {
+		return "", "", fmt.Errorf("subject %q matched no wildcards", subject)
+	}
+	return "", strings.Join(matched, "."), nil
+}
+
+type Subscriber struct {
+	db   *tissa.DB
+	conn Conn
+	// maps subjects; DefaultMapper if nil
+	Mapper Mapper
+	// called with each message that couldn't be added, if set
+	OnError func(error)
+
+	mu   sync.Mutex
+	subs []Subscription
+}
+
+func NewSubscriber(db *tissa.DB, conn Conn) *Subscriber {
+	return &Subscriber{ db: db, conn: conn }
+}
+
+//
+// Add the values published on subjects matching subject until the
+// Subscriber's closed.
+//
+func (s *Subscriber) Subscribe(subject string) error {
+	pattern := strings.Split(subject, ".")
+	sub, err := s.conn.Subscribe(subject, func(m Msg) {
+		s.report(s.handle(pattern, m))
+	})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.subs = append(s.subs, sub)
+	s.mu.Unlock()
+	return nil
+}
+
+//
+// Unsubscribe from everything, returning the first error.
+//
+func (s *Subscriber) Close() error {
+	s.mu.Lock()
+	subs := s.subs
+	s.subs = nil
+	s.mu.Unlock()
+	var firstErr error
+	for _, sub := range subs {
+		if err := sub.Unsubscribe(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (s *Subscriber) report(err error) {
+	if err != nil && s.OnError != nil {
+		s.OnError(err)
+	}
+}
+
+//
+// The tokens of subject matched by the wildcards in pattern: one for
+// each *, and the rest for a final >.
+//
+func matchWildcards(pattern []string, subject string) []string {
+	tokens := strings.Split(subject, ".")
+	var matched []string
+	for i, p := range pattern {
+		if i >= len(tokens) {
+			break
+		}
+		switch p {
+		case "*":
+			matched = append(matched, tokens[i])
+		case ">":
+			return append(matched, tokens[i:]...)
+		}
+	}
+	return matched
+}
+
+//
+// What a DB and its Namespaces have in common.
+//
+type seriesSet interface {
+	AddValues(name string, vals map[string]float64, timestamp int64) error
+}
+
+type published struct {
+	Timestamp *int64             `json:"timestamp"`
+	Values    map[string]float64 `json:"values"`
+}
+
+func (s *Subscriber) handle(pattern []string, m Msg) error {
+	mapper := s.Mapper
+	if mapper == nil {
+		mapper = DefaultMapper
+	}
+	namespace, series, err := mapper(m.Subject, matchWildcards(pattern, m.Subject))
+	if err != nil {
+		return err
+	}
+	points, err := decode(m.Data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", m.Subject, err)
+	}
+
+	var set seriesSet = s.db
+	if namespace != "" {
+		ns, err := s.db.Namespace(namespace)
+		if err != nil {
+			return fmt.Errorf("%s: %w", m.Subject, err)
+		}
+		set = ns
+	}
+	now := time.Now().Unix()
+	for _, p := range points {
+		timestamp := now
+		if p.Timestamp != nil {
+			timestamp = *p.Timestamp
+		}
+		if err = set.AddValues(series, p.Values, timestamp); err != nil {
+			return fmt.Errorf("%s: %w", m.Subject, err)
+		}
+	}
+	return nil
+}
+
+func decode(data []byte) ([]published, error) {
+	var raw json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	var points []published
+	if len(raw) > 0 && raw[0] == '[' {
+		if err := json.Unmarshal(raw, &points); err != nil {
+			return nil, err
+		}
+	} else {
+		var p published
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	for _, p := range points {
+		if len(p.Values) == 0 {
+			return nil, errors.New("no values")
+		}
+	}
+	return points, nil
+}
@@ -0,0 +1,120 @@
+package nats
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fred-lewis/tissa"
+)
+
+// Delivers published messages to matching subscriptions.
+type fakeConn struct {
+	subs map[string]func(Msg)
+}
+
+type fakeSub struct {
+	c       *fakeConn
+	subject string
+}
+
+func (c *fakeConn) Subscribe(subject string, handler func(Msg)) (Subscription, error) {
+	c.subs[subject] = handler
+	return &fakeSub{ c, subject }, nil
+}
+
+func (s *fakeSub) Unsubscribe() error {
+	delete(s.c.subs, s.subject)
+	return nil
+}
+
+func matches(pattern, subject string) bool {
+	p, s := strings.Split(pattern, "."), strings.Split(subject, ".")
+	for i := range p {
+		switch {
+		case p[i] == ">":
+			return len(s) > i
+		case i >= len(s) || (p[i] != "*" && p[i] != s[i]):
+			return false
+		}
+	}
+	return len(p) == len(s)
+}
+
+func (c *fakeConn) publish(subject, data string) {
+	for pattern, handler := range c.subs {
+		if matches(pattern, subject) {
+			handler(Msg{ Subject: subject, Data: []byte(data) })
+		}
+	}
+}
+
+func TestSubscriber(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/nats")
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+
+	db, err := tissa.NewDB("/tmp/timeseries_test/nats", tissa.TimeSeriesConfig{
+		Archives: []tissa.ArchiveConfig{
+			{Resolution: tissa.SECOND, Retention: tissa.HOUR},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &fakeConn{ subs: make(map[string]func(Msg)) }
+	s := NewSubscriber(db, conn)
+	var errs []error
+	s.OnError = func(err error) { errs = append(errs, err) }
+	if err = s.Subscribe("telemetry.*"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Subscribe("hosts.>"); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.publish("telemetry.cpu", `{"timestamp": 1560628800, "values": {"web1": 0.5}}`)
+	conn.publish("telemetry.cpu", `[{"timestamp": 1560628801, "values": {"web1": 0.75, "web2": 1}}]`)
+	conn.publish("hosts.web1.mem", `{"timestamp": 1560628800, "values": {"used": 1024}}`)
+	conn.publish("telemetry.cpu", `not json`)
+	conn.publish("telemetry.cpu", `{"timestamp": 1560628802}`)
+	if len(errs) != 2 {
+		t.Errorf("Expected 2 bad messages reported, got %v", errs)
+	}
+
+	ts, err := db.Series("cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vals, timestamp := ts.Latest(); timestamp != 1560628801 || vals["web1"] != 0.75 || vals["web2"] != 1 {
+		t.Errorf("Latest cpu was %v at %d", vals, timestamp)
+	}
+	ts, err = db.Series("web1.mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _, ok, _ := ts.LatestFor("used"); !ok || v != 1024 {
+		t.Errorf("Expected used 1024, got %g", v)
+	}
+
+	if _, err = db.CreateNamespace("acme", tissa.TimeSeriesConfig{
+		Archives: []tissa.ArchiveConfig{ {Resolution: tissa.SECOND, Retention: tissa.HOUR} },
+	}); err != nil {
+		t.Fatal(err)
+	}
+	s.Mapper = func(subject string, matched []string) (string, string, error) {
+		return "acme", matched[len(matched) - 1], nil
+	}
+	conn.publish("hosts.web2.disk", `{"timestamp": 1560628800, "values": {"free": 5}}`)
+	ns, _ := db.Namespace("acme")
+	if ts, err = ns.Series("disk"); err != nil {
+		t.Fatalf("Mapped series missing: %v", err)
+	}
+
+	s.Close()
+	if len(conn.subs) != 0 {
+		t.Errorf("Still subscribed to %d subjects", len(conn.subs))
+	}
+}
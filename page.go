@@ -0,0 +1,53 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Returned (wrapped) by QueryPage when a continuation token is
+// malformed or doesn't belong to the query it's passed to.
+var ErrBadPageToken = errors.New("bad page token")
+
+//
+// Like Query, but returning at most limit intervals of
+// [startTime, endTime), beginning where token says (the start, if
+// token is empty), along with the token for the next page ("" after
+// the last).  Pages are split on interval boundaries, so appending
+// them gives the same timestamps as one Query over the whole range,
+// but gap filling and Transforms only see one page at a time.
+//
+func (t *TimeSeries) QueryPage(startTime, endTime, resolution int64, agg Aggregation, limit int,
+	token string, opts ...QueryOptions) (res *Result, next string, err error) {
+
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("page limit must be positive, got %d", limit)
+	}
+	if resolution <= 0 {
+		return nil, "", fmt.Errorf("resolution must be positive, got %d", resolution)
+	}
+	// archives round the start up to the next interval
+	pageStart := startTime - startTime % resolution
+	if pageStart < startTime {
+		pageStart += resolution
+	}
+	if token != "" {
+		pageStart, err = strconv.ParseInt(token, 36, 64)
+		if err != nil || pageStart <= startTime || pageStart >= endTime || pageStart % resolution != 0 {
+			return nil, "", fmt.Errorf("%w: %q", ErrBadPageToken, token)
+		}
+	}
+
+	pageEnd := pageStart + int64(limit) * resolution
+	if pageEnd < endTime {
+		next = strconv.FormatInt(pageEnd, 36)
+	} else {
+		pageEnd = endTime
+	}
+	res, err = t.Query(pageStart, pageEnd, resolution, agg, opts...)
+	return res, next, err
+}
@@ -0,0 +1,648 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//
+// A subset of PromQL, over labeled series (see labels.go):
+//
+//	http_requests_total{job="api",code=~"5.."}
+//	rate(http_requests_total[5m])
+//	increase(errors[1h])
+//	sum by (region) (rate(http_requests_total[5m]))
+//	avg(cpu) by (host) * 100
+//	abs(a - b) / 2
+//
+// Selectors give each matching series' latest value in each step.
+// rate and increase take a range, which must be a multiple of the
+// step, and give the change from each series' latest value one range
+// back to its latest value now (allowing for counter resets), per
+// second for rate; there's no extrapolation.  The aggregations are
+// sum, avg, min, max and count, grouped by labels given with "by"
+// before or after the argument.  Arithmetic (+, -, *, /) works
+// between numbers, a vector and a number, or two vectors, whose
+// series are matched one-to-one by their labels.  As in Prometheus,
+// functions, aggregations and arithmetic drop series names.
+//
+
+const (
+	pqNumber = iota
+	pqSelector
+	pqCall
+	pqAggregate
+	pqBinary
+	pqNeg
+)
+
+var pqAggregations = map[string]Aggregation{
+	"sum": AGGREGATE_SUM,
+	"avg": AGGREGATE_AVERAGE,
+	"min": AGGREGATE_MIN,
+	"max": AGGREGATE_MAX,
+	"count": AGGREGATE_COUNT,
+}
+
+type pqNode struct {
+	kind     int
+	value    float64
+	// the series, function, aggregation or operator
+	name     string
+	matchers []*LabelMatcher
+	// the range of a range selector, in seconds
+	window   int64
+	by       []string
+	args     []*pqNode
+}
+
+type pqParser struct {
+	exprParser
+}
+
+func parsePromQL(src string) (*pqNode, error) {
+	p := &pqParser{ exprParser{ src: src } }
+	n, err := p.sum()
+	if err == nil && p.peek() != 0 {
+		err = p.errorf("unexpected %q", p.src[p.pos:])
+	}
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (p *pqParser) sum() (*pqNode, error) {
+	n, err := p.product()
+	for err == nil {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			break
+		}
+		p.pos++
+		var r *pqNode
+		r, err = p.product()
+		n = &pqNode{ kind: pqBinary, name: string(op), args: []*pqNode{ n, r } }
+	}
+	return n, err
+}
+
+func (p *pqParser) product() (*pqNode, error) {
+	n, err := p.unary()
+	for err == nil {
+		op := p.peek()
+		if op != '*' && op != '/' {
+			break
+		}
+		p.pos++
+		var r *pqNode
+		r, err = p.unary()
+		n = &pqNode{ kind: pqBinary, name: string(op), args: []*pqNode{ n, r } }
+	}
+	return n, err
+}
+
+func (p *pqParser) unary() (*pqNode, error) {
+	if p.peek() == '-' {
+		p.pos++
+		n, err := p.unary()
+		return &pqNode{ kind: pqNeg, args: []*pqNode{ n } }, err
+	}
+	return p.primary()
+}
+
+func (p *pqParser) ident() string {
+	p.skipSpace()
+	start := p.pos
+	if p.pos < len(p.src) && isIdentStart(p.src[p.pos]) {
+		for p.pos < len(p.src) && isIdentChar(p.src[p.pos]) {
+			p.pos++
+		}
+	}
+	return p.src[start:p.pos]
+}
+
+func (p *pqParser) expect(c byte) error {
+	if p.peek() != c {
+		return p.errorf("expected %q at %d", c, p.pos)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *pqParser) primary() (*pqNode, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		n, err := p.sum()
+		if err == nil {
+			err = p.expect(')')
+		}
+		return n, err
+	case c == '.' || (c >= '0' && c <= '9'):
+		e, err := p.exprParser.primary()
+		if err != nil {
+			return nil, err
+		}
+		return &pqNode{ kind: pqNumber, value: e.value }, nil
+	case c == '{':
+		return p.selector("")
+	case !isIdentStart(c):
+		return nil, p.errorf("unexpected %q", p.src[p.pos:])
+	}
+
+	name := p.ident()
+	if _, ok := pqAggregations[name]; ok {
+		return p.aggregation(name)
+	}
+	if p.peek() != '(' {
+		return p.selector(name)
+	}
+	p.pos++
+	n := &pqNode{ kind: pqCall, name: name }
+	arg, err := p.sum()
+	if err == nil {
+		err = p.expect(')')
+	}
+	if err != nil {
+		return nil, err
+	}
+	n.args = []*pqNode{ arg }
+	switch name {
+	case "rate", "increase":
+		if arg.kind != pqSelector || arg.window == 0 {
+			return nil, p.errorf("%s needs a range selector", name)
+		}
+	case "abs":
+		if arg.window > 0 {
+			return nil, p.errorf("abs of a range selector")
+		}
+	default:
+		return nil, p.errorf("unknown function %s", name)
+	}
+	return n, nil
+}
+
+func (p *pqParser) aggregation(name string) (*pqNode, error) {
+	n := &pqNode{ kind: pqAggregate, name: name }
+	var err error
+	if p.hasWord("by") {
+		n.by, err = p.labelList()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = p.expect('('); err != nil {
+		return nil, err
+	}
+	arg, err := p.sum()
+	if err == nil {
+		err = p.expect(')')
+	}
+	if err != nil {
+		return nil, err
+	}
+	n.args = []*pqNode{ arg }
+	if n.by == nil && p.hasWord("by") {
+		n.by, err = p.labelList()
+	}
+	return n, err
+}
+
+//
+// Whether the next word is w, consuming it if so.
+//
+func (p *pqParser) hasWord(w string) bool {
+	save := p.pos
+	if p.ident() == w {
+		return true
+	}
+	p.pos = save
+	return false
+}
+
+func (p *pqParser) labelList() ([]string, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	labels := []string{}
+	for p.peek() != ')' {
+		if len(labels) > 0 {
+			if err := p.expect(','); err != nil {
+				return nil, err
+			}
+		}
+		l := p.ident()
+		if !validLabelName(l) {
+			return nil, p.errorf("bad label name at %d", p.pos)
+		}
+		labels = append(labels, l)
+	}
+	p.pos++
+	return labels, nil
+}
+
+func (p *pqParser) selector(name string) (*pqNode, error) {
+	n := &pqNode{ kind: pqSelector, name: name }
+	if p.peek() == '{' {
+		p.pos++
+		for p.peek() != '}' {
+			if len(n.matchers) > 0 {
+				if err := p.expect(','); err != nil {
+					return nil, err
+				}
+			}
+			label := p.ident()
+			p.skipSpace()
+			var typ MatchType
+			ok := false
+			for _, op := range []string{ "=~", "!~", "!=", "=" } {
+				if strings.HasPrefix(p.src[p.pos:], op) {
+					typ, ok = matchOps[op], true
+					p.pos += len(op)
+					break
+				}
+			}
+			if !ok || !validLabelName(label) {
+				return nil, p.errorf("bad label matcher at %d", p.pos)
+			}
+			p.skipSpace()
+			q, err := strconv.QuotedPrefix(p.src[p.pos:])
+			if err != nil {
+				return nil, p.errorf("bad label value at %d", p.pos)
+			}
+			p.pos += len(q)
+			v, _ := strconv.Unquote(q)
+			m, err := NewLabelMatcher(label, typ, v)
+			if err != nil {
+				return nil, err
+			}
+			n.matchers = append(n.matchers, m)
+		}
+		p.pos++
+	}
+	if name == "" && len(n.matchers) == 0 {
+		return nil, p.errorf("empty selector")
+	}
+	if p.peek() == '[' {
+		p.pos++
+		p.skipSpace()
+		end := strings.IndexByte(p.src[p.pos:], ']')
+		if end < 0 {
+			return nil, p.errorf("missing ]")
+		}
+		w, err := parsePromDuration(strings.TrimSpace(p.src[p.pos:p.pos + end]))
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		n.window = w
+		p.pos += end + 1
+	}
+	return n, nil
+}
+
+//
+// A duration such as 30s, 5m, 1h30m, 2d or 1w, in seconds.
+//
+func parsePromDuration(s string) (int64, error) {
+	units := map[byte]int64{ 's': 1, 'm': MINUTE, 'h': HOUR, 'd': DAY, 'w': 7 * DAY }
+	var total int64
+	rest := s
+	for rest != "" {
+		i := 0
+		for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+			i++
+		}
+		if i == 0 || i == len(rest) || units[rest[i]] == 0 {
+			return 0, fmt.Errorf("bad duration %q", s)
+		}
+		n, _ := strconv.ParseInt(rest[:i], 10, 64)
+		total += n * units[rest[i]]
+		rest = rest[i + 1:]
+	}
+	if total <= 0 {
+		return 0, fmt.Errorf("bad duration %q", s)
+	}
+	return total, nil
+}
+
+type pqSeries struct {
+	name   string
+	labels Labels
+	vals   []float64
+}
+
+// A scalar, if scalar is set, or a vector of series.
+type pqValue struct {
+	scalar []float64
+	series []*pqSeries
+}
+
+type pqEval struct {
+	t         *TimeSeries
+	startTime int64
+	endTime   int64
+	step      int64
+	l         int
+	err       error
+}
+
+//
+//  Evaluate a PromQL query (see promql.go for the subset supported)
+//  over [startTime, endTime), at each step, which must be the
+//  resolution of an archive.  The Result has a series per series in
+//  the query's result, keyed as by SeriesKey (without a name if it
+//  was dropped, "{}" with no labels either, as for a number), with
+//  missing values NaN and marked in Missing.
+//
+func (t *TimeSeries) PromQL(query string, startTime, endTime, step int64) (*Result, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	n, err := parsePromQL(query)
+	if err != nil {
+		return nil, err
+	}
+	// the timestamps, which also checks the step
+	_, timestamps, err := t.query(startTime, endTime, step, averageOf, false,
+		[]QueryOptions{ { Keys: Keys(), Fill: FILL_NAN } })
+	if err != nil {
+		return nil, err
+	}
+
+	ev := &pqEval{ t: t, startTime: startTime, endTime: endTime, step: step, l: len(timestamps) }
+	v, err := ev.eval(n)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{
+		Resolution: step,
+		Timestamps: timestamps,
+		Values: make(map[string][]float64),
+		Missing: make(map[string][]bool),
+	}
+	add := func(key string, vals []float64) {
+		missing := make([]bool, len(vals))
+		for i := range vals {
+			missing[i] = math.IsNaN(vals[i])
+		}
+		res.Values[key] = vals
+		res.Missing[key] = missing
+	}
+	if v.scalar != nil {
+		add("{}", v.scalar)
+	}
+	for _, s := range v.series {
+		add(groupKey(s.name, s.labels), s.vals)
+	}
+	return res, ev.err
+}
+
+func (ev *pqEval) keep(err error) {
+	if ev.err == nil {
+		ev.err = err
+	}
+}
+
+func (ev *pqEval) eval(n *pqNode) (*pqValue, error) {
+	switch n.kind {
+	case pqNumber:
+		v := make([]float64, ev.l)
+		for i := range v {
+			v[i] = n.value
+		}
+		return &pqValue{ scalar: v }, nil
+	case pqSelector:
+		if n.window > 0 {
+			return nil, fmt.Errorf("range selector outside rate or increase")
+		}
+		return ev.instant(n)
+	case pqCall:
+		if n.name == "abs" {
+			v, err := ev.eval(n.args[0])
+			if err != nil {
+				return nil, err
+			}
+			v.each(func(s *pqSeries) { s.name = "" }, math.Abs)
+			return v, nil
+		}
+		return ev.increase(n.args[0], n.name == "rate")
+	case pqAggregate:
+		return ev.aggregate(n)
+	case pqNeg:
+		v, err := ev.eval(n.args[0])
+		if err != nil {
+			return nil, err
+		}
+		v.each(func(s *pqSeries) { s.name = "" }, func(x float64) float64 { return -x })
+		return v, nil
+	}
+	return ev.binary(n)
+}
+
+//
+// Apply fn to every value in v, and series to every series.
+//
+func (v *pqValue) each(series func(*pqSeries), fn func(float64) float64) {
+	apply := func(vals []float64) {
+		for i := range vals {
+			vals[i] = fn(vals[i])
+		}
+	}
+	apply(v.scalar)
+	for _, s := range v.series {
+		series(s)
+		apply(s.vals)
+	}
+}
+
+func (ev *pqEval) instant(n *pqNode) (*pqValue, error) {
+	keys := ev.t.Select(n.name, n.matchers...)
+	res, err := ev.t.queryResult(ev.startTime, ev.endTime, ev.step, AGGREGATE_LAST, []QueryOptions{{
+		Keys: Keys(keys...),
+		Fill: FILL_NAN,
+	}})
+	if res == nil {
+		return nil, err
+	}
+	ev.keep(err)
+	return ev.vector(res.Values), nil
+}
+
+//
+// The series in vals as a vector, sorted by key.
+//
+func (ev *pqEval) vector(vals map[string][]float64) *pqValue {
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	v := &pqValue{ series: []*pqSeries{} }
+	for _, k := range keys {
+		name, labels, err := ParseSeriesKey(k)
+		if err != nil {
+			continue
+		}
+		s := &pqSeries{ name: name, labels: labels, vals: make([]float64, ev.l) }
+		for i := range s.vals {
+			s.vals[i] = math.NaN()
+		}
+		copy(s.vals, vals[k])
+		v.series = append(v.series, s)
+	}
+	return v
+}
+
+func (ev *pqEval) increase(sel *pqNode, perSecond bool) (*pqValue, error) {
+	if sel.window % ev.step != 0 {
+		return nil, fmt.Errorf("range %ds is not a multiple of the step", sel.window)
+	}
+	back := int(sel.window / ev.step)
+	keys := ev.t.Select(sel.name, sel.matchers...)
+	// from one range back
+	vals, _, err := ev.t.walkData(nil, nil, ev.startTime - sel.window, ev.endTime, ev.step, latestOf, true, Keys(keys...))
+	if vals == nil && err != nil {
+		return nil, err
+	}
+	ev.keep(err)
+
+	out := make(map[string][]float64, len(vals))
+	for k, raw := range vals {
+		v := make([]float64, ev.l)
+		for i := range v {
+			v[i] = math.NaN()
+			prev := math.NaN()
+			total, n := 0.0, 0
+			for j := i; j <= i + back && j < len(raw); j++ {
+				if math.IsNaN(raw[j]) {
+					continue
+				}
+				if !math.IsNaN(prev) {
+					d := raw[j] - prev
+					if d < 0 {
+						// a counter reset
+						d = raw[j]
+					}
+					total += d
+				}
+				prev = raw[j]
+				n++
+			}
+			if n >= 2 {
+				v[i] = total
+				if perSecond {
+					v[i] /= float64(sel.window)
+				}
+			}
+		}
+		out[k] = v
+	}
+	res := ev.vector(out)
+	for _, s := range res.series {
+		s.name = ""
+	}
+	return res, nil
+}
+
+func (ev *pqEval) aggregate(n *pqNode) (*pqValue, error) {
+	arg, err := ev.eval(n.args[0])
+	if err != nil {
+		return nil, err
+	}
+	if arg.scalar != nil {
+		return nil, fmt.Errorf("%s of a number", n.name)
+	}
+	combine, err := lookupAggregation(pqAggregations[n.name])
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string][]Rollup)
+	for _, s := range arg.series {
+		gl := make(Labels, len(n.by))
+		for _, b := range n.by {
+			if lv, ok := s.labels[b]; ok {
+				gl[b] = lv
+			}
+		}
+		gk := groupKey("", gl)
+		g := groups[gk]
+		if g == nil {
+			g = make([]Rollup, ev.l)
+			groups[gk] = g
+		}
+		for i, x := range s.vals {
+			if !math.IsNaN(x) {
+				g[i].Add(x)
+			}
+		}
+	}
+
+	out := make(map[string][]float64, len(groups))
+	for gk, g := range groups {
+		v := make([]float64, ev.l)
+		for i := range g {
+			if g[i].Count == 0 {
+				v[i] = math.NaN()
+			} else {
+				v[i] = combine(g[i])
+			}
+		}
+		out[gk] = v
+	}
+	return ev.vector(out), nil
+}
+
+func (ev *pqEval) binary(n *pqNode) (*pqValue, error) {
+	l, err := ev.eval(n.args[0])
+	if err != nil {
+		return nil, err
+	}
+	r, err := ev.eval(n.args[1])
+	if err != nil {
+		return nil, err
+	}
+	op := n.name[0]
+	apply := func(a, b []float64) []float64 {
+		v := make([]float64, ev.l)
+		for i := range v {
+			v[i] = arith(op, a[i], b[i])
+		}
+		return v
+	}
+
+	switch {
+	case l.scalar != nil && r.scalar != nil:
+		return &pqValue{ scalar: apply(l.scalar, r.scalar) }, nil
+	case r.scalar != nil:
+		for _, s := range l.series {
+			s.name, s.vals = "", apply(s.vals, r.scalar)
+		}
+		return l, nil
+	case l.scalar != nil:
+		for _, s := range r.series {
+			s.name, s.vals = "", apply(l.scalar, s.vals)
+		}
+		return r, nil
+	}
+
+	// one-to-one, by labels
+	right := make(map[string]*pqSeries, len(r.series))
+	for _, s := range r.series {
+		right[groupKey("", s.labels)] = s
+	}
+	res := &pqValue{ series: []*pqSeries{} }
+	for _, s := range l.series {
+		if rs, ok := right[groupKey("", s.labels)]; ok {
+			res.series = append(res.series, &pqSeries{ labels: s.labels, vals: apply(s.vals, rs.vals) })
+		}
+	}
+	return res, nil
+}
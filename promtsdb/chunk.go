@@ -0,0 +1,256 @@
+package promtsdb
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+//
+// Chunk files are numbered from 000001 in the block's chunks
+// directory, each an 8-byte header, then chunks of
+//
+//	len <uvarint>, encoding <1 byte>, data <len bytes>, CRC32 <4 bytes>
+//
+// A chunk's reference is its file's number, less 1, in the upper 32
+// bits, and its offset in the file in the lower.
+//
+
+const (
+	chunksMagic = 0x85BD40DD
+	encodingXOR = 1
+	// the bits of the NaN Prometheus marks series gone stale with
+	staleNaN    = 0x7ff0000000000002
+)
+
+var errBadChunk = errors.New("bad chunk")
+
+type chunkFiles struct {
+	dir   string
+	files map[uint64]*os.File
+}
+
+func (cf *chunkFiles) Close() error {
+	var firstErr error
+	for _, f := range cf.files {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (cf *chunkFiles) file(seq uint64) (*os.File, error) {
+	if f, ok := cf.files[seq]; ok {
+		return f, nil
+	}
+	f, err := os.Open(filepath.Join(cf.dir, fmt.Sprintf("%06d", seq + 1)))
+	if err != nil {
+		return nil, err
+	}
+	var hdr [8]byte
+	if _, err = f.ReadAt(hdr[:], 0); err != nil || binary.BigEndian.Uint32(hdr[:]) != chunksMagic {
+		f.Close()
+		return nil, fmt.Errorf("%s: not a chunk file", f.Name())
+	}
+	cf.files[seq] = f
+	return f, nil
+}
+
+//
+// The encoding and data of the chunk at ref.
+//
+func (cf *chunkFiles) read(ref uint64) (byte, []byte, error) {
+	f, err := cf.file(ref >> 32)
+	if err != nil {
+		return 0, nil, err
+	}
+	off := int64(ref & 0xffffffff)
+	var hdr [binary.MaxVarintLen64 + 1]byte
+	n, err := f.ReadAt(hdr[:], off)
+	if err != nil && !(err == io.EOF && n > 0) {
+		return 0, nil, err
+	}
+	size, vn := binary.Uvarint(hdr[:n])
+	if vn <= 0 || vn >= n {
+		return 0, nil, fmt.Errorf("chunk %d: %w", ref, errBadChunk)
+	}
+	data := make([]byte, size)
+	if _, err = f.ReadAt(data, off + int64(vn) + 1); err != nil {
+		return 0, nil, fmt.Errorf("chunk %d: %w", ref, err)
+	}
+	return hdr[vn], data, nil
+}
+
+// Reads a stream of bits, most significant first.
+type bitReader struct {
+	data []byte
+	pos  uint
+}
+
+func (br *bitReader) readBit() (uint64, error) {
+	if br.pos >= uint(len(br.data)) * 8 {
+		return 0, errBadChunk
+	}
+	bit := br.data[br.pos / 8] >> (7 - br.pos % 8) & 1
+	br.pos++
+	return uint64(bit), nil
+}
+
+func (br *bitReader) readBits(n uint8) (uint64, error) {
+	var v uint64
+	for i := uint8(0); i < n; i++ {
+		bit, err := br.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v = v << 1 | bit
+	}
+	return v, nil
+}
+
+func (br *bitReader) ReadByte() (byte, error) {
+	b, err := br.readBits(8)
+	return byte(b), err
+}
+
+//
+// Decode an XOR chunk: a 2-byte sample count, then samples encoded
+// as in Facebook's Gorilla, with millisecond timestamps.  The first
+// sample is a varint timestamp and 64-bit value, the second the
+// uvarint delta from it and the value XORed with the first, and the
+// rest delta-of-deltas in a few sizes and XORed values.
+//
+func decodeXOR(data []byte) ([]int64, []float64, error) {
+	if len(data) < 2 {
+		return nil, nil, errBadChunk
+	}
+	num := int(binary.BigEndian.Uint16(data))
+	br := &bitReader{ data: data[2:] }
+	ts := make([]int64, 0, num)
+	vals := make([]float64, 0, num)
+
+	var t int64
+	var tDelta uint64
+	var v float64
+	var leading, trailing uint8
+	for i := 0; i < num; i++ {
+		switch i {
+		case 0:
+			first, err := binary.ReadVarint(br)
+			if err != nil {
+				return nil, nil, errBadChunk
+			}
+			bits, err := br.readBits(64)
+			if err != nil {
+				return nil, nil, err
+			}
+			t, v = first, math.Float64frombits(bits)
+			ts, vals = append(ts, t), append(vals, v)
+			continue
+		case 1:
+			d, err := binary.ReadUvarint(br)
+			if err != nil {
+				return nil, nil, errBadChunk
+			}
+			tDelta = d
+		default:
+			dod, err := readDod(br)
+			if err != nil {
+				return nil, nil, err
+			}
+			tDelta = uint64(int64(tDelta) + dod)
+		}
+		t += int64(tDelta)
+		if err := readXORValue(br, &v, &leading, &trailing); err != nil {
+			return nil, nil, err
+		}
+		ts, vals = append(ts, t), append(vals, v)
+	}
+	return ts, vals, nil
+}
+
+//
+// A delta-of-delta: 0 for 0, or 10, 110 or 1110 then 14, 17 or 20
+// bits, or 1111 then 64.
+//
+func readDod(br *bitReader) (int64, error) {
+	var prefix uint8
+	for i := 0; i < 4; i++ {
+		bit, err := br.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if bit == 0 {
+			break
+		}
+		prefix++
+	}
+	var size uint8
+	switch prefix {
+	case 0:
+		return 0, nil
+	case 1:
+		size = 14
+	case 2:
+		size = 17
+	case 3:
+		size = 20
+	default:
+		bits, err := br.readBits(64)
+		return int64(bits), err
+	}
+	bits, err := br.readBits(size)
+	if err != nil {
+		return 0, err
+	}
+	// negative numbers come back as large unsigned ones
+	if bits > 1 << (size - 1) {
+		bits -= 1 << size
+	}
+	return int64(bits), nil
+}
+
+//
+// A value XORed with the last: 0 if it's unchanged, 10 then the
+// meaningful bits if they fit in the last's leading and trailing
+// zeros, or 11, 5 bits of leading zeros, 6 of meaningful bits (0
+// meaning 64), and those bits.
+//
+func readXORValue(br *bitReader, v *float64, leading, trailing *uint8) error {
+	bit, err := br.readBit()
+	if err != nil || bit == 0 {
+		return err
+	}
+	if bit, err = br.readBit(); err != nil {
+		return err
+	}
+	if bit == 1 {
+		l, err := br.readBits(5)
+		if err != nil {
+			return err
+		}
+		m, err := br.readBits(6)
+		if err != nil {
+			return err
+		}
+		if m == 0 {
+			m = 64
+		}
+		*leading, *trailing = uint8(l), uint8(64 - l - m)
+	}
+	meaningful := 64 - *leading - *trailing
+	bits, err := br.readBits(meaningful)
+	if err != nil {
+		return err
+	}
+	*v = math.Float64frombits(math.Float64bits(*v) ^ bits << *trailing)
+	return nil
+}
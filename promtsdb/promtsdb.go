@@ -0,0 +1,378 @@
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package promtsdb imports the blocks Prometheus stores its data in
+into a tissa.TimeSeries, for archiving old Prometheus data in a far
+simpler format:
+
+	ts, _ := tissa.OpenTimeSeries("/var/lib/tissa/prometheus")
+	n, err := promtsdb.ImportBlock(ts, "/prometheus/data/01BKGV7JBM69T2G1BGBGM6KB12",
+		`http_requests_total{job="api"}`)
+
+A block is a directory holding an index of its series and the chunks
+of their samples.  The series matching a selector, as
+tissa.ParseSelector parses it, are added as labeled values, named by
+their __name__ label and labeled with the rest; an empty selector
+imports every series.  Samples from all of them are added in
+timestamp order, as AddValues would have added them as they came in,
+so they're rolled up into the series' rollup archives along the
+way.  Timestamps are cut from milliseconds to seconds, and the last
+sample a series has in a second is the one kept.
+
+Stale markers and native histogram chunks are skipped, and deletions
+recorded in the block's tombstones aren't applied.  Since a
+TimeSeries drops appends older than its latest data, blocks should be
+imported oldest first, into a series with nothing newer.
+*/
+package promtsdb
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/fred-lewis/tissa"
+)
+
+const (
+	indexMagic = 0xBAAAD700
+	indexV2    = 2
+	// six section offsets, then a CRC32
+	tocSize    = 6 * 8 + 4
+)
+
+var ErrBadIndex = errors.New("bad block index")
+
+// The chunks of a series: their time ranges, in milliseconds, and
+// references.
+type chunkMeta struct {
+	minTime, maxTime int64
+	ref              uint64
+}
+
+type series struct {
+	name   string
+	labels tissa.Labels
+	chunks []chunkMeta
+}
+
+//
+// Add the samples of the series in the block at dir matched by
+// selector to ts.  Returns the number of samples added.
+//
+func ImportBlock(ts *tissa.TimeSeries, dir, selector string) (int, error) {
+	name, matchers, err := tissa.ParseSelector(selector)
+	if err != nil {
+		return 0, err
+	}
+	index, err := os.ReadFile(filepath.Join(dir, "index"))
+	if err != nil {
+		return 0, err
+	}
+	all, err := readIndex(index)
+	if err != nil {
+		return 0, err
+	}
+	var selected []*series
+	for _, s := range all {
+		if matchesAll(s, name, matchers) {
+			selected = append(selected, s)
+		}
+	}
+
+	cf := &chunkFiles{ dir: filepath.Join(dir, "chunks"), files: make(map[uint64]*os.File) }
+	defer cf.Close()
+	return merge(ts, cf, selected)
+}
+
+func matchesAll(s *series, name string, matchers []*tissa.LabelMatcher) bool {
+	if s.name == "" || name != "" && s.name != name {
+		return false
+	}
+	for _, m := range matchers {
+		if !m.Matches(s.labels) {
+			return false
+		}
+	}
+	return true
+}
+
+//
+// Read the series from an index: a magic number and version, then
+// sections located by the table of contents at the end.  Only the
+// symbol table, of the strings labels are made of, and the series,
+// are needed.
+//
+func readIndex(b []byte) ([]*series, error) {
+	if len(b) < 5 + tocSize || binary.BigEndian.Uint32(b) != indexMagic {
+		return nil, ErrBadIndex
+	}
+	if b[4] != indexV2 {
+		return nil, fmt.Errorf("index version %d isn't supported: %w", b[4], ErrBadIndex)
+	}
+	var toc [6]uint64
+	for i := range toc {
+		toc[i] = binary.BigEndian.Uint64(b[len(b) - tocSize + 8 * i:])
+	}
+	symbols, err := readSymbols(b, toc[0])
+	if err != nil {
+		return nil, err
+	}
+	// the series run up to the next section
+	start, end := toc[1], uint64(len(b) - tocSize)
+	for _, off := range toc[2:] {
+		if off > start && off < end {
+			end = off
+		}
+	}
+	if start == 0 || start > end {
+		return nil, ErrBadIndex
+	}
+
+	var res []*series
+	for pos := start; pos < end; {
+		// each series is 16-byte aligned, so its reference is its offset / 16
+		pos = (pos + 15) / 16 * 16
+		if pos >= end {
+			break
+		}
+		size, n := binary.Uvarint(b[pos:end])
+		if n <= 0 || size == 0 || pos + uint64(n) + size > end {
+			return nil, fmt.Errorf("series at %d: %w", pos, ErrBadIndex)
+		}
+		s, err := readSeries(b[pos + uint64(n):pos + uint64(n) + size], symbols)
+		if err != nil {
+			return nil, fmt.Errorf("series at %d: %w", pos, err)
+		}
+		res = append(res, s)
+		// and a CRC32
+		pos += uint64(n) + size + 4
+	}
+	return res, nil
+}
+
+//
+// The symbol table: its length and the number of symbols, then each
+// as a uvarint length and its bytes.
+//
+func readSymbols(b []byte, off uint64) ([]string, error) {
+	if off == 0 || off + 8 > uint64(len(b)) {
+		return nil, ErrBadIndex
+	}
+	count := int(binary.BigEndian.Uint32(b[off + 4:]))
+	p := b[off + 8:]
+	symbols := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		n, vn := binary.Uvarint(p)
+		if vn <= 0 || uint64(vn) + n > uint64(len(p)) {
+			return nil, fmt.Errorf("symbol %d: %w", i, ErrBadIndex)
+		}
+		symbols = append(symbols, string(p[vn:uint64(vn) + n]))
+		p = p[uint64(vn) + n:]
+	}
+	return symbols, nil
+}
+
+// Reads uvarints and varints, remembering the first failure.
+type varints struct {
+	b   []byte
+	err error
+}
+
+func (d *varints) uvarint() uint64 {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = ErrBadIndex
+		d.b = nil
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *varints) varint() int64 {
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = ErrBadIndex
+		d.b = nil
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+//
+// A series: its labels, as pairs of symbol references, then its
+// chunks.  The first chunk's minimum time is a varint, and every
+// other's the uvarint time since the last one's maximum; maximum
+// times are uvarints since their chunk's minimum; the first
+// reference is a uvarint, and the rest varints from the last.
+//
+func readSeries(b []byte, symbols []string) (*series, error) {
+	d := &varints{ b: b }
+	s := &series{ labels: make(tissa.Labels) }
+	symbol := func() string {
+		ref := d.uvarint()
+		if ref >= uint64(len(symbols)) {
+			d.err = ErrBadIndex
+			return ""
+		}
+		return symbols[ref]
+	}
+	for n := d.uvarint(); n > 0 && d.err == nil; n-- {
+		l, v := symbol(), symbol()
+		if l == "__name__" {
+			s.name = v
+		} else {
+			s.labels[l] = v
+		}
+	}
+	n := d.uvarint()
+	var last chunkMeta
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		var c chunkMeta
+		if i == 0 {
+			c.minTime = d.varint()
+			c.maxTime = c.minTime + int64(d.uvarint())
+			c.ref = d.uvarint()
+		} else {
+			c.minTime = last.maxTime + int64(d.uvarint())
+			c.maxTime = c.minTime + int64(d.uvarint())
+			c.ref = uint64(int64(last.ref) + d.varint())
+		}
+		s.chunks = append(s.chunks, c)
+		last = c
+	}
+	return s, d.err
+}
+
+//
+// A series' samples, a chunk at a time.
+//
+type cursor struct {
+	*series
+	chunk int
+	ts    []int64
+	vals  []float64
+	i     int
+}
+
+//
+// Move to the next sample, reading chunks as needed.  Returns false
+// when the series has no more.
+//
+func (c *cursor) next(cf *chunkFiles) (bool, error) {
+	c.i++
+	for c.i >= len(c.ts) {
+		if c.chunk >= len(c.chunks) {
+			return false, nil
+		}
+		enc, data, err := cf.read(c.chunks[c.chunk].ref)
+		c.chunk++
+		if err != nil {
+			return false, err
+		}
+		c.ts, c.vals, c.i = nil, nil, 0
+		if enc != encodingXOR {
+			// native histograms
+			continue
+		}
+		if c.ts, c.vals, err = decodeXOR(data); err != nil {
+			return false, fmt.Errorf("%s%v: %w", c.name, c.labels, err)
+		}
+	}
+	return true, nil
+}
+
+// Cursors ordered by their current sample's time.
+type cursors []*cursor
+
+func (h cursors) Len() int            { return len(h) }
+func (h cursors) Less(i, j int) bool  { return h[i].ts[h[i].i] < h[j].ts[h[j].i] }
+func (h cursors) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *cursors) Push(x interface{}) { *h = append(*h, x.(*cursor)) }
+func (h *cursors) Pop() interface{} {
+	old := *h
+	c := old[len(old) - 1]
+	*h = old[:len(old) - 1]
+	return c
+}
+
+//
+// Add the samples of every series to ts in time order, a second at
+// a time.
+//
+func merge(ts *tissa.TimeSeries, cf *chunkFiles, selected []*series) (int, error) {
+	h := make(cursors, 0, len(selected))
+	for _, s := range selected {
+		c := &cursor{ series: s, i: -1 }
+		ok, err := c.next(cf)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			h = append(h, c)
+		}
+	}
+	heap.Init(&h)
+
+	added := 0
+	second := int64(math.MinInt64)
+	batch := make(map[*cursor]float64)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		vals := make([]tissa.LabeledValue, 0, len(batch))
+		for c, v := range batch {
+			vals = append(vals, tissa.LabeledValue{ Name: c.name, Labels: c.labels, Value: v })
+		}
+		added += len(vals)
+		for c := range batch {
+			delete(batch, c)
+		}
+		return ts.AddLabeledValues(vals, second)
+	}
+
+	for len(h) > 0 {
+		c := h[0]
+		t, v := c.ts[c.i], c.vals[c.i]
+		if s := floorDiv(t, 1000); s != second {
+			if err := flush(); err != nil {
+				return added, err
+			}
+			second = s
+		}
+		if math.Float64bits(v) != staleNaN {
+			batch[c] = v
+		}
+
+		ok, err := c.next(cf)
+		if err != nil {
+			return added, err
+		}
+		if ok {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+	}
+	if err := flush(); err != nil {
+		return added, err
+	}
+	return added, ts.Write()
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a % b < 0 {
+		q--
+	}
+	return q
+}
@@ -0,0 +1,303 @@
+package promtsdb
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/fred-lewis/tissa"
+)
+
+type bitWriter struct {
+	buf []byte
+	n   uint
+}
+
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n % 8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if v >> uint(i) & 1 == 1 {
+			w.buf[len(w.buf) - 1] |= 1 << (7 - w.n % 8)
+		}
+		w.n++
+	}
+}
+
+func (w *bitWriter) writeBytes(b []byte) {
+	for _, c := range b {
+		w.writeBits(uint64(c), 8)
+	}
+}
+
+// An XOR chunk, encoded as Prometheus' appender encodes it.
+func encodeXOR(ts []int64, vals []float64) []byte {
+	w := &bitWriter{}
+	var tDelta uint64
+	leading, trailing := uint8(0xff), uint8(0)
+	var buf [binary.MaxVarintLen64]byte
+	for i := range ts {
+		switch i {
+		case 0:
+			w.writeBytes(buf[:binary.PutVarint(buf[:], ts[0])])
+			w.writeBits(math.Float64bits(vals[0]), 64)
+			continue
+		case 1:
+			tDelta = uint64(ts[1] - ts[0])
+			w.writeBytes(buf[:binary.PutUvarint(buf[:], tDelta)])
+		default:
+			d := uint64(ts[i] - ts[i - 1])
+			dod := int64(d - tDelta)
+			tDelta = d
+			inRange := func(n uint) bool { return -(1 << (n - 1) - 1) <= dod && dod <= 1 << (n - 1) }
+			switch {
+			case dod == 0:
+				w.writeBits(0, 1)
+			case inRange(14):
+				w.writeBits(0x2, 2)
+				w.writeBits(uint64(dod), 14)
+			case inRange(17):
+				w.writeBits(0x6, 3)
+				w.writeBits(uint64(dod), 17)
+			case inRange(20):
+				w.writeBits(0xe, 4)
+				w.writeBits(uint64(dod), 20)
+			default:
+				w.writeBits(0xf, 4)
+				w.writeBits(uint64(dod), 64)
+			}
+		}
+		delta := math.Float64bits(vals[i]) ^ math.Float64bits(vals[i - 1])
+		if delta == 0 {
+			w.writeBits(0, 1)
+			continue
+		}
+		w.writeBits(1, 1)
+		l, t := uint8(bits.LeadingZeros64(delta)), uint8(bits.TrailingZeros64(delta))
+		if l >= 32 {
+			l = 31
+		}
+		if leading != 0xff && l >= leading && t >= trailing {
+			w.writeBits(0, 1)
+			w.writeBits(delta >> trailing, int(64 - leading - trailing))
+			continue
+		}
+		leading, trailing = l, t
+		w.writeBits(1, 1)
+		w.writeBits(uint64(l), 5)
+		w.writeBits(uint64(64 - l - t), 6)
+		w.writeBits(delta >> t, int(64 - l - t))
+	}
+	res := make([]byte, 2, 2 + len(w.buf))
+	binary.BigEndian.PutUint16(res, uint16(len(ts)))
+	return append(res, w.buf...)
+}
+
+type testSeries struct {
+	labels map[string]string
+	// chunks of samples
+	ts     [][]int64
+	vals   [][]float64
+}
+
+// Write a block of series to dir.
+func writeBlock(t *testing.T, dir string, series []testSeries) {
+	os.MkdirAll(filepath.Join(dir, "chunks"), os.ModePerm)
+	chunks := []byte{ 0x85, 0xbd, 0x40, 0xdd, 1, 0, 0, 0 }
+	var refs [][]uint64
+	for _, s := range series {
+		var r []uint64
+		for i := range s.ts {
+			r = append(r, uint64(len(chunks)))
+			data := encodeXOR(s.ts[i], s.vals[i])
+			chunks = binary.AppendUvarint(chunks, uint64(len(data)))
+			chunks = append(chunks, encodingXOR)
+			chunks = append(chunks, data...)
+			chunks = append(chunks, 0, 0, 0, 0)
+		}
+		refs = append(refs, r)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "chunks", "000001"), chunks, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[string]bool{}
+	for _, s := range series {
+		for l, v := range s.labels {
+			seen[l], seen[v] = true, true
+		}
+	}
+	var symbols []string
+	for s := range seen {
+		symbols = append(symbols, s)
+	}
+	sort.Strings(symbols)
+	ref := make(map[string]uint64)
+	for i, s := range symbols {
+		ref[s] = uint64(i)
+	}
+
+	var idx bytes.Buffer
+	idx.Write([]byte{ 0xba, 0xaa, 0xd7, 0x00, indexV2 })
+	var toc [6]uint64
+	toc[0] = uint64(idx.Len())
+	var sym []byte
+	for _, s := range symbols {
+		sym = binary.AppendUvarint(sym, uint64(len(s)))
+		sym = append(sym, s...)
+	}
+	binary.Write(&idx, binary.BigEndian, []uint32{ uint32(len(sym) + 4), uint32(len(symbols)) })
+	idx.Write(sym)
+	idx.Write([]byte{ 0, 0, 0, 0 })
+
+	toc[1] = uint64(idx.Len())
+	for i, s := range series {
+		for idx.Len() % 16 != 0 {
+			idx.WriteByte(0)
+		}
+		var names []string
+		for l := range s.labels {
+			names = append(names, l)
+		}
+		sort.Strings(names)
+		e := binary.AppendUvarint(nil, uint64(len(names)))
+		for _, l := range names {
+			e = binary.AppendUvarint(e, ref[l])
+			e = binary.AppendUvarint(e, ref[s.labels[l]])
+		}
+		e = binary.AppendUvarint(e, uint64(len(s.ts)))
+		var lastMax int64
+		for j, ts := range s.ts {
+			min, max := ts[0], ts[len(ts) - 1]
+			if j == 0 {
+				e = binary.AppendVarint(e, min)
+				e = binary.AppendUvarint(e, uint64(max - min))
+				e = binary.AppendUvarint(e, refs[i][0])
+			} else {
+				e = binary.AppendUvarint(e, uint64(min - lastMax))
+				e = binary.AppendUvarint(e, uint64(max - min))
+				e = binary.AppendVarint(e, int64(refs[i][j] - refs[i][j - 1]))
+			}
+			lastMax = max
+		}
+		idx.Write(binary.AppendUvarint(nil, uint64(len(e))))
+		idx.Write(e)
+		idx.Write([]byte{ 0, 0, 0, 0 })
+	}
+	// the label indices and postings, which aren't read
+	for i := 2; i < 6; i++ {
+		toc[i] = uint64(idx.Len())
+	}
+	binary.Write(&idx, binary.BigEndian, toc)
+	idx.Write([]byte{ 0, 0, 0, 0 })
+	if err := os.WriteFile(filepath.Join(dir, "index"), idx.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecodeXOR(t *testing.T) {
+	ts := []int64{ 1000, 16000, 31000, 46005, 60000, 61000, 1000000, 1000001 }
+	vals := []float64{ 1, 1, 2.5, -7, 1e100, math.Inf(1), 0.1, 0.1 }
+	gotTs, gotVals, err := decodeXOR(encodeXOR(ts, vals))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(gotTs, gotVals) != fmt.Sprint(ts, vals) {
+		t.Errorf("Decoded %v %v", gotTs, gotVals)
+	}
+	if _, _, err = decodeXOR([]byte{ 0, 5, 1 }); !errors.Is(err, errBadChunk) {
+		t.Errorf("Truncated chunk gave %v", err)
+	}
+}
+
+func TestImportBlock(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/promtsdb")
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+	block := "/tmp/timeseries_test/promtsdb/block"
+
+	start := int64(1560628800)
+	ms := func(s int64) int64 { return (start + s) * 1000 }
+	writeBlock(t, block, []testSeries{
+		{
+			labels: map[string]string{ "__name__": "up", "job": "api" },
+			ts: [][]int64{ { ms(0), ms(15), ms(30) }, { ms(45), ms(60) } },
+			vals: [][]float64{ { 1, 1, 0 }, { 1, math.Float64frombits(staleNaN) } },
+		},
+		{
+			labels: map[string]string{ "__name__": "up", "job": "db" },
+			// two samples in a second; the last is kept
+			ts: [][]int64{ { ms(0), ms(0) + 500, ms(30), ms(61) } },
+			vals: [][]float64{ { 3, 4, 5, 6 } },
+		},
+		{
+			labels: map[string]string{ "__name__": "requests_total", "job": "api" },
+			ts: [][]int64{ { ms(0) } },
+			vals: [][]float64{ { 100 } },
+		},
+	})
+
+	ts, err := tissa.NewTimeSeries("/tmp/timeseries_test/promtsdb/series", tissa.TimeSeriesConfig{
+		Archives: []tissa.ArchiveConfig{
+			{Resolution: tissa.SECOND, Retention: tissa.HOUR},
+			{Resolution: tissa.MINUTE, Retention: tissa.DAY},
+		},
+		CarryForwardTicks: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := ImportBlock(ts, block, `up{job=~"api|db"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the stale marker, and the first of the two in a second, aren't added
+	if n != 7 {
+		t.Errorf("Added %d samples", n)
+	}
+
+	api, db := `up{job="api"}`, `up{job="db"}`
+	if keys := ts.Keys(); fmt.Sprint(keys) != fmt.Sprint([]string{ api, db }) {
+		t.Errorf("Keys were %v", keys)
+	}
+	if sel := ts.SelectSeries("up", tissa.Labels{ "job": "db" }); len(sel) != 1 {
+		t.Errorf("Labeled series were %v", sel)
+	}
+	res, err := ts.Query(start, start + 61, tissa.SECOND, tissa.AGGREGATE_AVERAGE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := res.Values[api]; v[15] != 1 || v[30] != 0 || v[45] != 1 || !res.Missing[api][60] {
+		t.Errorf("api was %v", v)
+	}
+	if v := res.Values[db]; v[0] != 4 || v[30] != 5 {
+		t.Errorf("db was %v", v)
+	}
+	// rolled up as they were added, once past the minute, and stamped
+	// with its end
+	rollups, _, err := ts.Rollups(start + 60, start + 120, tissa.MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := rollups[api]; len(r) != 1 || r[0].Count != 4 || r[0].Total != 3 {
+		t.Errorf("api rolled up to %+v", r)
+	}
+
+	if _, err = ImportBlock(ts, "/tmp/timeseries_test/promtsdb/series", ""); err == nil {
+		t.Error("Imported a directory without an index")
+	}
+	os.WriteFile("/tmp/timeseries_test/promtsdb/index", make([]byte, 100), 0600)
+	if _, err = ImportBlock(ts, "/tmp/timeseries_test/promtsdb", ""); !errors.Is(err, ErrBadIndex) {
+		t.Errorf("Bad index gave %v", err)
+	}
+}
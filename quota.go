@@ -0,0 +1,232 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fred-lewis/tissa/internal"
+)
+
+//
+// Limits on a series (TimeSeriesConfig.Quota) or on all the series
+// in a Namespace together (Namespace.SetQuota); 0 means no limit.
+// Appends that would break a limit fail with ErrQuotaExceeded, and
+// nothing is appended.
+//
+// MaxKeys is the number of keys with data in the latest chunk of the
+// base archive; keys already there can still be appended to.
+// MaxDiskBytes is the size of the files on disk as of the last
+// Write; once it's reached, appends fail until retention frees
+// space.  MaxWriteRate is the number of values appended per second,
+// allowing bursts of up to a second's worth.
+//
+type Quota struct {
+	MaxKeys      int
+	MaxDiskBytes int64
+	MaxWriteRate float64
+}
+
+// Returned (wrapped) by appends that would exceed a Quota.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+const quotaFile = "quota"
+
+func (q Quota) isZero() bool {
+	return q == Quota{}
+}
+
+//
+// Usage counted against a Quota.
+//
+type quotaState struct {
+	mu        sync.Mutex
+	tokens    float64
+	last      time.Time
+	diskBytes int64
+	// the keys held, kept as a running count for namespaces
+	keys      int
+}
+
+//
+// Check an append of n values at now, newKeys of them for keys not
+// yet held, against q, given held keys.  Nothing is spent; s.mu must
+// be held.
+//
+func (s *quotaState) check(q Quota, held, newKeys, n int, now time.Time) error {
+	if q.MaxKeys > 0 && newKeys > 0 && held + newKeys > q.MaxKeys {
+		return fmt.Errorf("%w: %d keys, limit %d", ErrQuotaExceeded, held + newKeys, q.MaxKeys)
+	}
+	if q.MaxDiskBytes > 0 && s.diskBytes >= q.MaxDiskBytes {
+		return fmt.Errorf("%w: %d bytes on disk, limit %d", ErrQuotaExceeded, s.diskBytes, q.MaxDiskBytes)
+	}
+	if q.MaxWriteRate > 0 && float64(n) > s.available(q, now) {
+		return fmt.Errorf("%w: more than %g values per second", ErrQuotaExceeded, q.MaxWriteRate)
+	}
+	return nil
+}
+
+//
+// The write rate tokens there are at now.
+//
+func (s *quotaState) available(q Quota, now time.Time) float64 {
+	if s.last.IsZero() {
+		return q.MaxWriteRate
+	}
+	tokens := s.tokens + now.Sub(s.last).Seconds() * q.MaxWriteRate
+	if tokens > q.MaxWriteRate {
+		tokens = q.MaxWriteRate
+	}
+	return tokens
+}
+
+//
+// Spend the tokens for an append of n values that check allowed.
+// s.mu must be held.
+//
+func (s *quotaState) spend(q Quota, n int, now time.Time) {
+	if q.MaxWriteRate > 0 {
+		s.tokens = s.available(q, now) - float64(n)
+		s.last = now
+	}
+}
+
+func (s *quotaState) addKeys(n int) {
+	s.mu.Lock()
+	s.keys += n
+	s.mu.Unlock()
+}
+
+//
+// Record the size of the files under dir.
+//
+func (s *quotaState) measure(dir string) error {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				// removed by retention as we walked
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			if info, ierr := d.Info(); ierr == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	s.mu.Lock()
+	s.diskBytes = size
+	s.mu.Unlock()
+	return err
+}
+
+//
+// Check an append of vals against the series' quota and its
+// namespace's, spending from them only if both allow it.
+//
+func (t *TimeSeries) admit(vals map[string]float64) error {
+	q := t.config.Quota
+	g := t.group
+	var gq Quota
+	if g != nil {
+		gq = g.getQuota()
+	}
+	if q.isZero() && gq.isZero() {
+		return nil
+	}
+	base := t.baseArchive()
+	newKeys := 0
+	for k := range vals {
+		if !base.HasKey(k) {
+			newKeys++
+		}
+	}
+	now := time.Now()
+	// always the series' state first, then the namespace's
+	t.quota.mu.Lock()
+	defer t.quota.mu.Unlock()
+	if !q.isZero() {
+		if err := t.quota.check(q, base.NumKeys(), newKeys, len(vals), now); err != nil {
+			return err
+		}
+	}
+	if !gq.isZero() {
+		g.usage.mu.Lock()
+		defer g.usage.mu.Unlock()
+		if err := g.usage.check(gq, g.usage.keys, newKeys, len(vals), now); err != nil {
+			return err
+		}
+		g.usage.spend(gq, len(vals), now)
+	}
+	t.quota.spend(q, len(vals), now)
+	return nil
+}
+
+//
+// Limit the namespace's series together to q, replacing any earlier
+// quota.  The quota is saved with the namespace.  Setting MaxKeys
+// opens every series in the namespace to count their keys; from
+// then on the count is kept up to date as values are appended.
+//
+func (ns *Namespace) SetQuota(q Quota) error {
+	err := internal.WriteObject(filepath.Join(ns.dir, quotaFile), q)
+	if err != nil {
+		return err
+	}
+	if q.MaxKeys > 0 {
+		ns.countKeys()
+	}
+	ns.quota.Store(q)
+	if q.MaxDiskBytes > 0 {
+		return ns.usage.measure(ns.dir)
+	}
+	return nil
+}
+
+//
+// The namespace's quota.
+//
+func (ns *Namespace) Quota() Quota {
+	return ns.getQuota()
+}
+
+func (s *seriesSet) getQuota() Quota {
+	q, _ := s.quota.Load().(Quota)
+	return q
+}
+
+//
+// Count the keys held by all the set's series, opening them if need
+// be.
+//
+func (s *seriesSet) countKeys() {
+	names, _ := s.Names()
+	keys := 0
+	for _, name := range names {
+		if ts, err := s.Series(name); err == nil {
+			keys += ts.numKeys()
+		}
+	}
+	s.usage.mu.Lock()
+	s.usage.keys = keys
+	s.usage.mu.Unlock()
+}
+
+//
+// The keys with data in the latest chunk of the base archive.
+//
+func (t *TimeSeries) numKeys() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.baseArchive().NumKeys()
+}
@@ -0,0 +1,190 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/fred-lewis/tissa/internal"
+)
+
+//
+// Recording rules store the value of an expression (see expr.go) as
+// a key of its own, computed as data is added, so it gets rollups
+// and can be queried like any other key.  Whenever an append at the
+// base resolution includes a key a rule refers to, the rule is
+// evaluated against the latest values of its keys in that interval
+// (so they may come from separate AddValue calls), and stored if
+// every key has a value there and the result is a finite number.
+// Rules are saved in the "recording" file and apply from when they
+// are added; they don't fill in earlier data.
+//
+
+const recordingFile = "recording"
+
+// A recording rule, as saved.
+type recordingRule struct {
+	Key  string
+	Expr string
+	expr *expr
+	refs map[string]bool
+}
+
+func newRecordingRule(key, src string) (*recordingRule, error) {
+	e, err := parseExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	r := &recordingRule{ Key: key, Expr: src, expr: e, refs: make(map[string]bool) }
+	if e.hasCalls() {
+		return nil, fmt.Errorf("recording rule for %q calls a function", key)
+	}
+	e.keys(r.refs)
+	if r.refs[key] {
+		return nil, fmt.Errorf("recording rule for %q refers to itself", key)
+	}
+	return r, nil
+}
+
+func readRecordingRules(dir string) ([]*recordingRule, error) {
+	var saved []*recordingRule
+	err := internal.ReadObject(filepath.Join(dir, recordingFile), &saved)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]*recordingRule, len(saved))
+	for i, s := range saved {
+		rules[i], err = newRecordingRule(s.Key, s.Expr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+func (t *TimeSeries) writeRecordingRules() error {
+	if t.InMemory() {
+		return nil
+	}
+	fp := filepath.Join(t.dir, recordingFile)
+	err := internal.WriteObject(fp, t.recording)
+	if err == nil && t.config.Durability != DURABILITY_NONE {
+		err = internal.SyncFile(fp)
+	}
+	return err
+}
+
+//
+// Record the value of expr as key from now on, replacing any rule
+// for key.  Rules are evaluated in the order they were added, so a
+// rule may use keys recorded by earlier ones.
+//
+func (t *TimeSeries) AddRecordingRule(key, expr string) error {
+	if t.readOnly {
+		return ErrReadOnly
+	}
+	r, err := newRecordingRule(key, expr)
+	if err != nil {
+		return err
+	}
+	t.recordingMu.Lock()
+	defer t.recordingMu.Unlock()
+	t.removeRecordingRule(key)
+	t.recording = append(t.recording, r)
+	return t.writeRecordingRules()
+}
+
+//
+// Stop recording key.  Values already recorded are kept.
+//
+func (t *TimeSeries) RemoveRecordingRule(key string) error {
+	if t.readOnly {
+		return ErrReadOnly
+	}
+	t.recordingMu.Lock()
+	defer t.recordingMu.Unlock()
+	if !t.removeRecordingRule(key) {
+		return nil
+	}
+	return t.writeRecordingRules()
+}
+
+func (t *TimeSeries) removeRecordingRule(key string) bool {
+	for i, r := range t.recording {
+		if r.Key == key {
+			t.recording = append(t.recording[:i], t.recording[i + 1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+//
+// The recording rules, as key to expression.
+//
+func (t *TimeSeries) RecordingRules() map[string]string {
+	t.recordingMu.Lock()
+	defer t.recordingMu.Unlock()
+	rules := make(map[string]string, len(t.recording))
+	for _, r := range t.recording {
+		rules[r.Key] = r.Expr
+	}
+	return rules
+}
+
+//
+// The values of the rules affected by vals, just appended to the
+// base archive; nil if there are none.
+//
+func (t *TimeSeries) recordRules(vals map[string]float64) map[string]float64 {
+	t.recordingMu.Lock()
+	defer t.recordingMu.Unlock()
+	if len(t.recording) == 0 {
+		return nil
+	}
+
+	var latest, res map[string]float64
+	lookup := func(key string) (float64, bool) {
+		if v, ok := res[key]; ok {
+			return v, true
+		}
+		v, ok := latest[key]
+		return v, ok && !math.IsNaN(v)
+	}
+	for _, r := range t.recording {
+		affected := false
+		for k := range r.refs {
+			if _, ok := vals[k]; ok {
+				affected = true
+				break
+			}
+			if _, ok := res[k]; ok {
+				affected = true
+				break
+			}
+		}
+		if !affected {
+			continue
+		}
+		if latest == nil {
+			latest, _ = t.baseArchive().LatestFloats()
+		}
+		v, ok := r.expr.evalScalar(lookup)
+		if !ok || math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		if res == nil {
+			res = make(map[string]float64)
+		}
+		res[r.Key] = v
+	}
+	return res
+}
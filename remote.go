@@ -0,0 +1,352 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/fred-lewis/tissa/internal"
+)
+
+//
+// The read side of a TimeSeries, which a Client also provides, so
+// code can query a series whether it's open in this process or
+// served by another with Serve.
+//
+type SeriesReader interface {
+	Queryable
+	Averages(startTime, endTime, resolution int64, opts ...QueryOptions) (map[string][]float64, []int64, error)
+	Rollups(startTime, endTime, resolution int64, opts ...QueryOptions) (map[string][]Rollup, []int64, error)
+	Latest() (map[string]float64, int64)
+}
+
+//
+// The remote protocol: each request and response is a msgpack
+// object, preceded by its length as a 4-byte big-endian integer.
+// A connection carries one request at a time, each answered before
+// the next is sent.  Requests are small, so servers refuse any
+// larger than maxRequest; clients take responses up to maxResponse.
+//
+const (
+	maxRequest  = 1 << 20
+	maxResponse = 64 << 20
+)
+
+const (
+	opQuery    = "query"
+	opAverages = "averages"
+	opRollups  = "rollups"
+	opLatest   = "latest"
+)
+
+type wireRequest struct {
+	Op          string
+	StartTime   int64
+	EndTime     int64
+	Resolution  int64
+	Aggregation Aggregation
+	// Keys is only used if HasKeys is set; an empty list selects
+	// nothing
+	HasKeys     bool
+	Keys        []string
+	Limit       int
+	Fill        FillPolicy
+	FillValue   float64
+}
+
+type wireResponse struct {
+	Err        string
+	Timestamps []int64
+	Values     map[string][]float64
+	Missing    map[string][]bool
+	Rollups    map[string][]Rollup
+	Time       int64
+}
+
+func writeFrame(w io.Writer, v interface{}) error {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 4))
+	if err := internal.Msgpack.Encode(&buf, v); err != nil {
+		return err
+	}
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b) - 4))
+	_, err := w.Write(b)
+	return err
+}
+
+func readFrame(r io.Reader, v interface{}, max uint32) error {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > max {
+		return fmt.Errorf("frame of %d bytes is too large", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	return internal.Msgpack.Decode(bytes.NewReader(buf), v)
+}
+
+//
+// The request for a query with opts.  Only listed keys can be sent,
+// and transforms can't.
+//
+func newWireRequest(op string, startTime, endTime, resolution int64, opts []QueryOptions) (*wireRequest, error) {
+	req := &wireRequest{ Op: op, StartTime: startTime, EndTime: endTime, Resolution: resolution }
+	if len(opts) == 0 {
+		return req, nil
+	}
+	o := opts[0]
+	if len(o.Transforms) > 0 {
+		return nil, errors.New("transforms can't be sent to a remote series")
+	}
+	if o.Keys != nil {
+		req.Keys = o.Keys.Names()
+		if req.Keys == nil {
+			return nil, errors.New("only listed keys can be sent to a remote series")
+		}
+		req.HasKeys = true
+	}
+	req.Limit, req.Fill, req.FillValue = o.Limit, o.Fill, o.FillValue
+	return req, nil
+}
+
+func (req *wireRequest) options() QueryOptions {
+	o := QueryOptions{ Limit: req.Limit, Fill: req.Fill, FillValue: req.FillValue }
+	if req.HasKeys {
+		o.Keys = Keys(req.Keys...)
+	}
+	return o
+}
+
+//
+// Answer requests from clients connecting to l with s, until l is
+// closed.  Each connection is served by a goroutine of its own.
+//
+func Serve(l net.Listener, s SeriesReader) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go ServeConn(conn, s)
+	}
+}
+
+//
+// Answer requests on conn with s until the client hangs up, then
+// close it.
+//
+func ServeConn(conn io.ReadWriteCloser, s SeriesReader) error {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		var req wireRequest
+		if err := readFrame(r, &req, maxRequest); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if err := writeFrame(conn, handleRequest(s, &req)); err != nil {
+			return err
+		}
+	}
+}
+
+func handleRequest(s SeriesReader, req *wireRequest) *wireResponse {
+	resp := &wireResponse{}
+	var err error
+	o := req.options()
+	if req.Op != opLatest && req.Resolution <= 0 {
+		resp.Err = "resolution must be positive"
+		return resp
+	}
+	switch req.Op {
+	case opQuery:
+		var res *Result
+		res, err = s.Query(req.StartTime, req.EndTime, req.Resolution, req.Aggregation, o)
+		if res != nil {
+			resp.Timestamps, resp.Values, resp.Missing = res.Timestamps, res.Values, res.Missing
+		}
+	case opAverages:
+		resp.Values, resp.Timestamps, err = s.Averages(req.StartTime, req.EndTime, req.Resolution, o)
+	case opRollups:
+		resp.Rollups, resp.Timestamps, err = s.Rollups(req.StartTime, req.EndTime, req.Resolution, o)
+	case opLatest:
+		resp.Values = make(map[string][]float64)
+		vals, ts := s.Latest()
+		for k, v := range vals {
+			resp.Values[k] = []float64{ v }
+		}
+		resp.Time = ts
+	default:
+		err = fmt.Errorf("unknown operation %q", req.Op)
+	}
+	if err != nil {
+		resp.Err = err.Error()
+	}
+	return resp
+}
+
+//
+// A Client queries a series served by another process with Serve.
+// It's safe for concurrent use; requests are sent one at a time.
+// Errors returned by the remote series come back as RemoteErrors.
+//
+type Client struct {
+	conn net.Conn
+	r    *bufio.Reader
+	mu   sync.Mutex
+	// the error from the last Latest call, which can't return one
+	latestErr error
+}
+
+//
+// An error returned by the series a Client queries.
+//
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return e.Message
+}
+
+//
+// Connect to a series served at address on the named network
+// ("tcp", "unix"), as for net.Dial.
+//
+func Dial(network, address string) (*Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{ conn: conn, r: bufio.NewReader(conn) }, nil
+}
+
+//
+// Hang up.
+//
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) call(req *wireRequest) (*wireResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := writeFrame(c.conn, req); err != nil {
+		return nil, err
+	}
+	var resp wireResponse
+	if err := readFrame(c.r, &resp, maxResponse); err != nil {
+		return nil, err
+	}
+	if resp.Err != "" {
+		return &resp, &RemoteError{ Message: resp.Err }
+	}
+	return &resp, nil
+}
+
+//
+// Query the remote series.  Keys in opts must be listed (as by
+// Keys), and Transforms and Stats can't be used.
+//
+func (c *Client) Query(startTime, endTime, resolution int64, agg Aggregation,
+	opts ...QueryOptions) (*Result, error) {
+
+	req, err := newWireRequest(opQuery, startTime, endTime, resolution, opts)
+	if err != nil {
+		return nil, err
+	}
+	req.Aggregation = agg
+	resp, err := c.call(req)
+	if resp == nil {
+		return nil, err
+	}
+	res := &Result{
+		Resolution: resolution,
+		Timestamps: resp.Timestamps,
+		Values: resp.Values,
+		Missing: resp.Missing,
+	}
+	if res.Values == nil {
+		res.Values = make(map[string][]float64)
+		res.Missing = make(map[string][]bool)
+	}
+	return res, err
+}
+
+//
+// Like TimeSeries.Averages, on the remote series, with opts
+// limited as for Query.
+//
+func (c *Client) Averages(startTime, endTime, resolution int64, opts ...QueryOptions) (map[string][]float64, []int64, error) {
+	req, err := newWireRequest(opAverages, startTime, endTime, resolution, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := c.call(req)
+	if resp == nil {
+		return nil, nil, err
+	}
+	return resp.Values, resp.Timestamps, err
+}
+
+//
+// Like TimeSeries.Rollups, on the remote series, with opts limited
+// as for Query.
+//
+func (c *Client) Rollups(startTime, endTime, resolution int64, opts ...QueryOptions) (map[string][]Rollup, []int64, error) {
+	req, err := newWireRequest(opRollups, startTime, endTime, resolution, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := c.call(req)
+	if resp == nil {
+		return nil, nil, err
+	}
+	return resp.Rollups, resp.Timestamps, err
+}
+
+//
+// Like TimeSeries.Latest, on the remote series.  If the request
+// fails, nothing is returned, and LatestErr says why.
+//
+func (c *Client) Latest() (map[string]float64, int64) {
+	resp, err := c.call(&wireRequest{ Op: opLatest })
+	c.mu.Lock()
+	c.latestErr = err
+	c.mu.Unlock()
+	if err != nil {
+		return nil, 0
+	}
+	vals := make(map[string]float64, len(resp.Values))
+	for k, v := range resp.Values {
+		if len(v) > 0 {
+			vals[k] = v[0]
+		}
+	}
+	return vals, resp.Time
+}
+
+//
+// The error from the last call to Latest, if it failed.
+//
+func (c *Client) LatestErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.latestErr
+}
@@ -0,0 +1,122 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fred-lewis/tissa/internal"
+)
+
+// Returned by appends, writes, and anything else that would change
+// a series opened with OpenTimeSeriesReplica.
+var ErrReadOnly = errors.New("series is read-only")
+
+//
+// Open the TimeSeries in dir read-only, as a replica of the series
+// another process appends to and writes, so a separate process can
+// serve queries off the same directory.  Nothing in dir is written
+// to; appends, Write, Compact and the like fail with ErrReadOnly,
+// and the change log isn't opened.  Replicas don't lock the series,
+// so they can be opened while the writer has it open.
+//
+// A replica holds the data the writer had written when it was
+// opened, and catches up with what's written since when it's
+// refreshed, by Refresh or RefreshEvery.  Alerts and subscriptions
+// only see the writer's appends in the writer's process.
+//
+func OpenTimeSeriesReplica(dir string) (*TimeSeries, error) {
+	return openTimeSeries(dir, true)
+}
+
+//
+// Whether the series was opened with OpenTimeSeriesReplica.
+//
+func (t *TimeSeries) ReadOnly() bool {
+	return t.readOnly
+}
+
+//
+// Re-read a replica's archives, counter state, label index and
+// recording rules, as the writer last wrote them.  Files are read
+// before the series is changed, so queries carry on meanwhile, and
+// if any can't be read (in the middle of being written, say) the
+// replica is left as it was, to be refreshed again later.
+//
+func (t *TimeSeries) Refresh() error {
+	if !t.readOnly {
+		return fmt.Errorf("only replicas can be refreshed")
+	}
+	codec, err := lookupCodec(t.config.Codec)
+	if err != nil {
+		return err
+	}
+	archives := make([]*internal.Archive, len(t.config.Archives))
+	for i, a := range t.config.Archives {
+		if archives[i], err = openArchive(t.dir, t.config, a, codec); err != nil {
+			return fmt.Errorf("refreshing archive %d: %w", a.Resolution, err)
+		}
+	}
+	metrics, err := readMetrics(t.dir)
+	if err != nil {
+		return err
+	}
+	labels, err := readLabels(t.dir)
+	if err != nil {
+		return err
+	}
+	recording, err := readRecordingRules(t.dir)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.archives = archives
+	t.configureArchives()
+	t.mu.Unlock()
+	t.metricsMu.Lock()
+	t.metrics = metrics
+	t.metricsMu.Unlock()
+	t.labelsMu.Lock()
+	t.labels = labels
+	t.labelsMu.Unlock()
+	t.recordingMu.Lock()
+	t.recording = recording
+	t.recordingMu.Unlock()
+	return nil
+}
+
+//
+// Refresh a replica every interval seconds, until the returned
+// function is called.  Errors are passed to onError, if not nil.
+//
+func (t *TimeSeries) RefreshEvery(interval int64, onError func(error)) (stop func()) {
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				if err := t.Refresh(); err != nil && onError != nil {
+					onError(err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+			<-stopped
+		})
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package replication keeps a standby copy of a tissa.TimeSeries on
+another server, by shipping the primary's change log to it over
+HTTP, so the standby can take over reads, and writes, if the
+primary dies.  The primary's series must keep a change log
+(TimeSeriesConfig.ChangeLog).  On the primary:
+
+	http.Handle("/replication/", http.StripPrefix("/replication", replication.NewHandler(ts)))
+
+and on the standby, once:
+
+	ts, err := replication.NewStandby("/var/lib/tissa/cpu", "http://primary:8080/replication")
+
+then, whenever it starts:
+
+	ts, _ := tissa.OpenTimeSeries("/var/lib/tissa/cpu")
+	stop := replication.Follow(ts, "http://primary:8080/replication", "standby1", 10, logError)
+
+The endpoints are:
+
+	GET /config     the series' config and counter keys
+	GET /changes    changes from the offset from, up to max of them
+
+Both are gob-encoded: the config as a Config, and changes as a
+Batch.  /changes takes consumer, the standby's name, and records
+from as its committed offset in the primary's change log, for
+deciding what can be truncated; it returns 410 if from has been
+truncated already.
+
+The standby replays the changes with TimeSeries.Replay, which
+records them in its own change log at the same offsets, so it knows
+where to resume from after a restart without any state of its own,
+and other standbys can follow it in turn if it's promoted.  A
+standby can also be seeded with a backup of the primary, restored
+with tissa.RestoreTimeSeries, and catch up from there; that's the
+only way to start one once the primary has truncated its log.
+Metric types set on the primary after the standby was created
+aren't replicated.
+*/
+package replication
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fred-lewis/tissa"
+)
+
+// The most changes /changes returns when max isn't given.
+const defaultBatch = 1000
+
+//
+// What a standby needs to start: the primary's config, and the keys
+// it treats as counters.
+//
+type Config struct {
+	Config   tissa.TimeSeriesConfig
+	Counters []string
+}
+
+//
+// Changes from the primary's log, and the offset the next of them
+// will get.
+//
+type Batch struct {
+	Changes    []tissa.Change
+	NextOffset int64
+}
+
+type handler struct {
+	ts *tissa.TimeSeries
+}
+
+//
+// An http.Handler serving ts's change log to standbys.
+//
+func NewHandler(ts *tissa.TimeSeries) http.Handler {
+	return &handler{ ts: ts }
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := h.ts.ChangeLog()
+	if log == nil {
+		http.Error(w, "series doesn't keep a change log", http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var v interface{}
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "/config":
+		c := Config{ Config: h.ts.Config() }
+		for _, k := range h.ts.Keys() {
+			if h.ts.MetricType(k) == tissa.METRIC_COUNTER {
+				c.Counters = append(c.Counters, k)
+			}
+		}
+		v = c
+	case "/changes":
+		q := r.URL.Query()
+		from, err := strconv.ParseInt(q.Get("from"), 10, 64)
+		if err != nil {
+			http.Error(w, "bad from", http.StatusBadRequest)
+			return
+		}
+		max := defaultBatch
+		if s := q.Get("max"); s != "" {
+			if max, err = strconv.Atoi(s); err != nil || max < 1 {
+				http.Error(w, "bad max", http.StatusBadRequest)
+				return
+			}
+		}
+		if consumer := q.Get("consumer"); consumer != "" {
+			if err = log.Commit(consumer, from); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		b := Batch{ NextOffset: log.NextOffset() }
+		if b.Changes, err = log.Read(from, max); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, tissa.ErrTruncated) {
+				status = http.StatusGone
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		v = b
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-gob")
+	gob.NewEncoder(w).Encode(v)
+}
+
+//
+// GET path from the primary at addr, decoding the response into v.
+//
+func get(addr, path string, params url.Values, v interface{}) error {
+	u := strings.TrimSuffix(addr, "/") + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	resp, err := http.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = fmt.Errorf("%s: %s: %s", u, resp.Status, strings.TrimSpace(string(msg)))
+		if resp.StatusCode == http.StatusGone {
+			err = fmt.Errorf("%w: %v", tissa.ErrTruncated, err)
+		}
+		return err
+	}
+	return gob.NewDecoder(resp.Body).Decode(v)
+}
+
+//
+// Create an empty standby in dir for the primary served at addr,
+// configured as it is.  CatchUp or Follow then fill it in.
+//
+func NewStandby(dir, addr string) (*tissa.TimeSeries, error) {
+	var c Config
+	if err := get(addr, "/config", nil, &c); err != nil {
+		return nil, err
+	}
+	if !c.Config.ChangeLog {
+		return nil, fmt.Errorf("primary doesn't keep a change log")
+	}
+	ts, err := tissa.NewTimeSeries(dir, c.Config)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range c.Counters {
+		if err = ts.SetMetricType(k, tissa.METRIC_COUNTER); err != nil {
+			return nil, err
+		}
+	}
+	return ts, nil
+}
+
+//
+// Replay the changes the primary served at addr has that ts hasn't,
+// writing ts after each batch, until it's caught up.  consumer names
+// ts to the primary.  Returns the number of changes replayed.
+// Fails, wrapping tissa.ErrTruncated, if the primary no longer has
+// the changes ts needs next.
+//
+func CatchUp(ts *tissa.TimeSeries, addr, consumer string) (int, error) {
+	log := ts.ChangeLog()
+	if log == nil {
+		return 0, fmt.Errorf("standby doesn't keep a change log")
+	}
+	applied := 0
+	for {
+		from := log.NextOffset()
+		params := url.Values{ "from": { strconv.FormatInt(from, 10) } }
+		if consumer != "" {
+			params.Set("consumer", consumer)
+		}
+		var b Batch
+		if err := get(addr, "/changes", params, &b); err != nil {
+			return applied, err
+		}
+		if len(b.Changes) == 0 {
+			return applied, nil
+		}
+		if err := ts.Replay(b.Changes); err != nil {
+			return applied, err
+		}
+		if err := ts.Write(); err != nil {
+			return applied, err
+		}
+		applied += int(log.NextOffset() - from)
+		if log.NextOffset() >= b.NextOffset {
+			return applied, nil
+		}
+	}
+}
+
+//
+// Run CatchUp every interval seconds, until the returned function is
+// called.  Errors are passed to onError, if set, and the next
+// attempt carries on from where the last left off.
+//
+func Follow(ts *tissa.TimeSeries, addr, consumer string, interval int64,
+	onError func(error)) (stop func()) {
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	catchUp := func() {
+		if _, err := CatchUp(ts, addr, consumer); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+	go func() {
+		defer close(stopped)
+		catchUp()
+		for {
+			select {
+			case <-ticker.C:
+				catchUp()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+			<-stopped
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package replication
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/fred-lewis/tissa"
+)
+
+func TestReplication(t *testing.T) {
+	dir := "/tmp/timeseries_test/replication"
+	os.RemoveAll(dir)
+	os.MkdirAll(dir, os.ModePerm)
+	primary, err := tissa.NewTimeSeries(dir + "/primary", tissa.TimeSeriesConfig{
+		Archives: []tissa.ArchiveConfig{
+			{Resolution: tissa.SECOND, Retention: tissa.HOUR},
+			{Resolution: tissa.MINUTE, Retention: tissa.DAY},
+		},
+		ChangeLog: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = primary.SetMetricType("requests", tissa.METRIC_COUNTER); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.StripPrefix("/replication", NewHandler(primary)))
+	defer srv.Close()
+	addr := srv.URL + "/replication"
+
+	start := int64(1560628800)
+	add := func(from, to int64) {
+		t.Helper()
+		for s := from; s < to; s++ {
+			// the counter resets at 50
+			if err := primary.AddValue("requests", float64(s % 50), start + s); err != nil {
+				t.Fatal(err)
+			}
+			err := primary.AddLabeledValues([]tissa.LabeledValue{
+				{ Name: "cpu", Labels: tissa.Labels{ "host": "a" }, Value: float64(s) },
+			}, start + s)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := primary.Write(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add(0, 60)
+
+	standby, err := NewStandby(dir + "/standby", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if standby.MetricType("requests") != tissa.METRIC_COUNTER || !standby.Config().ChangeLog {
+		t.Errorf("Standby wasn't configured as the primary")
+	}
+	n, err := CatchUp(standby, addr, "standby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 120 {
+		t.Errorf("Replayed %d changes", n)
+	}
+	same := func(end int64) {
+		t.Helper()
+		for _, res := range []int64{ tissa.SECOND, tissa.MINUTE } {
+			want, err := primary.Query(start, end, res, tissa.AGGREGATE_AVERAGE)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := standby.Query(start, end, res, tissa.AGGREGATE_AVERAGE)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got.Values) != fmt.Sprint(want.Values) {
+				t.Errorf("Standby has %v at %d, not %v", got.Values, res, want.Values)
+			}
+		}
+	}
+	same(start + 60)
+	if keys := standby.SelectSeries("cpu", tissa.Labels{ "host": "a" }); len(keys) != 1 {
+		t.Errorf("Selected %v", keys)
+	}
+
+	// reopened, the standby resumes where it left off
+	add(60, 150)
+	if err = standby.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if standby, err = tissa.OpenTimeSeries(dir + "/standby"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err = CatchUp(standby, addr, "standby"); err != nil || n != 180 {
+		t.Fatalf("Resumed with %d, %v", n, err)
+	}
+	same(start + 150)
+	if n, err = CatchUp(standby, addr, "standby"); err != nil || n != 0 {
+		t.Errorf("Caught up again with %d, %v", n, err)
+	}
+	// each request acknowledges what came before it
+	if c, _ := primary.ChangeLog().Committed("standby"); c != 300 {
+		t.Errorf("Standby committed %d", c)
+	}
+
+	// a series without a change log can't be replicated
+	plain, err := tissa.NewTimeSeries(dir + "/plain", tissa.TimeSeriesConfig{
+		Archives: []tissa.ArchiveConfig{ {Resolution: tissa.SECOND, Retention: tissa.HOUR} },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv2 := httptest.NewServer(NewHandler(plain))
+	defer srv2.Close()
+	if _, err = NewStandby(dir + "/fresh", srv2.URL); err == nil {
+		t.Errorf("Replicated a series without a change log")
+	}
+	if _, err = CatchUp(plain, addr, "plain"); err == nil {
+		t.Errorf("Caught up a standby without a change log")
+	}
+}
@@ -0,0 +1,269 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+//
+// The result of a Query: a series of values per key, all sharing
+// Timestamps, along with which values were missing (filled in
+// according to the query's FillPolicy rather than read).
+//
+type Result struct {
+	Resolution int64
+	Timestamps []int64
+	Values     map[string][]float64
+	Missing    map[string][]bool
+}
+
+//
+// Query the series at the given resolution, reducing each interval
+// with agg (AGGREGATE_AVERAGE if empty), for all keys or those
+// selected by opts.  Stored NaNs are reported as missing.
+//
+func (t *TimeSeries) Query(startTime, endTime, resolution int64, agg Aggregation,
+	opts ...QueryOptions) (*Result, error) {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.queryResult(startTime, endTime, resolution, agg, opts)
+}
+
+func (t *TimeSeries) queryResult(startTime, endTime, resolution int64, agg Aggregation,
+	opts []QueryOptions) (*Result, error) {
+
+	fn, err := lookupAggregation(agg)
+	if err != nil {
+		return nil, err
+	}
+
+	o := t.queryOptions(opts)
+	stats := collectStats(&o)
+	fill := o.Fill
+	o.Fill = FILL_NAN
+	transforms := o.Transforms
+	o.Transforms = nil
+	vals, timestamps, err := t.query(startTime, endTime, resolution, fn, false, []QueryOptions{ o })
+
+	res := &Result{
+		Resolution: resolution,
+		Timestamps: timestamps,
+		Values: vals,
+		Missing: make(map[string][]bool, len(vals)),
+	}
+	def := 0.0
+	if resolution == t.baseArchive().Interval {
+		def = t.config.DefaultValue
+	}
+	if fill == FILL_DEFAULT {
+		fill, o.FillValue = FILL_CONSTANT, def
+	}
+	for k, v := range vals {
+		missing := make([]bool, len(v))
+		for i := range v {
+			missing[i] = math.IsNaN(v[i])
+		}
+		res.Missing[k] = missing
+		fillGaps(v, fill, o.FillValue)
+	}
+	applyTransforms(vals, transforms)
+	finishStats(stats, vals)
+	return res, err
+}
+
+//
+// Like Query, at BestResolution(startTime), so callers needn't know
+// the archive layout; the resolution used is in the Result.  If that
+// would be more than MaxQueryPoints or MaxQueryBytes, the next
+// coarser archive that fits is used instead.
+//
+func (t *TimeSeries) QueryAuto(startTime, endTime int64, agg Aggregation, opts ...QueryOptions) (*Result, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	o := t.queryOptions(opts)
+	resolution := t.fittingResolution(startTime, endTime, t.bestResolution(startTime), o.Keys)
+	return t.queryResult(startTime, endTime, resolution, agg, opts)
+}
+
+//
+// Like Query, but reading each part of [startTime, endTime) from the
+// finest archive that still holds it and rolling everything up to
+// resolution, so a range reaching past the finer archives'
+// retention comes back as one continuous series.  Only archives
+// whose resolution divides resolution are used; 0 means
+// BestResolution(startTime), or coarser as for QueryAuto.  Unlike other queries, each timestamp
+// is the start of the interval its values cover.
+//
+func (t *TimeSeries) Stitched(startTime, endTime, resolution int64, agg Aggregation,
+	opts ...QueryOptions) (*Result, error) {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	o := t.queryOptions(opts)
+	if resolution == 0 {
+		resolution = t.fittingResolution(startTime, endTime, t.bestResolution(startTime), o.Keys)
+	}
+	if resolution % t.baseArchive().Interval != 0 {
+		return nil, fmt.Errorf("resolution %d is not a multiple of the base resolution", resolution)
+	}
+	fn, err := lookupAggregation(agg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = t.checkQuerySize(startTime, endTime, resolution, o.Keys, 8); err != nil {
+		return nil, err
+	}
+	stats := collectStats(&o)
+	startTime -= startTime % resolution
+	l := int((endTime - startTime + resolution - 1) / resolution)
+	res := &Result{
+		Resolution: resolution,
+		Timestamps: make([]int64, l),
+		Values: make(map[string][]float64),
+		Missing: make(map[string][]bool),
+	}
+	for i := range res.Timestamps {
+		res.Timestamps[i] = startTime + int64(i) * resolution
+	}
+
+	// finest first, each covering what's older than the last
+	var firstErr error
+	segEnd := endTime
+	for _, a := range t.archives {
+		start, ok := t.dataStart(a)
+		if !ok || resolution % a.Interval != 0 {
+			continue
+		}
+		if rem := (start - startTime) % resolution; rem > 0 {
+			// a partial bucket would mix resolutions
+			start += resolution - rem
+		}
+		if start < startTime {
+			start = startTime
+		}
+		if start >= segEnd {
+			continue
+		}
+		rollups, err := a.RollupBuckets(start, segEnd, resolution, o.Keys)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		offset := int((start - startTime) / resolution)
+		for k, ser := range rollups {
+			vals := res.Values[k]
+			if vals == nil {
+				vals = make([]float64, l)
+				for i := range vals {
+					vals[i] = math.NaN()
+				}
+				res.Values[k] = vals
+			}
+			for i, r := range ser {
+				if r.Count > 0 {
+					vals[offset + i] = fn(r)
+				}
+			}
+		}
+		segEnd = start
+	}
+
+	limitSeries(res.Values, o.Limit)
+	fill, value := o.Fill, o.FillValue
+	if fill == FILL_DEFAULT {
+		fill, value = FILL_CONSTANT, 0
+	}
+	for k, v := range res.Values {
+		missing := make([]bool, len(v))
+		for i := range v {
+			missing[i] = math.IsNaN(v[i])
+		}
+		res.Missing[k] = missing
+		fillGaps(v, fill, value)
+	}
+	applyTransforms(res.Values, o.Transforms)
+	finishStats(stats, res.Values)
+	return res, firstErr
+}
+
+//
+// The keys in the result, sorted.
+//
+func (r *Result) Keys() []string {
+	keys := make([]string, 0, len(r.Values))
+	for k := range r.Values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//
+// The value of key in the interval holding timestamp.  ok is false if
+// it's missing or outside the result.
+//
+func (r *Result) At(key string, timestamp int64) (val float64, ok bool) {
+	i := r.index(timestamp)
+	v := r.Values[key]
+	if i < 0 || i >= len(v) || r.Missing[key][i] {
+		return 0, false
+	}
+	return v[i], true
+}
+
+func (r *Result) index(timestamp int64) int {
+	if len(r.Timestamps) == 0 || timestamp < r.Timestamps[0] {
+		return -1
+	}
+	i := int((timestamp - r.Timestamps[0]) / r.Resolution)
+	if i >= len(r.Timestamps) {
+		return -1
+	}
+	return i
+}
+
+//
+// Resample onto the given timestamps, taking for each the interval
+// that holds it, so results at different resolutions (or from
+// different series) can be compared point by point.  Timestamps
+// outside the result are missing, with NaN values.
+//
+func (r *Result) Align(timestamps []int64) *Result {
+	res := &Result{
+		Timestamps: timestamps,
+		Values: make(map[string][]float64, len(r.Values)),
+		Missing: make(map[string][]bool, len(r.Values)),
+	}
+	if len(timestamps) > 1 {
+		res.Resolution = timestamps[1] - timestamps[0]
+	} else {
+		res.Resolution = r.Resolution
+	}
+	for k, v := range r.Values {
+		vals := make([]float64, len(timestamps))
+		missing := make([]bool, len(timestamps))
+		for j, ts := range timestamps {
+			i := r.index(ts)
+			if i < 0 || i >= len(v) {
+				vals[j], missing[j] = math.NaN(), true
+				continue
+			}
+			vals[j], missing[j] = v[i], r.Missing[k][i]
+		}
+		res.Values[k] = vals
+		res.Missing[k] = missing
+	}
+	return res
+}
+
+//
+// The result in the shape the other queries return.
+//
+func (r *Result) ToMap() (map[string][]float64, []int64) {
+	return r.Values, r.Timestamps
+}
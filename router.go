@@ -0,0 +1,356 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"sync"
+)
+
+//
+// What a Router spreads keys across: a TimeSeries, a ShardedSeries,
+// a MirroredTimeSeries, a series in a DB (see DBStore), or anything
+// else that takes appends and answers queries.
+//
+type Store interface {
+	Queryable
+	AddValues(vals map[string]float64, timestamp int64) error
+	Write() error
+}
+
+//
+// A Router spreads the keys of a series across a number of stores,
+// on other disks or other hosts, by consistent hashing, so a series
+// can outgrow any one of them.  Each store owns the keys hashing to
+// its points on a ring, several per store so the keys are spread
+// evenly, and adding or removing a store only moves the keys it
+// gains or loses, about one store's share.
+//
+// Appends go to the owners of their keys.  Queries go to every
+// store, since data isn't moved when stores come and go: a key that
+// moves starts afresh on its new owner, and its older data stays
+// where it was, and is merged back in, the owner's values taking
+// precedence where both have them.
+//
+type Router struct {
+	mu     sync.RWMutex
+	names  []string
+	stores []Store
+	ring   []ringPoint
+}
+
+type ringPoint struct {
+	hash  uint32
+	store int
+}
+
+// Points on the ring per store.
+const routerPoints = 128
+
+func routerHash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	// FNV-1a alone clusters similar strings, such as "host-1" and
+	// "host-2", so mix the bits further
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x7feb352d
+	x ^= x >> 15
+	x *= 0x846ca68b
+	x ^= x >> 16
+	return x
+}
+
+//
+// Add a store, with a name unique in the router which places it on
+// the ring; a store re-added under the same name owns the same keys
+// again.
+//
+func (r *Router) Add(name string, s Store) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, n := range r.names {
+		if n == name {
+			return fmt.Errorf("router already has a store named %s", name)
+		}
+	}
+	r.names = append(r.names, name)
+	r.stores = append(r.stores, s)
+	r.buildRing()
+	return nil
+}
+
+//
+// Remove the named store.  Its keys go to the stores next to it on
+// the ring.
+//
+func (r *Router) Remove(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, n := range r.names {
+		if n == name {
+			r.names = append(r.names[:i], r.names[i + 1:]...)
+			r.stores = append(r.stores[:i], r.stores[i + 1:]...)
+			r.buildRing()
+			return nil
+		}
+	}
+	return fmt.Errorf("router has no store named %s", name)
+}
+
+func (r *Router) buildRing() {
+	r.ring = make([]ringPoint, 0, len(r.names) * routerPoints)
+	for i, name := range r.names {
+		for j := 0; j < routerPoints; j++ {
+			r.ring = append(r.ring, ringPoint{ hash: routerHash(fmt.Sprintf("%s#%d", name, j)), store: i })
+		}
+	}
+	sort.Slice(r.ring, func(i, j int) bool {
+		if r.ring[i].hash != r.ring[j].hash {
+			return r.ring[i].hash < r.ring[j].hash
+		}
+		// so ties don't depend on the order stores were added
+		return r.names[r.ring[i].store] < r.names[r.ring[j].store]
+	})
+}
+
+//
+// The index of the store owning key: the first point on the ring at
+// or after its hash.  r.mu must be held, and r must have a store.
+//
+func (r *Router) owner(key string) int {
+	h := routerHash(key)
+	i := sort.Search(len(r.ring), func(i int) bool { return r.ring[i].hash >= h })
+	if i == len(r.ring) {
+		i = 0
+	}
+	return r.ring[i].store
+}
+
+//
+// The name of the store owning key, or "" if the router has none.
+//
+func (r *Router) Owner(key string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.stores) == 0 {
+		return ""
+	}
+	return r.names[r.owner(key)]
+}
+
+//
+// The stores' names, in the order they were added.
+//
+func (r *Router) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]string(nil), r.names...)
+}
+
+//
+// The named store, or nil.
+//
+func (r *Router) Store(name string) Store {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for i, n := range r.names {
+		if n == name {
+			return r.stores[i]
+		}
+	}
+	return nil
+}
+
+//
+// Run fn on each of the stores, all at once, returning their errors
+// joined, each named for its store.
+//
+func (r *Router) each(stores []int, fn func(i int, s Store) error) error {
+	errs := make([]error, len(stores))
+	var wg sync.WaitGroup
+	for j, i := range stores {
+		wg.Add(1)
+		go func(j, i int) {
+			defer wg.Done()
+			if err := fn(i, r.stores[i]); err != nil {
+				errs[j] = fmt.Errorf("%s: %w", r.names[i], err)
+			}
+		}(j, i)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (r *Router) all() []int {
+	stores := make([]int, len(r.stores))
+	for i := range stores {
+		stores[i] = i
+	}
+	return stores
+}
+
+//
+// Add a single key-value pair to the store owning key.
+//
+func (r *Router) AddValue(key string, val float64, timestamp int64) error {
+	return r.AddValues(map[string]float64{ key: val }, timestamp)
+}
+
+//
+// Add multiple key-value pairs for the given timestamp, each to the
+// store owning its key, all at once.  Every store is appended to,
+// even if others fail; their errors are returned joined.
+//
+func (r *Router) AddValues(vals map[string]float64, timestamp int64) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.stores) == 0 {
+		return fmt.Errorf("router has no stores")
+	}
+	parts := make(map[int]map[string]float64)
+	for k, v := range vals {
+		i := r.owner(k)
+		if parts[i] == nil {
+			parts[i] = make(map[string]float64)
+		}
+		parts[i][k] = v
+	}
+	stores := make([]int, 0, len(parts))
+	for i := range parts {
+		stores = append(stores, i)
+	}
+	return r.each(stores, func(i int, s Store) error { return s.AddValues(parts[i], timestamp) })
+}
+
+//
+// Write every store, all at once, returning their errors joined.
+//
+func (r *Router) Write() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.each(r.all(), func(i int, s Store) error { return s.Write() })
+}
+
+//
+// Run a Query on every store at the same time and merge the
+// results.  Limit, Fill and Transforms in opts apply to the merged
+// result, and Stats is ignored.  Stores that fail are left out, and
+// their errors returned (joined) along with the rest.
+//
+func (r *Router) Query(startTime, endTime, resolution int64, agg Aggregation,
+	opts ...QueryOptions) (*Result, error) {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var o QueryOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	// gaps are filled and transforms applied once merged
+	merged := o
+	o.Limit, o.Fill, o.Transforms, o.Stats = 0, FILL_NAN, nil, nil
+
+	results := make([]*Result, len(r.stores))
+	err := r.each(r.all(), func(i int, s Store) error {
+		var err error
+		results[i], err = s.Query(startTime, endTime, resolution, agg, o)
+		return err
+	})
+
+	res := &Result{
+		Resolution: resolution,
+		Values: make(map[string][]float64),
+		Missing: make(map[string][]bool),
+	}
+	for _, rs := range results {
+		if rs != nil && len(rs.Timestamps) > len(res.Timestamps) {
+			res.Timestamps = rs.Timestamps
+		}
+	}
+	l := len(res.Timestamps)
+	keys := make(map[string]bool)
+	for _, rs := range results {
+		if rs != nil {
+			for k := range rs.Values {
+				keys[k] = true
+			}
+		}
+	}
+	for k := range keys {
+		vals := make([]float64, l)
+		missing := make([]bool, l)
+		for i := range vals {
+			vals[i], missing[i] = math.NaN(), true
+		}
+		// the owner's values first, then any the others have
+		for _, j := range append([]int{ r.owner(k) }, r.all()...) {
+			rs := results[j]
+			if rs == nil {
+				continue
+			}
+			v, m := rs.Values[k], rs.Missing[k]
+			for i := 0; i < len(v) && i < l; i++ {
+				if missing[i] && !m[i] {
+					vals[i], missing[i] = v[i], false
+				}
+			}
+		}
+		res.Values[k] = vals
+		res.Missing[k] = missing
+	}
+	limitSeries(res.Values, merged.Limit)
+	limitSeries(res.Missing, merged.Limit)
+	fill, value := merged.Fill, merged.FillValue
+	if fill == FILL_DEFAULT {
+		fill, value = FILL_CONSTANT, 0
+	}
+	for _, v := range res.Values {
+		fillGaps(v, fill, value)
+	}
+	applyTransforms(res.Values, merged.Transforms)
+	return res, err
+}
+
+//
+// A series in a DB, as a Store: appends create it if need be, and a
+// DB without it answers queries with no keys.
+//
+func DBStore(db *DB, series string) Store {
+	return &dbStore{ db: db, series: series }
+}
+
+type dbStore struct {
+	db     *DB
+	series string
+}
+
+func (s *dbStore) AddValues(vals map[string]float64, timestamp int64) error {
+	return s.db.AddValues(s.series, vals, timestamp)
+}
+
+func (s *dbStore) Write() error {
+	ts, err := s.db.Series(s.series)
+	if errors.Is(err, ErrNoSeries) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return ts.Write()
+}
+
+func (s *dbStore) Query(startTime, endTime, resolution int64, agg Aggregation,
+	opts ...QueryOptions) (*Result, error) {
+
+	res, err := s.db.Query(s.series, startTime, endTime, resolution, agg, opts...)
+	if errors.Is(err, ErrNoSeries) {
+		return &Result{ Resolution: resolution, Values: map[string][]float64{}, Missing: map[string][]bool{} }, nil
+	}
+	return res, err
+}
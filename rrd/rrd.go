@@ -0,0 +1,207 @@
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package rrd imports RRDtool databases, as dumped to XML by
+
+	rrdtool dump metrics.rrd > metrics.xml
+
+into a tissa.TimeSeries, for moving years of RRD history over:
+
+	f, _ := os.Open("metrics.xml")
+	ts, err := rrd.Import("/var/lib/tissa/metrics", f)
+
+Each data source becomes a key, and each resolution the RRAs
+(round-robin archives) consolidate to, an archive as long as the
+longest of them.  The finest is the series' base archive, holding the
+AVERAGE RRA's values (or another's, if it has none).  At coarser
+resolutions, the AVERAGE, MIN, MAX and LAST RRAs are merged into
+rollups of a single datapoint, with the MIN, MAX and LAST RRAs giving
+their Min, Max and Last, and the AVERAGE the rest; a rollup missing
+any of them has the others' value in its place.  Values are stored as
+RRDtool stored them: COUNTER and DERIVE sources as rates.  Unknown
+(NaN) values are left out.
+
+RRDtool labels each row with the end of the interval it
+consolidates, as tissa labels rollups, but tissa labels plain values
+with the start, so a row dumped at 12:05 at the finest 5-minute
+resolution is stored at 12:00.
+*/
+package rrd
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/fred-lewis/tissa"
+)
+
+type dump struct {
+	Step       int64        `xml:"step"`
+	LastUpdate int64        `xml:"lastupdate"`
+	Sources    []dataSource `xml:"ds"`
+	Archives   []rra        `xml:"rra"`
+}
+
+type dataSource struct {
+	Name string `xml:"name"`
+}
+
+type rra struct {
+	CF        string `xml:"cf"`
+	PDPPerRow int64  `xml:"pdp_per_row"`
+	Rows      []row  `xml:"database>row"`
+}
+
+type row struct {
+	Values []float64 `xml:"v"`
+}
+
+// Consolidation functions, in the order they're merged.
+var consolidations = map[string]int{ "AVERAGE": 0, "LAST": 1, "MIN": 2, "MAX": 3 }
+
+//
+// Create a TimeSeries in dir from the rrdtool dump read from r.
+//
+func Import(dir string, r io.Reader) (*tissa.TimeSeries, error) {
+	var d dump
+	if err := xml.NewDecoder(r).Decode(&d); err != nil {
+		return nil, err
+	}
+	if d.Step <= 0 || len(d.Sources) == 0 || len(d.Archives) == 0 {
+		return nil, fmt.Errorf("dump has no step, data sources or RRAs")
+	}
+	keys := make([]string, len(d.Sources))
+	for i, ds := range d.Sources {
+		keys[i] = strings.TrimSpace(ds.Name)
+	}
+
+	archives := make([]rra, 0, len(d.Archives))
+	for _, a := range d.Archives {
+		a.CF = strings.TrimSpace(a.CF)
+		if _, ok := consolidations[a.CF]; !ok {
+			// HWPREDICT and the other forecasting RRAs
+			continue
+		}
+		if a.PDPPerRow <= 0 {
+			return nil, fmt.Errorf("%s RRA has %d PDPs per row", a.CF, a.PDPPerRow)
+		}
+		archives = append(archives, a)
+	}
+	if len(archives) == 0 {
+		return nil, fmt.Errorf("dump has no AVERAGE, MIN, MAX or LAST RRAs")
+	}
+	sort.SliceStable(archives, func(i, j int) bool {
+		return consolidations[archives[i].CF] < consolidations[archives[j].CF]
+	})
+
+	// resolution -> timestamp -> key -> rollup
+	merged := make(map[int64]map[int64]map[string]*tissa.Rollup)
+	retention := make(map[int64]int64)
+	for _, a := range archives {
+		res := d.Step * a.PDPPerRow
+		if n := int64(len(a.Rows)) * res; n > retention[res] {
+			retention[res] = n
+		}
+		rows := merged[res]
+		if rows == nil {
+			rows = make(map[int64]map[string]*tissa.Rollup)
+			merged[res] = rows
+		}
+		last := d.LastUpdate - d.LastUpdate % res
+		for i, rw := range a.Rows {
+			// the end of the interval the row consolidates
+			ts := last - int64(len(a.Rows) - 1 - i) * res
+			for j, v := range rw.Values {
+				if j >= len(keys) || math.IsNaN(v) {
+					continue
+				}
+				if rows[ts] == nil {
+					rows[ts] = make(map[string]*tissa.Rollup)
+				}
+				merge(rows[ts], keys[j], a.CF, v, res)
+			}
+		}
+	}
+
+	var resolutions []int64
+	for res := range retention {
+		resolutions = append(resolutions, res)
+	}
+	sort.Slice(resolutions, func(i, j int) bool { return resolutions[i] < resolutions[j] })
+	config := tissa.TimeSeriesConfig{}
+	for _, res := range resolutions {
+		config.Archives = append(config.Archives, tissa.ArchiveConfig{ Resolution: res, Retention: retention[res] })
+	}
+	ts, err := tissa.NewTimeSeries(dir, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// the coarser archives first, as the base archive's values only
+	// roll up into them past their latest rows
+	for _, res := range resolutions[1:] {
+		rows := merged[res]
+		for _, stamp := range sortedStamps(rows) {
+			vals := make(map[string]tissa.Rollup, len(rows[stamp]))
+			for k, r := range rows[stamp] {
+				vals[k] = *r
+			}
+			if err = ts.AddRollups(res, vals, stamp); err != nil {
+				return nil, err
+			}
+		}
+	}
+	rows := merged[resolutions[0]]
+	for _, stamp := range sortedStamps(rows) {
+		vals := make(map[string]float64, len(rows[stamp]))
+		for k, r := range rows[stamp] {
+			vals[k] = r.Total
+		}
+		if err = ts.AddValues(vals, stamp - resolutions[0]); err != nil {
+			return nil, err
+		}
+	}
+	if err = ts.Write(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+//
+// Merge a consolidated value into key's rollup in rollups: the first
+// value seen for it fills in the whole rollup, and later ones their
+// own part of it.
+//
+func merge(rollups map[string]*tissa.Rollup, key, cf string, v float64, res int64) {
+	r, ok := rollups[key]
+	if !ok {
+		rollups[key] = &tissa.Rollup{
+			Total: v, Count: 1, Min: v, Max: v, SumSq: v * v, First: v, Last: v,
+			Weighted: v * float64(res), Duration: float64(res),
+		}
+		return
+	}
+	switch cf {
+	case "LAST":
+		r.Last = v
+	case "MIN":
+		r.Min = v
+	case "MAX":
+		r.Max = v
+	}
+}
+
+func sortedStamps(rows map[int64]map[string]*tissa.Rollup) []int64 {
+	stamps := make([]int64, 0, len(rows))
+	for ts := range rows {
+		stamps = append(stamps, ts)
+	}
+	sort.Slice(stamps, func(i, j int) bool { return stamps[i] < stamps[j] })
+	return stamps
+}
@@ -0,0 +1,111 @@
+package rrd
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fred-lewis/tissa"
+)
+
+const testDump = `<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE rrd SYSTEM "https://oss.oetiker.ch/rrdtool/rrdtool.dtd">
+<rrd>
+	<version>0003</version>
+	<step>60</step> <!-- Seconds -->
+	<lastupdate>1560629100</lastupdate> <!-- 2019-06-15 20:05:00 UTC -->
+	<ds>
+		<name> load </name>
+		<type> GAUGE </type>
+		<minimal_heartbeat>120</minimal_heartbeat>
+	</ds>
+	<ds>
+		<name> users </name>
+		<type> GAUGE </type>
+		<minimal_heartbeat>120</minimal_heartbeat>
+	</ds>
+	<!-- Round Robin Archives -->
+	<rra>
+		<cf>AVERAGE</cf>
+		<pdp_per_row>1</pdp_per_row> <!-- 60 seconds -->
+		<params><xff>5.0000000000e-01</xff></params>
+		<cdp_prep><ds><value>NaN</value></ds><ds><value>NaN</value></ds></cdp_prep>
+		<database>
+			<!-- 2019-06-15 20:03:00 UTC / 1560628980 --> <row><v>1.0000000000e+00</v><v>NaN</v></row>
+			<!-- 2019-06-15 20:04:00 UTC / 1560629040 --> <row><v>2.0000000000e+00</v><v>2.0000000000e+01</v></row>
+			<!-- 2019-06-15 20:05:00 UTC / 1560629100 --> <row><v>3.0000000000e+00</v><v>3.0000000000e+01</v></row>
+		</database>
+	</rra>
+	<rra>
+		<cf>AVERAGE</cf>
+		<pdp_per_row>5</pdp_per_row> <!-- 300 seconds -->
+		<database>
+			<row><v>5.0000000000e+00</v><v>5.0000000000e+01</v></row>
+			<row><v>6.0000000000e+00</v><v>6.0000000000e+01</v></row>
+		</database>
+	</rra>
+	<rra>
+		<cf>MAX</cf>
+		<pdp_per_row>5</pdp_per_row> <!-- 300 seconds -->
+		<database>
+			<row><v>9.0000000000e+00</v><v>9.0000000000e+01</v></row>
+			<row><v>NaN</v><v>7.0000000000e+01</v></row>
+		</database>
+	</rra>
+	<rra>
+		<cf>HWPREDICT</cf>
+		<pdp_per_row>1</pdp_per_row>
+		<database>
+			<row><v>0</v><v>0</v></row>
+		</database>
+	</rra>
+</rrd>
+`
+
+func TestImport(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/rrd")
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+
+	ts, err := Import("/tmp/timeseries_test/rrd", strings.NewReader(testDump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archives := ts.Config().Archives; len(archives) != 2 || archives[0].Retention != 180 ||
+		archives[1].Resolution != 300 || archives[1].Retention != 600 {
+		t.Errorf("Archives were %+v", archives)
+	}
+
+	res, err := ts.Query(1560628920, 1560629100, tissa.MINUTE, tissa.AGGREGATE_AVERAGE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(res.Values["load"]) != "[1 2 3]" || !res.Missing["users"][0] ||
+		fmt.Sprint(res.Values["users"][1:]) != "[20 30]" {
+		t.Errorf("Minutes were %v", res.Values)
+	}
+
+	// rows are stamped with the end of their interval, as RRDtool stamps them
+	res, err = ts.Query(1560628800, 1560629400, 300, tissa.AGGREGATE_MAX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second load row has no MAX, so its average stands in
+	if fmt.Sprint(res.Values["load"]) != "[9 6]" || fmt.Sprint(res.Values["users"]) != "[90 70]" {
+		t.Errorf("Maximums were %v", res.Values)
+	}
+	res, err = ts.Query(1560628800, 1560629400, 300, tissa.AGGREGATE_AVERAGE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(res.Values["load"]) != "[5 6]" {
+		t.Errorf("Averages were %v", res.Values)
+	}
+
+	if _, err = Import("/tmp/timeseries_test/rrd2", strings.NewReader("<rrd></rrd>")); err == nil {
+		t.Error("Imported an empty dump")
+	}
+}
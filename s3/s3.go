@@ -0,0 +1,248 @@
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package s3 keeps the chunk files of tissa archives in S3-compatible
+object storage (Amazon S3, MinIO, Ceph, R2 and the like), so
+long-retention archives don't need local disk.  Register a Store,
+then name it in the archives that should use it:
+
+	tissa.RegisterChunkStore("s3", s3.New(s3.Config{
+		Endpoint:  "https://s3.eu-west-1.amazonaws.com",
+		Region:    "eu-west-1",
+		Bucket:    "metrics",
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}))
+	ts, err := tissa.NewTimeSeries(dir, tissa.TimeSeriesConfig{
+		Archives: []tissa.ArchiveConfig{
+			{Resolution: tissa.SECOND, Retention: tissa.DAY},
+			{Resolution: tissa.HOUR, Retention: 5 * 365 * tissa.DAY, Store: "s3"},
+		},
+	})
+
+The store must be registered under the same name before the series
+is reopened.  Requests are signed with AWS Signature Version 4, and
+objects addressed path-style, as endpoint/bucket/name, which every
+S3-compatible store accepts.  Failed requests aren't retried; the
+archive reports the error, and the next Write tries again.
+*/
+package s3
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+//
+// Where a Store keeps objects, and the credentials to sign requests
+// with.  Endpoint is the service's base URL; Prefix, if set, starts
+// the name of every object.  Client is http.DefaultClient if nil.
+//
+type Config struct {
+	Endpoint     string
+	Region       string
+	Bucket       string
+	Prefix       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Client       *http.Client
+}
+
+//
+// A bucket of S3-compatible object storage, as a tissa.ChunkStore.
+//
+type Store struct {
+	config Config
+}
+
+func New(config Config) *Store {
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+	return &Store{ config: config }
+}
+
+//
+// The object's contents.  Fails with an error wrapping
+// os.ErrNotExist if there's no such object.
+//
+func (s *Store) Get(name string) ([]byte, error) {
+	resp, err := s.do("GET", name, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+//
+// Write the object, replacing any by that name.
+//
+func (s *Store) Put(name string, data []byte) error {
+	resp, err := s.do("PUT", name, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+//
+// Delete the object, if it exists.
+//
+func (s *Store) Delete(name string) error {
+	resp, err := s.do("DELETE", name, nil)
+	if errors.Is(err, os.ErrNotExist) {
+		// S3 itself answers 204, but not every store does
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+//
+// Send a signed request for the named object, failing unless it
+// succeeds.
+//
+func (s *Store) do(method, name string, body []byte) (*http.Response, error) {
+	u := s.config.Endpoint + "/" + escapePath(s.config.Bucket + "/" + s.config.Prefix + name)
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	sum := sha256.Sum256(body)
+	s.sign(req, hex.EncodeToString(sum[:]), time.Now())
+
+	resp, err := s.config.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode / 100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("s3 %s %s: %s: %s", method, name, resp.Status, bytes.TrimSpace(msg))
+	if resp.StatusCode == http.StatusNotFound && method != "PUT" {
+		err = fmt.Errorf("%w: %v", os.ErrNotExist, err)
+	}
+	return nil, err
+}
+
+//
+// Sign req with AWS Signature Version 4, as of now, covering its
+// host and every header already set on it.  payloadHash is the hex
+// SHA-256 of its body.
+//
+func (s *Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	stamp, date := now.Format("20060102T150405Z"), now.Format("20060102")
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.config.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.config.SessionToken)
+	}
+
+	headers := map[string]string{ "host": req.URL.Host }
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, k := range names {
+		canonical.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	request := strings.Join([]string{
+		req.Method, path, canonicalQuery(req.URL.Query()), canonical.String(), signed, payloadHash,
+	}, "\n")
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	reqHash := sha256.Sum256([]byte(request))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(reqHash[:])
+
+	key := []byte("AWS4" + s.config.SecretKey)
+	for _, part := range []string{ date, s.config.Region, "s3", "aws4_request" } {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKey, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, escape(k) + "=" + escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+//
+// Escape s as SigV4 requires: everything but unreserved characters.
+//
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func escapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = escape(part)
+	}
+	return strings.Join(parts, "/")
+}
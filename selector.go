@@ -0,0 +1,292 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// How a LabelMatcher compares a label's value: MATCH_EQUAL and
+// MATCH_NOT_EQUAL compare it with Value, MATCH_REGEXP and
+// MATCH_NOT_REGEXP match it against Value as a regular expression,
+// which must match the whole value.  A series without the label
+// has it as "".
+type MatchType int
+
+const (
+	MATCH_EQUAL MatchType = iota
+	MATCH_NOT_EQUAL
+	MATCH_REGEXP
+	MATCH_NOT_REGEXP
+)
+
+var matchOps = map[string]MatchType{
+	"=": MATCH_EQUAL,
+	"!=": MATCH_NOT_EQUAL,
+	"=~": MATCH_REGEXP,
+	"!~": MATCH_NOT_REGEXP,
+}
+
+type LabelMatcher struct {
+	Label string
+	Type  MatchType
+	Value string
+	re    *regexp.Regexp
+}
+
+//
+// A matcher for label; fails if a regular expression doesn't compile.
+//
+func NewLabelMatcher(label string, typ MatchType, value string) (*LabelMatcher, error) {
+	m := &LabelMatcher{ Label: label, Type: typ, Value: value }
+	if typ == MATCH_REGEXP || typ == MATCH_NOT_REGEXP {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, err
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+//
+// Whether labels have a value m matches.
+//
+func (m *LabelMatcher) Matches(labels Labels) bool {
+	v := labels[m.Label]
+	switch m.Type {
+	case MATCH_NOT_EQUAL:
+		return v != m.Value
+	case MATCH_REGEXP:
+		return m.re.MatchString(v)
+	case MATCH_NOT_REGEXP:
+		return !m.re.MatchString(v)
+	}
+	return v == m.Value
+}
+
+//
+// Parse a selector such as
+//
+//	cpu{host=~"web.*",region="us-east"}
+//
+// into a series name (empty if left out) and matchers.  Values are
+// quoted as Go strings; the operators are =, !=, =~ and !~.
+//
+func ParseSelector(sel string) (name string, matchers []*LabelMatcher, err error) {
+	sel = strings.TrimSpace(sel)
+	i := strings.IndexByte(sel, '{')
+	if i < 0 {
+		return sel, nil, nil
+	}
+	name = strings.TrimSpace(sel[:i])
+	rest := strings.TrimSpace(sel[i + 1:])
+	for {
+		if rest == "}" {
+			return name, matchers, nil
+		}
+		j := strings.IndexAny(rest, "=!")
+		if j < 0 || j + 2 > len(rest) {
+			break
+		}
+		label := strings.TrimSpace(rest[:j])
+		op := rest[j:j + 2]
+		typ, ok := matchOps[op]
+		if !ok {
+			op = op[:1]
+			typ, ok = matchOps[op]
+		}
+		if !ok || !validLabelName(label) {
+			break
+		}
+		rest = strings.TrimSpace(rest[j + len(op):])
+		q, qerr := strconv.QuotedPrefix(rest)
+		if qerr != nil {
+			break
+		}
+		v, _ := strconv.Unquote(q)
+		m, merr := NewLabelMatcher(label, typ, v)
+		if merr != nil {
+			return "", nil, merr
+		}
+		matchers = append(matchers, m)
+
+		rest = strings.TrimSpace(rest[len(q):])
+		if strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		} else if rest != "}" {
+			break
+		}
+	}
+	return "", nil, fmt.Errorf("invalid selector %q", sel)
+}
+
+//
+// The keys of the labeled series named name (any name if empty)
+// matched by every matcher, sorted.
+//
+func (t *TimeSeries) Select(name string, matchers ...*LabelMatcher) []string {
+	// narrow down by the index first
+	eq := make(Labels)
+	for _, m := range matchers {
+		if m.Type == MATCH_EQUAL && m.Value != "" {
+			eq[m.Label] = m.Value
+		}
+	}
+	keys := t.SelectSeries(name, eq)
+
+	res := keys[:0]
+	for _, k := range keys {
+		_, labels, err := ParseSeriesKey(k)
+		if err != nil {
+			continue
+		}
+		ok := true
+		for _, m := range matchers {
+			if !m.Matches(labels) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			res = append(res, k)
+		}
+	}
+	return res
+}
+
+//
+// A filter for the series a selector (see ParseSelector) matches,
+// for QueryOptions.  Series are looked up when the filter is made.
+//
+func (t *TimeSeries) SelectorFilter(sel string) (*KeyFilter, error) {
+	name, matchers, err := ParseSelector(sel)
+	if err != nil {
+		return nil, err
+	}
+	return Keys(t.Select(name, matchers...)...), nil
+}
+
+//
+// A query across labeled series.  Each series matched by Selector
+// is reduced per interval with Aggregation, as by Query.  The series
+// are then grouped by the values of the By labels, and each group's
+// values in an interval are combined with Combine (AGGREGATE_SUM if
+// empty): the values are gathered into a Rollup, so AGGREGATE_AVERAGE,
+// AGGREGATE_MAX, AGGREGATE_COUNT and so on all apply.  With no By
+// labels, every matched series falls into one group.
+//
+type GroupQuery struct {
+	Selector    string
+	Aggregation Aggregation
+	Combine     Aggregation
+	By          []string
+}
+
+//
+// Run a GroupQuery.  The Result has a series per group, keyed by the
+// series name (if the selector gives one) and the group's By labels,
+// as SeriesKey would; "{}" if both are empty.  An interval is missing
+// from a group if none of its series has a value there.  Keys in
+// opts is ignored.
+//
+func (t *TimeSeries) QueryGroups(startTime, endTime, resolution int64, q GroupQuery,
+	opts ...QueryOptions) (*Result, error) {
+
+	name, matchers, err := ParseSelector(q.Selector)
+	if err != nil {
+		return nil, err
+	}
+	if q.Combine == "" {
+		q.Combine = AGGREGATE_SUM
+	}
+	combine, err := lookupAggregation(q.Combine)
+	if err != nil {
+		return nil, err
+	}
+
+	o := t.queryOptions(opts)
+	stats := collectStats(&o)
+	series, err := t.Query(startTime, endTime, resolution, q.Aggregation, QueryOptions{
+		Keys: stats.keys(Keys(t.Select(name, matchers...)...)),
+		Fill: FILL_NAN,
+	})
+	if series == nil {
+		return nil, err
+	}
+
+	l := len(series.Timestamps)
+	groups := make(map[string][]Rollup)
+	for k, v := range series.Values {
+		_, labels, perr := ParseSeriesKey(k)
+		if perr != nil {
+			continue
+		}
+		gl := make(Labels, len(q.By))
+		for _, b := range q.By {
+			if lv, ok := labels[b]; ok {
+				gl[b] = lv
+			}
+		}
+		gk := groupKey(name, gl)
+		g := groups[gk]
+		if g == nil {
+			g = make([]Rollup, l)
+			groups[gk] = g
+		}
+		for i := range v {
+			if !math.IsNaN(v[i]) {
+				g[i].Add(v[i])
+			}
+		}
+	}
+
+	res := &Result{
+		Resolution: series.Resolution,
+		Timestamps: series.Timestamps,
+		Values: make(map[string][]float64, len(groups)),
+		Missing: make(map[string][]bool, len(groups)),
+	}
+	for gk, g := range groups {
+		vals := make([]float64, l)
+		missing := make([]bool, l)
+		for i := range g {
+			if g[i].Count == 0 {
+				vals[i] = math.NaN()
+				missing[i] = true
+			} else {
+				vals[i] = combine(g[i])
+			}
+		}
+		res.Values[gk] = vals
+		res.Missing[gk] = missing
+	}
+	limitSeries(res.Values, o.Limit)
+	limitSeries(res.Missing, o.Limit)
+
+	fill, value := o.Fill, o.FillValue
+	if fill == FILL_DEFAULT {
+		fill, value = FILL_CONSTANT, 0
+	}
+	for _, v := range res.Values {
+		fillGaps(v, fill, value)
+	}
+	applyTransforms(res.Values, o.Transforms)
+	finishStats(stats, res.Values)
+	return res, err
+}
+
+//
+// The key of a group: name with labels, as by SeriesKey.
+//
+func groupKey(name string, labels Labels) string {
+	if name == "" && len(labels) == 0 {
+		return "{}"
+	}
+	return formatSeries(name, labels)
+}
@@ -0,0 +1,374 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fred-lewis/tissa/internal"
+)
+
+//
+// A ShardedSeries spreads the keys of a very large series across a
+// number of TimeSeries, each in a subdirectory of its own, by a hash
+// of the key, so no single series (or directory) has to hold them
+// all.  Appends are split between the shards, and Query, Averages,
+// Rollups and Latest fan out to the shards concerned and merge their
+// results; other queries go to the shards themselves, through Shard
+// or Shards.  The shard count
+// is fixed when the series is created, and saved in the "shards"
+// file.
+//
+type ShardedSeries struct {
+	dir    string
+	shards []*TimeSeries
+}
+
+const shardsFile = "shards"
+
+func shardDir(dir string, i int) string {
+	return filepath.Join(dir, fmt.Sprintf("shard-%03d", i))
+}
+
+//
+// Construct a new ShardedSeries of n shards in the given directory,
+// each with the given configuration.
+//
+func NewShardedSeries(dir string, config TimeSeriesConfig, n int) (*ShardedSeries, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("shard count %d is less than 1", n)
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	err = internal.WriteObject(filepath.Join(dir, shardsFile), n)
+	if err != nil {
+		return nil, err
+	}
+	s := &ShardedSeries{ dir: dir, shards: make([]*TimeSeries, n) }
+	for i := range s.shards {
+		// NewTimeSeries sorts the archives in place
+		c := config
+		c.Archives = append([]ArchiveConfig(nil), config.Archives...)
+		s.shards[i], err = NewTimeSeries(shardDir(dir, i), c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+//
+// Open an existing ShardedSeries in the given directory.
+//
+func OpenShardedSeries(dir string) (*ShardedSeries, error) {
+	var n int
+	err := internal.ReadObject(filepath.Join(dir, shardsFile), &n)
+	if err != nil {
+		return nil, err
+	}
+	s := &ShardedSeries{ dir: dir, shards: make([]*TimeSeries, n) }
+	for i := range s.shards {
+		s.shards[i], err = OpenTimeSeries(shardDir(dir, i))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *ShardedSeries) shardOf(key string) int {
+	return internal.ShardOf(key, len(s.shards))
+}
+
+//
+// The series holding key, for anything not done through the
+// ShardedSeries itself.
+//
+func (s *ShardedSeries) Shard(key string) *TimeSeries {
+	return s.shards[s.shardOf(key)]
+}
+
+//
+// All the shards, in order.
+//
+func (s *ShardedSeries) Shards() []*TimeSeries {
+	return s.shards
+}
+
+//
+// Add a single key-value pair, as TimeSeries.AddValue does.
+//
+func (s *ShardedSeries) AddValue(key string, val float64, timestamp int64) error {
+	return s.Shard(key).AddValue(key, val, timestamp)
+}
+
+//
+// Add multiple key-value pairs for the given timestamp, each to its
+// shard.  Every shard is appended to, even if an earlier one fails;
+// the first error is returned.
+//
+func (s *ShardedSeries) AddValues(vals map[string]float64, timestamp int64) error {
+	parts := make([]map[string]float64, len(s.shards))
+	for k, v := range vals {
+		i := s.shardOf(k)
+		if parts[i] == nil {
+			parts[i] = make(map[string]float64)
+		}
+		parts[i][k] = v
+	}
+	var firstErr error
+	for i, part := range parts {
+		if part == nil {
+			continue
+		}
+		if err := s.shards[i].AddValues(part, timestamp); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+//
+// Write every shard, returning the first error.  The rest are still
+// written.
+//
+func (s *ShardedSeries) Write() error {
+	var firstErr error
+	for _, ts := range s.shards {
+		if err := ts.Write(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+//
+// Close every shard, as TimeSeries.Close does, returning the first
+// error.  The rest are still closed.
+//
+func (s *ShardedSeries) Close() error {
+	var firstErr error
+	for _, ts := range s.shards {
+		if err := ts.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+//
+// The latest values of every shard, at the latest timestamp any of
+// them has, as TimeSeries.Latest returns.
+//
+func (s *ShardedSeries) Latest() (map[string]float64, int64) {
+	vals := make(map[string]float64)
+	var timestamp int64
+	for _, ts := range s.shards {
+		v, t := ts.Latest()
+		if t > timestamp {
+			vals, timestamp = make(map[string]float64, len(v)), t
+		}
+		if t == timestamp {
+			for k, x := range v {
+				vals[k] = x
+			}
+		}
+	}
+	return vals, timestamp
+}
+
+//
+// The shards holding keys selected by keys, all of them unless it
+// lists keys.
+//
+func (s *ShardedSeries) shardsFor(keys *KeyFilter) []int {
+	shards := make([]int, 0, len(s.shards))
+	if names := keys.Names(); names != nil {
+		seen := make(map[int]bool)
+		for _, k := range names {
+			if i := s.shardOf(k); !seen[i] {
+				seen[i] = true
+				shards = append(shards, i)
+			}
+		}
+	} else {
+		for i := range s.shards {
+			shards = append(shards, i)
+		}
+	}
+	return shards
+}
+
+//
+// Run query on every shard holding keys selected by o, at the same
+// time, passing each the index of its result and o with Stats of
+// its own if o has them.  Returns the shards' stats and the first
+// error.
+//
+func (s *ShardedSeries) fanOut(o QueryOptions,
+	query func(j int, ts *TimeSeries, o QueryOptions) error) ([]QueryStats, error) {
+
+	shards := s.shardsFor(o.Keys)
+	errs := make([]error, len(shards))
+	shardStats := make([]QueryStats, len(shards))
+	var wg sync.WaitGroup
+	for j, i := range shards {
+		wg.Add(1)
+		go func(j, i int) {
+			defer wg.Done()
+			so := o
+			if o.Stats != nil {
+				so.Stats = &shardStats[j]
+			}
+			errs[j] = query(j, s.shards[i], so)
+		}(j, i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return shardStats, err
+		}
+	}
+	return shardStats, nil
+}
+
+//
+// Set stats, if not nil, to the shards' stats added up, for a query
+// that started at start and returned vals.
+//
+func addShardStats[T any](stats *QueryStats, shardStats []QueryStats, start time.Time, vals map[string][]T) {
+	if stats == nil {
+		return
+	}
+	*stats = QueryStats{ Duration: time.Since(start) }
+	for _, st := range shardStats {
+		stats.ChunksRead += st.ChunksRead
+		stats.CacheHits += st.CacheHits
+		stats.BytesDecoded += st.BytesDecoded
+	}
+	for _, v := range vals {
+		stats.Points += int64(len(v))
+	}
+}
+
+//
+// Merge the shards' values, each key being in one shard only, and
+// take the longest of their timestamps.
+//
+func mergeShards[T any](parts []map[string][]T, stamps [][]int64) (map[string][]T, []int64) {
+	vals := make(map[string][]T)
+	var timestamps []int64
+	for j, part := range parts {
+		if len(stamps[j]) > len(timestamps) {
+			timestamps = stamps[j]
+		}
+		for k, v := range part {
+			vals[k] = v
+		}
+	}
+	return vals, timestamps
+}
+
+func firstOpts(opts []QueryOptions) QueryOptions {
+	if len(opts) > 0 {
+		return opts[0]
+	}
+	return QueryOptions{}
+}
+
+//
+// Run a Query on every shard holding keys selected by opts, at the
+// same time, and merge the results.  Limit in opts applies to the
+// merged result, and Stats, if set, adds up the shards' stats, with
+// Duration the time taken overall.
+//
+func (s *ShardedSeries) Query(startTime, endTime, resolution int64, agg Aggregation,
+	opts ...QueryOptions) (*Result, error) {
+
+	o := firstOpts(opts)
+	stats, limit := o.Stats, o.Limit
+	o.Limit = 0
+
+	start := time.Now()
+	results := make([]*Result, len(s.shards))
+	shardStats, err := s.fanOut(o, func(j int, ts *TimeSeries, o QueryOptions) error {
+		var err error
+		results[j], err = ts.Query(startTime, endTime, resolution, agg, o)
+		return err
+	})
+
+	res := &Result{
+		Resolution: resolution,
+		Values: make(map[string][]float64),
+		Missing: make(map[string][]bool),
+	}
+	for _, r := range results {
+		if r == nil {
+			continue
+		}
+		if len(r.Timestamps) > len(res.Timestamps) {
+			res.Timestamps = r.Timestamps
+		}
+		for k, v := range r.Values {
+			res.Values[k] = v
+			res.Missing[k] = r.Missing[k]
+		}
+	}
+	limitSeries(res.Values, limit)
+	limitSeries(res.Missing, limit)
+	addShardStats(stats, shardStats, start, res.Values)
+	return res, err
+}
+
+//
+// Averages of every shard holding keys selected by opts, fanned out
+// and merged as for Query.
+//
+func (s *ShardedSeries) Averages(startTime, endTime, resolution int64, opts ...QueryOptions) (map[string][]float64, []int64, error) {
+	o := firstOpts(opts)
+	stats, limit := o.Stats, o.Limit
+	o.Limit = 0
+
+	start := time.Now()
+	parts := make([]map[string][]float64, len(s.shards))
+	stamps := make([][]int64, len(s.shards))
+	shardStats, err := s.fanOut(o, func(j int, ts *TimeSeries, o QueryOptions) error {
+		var err error
+		parts[j], stamps[j], err = ts.Averages(startTime, endTime, resolution, o)
+		return err
+	})
+	vals, timestamps := mergeShards(parts, stamps)
+	limitSeries(vals, limit)
+	addShardStats(stats, shardStats, start, vals)
+	return vals, timestamps, err
+}
+
+//
+// Rollups of every shard holding keys selected by opts, fanned out
+// and merged as for Query.
+//
+func (s *ShardedSeries) Rollups(startTime, endTime, resolution int64, opts ...QueryOptions) (map[string][]Rollup, []int64, error) {
+	o := firstOpts(opts)
+	stats, limit := o.Stats, o.Limit
+	o.Limit = 0
+
+	start := time.Now()
+	parts := make([]map[string][]Rollup, len(s.shards))
+	stamps := make([][]int64, len(s.shards))
+	shardStats, err := s.fanOut(o, func(j int, ts *TimeSeries, o QueryOptions) error {
+		var err error
+		parts[j], stamps[j], err = ts.Rollups(startTime, endTime, resolution, o)
+		return err
+	})
+	vals, timestamps := mergeShards(parts, stamps)
+	limitSeries(vals, limit)
+	addShardStats(stats, shardStats, start, vals)
+	return vals, timestamps, err
+}
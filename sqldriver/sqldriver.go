@@ -0,0 +1,634 @@
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package sqldriver is a read-only database/sql driver for tissa, so
+reporting tools can query a TimeSeries with SQL.  It registers the
+driver "tissa", whose data source name is a TimeSeries directory:
+
+	db, _ := sql.Open("tissa", "/var/lib/my_timeseries")
+	rows, _ := db.Query(`SELECT key, ts, value FROM series
+		WHERE ts BETWEEN ? AND ? AND resolution = 60 AND key LIKE 'cpu.%'`,
+		start, end)
+
+Each connection opens the directory with OpenTimeSeriesReplica, so it
+sees the data last written there, and can be opened while another
+TimeSeries has it open for writing.  To see appends this process
+hasn't written yet, use NewConnector and sql.OpenDB instead.
+
+The one table, series, has the columns key (a string), ts (an int64
+Unix time, as the TimeSeries queries report it) and value (a
+float64), one row per key and interval that has data, ordered by key
+and then ts.  SELECT
+takes * or any of the columns, and WHERE takes conditions joined by
+AND:
+
+	ts BETWEEN a AND b, ts >= a, ts > a, ts <= b, ts < b, ts = a
+	resolution = r        the resolution; BestResolution by default
+	aggregation = 'max'   how intervals are reduced; 'avg' by default
+	key = 'k', key IN ('j', 'k'), key LIKE 'cpu.%'
+
+A time range is required.  Arguments may be given as ? placeholders;
+times may be passed as time.Time.
+*/
+package sqldriver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fred-lewis/tissa"
+)
+
+func init() {
+	sql.Register("tissa", &Driver{})
+}
+
+var errReadOnly = errors.New("tissa: the sql driver is read-only")
+
+type Driver struct {}
+
+//
+// Open the TimeSeries in the directory named by dsn, read-only.
+//
+func (d *Driver) Open(dsn string) (driver.Conn, error) {
+	ts, err := tissa.OpenTimeSeriesReplica(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{ ts: ts }, nil
+}
+
+type connector struct {
+	ts *tissa.TimeSeries
+}
+
+//
+// A Connector for sql.OpenDB, querying an open TimeSeries.
+//
+func NewConnector(ts *tissa.TimeSeries) driver.Connector {
+	return &connector{ ts: ts }
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	return &conn{ ts: c.ts }, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return &Driver{}
+}
+
+type conn struct {
+	ts *tissa.TimeSeries
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	q, err := parseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	return &stmt{ ts: c.ts, q: q }, nil
+}
+
+func (c *conn) Close() error {
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return nil, errReadOnly
+}
+
+type stmt struct {
+	ts *tissa.TimeSeries
+	q  *query
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+func (s *stmt) NumInput() int {
+	return s.q.inputs
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errReadOnly
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.q.run(s.ts, args)
+}
+
+//
+// A parsed SELECT: the columns, and the WHERE conditions.
+//
+type query struct {
+	columns []string
+	conds   []cond
+	inputs  int
+}
+
+// A condition on column: op is one of the comparisons, "between",
+// "in" or "like".
+type cond struct {
+	column string
+	op     string
+	args   []operand
+}
+
+// A literal, or the index of a ? placeholder if it's 0 or more.
+type operand struct {
+	value driver.Value
+	arg   int
+}
+
+var columnNames = map[string]bool{ "key": true, "ts": true, "value": true }
+
+type token struct {
+	// 'i' for an identifier or keyword, 'n' for a number, 's' for a
+	// string, else the punctuation (">=" and "<=" as 'g' and 'l')
+	kind byte
+	text string
+}
+
+func tokenize(src string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || (src[j] >= 'a' && src[j] <= 'z') ||
+				(src[j] >= 'A' && src[j] <= 'Z') || (src[j] >= '0' && src[j] <= '9')) {
+				j++
+			}
+			toks = append(toks, token{ 'i', strings.ToLower(src[i:j]) })
+			i = j
+		case c == '-' || c == '.' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(src) && strings.IndexByte("0123456789.eE", src[j]) >= 0 {
+				j++
+			}
+			toks = append(toks, token{ 'n', src[i:j] })
+			i = j
+		case c == '\'':
+			var b strings.Builder
+			j := i + 1
+			for {
+				if j >= len(src) {
+					return nil, fmt.Errorf("unterminated string in %q", src)
+				}
+				if src[j] == '\'' {
+					if j + 1 < len(src) && src[j + 1] == '\'' {
+						b.WriteByte('\'')
+						j += 2
+						continue
+					}
+					break
+				}
+				b.WriteByte(src[j])
+				j++
+			}
+			toks = append(toks, token{ 's', b.String() })
+			i = j + 1
+		case (c == '>' || c == '<') && i + 1 < len(src) && src[i + 1] == '=':
+			kind := byte('g')
+			if c == '<' {
+				kind = 'l'
+			}
+			toks = append(toks, token{ kind, src[i:i + 2] })
+			i += 2
+		case strings.IndexByte("(),*=<>?;", c) >= 0:
+			toks = append(toks, token{ c, src[i:i + 1] })
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected %q in %q", src[i:], src)
+		}
+	}
+	// a trailing semicolon is allowed
+	if len(toks) > 0 && toks[len(toks) - 1].kind == ';' {
+		toks = toks[:len(toks) - 1]
+	}
+	return toks, nil
+}
+
+type parser struct {
+	src  string
+	toks []token
+	pos  int
+	q    *query
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("sql %q: %s", p.src, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) next() token {
+	if p.pos < len(p.toks) {
+		p.pos++
+		return p.toks[p.pos - 1]
+	}
+	return token{}
+}
+
+func (p *parser) peek() token {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return token{}
+}
+
+func (p *parser) expect(kind byte, text string) error {
+	t := p.next()
+	if t.kind != kind || (text != "" && t.text != text) {
+		if text == "" {
+			text = string(kind)
+		}
+		return p.errorf("expected %s", text)
+	}
+	return nil
+}
+
+func parseQuery(src string) (*query, error) {
+	toks, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{ src: src, toks: toks, q: &query{} }
+	if err := p.expect('i', "select"); err != nil {
+		return nil, err
+	}
+	if p.peek().kind == '*' {
+		p.next()
+		p.q.columns = []string{ "key", "ts", "value" }
+	} else {
+		for {
+			t := p.next()
+			if t.kind != 'i' || !columnNames[t.text] {
+				return nil, p.errorf("unknown column %q", t.text)
+			}
+			p.q.columns = append(p.q.columns, t.text)
+			if p.peek().kind != ',' {
+				break
+			}
+			p.next()
+		}
+	}
+	if err := p.expect('i', "from"); err != nil {
+		return nil, err
+	}
+	if err := p.expect('i', "series"); err != nil {
+		return nil, err
+	}
+	if p.peek().kind == 'i' && p.peek().text == "where" {
+		p.next()
+		for {
+			if err := p.cond(); err != nil {
+				return nil, err
+			}
+			if t := p.peek(); t.kind != 'i' || t.text != "and" {
+				break
+			}
+			p.next()
+		}
+	}
+	if p.pos < len(p.toks) {
+		return nil, p.errorf("unexpected %q", p.toks[p.pos].text)
+	}
+	return p.q, nil
+}
+
+func (p *parser) cond() error {
+	col := p.next()
+	if col.kind != 'i' {
+		return p.errorf("expected a column")
+	}
+	c := cond{ column: col.text }
+	switch col.text {
+	case "ts", "key", "resolution", "aggregation":
+	default:
+		return p.errorf("unknown column %q in WHERE", col.text)
+	}
+
+	op := p.next()
+	switch {
+	case op.kind == 'i' && op.text == "between":
+		c.op = "between"
+		lo, err := p.operand()
+		if err != nil {
+			return err
+		}
+		if err = p.expect('i', "and"); err != nil {
+			return err
+		}
+		hi, err := p.operand()
+		if err != nil {
+			return err
+		}
+		c.args = []operand{ lo, hi }
+	case op.kind == 'i' && op.text == "in":
+		c.op = "in"
+		if err := p.expect('(', ""); err != nil {
+			return err
+		}
+		for {
+			a, err := p.operand()
+			if err != nil {
+				return err
+			}
+			c.args = append(c.args, a)
+			if p.peek().kind != ',' {
+				break
+			}
+			p.next()
+		}
+		if err := p.expect(')', ""); err != nil {
+			return err
+		}
+	case op.kind == 'i' && op.text == "like":
+		c.op = "like"
+	case op.kind == '=' || op.kind == '<' || op.kind == '>' || op.kind == 'g' || op.kind == 'l':
+		c.op = op.text
+	default:
+		return p.errorf("unsupported operator %q", op.text)
+	}
+	if c.op == "like" || (c.op != "between" && c.op != "in") {
+		a, err := p.operand()
+		if err != nil {
+			return err
+		}
+		c.args = []operand{ a }
+	}
+
+	switch {
+	case (c.op == "in" || c.op == "like") && c.column != "key",
+		c.column == "key" && c.op != "=" && c.op != "in" && c.op != "like",
+		(c.column == "resolution" || c.column == "aggregation") && c.op != "=":
+		return p.errorf("unsupported condition on %s", c.column)
+	}
+	p.q.conds = append(p.q.conds, c)
+	return nil
+}
+
+func (p *parser) operand() (operand, error) {
+	t := p.next()
+	switch t.kind {
+	case '?':
+		p.q.inputs++
+		return operand{ arg: p.q.inputs - 1 }, nil
+	case 's':
+		return operand{ value: t.text, arg: -1 }, nil
+	case 'n':
+		if n, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return operand{ value: n, arg: -1 }, nil
+		}
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return operand{}, p.errorf("bad number %q", t.text)
+		}
+		return operand{ value: f, arg: -1 }, nil
+	}
+	return operand{}, p.errorf("expected a value")
+}
+
+func (o operand) resolve(args []driver.Value) driver.Value {
+	if o.arg >= 0 {
+		return args[o.arg]
+	}
+	return o.value
+}
+
+func toInt(v driver.Value) (int64, error) {
+	switch x := v.(type) {
+	case int64:
+		return x, nil
+	case float64:
+		return int64(x), nil
+	case time.Time:
+		return x.Unix(), nil
+	case string:
+		return strconv.ParseInt(x, 10, 64)
+	}
+	return 0, fmt.Errorf("tissa: %v is not a number", v)
+}
+
+func toString(v driver.Value) (string, error) {
+	switch x := v.(type) {
+	case string:
+		return x, nil
+	case []byte:
+		return string(x), nil
+	}
+	return "", fmt.Errorf("tissa: %v is not a string", v)
+}
+
+//
+// A LIKE pattern as an anchored regular expression.
+//
+func likePattern(like string) string {
+	var b strings.Builder
+	b.WriteByte('^')
+	for _, r := range like {
+		switch r {
+		case '%':
+			b.WriteString(".*")
+		case '_':
+			b.WriteByte('.')
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteByte('$')
+	return b.String()
+}
+
+func (q *query) run(ts *tissa.TimeSeries, args []driver.Value) (driver.Rows, error) {
+	if len(args) != q.inputs {
+		return nil, fmt.Errorf("tissa: %d arguments for %d placeholders", len(args), q.inputs)
+	}
+	var start, end int64
+	haveStart, haveEnd := false, false
+	var resolution int64
+	agg := tissa.AGGREGATE_AVERAGE
+	// nil for every key; the keys and patterns that must all match
+	var keySets [][]string
+	var patterns []*regexp.Regexp
+
+	for _, c := range q.conds {
+		vals := make([]driver.Value, len(c.args))
+		for i, a := range c.args {
+			vals[i] = a.resolve(args)
+		}
+		switch c.column {
+		case "ts":
+			bounds := make([]int64, len(vals))
+			for i, v := range vals {
+				n, err := toInt(v)
+				if err != nil {
+					return nil, err
+				}
+				bounds[i] = n
+			}
+			lo, hi := int64(0), int64(0)
+			setLo, setHi := false, false
+			switch c.op {
+			case "between":
+				lo, hi, setLo, setHi = bounds[0], bounds[1], true, true
+			case "=":
+				lo, hi, setLo, setHi = bounds[0], bounds[0], true, true
+			case ">=":
+				lo, setLo = bounds[0], true
+			case ">":
+				lo, setLo = bounds[0] + 1, true
+			case "<=":
+				hi, setHi = bounds[0], true
+			case "<":
+				hi, setHi = bounds[0] - 1, true
+			}
+			// start is inclusive, end exclusive
+			if setLo && (!haveStart || lo > start) {
+				start, haveStart = lo, true
+			}
+			if setHi && (!haveEnd || hi + 1 < end) {
+				end, haveEnd = hi + 1, true
+			}
+		case "resolution":
+			n, err := toInt(vals[0])
+			if err != nil {
+				return nil, err
+			}
+			resolution = n
+		case "aggregation":
+			s, err := toString(vals[0])
+			if err != nil {
+				return nil, err
+			}
+			agg = tissa.Aggregation(s)
+			if s == "avg" {
+				agg = tissa.AGGREGATE_AVERAGE
+			}
+		case "key":
+			strs := make([]string, len(vals))
+			for i, v := range vals {
+				s, err := toString(v)
+				if err != nil {
+					return nil, err
+				}
+				strs[i] = s
+			}
+			if c.op == "like" {
+				patterns = append(patterns, regexp.MustCompile(likePattern(strs[0])))
+			} else {
+				keySets = append(keySets, strs)
+			}
+		}
+	}
+	if !haveStart || !haveEnd {
+		return nil, fmt.Errorf("tissa: queries need a ts range")
+	}
+	if resolution == 0 {
+		resolution = ts.BestResolution(start)
+	}
+
+	match := func(key string) bool {
+		for _, set := range keySets {
+			found := false
+			for _, k := range set {
+				if k == key {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		for _, re := range patterns {
+			if !re.MatchString(key) {
+				return false
+			}
+		}
+		return true
+	}
+	// narrow the query where possible; match has the final say
+	var filter *tissa.KeyFilter
+	if len(keySets) > 0 {
+		filter = tissa.Keys(keySets[0]...)
+	} else if len(patterns) > 0 {
+		filter, _ = tissa.KeyRegexp(patterns[0].String())
+	}
+
+	res, err := ts.Query(start, end, resolution, agg, tissa.QueryOptions{ Keys: filter, Fill: tissa.FILL_NAN })
+	if res == nil {
+		return nil, err
+	}
+	r := &rows{ columns: q.columns }
+	keys := make([]string, 0, len(res.Values))
+	for k := range res.Values {
+		if match(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for i, v := range res.Values[k] {
+			stamp := res.Timestamps[i]
+			if res.Missing[k][i] || stamp < start || stamp >= end {
+				continue
+			}
+			r.data = append(r.data, row{ k, stamp, v })
+		}
+	}
+	return r, err
+}
+
+type row struct {
+	key   string
+	ts    int64
+	value float64
+}
+
+type rows struct {
+	columns []string
+	data    []row
+	pos     int
+}
+
+func (r *rows) Columns() []string {
+	return r.columns
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.data) {
+		return io.EOF
+	}
+	d := r.data[r.pos]
+	r.pos++
+	for i, c := range r.columns {
+		switch c {
+		case "key":
+			dest[i] = d.key
+		case "ts":
+			dest[i] = d.ts
+		case "value":
+			dest[i] = d.value
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package sqldriver
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fred-lewis/tissa"
+)
+
+func TestSQL(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/sql")
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := tissa.TimeSeriesConfig{
+		Archives: []tissa.ArchiveConfig{
+			{Resolution: tissa.SECOND, Retention: tissa.HOUR},
+			{Resolution: tissa.MINUTE, Retention: tissa.DAY},
+		},
+	}
+	ts, err := tissa.NewTimeSeries("/tmp/timeseries_test/sql", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560632400)
+	for i := int64(0); i <= 180; i++ {
+		ts.AddValues(map[string]float64{
+			"cpu.web1": float64(i),
+			"cpu.web2": 2,
+			"mem.web1": 3,
+		}, startTime + i)
+	}
+	if err = ts.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("tissa", "/tmp/timeseries_test/sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT key, ts, value FROM series
+		WHERE ts BETWEEN ? AND ? AND resolution = 60 AND key LIKE 'cpu.%'`,
+		startTime + 60, time.Unix(startTime + 180, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	var values []float64
+	for rows.Next() {
+		var key string
+		var stamp int64
+		var v float64
+		if err = rows.Scan(&key, &stamp, &v); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, key)
+		values = append(values, v)
+		if (stamp - startTime) % 60 != 0 || stamp < startTime + 60 || stamp > startTime + 180 {
+			t.Errorf("Timestamp %d", stamp)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 6 || got[0] != "cpu.web1" || got[3] != "cpu.web2" {
+		t.Errorf("Keys are %v", got)
+	}
+	if len(values) == 6 && (values[0] != 29.5 || values[2] != 149.5 || values[3] != 2) {
+		t.Errorf("Values are %v", values)
+	}
+
+	var max float64
+	err = db.QueryRow(`select value from series where key = 'cpu.web1' and ts >= ? and ts < ?
+		and resolution = 60 and aggregation = 'max';`, startTime + 120, startTime + 180).Scan(&max)
+	if err != nil || max != 119 {
+		t.Errorf("Max is %v, %v", max, err)
+	}
+
+	// a live series, at the base resolution
+	live := sql.OpenDB(NewConnector(ts))
+	var n int
+	err = live.QueryRow(`SELECT count(*) FROM series WHERE ts > 0 AND ts < 1`).Scan(&n)
+	if err == nil {
+		t.Errorf("Counted")
+	}
+	rows, err = live.Query(`SELECT * FROM series WHERE key IN ('mem.web1', 'nope') AND ts BETWEEN ? AND ?
+		AND resolution = 1`, startTime + 178, startTime + 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for rows.Next() {
+		count++
+	}
+	if count != 3 {
+		t.Errorf("Got %d live rows", count)
+	}
+
+	for _, bad := range []string{
+		`SELECT key FROM series`,
+		`SELECT key FROM other WHERE ts BETWEEN 0 AND 10`,
+		`SELECT nope FROM series WHERE ts BETWEEN 0 AND 10`,
+		`SELECT key FROM series WHERE value > 1 AND ts BETWEEN 0 AND 10`,
+		`SELECT key FROM series WHERE ts BETWEEN 0 AND 10 AND resolution = 7`,
+		`SELECT key FROM series WHERE key = 'a`,
+	} {
+		if _, err = db.Query(bad); err == nil {
+			t.Errorf("Ran %s", bad)
+		}
+	}
+	if _, err = db.Exec(`DELETE FROM series`); err == nil {
+		t.Errorf("Deleted")
+	}
+}
@@ -0,0 +1,77 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"time"
+
+	"github.com/fred-lewis/tissa/internal"
+)
+
+//
+// What a query did, filled in when it's given in QueryOptions.Stats.
+// ChunksRead is the number of chunks (or chunk shards) visited,
+// whether in memory or on disk, CacheHits how many were found in the
+// chunk cache, and BytesDecoded the size of the chunk files read
+// from disk.  Points is the number of values returned, across all
+// series, and Duration how long the query took.
+//
+type QueryStats struct {
+	ChunksRead   int64
+	CacheHits    int64
+	BytesDecoded int64
+	Points       int64
+	Duration     time.Duration
+}
+
+type statsCollector struct {
+	stats *QueryStats
+	read  internal.Stats
+	start time.Time
+}
+
+//
+// Start collecting the stats o asks for, if it does.  o.Keys is set
+// to count what's read and o.Stats is cleared, so the queries o is
+// passed on to don't collect them again.
+//
+func collectStats(o *QueryOptions) *statsCollector {
+	if o.Stats == nil {
+		return nil
+	}
+	c := &statsCollector{ stats: o.Stats, start: time.Now() }
+	o.Keys = o.Keys.WithStats(&c.read)
+	o.Stats = nil
+	return c
+}
+
+//
+// keys, counting what's read with them.
+//
+func (c *statsCollector) keys(keys *KeyFilter) *KeyFilter {
+	if c == nil {
+		return keys
+	}
+	return keys.WithStats(&c.read)
+}
+
+//
+// Fill in the stats for a query returning vals.
+//
+func finishStats[T any](c *statsCollector, vals map[string][]T) {
+	if c == nil {
+		return
+	}
+	points := 0
+	for _, v := range vals {
+		points += len(v)
+	}
+	*c.stats = QueryStats{
+		ChunksRead: c.read.ChunksRead,
+		CacheHits: c.read.CacheHits,
+		BytesDecoded: c.read.BytesDecoded,
+		Points: int64(points),
+		Duration: time.Since(c.start),
+	}
+}
@@ -0,0 +1,341 @@
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package statsd accepts metrics from StatsD clients over UDP,
+aggregates them and writes the aggregates into a tissa.DB, so apps
+instrumented with a statsd client can use tissa for storage:
+
+	db, _ := tissa.OpenDB("/var/lib/tissa")
+	pc, _ := net.ListenPacket("udp", ":8125")
+	statsd.NewServer(db).Serve(pc)
+
+Packets hold one or more lines of the form name:value|type, with an
+optional |@rate sample rate (and |#tags, which are ignored).  The
+types are counters (c), gauges (g, where a value starting with + or
+- changes the gauge rather than setting it), and timers (ms; h and d
+are taken as timers too).
+
+Metric names are mapped to a series and key by the server's Mapper;
+by default, as for Graphite, the first component of the name is the
+series and the rest the key.  Series are created with the DB's
+defaults as needed.  Each series' metrics are aggregated over its
+base resolution, and the aggregates appended at the start of the
+interval once it's over:
+
+	key                      counters: the count, scaled up by the sample rate
+	key                      gauges: the latest value
+	key.count, key.sum       timers: the number of timings and their total,
+	key.mean, key.median     and their mean, median,
+	key.lower, key.upper     least and greatest,
+	key.upper_90             and each of the server's Percentiles
+*/
+package statsd
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fred-lewis/tissa"
+)
+
+//
+// Maps a metric name to the series and key its aggregates are added
+// to.
+//
+type Mapper func(name string) (series, key string, err error)
+
+//
+// The first component of the name is the series, the rest the key.
+//
+func DefaultMapper(name string) (series, key string, err error) {
+	i := strings.IndexByte(name, '.')
+	if i <= 0 || i == len(name) - 1 {
+		return "", "", fmt.Errorf("metric name %q has no key", name)
+	}
+	return name[:i], name[i + 1:], nil
+}
+
+type Server struct {
+	db *tissa.DB
+	// maps metric names; DefaultMapper if nil
+	Mapper Mapper
+	// the upper percentiles of timers to keep, from 0 to 100; 90 by
+	// default
+	Percentiles []float64
+	// called with each metric that couldn't be parsed or stored, if set
+	OnError func(error)
+
+	mu sync.Mutex
+	// the interval being aggregated, by series
+	buckets map[string]*bucket
+	// the latest value of each gauge, by series and key
+	gauges  map[string]map[string]float64
+	now     func() time.Time
+}
+
+type bucket struct {
+	start      int64
+	resolution int64
+	counters   map[string]float64
+	gauges     map[string]float64
+	timers     map[string]*timer
+}
+
+type timer struct {
+	values []float64
+	// the timings represent, allowing for sample rates
+	count  float64
+}
+
+// The largest packet read.
+const maxPacket = 65535
+
+func NewServer(db *tissa.DB) *Server {
+	return &Server{
+		db: db,
+		Percentiles: []float64{ 90 },
+		buckets: make(map[string]*bucket),
+		gauges: make(map[string]map[string]float64),
+		now: time.Now,
+	}
+}
+
+//
+// Read packets from pc until it's closed, then append what's been
+// aggregated.
+//
+func (s *Server) Serve(pc net.PacketConn) error {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tick := time.NewTicker(time.Second)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				s.flush(false)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, maxPacket)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			close(stop)
+			<-done
+			s.flush(true)
+			return err
+		}
+		s.handlePacket(buf[:n])
+	}
+}
+
+//
+// Append everything aggregated so far, including intervals that
+// aren't over.
+//
+func (s *Server) Flush() {
+	s.flush(true)
+}
+
+func (s *Server) report(err error) {
+	if err != nil && s.OnError != nil {
+		s.OnError(err)
+	}
+}
+
+func (s *Server) handlePacket(p []byte) {
+	for _, line := range strings.Split(string(p), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			s.report(s.handle(line))
+		}
+	}
+}
+
+type metric struct {
+	name  string
+	value float64
+	typ   string
+	rate  float64
+	// a gauge change rather than a new value
+	delta bool
+}
+
+//
+// Parse name:value|type[|@rate][|#tags].
+//
+func parseLine(line string) (*metric, error) {
+	bad := fmt.Errorf("bad metric %q", line)
+	// tags may hold colons too
+	pipe := strings.IndexByte(line, '|')
+	if pipe < 0 {
+		return nil, bad
+	}
+	i := strings.LastIndexByte(line[:pipe], ':')
+	if i <= 0 {
+		return nil, bad
+	}
+	m := &metric{ name: line[:i], rate: 1 }
+	fields := strings.Split(line[i + 1:], "|")
+	value := fields[0]
+	m.typ = fields[1]
+	for _, f := range fields[2:] {
+		if strings.HasPrefix(f, "@") {
+			rate, err := strconv.ParseFloat(f[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, bad
+			}
+			m.rate = rate
+		}
+	}
+	switch m.typ {
+	case "c", "ms", "h", "d":
+	case "g":
+		m.delta = strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-")
+	default:
+		return nil, fmt.Errorf("unsupported metric type in %q", line)
+	}
+	var err error
+	if m.value, err = strconv.ParseFloat(value, 64); err != nil || math.IsNaN(m.value) || math.IsInf(m.value, 0) {
+		return nil, bad
+	}
+	return m, nil
+}
+
+func (s *Server) handle(line string) error {
+	m, err := parseLine(line)
+	if err != nil {
+		return err
+	}
+	mapper := s.Mapper
+	if mapper == nil {
+		mapper = DefaultMapper
+	}
+	series, key, err := mapper(m.name)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now().Unix()
+	b := s.buckets[series]
+	if b != nil && now - now % b.resolution != b.start {
+		s.flushBucket(series, b)
+		b = nil
+	}
+	if b == nil {
+		ts, err := s.db.SeriesOrCreate(series)
+		if err != nil {
+			return fmt.Errorf("%s: %w", m.name, err)
+		}
+		res := ts.Config().Archives[0].Resolution
+		b = &bucket{
+			start: now - now % res,
+			resolution: res,
+			counters: make(map[string]float64),
+			gauges: make(map[string]float64),
+			timers: make(map[string]*timer),
+		}
+		s.buckets[series] = b
+	}
+
+	switch m.typ {
+	case "c":
+		b.counters[key] += m.value / m.rate
+	case "g":
+		gauges := s.gauges[series]
+		if gauges == nil {
+			gauges = make(map[string]float64)
+			s.gauges[series] = gauges
+		}
+		if m.delta {
+			m.value += gauges[key]
+		}
+		gauges[key] = m.value
+		b.gauges[key] = m.value
+	default:
+		t := b.timers[key]
+		if t == nil {
+			t = &timer{}
+			b.timers[key] = t
+		}
+		t.values = append(t.values, m.value)
+		t.count += 1 / m.rate
+	}
+	return nil
+}
+
+//
+// Append the aggregates of each series' interval, if it's over or
+// all is set.
+//
+func (s *Server) flush(all bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now().Unix()
+	for series, b := range s.buckets {
+		if all || b.start + b.resolution <= now {
+			s.flushBucket(series, b)
+		}
+	}
+}
+
+func (s *Server) flushBucket(series string, b *bucket) {
+	delete(s.buckets, series)
+	vals := make(map[string]float64, len(b.counters) + len(b.gauges) + 6 * len(b.timers))
+	for k, v := range b.counters {
+		vals[k] = v
+	}
+	for k, v := range b.gauges {
+		vals[k] = v
+	}
+	for k, t := range b.timers {
+		s.timerStats(vals, k, t)
+	}
+	if err := s.db.AddValues(series, vals, b.start); err != nil {
+		s.report(fmt.Errorf("%s: %w", series, err))
+	}
+}
+
+func (s *Server) timerStats(vals map[string]float64, key string, t *timer) {
+	v := t.values
+	sort.Float64s(v)
+	n := len(v)
+	sum := 0.0
+	for _, x := range v {
+		sum += x
+	}
+	vals[key + ".count"] = t.count
+	vals[key + ".sum"] = sum
+	vals[key + ".mean"] = sum / float64(n)
+	vals[key + ".lower"] = v[0]
+	vals[key + ".upper"] = v[n - 1]
+	if n % 2 == 1 {
+		vals[key + ".median"] = v[n / 2]
+	} else {
+		vals[key + ".median"] = (v[n / 2 - 1] + v[n / 2]) / 2
+	}
+	for _, p := range s.Percentiles {
+		i := int(math.Round(p / 100 * float64(n)))
+		if i < 1 {
+			i = 1
+		} else if i > n {
+			i = n
+		}
+		name := strings.ReplaceAll(strconv.FormatFloat(p, 'f', -1, 64), ".", "_")
+		vals[key + ".upper_" + name] = v[i - 1]
+	}
+}
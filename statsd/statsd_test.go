@@ -0,0 +1,96 @@
+package statsd
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fred-lewis/tissa"
+)
+
+func TestServer(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/statsd")
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+
+	db, err := tissa.NewDB("/tmp/timeseries_test/statsd", tissa.TimeSeriesConfig{
+		Archives: []tissa.ArchiveConfig{
+			{Resolution: tissa.TEN_SECOND, Retention: tissa.DAY},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(db)
+	s.Percentiles = []float64{ 50, 99.9 }
+	var errs []error
+	s.OnError = func(err error) { errs = append(errs, err) }
+	startTime := int64(1560628800)
+	now := startTime + 3
+	s.now = func() time.Time { return time.Unix(now, 0) }
+
+	s.handlePacket([]byte("app.requests:1|c\napp.requests:2|c|@0.5\napp.temp:20|g\napp.temp:-5|g|#host:web1\n" +
+		"app.latency:30|ms\napp.latency:10|ms\napp.latency:20|ms|@0.5\napp.latency:40|h\n" +
+		"app.users:bob|s\nnoseries:1|c\napp.bad:x|c\n"))
+	if len(errs) != 3 {
+		t.Errorf("Expected 3 bad metrics reported, got %v", errs)
+	}
+	now = startTime + 9
+	s.flush(false)
+	if names, _ := db.Names(); len(names) != 1 {
+		t.Fatalf("Expected only the app series, got %v", names)
+	}
+	ts, _ := db.Series("app")
+	if _, stamp := ts.Latest(); stamp != 0 {
+		t.Errorf("Expected nothing appended before the interval's over")
+	}
+
+	now = startTime + 12
+	s.handlePacket([]byte("app.temp:+1|g\napp.requests:4|c"))
+	vals, stamp := ts.Latest()
+	expect := map[string]float64{
+		"requests": 5, "temp": 15,
+		"latency.count": 5, "latency.sum": 100, "latency.mean": 25, "latency.median": 25,
+		"latency.lower": 10, "latency.upper": 40, "latency.upper_50": 20, "latency.upper_99_9": 40,
+	}
+	if stamp != startTime {
+		t.Errorf("Expected the first interval appended at %d, got %d", startTime, stamp)
+	}
+	for k, v := range expect {
+		if vals[k] != v {
+			t.Errorf("Expected %s = %g, got %g", k, v, vals[k])
+		}
+	}
+
+	// the rest is appended when the server's closed
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() { served <- s.Serve(pc) }()
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("app.requests:3|c"))
+	conn.Close()
+	for i := 0; i < 100; i++ {
+		s.mu.Lock()
+		n := s.buckets["app"].counters["requests"]
+		s.mu.Unlock()
+		if n == 7 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	pc.Close()
+	<-served
+	vals, stamp = ts.Latest()
+	if stamp != startTime + 10 || vals["requests"] != 7 || vals["temp"] != 16 {
+		t.Errorf("Expected requests 7 and temp 16 at %d, got %v at %d", startTime + 10, vals, stamp)
+	}
+}
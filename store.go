@@ -0,0 +1,82 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/fred-lewis/tissa/internal"
+)
+
+// Where archives with ArchiveConfig.Store set keep their chunk
+// files: a store of named objects, such as a bucket of S3-compatible
+// object storage (see the s3 package).  Get must fail with an error
+// wrapping os.ErrNotExist if there's no object by that name, and
+// Delete must succeed if there isn't.
+type ChunkStore = internal.ChunkStore
+
+var chunkStores = map[string]ChunkStore{}
+var chunkStoresMu sync.RWMutex
+
+//
+// Make a chunk store available to ArchiveConfig.Store under name.
+// Registering a name again replaces the earlier store.
+//
+func RegisterChunkStore(name string, s ChunkStore) {
+	chunkStoresMu.Lock()
+	defer chunkStoresMu.Unlock()
+	chunkStores[name] = s
+}
+
+func lookupChunkStore(name string) (ChunkStore, error) {
+	chunkStoresMu.RLock()
+	defer chunkStoresMu.RUnlock()
+	s, ok := chunkStores[name]
+	if !ok {
+		return nil, fmt.Errorf("chunk store %q is not registered", name)
+	}
+	return s, nil
+}
+
+//
+// The store the archive a keeps its chunks in, and the prefix of
+// their names there, or nil if it keeps them on disk.
+//
+func archiveStore(config TimeSeriesConfig, a ArchiveConfig) (ChunkStore, string, error) {
+	if a.Store == "" {
+		return nil, "", nil
+	}
+	s, err := lookupChunkStore(a.Store)
+	if err != nil {
+		return nil, "", err
+	}
+	return s, fmt.Sprintf("%s/%d/", config.StorePrefix, a.Resolution), nil
+}
+
+//
+// Open the archive a of the series in dir.
+//
+func openArchive(dir string, config TimeSeriesConfig, a ArchiveConfig, codec Codec) (*internal.Archive, error) {
+	store, prefix, err := archiveStore(config, a)
+	if err != nil {
+		return nil, err
+	}
+	return internal.OpenArchiveStore(filepath.Join(dir, fmt.Sprintf("%d", a.Resolution)), codec, store, prefix)
+}
+
+//
+// A prefix for a new series' objects, unlikely to be any other
+// series'.
+//
+func newStorePrefix() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
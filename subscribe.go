@@ -0,0 +1,123 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"sort"
+	"sync"
+)
+
+//
+// Subscribers are called with values as AddValue(s) appends them,
+// for pushing new data to live dashboards and the like.  Like alert
+// rules, they live in memory only.
+//
+
+type subscriber struct {
+	keys *KeyFilter
+	fn   func(timestamp int64, vals map[string]float64)
+}
+
+//
+// Call fn from AddValue(s) with the values appended for keys
+// selected by keys (all if nil), as stored (so counters are
+// corrected for resets), along with any recorded by recording
+// rules, and the timestamp they were stored at, a multiple of the
+// base resolution.  Appends dropped as older than the latest data
+// aren't passed on.  fn gets
+// a map of its own, and isn't called when none of its keys were
+// appended.  It's called before AddValue(s) returns, so it should
+// hand the values off rather than block.  Call cancel to stop.
+//
+func (t *TimeSeries) Subscribe(keys *KeyFilter, fn func(timestamp int64, vals map[string]float64)) (cancel func()) {
+	s := &subscriber{ keys: keys, fn: fn }
+	t.subscribersMu.Lock()
+	t.subscribers = append(t.subscribers, s)
+	t.subscribersMu.Unlock()
+	return func() {
+		t.subscribersMu.Lock()
+		defer t.subscribersMu.Unlock()
+		for i, sub := range t.subscribers {
+			if sub == s {
+				t.subscribers = append(t.subscribers[:i:i], t.subscribers[i + 1:]...)
+				return
+			}
+		}
+	}
+}
+
+//
+// Pass the values appended at timestamp to the subscribers.
+//
+func (t *TimeSeries) notify(vals map[string]float64, timestamp int64) {
+	t.subscribersMu.Lock()
+	subs := t.subscribers
+	t.subscribersMu.Unlock()
+	for _, s := range subs {
+		matched := make(map[string]float64)
+		for k, v := range vals {
+			if s.keys.Has(k) {
+				matched[k] = v
+			}
+		}
+		if len(matched) > 0 {
+			s.fn(timestamp, matched)
+		}
+	}
+}
+
+// A value appended to a series, as sent by Watch.
+type Sample struct {
+	Key       string
+	Value     float64
+	Timestamp int64
+}
+
+// How many Samples a Watch channel holds before dropping more.
+const watchBuffer = 1024
+
+//
+// A channel receiving a Sample for each value AddValue(s) appends to
+// the given keys (all if none are given), in the order they're
+// added, until cancel is called, which closes it.  Like alert
+// events, Samples are sent without blocking, so they're dropped if
+// the consumer falls more than a thousand or so behind.
+//
+func (t *TimeSeries) Watch(keys ...string) (<-chan Sample, func()) {
+	var filter *KeyFilter
+	if len(keys) > 0 {
+		filter = Keys(keys...)
+	}
+	ch := make(chan Sample, watchBuffer)
+	var mu sync.Mutex
+	closed := false
+	unsubscribe := t.Subscribe(filter, func(timestamp int64, vals map[string]float64) {
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return
+		}
+		sorted := make([]string, 0, len(vals))
+		for k := range vals {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+		for _, k := range sorted {
+			select {
+			case ch <- Sample{ Key: k, Value: vals[k], Timestamp: timestamp }:
+			default:
+			}
+		}
+	})
+	cancel := func() {
+		unsubscribe()
+		mu.Lock()
+		defer mu.Unlock()
+		if !closed {
+			closed = true
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
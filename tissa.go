@@ -5,42 +5,470 @@ package tissa
 
 import (
 	"github.com/fred-lewis/tissa/internal"
+	"errors"
 	"fmt"
+	"math"
 	"sort"
+	"path"
 	"path/filepath"
+	"regexp"
 	"os"
-	"github.com/ugorji/go/codec"
+	"sync"
 	"time"
 )
 
 //
 // A TimeSeries can track multiple key/value pairs over time.
 // TimeSeries are append-only,and data can be rolled up to a
-// number of loawer-resolution archives.
+// number of loawer-resolution archives.  A TimeSeries may be used
+// from several goroutines: appends, writes and compactions take
+// turns, and queries run alongside each other between them.
+//
+// Each append, rollups included, happens whole before any query
+// sees it, and a Write saves the series as of some point between
+// appends.  Appends racing for the same tick are stored in the order
+// they take the lock, so the later may be dropped as older, and
+// subscribers may see them out of order.  Alert handlers and
+// subscribers are called outside the lock, and can query the series.
 //
 type TimeSeries struct {
+	// held to append, write or compact, and read-held by queries
+	mu          sync.RWMutex
 	archives    []*internal.Archive
+	aggregators []Aggregator
 	config      TimeSeriesConfig
+	dir         string
+	metrics     map[string]*metricState
+	metricsMu   sync.Mutex
+	// counter state changed since the last Write
+	metricsDirty bool
+	labels      *labelIndex
+	labelsMu    sync.Mutex
+	alerts      []*alertRule
+	alertsMu    sync.Mutex
+	recording   []*recordingRule
+	recordingMu sync.Mutex
+	subscribers []*subscriber
+	subscribersMu sync.Mutex
+	quota       quotaState
+	changes     *ChangeLog
+	// the set the series was opened from, if any
+	group       *seriesSet
+	// opened with OpenTimeSeriesReplica
+	readOnly    bool
+	// held while the series is open for writing
+	lock        *dirLock
+	flusher     *flusher
+	// values appended since the last Write, and when the first was
+	unflushed   int64
+	unflushedSince time.Time
+	// whoever opened it last didn't Close it
+	unclean     bool
+	// set by Close; guarded by mu
+	closed      bool
+	closeOnce   sync.Once
+	closeErr    error
+	// set by Write; see LastWriteTime to read it alongside one
 	LastWritten int64
+	lastSynced  int64
 }
 
 //
 // One or more ArchiveConfigs is required. DefaultValue is the value
-// to use for missing data.
+// to use for missing data.  Durability controls whether Write()
+// flushes files to stable storage; SyncInterval is the minimum
+// number of seconds between flushes for DURABILITY_PERIODIC.
+//
+// MaxGap, if set, is the largest number of seconds an append may
+// skip ahead of the latest data.  Appends further ahead fail with
+// ErrGapTooLarge, so a single bad timestamp can't push the whole
+// series past its retention.
+//
+// CacheSize, if set, is the number of bytes of decoded historical
+// chunks to keep in memory for queries, shared by all archives.
+// QueryWorkers limits how many chunks a query reads concurrently;
+// 0 means GOMAXPROCS.  Compression selects how chunk files are
+// compressed (COMPRESSION_NONE by default).
+//
+// Codec names the codec used to serialize chunk files, which must
+// have been registered with RegisterCodec; the default is msgpack.
+// The name is recorded in the config file, so the same codec must
+// be registered before the series is reopened.
+//
+// Fill is how queries fill gaps unless their QueryOptions say
+// otherwise; FILL_CONSTANT fills with DefaultValue.
+//
+// CarryForwardTicks is the longest gap, in ticks, that appends fill
+// in by repeating the latest values, in every archive; longer gaps
+// are left missing.  0 means 1, and a negative number turns it off,
+// so only appended values are ever stored.
+//
+// MaxQueryPoints and MaxQueryBytes, if set, cap how much a single
+// query may return: the number of intervals per series, and an
+// estimate of the bytes of all its series.  Queries over a larger
+// range fail with ErrQueryTooLarge; those that choose their own
+// resolution (QueryAuto, and Stitched at resolution 0) fall back to
+// the finest archive that fits.
+//
+// Quota, if set, limits the series' keys, disk usage and write rate.
+//
+// ChangeLog keeps an ordered log of every append, with offsets
+// consumers can commit and resume from; see ChangeLog().
+//
+// StorePrefix starts the names of the objects archives with a Store
+// keep their chunks in, followed by "/<resolution>/".  If empty, a
+// random one is chosen when the series is created, so series can
+// share a store.
+//
+// FlushInterval and MaxUnflushedPoints, if set, start a goroutine
+// when the series is created or opened that Writes it every
+// FlushInterval seconds, and whenever MaxUnflushedPoints values have
+// been appended since the last Write.  Errors are left for the next
+// Write to retry.  Call Close to stop it and flush the rest.
+// MaxUnflushedTicks and MaxUnflushedAge start it too, and have it
+// Write once that many base-resolution ticks have been appended
+// since the last Write, or the oldest append not yet written is that
+// many seconds old.  Together, they bound how much a Write has to
+// write, and how long appends wait to be written.
 //
 type TimeSeriesConfig struct {
 	Archives []ArchiveConfig
 	DefaultValue float64
+	Durability Durability
+	SyncInterval int64
+	MaxGap int64
+	CacheSize int64
+	QueryWorkers int
+	Compression CompressionCodec
+	Codec string
+	Fill FillPolicy
+	CarryForwardTicks int
+	MaxQueryPoints int64
+	MaxQueryBytes int64
+	Quota Quota
+	ChangeLog bool
+	StorePrefix string
+	FlushInterval int64
+	MaxUnflushedPoints int64
+	MaxUnflushedTicks int64
+	MaxUnflushedAge int64
 }
 
+// Durability levels for Write().  DURABILITY_NONE (the default)
+// leaves flushing to the OS.  DURABILITY_FSYNC fsyncs every file
+// on every Write().  DURABILITY_PERIODIC fsyncs everything written
+// since the last sync, on the first Write() after SyncInterval
+// seconds have passed.
+type Durability int
+
+const (
+	DURABILITY_NONE Durability = iota
+	DURABILITY_FSYNC
+	DURABILITY_PERIODIC
+)
+
 // Resolution and retention specified in seconds.  Use
 // package-level enum (SECOND, TEN_SECOND ...) to ensure
-// all resolutions divide evenly
+// all resolutions divide evenly.  Encoding selects the
+// on-disk chunk format (ENCODING_RAW by default).  Shards, if
+// more than 1, splits each chunk across that many files by key,
+// so queries for a few keys out of thousands only read the files
+// holding those keys.  ValueType sets the stored precision of
+// values (VALUE_FLOAT64 by default).  Percentiles, for rollup
+// archives, keeps a quantile sketch of each interval alongside its
+// Rollup, for the Percentiles query; every smaller rollup archive
+// must keep them too.  Sketches take far more space than Rollups,
+// and chunks holding them are never written fixed-layout.
+// Uniques is like Percentiles, but keeps a HyperLogLog of the
+// distinct values seen in each interval, for the UniqueCounts query.
+// Aggregation picks the single value the Values query returns for
+// each interval of a rollup archive (AGGREGATE_AVERAGE by default).
+// Store, if set, names a ChunkStore registered with
+// RegisterChunkStore, which keeps the archive's chunk files instead
+// of the local disk, for long-retention archives too large for it;
+// the archive's directory then holds only its metadata.  The latest
+// chunk is put to the store on every Write that changes it, and
+// chunks in the store can't be rechunked, and aren't copied by
+// Backup.
 type ArchiveConfig struct {
-	Resolution int64
-	Retention  int64
+	Resolution  int64
+	Retention   int64
+	Encoding    ChunkEncoding
+	Shards      int
+	ValueType   ValueType
+	Percentiles bool
+	Uniques     bool
+	Aggregation Aggregation
+	Store       string
+}
+
+// On-disk chunk formats.  ENCODING_GORILLA uses Gorilla-style
+// XOR float compression, which is typically much smaller for
+// slowly-changing values.  ENCODING_FIXED uses a fixed binary
+// layout that queries read directly from memory-mapped files,
+// without decoding whole chunks, which is fastest for large range
+// queries and keeps small ones cheap; such chunks bypass the
+// chunk cache.  ENCODING_RLE stores
+// runs of repeated values once, which suits keys that rarely
+// change (status flags, values carried forward).  ENCODING_DELTA
+// stores whole numbers as the difference from the previous tick,
+// for counters such as byte or request totals; other values are
+// stored in full, so it's safe for series that mix counters with
+// other keys.  Chunks are decoded
+// transparently on read, and each chunk file records its own
+// encoding, so an archive's encoding can be changed without
+// rewriting old data.
+type ChunkEncoding int
+
+const (
+	ENCODING_RAW ChunkEncoding = internal.EncodingRaw
+	ENCODING_GORILLA ChunkEncoding = internal.EncodingGorilla
+	ENCODING_FIXED ChunkEncoding = internal.EncodingFixed
+	ENCODING_RLE ChunkEncoding = internal.EncodingRLE
+	ENCODING_DELTA ChunkEncoding = internal.EncodingDelta
+)
+
+// Compression codecs for chunk files.  Each file records the codec
+// it was written with, so the codec can be changed without rewriting
+// old data.  Fixed-layout chunks (ENCODING_FIXED) are never
+// compressed, since queries read them in place.
+type CompressionCodec int
+
+const (
+	COMPRESSION_NONE CompressionCodec = internal.CompressNone
+	COMPRESSION_GZIP CompressionCodec = internal.CompressGzip
+	COMPRESSION_SNAPPY CompressionCodec = internal.CompressSnappy
+	COMPRESSION_ZSTD CompressionCodec = internal.CompressZstd
+)
+
+// Stored value precisions.  VALUE_FLOAT32 halves the size of raw
+// and fixed-layout chunks (and usually shrinks Gorilla ones) at the
+// cost of rounding each value to float32 on append.  Queries still
+// return float64.  It only affects archives of plain values (the
+// base archive); rollups are always stored in full, since totals
+// can grow large.
+type ValueType int
+
+const (
+	VALUE_FLOAT64 ValueType = internal.ValueFloat64
+	VALUE_FLOAT32 ValueType = internal.ValueFloat32
+)
+
+// Serializes the objects stored in chunk files.  Implementations
+// must round-trip exported struct fields of slices, maps, strings,
+// byte slices and numbers (including NaN).
+type Codec = internal.Codec
+
+var codecs = map[string]Codec{
+	internal.Msgpack.Name(): internal.Msgpack,
+}
+var codecsMu sync.RWMutex
+
+//
+// Make a codec available to TimeSeriesConfig.Codec under its Name().
+// Registering a name again replaces the earlier codec.
+//
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.Name()] = c
+}
+
+func lookupCodec(name string) (Codec, error) {
+	if name == "" {
+		return internal.Msgpack, nil
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("codec %q is not registered", name)
+	}
+	return c, nil
+}
+
+// How a rollup archive reduces each interval to one value for the
+// Values query: e.g. AGGREGATE_SUM for counters, AGGREGATE_LAST for
+// gauges.  Rollups always keep everything needed to merge them, so
+// an archive's aggregation doesn't limit the other queries.  Custom
+// aggregations are added with RegisterAggregation.
+type Aggregation string
+
+const (
+	AGGREGATE_AVERAGE Aggregation = "average"
+	AGGREGATE_SUM Aggregation = "sum"
+	AGGREGATE_COUNT Aggregation = "count"
+	AGGREGATE_MIN Aggregation = "min"
+	AGGREGATE_MAX Aggregation = "max"
+	AGGREGATE_FIRST Aggregation = "first"
+	AGGREGATE_LAST Aggregation = "last"
+	AGGREGATE_TIME_WEIGHTED Aggregation = "time-weighted"
+)
+
+// Reduces one interval's Rollup to a single value.
+type Aggregator func(Rollup) float64
+
+var aggregators = map[Aggregation]Aggregator{
+	AGGREGATE_AVERAGE: averageOf,
+	AGGREGATE_SUM: sumOf,
+	AGGREGATE_COUNT: countOf,
+	AGGREGATE_MIN: minimumOf,
+	AGGREGATE_MAX: maximumOf,
+	AGGREGATE_FIRST: firstOf,
+	AGGREGATE_LAST: lastOf,
+	AGGREGATE_TIME_WEIGHTED: Rollup.TimeWeightedAverage,
+}
+var aggregatorsMu sync.RWMutex
+
+//
+// Make a custom aggregation available to ArchiveConfig.Aggregation.
+// Like codecs, the name is recorded in the config file, so it must
+// be registered again before the series is reopened.
+//
+func RegisterAggregation(name Aggregation, fn Aggregator) {
+	aggregatorsMu.Lock()
+	defer aggregatorsMu.Unlock()
+	aggregators[name] = fn
+}
+
+func lookupAggregators(archives []ArchiveConfig) ([]Aggregator, error) {
+	aggregatorsMu.RLock()
+	defer aggregatorsMu.RUnlock()
+	res := make([]Aggregator, len(archives))
+	for i, a := range archives {
+		name := a.Aggregation
+		if name == "" {
+			name = AGGREGATE_AVERAGE
+		}
+		fn, ok := aggregators[name]
+		if !ok {
+			return nil, fmt.Errorf("aggregation %q is not registered", name)
+		}
+		res[i] = fn
+	}
+	return res, nil
+}
+
+//
+// The Aggregator registered as agg; AGGREGATE_AVERAGE if empty.
+//
+func lookupAggregation(agg Aggregation) (Aggregator, error) {
+	if agg == "" {
+		agg = AGGREGATE_AVERAGE
+	}
+	aggregatorsMu.RLock()
+	fn, ok := aggregators[agg]
+	aggregatorsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("aggregation %q is not registered", agg)
+	}
+	return fn, nil
+}
+
+// Selects the keys a query returns, as QueryOptions.Keys.
+// Only matching series are scanned and returned; in sharded
+// archives, a list of keys also limits which shard files are read.
+type KeyFilter = internal.KeySet
+
+//
+// A filter for exactly the given keys.
+//
+func Keys(keys ...string) *KeyFilter {
+	return internal.KeyNames(keys...)
+}
+
+//
+// A filter for keys matching a shell pattern, as for path.Match
+// ("cpu.*", "host?/load").
+//
+func KeyGlob(pattern string) (*KeyFilter, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	return internal.MatchKeys(func(key string) bool {
+		ok, _ := path.Match(pattern, key)
+		return ok
+	}), nil
+}
+
+//
+// A filter for keys matching a regular expression anywhere in the
+// key; anchor it with ^ and $ to match whole keys.
+//
+func KeyRegexp(expr string) (*KeyFilter, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return internal.MatchKeys(re.MatchString), nil
+}
+
+// How queries fill intervals with no data.  FILL_DEFAULT in
+// QueryOptions defers to TimeSeriesConfig.Fill; as that, it gives
+// DefaultValue at the base resolution and 0 in rollups, which can't
+// be told apart from real values.  FILL_NAN gives NaN, so missing
+// data can be found with math.IsNaN (Query also reports it in
+// Result.Missing).  FILL_PREVIOUS carries the previous interval's
+// value forward (NaN before the first).  FILL_LINEAR interpolates
+// between the values either side of a gap (NaN before the first
+// and after the last).  FILL_CONSTANT fills with a fixed value.
+type FillPolicy int
+
+const (
+	FILL_DEFAULT FillPolicy = iota
+	FILL_NAN
+	FILL_PREVIOUS
+	FILL_LINEAR
+	FILL_CONSTANT
+)
+
+// Optional settings for the queries that take them (those returning
+// one value per interval).  Keys restricts the keys returned
+// (all by default).  Limit, if more than 0, caps the number of
+// series returned, keeping the first keys in sorted order.  Fill
+// sets how gaps are filled, and FillValue the value for
+// FILL_CONSTANT.  Transforms, such as MovingAverage or EWMA, are
+// then applied to each series in order.  Only Keys, Limit and Stats
+// apply to Rollups.  Stats, if set, is filled in with what the query
+// read and returned.
+type QueryOptions struct {
+	Keys       *KeyFilter
+	Limit      int
+	Fill       FillPolicy
+	FillValue  float64
+	Transforms []Transform
+	Stats      *QueryStats
+}
+
+//
+// The options for a query, with the series' fill policy in place of
+// FILL_DEFAULT.
+//
+func (t *TimeSeries) queryOptions(opts []QueryOptions) QueryOptions {
+	var o QueryOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if o.Fill == FILL_DEFAULT && t.config.Fill != FILL_DEFAULT {
+		o.Fill = t.config.Fill
+		o.FillValue = t.config.DefaultValue
+	}
+	return o
 }
 
+// Returned (wrapped) by queries when a chunk file fails its
+// checksum or can't be decoded.  Whatever data could be read is
+// returned alongside the error, so callers may choose to use it.
+var ErrCorruptChunk = internal.ErrCorruptChunk
+
+// Returned (wrapped) by AddValue(s) when a timestamp is more than
+// MaxGap seconds past the latest data.  Nothing is appended.
+var ErrGapTooLarge = errors.New("gap too large")
+
+// Returned by appends, writes, and anything else that would change
+// a series after its Close.
+var ErrClosed = errors.New("series is closed")
+
 // Each divisible by all priors
 const (
 	SECOND int64 = 1
@@ -66,19 +494,80 @@ const chunkSizeSlots = 2000
 // each resolution must be a multiple of the last, and rollups will be
 // populated automatically when new data is inserted.
 //
+// If dir is "", the series is kept only in memory, and nothing is
+// written to disk: Write still compresses finished chunks and
+// exercises retention, but the series is gone once it's dropped.
+// In-memory series can't have a change log, a disk quota, or
+// archives in a chunk store, and can't be backed up or reopened.
+//
+// As with OpenTimeSeries, the directory is locked, and NewTimeSeries
+// fails with ErrLocked if a series is open there already.
+//
 func NewTimeSeries(dir string, config TimeSeriesConfig) (*TimeSeries, error) {
 	if config.Archives == nil || len(config.Archives) == 0 {
 		return nil, fmt.Errorf("config must specify at least one archive")
 	}
+	memory := dir == ""
+	if memory {
+		if config.ChangeLog {
+			return nil, fmt.Errorf("in-memory series can't keep a change log")
+		}
+		if config.Quota.MaxDiskBytes > 0 {
+			return nil, fmt.Errorf("in-memory series can't have a disk quota")
+		}
+		for _, a := range config.Archives {
+			if a.Store != "" {
+				return nil, fmt.Errorf("in-memory series can't keep archives in a chunk store")
+			}
+		}
+	}
 
 	sort.Slice(config.Archives, func(i, j int) bool {
 		return config.Archives[i].Resolution < config.Archives[j].Resolution
 	})
 
-	os.Mkdir(dir, 0700)
+	codec, err := lookupCodec(config.Codec)
+	if err != nil {
+		return nil, err
+	}
+	aggs, err := lookupAggregators(config.Archives)
+	if err != nil {
+		return nil, err
+	}
+	stores := make([]ChunkStore, len(config.Archives))
+	for i, a := range config.Archives {
+		if a.Store == "" {
+			continue
+		}
+		if config.StorePrefix == "" {
+			if config.StorePrefix, err = newStorePrefix(); err != nil {
+				return nil, err
+			}
+		}
+		if stores[i], err = lookupChunkStore(a.Store); err != nil {
+			return nil, err
+		}
+	}
+
 	series := TimeSeries{
 		config: config,
+		aggregators: aggs,
+		dir: dir,
+		metrics: make(map[string]*metricState),
+		labels: newLabelIndex(),
+	}
+	if !memory {
+		os.Mkdir(dir, 0700)
+		if series.lock, err = lockDir(dir); err != nil {
+			return nil, err
+		}
 	}
+	created := false
+	defer func() {
+		if !created {
+			series.lock.release(false)
+		}
+	}()
 
 	series.archives = make([]*internal.Archive, len(config.Archives))
 	last := int64(1)
@@ -87,47 +576,165 @@ func NewTimeSeries(dir string, config TimeSeriesConfig) (*TimeSeries, error) {
 			return nil, fmt.Errorf("each archive resolution must be divisible by all smaller ones")
 		}
 		last = a.Resolution
+		if a.Percentiles && i > 1 && !config.Archives[i - 1].Percentiles {
+			return nil, fmt.Errorf("archives keeping percentiles need every smaller rollup archive to keep them")
+		}
+		if a.Uniques && i > 1 && !config.Archives[i - 1].Uniques {
+			return nil, fmt.Errorf("archives keeping unique counts need every smaller rollup archive to keep them")
+		}
 
-		fp := filepath.Join(dir, fmt.Sprintf("%d", a.Resolution))
-		err := os.Mkdir(fp, 0700)
-		if err != nil {
-			return nil, err
+		fp := ""
+		if !memory {
+			fp = filepath.Join(dir, fmt.Sprintf("%d", a.Resolution))
+			err := os.Mkdir(fp, 0700)
+			if err != nil {
+				return nil, err
+			}
 		}
 		series.archives[i] = internal.NewArchive(fp, a.Resolution, a.Retention, chunkSizeSlots * a.Resolution)
+		series.archives[i].Encoding = int(a.Encoding)
+		series.archives[i].Shards = a.Shards
+		series.archives[i].ValueType = int(a.ValueType)
+		series.archives[i].Compression = int(config.Compression)
+		series.archives[i].Sketches = a.Percentiles && i > 0
+		series.archives[i].Uniques = a.Uniques && i > 0
+		series.archives[i].SetCodec(codec)
+		if stores[i] != nil {
+			_, prefix, _ := archiveStore(config, a)
+			series.archives[i].SetChunkStore(stores[i], prefix)
+		}
+		if memory {
+			series.archives[i].SetMemory()
+		}
 		series.archives[i].Write()
 	}
+	series.configureArchives()
+	if memory {
+		created = true
+		series.startFlusher()
+		return &series, nil
+	}
+	if config.ChangeLog {
+		if series.changes, err = openChangeLog(filepath.Join(dir, changeLogDir)); err != nil {
+			return nil, err
+		}
+	}
 
 	fp := filepath.Join(dir, "config")
-	err := writeObject(fp, config)
+	err = internal.WriteObject(fp, config)
 	if err != nil {
 		return nil, err
 	}
+	if config.Durability != DURABILITY_NONE {
+		err = internal.SyncFile(fp)
+		if err == nil {
+			err = internal.SyncFile(dir)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
 
+	created = true
+	series.startFlusher()
 	return &series, nil
 }
 
 //
 //  Open an existing TimeSeries in the given directory
 //
+// The directory is locked while the series is open, so a series
+// can only be open for writing once at a time, even within a
+// process; opening it again gets ErrLocked, but it can be opened
+// with OpenTimeSeriesReplica to query it.  Call Close to unlock it;
+// UncleanShutdown reports whether whoever opened it last did.
+//
 func OpenTimeSeries(dir string) (*TimeSeries, error) {
+	return openTimeSeries(dir, false)
+}
+
+//
+// Open the TimeSeries in dir, read-only if readOnly, in which case
+// nothing in it is written to.
+//
+func openTimeSeries(dir string, readOnly bool) (*TimeSeries, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("in-memory series can't be reopened")
+	}
 	fp := filepath.Join(dir, "config")
 
 	var config TimeSeriesConfig
-	err := readObject(fp, &config)
+	err := internal.ReadObject(fp, &config)
+	if err != nil {
+		return nil, err
+	}
+	var lock *dirLock
+	if !readOnly {
+		if lock, err = lockDir(dir); err != nil {
+			return nil, err
+		}
+	}
+	opened := false
+	defer func() {
+		if !opened {
+			lock.release(false)
+		}
+	}()
+	codec, err := lookupCodec(config.Codec)
+	if err != nil {
+		return nil, err
+	}
+	aggs, err := lookupAggregators(config.Archives)
 	if err != nil {
 		return nil, err
 	}
 
 	series := TimeSeries{
 		config: config,
+		aggregators: aggs,
+		dir: dir,
+		readOnly: readOnly,
+		lock: lock,
+		unclean: lock != nil && lock.unclean,
+	}
+	series.metrics, err = readMetrics(dir)
+	if err != nil {
+		return nil, err
+	}
+	series.labels, err = readLabels(dir)
+	if err != nil {
+		return nil, err
+	}
+	series.recording, err = readRecordingRules(dir)
+	if err != nil {
+		return nil, err
 	}
 
 	series.archives = make([]*internal.Archive, len(config.Archives))
 	for i, a := range config.Archives {
-		fp := filepath.Join(dir, fmt.Sprintf("%d", a.Resolution))
-		series.archives[i], err = internal.OpenArchive(fp)
+		series.archives[i], err = openArchive(dir, config, a, codec)
+		if err != nil {
+			return nil, err
+		}
+	}
+	series.configureArchives()
+	if readOnly {
+		opened = true
+		return &series, nil
+	}
+	if config.ChangeLog {
+		if series.changes, err = openChangeLog(filepath.Join(dir, changeLogDir)); err != nil {
+			return nil, err
+		}
+	}
+	if config.Quota.MaxDiskBytes > 0 {
+		if err = series.quota.measure(dir); err != nil {
+			return nil, err
+		}
 	}
 
+	opened = true
+	series.startFlusher()
 	return &series, nil
 }
 
@@ -149,15 +756,116 @@ func (t *TimeSeries) AddValue(key string, val float64, timestamp int64) error {
 // will be normalized to a multiple of the TimeSeries' base resolution.
 //
 func (t *TimeSeries) AddValues(vals map[string]float64, timestamp int64) error {
+	var alerts alertBatch
+	t.mu.Lock()
+	stored, normalized, err := t.addValues(vals, timestamp, &alerts)
+	if stored != nil {
+		t.countUnflushed(len(stored))
+	}
+	t.mu.Unlock()
+	// outside the lock, so handlers can query the series
+	alerts.send()
+	if stored != nil {
+		t.notify(stored, normalized)
+	}
+	return err
+}
+
+//
+// Append rollups to the rollup archive at resolution, for backfilling
+// history kept elsewhere, such as the coarser archives of a Whisper
+// file.  Unlike AddValues, nothing is rolled up further, counters
+// aren't corrected, and alerts, subscribers and the change log
+// aren't told.  As for the rollups archives make themselves,
+// timestamp is the end of the interval the rollups cover.  Rollups
+// older than the archive's latest are dropped.
+//
+func (t *TimeSeries) AddRollups(resolution int64, vals map[string]Rollup, timestamp int64) error {
+	if t.readOnly {
+		return ErrReadOnly
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrClosed
+	}
+	for i, a := range t.archives {
+		if a.Interval != resolution {
+			continue
+		}
+		if i == 0 {
+			return fmt.Errorf("resolution %d is the base archive's; add values instead", resolution)
+		}
+		a.AppendRollups(vals, timestamp)
+		t.countUnflushed(len(vals))
+		return nil
+	}
+	return fmt.Errorf("no archive with resolution %d", resolution)
+}
+
+//
+// Append vals, collecting alert events in alerts.  Returns the
+// values stored and their normalized timestamp, or nil if the
+// append was older than the latest data and dropped.
+//
+func (t *TimeSeries) addValues(vals map[string]float64, timestamp int64,
+	alerts *alertBatch) (map[string]float64, int64, error) {
+
+	if t.readOnly {
+		return nil, 0, ErrReadOnly
+	}
+	if t.closed {
+		return nil, 0, ErrClosed
+	}
+	if err := t.admit(vals); err != nil {
+		return nil, 0, err
+	}
 	curArchive := t.baseArchive()
 	lastTimestamp := curArchive.EndTime
+	held := curArchive.NumKeys()
 
-	convertedMap := make(map[string]interface{}, len(vals))
-	for k, v := range vals {
-		convertedMap[k] = v
+	maxGap := t.config.MaxGap
+	if maxGap > 0 && lastTimestamp > 0 && timestamp - lastTimestamp > maxGap {
+		return nil, 0, fmt.Errorf("timestamp %d is %d seconds past latest data: %w",
+			timestamp, timestamp - lastTimestamp, ErrGapTooLarge)
 	}
 
-	curArchive.Append(convertedMap, timestamp)
+	// rounded as the archive rounds it, so fresh is whether the
+	// archive keeps the append, merging it into the latest tick if
+	// it's in that one, and dropping it if it's older
+	normalized := curArchive.Normalize(timestamp)
+	fresh := normalized >= lastTimestamp
+	if fresh && t.changes != nil {
+		// logged as given, and whenever the archive keeps it, so
+		// replaying the log reproduces the series
+		if err := t.changes.append(vals, timestamp); err != nil {
+			return nil, 0, err
+		}
+	}
+	if fresh {
+		vals = t.correctCounters(vals)
+	}
+	curArchive.AppendFloats(vals, timestamp)
+	if fresh {
+		if rec := t.recordRules(vals); rec != nil {
+			curArchive.AppendFloats(rec, timestamp)
+			all := make(map[string]float64, len(vals) + len(rec))
+			for k, v := range vals {
+				all[k] = v
+			}
+			for k, v := range rec {
+				all[k] = v
+			}
+			vals = all
+		}
+	}
+	if t.group != nil {
+		// the namespace keeps a running count of keys for its quota
+		t.group.usage.addKeys(curArchive.NumKeys() - held)
+	}
+	if fresh && t.alertsOn(0) {
+		t.checkAlerts(0, vals, curArchive.EndTime, alerts)
+	}
 
 	for i := 1; i < len(t.archives); i++ {
 		rollupArchive := t.archives[i]
@@ -171,239 +879,1262 @@ func (t *TimeSeries) AddValues(vals map[string]float64, timestamp int64) error {
 		rollupStart := timestamp - (timestamp % rollupIval) - rollupIval
 		rollupEnd := rollupStart + rollupIval
 
-		data, _ := curArchive.GetData(rollupStart, rollupEnd)
-
-		var rollups map[string]interface{}
-		if i == 1 {
-			rollups = rollupRawData(data)
-		} else {
-			rollups = rollupRollupData(data)
+		curArchive.RollupTo(rollupArchive, rollupStart, rollupEnd)
+		if t.alertsOn(i) {
+			t.checkRollupAlerts(i, rollupEnd, alerts)
 		}
-
-		rollupArchive.Append(rollups, rollupEnd)
 		curArchive = rollupArchive
 	}
 
-	return nil
+	if !fresh {
+		return nil, normalized, nil
+	}
+	return vals, normalized, nil
 }
 
 
-//
-//  Retrieve the latest key-value pairs
-//
-func (t *TimeSeries) Latest() (val map[string]float64, timestamp int64) {
-	d, ts := t.baseArchive().Latest()
-	res := make(map[string]float64, len(d))
-	for k, v := range d {
-		res[k] = v.(float64)
-	}
-	return res, ts
+// Metric types for SetMetricType.  Keys are METRIC_GAUGE unless set
+// otherwise.  METRIC_COUNTER keys are cumulative totals that only go
+// up, except when the counter is reset (e.g. its process restarts)
+// or wraps.  AddValue treats any decrease as a reset and stores the
+// value plus everything counted before the reset, so the stored
+// series keeps increasing; rollups and queries such as Averages and
+// Rates then see no drop.
+type MetricType int
+
+const (
+	METRIC_GAUGE MetricType = iota
+	METRIC_COUNTER
+)
+
+type metricState struct {
+	Type   MetricType
+	// the latest value appended, as given
+	Raw    float64
+	Seen   bool
+	// added to appended values to carry totals across resets
+	Offset float64
 }
 
-//
-//  For querying rollup archives.  Returns average value series for all keys.
-//
-func (t *TimeSeries) Averages(startTime, endTime, resolution int64) (map[string][]float64, []int64, error) {
-	return t.walkData(startTime, endTime, resolution, func(r Rollup) float64 {
-		if r.Count > 0 {
-			return r.Total / float64(r.Count)
-		}
-		return 0.0
-	})
+const metricsFile = "metrics"
+
+func readMetrics(dir string) (map[string]*metricState, error) {
+	var metrics map[string]*metricState
+	err := internal.ReadObject(filepath.Join(dir, metricsFile), &metrics)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	if metrics == nil {
+		metrics = make(map[string]*metricState)
+	}
+	return metrics, err
 }
 
 //
-//  For querying rollup archives.  Returns maximum value series for all keys.
+// Set the metric type of key.  Types are recorded alongside the
+// config, and counter state is saved by Write.  Changing a counter
+// back to a gauge forgets its state, so later values are stored as
+// given.
 //
-func (t *TimeSeries) Maximums(startTime, endTime, resolution int64) (map[string][]float64, []int64, error) {
-	return t.walkData(startTime, endTime, resolution, func(r Rollup) float64 {
-		if r.Count > 0 {
-			return r.Max
-		}
-		return 0.0
-	})
+func (t *TimeSeries) SetMetricType(key string, typ MetricType) error {
+	if t.readOnly {
+		return ErrReadOnly
+	}
+	t.metricsMu.Lock()
+	defer t.metricsMu.Unlock()
+	m, ok := t.metrics[key]
+	if ok && m.Type == typ {
+		return nil
+	}
+	if typ == METRIC_GAUGE {
+		delete(t.metrics, key)
+	} else {
+		t.metrics[key] = &metricState{ Type: typ }
+	}
+	return t.writeMetrics()
 }
 
 //
-//  For querying rollup archives.  Returns minimums value series for all keys.
+// The metric type of key.
 //
-func (t *TimeSeries) Minimums(startTime, endTime, resolution int64) (map[string][]float64, []int64, error) {
-	return t.walkData(startTime, endTime, resolution, func(r Rollup) float64 {
-		if r.Count > 0 {
-			return r.Min
-		}
-		return 0.0
-	})
+func (t *TimeSeries) MetricType(key string) MetricType {
+	t.metricsMu.Lock()
+	defer t.metricsMu.Unlock()
+	if m, ok := t.metrics[key]; ok {
+		return m.Type
+	}
+	return METRIC_GAUGE
 }
 
 //
-//  For querying raw daa from rollup archives.
+// Returns vals with counters corrected for resets, copying it if
+// anything changes.
 //
-func (t *TimeSeries) Rollups(startTime, endTime, resolution int64) (map[string][]Rollup, []int64, error) {
-	if resolution == t.baseArchive().Interval {
-		//TODO
-		return nil, nil, fmt.Errorf("cannot get rollups from base archive")
+func (t *TimeSeries) correctCounters(vals map[string]float64) map[string]float64 {
+	t.metricsMu.Lock()
+	defer t.metricsMu.Unlock()
+	if len(t.metrics) == 0 {
+		return vals
 	}
-
-	var archive *internal.Archive = nil
-	for i := 1; i < len(t.archives); i++ {
-		if t.archives[i].Interval == resolution {
-			archive = t.archives[i]
+	var res map[string]float64
+	for k, v := range vals {
+		m, ok := t.metrics[k]
+		if !ok || m.Type != METRIC_COUNTER {
+			continue
 		}
-	}
-	if archive == nil {
-		return nil, nil, fmt.Errorf("no matching archive")
-	}
-
-	data, ts := archive.GetData(startTime, endTime)
-	vals := make(map[string][]Rollup, len(data))
-	for k, v := range data {
-		vals[k] = make([]Rollup, len(v))
-		for i, d := range v {
-			if d != nil {
-				vals[k][i] = d.(Rollup)
-			} else {
-				vals[k][i] = Rollup{}
+		if m.Seen && v < m.Raw {
+			// reset
+			m.Offset += m.Raw
+		}
+		m.Raw, m.Seen = v, true
+		t.metricsDirty = true
+		if m.Offset == 0 {
+			continue
+		}
+		if res == nil {
+			res = make(map[string]float64, len(vals))
+			for k2, v2 := range vals {
+				res[k2] = v2
 			}
 		}
+		res[k] = v + m.Offset
+	}
+	if res == nil {
+		return vals
 	}
+	return res
+}
 
-	return vals, ts, nil
+func (t *TimeSeries) writeMetrics() error {
+	if t.InMemory() {
+		t.metricsDirty = false
+		return nil
+	}
+	fp := filepath.Join(t.dir, metricsFile)
+	err := internal.WriteObject(fp, t.metrics)
+	if err == nil && t.config.Durability != DURABILITY_NONE {
+		err = internal.SyncFile(fp)
+	}
+	if err == nil {
+		t.metricsDirty = false
+	}
+	return err
 }
 
 //
-// Write the TimeSeries to disk, and exercise retention (delete any
-// chunks that are fully expired).
+// Whether the series is kept only in memory, having been created
+// with no directory.
 //
-func (t *TimeSeries) Write() error {
-	for _, a := range t.archives {
-		err := a.Write()
-		if err != nil {
-			return err
+func (t *TimeSeries) InMemory() bool {
+	return t.dir == ""
+}
+
+//
+//  Retrieve the latest key-value pairs
+//
+func (t *TimeSeries) Latest() (val map[string]float64, timestamp int64) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.baseArchive().LatestFloats()
+}
+
+//
+//  The configuration the series was created with.
+//
+func (t *TimeSeries) Config() TimeSeriesConfig {
+	return t.config
+}
+
+//
+//  The keys written to recently: those in the latest chunk of the
+//  base archive, sorted.
+//
+func (t *TimeSeries) Keys() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.baseArchive().Keys()
+}
+
+//
+//  The range of data held at the given resolution, as [start, end)
+//  bounds to query with.  Both are 0 if the archive is empty.
+//
+func (t *TimeSeries) TimeRange(resolution int64) (start, end int64, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, a := range t.archives {
+		if a.Interval == resolution {
+			start, end = a.TimeRange()
+			if end == 0 {
+				return 0, 0, nil
+			}
+			return start, end + a.Interval, nil
 		}
 	}
-	t.LastWritten = time.Now().Unix()
-	return nil
+	return 0, 0, fmt.Errorf("no matching archive")
+}
+
+//
+//  The timestamp of the oldest data held at any resolution; coarser
+//  archives usually reach further back.  0 if the series is empty.
+//
+func (t *TimeSeries) Oldest() int64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	oldest := int64(0)
+	for _, a := range t.archives {
+		start, end := a.TimeRange()
+		if end > 0 && (oldest == 0 || start < oldest) {
+			oldest = start
+		}
+	}
+	return oldest
 }
 
-func (t *TimeSeries) walkData(startTime, endTime, resolution int64,
-	rollupHandler func(Rollup) float64) (map[string][]float64, []int64, error)  {
+//
+//  The timestamp of the latest data, or 0 if the series is empty.
+//
+func (t *TimeSeries) Newest() int64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, end := t.baseArchive().TimeRange()
+	return end
+}
 
-	l := (endTime - startTime) / resolution
-	if (endTime - startTime) % resolution > 0 {
-		l++
+//
+//  Retrieve the latest value of key, and its timestamp.  ok is false
+//  if the series holds no value for key.
+//
+func (t *TimeSeries) LatestFor(key string) (val float64, timestamp int64, ok bool, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	vals, stamps, err := t.baseArchive().LatestN(key, 1)
+	if len(vals) == 0 {
+		return 0, 0, false, err
 	}
+	return vals[0], stamps[0], true, err
+}
 
-	if resolution == t.baseArchive().Interval {
-		idata, ts := t.baseArchive().GetData(startTime, endTime)
-		vals := make(map[string][]float64, len(idata))
-		for k, v := range idata {
-			vals[k] = make([]float64, l)
-			for i, d := range v {
-				if d != nil {
-					vals[k][i] = d.(float64)
-				} else {
-					vals[k][i] = t.config.DefaultValue
+//
+//  The Rollup of key for the interval at resolution covering
+//  timestamp, e.g. the hour from 3pm, without a range query.  At the
+//  base resolution, it's the tick timestamp is normalized to, as a
+//  Rollup of its one value.  ok is false if key has no data there.
+//
+func (t *TimeSeries) RollupAt(key string, timestamp, resolution int64) (r Rollup, ok bool, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	archive := t.baseArchive()
+	// rollups are stored at the end of the interval they cover, and
+	// base values at the tick their timestamp rounds up to
+	stamp := timestamp - timestamp % resolution
+	if resolution != archive.Interval {
+		archive, err = t.rollupArchive(resolution)
+		if err != nil {
+			return r, false, err
+		}
+		stamp += resolution
+	} else if stamp < timestamp {
+		stamp += resolution
+	}
+
+	_, _, err = archive.GetRollupValuesMatching(nil, nil, stamp, stamp + resolution, func(got Rollup) float64 {
+		r = got
+		return 0
+	}, internal.KeyNames(key))
+	return r, r.Count > 0, err
+}
+
+//
+//  Retrieve the latest n values of key, oldest first, and their
+//  timestamps.  Only as much of the base archive as is needed is
+//  read, so this is much cheaper than a query for a few points.
+//  Fewer than n are returned if the series doesn't hold that many.
+//
+func (t *TimeSeries) LatestN(key string, n int) ([]float64, []int64, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.baseArchive().LatestN(key, n)
+}
+
+//
+//  For querying rollup archives.  Returns average value series for all
+//  keys, or those selected by opts.
+//
+func (t *TimeSeries) Averages(startTime, endTime, resolution int64, opts ...QueryOptions) (map[string][]float64, []int64, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.query(startTime, endTime, resolution, averageOf, false, opts)
+}
+
+//
+//  For querying rollup archives.  Returns maximum value series for all
+//  keys, or those selected by opts.
+//
+func (t *TimeSeries) Maximums(startTime, endTime, resolution int64, opts ...QueryOptions) (map[string][]float64, []int64, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.query(startTime, endTime, resolution, maximumOf, false, opts)
+}
+
+//
+//  For querying rollup archives.  Returns minimums value series for all
+//  keys, or those selected by opts.
+//
+func (t *TimeSeries) Minimums(startTime, endTime, resolution int64, opts ...QueryOptions) (map[string][]float64, []int64, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.query(startTime, endTime, resolution, minimumOf, false, opts)
+}
+
+//
+// Like Averages, but reuses the series in dst and the timestamps
+// slice where they're big enough, so that a caller polling the same
+// query can avoid allocating.  Pass the results of the previous call
+// back in; keys with no data in the range are removed from dst.
+//
+func (t *TimeSeries) AveragesInto(dst map[string][]float64, timestamps []int64,
+	startTime, endTime, resolution int64) (map[string][]float64, []int64, error) {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.walkData(dst, timestamps, startTime, endTime, resolution, averageOf, false, nil)
+}
+
+//
+// Like Maximums, reusing dst and timestamps as AveragesInto does.
+//
+func (t *TimeSeries) MaximumsInto(dst map[string][]float64, timestamps []int64,
+	startTime, endTime, resolution int64) (map[string][]float64, []int64, error) {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.walkData(dst, timestamps, startTime, endTime, resolution, maximumOf, false, nil)
+}
+
+//
+// Like Minimums, reusing dst and timestamps as AveragesInto does.
+//
+func (t *TimeSeries) MinimumsInto(dst map[string][]float64, timestamps []int64,
+	startTime, endTime, resolution int64) (map[string][]float64, []int64, error) {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.walkData(dst, timestamps, startTime, endTime, resolution, minimumOf, false, nil)
+}
+
+//
+//  For querying rollup archives.  Returns the total of the values
+//  in each interval, for all keys.
+//
+func (t *TimeSeries) Sums(startTime, endTime, resolution int64, opts ...QueryOptions) (map[string][]float64, []int64, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.query(startTime, endTime, resolution, sumOf, false, opts)
+}
+
+//
+//  For querying rollup archives.  Returns the number of values
+//  appended in each interval, for all keys.  At the base resolution
+//  each tick counts 1 if it has a value, and 0 if not.
+//
+func (t *TimeSeries) Counts(startTime, endTime, resolution int64, opts ...QueryOptions) (map[string][]float64, []int64, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.query(startTime, endTime, resolution, countOf, true, opts)
+}
+
+//
+//  For querying rollup archives.  Returns the (population) standard
+//  deviation of the values in each interval, for all keys.  Intervals
+//  rolled up before standard deviations were tracked are NaN, unless
+//  all their values were the same.
+//
+func (t *TimeSeries) StdDevs(startTime, endTime, resolution int64, opts ...QueryOptions) (map[string][]float64, []int64, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.query(startTime, endTime, resolution, stdDevOf, true, opts)
+}
+
+//
+//  For querying rollup archives.  Returns the first value appended
+//  in each interval, for all keys.
+//
+func (t *TimeSeries) Firsts(startTime, endTime, resolution int64, opts ...QueryOptions) (map[string][]float64, []int64, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.query(startTime, endTime, resolution, firstOf, false, opts)
+}
+
+//
+//  For querying rollup archives.  Returns the last value appended
+//  in each interval, for all keys, e.g. for gauges such as queue
+//  depths.
+//
+func (t *TimeSeries) Lasts(startTime, endTime, resolution int64, opts ...QueryOptions) (map[string][]float64, []int64, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.query(startTime, endTime, resolution, lastOf, false, opts)
+}
+
+//
+//  For querying rollup archives.  Returns the average value in each
+//  interval weighted by how long each value was in effect, for all
+//  keys.  This suits sparse or irregular series, where a value held
+//  for an hour should count for more than one replaced a second
+//  later.
+//
+func (t *TimeSeries) TimeWeightedAverages(startTime, endTime, resolution int64, opts ...QueryOptions) (map[string][]float64, []int64, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.query(startTime, endTime, resolution, Rollup.TimeWeightedAverage, false, opts)
+}
+
+//
+// Like TimeWeightedAverages, reusing dst and timestamps as
+// AveragesInto does.
+//
+func (t *TimeSeries) TimeWeightedAveragesInto(dst map[string][]float64, timestamps []int64,
+	startTime, endTime, resolution int64) (map[string][]float64, []int64, error) {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.walkData(dst, timestamps, startTime, endTime, resolution, Rollup.TimeWeightedAverage, false, nil)
+}
+
+//
+//  Average value series at any resolution, including ones finer
+//  than the archive holding the data, for all keys or those selected
+//  by opts.  Values are read from the finest archive at least as
+//  coarse as resolution that still holds startTime, and linearly
+//  interpolated between the middles of its intervals (or between
+//  plain values).  Timestamps
+//  before the first or after the last value are filled per opts;
+//  FILL_DEFAULT leaves them NaN.
+//
+func (t *TimeSeries) Interpolated(startTime, endTime, resolution int64, opts ...QueryOptions) (map[string][]float64, []int64, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if resolution <= 0 {
+		return nil, nil, fmt.Errorf("resolution %d is not positive", resolution)
+	}
+	o := t.queryOptions(opts)
+	if err := t.checkQuerySize(startTime, endTime, resolution, o.Keys, 8); err != nil {
+		return nil, nil, err
+	}
+	stats := collectStats(&o)
+	src := t.sourceArchive(startTime, resolution)
+	ival := src.Interval
+	// plain values are taken as samples at their own timestamp, and
+	// rollups (stamped at the end of their interval) at its middle
+	mid := 0.0
+	if src != t.baseArchive() {
+		mid = -float64(ival) / 2
+	}
+
+	fill := o.Fill
+	o.Fill = FILL_NAN
+	transforms := o.Transforms
+	o.Transforms = nil
+	// an interval either side, to interpolate the ends from
+	vals, stamps, err := t.query(startTime - ival, endTime + 2 * ival, ival, averageOf, false, []QueryOptions{ o })
+
+	startTime -= startTime % resolution
+	l := int((endTime - startTime + resolution - 1) / resolution)
+	timestamps := make([]int64, l)
+	for i := range timestamps {
+		timestamps[i] = startTime + int64(i) * resolution
+	}
+
+	res := make(map[string][]float64, len(vals))
+	var xs, ys []float64
+	for k, v := range vals {
+		xs, ys = xs[:0], ys[:0]
+		for i, ts := range stamps {
+			if !math.IsNaN(v[i]) {
+				xs = append(xs, float64(ts) + mid)
+				ys = append(ys, v[i])
+			}
+		}
+
+		out := make([]float64, l)
+		// the latest known value at or before each timestamp
+		p := -1
+		for i, ts := range timestamps {
+			x := float64(ts)
+			for p + 1 < len(xs) && xs[p + 1] <= x {
+				p++
+			}
+			switch {
+			case p >= 0 && xs[p] == x:
+				out[i] = ys[p]
+			case p >= 0 && p + 1 < len(xs):
+				out[i] = ys[p] + (ys[p + 1] - ys[p]) * (x - xs[p]) / (xs[p + 1] - xs[p])
+			default:
+				out[i] = math.NaN()
+			}
+		}
+		if fill != FILL_DEFAULT {
+			fillGaps(out, fill, o.FillValue)
+		}
+		res[k] = out
+	}
+	applyTransforms(res, transforms)
+	finishStats(stats, res)
+	return res, timestamps, err
+}
+
+//
+// The archive Interpolated reads from.
+//
+func (t *TimeSeries) sourceArchive(startTime, resolution int64) *internal.Archive {
+	var src *internal.Archive
+	for _, a := range t.archives {
+		if a.Interval < resolution && a != t.archives[len(t.archives) - 1] {
+			continue
+		}
+		src = a
+		if t.holds(a, startTime) {
+			break
+		}
+	}
+	return src
+}
+
+//
+// Whether a still holds data from timestamp on.
+//
+func (t *TimeSeries) holds(a *internal.Archive, timestamp int64) bool {
+	start, ok := t.dataStart(a)
+	return ok && start <= timestamp
+}
+
+//
+// The start of the oldest data in a; false if it's empty.
+//
+func (t *TimeSeries) dataStart(a *internal.Archive) (int64, bool) {
+	start, end := a.TimeRange()
+	if a != t.baseArchive() {
+		// the first rollup covers the interval before it
+		start -= a.Interval
+	}
+	return start, end > 0
+}
+
+//
+//  The finest resolution whose archive still holds data from
+//  startTime on, or the coarsest if none does.
+//
+func (t *TimeSeries) BestResolution(startTime int64) int64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.bestResolution(startTime)
+}
+
+func (t *TimeSeries) bestResolution(startTime int64) int64 {
+	for _, a := range t.archives {
+		if t.holds(a, startTime) {
+			return a.Interval
+		}
+	}
+	return t.archives[len(t.archives) - 1].Interval
+}
+
+//
+//  For querying counters.  Returns the per-second rate at which each
+//  key increased over each interval: the change in its latest value
+//  since the previous interval with one, divided by the time between
+//  them.  A decrease is taken as the counter being reset to zero, so
+//  the rate is worked out from the new value alone.  Intervals
+//  without a value are 0.
+//
+func (t *TimeSeries) Rates(startTime, endTime, resolution int64) (map[string][]float64, []int64, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.differences(startTime, endTime, resolution, true, nil)
+}
+
+//
+//  Like Rates, but without reset detection, so decreases give
+//  negative rates.  For gauges.
+//
+func (t *TimeSeries) Derivatives(startTime, endTime, resolution int64) (map[string][]float64, []int64, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.differences(startTime, endTime, resolution, false, nil)
+}
+
+func (t *TimeSeries) differences(startTime, endTime, resolution int64, resets bool,
+	keys *internal.KeySet) (map[string][]float64, []int64, error) {
+
+	// one interval early, so the first has something to compare with
+	vals, timestamps, err := t.walkData(nil, nil, startTime - resolution, endTime, resolution, latestOf, true, keys)
+	if len(timestamps) == 0 {
+		return vals, timestamps, err
+	}
+
+	res := make(map[string][]float64, len(vals))
+	for k, v := range vals {
+		d := make([]float64, len(v) - 1)
+		prev := -1
+		for i := 0; i < len(timestamps); i++ {
+			if math.IsNaN(v[i]) {
+				continue
+			}
+			if prev >= 0 {
+				delta := v[i] - v[prev]
+				if resets && delta < 0 {
+					delta = v[i]
 				}
+				d[i - 1] = delta / float64(timestamps[i] - timestamps[prev])
 			}
+			prev = i
 		}
-		return vals, ts, nil
-	} else {
-		rdata, ts, err := t.Rollups(startTime, endTime, resolution)
+		res[k] = d
+	}
+	return res, timestamps[1:], err
+}
+
+//
+//  For querying rollup archives.  Returns each interval's value under
+//  the archive's Aggregation, for all keys.  At the base resolution,
+//  returns the values themselves.
+//
+func (t *TimeSeries) Values(startTime, endTime, resolution int64, opts ...QueryOptions) (map[string][]float64, []int64, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.query(startTime, endTime, resolution, t.aggregatorFor(resolution), false, opts)
+}
+
+//
+// Like Values, reusing dst and timestamps as AveragesInto does.
+//
+func (t *TimeSeries) ValuesInto(dst map[string][]float64, timestamps []int64,
+	startTime, endTime, resolution int64) (map[string][]float64, []int64, error) {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.walkData(dst, timestamps, startTime, endTime, resolution, t.aggregatorFor(resolution), false, nil)
+}
+
+func (t *TimeSeries) aggregatorFor(resolution int64) Aggregator {
+	for i, a := range t.archives {
+		if i > 0 && a.Interval == resolution {
+			return t.aggregators[i]
+		}
+	}
+	return averageOf
+}
+
+//
+// Like Sums, reusing dst and timestamps as AveragesInto does.
+//
+func (t *TimeSeries) SumsInto(dst map[string][]float64, timestamps []int64,
+	startTime, endTime, resolution int64) (map[string][]float64, []int64, error) {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.walkData(dst, timestamps, startTime, endTime, resolution, sumOf, false, nil)
+}
+
+//
+// Like Counts, reusing dst and timestamps as AveragesInto does.
+//
+func (t *TimeSeries) CountsInto(dst map[string][]float64, timestamps []int64,
+	startTime, endTime, resolution int64) (map[string][]float64, []int64, error) {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.walkData(dst, timestamps, startTime, endTime, resolution, countOf, true, nil)
+}
+
+//
+// Like Firsts, reusing dst and timestamps as AveragesInto does.
+//
+func (t *TimeSeries) FirstsInto(dst map[string][]float64, timestamps []int64,
+	startTime, endTime, resolution int64) (map[string][]float64, []int64, error) {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.walkData(dst, timestamps, startTime, endTime, resolution, firstOf, false, nil)
+}
+
+//
+// Like Lasts, reusing dst and timestamps as AveragesInto does.
+//
+func (t *TimeSeries) LastsInto(dst map[string][]float64, timestamps []int64,
+	startTime, endTime, resolution int64) (map[string][]float64, []int64, error) {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.walkData(dst, timestamps, startTime, endTime, resolution, lastOf, false, nil)
+}
+
+//
+// Like StdDevs, reusing dst and timestamps as AveragesInto does.
+//
+func (t *TimeSeries) StdDevsInto(dst map[string][]float64, timestamps []int64,
+	startTime, endTime, resolution int64) (map[string][]float64, []int64, error) {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.walkData(dst, timestamps, startTime, endTime, resolution, stdDevOf, true, nil)
+}
+
+func averageOf(r Rollup) float64 {
+	if r.Count > 0 {
+		return r.Total / float64(r.Count)
+	}
+	return 0.0
+}
+
+func maximumOf(r Rollup) float64 {
+	if r.Count > 0 {
+		return r.Max
+	}
+	return 0.0
+}
+
+func minimumOf(r Rollup) float64 {
+	if r.Count > 0 {
+		return r.Min
+	}
+	return 0.0
+}
+
+func sumOf(r Rollup) float64 {
+	return r.Total
+}
+
+func countOf(r Rollup) float64 {
+	return float64(r.Count)
+}
+
+func firstOf(r Rollup) float64 {
+	if r.Count > 0 {
+		return r.First
+	}
+	return 0.0
+}
+
+func lastOf(r Rollup) float64 {
+	if r.Count > 0 {
+		return r.Last
+	}
+	return 0.0
+}
+
+// Like lastOf, but NaN for empty intervals.
+func latestOf(r Rollup) float64 {
+	if r.Count > 0 {
+		return r.Last
+	}
+	return math.NaN()
+}
+
+func stdDevOf(r Rollup) float64 {
+	return r.StdDev()
+}
+
+//
+//  For querying rollup archives that keep percentiles.  Returns the
+//  value at quantile q (e.g. 0.99) in each interval, for all keys,
+//  accurate to within 1%.  At the base resolution, this is just the
+//  values.
+//
+func (t *TimeSeries) Percentiles(startTime, endTime, resolution int64, q float64) (map[string][]float64, []int64, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if q < 0 || q > 1 {
+		return nil, nil, fmt.Errorf("quantile %f is not between 0 and 1", q)
+	}
+	if resolution == t.baseArchive().Interval {
+		return t.walkData(nil, nil, startTime, endTime, resolution, averageOf, false, nil)
+	}
+	archive, err := t.rollupArchive(resolution)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !archive.Sketches {
+		return nil, nil, fmt.Errorf("archive does not keep percentiles")
+	}
+	if err = t.checkQuerySize(startTime, endTime, resolution, nil, 8); err != nil {
+		return nil, nil, err
+	}
+	return archive.GetQuantiles(startTime, endTime, q)
+}
+
+//
+// Approximate number of distinct values each key took in each
+// interval, from an archive configured with Uniques; counts are
+// within a few percent.  At the base resolution, this is 1 for
+// every tick with a value.
+//
+func (t *TimeSeries) UniqueCounts(startTime, endTime, resolution int64) (map[string][]float64, []int64, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if resolution == t.baseArchive().Interval {
+		return t.walkData(nil, nil, startTime, endTime, resolution, countOf, true, nil)
+	}
+	archive, err := t.rollupArchive(resolution)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !archive.Uniques {
+		return nil, nil, fmt.Errorf("archive does not keep unique counts")
+	}
+	if err = t.checkQuerySize(startTime, endTime, resolution, nil, 8); err != nil {
+		return nil, nil, err
+	}
+	return archive.GetUniqueCounts(startTime, endTime)
+}
+
+//
+//  For querying raw daa from rollup archives.
+//
+func (t *TimeSeries) Rollups(startTime, endTime, resolution int64, opts ...QueryOptions) (map[string][]Rollup, []int64, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	archive, err := t.rollupArchive(resolution)
+	if err != nil {
+		return nil, nil, err
+	}
+	o := t.queryOptions(opts)
+	if err = t.checkQuerySize(startTime, endTime, resolution, o.Keys, rollupSize); err != nil {
+		return nil, nil, err
+	}
+	stats := collectStats(&o)
+	vals, timestamps, err := archive.GetRollupsMatching(startTime, endTime, o.Keys)
+	limitSeries(vals, o.Limit)
+	finishStats(stats, vals)
+	return vals, timestamps, err
+}
+
+// A key and its score, as ranked by TopK.
+type Ranked struct {
+	Key   string
+	Value float64
+}
+
+//
+//  The k keys scoring highest over [startTime, endTime) in the
+//  archive with the given resolution, highest first (ties by key).
+//  Everything in the window is summarized into one Rollup per key,
+//  which is scored with by (AGGREGATE_AVERAGE if empty), so
+//  AGGREGATE_SUM ranks by total and AGGREGATE_MAX by peak.  Keys with
+//  no data in the window aren't ranked.
+//
+func (t *TimeSeries) TopK(startTime, endTime, resolution int64, k int, by Aggregation) ([]Ranked, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	fn, err := lookupAggregation(by)
+	if err != nil {
+		return nil, err
+	}
+	archive := t.baseArchive()
+	if resolution != archive.Interval {
+		archive, err = t.rollupArchive(resolution)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rollups, err := archive.RollupRange(startTime, endTime)
+
+	ranked := make([]Ranked, 0, len(rollups))
+	for key, r := range rollups {
+		if r.Count == 0 {
+			continue
+		}
+		if v := fn(r); !math.IsNaN(v) {
+			ranked = append(ranked, Ranked{ Key: key, Value: v })
+		}
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Value != ranked[j].Value {
+			return ranked[i].Value > ranked[j].Value
+		}
+		return ranked[i].Key < ranked[j].Key
+	})
+	if k >= 0 && len(ranked) > k {
+		ranked = ranked[:k]
+	}
+	return ranked, err
+}
+
+func (t *TimeSeries) rollupArchive(resolution int64) (*internal.Archive, error) {
+	if resolution == t.baseArchive().Interval {
+		//TODO
+		return nil, fmt.Errorf("cannot get rollups from base archive")
+	}
+
+	var archive *internal.Archive = nil
+	for i := 1; i < len(t.archives); i++ {
+		if t.archives[i].Interval == resolution {
+			archive = t.archives[i]
+		}
+	}
+	if archive == nil {
+		return nil, fmt.Errorf("no matching archive")
+	}
+	return archive, nil
+}
+
+//
+// Write the TimeSeries to disk, and exercise retention (delete any
+// chunks that are fully expired).
+//
+func (t *TimeSeries) Write() error {
+	if t.readOnly {
+		return ErrReadOnly
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrClosed
+	}
+	return t.write()
+}
+
+//
+// Write, with t.mu held.
+//
+func (t *TimeSeries) write() error {
+	now := time.Now().Unix()
+	durable := t.needsSync(now)
+	if t.changes != nil {
+		if err := t.changes.flush(durable); err != nil {
+			return err
+		}
+	}
+	for _, a := range t.archives {
+		err := a.Write()
+		if err != nil {
+			return err
+		}
+	}
+	t.metricsMu.Lock()
+	if t.metricsDirty {
+		err := t.writeMetrics()
 		if err != nil {
-			return nil, nil, err
+			t.metricsMu.Unlock()
+			return err
+		}
+	}
+	t.metricsMu.Unlock()
+	t.labelsMu.Lock()
+	if t.labels.dirty {
+		err := t.writeLabels()
+		if err != nil {
+			t.labelsMu.Unlock()
+			return err
 		}
-		vals := make(map[string][]float64, len(rdata))
-		for k, v := range rdata {
-			vals[k] = make([]float64, l)
-			for i, d := range v {
-				vals[k][i] = rollupHandler(d)
+	}
+	t.labelsMu.Unlock()
+	if t.config.Quota.MaxDiskBytes > 0 {
+		if err := t.quota.measure(t.dir); err != nil {
+			return err
+		}
+	}
+	t.LastWritten = now
+	t.unflushed, t.unflushedSince = 0, time.Time{}
+
+	if durable {
+		for _, a := range t.archives {
+			err := a.Sync()
+			if err != nil {
+				return err
 			}
 		}
-		return vals, ts, nil
+		t.lastSynced = now
 	}
+	return nil
 }
 
-type Rollup struct {
-	Total float64
-	Count int64
-	Min   float64
-	Max   float64
+//
+// When the series was last written, as a Unix time, or 0 if it
+// hasn't been.  Unlike reading LastWritten, safe while another
+// goroutine may be writing.
+//
+func (t *TimeSeries) LastWriteTime() int64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.LastWritten
 }
 
-func rollupRawData(data map[string][]interface{}) map[string]interface{} {
-	res := make(map[string]interface{}, len(data))
+//
+// Finish with the series: stop the background flusher, if any,
+// Write what's been appended since the last flush, close the change
+// log, and unlock the directory, marking the series closed cleanly
+// (see UncleanShutdown).  Appends, Write and the like fail with
+// ErrClosed once the series is closed; calling Close again returns
+// the same result.
+//
+func (t *TimeSeries) Close() error {
+	t.closeOnce.Do(func() {
+		t.stopFlusher()
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.closed = true
+		if t.readOnly {
+			return
+		}
+		err := t.write()
+		if t.changes != nil {
+			if cerr := t.changes.close(); err == nil {
+				err = cerr
+			}
+		}
+		// not clean if the final Write failed
+		if lerr := t.lock.release(err == nil); err == nil {
+			err = lerr
+		}
+		t.closeErr = err
+	})
+	return t.closeErr
+}
 
-	for k, v := range data {
-		r := Rollup{}
-		first := true
-		for _, val := range v {
-			if val != nil {
-				r.Count++
-				r.Total += val.(float64)
-				if first || val.(float64) > r.Max {
-					r.Max = val.(float64)
-				}
-				if first || val.(float64) < r.Min {
-					r.Min = val.(float64)
-				}
-				first = false
+//
+// Whether whoever last opened the series didn't close it with
+// Close: its process crashed, or it was dropped without calling it,
+// so whatever was appended after its last Write was lost, and any
+// file it was in the middle of writing will be read in its previous
+// version.  Series created or opened before Close existed count as
+// closed cleanly.
+//
+func (t *TimeSeries) UncleanShutdown() bool {
+	return t.unclean
+}
+
+func (t *TimeSeries) needsSync(now int64) bool {
+	switch t.config.Durability {
+	case DURABILITY_FSYNC:
+		return true
+	case DURABILITY_PERIODIC:
+		return now - t.lastSynced >= t.config.SyncInterval
+	}
+	return false
+}
+
+//
+// Tidy up historical chunk files in every archive: rewrite chunks
+// written in an older encoding with the current one, delete chunks
+// that hold no data, and clean up after interrupted writes.  Safe to
+// call while appending and querying.
+//
+func (t *TimeSeries) Compact() error {
+	if t.readOnly {
+		return ErrReadOnly
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrClosed
+	}
+	var firstErr error
+	for _, a := range t.archives {
+		err := a.Compact()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+//
+// Run Compact in the background every interval seconds, until the
+// returned function is called.  Errors are ignored; chunks that
+// couldn't be compacted are retried next time.
+//
+func (t *TimeSeries) CompactEvery(interval int64) (stop func()) {
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				t.Compact()
+			case <-done:
+				return
 			}
 		}
-		res[k] = r
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+		})
 	}
+}
 
-	return res
+//
+// Rewrite every archive's chunk files to hold slots intervals each
+// (2000 for new series).  Larger chunks mean fewer files; smaller
+// ones mean less to read for short queries.  Each archive is
+// rewritten one chunk at a time, and is locked while it's rewritten.
+// If Rechunk is interrupted, call it again with the same slots to
+// resume.  Don't run it alongside Compact.
+//
+func (t *TimeSeries) Rechunk(slots int64) error {
+	if t.readOnly {
+		return ErrReadOnly
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrClosed
+	}
+	if slots <= 0 {
+		return fmt.Errorf("chunks must hold at least one slot")
+	}
+	for _, a := range t.archives {
+		err := a.Rechunk(slots * a.Interval)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func rollupRollupData(data map[string][]interface{}) map[string]interface{} {
-	res := make(map[string]interface{}, len(data))
+//
+// Query one series per key at resolution.  Rollups are reduced to
+// values by rollupHandler.  At the base resolution, values are
+// returned as they are, or if rollBase is set, treated as rollups of
+// a single value and passed to rollupHandler too.
+//
+func (t *TimeSeries) walkData(dst map[string][]float64, timestamps []int64, startTime, endTime, resolution int64,
+	rollupHandler func(Rollup) float64, rollBase bool, keys *internal.KeySet) (map[string][]float64, []int64, error)  {
 
-	for k, v := range data {
-		r := Rollup{}
-		first := true
-		for _, val := range v {
-			if val != nil {
-				rVal := val.(Rollup)
-				r.Count += rVal.Count
-				r.Total += rVal.Total
+	if err := t.checkQuerySize(startTime, endTime, resolution, keys, 8); err != nil {
+		return nil, nil, err
+	}
+	l := int((endTime - startTime) / resolution)
+	if (endTime - startTime) % resolution > 0 {
+		l++
+	}
 
-				if first || rVal.Max > r.Max {
-					r.Max = rVal.Max
-				}
-				if first || rVal.Min < r.Min {
-					r.Min = rVal.Min
+	var vals map[string][]float64
+	var err error
+	if resolution == t.baseArchive().Interval && rollBase {
+		vals, timestamps, err = t.baseArchive().GetRollupValuesMatching(dst, timestamps,
+			startTime, endTime, rollupHandler, keys)
+	} else if resolution == t.baseArchive().Interval {
+		vals, timestamps, err = t.baseArchive().GetFloatsMatching(dst, timestamps,
+			startTime, endTime, t.config.DefaultValue, keys)
+	} else {
+		archive, aerr := t.rollupArchive(resolution)
+		if aerr != nil {
+			return nil, nil, aerr
+		}
+		vals, timestamps, err = archive.GetRollupValuesMatching(dst, timestamps,
+			startTime, endTime, rollupHandler, keys)
+	}
+
+	for k, v := range vals {
+		if len(v) < l {
+			vals[k] = append(v, make([]float64, l - len(v))...)
+		}
+	}
+	return vals, timestamps, err
+}
+
+//
+// walkData with QueryOptions applied.
+//
+func (t *TimeSeries) query(startTime, endTime, resolution int64,
+	rollupHandler func(Rollup) float64, rollBase bool, opts []QueryOptions) (map[string][]float64, []int64, error) {
+
+	o := t.queryOptions(opts)
+	stats := collectStats(&o)
+	if o.Fill == FILL_DEFAULT {
+		vals, timestamps, err := t.walkData(nil, nil, startTime, endTime, resolution, rollupHandler, rollBase, o.Keys)
+		limitSeries(vals, o.Limit)
+		applyTransforms(vals, o.Transforms)
+		finishStats(stats, vals)
+		return vals, timestamps, err
+	}
+
+	// gaps come back as NaN; plain values are passed through as
+	// Rollups of one value
+	handler := func(r Rollup) float64 {
+		if r.Count == 0 {
+			return math.NaN()
+		}
+		return rollupHandler(r)
+	}
+	vals, timestamps, err := t.walkData(nil, nil, startTime, endTime, resolution, handler, true, o.Keys)
+	limitSeries(vals, o.Limit)
+	for _, v := range vals {
+		for i := len(timestamps); i < len(v); i++ {
+			// padding past the end of the archive
+			v[i] = math.NaN()
+		}
+		fillGaps(v, o.Fill, o.FillValue)
+	}
+	applyTransforms(vals, o.Transforms)
+	finishStats(stats, vals)
+	return vals, timestamps, err
+}
+
+//
+// Fill the NaNs in v according to fill.
+//
+func fillGaps(v []float64, fill FillPolicy, value float64) {
+	prev := -1
+	for i := range v {
+		if !math.IsNaN(v[i]) {
+			if fill == FILL_LINEAR && prev >= 0 && prev < i - 1 {
+				step := (v[i] - v[prev]) / float64(i - prev)
+				for j := prev + 1; j < i; j++ {
+					v[j] = v[prev] + step * float64(j - prev)
 				}
-				first = false
 			}
+			prev = i
+			continue
+		}
+		switch fill {
+		case FILL_PREVIOUS:
+			if i > 0 {
+				v[i] = v[i - 1]
+			}
+		case FILL_CONSTANT:
+			v[i] = value
 		}
-		res[k] = r
 	}
-	return res
 }
 
-func (t *TimeSeries) baseArchive() *internal.Archive {
-	return t.archives[0]
+func limitSeries[T any](vals map[string][]T, limit int) {
+	if limit <= 0 || len(vals) <= limit {
+		return
+	}
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys[limit:] {
+		delete(vals, k)
+	}
 }
 
-var mph = codec.MsgpackHandle{}
+// Summary of all datapoints for a key within one rollup interval.
+type Rollup = internal.Rollup
 
-func writeObject(filePath string, obj interface{}) error {
-	file, err := os.Create(filePath)
-	if err == nil {
-		enc := codec.NewEncoder(file, &mph)
-		err = enc.Encode(obj)
+//
+// Apply the settings that archives don't store themselves.
+//
+func (t *TimeSeries) configureArchives() {
+	var cc *internal.ChunkCache
+	if t.config.CacheSize > 0 {
+		cc = internal.NewChunkCache(t.config.CacheSize)
+	}
+	for _, a := range t.archives {
+		a.SetCache(cc)
+		a.SetQueryWorkers(t.config.QueryWorkers)
+		a.SetCarryForward(t.config.CarryForwardTicks)
 	}
-	file.Close()
-	return err
 }
 
-func readObject(filePath string, v interface{}) error {
-	file, err := os.Open(filePath)
-	if err == nil {
-		dec := codec.NewDecoder(file, &mph)
-		err = dec.Decode(&v)
-	}
-	file.Close()
-	return err
+func (t *TimeSeries) baseArchive() *internal.Archive {
+	return t.archives[0]
 }
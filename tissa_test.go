@@ -4,8 +4,24 @@ package tissa
 // license that can be found in the LICENSE file.
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"math"
+	"net"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 	"os"
+
+	"github.com/fred-lewis/tissa/internal"
 )
 
 func TestBasicTimeSeries(t *testing.T) {
@@ -15,9 +31,9 @@ func TestBasicTimeSeries(t *testing.T) {
 
 	tsc := TimeSeriesConfig{
 		Archives: []ArchiveConfig{
-			{SECOND, HOUR},
-			{MINUTE, DAY},
-			{HOUR, 30 * DAY},
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+			{Resolution: HOUR, Retention: 30 * DAY},
 		},
 	}
 
@@ -85,6 +101,69 @@ func TestBasicTimeSeries(t *testing.T) {
 	if stamps[5] != int64(1560632340) {
 		t.Errorf("Timestamp[5] is %d", stamps[5])
 	}
+
+	d, _, err = ts.Sums(startTime, startTime + 6000, MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d["val"][0] != 780 || d["val"][5] != 18569 {
+		t.Errorf("Minute Sums are %f, %f", d["val"][0], d["val"][5])
+	}
+
+	d, _, err = ts.Counts(startTime, startTime + 6000, MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d["val"][0] != 39 || d["val"][5] != 60 {
+		t.Errorf("Minute Counts are %f, %f", d["val"][0], d["val"][5])
+	}
+
+	// 1..39 has a variance of (39^2 - 1) / 12
+	d, _, err = ts.StdDevs(startTime, startTime + 6000, MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if math.Abs(d["val"][0] - math.Sqrt(1520.0 / 12)) > 1e-9 {
+		t.Errorf("Minute StdDevs[0] is %f", d["val"][0])
+	}
+
+	d, _, err = ts.Firsts(startTime, startTime + 6000, MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d["val"][0] != 1 || d["val"][5] != 280 {
+		t.Errorf("Minute Firsts are %f, %f", d["val"][0], d["val"][5])
+	}
+
+	d, _, err = ts.Lasts(startTime, startTime + 6000, HOUR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// hours are rolled up from minutes; the data only goes up
+	m, _, err := ts.Maximums(startTime, startTime + 6000, HOUR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range m["val"] {
+		if d["val"][i] != m["val"][i] {
+			t.Errorf("Hour Lasts[%d] is %f, expected %f", i, d["val"][i], m["val"][i])
+		}
+	}
+
+	// a tick counts if it has a value
+	d, _, err = ts.Counts(startTime, startTime + 6000, SECOND)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d["val"][0] != 0 || d["val"][1] != 1 || d["val"][100] != 1 {
+		t.Errorf("Counts are %v", d["val"][:101])
+	}
 }
 
 func TestTimeSeriesExample(tst *testing.T) {
@@ -94,8 +173,8 @@ func TestTimeSeriesExample(tst *testing.T) {
 
 	tsc := TimeSeriesConfig{
 		Archives: []ArchiveConfig{
-			{SECOND, HOUR},
-			{MINUTE, DAY},
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
 		},
 		DefaultValue: 0,
 	}
@@ -144,3 +223,4291 @@ func TestTimeSeriesExample(tst *testing.T) {
 		tst.Errorf("Minute Avg Data[thing2][0] is %f", averages["thing2"][0])
 	}
 }
+
+func TestGorillaTimeSeries(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/c")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR, Encoding: ENCODING_GORILLA},
+			{Resolution: MINUTE, Retention: DAY, Encoding: ENCODING_GORILLA},
+		},
+	}
+
+	ts, err := NewTimeSeries("/tmp/timeseries_test/c", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startTime := int64(1560632000)
+	for i := 0; i < 3000; i++ {
+		ts.AddValues(map[string]float64{ "a": float64(i), "b": 5.0 }, startTime + int64(i))
+	}
+	err = ts.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts, err = OpenTimeSeries("/tmp/timeseries_test/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, _, err := ts.Averages(startTime, startTime + 3000, SECOND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d["a"][2500] != 2500 || d["b"][10] != 5 {
+		t.Errorf("Data is %f, %f", d["a"][2500], d["b"][10])
+	}
+
+	r, _, err := ts.Rollups(startTime, startTime + 3000, MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r["a"][1].Count != 60 || r["a"][1].Max != 99 || r["b"][1].Total != 300 {
+		t.Errorf("Rollup is %+v, %+v", r["a"][1], r["b"][1])
+	}
+}
+
+func TestQueryAllocations(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/d")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/d", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vals := map[string]float64{ "a": 1, "b": 2, "c": 3, "d": 4 }
+	startTime := int64(1560632400)
+	for i := 0; i < 1000; i++ {
+		ts.AddValues(vals, startTime + int64(i))
+	}
+
+	// values are stored unboxed, so allocations don't scale with
+	// the number of keys or datapoints
+	now := startTime + 1000
+	allocs := testing.AllocsPerRun(100, func() {
+		ts.AddValues(vals, now)
+		now++
+	})
+	if allocs > 1 {
+		t.Errorf("AddValues allocates %f times", allocs)
+	}
+
+	allocs = testing.AllocsPerRun(10, func() {
+		ts.Averages(startTime, startTime + 1000, SECOND)
+	})
+	if allocs > 12 {
+		t.Errorf("Averages allocates %f times", allocs)
+	}
+	// reusing the previous result avoids allocating the series
+	for _, res := range []int64{ SECOND, MINUTE } {
+		d, stamps, _ := ts.AveragesInto(nil, nil, startTime, startTime + 1000, res)
+		allocs = testing.AllocsPerRun(10, func() {
+			d, stamps, _ = ts.AveragesInto(d, stamps, startTime, startTime + 1000, res)
+		})
+		if allocs > 6 {
+			t.Errorf("AveragesInto at %d allocates %f times", res, allocs)
+		}
+		l := len(stamps)
+		if len(d) != 4 || len(d["c"]) != l || d["c"][l - 1] != 3 {
+			t.Errorf("AveragesInto at %d returned %d keys, %d stamps", res, len(d), l)
+		}
+	}
+}
+
+func TestMaxGap(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/gap")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+		MaxGap: HOUR,
+	}
+
+	ts, err := NewTimeSeries("/tmp/timeseries_test/gap", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startTime := int64(1560632000)
+	for i := 0; i < 100; i++ {
+		err = ts.AddValue("val", float64(i), startTime + int64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = ts.AddValue("val", 1000, startTime + 100 * DAY)
+	if !errors.Is(err, ErrGapTooLarge) {
+		t.Fatalf("Far-future append returned %v", err)
+	}
+	if _, latest := ts.Latest(); latest != startTime + 99 {
+		t.Errorf("Latest is %d after rejected append", latest)
+	}
+
+	// gaps within MaxGap are fine
+	err = ts.AddValue("val", 1000, startTime + 99 + HOUR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts.Close()
+	ts, err = OpenTimeSeries("/tmp/timeseries_test/gap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ts.AddValue("val", 1000, startTime + 100 * DAY)
+	if !errors.Is(err, ErrGapTooLarge) {
+		t.Errorf("Far-future append after reopen returned %v", err)
+	}
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Encode(w io.Writer, v interface{}) error {
+	return gob.NewEncoder(w).Encode(v)
+}
+
+func (gobCodec) Decode(r io.Reader, v interface{}) error {
+	return gob.NewDecoder(r).Decode(v)
+}
+
+func TestCodec(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/codec")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: DAY},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+		Codec: "gob",
+	}
+
+	_, err := NewTimeSeries("/tmp/timeseries_test/codec", tsc)
+	if err == nil {
+		t.Fatalf("Unregistered codec accepted")
+	}
+
+	RegisterCodec(gobCodec{})
+	ts, err := NewTimeSeries("/tmp/timeseries_test/codec", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startTime := int64(1560632000)
+	for i := 0; i < 5000; i++ {
+		ts.AddValue("val", float64(i), startTime + int64(i))
+	}
+	ts.Close()
+
+	ts, err = OpenTimeSeries("/tmp/timeseries_test/codec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := ts.Averages(startTime, startTime + 5000, SECOND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range data["val"] {
+		if v != float64(i) {
+			t.Fatalf("Value %d is %f", i, v)
+		}
+	}
+	data, _, err = ts.Averages(startTime, startTime + 3600, MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data["val"]) != 60 || data["val"][1] != 69.5 {
+		t.Errorf("Rollups read back as %v", data["val"])
+	}
+}
+
+func TestPercentiles(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/pct")
+	os.RemoveAll("/tmp/timeseries_test/pct2")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: DAY},
+			{Resolution: MINUTE, Retention: DAY, Percentiles: true},
+			{Resolution: HOUR, Retention: DAY, Percentiles: true, Shards: 2},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/pct", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startTime := int64(1560628800)
+	for i := 0; i < 3 * 3600; i++ {
+		ts.AddValues(map[string]float64{ "lat": float64(1 + i % 100), "n": 5 }, startTime + int64(i))
+	}
+	ts.Close()
+
+	ts, err = OpenTimeSeries("/tmp/timeseries_test/pct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _, err := ts.Percentiles(startTime, startTime + 3 * 3600, HOUR, 0.99)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first hour is rolled up at its end
+	if v := d["lat"][1]; math.Abs(v - 99) > 1 {
+		t.Errorf("Hour p99 is %f", v)
+	}
+	if v := d["n"][1]; math.Abs(v - 5) > 0.05 {
+		t.Errorf("Hour p99 of a constant is %f", v)
+	}
+
+	d, _, err = ts.Percentiles(startTime, startTime + 3600, MINUTE, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// seconds 0-59 hold 1-60
+	if v := d["lat"][1]; math.Abs(v - 30.5) > 0.5 {
+		t.Errorf("Minute median is %f", v)
+	}
+
+	tsc.Archives[1].Percentiles = false
+	_, err = NewTimeSeries("/tmp/timeseries_test/pct2", tsc)
+	if err == nil {
+		t.Errorf("Hour percentiles accepted without minute ones")
+	}
+}
+
+func TestUniqueCounts(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/uniq")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: DAY},
+			{Resolution: MINUTE, Retention: DAY, Uniques: true},
+			{Resolution: HOUR, Retention: DAY, Uniques: true},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/uniq", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startTime := int64(1560628800)
+	for i := 0; i < 3 * 3600; i++ {
+		ts.AddValues(map[string]float64{ "client": float64(1000 + i % 500), "n": 5 }, startTime + int64(i))
+	}
+	ts.Close()
+
+	ts, err = OpenTimeSeries("/tmp/timeseries_test/uniq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _, err := ts.UniqueCounts(startTime, startTime + 3 * 3600, HOUR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := d["client"][1]; math.Abs(v - 500) > 25 {
+		t.Errorf("Hour unique count is %f", v)
+	}
+	if v := d["n"][1]; v != 1 {
+		t.Errorf("Hour unique count of a constant is %f", v)
+	}
+
+	d, _, err = ts.UniqueCounts(startTime, startTime + 3600, MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := d["client"][1]; math.Abs(v - 60) > 2 {
+		t.Errorf("Minute unique count is %f", v)
+	}
+
+	d, _, err = ts.UniqueCounts(startTime, startTime + 60, SECOND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := d["client"][10]; v != 1 {
+		t.Errorf("Second unique count is %f", v)
+	}
+
+	_, _, err = ts.Percentiles(startTime, startTime + 3600, MINUTE, 0.5)
+	if err == nil {
+		t.Errorf("Percentiles read from an archive without sketches")
+	}
+}
+
+func TestAggregation(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/agg")
+	os.RemoveAll("/tmp/timeseries_test/agg2")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	RegisterAggregation("range", func(r Rollup) float64 {
+		return r.Max - r.Min
+	})
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: DAY},
+			{Resolution: MINUTE, Retention: DAY, Aggregation: AGGREGATE_SUM},
+			{Resolution: HOUR, Retention: DAY, Aggregation: "range"},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/agg", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startTime := int64(1560628800)
+	for i := 0; i < 3 * 3600; i++ {
+		ts.AddValue("bytes", float64(i % 60), startTime + int64(i))
+	}
+	ts.Close()
+
+	ts, err = OpenTimeSeries("/tmp/timeseries_test/agg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _, err := ts.Values(startTime, startTime + 3600, MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := d["bytes"][1]; v != 1770 {
+		t.Errorf("Minute sum is %f", v)
+	}
+	d, _, err = ts.Values(startTime, startTime + 3 * 3600, HOUR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := d["bytes"][1]; v != 59 {
+		t.Errorf("Hour range is %f", v)
+	}
+	d, _, err = ts.Values(startTime, startTime + 60, SECOND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := d["bytes"][7]; v != 7 {
+		t.Errorf("Second value is %f", v)
+	}
+
+	tsc.Archives[2].Aggregation = "median"
+	_, err = NewTimeSeries("/tmp/timeseries_test/agg2", tsc)
+	if err == nil {
+		t.Errorf("Unregistered aggregation accepted")
+	}
+}
+
+func TestTimeWeightedAverages(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/twa")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: DAY},
+			{Resolution: MINUTE, Retention: DAY},
+			{Resolution: HOUR, Retention: DAY},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/twa", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 10 for 50 seconds of every minute, then 100 for 10
+	startTime := int64(1560628800)
+	for m := int64(0); m < 3 * 60; m++ {
+		ts.AddValue("temp", 10, startTime + m * 60)
+		ts.AddValue("temp", 100, startTime + m * 60 + 50)
+	}
+	ts.AddValue("temp", 10, startTime + 3 * 3600)
+	ts.Close()
+
+	ts, err = OpenTimeSeries("/tmp/timeseries_test/twa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _, err := ts.TimeWeightedAverages(startTime, startTime + 3600, MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := d["temp"][1]; v != 25 {
+		t.Errorf("Minute time-weighted average is %f", v)
+	}
+	d, _, err = ts.Averages(startTime, startTime + 3600, MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := d["temp"][1]; v != 55 {
+		t.Errorf("Minute average is %f", v)
+	}
+	d, _, err = ts.TimeWeightedAverages(startTime, startTime + 3 * 3600, HOUR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := d["temp"][1]; v != 25 {
+		t.Errorf("Hour time-weighted average is %f", v)
+	}
+}
+
+func TestSparseTimeWeightedAverages(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/twa2")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: DAY},
+			{Resolution: MINUTE, Retention: DAY},
+			{Resolution: HOUR, Retention: DAY, Aggregation: AGGREGATE_TIME_WEIGHTED},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/twa2", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 0 for 90 seconds, then 30 for 30, every two minutes
+	startTime := int64(1560628800)
+	for i := int64(0); i < 2 * 60; i++ {
+		ts.AddValue("level", 0, startTime + i * 120)
+		ts.AddValue("level", 30, startTime + i * 120 + 90)
+	}
+	ts.AddValue("level", 0, startTime + 4 * 3600)
+	ts.Write()
+
+	d, _, err := ts.Values(startTime, startTime + 4 * 3600, HOUR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := d["level"][2]; math.Abs(v - 7.5) > 0.1 {
+		t.Errorf("Hour time-weighted average is %f", v)
+	}
+	d, _, err = ts.Averages(startTime, startTime + 4 * 3600, HOUR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := d["level"][2]; v != 15 {
+		t.Errorf("Hour average is %f", v)
+	}
+}
+
+func TestRates(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/rates")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: TEN_SECOND, Retention: DAY},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/rates", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 5 bytes a second, reset to zero after 300 seconds
+	startTime := int64(1560628800)
+	total := 0.0
+	for i := int64(0); i < 600; i += 10 {
+		if i == 300 {
+			total = 0
+		}
+		total += 50
+		ts.AddValue("bytes", total, startTime + i)
+	}
+	ts.Write()
+
+	d, stamps, err := ts.Rates(startTime + 10, startTime + 600, TEN_SECOND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stamps) != 59 || stamps[0] != startTime + 10 {
+		t.Errorf("Timestamps are %v", stamps)
+	}
+	for i, v := range d["bytes"] {
+		// the reset at 29 counts 50 since zero
+		if v != 5 {
+			t.Errorf("Rate at %d is %f", i, v)
+		}
+	}
+
+	d, _, err = ts.Derivatives(startTime + 10, startTime + 600, TEN_SECOND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := d["bytes"][29]; v != -145 {
+		t.Errorf("Derivative at reset is %f", v)
+	}
+
+	d, _, err = ts.Rates(startTime + 120, startTime + 300, MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := d["bytes"][0]; v != 5 {
+		t.Errorf("Minute rate is %f", v)
+	}
+}
+
+func TestCounters(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/counters")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: DAY},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/counters", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ts.SetMetricType("requests", METRIC_COUNTER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the counter restarts after 100 seconds
+	startTime := int64(1560628800)
+	for i := int64(0); i < 200; i++ {
+		ts.AddValues(map[string]float64{ "requests": float64(i % 100 + 1), "temp": float64(i % 100) }, startTime + i)
+	}
+	ts.Close()
+
+	ts, err = OpenTimeSeries("/tmp/timeseries_test/counters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.MetricType("requests") != METRIC_COUNTER || ts.MetricType("temp") != METRIC_GAUGE {
+		t.Errorf("Metric types not saved")
+	}
+	// still counting on from 200
+	ts.AddValue("requests", 101, startTime + 200)
+	ts.AddValue("requests", 5, startTime + 201)
+
+	d, _, err := ts.Averages(startTime, startTime + 202, SECOND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range d["requests"] {
+		want := float64(i + 1)
+		if i == 201 {
+			want = 206
+		}
+		if v != want {
+			t.Errorf("Counter at %d is %f", i, v)
+		}
+	}
+	if v := d["temp"][100]; v != 0 {
+		t.Errorf("Gauge was corrected to %f", v)
+	}
+
+	d, _, err = ts.Rates(startTime + 60, startTime + 180, MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := d["requests"][1]; v != 1 {
+		t.Errorf("Minute rate across the reset is %f", v)
+	}
+}
+
+func TestLatestFor(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/latest")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/latest", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560628800)
+	for i := int64(0); i < 100; i++ {
+		ts.AddValue("a", float64(i), startTime + i)
+	}
+	ts.AddValue("b", 7, startTime + 100)
+
+	v, stamp, ok, err := ts.LatestFor("a")
+	if err != nil || !ok || v != 99 || stamp != startTime + 99 {
+		t.Errorf("Latest a is %f at %d", v, stamp)
+	}
+	if _, _, ok, _ = ts.LatestFor("c"); ok {
+		t.Errorf("Found a latest value for a missing key")
+	}
+	vals, _, err := ts.LatestN("a", 3)
+	if err != nil || len(vals) != 3 || vals[0] != 97 {
+		t.Errorf("Latest 3 values of a are %v", vals)
+	}
+}
+
+func TestTimeRange(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/range")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/range", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.Oldest() != 0 || ts.Newest() != 0 {
+		t.Errorf("Empty series holds %d to %d", ts.Oldest(), ts.Newest())
+	}
+
+	startTime := int64(1560628800)
+	for i := int64(0); i < 3 * 3600; i++ {
+		ts.AddValue("val", float64(i), startTime + i)
+	}
+	ts.Write()
+
+	start, end, err := ts.TimeRange(SECOND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if end != startTime + 3 * 3600 || start <= startTime || end - start > 2 * HOUR {
+		t.Errorf("Second range is %d to %d", start, end)
+	}
+	d, _, _ := ts.Averages(start, end, SECOND)
+	if v := d["val"][len(d["val"]) - 1]; v != 3 * 3600 - 1 {
+		t.Errorf("Latest value in range is %f", v)
+	}
+
+	start, _, err = ts.TimeRange(MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.Oldest() != start || start > startTime + 60 {
+		t.Errorf("Oldest is %d, minute range starts at %d", ts.Oldest(), start)
+	}
+	if ts.Newest() != startTime + 3 * 3600 - 1 {
+		t.Errorf("Newest is %d", ts.Newest())
+	}
+	if _, _, err = ts.TimeRange(HOUR); err == nil {
+		t.Errorf("Range of a missing archive")
+	}
+}
+
+func TestKeyFilters(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/filters")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR, Shards: 4},
+			{Resolution: MINUTE, Retention: DAY, Shards: 4},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/filters", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560628800)
+	for i := int64(0); i < 600; i++ {
+		ts.AddValues(map[string]float64{
+			"cpu.user": 1, "cpu.system": 2, "mem.used": 3, "mem.free": float64(i),
+		}, startTime + i)
+	}
+	ts.Write()
+
+	glob, err := KeyGlob("cpu.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _, err := ts.Averages(startTime, startTime + 600, MINUTE, QueryOptions{ Keys: glob })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d) != 2 || d["cpu.user"] == nil || d["cpu.system"] == nil {
+		t.Errorf("Glob matched %v", d)
+	}
+
+	re, err := KeyRegexp("^mem\\.f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _, err = ts.Maximums(startTime, startTime + 600, SECOND, QueryOptions{ Keys: re })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d) != 1 || d["mem.free"][599] != 599 {
+		t.Errorf("Regexp matched %v", d)
+	}
+
+	r, _, err := ts.Rollups(startTime, startTime + 600, MINUTE, QueryOptions{ Keys: Keys("mem.used", "cpu.user") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 2 || r["mem.used"][2].Total != 180 {
+		t.Errorf("Keys matched %v", r)
+	}
+
+	if _, err = KeyGlob("[cpu"); err == nil {
+		t.Errorf("Bad glob accepted")
+	}
+	if _, err = KeyRegexp("(cpu"); err == nil {
+		t.Errorf("Bad regexp accepted")
+	}
+}
+
+func TestQueryOptions(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/options")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+		DefaultValue: -1,
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/options", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// b is missing from the third minute
+	startTime := int64(1560628800)
+	for i := int64(0); i < 300; i++ {
+		vals := map[string]float64{ "a": float64(i), "c": 1 }
+		if i / 60 != 2 {
+			vals["b"] = float64(i / 60)
+		}
+		ts.AddValues(vals, startTime + i)
+	}
+	ts.Write()
+
+	d, _, err := ts.Averages(startTime, startTime + 300, MINUTE, QueryOptions{ Fill: FILL_NAN, Keys: Keys("b") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d) != 1 || !math.IsNaN(d["b"][3]) || d["b"][2] != 1 {
+		t.Errorf("NaN-filled minutes are %v", d)
+	}
+	d, _, err = ts.Maximums(startTime, startTime + 300, MINUTE, QueryOptions{ Fill: FILL_PREVIOUS })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d["b"][3] != 1 || d["b"][4] != 3 || !math.IsNaN(d["b"][0]) {
+		t.Errorf("Previous-filled minutes are %v", d["b"])
+	}
+	d, _, err = ts.Minimums(startTime + 100, startTime + 200, SECOND, QueryOptions{ Fill: FILL_NAN })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d["a"][50] != 150 || !math.IsNaN(d["b"][30]) {
+		t.Errorf("NaN-filled seconds are %v, %v", d["a"][50], d["b"][30])
+	}
+
+	d, _, err = ts.Averages(startTime, startTime + 300, MINUTE, QueryOptions{ Limit: 2 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d) != 2 || d["a"] == nil || d["b"] == nil {
+		t.Errorf("Limited query returned %d series", len(d))
+	}
+	r, _, err := ts.Rollups(startTime, startTime + 300, MINUTE, QueryOptions{ Keys: Keys("c") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 1 || r["c"][1].Count != 60 {
+		t.Errorf("Rollups are %v", r)
+	}
+}
+
+func TestQueryResult(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/result")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/result", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// b is missing from the third minute
+	startTime := int64(1560628800)
+	for i := int64(0); i < 300; i++ {
+		vals := map[string]float64{ "a": float64(i) }
+		if i / 60 != 2 {
+			vals["b"] = 0
+		}
+		ts.AddValues(vals, startTime + i)
+	}
+	ts.Write()
+
+	res, err := ts.Query(startTime, startTime + 300, MINUTE, AGGREGATE_MAX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := res.Keys(); len(keys) != 2 || keys[0] != "a" {
+		t.Errorf("Keys are %v", keys)
+	}
+	if v, ok := res.At("a", startTime + 90); !ok || v != 59 {
+		t.Errorf("a at 90 is %f", v)
+	}
+	if v, ok := res.At("b", startTime + 90); !ok || v != 0 {
+		t.Errorf("b at 90 is %f", v)
+	}
+	if _, ok := res.At("b", startTime + 190); ok {
+		t.Errorf("Missing b found at 190")
+	}
+	if _, ok := res.At("a", startTime + 301); ok {
+		t.Errorf("a found past the end")
+	}
+	m, stamps := res.ToMap()
+	if m["b"][3] != 0 || len(stamps) != 5 {
+		t.Errorf("Map is %v", m)
+	}
+
+	secs, err := ts.Query(startTime, startTime + 300, SECOND, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aligned := res.Align(secs.Timestamps)
+	if len(aligned.Values["a"]) != 300 || aligned.Values["a"][90] != 59 || !aligned.Missing["b"][190] {
+		t.Errorf("Aligned a is %v", aligned.Values["a"][90])
+	}
+
+	if _, err = ts.Query(startTime, startTime + 300, MINUTE, "median"); err == nil {
+		t.Errorf("Query with an unregistered aggregation")
+	}
+}
+
+func TestMissingAsNaN(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/nan")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/nan", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// b is 0 for the first minute, and missing from the second
+	startTime := int64(1560628800)
+	for i := int64(0); i < 180; i++ {
+		vals := map[string]float64{ "a": 1 }
+		if i / 60 != 1 {
+			vals["b"] = 0
+		}
+		ts.AddValues(vals, startTime + i)
+	}
+
+	nan := QueryOptions{ Fill: FILL_NAN }
+	d, _, err := ts.Sums(startTime, startTime + 180, MINUTE, nan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d["b"][1] != 0 || !math.IsNaN(d["b"][2]) || d["a"][2] != 60 {
+		t.Errorf("Sums are %v", d)
+	}
+	d, _, err = ts.Counts(startTime, startTime + 180, SECOND, nan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d["b"][10] != 1 || !math.IsNaN(d["b"][70]) {
+		t.Errorf("Counts are %v, %v", d["b"][10], d["b"][70])
+	}
+	d, _, err = ts.Lasts(startTime, startTime + 180, MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d["b"][2] != 0 {
+		t.Errorf("Default-filled last is %f", d["b"][2])
+	}
+}
+
+func TestFillPolicies(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/fill")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+		DefaultValue: -1,
+		Fill: FILL_CONSTANT,
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/fill", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// b is 10 in the first minute, missing from the next two, and 40
+	// in the fourth
+	startTime := int64(1560628800)
+	for i := int64(0); i < 300; i++ {
+		vals := map[string]float64{ "a": 1 }
+		if i < 60 {
+			vals["b"] = 10
+		} else if i >= 180 {
+			vals["b"] = 40
+		}
+		ts.AddValues(vals, startTime + i)
+	}
+	ts.Close()
+
+	ts, err = OpenTimeSeries("/tmp/timeseries_test/fill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _, err := ts.Averages(startTime, startTime + 300, MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d["b"][2] != -1 || d["b"][3] != -1 || d["b"][4] != 40 || d["b"][0] != -1 {
+		t.Errorf("Constant-filled minutes are %v", d["b"])
+	}
+
+	d, _, err = ts.Averages(startTime, startTime + 300, MINUTE, QueryOptions{ Fill: FILL_LINEAR })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d["b"][2] != 20 || d["b"][3] != 30 || !math.IsNaN(d["b"][0]) {
+		t.Errorf("Interpolated minutes are %v", d["b"])
+	}
+
+	d, _, err = ts.Averages(startTime, startTime + 300, MINUTE, QueryOptions{ Fill: FILL_CONSTANT, FillValue: 5 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d["b"][2] != 5 {
+		t.Errorf("Constant-filled minute is %v", d["b"][2])
+	}
+}
+
+func TestInterpolated(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/interp")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/interp", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560628800)
+	for i := int64(0); i < 3 * 3600; i++ {
+		ts.AddValue("ramp", float64(i), startTime + i)
+	}
+	ts.Write()
+
+	// the seconds have expired, so this comes from minutes, whose
+	// averages sit half a second behind the ramp
+	d, stamps, err := ts.Interpolated(startTime + 600, startTime + 1200, TEN_SECOND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stamps) != 60 || stamps[1] != startTime + 610 {
+		t.Errorf("Timestamps are %v", stamps)
+	}
+	for i, v := range d["ramp"] {
+		if want := float64(600 + 10 * i) - 0.5; math.Abs(v - want) > 1e-9 {
+			t.Errorf("Interpolated value %d is %f", i, v)
+		}
+	}
+
+	// from the seconds themselves
+	d, _, err = ts.Interpolated(startTime + 3 * 3600 - 100, startTime + 3 * 3600 - 50, SECOND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := d["ramp"][10]; v != 3 * 3600 - 90 {
+		t.Errorf("Value from seconds is %f", v)
+	}
+
+	// past the end
+	d, _, err = ts.Interpolated(startTime + 3 * 3600 - 30, startTime + 3 * 3600 + 30, SECOND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := d["ramp"][59]; !math.IsNaN(v) {
+		t.Errorf("Value past the end is %f", v)
+	}
+}
+
+func TestQueryAuto(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/auto")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: 6 * HOUR},
+			{Resolution: HOUR, Retention: DAY},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/auto", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := ts.BestResolution(0); r != HOUR {
+		t.Errorf("Best resolution of an empty series is %d", r)
+	}
+
+	startTime := int64(1560628800)
+	for i := int64(0); i < 3 * 3600; i++ {
+		ts.AddValue("val", 1, startTime + i)
+	}
+	ts.Write()
+
+	now := startTime + 3 * 3600
+	res, err := ts.QueryAuto(now - 600, now, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Resolution != SECOND || len(res.Timestamps) != 600 || res.Values["val"][599] != 1 {
+		t.Errorf("Recent query used resolution %d", res.Resolution)
+	}
+	res, err = ts.QueryAuto(startTime, now, AGGREGATE_COUNT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Resolution != MINUTE || res.Values["val"][100] != 60 {
+		t.Errorf("Older query used resolution %d", res.Resolution)
+	}
+	if r := ts.BestResolution(startTime - DAY); r != HOUR {
+		t.Errorf("Best resolution before the data is %d", r)
+	}
+}
+
+func TestStitched(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/stitched")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: 34 * HOUR},
+			{Resolution: HOUR, Retention: 4 * DAY},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/stitched", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560628800)
+	for i := int64(0); i < 48 * 3600; i += 5 {
+		ts.AddValue("val", float64(i / 3600), startTime + i)
+	}
+	ts.AddValue("val", 99, startTime + 48 * 3600)
+	ts.Write()
+
+	res, err := ts.Stitched(startTime, startTime + 48 * 3600, HOUR, AGGREGATE_AVERAGE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := res.Values["val"]
+	if len(v) != 48 || res.Timestamps[1] != startTime + 3600 {
+		t.Fatalf("Stitched %d hours", len(v))
+	}
+	for i := range v {
+		if math.Abs(v[i] - float64(i)) > 0.05 || res.Missing["val"][i] {
+			t.Errorf("Hour %d is %f", i, v[i])
+		}
+	}
+
+	// too fine for the HOUR archive
+	res, err = ts.Stitched(startTime, startTime + 48 * 3600, 10 * MINUTE, AGGREGATE_COUNT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := res.Values["val"]
+	if !res.Missing["val"][0] {
+		t.Errorf("First ten minutes should be missing")
+	}
+	for i := len(c) - 36; i < len(c); i++ {
+		if c[i] != 120 {
+			t.Errorf("Ten minutes %d hold %f values", i, c[i])
+		}
+	}
+
+	if _, err = ts.Stitched(startTime, startTime + 3600, 90, ""); err != nil {
+		t.Errorf("Resolution of 90 seconds rejected: %v", err)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/labels")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/labels", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560632400)
+	for i := int64(0); i < 10; i++ {
+		ts.AddLabeledValues([]LabeledValue{
+			{ Name: "cpu", Labels: Labels{ "host": "web1", "region": "us-east" }, Value: 1 },
+			{ Name: "cpu", Labels: Labels{ "host": "web2", "region": "us-west" }, Value: 2 },
+			{ Name: "mem", Labels: Labels{ "host": "web1", "region": "us-east" }, Value: 3 },
+		}, startTime + i)
+		ts.AddValue("plain", 4, startTime + i)
+	}
+	if err = ts.AddLabeledValue("cpu", Labels{ "bad-label": "x" }, 1, startTime + 10); err == nil {
+		t.Errorf("Invalid label name accepted")
+	}
+	ts.Close()
+
+	key, _ := SeriesKey("cpu", Labels{ "region": "us-east", "host": "web1" })
+	if key != `cpu{host="web1",region="us-east"}` {
+		t.Errorf("Series key is %s", key)
+	}
+	name, labels, err := ParseSeriesKey(`cpu{host="we\"b1",region="us-east"}`)
+	if err != nil || name != "cpu" || labels["host"] != `we"b1` || len(labels) != 2 {
+		t.Errorf("Parsed %s %v %v", name, labels, err)
+	}
+
+	ts, err = OpenTimeSeries("/tmp/timeseries_test/labels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := ts.SelectSeries("cpu", nil); len(keys) != 2 {
+		t.Errorf("Series named cpu are %v", keys)
+	}
+	if keys := ts.SelectSeries("", Labels{ "host": "web1" }); len(keys) != 2 || keys[0] != key {
+		t.Errorf("Series on web1 are %v", keys)
+	}
+	if keys := ts.SelectSeries("mem", Labels{ "region": "us-west" }); len(keys) != 0 {
+		t.Errorf("mem in us-west is %v", keys)
+	}
+	if vals := ts.LabelValues("region"); len(vals) != 2 || vals[1] != "us-west" {
+		t.Errorf("Regions are %v", vals)
+	}
+
+	avgs, _, err := ts.Averages(startTime, startTime + 10, SECOND, QueryOptions{ Keys: ts.LabelFilter("cpu", Labels{ "region": "us-west" }) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(avgs) != 1 || avgs[`cpu{host="web2",region="us-west"}`][0] != 2 {
+		t.Errorf("Averages are %v", avgs)
+	}
+	avgs, _, _ = ts.Averages(startTime, startTime + 10, SECOND, QueryOptions{ Keys: ts.LabelFilter("disk", nil) })
+	if len(avgs) != 0 {
+		t.Errorf("Averages are %v", avgs)
+	}
+}
+
+func TestSelectors(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/selectors")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/selectors", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560632400)
+	for i := int64(0); i < 120; i++ {
+		vals := []LabeledValue{
+			{ Name: "req", Labels: Labels{ "host": "web1", "region": "us-east" }, Value: 1 },
+			{ Name: "req", Labels: Labels{ "host": "web2", "region": "us-east" }, Value: 2 },
+			{ Name: "req", Labels: Labels{ "host": "db1", "region": "us-east" }, Value: 4 },
+			{ Name: "req", Labels: Labels{ "host": "web3", "region": "us-west" }, Value: 8 },
+		}
+		if i >= 60 {
+			// web3 goes away
+			vals = vals[:3]
+		}
+		ts.AddLabeledValues(vals, startTime + i)
+	}
+
+	name, m, err := ParseSelector(` req { host =~ "web.*", region!="us-west" } `)
+	if err != nil || name != "req" || len(m) != 2 || m[0].Type != MATCH_REGEXP || m[1].Type != MATCH_NOT_EQUAL {
+		t.Fatalf("Parsed %s %v %v", name, m, err)
+	}
+	if keys := ts.Select(name, m...); len(keys) != 2 || keys[0] != `req{host="web1",region="us-east"}` {
+		t.Errorf("Selected %v", keys)
+	}
+	for _, sel := range []string{ `req{host~"a"}`, `req{host="a"`, `req{host=~"("}`, `{1host="a"}` } {
+		if _, _, err = ParseSelector(sel); err == nil {
+			t.Errorf("Parsed %s", sel)
+		}
+	}
+	f, err := ts.SelectorFilter(`{host!~"web.*"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	avgs, _, _ := ts.Averages(startTime, startTime + 10, SECOND, QueryOptions{ Keys: f })
+	if len(avgs) != 1 || avgs[`req{host="db1",region="us-east"}`][0] != 4 {
+		t.Errorf("Averages are %v", avgs)
+	}
+
+	res, err := ts.QueryGroups(startTime, startTime + 120, SECOND, GroupQuery{
+		Selector: `req{host=~"web.*"}`,
+		By: []string{ "region" },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	east, west := res.Values[`req{region="us-east"}`], res.Values[`req{region="us-west"}`]
+	if len(res.Values) != 2 || east[0] != 3 || west[0] != 8 {
+		t.Errorf("Groups are %v", res.Values)
+	}
+	if !res.Missing[`req{region="us-west"}`][60] || west[60] != 0 || res.Missing[`req{region="us-east"}`][60] {
+		t.Errorf("us-west after web3 went away is %f", west[60])
+	}
+
+	res, err = ts.QueryGroups(startTime, startTime + 120, MINUTE, GroupQuery{
+		Selector: `{region="us-east"}`,
+		Aggregation: AGGREGATE_MAX,
+		Combine: AGGREGATE_AVERAGE,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := res.Values["{}"]; len(res.Values) != 1 || len(v) != 2 || v[1] != 7.0 / 3 {
+		t.Errorf("Groups are %v", res.Values)
+	}
+}
+
+func TestTopK(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/topk")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/topk", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560632400)
+	for i := int64(0); i < 180; i++ {
+		vals := map[string]float64{ "steady": 5, "low": 1, "tied": 1 }
+		if i % 60 == 0 {
+			vals["bursty"] = 100
+		} else {
+			vals["bursty"] = 0
+		}
+		ts.AddValues(vals, startTime + i)
+	}
+
+	top, err := ts.TopK(startTime, startTime + 180, SECOND, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 2 || top[0].Key != "steady" || top[0].Value != 5 || top[1].Key != "bursty" {
+		t.Errorf("Top by average is %v", top)
+	}
+	top, _ = ts.TopK(startTime, startTime + 180, SECOND, 1, AGGREGATE_MAX)
+	if len(top) != 1 || top[0].Key != "bursty" || top[0].Value != 100 {
+		t.Errorf("Top by max is %v", top)
+	}
+	top, _ = ts.TopK(startTime, startTime + 180, SECOND, 10, AGGREGATE_SUM)
+	if len(top) != 4 || top[0].Key != "steady" || top[0].Value != 900 || top[2].Key != "low" || top[3].Key != "tied" {
+		t.Errorf("Top by sum is %v", top)
+	}
+	top, _ = ts.TopK(startTime + 60, startTime + 180, MINUTE, 1, AGGREGATE_MAX)
+	if len(top) != 1 || top[0].Key != "bursty" || top[0].Value != 100 {
+		t.Errorf("Top minute by max is %v", top)
+	}
+	if _, err = ts.TopK(startTime, startTime + 180, HOUR, 1, ""); err == nil {
+		t.Errorf("TopK at a missing resolution should fail")
+	}
+}
+
+func TestTransforms(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/transforms")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/transforms", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560632400)
+	for i := int64(0); i < 10; i++ {
+		if i != 5 && i != 6 {
+			ts.AddValue("val", float64(i % 2 * 10), startTime + i)
+		}
+	}
+
+	avgs, _, err := ts.Averages(startTime, startTime + 10, SECOND, QueryOptions{
+		Fill: FILL_NAN,
+		Transforms: []Transform{ MovingAverage(2) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := avgs["val"]
+	if v[0] != 0 || v[1] != 5 || v[4] != 5 || v[5] != 0 || !math.IsNaN(v[6]) || v[7] != 10 || v[9] != 5 {
+		t.Errorf("Moving average is %v", v)
+	}
+
+	res, err := ts.Query(startTime, startTime + 10, SECOND, AGGREGATE_AVERAGE, QueryOptions{
+		Fill: FILL_PREVIOUS,
+		Transforms: []Transform{ EWMA(0.5) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v = res.Values["val"]
+	if v[0] != 0 || v[1] != 5 || v[2] != 2.5 || v[3] != 6.25 || !res.Missing["val"][6] || res.Missing["val"][7] {
+		t.Errorf("EWMA is %v", v)
+	}
+
+	res, _ = ts.Query(startTime, startTime + 4, SECOND, "")
+	res.Transform(MovingAverage(0), EWMA(2))
+	if v = res.Values["val"]; v[1] != 10 || v[2] != 0 {
+		t.Errorf("Identity transforms gave %v", v)
+	}
+}
+
+func TestAlertRules(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/alerts")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY, Aggregation: AGGREGATE_MAX},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/alerts", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []AlertEvent
+	ch := make(chan AlertEvent, 10)
+	cpu, _ := KeyGlob("cpu.*")
+	err = ts.AddAlertRule(AlertRule{
+		Name: "busy",
+		Keys: cpu,
+		Condition: "> 0.9 for 5s",
+		Notify: func(ev AlertEvent) { events = append(events, ev) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ts.AddAlertRule(AlertRule{
+		Name: "spike",
+		Condition: ">= 2",
+		Resolution: MINUTE,
+		Events: ch,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cond := range []string{ "0.9", "> x", "> 1 for", "> 1 during 5s", "=> 1" } {
+		if err = ts.AddAlertRule(AlertRule{ Name: "bad", Condition: cond }); err == nil {
+			t.Errorf("Condition %q accepted", cond)
+		}
+	}
+	if err = ts.AddAlertRule(AlertRule{ Name: "bad", Condition: "> 1", Resolution: HOUR }); err == nil {
+		t.Errorf("Rule at a missing resolution accepted")
+	}
+
+	startTime := int64(1560632400)
+	for i := int64(0); i < 30; i++ {
+		v := 0.5
+		if i >= 10 && i < 20 {
+			v = 1
+		}
+		ts.AddValues(map[string]float64{ "cpu.a": v, "mem": 5 }, startTime + i)
+	}
+	if len(events) != 2 {
+		t.Fatalf("Events are %v", events)
+	}
+	if events[0].Key != "cpu.a" || events[0].State != ALERT_FIRING || events[0].Timestamp != startTime + 15 {
+		t.Errorf("Fired %+v", events[0])
+	}
+	if events[1].State != ALERT_RESOLVED || events[1].Timestamp != startTime + 20 || events[1].Value != 0.5 {
+		t.Errorf("Resolved %+v", events[1])
+	}
+
+	// the minute's max is 1; then a spike
+	ts.AddValues(map[string]float64{ "cpu.a": 3 }, startTime + 70)
+	ts.AddValues(map[string]float64{ "cpu.a": 0 }, startTime + 120)
+	ts.AddValues(map[string]float64{ "cpu.a": 0 }, startTime + 180)
+	close(ch)
+	var got []AlertEvent
+	for ev := range ch {
+		got = append(got, ev)
+	}
+	if len(got) != 3 || got[0].Key != "mem" || got[1].Key != "cpu.a" || got[1].Value != 3 || got[2].State != ALERT_RESOLVED {
+		t.Errorf("Minute events are %+v", got)
+	}
+
+	ts.RemoveAlertRule("busy")
+	events = nil
+	ts.AddValues(map[string]float64{ "cpu.a": 5 }, startTime + 300)
+	ts.AddValues(map[string]float64{ "cpu.a": 5 }, startTime + 310)
+	if len(events) != 0 {
+		t.Errorf("Removed rule fired %v", events)
+	}
+}
+
+func TestAbsenceAlerts(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/absence")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/absence", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560632400)
+	ts.AddValues(map[string]float64{ "a": 1, "b": 1 }, startTime)
+
+	var events []AlertEvent
+	err = ts.AddAlertRule(AlertRule{
+		Name: "dead",
+		Condition: "absent for 10s",
+		Notify: func(ev AlertEvent) { events = append(events, ev) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ts.AddAlertRule(AlertRule{ Name: "bad", Condition: "absent for" }); err == nil {
+		t.Errorf("Absence rule without a duration accepted")
+	}
+
+	// b stops at once
+	for i := int64(1); i < 20; i++ {
+		ts.AddValues(map[string]float64{ "a": 1 }, startTime + i)
+	}
+	if len(events) != 1 || events[0].Key != "b" || events[0].State != ALERT_FIRING || events[0].Timestamp != startTime + 10 {
+		t.Fatalf("Events are %+v", events)
+	}
+	ts.AddValues(map[string]float64{ "a": 1, "b": 2 }, startTime + 20)
+	if len(events) != 2 || events[1].Key != "b" || events[1].State != ALERT_RESOLVED || events[1].Value != 2 {
+		t.Fatalf("Events are %+v", events)
+	}
+
+	// everything stops
+	events = nil
+	ts.CheckAlerts(startTime + 25)
+	if len(events) != 0 {
+		t.Errorf("Events are %+v", events)
+	}
+	ts.CheckAlerts(startTime + 30)
+	if len(events) != 2 {
+		t.Errorf("Events are %+v", events)
+	}
+}
+
+func TestRecordingRules(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/recording")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/recording", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{ "errors /", "(errors", "errors $ 2", "error_rate + 1" } {
+		if err = ts.AddRecordingRule("error_rate", bad); err == nil {
+			t.Errorf("Rule %q accepted", bad)
+		}
+	}
+	if err = ts.AddRecordingRule("error_rate", "errors / requests * 100"); err != nil {
+		t.Fatal(err)
+	}
+	if err = ts.AddRecordingRule("ok_rate", `100 - error_rate`); err != nil {
+		t.Fatal(err)
+	}
+	ts.Close()
+
+	ts, err = OpenTimeSeries("/tmp/timeseries_test/recording")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules := ts.RecordingRules(); len(rules) != 2 || rules["ok_rate"] != "100 - error_rate" {
+		t.Fatalf("Rules are %v", rules)
+	}
+
+	startTime := int64(1560632400)
+	for i := int64(0); i < 120; i++ {
+		// separate appends for the same second
+		ts.AddValue("requests", 100, startTime + i)
+		ts.AddValue("errors", float64(i % 2), startTime + i)
+	}
+	ts.AddValue("requests", 0, startTime + 120)
+	ts.AddValue("errors", 0, startTime + 120)
+
+	avgs, _, err := ts.Averages(startTime, startTime + 2, SECOND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := avgs["error_rate"]; v[0] != 0 || v[1] != 1 {
+		t.Errorf("error_rate is %v", v)
+	}
+	if v := avgs["ok_rate"]; v[0] != 100 || v[1] != 99 {
+		t.Errorf("ok_rate is %v", v)
+	}
+	avgs, _, _ = ts.Averages(startTime + 60, startTime + 121, MINUTE)
+	if v := avgs["error_rate"]; len(v) != 2 || v[0] != 0.5 || v[1] != 0.5 {
+		t.Errorf("error_rate by minute is %v", v)
+	}
+	// 0 / 0 isn't recorded
+	if v, last, _, _ := ts.LatestFor("error_rate"); v != 1 || last != startTime + 119 {
+		t.Errorf("Latest error_rate is %f at %d", v, last)
+	}
+
+	ts.RemoveRecordingRule("ok_rate")
+	if rules := ts.RecordingRules(); len(rules) != 1 {
+		t.Errorf("Rules are %v", rules)
+	}
+}
+
+func TestEval(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/eval")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/eval", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560632400)
+	for i := int64(0); i <= 120; i++ {
+		vals := map[string]float64{ "a": 10, "bytes": float64(i * 100), `b{x="1"}`: float64(i % 4) }
+		if i == 3 {
+			delete(vals, "a")
+		}
+		ts.AddValues(vals, startTime + i)
+	}
+
+	v, stamps, err := ts.Eval(`a + "b{x=\"1\"}" / 2 * -(1 - 2)`, startTime, startTime + 10, SECOND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 10 || stamps[1] != startTime + 1 || v[0] != 10 || v[1] != 10.5 || v[2] != 11 {
+		t.Errorf("Values are %v", v)
+	}
+	// a is missing
+	if !math.IsNaN(v[3]) {
+		t.Errorf("Value with a missing is %f", v[3])
+	}
+
+	v, _, err = ts.Eval("rate(bytes) * 8", startTime + 1, startTime + 5, SECOND)
+	if err != nil || len(v) != 4 || v[0] != 800 || v[3] != 800 {
+		t.Errorf("Rates are %v, %v", v, err)
+	}
+	v, _, err = ts.Eval("max(bytes) - min(bytes) + abs(-1) + count(bytes) / 60", startTime + 60, startTime + 121, MINUTE)
+	if err != nil || len(v) != 2 || v[0] != 5901 + 1 || v[1] != 5901 + 1 {
+		t.Errorf("Minute values are %v, %v", v, err)
+	}
+	v, _, _ = ts.Eval("a / missing", startTime, startTime + 2, SECOND)
+	if !math.IsNaN(v[0]) {
+		t.Errorf("Missing key gave %v", v)
+	}
+	v, _, _ = ts.Eval("a / missing", startTime, startTime + 2, SECOND, QueryOptions{ Fill: FILL_CONSTANT, FillValue: -1 })
+	if v[0] != -1 {
+		t.Errorf("Filled missing key gave %v", v)
+	}
+
+	for _, bad := range []string{ "a +", "rate(a + 1)", "nosuch(a)", "max(a, a)", "abs(a", "3 4" } {
+		if _, _, err = ts.Eval(bad, startTime, startTime + 2, SECOND); err == nil {
+			t.Errorf("Evaluated %q", bad)
+		}
+	}
+	if _, _, err = ts.Eval("a", startTime, startTime + 2, HOUR); err == nil {
+		t.Errorf("Evaluated at a missing resolution")
+	}
+	if err = ts.AddRecordingRule("r", "rate(bytes)"); err == nil {
+		t.Errorf("Recording rule with a function accepted")
+	}
+}
+
+func TestPromQL(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/promql")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/promql", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560632400)
+	for i := int64(0); i <= 600; i++ {
+		reqs := float64(i * 10)
+		if i >= 300 {
+			// web2 restarts
+			reqs = float64((i - 299) * 10)
+		}
+		ts.AddLabeledValues([]LabeledValue{
+			{ Name: "http_requests_total", Labels: Labels{ "host": "web1", "region": "east" }, Value: float64(i * 2) },
+			{ Name: "http_requests_total", Labels: Labels{ "host": "web2", "region": "east" }, Value: reqs },
+			{ Name: "http_requests_total", Labels: Labels{ "host": "web3", "region": "west" }, Value: float64(i) },
+			{ Name: "cpu", Labels: Labels{ "host": "web1", "region": "east" }, Value: 0.5 },
+			{ Name: "cpu", Labels: Labels{ "host": "web3", "region": "west" }, Value: 0.25 },
+		}, startTime + i)
+	}
+
+	end := startTime + 600
+	res, err := ts.PromQL(`http_requests_total{host=~"web[12]"}`, end - 120, end, MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Values) != 2 || res.Values[`http_requests_total{host="web1",region="east"}`][1] != 1078 {
+		t.Errorf("Selected %v", res.Values)
+	}
+
+	res, err = ts.PromQL(`sum by (region) (rate(http_requests_total[5m]))`, end - 120, end, MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	east, west := res.Values[`{region="east"}`], res.Values[`{region="west"}`]
+	if len(res.Values) != 2 || math.Abs(east[1] - 12) > 1e-9 || math.Abs(west[1] - 1) > 1e-9 {
+		t.Errorf("Rates by region are %v", res.Values)
+	}
+	res, _ = ts.PromQL(`increase(http_requests_total{host="web2"}[5m])`, end - 60, end, MINUTE)
+	if v := res.Values[`{host="web2",region="east"}`]; len(v) != 1 || v[0] != 3000 {
+		t.Errorf("Increase across a reset is %v", res.Values)
+	}
+
+	res, err = ts.PromQL(`avg(cpu) by (region) * 100 - 1`, end - 60, end, MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := res.Values[`{region="west"}`]; len(res.Values) != 2 || v[0] != 24 {
+		t.Errorf("CPU is %v", res.Values)
+	}
+	res, _ = ts.PromQL(`cpu / cpu{host="web1"} + abs(-2)`, end - 60, end, MINUTE)
+	if v := res.Values[`{host="web1",region="east"}`]; len(res.Values) != 1 || v[0] != 3 {
+		t.Errorf("Matched vectors are %v", res.Values)
+	}
+	res, _ = ts.PromQL(`count(cpu)`, end - 60, end, MINUTE)
+	if v := res.Values["{}"]; len(v) != 1 || v[0] != 2 {
+		t.Errorf("Count is %v", res.Values)
+	}
+	res, _ = ts.PromQL(`(1 + 2) * 3`, end - 60, end, MINUTE)
+	if v := res.Values["{}"]; v[0] != 9 {
+		t.Errorf("Number is %v", res.Values)
+	}
+
+	for _, bad := range []string{ `rate(cpu)`, `cpu[5m]`, `sum(`, `cpu{host="a"`, `cpu{host~"a"}`,
+		`rate(cpu[90s])`, `rate(cpu[5x])`, `topk(cpu)`, `{}`, `sum(1)` } {
+		if _, err = ts.PromQL(bad, end - 60, end, MINUTE); err == nil {
+			t.Errorf("Evaluated %s", bad)
+		}
+	}
+}
+
+func TestQueryPage(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/page")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/page", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560628800)
+	for i := int64(0); i < 600; i++ {
+		ts.AddValues(map[string]float64{ "a": float64(i), "b": float64(2 * i) }, startTime + i)
+	}
+
+	for _, res := range []int64{ SECOND, MINUTE } {
+		whole, err := ts.Query(startTime + 7, startTime + 590, res, AGGREGATE_MAX)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stamps []int64
+		var vals []float64
+		token, pages := "", 0
+		for {
+			page, next, err := ts.QueryPage(startTime + 7, startTime + 590, res, AGGREGATE_MAX, 4, token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Timestamps) > 4 {
+				t.Errorf("Page of %d intervals", len(page.Timestamps))
+			}
+			stamps = append(stamps, page.Timestamps...)
+			vals = append(vals, page.Values["b"]...)
+			pages++
+			if token = next; token == "" {
+				break
+			}
+		}
+		if len(stamps) != len(whole.Timestamps) || pages != (len(stamps) + 3) / 4 {
+			t.Fatalf("%d timestamps in %d pages, want %d", len(stamps), pages, len(whole.Timestamps))
+		}
+		for i := range stamps {
+			if stamps[i] != whole.Timestamps[i] || vals[i] != whole.Values["b"][i] {
+				t.Fatalf("Paged %d: %f at %d, want %f at %d", i, vals[i], stamps[i],
+					whole.Values["b"][i], whole.Timestamps[i])
+			}
+		}
+	}
+
+	for _, bad := range []string{ "!", "0", "zzzzzzz" } {
+		if _, _, err = ts.QueryPage(startTime, startTime + 60, SECOND, "", 10, bad); !errors.Is(err, ErrBadPageToken) {
+			t.Errorf("Token %q gave %v", bad, err)
+		}
+	}
+	if _, _, err = ts.QueryPage(startTime, startTime + 60, SECOND, "", 0, ""); err == nil {
+		t.Errorf("Page of 0 intervals")
+	}
+}
+
+func TestQueryLimits(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/limits")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+		MaxQueryPoints: 1000,
+		MaxQueryBytes: 4000,
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/limits", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560628800)
+	for i := int64(0); i < 1200; i++ {
+		ts.AddValues(map[string]float64{ "a": float64(i), "b": 1 }, startTime + i)
+	}
+
+	if _, _, err = ts.Averages(startTime, startTime + 1200, SECOND); !errors.Is(err, ErrQueryTooLarge) {
+		t.Errorf("Query of 1200 points gave %v", err)
+	}
+	// two keys at 8 bytes each
+	if _, _, err = ts.Averages(startTime, startTime + 300, SECOND); !errors.Is(err, ErrQueryTooLarge) {
+		t.Errorf("Query of 4800 bytes gave %v", err)
+	}
+	if _, _, err = ts.Averages(startTime, startTime + 300, SECOND, QueryOptions{ Keys: Keys("a") }); err != nil {
+		t.Errorf("Query of one key: %v", err)
+	}
+	if _, _, err = ts.Rollups(startTime, startTime + 1200, MINUTE); err != nil {
+		t.Errorf("Rollups: %v", err)
+	}
+
+	res, err := ts.QueryAuto(startTime, startTime + 1200, AGGREGATE_MAX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Resolution != MINUTE || res.Values["a"][2] != 119 {
+		t.Errorf("Downsampled to %d: %v", res.Resolution, res.Values["a"])
+	}
+	res, err = ts.Stitched(startTime, startTime + 1200, 0, AGGREGATE_MAX)
+	if err != nil || res.Resolution != MINUTE {
+		t.Errorf("Stitched at %d: %v", res.Resolution, err)
+	}
+}
+
+func TestQueryStats(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/stats")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: DAY},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+		CacheSize: 1 << 20,
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/stats", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// three chunks at the base resolution, the first two on disk
+	startTime := int64(1560628000)
+	for i := int64(0); i < 5000; i++ {
+		ts.AddValues(map[string]float64{ "a": float64(i), "b": 1 }, startTime + i)
+	}
+	ts.Write()
+
+	var stats QueryStats
+	vals, _, err := ts.Averages(startTime, startTime + 5000, SECOND, QueryOptions{ Stats: &stats })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ChunksRead != 3 || stats.CacheHits != 0 || stats.BytesDecoded == 0 ||
+		stats.Points != int64(len(vals["a"]) + len(vals["b"])) || stats.Duration <= 0 {
+		t.Errorf("First query stats are %+v", stats)
+	}
+	res, err := ts.Query(startTime, startTime + 5000, SECOND, "", QueryOptions{ Keys: Keys("a"), Stats: &stats })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ChunksRead != 3 || stats.CacheHits != 2 || stats.BytesDecoded != 0 ||
+		stats.Points != int64(len(res.Values["a"])) {
+		t.Errorf("Cached query stats are %+v", stats)
+	}
+	if _, _, err = ts.Rollups(startTime, startTime + 5000, MINUTE, QueryOptions{ Stats: &stats }); err != nil {
+		t.Fatal(err)
+	}
+	if stats.ChunksRead != 1 || stats.Points == 0 {
+		t.Errorf("Rollup stats are %+v", stats)
+	}
+}
+
+func TestRollupAt(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/rollupat")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/rollupat", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560628800)
+	for i := int64(0); i < 300; i++ {
+		ts.AddValues(map[string]float64{ "a": float64(i) }, startTime + i)
+	}
+
+	r, ok, err := ts.RollupAt("a", startTime + 90, MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || r.Count != 60 || r.Min != 60 || r.Max != 119 {
+		t.Errorf("Rollup at 90 is %+v", r)
+	}
+	r, ok, _ = ts.RollupAt("a", startTime + 120, MINUTE)
+	if !ok || r.Min != 120 {
+		t.Errorf("Rollup at 120 is %+v", r)
+	}
+	r, ok, _ = ts.RollupAt("a", startTime + 42, SECOND)
+	if !ok || r.Count != 1 || r.Max != 42 {
+		t.Errorf("Value at 42 is %+v", r)
+	}
+	if _, ok, _ = ts.RollupAt("b", startTime + 90, MINUTE); ok {
+		t.Errorf("Found a rollup for a missing key")
+	}
+	if _, ok, _ = ts.RollupAt("a", startTime + 3600, MINUTE); ok {
+		t.Errorf("Found a rollup past the end")
+	}
+	if _, _, err = ts.RollupAt("a", startTime, HOUR); err == nil {
+		t.Errorf("Found a rollup without an archive")
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/aggregate")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/aggregate", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// b is missing from the second minute
+	startTime := int64(1560628800)
+	for i := int64(0); i < 180; i++ {
+		vals := map[string]float64{ "a": float64(i % 7) }
+		if i / 60 != 1 {
+			vals["b"] = float64(i)
+		}
+		ts.AddValues(vals, startTime + i)
+	}
+
+	median := func(v []float64) float64 {
+		s := append([]float64(nil), v...)
+		sort.Float64s(s)
+		return s[len(s) / 2]
+	}
+	vals, stamps, err := ts.Aggregate(startTime + 10, startTime + 180, MINUTE, median,
+		QueryOptions{ Fill: FILL_NAN })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stamps) != 3 || stamps[0] != startTime {
+		t.Errorf("Timestamps are %v", stamps)
+	}
+	if a := vals["a"]; len(a) != 3 || a[0] != 3 {
+		t.Errorf("Medians of a are %v", a)
+	}
+	if b := vals["b"]; b[0] != 30 || !math.IsNaN(b[1]) || b[2] != 150 {
+		t.Errorf("Medians of b are %v", b)
+	}
+
+	count := func(v []float64) float64 {
+		return float64(len(v))
+	}
+	vals, _, _ = ts.Aggregate(startTime, startTime + 60, 10 * SECOND, count, QueryOptions{ Keys: Keys("b") })
+	if b := vals["b"]; len(vals) != 1 || len(b) != 6 || b[5] != 10 {
+		t.Errorf("Counts of b are %v", vals)
+	}
+	if _, _, err = ts.Aggregate(startTime, startTime + 60, 0, count); err == nil {
+		t.Errorf("Aggregated at resolution 0")
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/histogram")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/histogram", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560628800)
+	for i := int64(0); i < 120; i++ {
+		ts.AddValues(map[string]float64{ "latency": float64(i % 60), "other": 1 }, startTime + i)
+	}
+
+	h, err := ts.Histogram(startTime, startTime + 120, MINUTE, LinearBuckets(10, 10, 3),
+		QueryOptions{ Keys: Keys("latency") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := h.Counts["latency"]
+	if len(h.Counts) != 1 || len(h.Timestamps) != 2 || len(rows) != 2 {
+		t.Fatalf("Histogram is %+v", h)
+	}
+	// 0-10, 11-20, 21-30 and 31-59
+	for _, row := range rows {
+		if len(row) != 4 || row[0] != 11 || row[1] != 10 || row[2] != 10 || row[3] != 29 {
+			t.Errorf("Row is %v", row)
+		}
+	}
+
+	if b := ExponentialBuckets(1, 2, 4); b[3] != 8 {
+		t.Errorf("Exponential buckets are %v", b)
+	}
+	if _, err = ts.Histogram(startTime, startTime + 120, MINUTE, []float64{ 2, 1 }); err == nil {
+		t.Errorf("Histogram with unsorted bounds")
+	}
+}
+
+func TestCorrelate(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/correlate")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/correlate", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// load follows requests by 3 seconds; idle is the opposite
+	startTime := int64(1560628800)
+	wave := func(i int64) float64 {
+		return math.Sin(float64(i) / 5)
+	}
+	for i := int64(0); i < 200; i++ {
+		ts.AddValues(map[string]float64{
+			"requests": wave(i),
+			"load": 2 * wave(i - 3) + 1,
+			"idle": -wave(i),
+			"flat": 1,
+		}, startTime + i)
+	}
+
+	c, err := ts.Correlate("requests", "idle", startTime, startTime + 200, SECOND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(c + 1) > 1e-9 {
+		t.Errorf("Correlation with idle is %f", c)
+	}
+	if c, _ = ts.Correlate("requests", "flat", startTime, startTime + 200, SECOND); !math.IsNaN(c) {
+		t.Errorf("Correlation with a constant is %f", c)
+	}
+	if c, _ = ts.Correlate("requests", "missing", startTime, startTime + 200, SECOND); !math.IsNaN(c) {
+		t.Errorf("Correlation with a missing key is %f", c)
+	}
+
+	lagged, err := ts.CrossCorrelate("requests", "load", startTime, startTime + 200, SECOND, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	best := 0
+	for i := range lagged {
+		if lagged[i] > lagged[best] {
+			best = i
+		}
+	}
+	if len(lagged) != 11 || best - 5 != 3 || math.Abs(lagged[best] - 1) > 1e-9 {
+		t.Errorf("Lagged correlations are %v", lagged)
+	}
+}
+
+func TestConcurrentSeries(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/concurrent")
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	db, err := NewDB("/tmp/timeseries_test/concurrent", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := db.SeriesOrCreate("cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// handlers are called outside the lock, so they may query
+	ts.Subscribe(nil, func(int64, map[string]float64) { ts.Latest() })
+
+	startTime := int64(1560628800)
+	stop := db.WriteEvery(1, func(err error) { t.Error(err) })
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := int64(0); i < 600; i++ {
+			db.AddValues("cpu", map[string]float64{ "web1": float64(i) }, startTime + i)
+			if i % 100 == 0 {
+				db.Write()
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			ts.Averages(startTime, startTime + 600, MINUTE)
+			ts.Query(startTime, startTime + 600, SECOND, AGGREGATE_MAX)
+			ts.TimeRange(SECOND)
+		}
+	}()
+	wg.Wait()
+	stop()
+
+	if _, timestamp := ts.Latest(); timestamp != startTime + 599 {
+		t.Errorf("Latest timestamp is %d", timestamp)
+	}
+}
+
+func TestDB(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/db")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	db, err := NewDB("/tmp/timeseries_test/db", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560628800)
+	for i := int64(0); i < 120; i++ {
+		db.AddValues("cpu", map[string]float64{ "web1": float64(i) }, startTime + i)
+		db.AddValues("mem", map[string]float64{ "web1": 2 }, startTime + i)
+	}
+	if _, err = db.CreateSeries("disk", TimeSeriesConfig{
+		Archives: []ArchiveConfig{ {Resolution: MINUTE, Retention: DAY} },
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.CreateSeries("cpu", tsc); err == nil {
+		t.Errorf("Created cpu twice")
+	}
+	if _, err = db.CreateSeries("../cpu", tsc); err == nil {
+		t.Errorf("Created a series outside the DB")
+	}
+	stop := db.WriteEvery(3600, func(err error) { t.Error(err) })
+	stop()
+	db.Close()
+
+	db, err = OpenDB("/tmp/timeseries_test/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := db.Names(); len(names) != 3 || names[0] != "cpu" || names[2] != "mem" {
+		t.Errorf("Names are %v", names)
+	}
+	res, err := db.Query("cpu", startTime, startTime + 120, MINUTE, AGGREGATE_MAX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := res.At("web1", startTime + 60); !ok || v != 59 {
+		t.Errorf("cpu at 60 is %f", v)
+	}
+	if _, err = db.Query("swap", startTime, startTime + 120, MINUTE, ""); !errors.Is(err, ErrNoSeries) {
+		t.Errorf("Query of a missing series gave %v", err)
+	}
+
+	if err = db.DeleteSeries("mem"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Series("mem"); !errors.Is(err, ErrNoSeries) {
+		t.Errorf("Deleted series gave %v", err)
+	}
+	if err = db.DeleteSeries("mem"); !errors.Is(err, ErrNoSeries) {
+		t.Errorf("Deleted mem twice: %v", err)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/namespaces")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	db, err := NewDB("/tmp/timeseries_test/namespaces", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acme, err := db.CreateNamespace("acme", TimeSeriesConfig{
+		Archives: []ArchiveConfig{ {Resolution: TEN_SECOND, Retention: DAY} },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	globex, err := db.CreateNamespace("globex", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.CreateNamespace("acme", tsc); err == nil {
+		t.Errorf("Created acme twice")
+	}
+
+	startTime := int64(1560628800)
+	for i := int64(0); i < 60; i++ {
+		acme.AddValues("cpu", map[string]float64{ "web1": 1 }, startTime + i)
+		globex.AddValues("cpu", map[string]float64{ "web1": 2 }, startTime + i)
+	}
+	db.Close()
+
+	db, err = OpenDB("/tmp/timeseries_test/namespaces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := db.Namespaces(); len(names) != 2 || names[0] != "acme" {
+		t.Errorf("Namespaces are %v", names)
+	}
+	acme, err = db.Namespace("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acme.Defaults().Archives[0].Resolution != TEN_SECOND {
+		t.Errorf("acme defaults are %+v", acme.Defaults())
+	}
+	res, err := acme.Query("cpu", startTime, startTime + 60, TEN_SECOND, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := res.At("web1", startTime + 30); !ok || v != 1 {
+		t.Errorf("acme cpu is %f", v)
+	}
+	if names, _ := db.Names(); len(names) != 0 {
+		t.Errorf("Series outside namespaces are %v", names)
+	}
+
+	if err = db.DeleteNamespace("globex"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Namespace("globex"); !errors.Is(err, ErrNoNamespace) {
+		t.Errorf("Deleted namespace gave %v", err)
+	}
+	if names, _ := acme.Names(); len(names) != 1 || names[0] != "cpu" {
+		t.Errorf("acme series are %v", names)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/quotas")
+	os.MkdirAll("/tmp/timeseries_test/quotas", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+		Quota: Quota{ MaxKeys: 2 },
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/quotas/keys", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560628800)
+	if err = ts.AddValues(map[string]float64{ "a": 1, "b": 1 }, startTime); err != nil {
+		t.Fatal(err)
+	}
+	if err = ts.AddValue("c", 1, startTime + 1); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Third key gave %v", err)
+	}
+	if err = ts.AddValue("a", 2, startTime + 1); err != nil {
+		t.Errorf("Existing key gave %v", err)
+	}
+
+	tsc.Quota = Quota{ MaxWriteRate: 10 }
+	ts, err = NewTimeSeries("/tmp/timeseries_test/quotas/rate", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 10; i++ {
+		if err = ts.AddValue("a", 1, startTime + i); err != nil {
+			t.Fatalf("Append %d: %v", i, err)
+		}
+	}
+	if err = ts.AddValue("a", 1, startTime + 10); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Eleventh append gave %v", err)
+	}
+
+	tsc.Quota = Quota{}
+	db, err := NewDB("/tmp/timeseries_test/quotas/db", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns, err := db.CreateNamespace("acme", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.AddValues("cpu", map[string]float64{ "a": 1 }, startTime)
+	db.Write()
+	if err = ns.SetQuota(Quota{ MaxKeys: 2, MaxDiskBytes: 1 }); err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.AddValues("mem", map[string]float64{ "a": 1 }, startTime); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Append over the disk quota gave %v", err)
+	}
+	ns.SetQuota(Quota{ MaxKeys: 2 })
+	db.Close()
+
+	db, err = OpenDB("/tmp/timeseries_test/quotas/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns, err = db.Namespace("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns.Quota().MaxKeys != 2 {
+		t.Errorf("Quota is %+v", ns.Quota())
+	}
+	if err = ns.AddValues("mem", map[string]float64{ "a": 1 }, startTime); err != nil {
+		t.Errorf("Second key gave %v", err)
+	}
+	if err = ns.AddValues("disk", map[string]float64{ "a": 1 }, startTime); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Third key gave %v", err)
+	}
+
+	// a refused append spends none of the series' rate
+	netc := tsc
+	netc.Quota = Quota{ MaxWriteRate: 1 }
+	if _, err = ns.CreateSeries("net", netc); err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.AddValues("net", map[string]float64{ "a": 1 }, startTime); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Third key gave %v", err)
+	}
+	if err = ns.DeleteSeries("mem"); err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.AddValues("net", map[string]float64{ "a": 1 }, startTime); err != nil {
+		t.Errorf("Append after deleting a series gave %v", err)
+	}
+}
+
+func TestShardedSeries(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/sharded")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	ss, err := NewShardedSeries("/tmp/timeseries_test/sharded", tsc, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560628800)
+	for i := int64(0); i < 120; i++ {
+		vals := make(map[string]float64)
+		for k := 0; k < 100; k++ {
+			vals[fmt.Sprintf("host%d", k)] = float64(k)
+		}
+		ss.AddValues(vals, startTime + i)
+	}
+	ss.Close()
+
+	ss, err = OpenShardedSeries("/tmp/timeseries_test/sharded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := 0
+	for _, shard := range ss.Shards() {
+		if v, _ := shard.Latest(); len(v) > 0 {
+			used++
+		}
+	}
+	if len(ss.Shards()) != 4 || used != 4 {
+		t.Errorf("%d of %d shards used", used, len(ss.Shards()))
+	}
+
+	var stats QueryStats
+	res, err := ss.Query(startTime, startTime + 120, MINUTE, AGGREGATE_MAX, QueryOptions{ Stats: &stats })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Values) != 100 || len(res.Timestamps) != 2 || stats.Points != 200 {
+		t.Errorf("Merged %d keys at %v, stats %+v", len(res.Values), res.Timestamps, stats)
+	}
+	if v, ok := res.At("host42", startTime + 60); !ok || v != 42 {
+		t.Errorf("host42 is %f", v)
+	}
+	res, _ = ss.Query(startTime, startTime + 120, MINUTE, "", QueryOptions{ Keys: Keys("host1", "host2") })
+	if len(res.Values) != 2 {
+		t.Errorf("Selected %v", res.Keys())
+	}
+	res, _ = ss.Query(startTime, startTime + 120, MINUTE, "", QueryOptions{ Limit: 3 })
+	if keys := res.Keys(); len(keys) != 3 || keys[0] != "host0" {
+		t.Errorf("Limited to %v", keys)
+	}
+
+	avgs, stamps, err := ss.Averages(startTime, startTime + 120, MINUTE, QueryOptions{ Stats: &stats })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(avgs) != 100 || len(stamps) != 2 || avgs["host42"][1] != 42 || stats.Points != 200 {
+		t.Errorf("Merged averages %d keys at %v, stats %+v", len(avgs), stamps, stats)
+	}
+	rollups, _, err := ss.Rollups(startTime, startTime + 120, MINUTE, QueryOptions{ Keys: Keys("host7") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rollups) != 1 || rollups["host7"][1].Count != 60 {
+		t.Errorf("Merged rollups %v", rollups)
+	}
+	latest, timestamp := ss.Latest()
+	if len(latest) != 100 || timestamp != startTime + 119 || latest["host99"] != 99 {
+		t.Errorf("Latest is %d keys at %d", len(latest), timestamp)
+	}
+}
+
+func TestFederation(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/federation")
+	os.MkdirAll("/tmp/timeseries_test/federation", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	web1, err := NewTimeSeries("/tmp/timeseries_test/federation/web1", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	web2, err := NewShardedSeries("/tmp/timeseries_test/federation/web2", tsc, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// web2 only reports in the second minute
+	startTime := int64(1560628800)
+	for i := int64(0); i < 180; i++ {
+		web1.AddValues(map[string]float64{ "requests": 1, "web1.cpu": 0.5 }, startTime + i)
+		if i >= 60 {
+			web2.AddValues(map[string]float64{ "requests": 2, "web2.cpu": 0.25 }, startTime + i)
+		}
+	}
+	web1.Close()
+	web2.Close()
+
+	var f Federation
+	if err = f.AddPath("/tmp/timeseries_test/federation/web1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.AddPath("/tmp/timeseries_test/federation/web2"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := f.Query(startTime, startTime + 180, MINUTE, AGGREGATE_MAX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := res.Keys(); len(keys) != 3 {
+		t.Errorf("Keys are %v", keys)
+	}
+	if r := res.Values["requests"]; r[1] != 1 || r[2] != 3 {
+		t.Errorf("Requests are %v", r)
+	}
+	if _, ok := res.At("web2.cpu", startTime + 30); ok {
+		t.Errorf("web2 found before it reported")
+	}
+
+	f.Combine = AGGREGATE_MAX
+	res, _ = f.Query(startTime, startTime + 180, MINUTE, AGGREGATE_MAX, QueryOptions{ Keys: Keys("requests") })
+	if r := res.Values["requests"]; len(res.Values) != 1 || r[2] != 2 {
+		t.Errorf("Max requests are %v", r)
+	}
+	if err = f.AddPath("/tmp/timeseries_test/federation/missing"); err == nil {
+		t.Errorf("Added a missing series")
+	}
+}
+
+func TestRemote(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/remote")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/remote", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560628800)
+	for i := int64(0); i < 180; i++ {
+		ts.AddValues(map[string]float64{ "a": float64(i), "b": 1 }, startTime + i)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go Serve(l, ts)
+
+	c, err := Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var _ SeriesReader = c
+
+	res, err := c.Query(startTime, startTime + 180, MINUTE, AGGREGATE_MAX, QueryOptions{ Keys: Keys("a") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := res.At("a", startTime + 60); len(res.Values) != 1 || !ok || v != 59 {
+		t.Errorf("Remote query gave %v", res.Values)
+	}
+	vals, stamps, err := c.Averages(startTime, startTime + 180, MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, _, _ := ts.Averages(startTime, startTime + 180, MINUTE)
+	if len(stamps) != 3 || vals["a"][1] != local["a"][1] {
+		t.Errorf("Remote averages are %v, local %v", vals, local)
+	}
+	rollups, _, err := c.Rollups(startTime, startTime + 180, MINUTE)
+	if err != nil || rollups["b"][1].Count != 60 {
+		t.Errorf("Remote rollups are %v: %v", rollups, err)
+	}
+	latest, when := c.Latest()
+	if latest["a"] != 179 || when != startTime + 179 || c.LatestErr() != nil {
+		t.Errorf("Remote latest is %v at %d", latest, when)
+	}
+
+	var remote *RemoteError
+	if _, _, err = c.Rollups(startTime, startTime + 180, HOUR); !errors.As(err, &remote) {
+		t.Errorf("Rollups without an archive gave %v", err)
+	}
+	if _, err = c.Query(0, 100, 0, ""); !errors.As(err, &remote) {
+		t.Errorf("Query at resolution 0 gave %v", err)
+	}
+	glob, _ := KeyGlob("a*")
+	if _, err = c.Query(startTime, startTime + 180, MINUTE, "", QueryOptions{ Keys: glob }); err == nil {
+		t.Errorf("Sent a glob")
+	}
+}
+
+func TestGraph(t *testing.T) {
+	startTime := int64(1560628800)
+	res := &Result{
+		Resolution: MINUTE,
+		Values: map[string][]float64{
+			"cpu": { 1, 2, math.NaN(), 4, 5 },
+			"mem": { 1500, 1800, 2100, 1900, 1700 },
+		},
+	}
+	for i := int64(0); i < 5; i++ {
+		res.Timestamps = append(res.Timestamps, startTime + i * MINUTE)
+	}
+
+	var svg bytes.Buffer
+	if err := RenderSVG(&svg, res, GraphOptions{ Title: "load <1m>" }); err != nil {
+		t.Fatal(err)
+	}
+	s := svg.String()
+	if strings.Count(s, "<polyline") != 3 || !strings.Contains(s, "load &lt;1m&gt;") ||
+		!strings.Contains(s, ">2k<") || !strings.Contains(s, ">20:02<") {
+		t.Errorf("SVG graph is %s", s)
+	}
+
+	var buf bytes.Buffer
+	if err := RenderPNG(&buf, res, GraphOptions{ Width: 400, Height: 150 }); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 400 || b.Dy() != 150 {
+		t.Errorf("PNG graph is %v", b)
+	}
+	if err = RenderPNG(&buf, res, GraphOptions{ Colors: []string{ "red" } }); err == nil {
+		t.Errorf("Rendered with a bad color")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/subscribe")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/subscribe", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560628800)
+	var all, web []map[string]float64
+	var stamps []int64
+	cancelAll := ts.Subscribe(nil, func(timestamp int64, vals map[string]float64) {
+		all = append(all, vals)
+	})
+	glob, _ := KeyGlob("web*")
+	cancelWeb := ts.Subscribe(glob, func(timestamp int64, vals map[string]float64) {
+		stamps = append(stamps, timestamp)
+		web = append(web, vals)
+	})
+
+	ts.AddValues(map[string]float64{ "web1": 1, "db1": 2 }, startTime)
+	ts.AddValues(map[string]float64{ "web1": 3 }, startTime + 1)
+	ts.AddValues(map[string]float64{ "db1": 4 }, startTime + 2)
+	if len(all) != 3 || all[0]["db1"] != 2 || len(web) != 2 || len(web[0]) != 1 || web[1]["web1"] != 3 {
+		t.Errorf("Subscribers got %v and %v", all, web)
+	}
+
+	cancelAll()
+	ts.AddValues(map[string]float64{ "web1": 5 }, startTime + 3)
+	if len(all) != 3 || len(web) != 3 || stamps[2] != startTime + 3 {
+		t.Errorf("Subscribers got %v and %v at %v after cancelling one", all, web, stamps)
+	}
+	// dropped as older than the latest data
+	ts.AddValues(map[string]float64{ "web1": 99 }, startTime + 1)
+	if len(web) != 3 {
+		t.Errorf("Subscriber got a stale append: %v", web)
+	}
+	cancelWeb()
+}
+
+func TestSubscribeRounding(t *testing.T) {
+	ts, err := NewTimeSeries("", TimeSeriesConfig{
+		Archives: []ArchiveConfig{ {Resolution: 10, Retention: HOUR} },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stamps []int64
+	var got []float64
+	ts.Subscribe(nil, func(timestamp int64, vals map[string]float64) {
+		stamps = append(stamps, timestamp)
+		got = append(got, vals["a"])
+	})
+	// both are stored in the tick at 1000020
+	ts.AddValue("a", 1, 1000015)
+	ts.AddValue("a", 2, 1000012)
+	if vals, newest := ts.Latest(); newest != 1000020 || vals["a"] != 2 {
+		t.Fatalf("Stored %v at %d", vals, newest)
+	}
+	if len(stamps) != 2 || stamps[0] != 1000020 || stamps[1] != 1000020 || got[1] != 2 {
+		t.Errorf("Subscriber got %v at %v", got, stamps)
+	}
+	// the tick before is dropped
+	ts.AddValue("a", 3, 1000010)
+	if len(stamps) != 2 {
+		t.Errorf("Subscriber got a dropped append: %v at %v", got, stamps)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/watch")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+		},
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/watch", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560628800)
+	all, cancelAll := ts.Watch()
+	web, cancelWeb := ts.Watch("web1", "web2")
+
+	ts.AddValues(map[string]float64{ "web2": 1, "web1": 2, "db1": 3 }, startTime)
+	ts.AddValue("db1", 4, startTime + 1)
+	cancelAll()
+	ts.AddValue("web1", 5, startTime + 2)
+	cancelWeb()
+
+	var got []Sample
+	for s := range all {
+		got = append(got, s)
+	}
+	if len(got) != 4 || got[0] != (Sample{ "db1", 3, startTime }) || got[3] != (Sample{ "db1", 4, startTime + 1 }) {
+		t.Errorf("Watching all keys got %v", got)
+	}
+	got = nil
+	for s := range web {
+		got = append(got, s)
+	}
+	if len(got) != 3 || got[0].Key != "web1" || got[1].Key != "web2" || got[2] != (Sample{ "web1", 5, startTime + 2 }) {
+		t.Errorf("Watching web keys got %v", got)
+	}
+}
+
+func TestChangeLog(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/changelog")
+	os.Mkdir("/tmp/timeseries_test", os.ModePerm)
+
+	tsc := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+		},
+		ChangeLog: true,
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/changelog", tsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560628800)
+	for i := int64(0); i < 10; i++ {
+		ts.AddValues(map[string]float64{ "a": float64(i), "b": float64(-i) }, startTime + i)
+	}
+	// dropped as older than the latest data, so not logged
+	ts.AddValue("a", 99, startTime)
+	log := ts.ChangeLog()
+	if log == nil || log.NextOffset() != 10 {
+		t.Fatalf("Expected 10 changes logged")
+	}
+	changes, err := log.Read(3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 4 || changes[0].Offset != 3 || changes[0].Timestamp != startTime + 3 || changes[3].Values["b"] != -6 {
+		t.Errorf("Read from 3 got %v", changes)
+	}
+	if err = log.Commit("pipeline", 7); err != nil {
+		t.Fatal(err)
+	}
+	ts.Close()
+
+	// a record torn by a crash is dropped when reopened
+	segment := "/tmp/timeseries_test/changelog/changelog/" + segmentName(0)
+	f, _ := os.OpenFile(segment, os.O_WRONLY | os.O_APPEND, 0600)
+	f.Write([]byte{ 0, 0, 1, 0, 1, 2 })
+	f.Close()
+
+	ts, err = OpenTimeSeries("/tmp/timeseries_test/changelog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log = ts.ChangeLog()
+	offset, err := log.Committed("pipeline")
+	if err != nil || offset != 7 {
+		t.Fatalf("Expected committed offset 7, got %d (%v)", offset, err)
+	}
+	if offset, _ = log.Committed("other"); offset != 0 {
+		t.Errorf("Expected a new consumer to start at 0, got %d", offset)
+	}
+	ts.AddValue("a", 10, startTime + 10)
+	changes, err = log.Read(offset + 7, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 4 || changes[3].Offset != 10 || changes[3].Values["a"] != 10 {
+		t.Errorf("Resuming from 7 got %v", changes)
+	}
+
+	// start a segment per change, then drop those before offset 12
+	defer func(size int64) { changeLogSegmentSize = size }(changeLogSegmentSize)
+	changeLogSegmentSize = 1
+	for i := int64(11); i < 15; i++ {
+		ts.AddValue("a", float64(i), startTime + i)
+	}
+	if err = log.Truncate(12); err != nil {
+		t.Fatal(err)
+	}
+	if log.FirstOffset() != 12 {
+		t.Errorf("Expected changes from 12 kept, got %d", log.FirstOffset())
+	}
+	if _, err = log.Read(5, 0); !errors.Is(err, ErrTruncated) {
+		t.Errorf("Expected ErrTruncated reading truncated changes, got %v", err)
+	}
+	if changes, _ = log.Read(12, 0); len(changes) != 3 || changes[2].Offset != 14 {
+		t.Errorf("Read after truncating got %v", changes)
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/csv")
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+
+	ts, err := NewTimeSeries("/tmp/timeseries_test/csv", TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560628800)
+	for i := int64(0); i < 4; i++ {
+		vals := map[string]float64{ "web1": float64(i) / 2 }
+		if i != 2 {
+			vals["web2"] = float64(i)
+		}
+		ts.AddValues(vals, startTime + i)
+	}
+
+	var buf bytes.Buffer
+	if err = ts.ExportCSV(&buf, startTime, startTime + 3, SECOND, "web2", "web1", "web3"); err != nil {
+		t.Fatal(err)
+	}
+	want := "timestamp,web2,web1,web3\n" +
+		"1560628800,0,0,\n" +
+		"1560628801,1,0.5,\n" +
+		"1560628802,,1,\n"
+	if buf.String() != want {
+		t.Errorf("CSV was\n%s", buf.String())
+	}
+
+	buf.Reset()
+	res, err := ts.Query(startTime, startTime + 2, SECOND, AGGREGATE_MAX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = res.WriteCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(buf.String(), "\n"); len(lines) != 4 || lines[0] != "timestamp,web1,web2" {
+		t.Errorf("Result CSV was\n%s", buf.String())
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/export")
+	os.RemoveAll("/tmp/timeseries_test/import")
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+
+	ts, err := NewTimeSeries("/tmp/timeseries_test/export", TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+		DefaultValue: math.NaN(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.SetMetricType("requests", METRIC_COUNTER)
+	startTime := int64(1560628800)
+	for i := int64(0); i < 150; i++ {
+		vals := map[string]float64{ "web1": float64(i % 7), "requests": float64(i % 100) }
+		if i == 3 {
+			vals["web1"] = math.Inf(1)
+		}
+		ts.AddValues(vals, startTime + i)
+	}
+	ts.AddLabeledValue("cpu", Labels{ "host": "web1" }, 0.5, startTime + 150)
+	if err = ts.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err = ts.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	exported := buf.String()
+	ts2, err := ImportTimeSeries("/tmp/timeseries_test/import", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !math.IsNaN(ts2.config.DefaultValue) {
+		t.Errorf("DefaultValue was %v", ts2.config.DefaultValue)
+	}
+
+	want, _, err := ts.Rollups(startTime, startTime + 180, MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := ts2.Rollups(startTime, startTime + 180, MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Rollups were %v, not %v", got, want)
+	}
+	wantVals, _, _ := ts.Averages(startTime, startTime + 151, SECOND)
+	gotVals, _, _ := ts2.Averages(startTime, startTime + 151, SECOND)
+	if fmt.Sprint(gotVals) != fmt.Sprint(wantVals) {
+		t.Errorf("Averages were %v, not %v", gotVals, wantVals)
+	}
+	if !math.IsInf(gotVals["web1"][3], 1) {
+		t.Errorf("web1 was %v at 3", gotVals["web1"][3])
+	}
+	if keys := ts2.SelectSeries("cpu", Labels{ "host": "web1" }); len(keys) != 1 {
+		t.Errorf("labeled series were %v", keys)
+	}
+
+	// counter state carries over, so the next value continues the total
+	ts2.AddValue("requests", 60, startTime + 151)
+	res, _, _ := ts2.Averages(startTime + 151, startTime + 152, SECOND)
+	if v := res["requests"]; len(v) != 1 || v[0] != 159 {
+		t.Errorf("requests was %v after import", v)
+	}
+	ts2.Close()
+
+	ts3, err := OpenTimeSeries("/tmp/timeseries_test/import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _, _ = ts3.Rollups(startTime, startTime + 180, MINUTE); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("reopened Rollups were %v", got)
+	}
+	if _, err = ImportTimeSeries("/tmp/timeseries_test/import2", strings.NewReader(`{"format":"other","version":1}`)); err == nil {
+		t.Error("imported an unknown format")
+	}
+	if !strings.Contains(exported, `"+Inf"`) {
+		t.Error("export didn't encode +Inf as a string")
+	}
+}
+
+// Reading back the flatbuffers in Arrow metadata.
+func fbFieldAt(buf []byte, table, slot int) int {
+	vtable := table - int(int32(binary.LittleEndian.Uint32(buf[table:])))
+	if 4 + 2 * slot >= int(binary.LittleEndian.Uint16(buf[vtable:])) {
+		return 0
+	}
+	off := int(binary.LittleEndian.Uint16(buf[vtable + 4 + 2 * slot:]))
+	if off == 0 {
+		return 0
+	}
+	return table + off
+}
+
+func fbDeref(buf []byte, pos int) int {
+	return pos + int(binary.LittleEndian.Uint32(buf[pos:]))
+}
+
+func TestWriteArrow(t *testing.T) {
+	res := &Result{
+		Resolution: SECOND,
+		Timestamps: []int64{ 100, 101, 102 },
+		Values: map[string][]float64{ "web2": { 1, 0, 3 }, "web1": { 0.5, 1.5, 2.5 } },
+		Missing: map[string][]bool{ "web2": { false, true, false }, "web1": { false, false, false } },
+	}
+	var buf bytes.Buffer
+	if err := res.WriteArrow(&buf); err != nil {
+		t.Fatal(err)
+	}
+	stream := buf.Bytes()
+
+	// each message is the marker, the metadata length, the metadata, then the body
+	next := func() ([]byte, int) {
+		if len(stream) < 8 || binary.LittleEndian.Uint32(stream) != 0xffffffff {
+			t.Fatalf("no continuation marker")
+		}
+		n := int(binary.LittleEndian.Uint32(stream[4:]))
+		meta := stream[8:8 + n]
+		stream = stream[8 + n:]
+		if n % 8 != 0 {
+			t.Errorf("metadata length %d isn't padded", n)
+		}
+		return meta, fbDeref(meta, 0)
+	}
+	str := func(buf []byte, pos int) string {
+		n := int(binary.LittleEndian.Uint32(buf[pos:]))
+		return string(buf[pos + 4:pos + 4 + n])
+	}
+
+	meta, msg := next()
+	if v := binary.LittleEndian.Uint16(meta[fbFieldAt(meta, msg, 0):]); v != arrowMetadataV5 {
+		t.Errorf("version was %d", v)
+	}
+	if h := meta[fbFieldAt(meta, msg, 1)]; h != arrowHeaderSchema {
+		t.Fatalf("first message was %d", h)
+	}
+	schema := fbDeref(meta, fbFieldAt(meta, msg, 2))
+	fields := fbDeref(meta, fbFieldAt(meta, schema, 1))
+	var names []string
+	var types []byte
+	for i := 0; i < int(binary.LittleEndian.Uint32(meta[fields:])); i++ {
+		f := fbDeref(meta, fields + 4 + 4 * i)
+		names = append(names, str(meta, fbDeref(meta, fbFieldAt(meta, f, 0))))
+		types = append(types, meta[fbFieldAt(meta, f, 2)])
+	}
+	if fmt.Sprint(names) != "[timestamp web1 web2]" || fmt.Sprint(types) != "[10 3 3]" {
+		t.Errorf("fields were %v of types %v", names, types)
+	}
+
+	meta, msg = next()
+	if h := meta[fbFieldAt(meta, msg, 1)]; h != arrowHeaderRecordBatch {
+		t.Fatalf("second message was %d", h)
+	}
+	lenPos := fbFieldAt(meta, msg, 3)
+	if lenPos % 8 != 0 {
+		t.Errorf("bodyLength isn't aligned")
+	}
+	bodyLen := int(binary.LittleEndian.Uint64(meta[lenPos:]))
+	body := stream[:bodyLen]
+	stream = stream[bodyLen:]
+	batch := fbDeref(meta, fbFieldAt(meta, msg, 2))
+	if n := binary.LittleEndian.Uint64(meta[fbFieldAt(meta, batch, 0):]); n != 3 {
+		t.Errorf("batch length was %d", n)
+	}
+	nodes := fbDeref(meta, fbFieldAt(meta, batch, 1))
+	if nulls := binary.LittleEndian.Uint64(meta[nodes + 4 + 16 * 2 + 8:]); nulls != 1 {
+		t.Errorf("web2 had %d nulls", nulls)
+	}
+	buffers := fbDeref(meta, fbFieldAt(meta, batch, 2))
+	if n := binary.LittleEndian.Uint32(meta[buffers:]); n != 6 {
+		t.Fatalf("batch had %d buffers", n)
+	}
+	buffer := func(i int) []byte {
+		off := binary.LittleEndian.Uint64(meta[buffers + 4 + 16 * i:])
+		n := binary.LittleEndian.Uint64(meta[buffers + 12 + 16 * i:])
+		return body[off:off + n]
+	}
+	if ts := buffer(1); binary.LittleEndian.Uint64(ts[16:]) != 102 {
+		t.Errorf("timestamps were %v", ts)
+	}
+	if len(buffer(2)) != 0 {
+		t.Errorf("web1 had a validity bitmap")
+	}
+	if valid := buffer(4); len(valid) != 1 || valid[0] != 5 {
+		t.Errorf("web2 validity was %v", valid)
+	}
+	if v := math.Float64frombits(binary.LittleEndian.Uint64(buffer(5)[16:])); v != 3 {
+		t.Errorf("web2 was %v at 102", v)
+	}
+	if !bytes.Equal(stream, []byte{ 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0 }) {
+		t.Errorf("stream ended with %v", stream)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/backup")
+	os.MkdirAll("/tmp/timeseries_test/backup", os.ModePerm)
+
+	ts, err := NewTimeSeries("/tmp/timeseries_test/backup/series", TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: DAY},
+			{Resolution: MINUTE, Retention: 7 * DAY},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560628800)
+	for i := int64(0); i < 5000; i++ {
+		ts.AddValue("web1", float64(i), startTime + i)
+	}
+	stats, err := ts.Backup("/tmp/timeseries_test/backup/1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Copied == 0 || stats.CopiedBytes == 0 || stats.Linked != 0 {
+		t.Errorf("Full backup was %+v", stats)
+	}
+	if _, err = ts.Backup("/tmp/timeseries_test/backup/1", ""); err == nil {
+		t.Error("Backed up over an existing backup")
+	}
+	if _, err = ts.Backup("/tmp/timeseries_test/backup/x", "/tmp/timeseries_test/backup/series"); err == nil {
+		t.Error("Used a series as a base backup")
+	}
+
+	for i := int64(5000); i < 6000; i++ {
+		ts.AddValue("web1", float64(i), startTime + i)
+	}
+	stats2, err := ts.Backup("/tmp/timeseries_test/backup/2", "/tmp/timeseries_test/backup/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the chunks filled before the first backup are linked
+	if stats2.Linked == 0 || stats2.CopiedBytes >= stats.CopiedBytes {
+		t.Errorf("Incremental backup was %+v after %+v", stats2, stats)
+	}
+	first := fmt.Sprintf("1/%d", startTime - startTime % (chunkSizeSlots * SECOND))
+	a, _ := os.Stat("/tmp/timeseries_test/backup/1/" + first)
+	b, _ := os.Stat("/tmp/timeseries_test/backup/2/" + first)
+	if a == nil || b == nil || !os.SameFile(a, b) {
+		t.Errorf("First chunk wasn't linked")
+	}
+
+	// each backup opens as the series was when it was taken, and
+	// deleting the first leaves the second whole
+	check := func(dir string, n int64) {
+		t.Helper()
+		b, err := OpenTimeSeries(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Newest() != startTime + n - 1 {
+			t.Errorf("%s newest was %d", dir, b.Newest())
+		}
+		vals, _, err := b.Values(startTime, startTime + n, SECOND)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := vals["web1"]; int64(len(v)) != n || v[0] != 0 || v[n - 1] != float64(n - 1) {
+			t.Errorf("%s held %d values", dir, len(v))
+		}
+	}
+	check("/tmp/timeseries_test/backup/1", 5000)
+	os.RemoveAll("/tmp/timeseries_test/backup/1")
+	check("/tmp/timeseries_test/backup/2", 6000)
+}
+
+func TestRestore(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/restore")
+	os.MkdirAll("/tmp/timeseries_test/restore", os.ModePerm)
+
+	ts, err := NewTimeSeries("/tmp/timeseries_test/restore/series", TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: DAY},
+			{Resolution: MINUTE, Retention: 7 * DAY},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.SetMetricType("requests", METRIC_COUNTER)
+	startTime := int64(1560628800)
+	for i := int64(0); i < 400; i++ {
+		// reset once, early on
+		raw := i
+		if i >= 100 {
+			raw = i - 100
+		}
+		ts.AddValues(map[string]float64{ "web1": float64(i), "requests": float64(raw) }, startTime + i)
+	}
+	ts.AddLabeledValue("cpu", Labels{ "host": "b" }, 1, startTime + 400)
+	ts.AddLabeledValue("cpu", Labels{ "host": "a" }, 1, startTime + 401)
+	if _, err = ts.Backup("/tmp/timeseries_test/restore/backup", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// whole, from the backup and from a copy of the directory
+	for _, src := range []string{ "backup", "series" } {
+		r, err := RestoreTimeSeries("/tmp/timeseries_test/restore/" + src, "/tmp/timeseries_test/restore/full-" + src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Newest() != ts.Newest() || len(r.SelectSeries("cpu", nil)) != 2 ||
+			r.MetricType("requests") != METRIC_COUNTER {
+			t.Errorf("Restored %s newest %d, cpu %v", src, r.Newest(), r.SelectSeries("cpu", nil))
+		}
+	}
+	if _, err = RestoreTimeSeries("/tmp/timeseries_test/restore/backup", "/tmp/timeseries_test/restore/full-series"); err == nil {
+		t.Error("Restored over an existing series")
+	}
+	first := fmt.Sprintf("/tmp/timeseries_test/restore/backup/1/%d", startTime - startTime % (chunkSizeSlots * SECOND))
+	os.Truncate(first, 10)
+	if _, err = RestoreTimeSeries("/tmp/timeseries_test/restore/backup", "/tmp/timeseries_test/restore/damaged"); !errors.Is(err, ErrCorruptChunk) {
+		t.Errorf("Damaged backup gave %v", err)
+	}
+	if _, err = os.Stat("/tmp/timeseries_test/restore/damaged"); !os.IsNotExist(err) {
+		t.Error("Failed restore was left behind")
+	}
+
+	until := startTime + 250
+	r, err := RestoreTimeSeriesUntil("/tmp/timeseries_test/restore/series", "/tmp/timeseries_test/restore/pitr", until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Newest() != until - 1 {
+		t.Errorf("Newest was %d", r.Newest())
+	}
+	if sel := r.SelectSeries("cpu", nil); len(sel) != 0 {
+		t.Errorf("Restored labeled series %v", sel)
+	}
+	rollups, _, err := r.Rollups(startTime + 240, startTime + 400, MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := rollups["web1"]; len(w) != 3 || w[0].Count != 60 || w[1].Count != 0 || w[2].Count != 0 {
+		t.Errorf("Rollups were %+v", w)
+	}
+
+	// appending carries on from until, rolling up its minute again
+	for i := int64(250); i < 301; i++ {
+		r.AddValues(map[string]float64{ "web1": float64(i), "requests": float64(i - 100) }, startTime + i)
+	}
+	rollups, _, err = r.Rollups(startTime + 300, startTime + 301, MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := rollups["web1"]; len(w) != 1 || w[0].Count != 60 || w[0].Total != (240 + 299) * 30 {
+		t.Errorf("Regenerated rollup was %+v", w)
+	}
+	vals, _, err := r.Values(startTime + 249, startTime + 251, SECOND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := vals["requests"]; len(v) != 2 || v[0] != 248 || v[1] != 249 {
+		t.Errorf("Counter carried on as %v", v)
+	}
+	if _, err = RestoreTimeSeriesUntil("/tmp/timeseries_test/restore/nothing", "/tmp/timeseries_test/restore/pitr2", until); err == nil {
+		t.Error("Restored from nothing")
+	}
+}
+
+func TestMirroredTimeSeries(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/mirror")
+	os.MkdirAll("/tmp/timeseries_test/mirror", os.ModePerm)
+	dirs := []string{ "/tmp/timeseries_test/mirror/a", "/tmp/timeseries_test/mirror/b" }
+	m, err := NewMirroredTimeSeries(dirs, TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: MINUTE, Retention: DAY},
+			{Resolution: SECOND, Retention: HOUR},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560628800)
+	for i := int64(0); i < 100; i++ {
+		if err = m.AddValues(map[string]float64{ "web1": float64(i) }, startTime + i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m, err = OpenMirroredTimeSeries(dirs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ts := range m.Targets() {
+		if vals, _ := ts.Latest(); vals["web1"] != 99 {
+			t.Errorf("Mirror %d latest was %v", i, vals)
+		}
+	}
+
+	// losing the first copy leaves the second serving queries
+	m.AddValue("web1", 100, startTime + 100)
+	os.RemoveAll(dirs[0])
+	err = m.Write()
+	var merr *MirrorError
+	if !errors.As(err, &merr) || len(merr.Errs) != 2 || merr.Errs[0] == nil || merr.Errs[1] != nil {
+		t.Fatalf("Write gave %v", err)
+	}
+	if !errors.Is(err, os.ErrNotExist) || !strings.HasPrefix(err.Error(), "1 of 2 mirrors failed: mirror 0:") {
+		t.Errorf("Error was %v", err)
+	}
+	if f := m.Failed(); !f[0] || f[1] || m.Reader() != m.Targets()[1] {
+		t.Errorf("Failed was %v", f)
+	}
+	res, err := m.Query(startTime, startTime + 101, SECOND, AGGREGATE_AVERAGE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := res.Values["web1"]; len(v) != 101 || v[100] != 100 {
+		t.Errorf("Query gave %v", v)
+	}
+	m.Close()
+	ts, err := OpenTimeSeries(dirs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, newest := ts.Latest(); newest != startTime + 100 {
+		t.Errorf("Second copy's newest was %d", newest)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/replay")
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+	config := TimeSeriesConfig{
+		Archives: []ArchiveConfig{ {Resolution: SECOND, Retention: HOUR} },
+		ChangeLog: true,
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/replay", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560628800)
+	key, _ := SeriesKey("cpu", Labels{ "host": "a" })
+	changes := []Change{
+		{ Offset: 0, Timestamp: startTime, Values: map[string]float64{ key: 1 } },
+		{ Offset: 1, Timestamp: startTime + 1, Values: map[string]float64{ key: 2 } },
+	}
+	if err = ts.Replay(changes); err != nil {
+		t.Fatal(err)
+	}
+	// replaying again skips what's applied
+	if err = ts.Replay(changes); err != nil || ts.ChangeLog().NextOffset() != 2 {
+		t.Errorf("Replaying again gave %v, next offset %d", err, ts.ChangeLog().NextOffset())
+	}
+	if keys := ts.SelectSeries("cpu", nil); len(keys) != 1 || keys[0] != key {
+		t.Errorf("Replayed keys indexed as %v", keys)
+	}
+	if vals, newest := ts.Latest(); newest != startTime + 1 || vals[key] != 2 {
+		t.Errorf("Latest was %v at %d", vals, newest)
+	}
+	if err = ts.Replay([]Change{ { Offset: 5, Timestamp: startTime + 5 } }); err == nil {
+		t.Errorf("Replayed a change past the next offset")
+	}
+	if err = ts.Replay([]Change{ { Offset: 2, Timestamp: startTime } }); err == nil {
+		t.Errorf("Replayed a change older than the latest data")
+	}
+}
+
+func TestReplaySameTick(t *testing.T) {
+	config := TimeSeriesConfig{
+		Archives: []ArchiveConfig{ {Resolution: 10, Retention: HOUR}, {Resolution: MINUTE, Retention: DAY} },
+		ChangeLog: true,
+	}
+	dirs := []string{ "/tmp/timeseries_test/replay_primary", "/tmp/timeseries_test/replay_standby" }
+	var series []*TimeSeries
+	for _, dir := range dirs {
+		os.RemoveAll(dir)
+		ts, err := NewTimeSeries(dir, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ts.Close()
+		series = append(series, ts)
+	}
+	primary, standby := series[0], series[1]
+	startTime := int64(1560628800)
+	for i := int64(0); i < 30; i++ {
+		// two appends in each tick, the later overwriting the earlier
+		primary.AddValue("a", float64(i), startTime + i * 10 + 3)
+		primary.AddValue("a", float64(i) + 0.5, startTime + i * 10 + 7)
+	}
+	primary.Write()
+	changes, err := primary.ChangeLog().Read(0, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 60 {
+		t.Errorf("Logged %d changes, not 60", len(changes))
+	}
+	if err = standby.Replay(changes); err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range []int64{ 10, MINUTE } {
+		want, err := primary.Query(startTime, startTime + 300, res, AGGREGATE_AVERAGE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := standby.Query(startTime, startTime + 300, res, AGGREGATE_AVERAGE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got.Values) != fmt.Sprint(want.Values) {
+			t.Errorf("At %d, replayed %v, not %v", res, got.Values, want.Values)
+		}
+	}
+}
+
+func TestReplica(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/replica")
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+	ts, err := NewTimeSeries("/tmp/timeseries_test/replica", TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: HOUR},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+		ChangeLog: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560628800)
+	for i := int64(0); i < 30; i++ {
+		ts.AddValue("a", float64(i), startTime + i)
+	}
+	ts.Write()
+
+	replica, err := OpenTimeSeriesReplica("/tmp/timeseries_test/replica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !replica.ReadOnly() || ts.ReadOnly() {
+		t.Errorf("Expected only the replica read-only")
+	}
+	if _, newest := replica.Latest(); newest != startTime + 29 {
+		t.Errorf("Replica's newest was %d", newest)
+	}
+	for _, err := range []error{
+		replica.AddValue("a", 1, startTime + 30),
+		replica.AddLabeledValues([]LabeledValue{ { Name: "b", Value: 1 } }, startTime + 30),
+		replica.SetMetricType("a", METRIC_COUNTER),
+		replica.Write(),
+		replica.Compact(),
+	} {
+		if !errors.Is(err, ErrReadOnly) {
+			t.Errorf("Expected ErrReadOnly, got %v", err)
+		}
+	}
+
+	// the writer's appends show up once written and refreshed
+	for i := int64(30); i < 90; i++ {
+		ts.AddLabeledValues([]LabeledValue{ { Name: "b", Labels: Labels{ "host": "x" }, Value: float64(i) } }, startTime + i)
+		ts.AddValue("a", float64(i), startTime + i)
+	}
+	ts.SetMetricType("a", METRIC_COUNTER)
+	if err = replica.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if _, newest := replica.Latest(); newest != startTime + 29 {
+		t.Errorf("Replica saw unwritten data, up to %d", newest)
+	}
+	ts.Write()
+	if err = replica.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if _, newest := replica.Latest(); newest != startTime + 89 {
+		t.Errorf("Refreshed replica's newest was %d", newest)
+	}
+	want, _ := ts.Query(startTime, startTime + 90, MINUTE, AGGREGATE_AVERAGE)
+	got, err := replica.Query(startTime, startTime + 90, MINUTE, AGGREGATE_AVERAGE)
+	if err != nil || fmt.Sprint(got.Values) != fmt.Sprint(want.Values) {
+		t.Errorf("Replica had %v, %v, not %v", got, err, want.Values)
+	}
+	if keys := replica.SelectSeries("b", Labels{ "host": "x" }); len(keys) != 1 {
+		t.Errorf("Refreshed replica selected %v", keys)
+	}
+	if replica.MetricType("a") != METRIC_COUNTER {
+		t.Errorf("Refreshed replica didn't see the metric type")
+	}
+	if err = ts.Refresh(); err == nil {
+		t.Errorf("Refreshed a writable series")
+	}
+}
+
+func TestRouter(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/router")
+	os.MkdirAll("/tmp/timeseries_test/router", os.ModePerm)
+	config := func() TimeSeriesConfig {
+		return TimeSeriesConfig{ Archives: []ArchiveConfig{ {Resolution: SECOND, Retention: HOUR} } }
+	}
+	r := &Router{}
+	if err := r.AddValue("a", 1, 0); err == nil {
+		t.Errorf("Added to a router without stores")
+	}
+	for i := 0; i < 3; i++ {
+		ts, err := NewTimeSeries(fmt.Sprintf("/tmp/timeseries_test/router/%d", i), config())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = r.Add(fmt.Sprintf("store-%d", i), ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Add("store-0", nil); err == nil {
+		t.Errorf("Added a store twice")
+	}
+
+	startTime := int64(1560628800)
+	keys := make([]string, 300)
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	vals := make(map[string]float64)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("host-%d", i)
+		owners[keys[i]] = r.Owner(keys[i])
+		counts[owners[keys[i]]]++
+		vals[keys[i]] = float64(i)
+	}
+	for name, n := range counts {
+		if n < 50 {
+			t.Errorf("%s owns only %d of %d keys", name, n, len(keys))
+		}
+	}
+	if err := r.AddValues(vals, startTime); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys[:5] {
+		latest, _ := r.Store(owners[k]).(*TimeSeries).Latest()
+		if _, ok := latest[k]; !ok {
+			t.Errorf("%s isn't in its owner, %s", k, owners[k])
+		}
+	}
+
+	// adding a store only moves keys to it
+	db, err := NewDB("/tmp/timeseries_test/router/db", config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Add("store-3", DBStore(db, "hosts"))
+	moved := 0
+	for _, k := range keys {
+		if o := r.Owner(k); o != owners[k] {
+			moved++
+			if o != "store-3" {
+				t.Errorf("%s moved from %s to %s", k, owners[k], o)
+			}
+		}
+	}
+	if moved == 0 || moved > len(keys) / 2 {
+		t.Errorf("Adding a store moved %d of %d keys", moved, len(keys))
+	}
+
+	// moved keys are appended to their new owner, and their old data
+	// is still found
+	for k := range vals {
+		vals[k] += 1000
+	}
+	if err = r.AddValues(vals, startTime + 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Write(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := r.Query(startTime, startTime + 3, SECOND, AGGREGATE_AVERAGE, QueryOptions{ Fill: FILL_NAN })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Values) != len(keys) || len(res.Timestamps) != 3 {
+		t.Fatalf("Query returned %d keys, %d timestamps", len(res.Values), len(res.Timestamps))
+	}
+	for i, k := range keys {
+		v := res.Values[k]
+		if v[0] != float64(i) || v[1] != float64(i + 1000) || !res.Missing[k][2] {
+			t.Errorf("%s was %v", k, v)
+		}
+	}
+	res, err = r.Query(startTime, startTime + 2, SECOND, AGGREGATE_AVERAGE,
+		QueryOptions{ Keys: Keys("host-1", "host-2"), Limit: 1 })
+	if err != nil || len(res.Values) != 1 {
+		t.Errorf("Limited query returned %v, %v", res.Values, err)
+	}
+
+	if err = r.Remove("store-1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys {
+		if o := r.Owner(k); o == "store-1" || (owners[k] != "store-1" && o != owners[k] && o != "store-3") {
+			t.Errorf("%s went from %s to %s", k, owners[k], o)
+		}
+	}
+	if names := r.Names(); fmt.Sprint(names) != "[store-0 store-2 store-3]" {
+		t.Errorf("Names were %v", names)
+	}
+}
+
+type memChunkStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (m *memChunkStore) Get(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.objects[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	return data, nil
+}
+
+func (m *memChunkStore) Put(name string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[name] = data
+	return nil
+}
+
+func (m *memChunkStore) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, name)
+	return nil
+}
+
+func TestChunkStore(t *testing.T) {
+	os.RemoveAll("/tmp/timeseries_test/chunkstore")
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+	store := &memChunkStore{ objects: make(map[string][]byte) }
+	RegisterChunkStore("mem", store)
+	config := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: 3000, Store: "mem"},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	if _, err := NewTimeSeries("/tmp/timeseries_test/chunkstore", TimeSeriesConfig{
+		Archives: []ArchiveConfig{ {Resolution: SECOND, Retention: HOUR, Store: "none"} },
+	}); err == nil {
+		t.Errorf("Created a series with an unregistered store")
+	}
+	ts, err := NewTimeSeries("/tmp/timeseries_test/chunkstore", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := ts.Config().StorePrefix
+	if prefix == "" {
+		t.Fatal("No store prefix chosen")
+	}
+	startTime := int64(1560628800)
+	for i := int64(0); i < 6000; i++ {
+		ts.AddValue("a", float64(i), startTime + i)
+		if i % 1000 == 999 {
+			ts.Write()
+		}
+	}
+	ts.Close()
+
+	// chunks are in the store, not the archive's directory, and
+	// retention deletes them there
+	files, _ := os.ReadDir("/tmp/timeseries_test/chunkstore/1")
+	for _, f := range files {
+		if f.Name() != "archive" && f.Name() != "archive.prev" {
+			t.Errorf("Found %s on disk", f.Name())
+		}
+	}
+	if _, ok := store.objects[fmt.Sprintf("%s/1/%d", prefix, startTime - startTime % 2000)]; ok {
+		t.Errorf("Expired chunk still in the store: %v", store.objects)
+	}
+	if len(store.objects) == 0 {
+		t.Fatal("Nothing in the store")
+	}
+
+	ts, err = OpenTimeSeries("/tmp/timeseries_test/chunkstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := ts.Query(startTime + 4000, startTime + 6000, SECOND, AGGREGATE_AVERAGE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := res.Values["a"]; v[0] != 4000 || v[1999] != 5999 {
+		t.Errorf("Values were %v ... %v", v[:3], v[len(v) - 3:])
+	}
+	if err = ts.Rechunk(1000); err == nil {
+		t.Errorf("Rechunked an archive in a store")
+	}
+	ts.Close()
+
+	// the store failing is an error, not a gap
+	store.mu.Lock()
+	saved := store.objects
+	store.objects = map[string][]byte{}
+	store.mu.Unlock()
+	RegisterChunkStore("mem", failingStore{})
+	ts, err = OpenTimeSeries("/tmp/timeseries_test/chunkstore")
+	if err == nil {
+		_, err = ts.Query(startTime + 4000, startTime + 5000, SECOND, AGGREGATE_AVERAGE)
+	}
+	if err == nil || !strings.Contains(err.Error(), "unreachable") {
+		t.Errorf("Failing store gave %v", err)
+	}
+	store.objects = saved
+}
+
+type failingStore struct{}
+
+func (failingStore) Get(name string) ([]byte, error) { return nil, fmt.Errorf("store unreachable") }
+func (failingStore) Put(name string, data []byte) error { return fmt.Errorf("store unreachable") }
+func (failingStore) Delete(name string) error { return fmt.Errorf("store unreachable") }
+
+func TestInMemory(t *testing.T) {
+	before, _ := os.ReadDir(".")
+	config := TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: 3000},
+			{Resolution: MINUTE, Retention: DAY},
+		},
+	}
+	ts, err := NewTimeSeries("", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ts.InMemory() {
+		t.Errorf("Series isn't in memory")
+	}
+	if err = ts.SetMetricType("requests", METRIC_COUNTER); err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560628800)
+	for i := int64(0); i < 6000; i++ {
+		ts.AddValues(map[string]float64{ "a": float64(i), "requests": float64(i % 100) }, startTime + i)
+		ts.AddLabeledValues([]LabeledValue{ {Name: "cpu", Labels: Labels{ "host": "a" }, Value: 1} }, startTime + i)
+		if i % 1000 == 999 {
+			if err = ts.Write(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err = ts.Compact(); err != nil {
+		t.Error(err)
+	}
+
+	res, err := ts.Query(startTime + 4000, startTime + 6000, SECOND, AGGREGATE_AVERAGE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := res.Values["a"]; v[0] != 4000 || v[1999] != 5999 {
+		t.Errorf("Values were %v ... %v", v[:3], v[len(v) - 3:])
+	}
+	// 99 is lost at each reset
+	if v := res.Values["requests"]; v[1999] != 5940 {
+		t.Errorf("Counter was %v", v[1999])
+	}
+	// past retention
+	start, _, _ := ts.TimeRange(SECOND)
+	if start != startTime + 3200 {
+		t.Errorf("Second archive starts at %d", start - startTime)
+	}
+	avgs, _, err := ts.Averages(startTime, startTime + 6000, MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := avgs["a"]; v[1] != 29.5 || v[len(v) - 1] != 5909.5 {
+		t.Errorf("Minutes were %v ... %v", v[:2], v[len(v) - 2:])
+	}
+	if keys := ts.SelectSeries("cpu", nil); len(keys) != 1 {
+		t.Errorf("Indexed %v", keys)
+	}
+
+	if _, err = ts.Backup("/tmp/timeseries_test/memory_backup", ""); err == nil {
+		t.Errorf("Backed up an in-memory series")
+	}
+	if err = ts.Rechunk(1000); err == nil {
+		t.Errorf("Rechunked an in-memory series")
+	}
+	config.ChangeLog = true
+	if _, err = NewTimeSeries("", config); err == nil {
+		t.Errorf("Created an in-memory series with a change log")
+	}
+	after, _ := os.ReadDir(".")
+	if len(after) != len(before) {
+		t.Errorf("In-memory series wrote files: %d entries became %d", len(before), len(after))
+	}
+}
+
+func TestLock(t *testing.T) {
+	dir := "/tmp/timeseries_test/lock"
+	os.RemoveAll(dir)
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+	config := TimeSeriesConfig{ Archives: []ArchiveConfig{ {Resolution: SECOND, Retention: HOUR} } }
+	ts, err := NewTimeSeries(dir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.AddValue("a", 1, 1560628800)
+	ts.Write()
+
+	// nor can it be opened for writing twice in one process
+	if _, err := OpenTimeSeries(dir); !errors.Is(err, ErrLocked) {
+		t.Errorf("Opened an open series: %v", err)
+	}
+	replica, err := OpenTimeSeriesReplica(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := replica.Latest(); v["a"] != 1 {
+		t.Errorf("Replica had %v", v)
+	}
+	ts.lock.release(true)
+
+	// another process, as far as flock is concerned
+	f, err := os.OpenFile(dir + "/" + lockFile, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = internal.LockFile(f); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenTimeSeries(dir); !errors.Is(err, ErrLocked) {
+		t.Errorf("Opened a locked series: %v", err)
+	}
+	if _, err = NewTimeSeries(dir, config); !errors.Is(err, ErrLocked) {
+		t.Errorf("Created a series over a locked one: %v", err)
+	}
+	replica, err = OpenTimeSeriesReplica(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := replica.Latest(); v["a"] != 1 {
+		t.Errorf("Replica had %v", v)
+	}
+	f.Close()
+
+	ts, err = OpenTimeSeries(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _ = os.OpenFile(dir + "/" + lockFile, os.O_RDWR, 0600)
+	if err = internal.LockFile(f); !errors.Is(err, ErrLocked) {
+		t.Errorf("Locked an open series: %v", err)
+	}
+	f.Close()
+	ts.lock.release(true)
+
+	// the lock isn't backed up
+	os.RemoveAll("/tmp/timeseries_test/lock_backup")
+	if _, err = ts.Backup("/tmp/timeseries_test/lock_backup", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat("/tmp/timeseries_test/lock_backup/" + lockFile); err == nil {
+		t.Errorf("Backed up the lock")
+	}
+}
+
+func TestConcurrentUse(t *testing.T) {
+	dir := "/tmp/timeseries_test/concurrent"
+	os.RemoveAll(dir)
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+	ts, err := NewTimeSeries(dir, TimeSeriesConfig{
+		Archives: []ArchiveConfig{
+			{Resolution: SECOND, Retention: 3000},
+			{Resolution: MINUTE, Retention: DAY, Percentiles: true},
+			{Resolution: HOUR, Retention: 30 * DAY, Percentiles: true},
+		},
+		CacheSize: 1 << 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.SetMetricType("requests", METRIC_COUNTER)
+	ts.AddRecordingRule("double", "a * 2")
+	var seen sync.Map
+	cancel := ts.Subscribe(Keys("a"), func(timestamp int64, vals map[string]float64) {
+		seen.Store(timestamp, vals["a"])
+	})
+	defer cancel()
+
+	startTime := int64(1560628800)
+	const n = 6000
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	// appenders, each with its own keys, taking turns over timestamps
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := int64(w); i < n; i += 4 {
+				ts.AddValues(map[string]float64{ "a": float64(i), "requests": float64(i) }, startTime + i)
+				ts.AddLabeledValues([]LabeledValue{
+					{Name: "cpu", Labels: Labels{ "host": fmt.Sprint(w) }, Value: float64(i)},
+				}, startTime + i)
+			}
+		}(w)
+	}
+	// readers and maintenance, until the appenders are done
+	background := []func(){
+		func() { ts.Write(); ts.LastWriteTime() },
+		func() { ts.Compact() },
+		func() { ts.Query(startTime, startTime + n, SECOND, AGGREGATE_AVERAGE) },
+		func() { ts.Query(startTime, startTime + n, MINUTE, AGGREGATE_MAX, QueryOptions{ Fill: FILL_PREVIOUS }) },
+		func() { ts.Percentiles(startTime, startTime + n, MINUTE, 0.9) },
+		func() { ts.Latest(); ts.Keys(); ts.TimeRange(MINUTE); ts.LatestFor("a") },
+		func() { ts.SelectSeries("cpu", nil); ts.MetricType("requests") },
+		func() { ts.Export(io.Discard) },
+	}
+	var bg sync.WaitGroup
+	for _, fn := range background {
+		bg.Add(1)
+		go func(fn func()) {
+			defer bg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(time.Millisecond):
+					fn()
+				}
+			}
+		}(fn)
+	}
+	wg.Wait()
+	close(done)
+	bg.Wait()
+	if err = ts.Write(); err != nil {
+		t.Fatal(err)
+	}
+	if ts.LastWriteTime() == 0 {
+		t.Errorf("No write time")
+	}
+
+	// appends racing for the same tick may land out of order, and
+	// older ones are dropped, but everything kept is consistent
+	res, err := ts.Query(startTime + n - 1000, startTime + n, SECOND, AGGREGATE_AVERAGE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := 0
+	for i, v := range res.Values["a"] {
+		if res.Missing["a"][i] {
+			continue
+		}
+		kept++
+		if d := res.Values["double"][i]; d != 2 * v {
+			t.Errorf("double was %v for %v", d, v)
+			break
+		}
+	}
+	if kept == 0 {
+		t.Errorf("Nothing kept: %v", res.Values["a"][:10])
+	}
+	if keys := ts.SelectSeries("cpu", nil); len(keys) != 4 {
+		t.Errorf("Indexed %v", keys)
+	}
+	count := 0
+	seen.Range(func(k, v interface{}) bool { count++; return true })
+	if count == 0 {
+		t.Errorf("Subscriber saw nothing")
+	}
+}
+
+func TestAutoFlush(t *testing.T) {
+	dir := "/tmp/timeseries_test/flush"
+	os.RemoveAll(dir)
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+	ts, err := NewTimeSeries(dir, TimeSeriesConfig{
+		Archives: []ArchiveConfig{ {Resolution: SECOND, Retention: HOUR} },
+		MaxUnflushedPoints: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// what another process would see
+	written := func() float64 {
+		r, err := OpenTimeSeriesReplica(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, _ := r.Latest()
+		return v["a"]
+	}
+	waitFor := func(want float64) {
+		t.Helper()
+		for i := 0; i < 200 && written() != want; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := written(); got != want {
+			t.Errorf("Written up to %v, not %v", got, want)
+		}
+	}
+	startTime := int64(1560628800)
+	for i := int64(0); i < 50; i++ {
+		ts.AddValue("a", float64(i), startTime + i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if ts.LastWriteTime() != 0 {
+		t.Errorf("Flushed early")
+	}
+	for i := int64(50); i < 100; i++ {
+		ts.AddValue("a", float64(i), startTime + i)
+	}
+	waitFor(99)
+	for i := int64(100); i < 120; i++ {
+		ts.AddValue("a", float64(i), startTime + i)
+	}
+	if err = ts.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := written(); got != 119 {
+		t.Errorf("Close wrote up to %v", got)
+	}
+	if err = ts.Close(); err != nil {
+		t.Errorf("Closing again: %v", err)
+	}
+
+	// reopened, the flusher starts again
+	ts, err = OpenTimeSeries(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.flusher == nil {
+		t.Errorf("No flusher once reopened")
+	}
+	ts.Close()
+
+	// flushing on a timer
+	config := ts.Config()
+	config.FlushInterval, config.MaxUnflushedPoints = 1, 0
+	os.RemoveAll(dir)
+	if ts, err = NewTimeSeries(dir, config); err != nil {
+		t.Fatal(err)
+	}
+	ts.AddValue("a", 7, startTime)
+	waitFor(7)
+	ts.Close()
+}
+
+func TestClose(t *testing.T) {
+	dir := "/tmp/timeseries_test/close"
+	os.RemoveAll(dir)
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+	ts, err := NewTimeSeries(dir, TimeSeriesConfig{
+		Archives: []ArchiveConfig{ {Resolution: SECOND, Retention: HOUR} },
+		ChangeLog: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560628800)
+	ts.AddValue("a", 1, startTime)
+	if err = ts.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ts, err = OpenTimeSeries(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.UncleanShutdown() {
+		t.Errorf("Closed series reported an unclean shutdown")
+	}
+	if v, _ := ts.Latest(); v["a"] != 1 {
+		t.Errorf("Close didn't write: %v", v)
+	}
+	if next := ts.ChangeLog().NextOffset(); next != 1 {
+		t.Errorf("Change log is at %d", next)
+	}
+	ts.AddValue("a", 2, startTime + 1)
+	ts.Write()
+	ts.AddValue("a", 3, startTime + 2)
+
+	// the process dies
+	ts.lock.file.Close()
+
+	ts, err = OpenTimeSeries(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ts.UncleanShutdown() {
+		t.Errorf("Crash wasn't noticed")
+	}
+	if v, _ := ts.Latest(); v["a"] != 2 {
+		t.Errorf("After the crash, had %v", v)
+	}
+	if err = ts.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = ts.Close(); err != nil {
+		t.Errorf("Closing again: %v", err)
+	}
+	if err = ts.AddValue("a", 4, startTime + 3); !errors.Is(err, ErrClosed) {
+		t.Errorf("Append after Close gave %v", err)
+	}
+	if err = ts.Write(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Write after Close gave %v", err)
+	}
+
+	// another process holding it is named
+	f, _ := os.OpenFile(dir + "/" + lockFile, os.O_RDWR, 0600)
+	defer f.Close()
+	if err = internal.LockFile(f); err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("12345")
+	if _, err = OpenTimeSeries(dir); !errors.Is(err, ErrLocked) || !strings.Contains(err.Error(), "12345") {
+		t.Errorf("Opening a locked series gave %v", err)
+	}
+	f.Truncate(0)
+	f.Close()
+
+	ts, err = OpenTimeSeries(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.UncleanShutdown() {
+		t.Errorf("Unclean after closing")
+	}
+	ts.Close()
+}
+
+func TestCloseDB(t *testing.T) {
+	dir := "/tmp/timeseries_test/close_db"
+	os.RemoveAll(dir)
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+	config := TimeSeriesConfig{ Archives: []ArchiveConfig{ {Resolution: SECOND, Retention: HOUR} } }
+	db, err := NewDB(dir + "/db", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns, err := db.CreateNamespace("acme", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := int64(1560628800)
+	db.AddValues("cpu", map[string]float64{ "a": 1 }, startTime)
+	ns.AddValues("cpu", map[string]float64{ "a": 2 }, startTime)
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB(dir + "/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns, err = db.Namespace("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, set := range []*seriesSet{ db.seriesSet, ns.seriesSet } {
+		ts, err := set.Series("cpu")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ts.UncleanShutdown() {
+			t.Errorf("Series %d reported an unclean shutdown", i)
+		}
+		if v, _ := ts.Latest(); v["a"] != float64(i + 1) {
+			t.Errorf("Series %d had %v", i, v)
+		}
+	}
+
+	// deleting a series closes it
+	ts, _ := db.Series("cpu")
+	if err = db.DeleteSeries("cpu"); err != nil {
+		t.Fatal(err)
+	}
+	if err = ts.AddValue("a", 3, startTime + 1); !errors.Is(err, ErrClosed) {
+		t.Errorf("Append to a deleted series gave %v", err)
+	}
+	ts, _ = ns.Series("cpu")
+	if err = db.DeleteNamespace("acme"); err != nil {
+		t.Fatal(err)
+	}
+	if err = ts.Write(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Write to a deleted namespace's series gave %v", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ss, err := NewShardedSeries(dir + "/sharded", config, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss.AddValues(map[string]float64{ "a": 1, "b": 2 }, startTime)
+	if err = ss.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ss, err = OpenShardedSeries(dir + "/sharded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ts := range ss.Shards() {
+		if ts.UncleanShutdown() {
+			t.Errorf("Shard %d reported an unclean shutdown", i)
+		}
+	}
+	if v, _ := ss.Latest(); v["a"] != 1 || v["b"] != 2 {
+		t.Errorf("Sharded series had %v", v)
+	}
+	ss.Close()
+}
+
+func TestWriteBuffer(t *testing.T) {
+	dir := "/tmp/timeseries_test/buffer"
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+	startTime := int64(1560628800)
+	for _, tc := range []struct{
+		config  TimeSeriesConfig
+		appends int64
+		written bool
+	}{
+		{ TimeSeriesConfig{ MaxUnflushedTicks: 100 }, 99, false },
+		{ TimeSeriesConfig{ MaxUnflushedTicks: 100 }, 100, true },
+		{ TimeSeriesConfig{ MaxUnflushedAge: 1 }, 10, true },
+	} {
+		os.RemoveAll(dir)
+		tc.config.Archives = []ArchiveConfig{ {Resolution: SECOND, Retention: HOUR} }
+		ts, err := NewTimeSeries(dir, tc.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := int64(0); i < tc.appends; i++ {
+			ts.AddValue("a", float64(i), startTime + i)
+		}
+		// long enough for the age to pass
+		var written bool
+		for i := 0; i < 150 && !written; i++ {
+			time.Sleep(10 * time.Millisecond)
+			written = ts.LastWriteTime() != 0
+		}
+		if written != tc.written {
+			t.Errorf("%+v: written %v after %d appends", tc.config, written, tc.appends)
+		}
+		if tc.written {
+			r, _ := OpenTimeSeriesReplica(dir)
+			if v, _ := r.Latest(); v["a"] != float64(tc.appends - 1) {
+				t.Errorf("%+v: wrote %v", tc.config, v)
+			}
+		}
+		ts.Close()
+	}
+
+	// an idle series isn't written again
+	os.RemoveAll(dir)
+	ts, err := NewTimeSeries(dir, TimeSeriesConfig{
+		Archives: []ArchiveConfig{ {Resolution: SECOND, Retention: HOUR} },
+		MaxUnflushedAge: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	ts.AddValue("a", 1, startTime)
+	ts.Write()
+	ts.LastWritten = 0
+	time.Sleep(1200 * time.Millisecond)
+	if ts.LastWriteTime() != 0 {
+		t.Errorf("Idle series was written")
+	}
+}
+
+func TestDeleteSeriesWhileAppending(t *testing.T) {
+	dir := "/tmp/timeseries_test/db_delete"
+	os.RemoveAll(dir)
+	os.MkdirAll("/tmp/timeseries_test", os.ModePerm)
+	db, err := NewDB(dir, TimeSeriesConfig{ Archives: []ArchiveConfig{ {Resolution: SECOND, Retention: HOUR} } })
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns, err := db.CreateNamespace("tenant", db.defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.SetQuota(Quota{ MaxKeys: 100 }); err != nil {
+		t.Fatal(err)
+	}
+
+	// so the two interleave even on one CPU
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	startTime := int64(1560628800)
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		var appending, deleting sync.WaitGroup
+		done := make(chan struct{})
+		for _, set := range []*seriesSet{ db.seriesSet, ns.seriesSet } {
+			appending.Add(1)
+			go func(set *seriesSet) {
+				defer appending.Done()
+				for i := int64(0); i < 2000; i++ {
+					// may land in a series being deleted
+					set.AddValues("a", map[string]float64{ "x": float64(i) }, startTime + i)
+				}
+			}(set)
+			deleting.Add(1)
+			go func(set *seriesSet) {
+				defer deleting.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+						set.DeleteSeries("a")
+					}
+				}
+			}(set)
+		}
+		appending.Wait()
+		close(done)
+		deleting.Wait()
+	}()
+	select {
+	case <-finished:
+	case <-time.After(30 * time.Second):
+		t.Fatal("Deadlocked deleting a series while appending to it")
+	}
+}
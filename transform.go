@@ -0,0 +1,90 @@
+package tissa
+// Copyright (c) 2019 Fred Lewis. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"math"
+)
+
+//
+// A transform of a series, applied in place to query results after
+// gaps are filled.  See QueryOptions.Transforms.
+//
+type Transform func(v []float64)
+
+//
+// The mean of each value and the n - 1 before it, smoothing out
+// noise over n intervals.  NaNs are left out of the mean, which is
+// NaN only if the whole window is.  n below 1 counts as 1.
+//
+func MovingAverage(n int) Transform {
+	if n < 1 {
+		n = 1
+	}
+	return func(v []float64) {
+		window := make([]float64, n)
+		total, count := 0.0, 0
+		for i := range v {
+			if i >= n {
+				if old := window[i % n]; !math.IsNaN(old) {
+					total -= old
+					count--
+				}
+			}
+			window[i % n] = v[i]
+			if !math.IsNaN(v[i]) {
+				total += v[i]
+				count++
+			}
+			if count > 0 {
+				v[i] = total / float64(count)
+			} else {
+				v[i] = math.NaN()
+			}
+		}
+	}
+}
+
+//
+// An exponentially weighted moving average: each value becomes
+// alpha times itself plus 1 - alpha times the previous average,
+// starting from the first value.  Smaller alphas smooth more.  NaNs
+// stay NaN and don't affect the average.  An alpha outside (0, 1]
+// counts as 1, leaving values as they are.
+//
+func EWMA(alpha float64) Transform {
+	if !(alpha > 0 && alpha <= 1) {
+		alpha = 1
+	}
+	return func(v []float64) {
+		avg := math.NaN()
+		for i := range v {
+			if math.IsNaN(v[i]) {
+				continue
+			}
+			if math.IsNaN(avg) {
+				avg = v[i]
+			} else {
+				avg = alpha * v[i] + (1 - alpha) * avg
+			}
+			v[i] = avg
+		}
+	}
+}
+
+func applyTransforms(vals map[string][]float64, transforms []Transform) {
+	for _, tr := range transforms {
+		for _, v := range vals {
+			tr(v)
+		}
+	}
+}
+
+//
+// Apply transforms to every series in the result, in order.
+// Missing is unchanged.
+//
+func (r *Result) Transform(transforms ...Transform) {
+	applyTransforms(r.Values, transforms)
+}